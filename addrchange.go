@@ -0,0 +1,128 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// AddressChangeConfig holds configurations of the reactions to the changes of
+// the external address of the overlay, e.g. when the NAT of the site gets a
+// new public IP. Beyond MaxChanges changes within Window seconds, the address
+// is flapping and the reactions are suspended until it settles.
+type AddressChangeConfig struct {
+	MaxChanges int `json:"max-changes"`
+	Window     int `json:"window"` // in seconds
+}
+
+// DefaultAddressChangeConfig returns default configurations of the reactions
+// to the address changes.
+func DefaultAddressChangeConfig() AddressChangeConfig {
+	return AddressChangeConfig{
+		MaxChanges: 3,
+		Window:     600,
+	}
+}
+
+// AddressHistory is the current and the previous external addresses of the
+// overlay.
+type AddressHistory struct {
+	Current  string    `json:"current,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	Changed  time.Time `json:"changed,omitempty"`
+	Changes  int       `json:"changes"` // since the start of the agent
+	Flapping bool      `json:"flapping"`
+}
+
+// addressChanges is the record of the changes of the external address.
+type addressChanges struct {
+	previous *net.UDPAddr
+	changed  time.Time
+	total    int
+	recent   []time.Time // within the window
+	flapping bool
+}
+
+// add records a change at given time, and returns true if the address is
+// flapping according to given configurations.
+func (c *addressChanges) add(cfg AddressChangeConfig, now time.Time) bool {
+	c.changed = now
+	c.total++
+	window := time.Duration(cfg.Window) * time.Second
+	recent := c.recent[:0]
+	for _, t := range c.recent {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	c.recent = append(recent, now)
+	c.flapping = cfg.MaxChanges > 0 && len(c.recent) > cfg.MaxChanges
+	return c.flapping
+}
+
+// setExternalAddr records given external address mapped by the primary
+// server. If it differs from the known one, e.g. after the connection of the
+// site bounced, the overlay binds again when rebind is true, which registers
+// the new address and refreshes the session table, and AddressChanged is
+// called; unless the address is flapping.
+func (overlay *OverlayConn) setExternalAddr(addr *net.UDPAddr, rebind bool) {
+	overlay.Lock()
+	old := overlay.externalAddr
+	overlay.externalAddr = addr
+	if old == nil || addr == nil || (old.IP.Equal(addr.IP) && old.Port == addr.Port) {
+		overlay.Unlock()
+		return
+	}
+	overlay.addrChanges.previous = old
+	flapping := overlay.addrChanges.add(overlay.Config.AddressChange, time.Now())
+	if !flapping && rebind {
+		// the listening state re-binds once the channel has expired
+		overlay.channelExpired = time.Now()
+	}
+	changed := overlay.AddressChanged
+	overlay.Unlock()
+
+	metrics.Inc("overlay.address_changes")
+	overlay.Events.Add(AgentEvent{Type: EventAddressChanged, From: old.String(), To: addr.String()})
+	if flapping {
+		metrics.Inc("overlay.address_flaps")
+		log.Printf("WARNING: external address changed %s -> %s more than %d times in %ds, not reacting until it settles",
+			old, addr, overlay.Config.AddressChange.MaxChanges, overlay.Config.AddressChange.Window)
+		return
+	}
+	log.Printf("external address changed %s -> %s, registering again", old, addr)
+	if changed != nil {
+		go changed(old, addr)
+	}
+}
+
+// AddressHistory returns the current and the previous external addresses.
+func (overlay *OverlayConn) AddressHistory() AddressHistory {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	h := AddressHistory{
+		Changed: overlay.addrChanges.changed,
+		Changes: overlay.addrChanges.total,
+	}
+	// the flapping ends once no change happens within the window
+	window := time.Duration(overlay.Config.AddressChange.Window) * time.Second
+	h.Flapping = overlay.addrChanges.flapping && time.Since(h.Changed) < window
+	if overlay.externalAddr != nil {
+		h.Current = overlay.externalAddr.String()
+	}
+	if overlay.addrChanges.previous != nil {
+		h.Previous = overlay.addrChanges.previous.String()
+	}
+	return h
+}
+
+// addressChanged re-announces the running updates once the external address
+// has changed, since their trackers still have the old one.
+func (a *Agent) addressChanged(old, new *net.UDPAddr) {
+	results, _ := a.reannounce("")
+	log.Printf("re-announced %d updates after the external address changed to %s", len(results), new)
+}
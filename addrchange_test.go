@@ -0,0 +1,75 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddressChanges(t *testing.T) {
+	cfg := AddressChangeConfig{MaxChanges: 2, Window: 60}
+	var c addressChanges
+	now := time.Now()
+	if c.add(cfg, now) || c.add(cfg, now.Add(time.Second)) {
+		t.Error("changes below the limit are flapping")
+	}
+	if !c.add(cfg, now.Add(2*time.Second)) {
+		t.Error("changes beyond the limit are not flapping")
+	}
+	// the changes out of the window are forgotten
+	if c.add(cfg, now.Add(2*time.Minute)) || c.total != 4 {
+		t.Errorf("unexpected changes %+v", c)
+	}
+}
+
+func TestSetExternalAddr(t *testing.T) {
+	cfg := OverlayConfig{AddressChange: AddressChangeConfig{MaxChanges: 1, Window: 60}}
+	changed := make(chan *net.UDPAddr, 4)
+	overlay := &OverlayConn{Config: &cfg, AddressChanged: func(old, new *net.UDPAddr) {
+		changed <- new
+	}}
+	first := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9322}
+	overlay.setExternalAddr(first, false)
+	overlay.setExternalAddr(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9322}, true)
+	if h := overlay.AddressHistory(); h.Current != first.String() || h.Previous != "" || h.Changes != 0 {
+		t.Fatalf("unexpected history %+v", h)
+	}
+
+	second := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40123}
+	overlay.channelExpired = time.Now().Add(time.Hour)
+	overlay.setExternalAddr(second, true)
+	select {
+	case addr := <-changed:
+		if addr != second {
+			t.Errorf("unexpected new address %s", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("change is not reported")
+	}
+	if overlay.channelExpired.After(time.Now()) {
+		t.Error("overlay does not bind again")
+	}
+	h := overlay.AddressHistory()
+	if h.Current != second.String() || h.Previous != first.String() || h.Changes != 1 || h.Flapping {
+		t.Errorf("unexpected history %+v", h)
+	}
+
+	// beyond the limit, the changes are recorded without reactions
+	overlay.channelExpired = time.Now().Add(time.Hour)
+	overlay.setExternalAddr(first, true)
+	if h = overlay.AddressHistory(); !h.Flapping || h.Previous != second.String() {
+		t.Errorf("unexpected history %+v", h)
+	}
+	if !overlay.channelExpired.After(time.Now()) {
+		t.Error("overlay binds again while the address is flapping")
+	}
+	select {
+	case <-changed:
+		t.Error("flapping change is reported")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -9,14 +9,32 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
 var (
-	updateURL  = "http://v1/update"
-	rUpdateURL = regexp.MustCompile("^/update/[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$")
+	updateURL               = "http://v1/update"
+	updatesURL              = "http://v1/updates"
+	overlayURL              = "http://v1/overlay"
+	blacklistURL            = "http://v1/overlay/blacklist"
+	validationFailuresURL   = "http://v1/overlay/validation-failures"
+	maintenanceURL          = "http://v1/maintenance"
+	maintenanceBroadcastURL = "http://v1/maintenance/broadcast"
+	uninstallURL            = "http://v1/uninstall"
+	controlURL              = "http://v1/control"
+	eventsURL               = "http://v1/events"
+	sendURL                 = "http://v1/overlay/send"
+	reannounceURL           = "http://v1/torrent/reannounce"
+	gcURL                   = "http://v1/gc"
+
+	rUpdateURL         = regexp.MustCompile("^/update/[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$")
+	rUpdateDecisionURL = regexp.MustCompile("^/update/([a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12})/(approve|reject|deploy)$")
+	rUpdateFilesURL    = regexp.MustCompile("^/update/([a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12})/files(/.+)?$")
+	rUpdateImportURL   = regexp.MustCompile("^/update/([a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12})/import$")
+	rUpdateStartURL    = regexp.MustCompile("^/update/([a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12})/start$")
 
 	strPOST            = []byte("POST")
 	strGET             = []byte("GET")
@@ -26,11 +44,27 @@ var (
 	strApplicationJSON = []byte("application/json")
 	strV1              = []byte("v1")
 
-	pathConfig          = []byte("/config")
-	pathOverlay         = []byte("/overlay")
-	pathOverlayPeers    = []byte("/overlay/peers")
-	pathUpdate          = []byte("/update")
-	pathTorrentDhtNodes = []byte("/torrent/dht/nodes")
+	pathConfig           = []byte("/config")
+	pathMetrics          = []byte("/metrics")
+	pathReady            = []byte("/ready")
+	pathOverlay          = []byte("/overlay")
+	pathOverlayPeers     = []byte("/overlay/peers")
+	pathOverlayBlacklist = []byte("/overlay/blacklist")
+	pathOverlayFailures  = []byte("/overlay/validation-failures")
+	pathUpdate           = []byte("/update")
+	pathUpdates          = []byte("/updates")
+	pathTorrentDhtNodes  = []byte("/torrent/dht/nodes")
+	pathReannounce       = []byte("/torrent/reannounce")
+	pathGroup            = []byte("/group/")
+	pathAudit            = []byte("/audit")
+	pathEvents           = []byte("/events")
+	pathGC               = []byte("/gc")
+
+	pathMaintenance          = []byte("/maintenance")
+	pathMaintenanceBroadcast = []byte("/maintenance/broadcast")
+	pathUninstall            = []byte("/uninstall")
+	pathControl              = []byte("/control")
+	pathOverlaySend          = []byte("/overlay/send")
 )
 
 // API provides REST API implementations of the agent.
@@ -56,14 +90,52 @@ func (a *API) requestHandler(ctx *fasthttp.RequestCtx) {
 		a.requestConfig(ctx)
 	case bytes.Compare(ctx.Path(), pathOverlayPeers) == 0:
 		a.requestOverlayPeers(ctx)
+	case bytes.Compare(ctx.Path(), pathOverlayBlacklist) == 0:
+		a.requestOverlayBlacklist(ctx)
+	case bytes.Compare(ctx.Path(), pathOverlayFailures) == 0:
+		a.requestOverlayFailures(ctx)
 	case bytes.Compare(ctx.Path(), pathOverlay) == 0:
 		a.requestOverlay(ctx)
 	case rUpdateURL.Match(ctx.Path()):
 		a.requestUpdateWithParam(ctx)
+	case rUpdateDecisionURL.Match(ctx.Path()):
+		a.requestUpdateDecision(ctx)
+	case rUpdateFilesURL.Match(ctx.Path()):
+		a.requestUpdateFiles(ctx)
+	case rUpdateImportURL.Match(ctx.Path()):
+		a.requestUpdateImport(ctx)
+	case rUpdateStartURL.Match(ctx.Path()):
+		a.requestUpdateStart(ctx)
 	case bytes.Compare(ctx.Path(), pathUpdate) == 0:
 		a.requestUpdate(ctx)
+	case bytes.Compare(ctx.Path(), pathUpdates) == 0:
+		a.requestUpdates(ctx)
 	case bytes.Compare(ctx.Path(), pathTorrentDhtNodes) == 0:
 		a.requestTorrentDhtNodes(ctx)
+	case bytes.Compare(ctx.Path(), pathReannounce) == 0:
+		a.requestReannounce(ctx)
+	case bytes.Compare(ctx.Path(), pathMetrics) == 0:
+		a.requestMetrics(ctx)
+	case bytes.Compare(ctx.Path(), pathReady) == 0:
+		a.requestReady(ctx)
+	case bytes.HasPrefix(ctx.Path(), pathGroup):
+		a.requestGroup(ctx, ctx.Path()[len(pathGroup):])
+	case bytes.Compare(ctx.Path(), pathAudit) == 0:
+		a.requestAudit(ctx)
+	case bytes.Compare(ctx.Path(), pathEvents) == 0:
+		a.requestEvents(ctx)
+	case bytes.Compare(ctx.Path(), pathGC) == 0:
+		a.requestGC(ctx)
+	case bytes.Compare(ctx.Path(), pathMaintenance) == 0:
+		a.requestMaintenance(ctx)
+	case bytes.Compare(ctx.Path(), pathMaintenanceBroadcast) == 0:
+		a.requestMaintenanceBroadcast(ctx)
+	case bytes.Compare(ctx.Path(), pathUninstall) == 0:
+		a.requestUninstall(ctx)
+	case bytes.Compare(ctx.Path(), pathControl) == 0:
+		a.requestControl(ctx)
+	case bytes.Compare(ctx.Path(), pathOverlaySend) == 0:
+		a.requestSend(ctx)
 	default:
 		ctx.Response.SetStatusCode(400)
 	}
@@ -78,6 +150,54 @@ func (a *API) requestConfig(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// requestReady returns the progress of the reload of the updates on start,
+// with status 503 until all of them are reloaded.
+func (a *API) requestReady(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		a.agent.RLock()
+		s := a.agent.startup
+		a.agent.RUnlock()
+		code := 200
+		if !s.Reloaded {
+			code = 503
+		}
+		doJSONWrite(ctx, code, s)
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+func (a *API) requestMetrics(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		sampleMemory()
+		doJSONWrite(ctx, 200, struct {
+			Counters map[string]int64 `json:"counters"`
+			Gauges   map[string]int64 `json:"gauges"`
+		}{
+			Counters: metrics.Counters(),
+			Gauges:   metrics.Gauges(),
+		})
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestGroup returns the status of the members of given update group.
+func (a *API) requestGroup(ctx *fasthttp.RequestCtx, id []byte) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		if gs, ok := a.agent.groupStatus(string(ctx.QueryArgs().Peek("namespace")), string(id)); ok {
+			doJSONWrite(ctx, 200, gs)
+		} else {
+			ctx.Response.SetStatusCode(404)
+		}
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
 func (a *API) requestTorrentDhtNodes(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
@@ -102,6 +222,32 @@ func (a *API) requestTorrentDhtNodes(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// requestReannounce re-announces the update of the uuid query argument, or
+// all updates, and returns the results.
+func (a *API) requestReannounce(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strPOST) == 0:
+		if results, ok := a.agent.reannounce(string(ctx.QueryArgs().Peek("uuid"))); ok {
+			doJSONWrite(ctx, 200, results)
+		} else {
+			ctx.Response.SetStatusCode(404)
+		}
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestGC compacts the metadata of the agent, or only returns what would be
+// removed if the dry-run query argument is true.
+func (a *API) requestGC(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strPOST) == 0:
+		doJSONWrite(ctx, 200, a.agent.gc(string(ctx.QueryArgs().Peek("dry-run")) == "true"))
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
 func (a *API) requestUpdate(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strPOST) == 0:
@@ -113,16 +259,314 @@ func (a *API) requestUpdate(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// requestUpdates returns the statuses of the updates selected by the filter
+// of the query arguments.
+func (a *API) requestUpdates(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		f, err := ParseUpdateFilter(ctx.QueryArgs())
+		if err != nil {
+			ctx.Response.SetStatusCode(400)
+			ctx.WriteString(err.Error())
+			return
+		}
+		doJSONWrite(ctx, 200, f.Apply(a.agent.updateStatuses()))
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// updateKeyArg returns the key of the update of given UUID in the namespace
+// of query argument 'namespace', which is the default one if it is absent.
+func updateKeyArg(ctx *fasthttp.RequestCtx, uuid []byte) []byte {
+	return []byte(updateKey(string(ctx.QueryArgs().Peek("namespace")), string(uuid)))
+}
+
 func (a *API) requestUpdateWithParam(ctx *fasthttp.RequestCtx) {
+	key := updateKeyArg(ctx, ctx.Path()[8:])
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		a.requestGetUpdateWithUUID(ctx, ctx.Path()[8:])
+		a.requestGetUpdateWithUUID(ctx, key)
 	case bytes.Compare(ctx.Method(), strDELETE) == 0:
-		a.requestDeleteUpdate(ctx, ctx.Path()[8:])
+		a.requestDeleteUpdate(ctx, key)
 	case bytes.Compare(ctx.Method(), strPATCH) == 0:
-		a.requestBroadcastUpdateWithUUID(ctx, ctx.Path()[8:])
+		a.requestBroadcastUpdateWithUUID(ctx, key)
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestUpdateFiles returns the files of the payload of a complete or
+// deployed update, or streams the file of the path following /files.
+func (a *API) requestUpdateFiles(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strGET) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	m := rUpdateFilesURL.FindSubmatch(ctx.Path())
+	key := string(updateKeyArg(ctx, m[1]))
+	if len(m[2]) == 0 {
+		files, err := a.agent.artifactList(key)
+		if err != nil {
+			artifactError(ctx, key, err)
+			return
+		}
+		doJSONWrite(ctx, 200, files)
+		return
+	}
+	r, size, err := a.agent.openArtifact(key, string(m[2][1:]))
+	if err != nil {
+		artifactError(ctx, key, err)
+		return
+	}
+	// the file is closed once it is sent, and the response is aborted if
+	// the update is deleted meanwhile
+	ctx.SetContentType("application/octet-stream")
+	ctx.SetBodyStream(r, int(size))
+}
+
+// requestUpdateImport imports the local file or directory of query argument
+// 'file', which must be an absolute path on the host of the agent, into the
+// payload of the update.
+func (a *API) requestUpdateImport(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	m := rUpdateImportURL.FindSubmatch(ctx.Path())
+	key := string(updateKeyArg(ctx, m[1]))
+	filename := string(ctx.QueryArgs().Peek("file"))
+	if !filepath.IsAbs(filename) {
+		ctx.Response.SetStatusCode(400)
+		ctx.WriteString("file must be an absolute path")
+		return
+	}
+	res, err := a.agent.importPayload(key, filename)
+	switch {
+	case err == nil:
+		doJSONWrite(ctx, 200, res)
+	case err == errUpdateNotFound:
+		ctx.Response.SetStatusCode(404)
+	case err == errImportNotRunning:
+		ctx.Response.SetStatusCode(409)
+		ctx.WriteString(err.Error())
+	case err == errImportMismatch:
+		ctx.Response.SetStatusCode(422)
+		ctx.WriteString(err.Error())
+	default:
+		ctx.Response.SetStatusCode(400)
+		ctx.WriteString(err.Error())
+	}
+}
+
+func artifactError(ctx *fasthttp.RequestCtx, key string, err error) {
+	switch {
+	case err == errUpdateNotFound, err == errArtifactNotFound, os.IsNotExist(err):
+		ctx.Response.SetStatusCode(404)
+	case err == errArtifactNotReady:
+		ctx.Response.SetStatusCode(409)
+		ctx.WriteString(err.Error())
+	default:
+		log.Printf("failed serving the files of update uuid:%s - %v", key, err)
+		ctx.Response.SetStatusCode(500)
+	}
+}
+
+// requestUpdateDecision approves (optionally only the version of query
+// argument 'version') or rejects an update awaiting approval, or deploys a
+// staged update (likewise). The decision is made by the local operator since
+// the API is only served on a unix socket.
+func (a *API) requestUpdateDecision(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	m := rUpdateDecisionURL.FindSubmatch(ctx.Path())
+	uuid, decision := string(updateKeyArg(ctx, m[1])), string(m[2])
+
+	var (
+		version int
+		err     error
+	)
+	if ctx.QueryArgs().Has("version") && decision != "reject" {
+		if version, err = ctx.QueryArgs().GetUint("version"); err != nil {
+			ctx.Response.SetStatusCode(400)
+			return
+		}
+	}
+	switch decision {
+	case "approve":
+		err = a.agent.approveUpdate(uuid, uint64(version), approvalLocal)
+	case "deploy":
+		err = a.agent.deployStagedUpdate(uuid, uint64(version), approvalLocal)
+	default:
+		err = a.agent.rejectUpdate(uuid, approvalLocal)
+	}
+	switch err {
+	case nil:
+		ctx.Response.SetStatusCode(200)
+	case errUpdateNotFound:
+		ctx.Response.SetStatusCode(404)
+	default:
+		log.Printf("failed to %s update uuid:%s - %v", decision, uuid, err)
+		ctx.Response.SetStatusCode(409)
+		ctx.WriteString(err.Error())
+	}
+}
+
+func (a *API) requestAudit(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		entries, err := a.agent.auditEntries()
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		doJSONWrite(ctx, 200, entries)
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestEvents returns the recent events after the sequence number of query
+// argument since, all of the events in the ring if it is not set.
+func (a *API) requestEvents(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		var since uint64
+		if v := ctx.QueryArgs().Peek("since"); len(v) > 0 {
+			var err error
+			if since, err = strconv.ParseUint(string(v), 10, 64); err != nil {
+				ctx.Error("invalid since", fasthttp.StatusBadRequest)
+				return
+			}
+		}
+		doJSONWrite(ctx, 200, a.agent.events.Since(since))
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestMaintenance returns the maintenance status, or sets (query argument
+// active=on) or lifts (active=off) the maintenance mode of the local operator.
+func (a *API) requestMaintenance(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		doJSONWrite(ctx, 200, a.agent.maintenance.Status())
+	case bytes.Compare(ctx.Method(), strPOST) == 0:
+		var active bool
+		switch string(ctx.QueryArgs().Peek("active")) {
+		case "on":
+			active = true
+		case "off":
+		default:
+			ctx.Response.SetStatusCode(400)
+			return
+		}
+		if err := a.agent.maintenance.SetLocal(active, approvalLocal); err != nil {
+			log.Printf("failed saving maintenance mode - %v", err)
+			ctx.Response.SetStatusCode(500)
+			return
+		}
+		doJSONWrite(ctx, 200, a.agent.maintenance.Status())
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestMaintenanceBroadcast applies a signed maintenance notice and
+// broadcasts it to the fleet.
+func (a *API) requestMaintenanceBroadcast(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	var mn MaintenanceNotice
+	if err := json.Unmarshal(ctx.PostBody(), &mn); err != nil {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	switch err := a.agent.broadcastMaintenance(&mn); err {
+	case nil:
+		doJSONWrite(ctx, 200, a.agent.maintenance.Status())
+	case errUpdateVerificationFailed:
+		ctx.Response.SetStatusCode(401)
+	case errMaintenanceNoticeIsOld:
+		ctx.Response.SetStatusCode(409)
+	default:
+		log.Printf("failed broadcasting maintenance notice - %v", err)
+		ctx.Response.SetStatusCode(500)
+	}
+}
+
+// requestUninstall applies a signed uninstall notice and broadcasts it to
+// the fleet. It responds the local outcome.
+func (a *API) requestUninstall(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	var un UninstallNotice
+	if err := json.Unmarshal(ctx.PostBody(), &un); err != nil || un.Validate() != nil {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	switch r, err := a.agent.broadcastUninstall(&un); err {
+	case nil:
+		doJSONWrite(ctx, 200, r)
+	case errUpdateVerificationFailed:
+		ctx.Response.SetStatusCode(401)
+	default:
+		log.Printf("failed broadcasting uninstall notice - %v", err)
+		ctx.Response.SetStatusCode(500)
+	}
+}
+
+// requestControl applies a signed control notice and broadcasts it to the
+// other agents.
+func (a *API) requestControl(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	var cn ControlNotice
+	if err := json.Unmarshal(ctx.PostBody(), &cn); err != nil || cn.Validate() != nil {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	switch r, err := a.agent.broadcastControl(&cn); err {
+	case nil:
+		doJSONWrite(ctx, 200, r)
+	case errUpdateVerificationFailed:
+		ctx.Response.SetStatusCode(401)
 	default:
+		log.Printf("failed broadcasting control notice - %v", err)
+		ctx.Response.SetStatusCode(500)
+	}
+}
+
+// requestUpdateStart starts a stopped update on request of the local
+// operator, which is refused with status 403 if it has been stopped remotely
+// unless the configurations allow it.
+func (a *API) requestUpdateStart(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
 		ctx.Response.SetStatusCode(400)
+		return
+	}
+	m := rUpdateStartURL.FindSubmatch(ctx.Path())
+	key := string(updateKeyArg(ctx, m[1]))
+	switch err := a.agent.startUpdate(key); err {
+	case nil:
+		ctx.Response.SetStatusCode(200)
+	case errUpdateNotFound:
+		ctx.Response.SetStatusCode(404)
+	case errUpdateStoppedRemotely:
+		ctx.Response.SetStatusCode(403)
+		ctx.WriteString(err.Error())
+	default:
+		log.Printf("failed starting update uuid:%s - %v", key, err)
+		ctx.Response.SetStatusCode(500)
+		ctx.WriteString(err.Error())
 	}
 }
 
@@ -173,8 +617,16 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 	}
 	u.agent = a.agent
 
+	// the notification is routed to its namespace before its payload is
+	// copied into the data directory of the namespace
+	u.Namespace = ""
+	if err = u.Verify(a.agent); err != nil {
+		ctx.Response.SetStatusCode(401)
+		return
+	}
+
 	if _, err = os.Stat(u.Source); err == nil {
-		dest := filepath.Join(a.agent.dataDir, u.Notification.Info.Name)
+		dest := filepath.Join(u.dataDir(), u.Notification.Info.Name)
 		cmd := exec.Command("cp", "-af", u.Source, dest)
 		if err := cmd.Run(); err != nil {
 			log.Printf("failed copying update file from '%s' to '%s': %v",
@@ -187,6 +639,14 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 		ctx.Response.SetStatusCode(404)
 		return
 	}
+	if d := u.Notification.Delta; d != nil && len(u.DeltaSource) > 0 {
+		dest := filepath.Join(u.dataDir(), d.Info.Name)
+		if err := exec.Command("cp", "-af", u.DeltaSource, dest).Run(); err != nil {
+			log.Printf("failed copying patch file from '%s' to '%s': %v", u.DeltaSource, dest, err)
+			ctx.Response.SetStatusCode(403)
+			return
+		}
+	}
 
 	if err = u.Start(a.agent); err != nil {
 		switch err {
@@ -201,16 +661,17 @@ func (a *API) requestPostUpdate(ctx *fasthttp.RequestCtx) {
 		}
 		log.Printf("failed to activating the torrent: %v", err)
 	} else {
-		go a.rebroadcastUpdate(string(u.Notification.UUID), u.Notification.Version)
+		go a.rebroadcastUpdate(u.key(), u.Notification.Version)
 		ctx.Response.SetStatusCode(200)
 	}
 }
 
-// rebroadcastUpdate broadcasts given update every minute within 5 minutes.
-func (a *API) rebroadcastUpdate(uuid string, version uint64) {
+// rebroadcastUpdate broadcasts the update of given key every minute within 5
+// minutes.
+func (a *API) rebroadcastUpdate(key string, version uint64) {
 	var update *Update
 	for i := 0; i < 5; i++ {
-		update = a.agent.getUpdate(uuid)
+		update = a.agent.getUpdate(key)
 		if update == nil || update.Notification.Version != version {
 			break
 		}
@@ -222,27 +683,101 @@ func (a *API) rebroadcastUpdate(uuid string, version uint64) {
 func (a *API) requestOverlayPeers(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
-		ctx.Response.Header.Set("Content-Type", "application/json")
-		ctx.Response.SetBody(a.agent.Overlay.peers.JSON())
+		doJSONWrite(ctx, 200, a.overlayPeers())
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestOverlayFailures returns the sources of invalid messages by
+// descending number of failures, at most query argument 'top' of them.
+func (a *API) requestOverlayFailures(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		top := 0
+		if ctx.QueryArgs().Has("top") {
+			var err error
+			if top, err = ctx.QueryArgs().GetUint("top"); err != nil {
+				ctx.Response.SetStatusCode(400)
+				return
+			}
+		}
+		doJSONWrite(ctx, 200, a.agent.Overlay.Validation().Offenders(top))
+	default:
+		ctx.Response.SetStatusCode(400)
+	}
+}
+
+// requestOverlayBlacklist returns the blacklisted sources, or removes the
+// source of query argument 'source' from the blacklist.
+func (a *API) requestOverlayBlacklist(ctx *fasthttp.RequestCtx) {
+	switch {
+	case bytes.Compare(ctx.Method(), strGET) == 0:
+		doJSONWrite(ctx, 200, a.agent.Overlay.Blacklist().Entries())
+	case bytes.Compare(ctx.Method(), strDELETE) == 0:
+		source := string(ctx.QueryArgs().Peek("source"))
+		if !a.agent.Overlay.Blacklist().Remove(source) {
+			ctx.Response.SetStatusCode(404)
+			return
+		}
+		ctx.Response.SetStatusCode(200)
 	default:
 		ctx.Response.SetStatusCode(400)
 	}
 }
 
+// OverlayPeer is a peer in the overlay peer listing.
+type OverlayPeer struct {
+	Addresses []string      `json:"addresses"`
+	Flags     []string      `json:"flags,omitempty"` // e.g. "lan" if the peer is behind the same NAT
+	Liveness  *PeerLiveness `json:"liveness,omitempty"`
+	Tags      []string      `json:"tags,omitempty"`
+
+	// ExtendedID is empty if the peer does not send it, e.g. an old agent.
+	ExtendedID string `json:"extended-id,omitempty"`
+}
+
+func (a *API) overlayPeers() map[string]OverlayPeer {
+	peers := make(map[string]OverlayPeer)
+	for id, sess := range a.agent.Overlay.Peers() {
+		p := OverlayPeer{Addresses: make([]string, 0, len(sess))}
+		for _, addr := range sess {
+			p.Addresses = append(p.Addresses, addr.String())
+		}
+		if a.agent.Overlay.SameLAN(sess) {
+			p.Flags = append(p.Flags, "lan")
+		}
+		if l, ok := a.agent.Overlay.Liveness(id); ok {
+			p.Liveness = &l
+		}
+		p.Tags = a.agent.Overlay.Tags(id)
+		peers[id.String()] = p
+	}
+	return peers
+}
+
 func (a *API) requestOverlay(ctx *fasthttp.RequestCtx) {
 	switch {
 	case bytes.Compare(ctx.Method(), strGET) == 0:
 		ctx.Response.Header.Set("Content-Type", "application/json")
 		state := struct {
-			ID           string   `json:"id"`
-			State        string   `json:"state"`
-			InternalAddr net.Addr `json:"internal-address"`
-			ExternalAddr net.Addr `json:"external-address"`
+			ID           string           `json:"id"`
+			ExtendedID   string           `json:"extended-id"`
+			State        string           `json:"state"`
+			InternalAddr net.Addr         `json:"internal-address"`
+			ExternalAddr net.Addr         `json:"external-address"`
+			Address      AddressHistory   `json:"address-history"`
+			Blacklist    []BlacklistEntry `json:"blacklist"`
+			Clock        ClockStatus      `json:"clock"`
 		}{
-			ID:           a.agent.Overlay.ID.String(),
+			ID:           a.agent.Overlay.LocalID().String(),
+			ExtendedID:   a.agent.Overlay.ExtID.String(),
 			State:        a.agent.Overlay.automata.Current().String(),
 			InternalAddr: a.agent.Overlay.InternalAddr(),
 			ExternalAddr: a.agent.Overlay.ExternalAddr(),
+			Address:      a.agent.Overlay.AddressHistory(),
+			Blacklist:    a.agent.Overlay.Blacklist().Entries(),
+			Clock:        a.agent.clock.Status(),
 		}
 		doJSONWrite(ctx, 200, state)
 	default:
@@ -250,6 +785,31 @@ func (a *API) requestOverlay(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// requestSend sends an operator message or a ping to the peers of the
+// session table, and responds the outcome of each peer.
+func (a *API) requestSend(ctx *fasthttp.RequestCtx) {
+	if bytes.Compare(ctx.Method(), strPOST) != 0 {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	var req SendRequest
+	if err := json.Unmarshal(ctx.PostBody(), &req); err != nil {
+		ctx.Response.SetStatusCode(400)
+		return
+	}
+	switch r, err := a.agent.send(req); err {
+	case nil:
+		doJSONWrite(ctx, 200, r)
+	case errUpdateVerificationFailed:
+		ctx.Response.SetStatusCode(401)
+	case errNotReady:
+		ctx.Response.SetStatusCode(503)
+	default:
+		log.Printf("failed sending to the peers - %v", err)
+		ctx.Response.SetStatusCode(500)
+	}
+}
+
 func doJSONWrite(ctx *fasthttp.RequestCtx, code int, obj interface{}) {
 	ctx.Response.Header.SetCanonical(strContentType, strApplicationJSON)
 	ctx.Response.SetStatusCode(code)
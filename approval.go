@@ -0,0 +1,150 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Approval decisions
+const (
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// approvalLocal is the identity of an operator of the local API, which is
+// only accessible through the unix socket.
+const approvalLocal = "local"
+
+var errUpdateNotAwaitingApproval = errors.New("update is not awaiting approval")
+
+// ApprovalConfig holds configurations of the updates that must be approved
+// by an operator before they are deployed.
+type ApprovalConfig struct {
+	Required bool     `json:"required"` // all updates
+	UUIDs    []string `json:"uuids"`    // updates of these UUIDs
+}
+
+// requires returns true if the updates of given UUID must be approved.
+func (cfg *ApprovalConfig) requires(uuid string) bool {
+	if cfg.Required {
+		return true
+	}
+	for _, id := range cfg.UUIDs {
+		if id == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// Approval is the decision of an operator on an update.
+type Approval struct {
+	Decision string    `json:"decision"`
+	By       string    `json:"by"`
+	At       time.Time `json:"at"`
+}
+
+// approved returns true if the update has been approved. The caller must
+// hold the lock.
+func (u *Update) approved() bool {
+	return u.Approval != nil && u.Approval.Decision == ApprovalApproved
+}
+
+// approveUpdate releases the deployment of the update of given key (see
+// updateKey), which must be awaiting approval. Version 0 means the current version.
+func (a *Agent) approveUpdate(uuid string, version uint64, by string) error {
+	u := a.getUpdate(uuid)
+	if u == nil {
+		return errUpdateNotFound
+	}
+	u.Lock()
+	defer u.Unlock()
+	if version != 0 && version != u.Notification.Version {
+		return fmt.Errorf("version %d of uuid:%s is not available, the current version is %d",
+			version, uuid, u.Notification.Version)
+	}
+	if u.State != UpdateAwaitingApproval {
+		return errUpdateNotAwaitingApproval
+	}
+	u.Approval = &Approval{Decision: ApprovalApproved, By: by, At: time.Now()}
+	if err := u.save(); err != nil {
+		return err
+	}
+	a.audit(AuditApproved, &u.Notification, by, "")
+	return nil
+}
+
+// rejectUpdate permanently rejects the update of given key: it is stopped,
+// deleted and tombstoned, so that the same or an older version is never
+// accepted again.
+func (a *Agent) rejectUpdate(uuid string, by string) error {
+	u := a.deleteUpdate(uuid)
+	if u == nil {
+		return errUpdateNotFound
+	}
+	version := u.Notification.Version
+	if err := a.tombstoneUpdate(uuid, version, u); err != nil {
+		log.Printf("WARNING: failed saving tombstone of uuid:%s version:%d - %v", uuid, version, err)
+	}
+	a.audit(AuditRejected, &u.Notification, by, "")
+	u.Stop()
+	return u.Delete()
+}
+
+// addTombstone rejects given and older versions of the update of given key.
+func (a *Agent) addTombstone(uuid string, version uint64) error {
+	return a.tombstoneUpdate(uuid, version, nil)
+}
+
+// tombstoneUpdate rejects given and older versions of the update of given
+// key, and deletes the metadata of given update in the same batch if it is
+// not nil, hence a crash never leaves its metadata without the tombstone.
+func (a *Agent) tombstoneUpdate(uuid string, version uint64, u *Update) error {
+	var ops []MetadataOp
+	if u != nil {
+		// the metadata are not saved anymore, even by a pending flush
+		u.Lock()
+		u.deleted = true
+		ops = append(ops, MetadataOp{Bucket: u.metadataBucket(), Key: u.metadataKey()})
+		u.Unlock()
+	}
+	a.Lock()
+	defer a.Unlock()
+	if v, ok := a.tombstones[uuid]; !ok || v < version {
+		a.tombstones[uuid] = version
+		ops = append(ops, MetadataOp{Bucket: MetadataTombstones, Key: uuid,
+			Value: []byte(strconv.FormatUint(version, 10))},
+			MetadataOp{Bucket: MetadataTombstoned, Key: uuid, Value: tombstoneTime(time.Now())})
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return a.metadata().Batch(ops)
+}
+
+// loadTombstones reads the rejected versions of updates.
+func (a *Agent) loadTombstones() error {
+	a.tombstones = make(map[string]uint64)
+	keys, err := a.metadata().List(MetadataTombstones)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		b, err := a.metadata().Get(MetadataTombstones, key)
+		if err != nil {
+			return err
+		}
+		if a.tombstones[key], err = strconv.ParseUint(string(b), 10, 64); err != nil {
+			return errors.Wrapf(err, "invalid tombstone of uuid:%s", key)
+		}
+	}
+	return nil
+}
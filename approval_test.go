@@ -0,0 +1,65 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestApprovalConfig(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	cfg := ApprovalConfig{}
+	if cfg.requires(uuid) {
+		t.Error("approval is not required by default")
+	}
+	cfg.UUIDs = []string{uuid}
+	if !cfg.requires(uuid) || cfg.requires("3f8cd1a8-2c5e-4d1b-9a0e-6d2b7c1e4f90") {
+		t.Error("approval must be required by the listed UUIDs only")
+	}
+	cfg = ApprovalConfig{Required: true}
+	if !cfg.requires(UUIDShell) {
+		t.Error("approval must be required by all UUIDs")
+	}
+}
+
+func TestTombstonesAndAudit(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	dir, err := ioutil.TempDir("", "approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &Agent{Config: &Config{DataDir: dir}}
+	if err = a.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.addTombstone(uuid, 5); err != nil {
+		t.Fatal(err)
+	}
+	a.addTombstone(uuid, 3) // an older rejection must not lower the tombstone
+
+	// the tombstones survive a restart
+	a = &Agent{Config: &Config{DataDir: dir}}
+	if err = a.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := a.tombstones[uuid]; !ok || v != 5 {
+		t.Errorf("wrong tombstones %v", a.tombstones)
+	}
+
+	a.audit(AuditApprovalRequested, &Notification{UUID: uuid, Version: 6}, "", "")
+	a.audit(AuditApproved, &Notification{UUID: uuid, Version: 6}, approvalLocal, "")
+	entries, err := a.auditEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Event != AuditApproved || entries[1].By != approvalLocal ||
+		entries[1].Version != 6 {
+		t.Errorf("wrong audit entries %+v", entries)
+	}
+}
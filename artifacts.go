@@ -0,0 +1,217 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+var (
+	errArtifactNotReady = errors.New("update is neither complete nor deployed")
+	errArtifactNotFound = errors.New("file is not in the payload of the update")
+	errArtifactDeleted  = errors.New("update has been deleted")
+)
+
+// ArtifactFile is a file of the payload of an update served to the local
+// consumers.
+type ArtifactFile struct {
+	Path   string `json:"path"` // slash-separated, relative to the data directory
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// artifactFiles returns the relative paths of the files of the payload of
+// given info and their info. The path of a single-file payload is its name.
+func artifactFiles(info *metainfo.Info) map[string]metainfo.FileInfo {
+	files := make(map[string]metainfo.FileInfo)
+	if len(info.Files) == 0 {
+		files[info.Name] = metainfo.FileInfo{Length: info.Length}
+		return files
+	}
+	for _, fi := range info.Files {
+		files[strings.Join(append([]string{info.Name}, fi.Path...), "/")] = fi
+	}
+	return files
+}
+
+// validArtifactPath returns true if none of the elements of given
+// slash-separated path could escape the data directory.
+func validArtifactPath(path string) bool {
+	for _, e := range strings.Split(path, "/") {
+		if e == "" || e == "." || e == ".." || strings.ContainsAny(e, `\:`) {
+			return false
+		}
+	}
+	return true
+}
+
+// servesArtifacts returns true if the payload of an update in given state is
+// complete and not being deployed, hence its files are served.
+func servesArtifacts(state UpdateState) bool {
+	switch state {
+	case UpdateDownloaded, UpdateWaiting, UpdateBlocked, UpdateAwaitingApproval, UpdateDeployed:
+		return true
+	}
+	return false
+}
+
+// artifactDigests caches the SHA-256 of the files of a complete payload,
+// which do not change, by path. It is safe for concurrent use.
+type artifactDigests struct {
+	sync.Mutex
+	digests map[string]artifactDigest
+}
+
+type artifactDigest struct {
+	size    int64
+	modTime time.Time
+	sha256  string
+}
+
+// get returns the SHA-256 of given file, which is computed again if the
+// size or modification time of the file has changed.
+func (d *artifactDigests) get(filename string, fi os.FileInfo) (string, error) {
+	d.Lock()
+	c, ok := d.digests[filename]
+	d.Unlock()
+	if ok && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.sha256, nil
+	}
+	sum, err := fileDigest(filename)
+	if err != nil {
+		return "", err
+	}
+	d.Lock()
+	if d.digests == nil {
+		d.digests = make(map[string]artifactDigest)
+	}
+	d.digests[filename] = artifactDigest{size: fi.Size(), modTime: fi.ModTime(), sha256: sum}
+	d.Unlock()
+	return sum, nil
+}
+
+// artifactUpdate returns the update of given key if its files are served,
+// and its data directory and info. The lock of the update is only held to
+// copy them, so that the monitor is not blocked by the consumers.
+func (a *Agent) artifactUpdate(key string) (*Update, string, metainfo.Info, error) {
+	u := a.getUpdate(key)
+	if u == nil {
+		return nil, "", metainfo.Info{}, errUpdateNotFound
+	}
+	u.RLock()
+	defer u.RUnlock()
+	if u.deleted {
+		return nil, "", metainfo.Info{}, errUpdateNotFound
+	} else if !servesArtifacts(u.State) {
+		return nil, "", metainfo.Info{}, errArtifactNotReady
+	}
+	return u, u.dataDir(), u.Notification.Info, nil
+}
+
+// artifactList returns the files of the payload of the update of given key
+// sorted by path.
+func (a *Agent) artifactList(key string) ([]ArtifactFile, error) {
+	u, dir, info, err := a.artifactUpdate(key)
+	if err != nil {
+		return nil, err
+	}
+	files := artifactFiles(&info)
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	list := make([]ArtifactFile, 0, len(paths))
+	for _, path := range paths {
+		if !validArtifactPath(path) {
+			return nil, fmt.Errorf("invalid path %s", path)
+		}
+		filename := artifactFilename(dir, path)
+		fi, err := os.Lstat(filename)
+		if err != nil {
+			return nil, err
+		} else if !fi.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", path)
+		}
+		sum, err := u.artifacts.get(filename, fi)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ArtifactFile{Path: path, Size: fi.Size(), SHA256: sum})
+	}
+	return list, nil
+}
+
+// openArtifact opens the file of given slash-separated path of the payload of
+// the update of given key. Only the files of the payload are served, hence a
+// path cannot escape the data directory. The reader fails once the update is
+// deleted, even if the file is still open.
+func (a *Agent) openArtifact(key, path string) (io.ReadCloser, int64, error) {
+	u, dir, info, err := a.artifactUpdate(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := artifactFiles(&info)[path]; !ok || !validArtifactPath(path) {
+		return nil, 0, errArtifactNotFound
+	}
+	filename := artifactFilename(dir, path)
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return nil, 0, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, 0, errArtifactNotFound
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &artifactReader{u: u, f: f, remaining: fi.Size()}, fi.Size(), nil
+}
+
+func artifactFilename(dir, path string) string {
+	return dir + string(os.PathSeparator) + strings.Replace(path, "/", string(os.PathSeparator), -1)
+}
+
+// artifactReader reads a file of the payload of an update, until the update
+// is deleted.
+type artifactReader struct {
+	u         *Update
+	f         *os.File
+	remaining int64
+}
+
+func (r *artifactReader) Read(b []byte) (int, error) {
+	r.u.RLock()
+	deleted := r.u.deleted
+	r.u.RUnlock()
+	if deleted {
+		return 0, errArtifactDeleted
+	}
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+	n, err := r.f.Read(b)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF // truncated
+	}
+	return n, err
+}
+
+func (r *artifactReader) Close() error {
+	return r.f.Close()
+}
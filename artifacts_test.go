@@ -0,0 +1,104 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestArtifactFiles(t *testing.T) {
+	single := metainfo.Info{Name: "app.bin", Length: 10}
+	if files := artifactFiles(&single); len(files) != 1 || files["app.bin"].Length != 10 {
+		t.Errorf("unexpected files of a single-file payload: %v", files)
+	}
+	multi := metainfo.Info{Name: "app", Files: []metainfo.FileInfo{
+		{Path: []string{"bin", "app"}, Length: 1},
+		{Path: []string{"README"}, Length: 2},
+	}}
+	files := artifactFiles(&multi)
+	var paths []string
+	for p := range files {
+		paths = append(paths, p)
+	}
+	if len(files) != 2 || files["app/bin/app"].Length != 1 || files["app/README"].Length != 2 {
+		t.Errorf("unexpected files of a multi-file payload: %v", paths)
+	}
+
+	for _, p := range []string{"app.bin", "app/bin/app"} {
+		if !validArtifactPath(p) {
+			t.Errorf("path %s is invalid", p)
+		}
+	}
+	for _, p := range []string{"", "/etc/passwd", "app/../../etc/passwd", "app//x", "./app", "app/", `app\..\x`, "c:x"} {
+		if validArtifactPath(p) {
+			t.Errorf("path %s is valid", p)
+		}
+	}
+}
+
+func TestServesArtifacts(t *testing.T) {
+	var served []UpdateState
+	for _, s := range []UpdateState{UpdatePending, UpdateDownloading, UpdateDownloaded, UpdateDeploying,
+		UpdateDeployed, UpdateFailed, UpdateWaiting, UpdateBlocked, UpdateAwaitingApproval} {
+		if servesArtifacts(s) {
+			served = append(served, s)
+		}
+	}
+	expected := []UpdateState{UpdateDownloaded, UpdateDeployed, UpdateWaiting, UpdateBlocked, UpdateAwaitingApproval}
+	if !reflect.DeepEqual(served, expected) {
+		t.Errorf("files are served in states %v, expected %v", served, expected)
+	}
+}
+
+func TestArtifactReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "app.bin")
+	if err = ioutil.WriteFile(filename, make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(u *Update, size int64) *artifactReader {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &artifactReader{u: u, f: f, remaining: size}
+	}
+	u := &Update{}
+	r := open(u, 1000)
+	if b, err := ioutil.ReadAll(r); err != nil || len(b) != 1000 {
+		t.Errorf("read %d bytes: %v", len(b), err)
+	}
+	r.Close()
+
+	// the file is truncated
+	r = open(u, 2000)
+	if _, err = ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated file is read: %v", err)
+	}
+	r.Close()
+
+	// the update is deleted during the read
+	r = open(u, 1000)
+	defer r.Close()
+	if _, err = r.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	u.deleted = true
+	if _, err = ioutil.ReadAll(r); err != errArtifactDeleted {
+		t.Errorf("file of a deleted update is read: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Audit events
+const (
+	AuditApprovalRequested    = "approval-requested"
+	AuditApproved             = "approved"
+	AuditRejected             = "rejected"
+	AuditSuperseded           = "superseded"
+	AuditDigestVerified       = "digest-verified"
+	AuditDigestMismatch       = "digest-mismatch"
+	AuditUninstalled          = "uninstalled"
+	AuditUnsafeEntrypoint     = "unsafe-entrypoint"
+	AuditNotificationRejected = "notification-rejected"
+	AuditRolledBack           = "rolled-back"
+	AuditDeployTriggered      = "deploy-triggered"
+)
+
+// AuditEntry is a record of an operator decision or of an event related to
+// it, which is appended to the audit log of the agent.
+type AuditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	UUID      string    `json:"uuid"`
+	Version   uint64    `json:"version"`
+	TraceID   string    `json:"trace-id,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	By        string    `json:"by,omitempty"` // identity of the operator
+	Detail    string    `json:"detail,omitempty"`
+	Reason    string    `json:"reason,omitempty"` // of a rejected notification
+
+	// UnsyncedClock is true if the timestamp was taken before the clock
+	// was known to be right, e.g. before NTP synced it.
+	UnsyncedClock bool `json:"unsynced-clock,omitempty"`
+
+	// Checkpoint are the data of a checkpoint replacing compacted entries.
+	Checkpoint *AuditCheckpointData `json:"checkpoint,omitempty"`
+}
+
+// auditFilename returns the audit log file, which has an entry per line.
+func (a *Agent) auditFilename() string {
+	return filepath.Join(a.Config.DataDir, "audit.log")
+}
+
+// audit appends an entry of the update of given notification to the audit
+// log.
+func (a *Agent) audit(event string, n *Notification, by, detail string) {
+	e := AuditEntry{
+		Timestamp: time.Now(),
+		Event:     event,
+		UUID:      n.UUID,
+		Version:   n.Version,
+		TraceID:   n.TraceID,
+		Title:     n.title(),
+		By:        by,
+		Detail:    detail,
+
+		UnsyncedClock: !a.clock.Synced(),
+	}
+	log.Printf("audit: %s uuid:%s version:%d by:%s %s%s%s", event, n.UUID, n.Version, by, detail,
+		titleSuffix(e.Title), traceSuffix(n.TraceID))
+	a.appendAudit(e)
+}
+
+// auditRejection appends an entry of given rejection of given notification
+// to the audit log.
+func (a *Agent) auditRejection(n *Notification, r *Rejection) {
+	e := AuditEntry{
+		Timestamp: time.Now(),
+		Event:     AuditNotificationRejected,
+		UUID:      n.UUID,
+		Version:   n.Version,
+		TraceID:   n.TraceID,
+		Title:     n.title(),
+		Detail:    r.Detail,
+		Reason:    string(r.Reason),
+
+		UnsyncedClock: !a.clock.Synced(),
+	}
+	log.Printf("audit: %s uuid:%s version:%d reason:%s %s%s%s", e.Event, n.UUID, n.Version, r.Reason,
+		r.Detail, titleSuffix(e.Title), traceSuffix(n.TraceID))
+	a.appendAudit(e)
+}
+
+// appendAudit appends given entry to the audit log.
+func (a *Agent) appendAudit(e AuditEntry) {
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	f, err := os.OpenFile(a.auditFilename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err == nil {
+		err = json.NewEncoder(f).Encode(e)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: failed writing audit log - %v", err)
+	}
+}
+
+// auditEntries returns the entries of the audit log.
+func (a *Agent) auditEntries() ([]AuditEntry, error) {
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	entries := make([]AuditEntry, 0)
+	f, err := os.Open(a.auditFilename())
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -90,24 +90,24 @@ func (a *Automata) Current() State {
 // Event returns an error when it cannot made the transition, for example:
 // there is no available transition.
 func (a *Automata) Event(event Event, data ...interface{}) error {
-	var (
-		dest State
-		ok   bool
-		cb   Callback
-	)
-	if dest, ok = a.transitions[a.current][event]; ok {
-		a.Lock()
-		log.Println("event", event.String(), "transition from",
-			a.current.String(), "to", dest.String())
-		a.current = dest
+	a.Lock()
+	src := a.current
+	dest, ok := a.transitions[src][event]
+	if !ok {
 		a.Unlock()
-		if cb, ok = a.callbacks[a.current]; ok {
-			cb(data)
-		}
-		return nil
+		return fmt.Errorf("state %s does not have transition for event %s",
+			src.String(), event.String())
+	}
+	log.Println("event", event.String(), "transition from",
+		src.String(), "to", dest.String())
+	a.current = dest
+	cb, ok := a.callbacks[dest]
+	a.Unlock()
+
+	if ok {
+		cb(data)
 	}
-	return fmt.Errorf("state %s does not have transition for event %s",
-		a.current.String(), event.String())
+	return nil
 }
 
 func (s State) String() string {
@@ -0,0 +1,222 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// bandwidthCheckInterval is the interval of the evaluation of the
+	// bandwidth schedule, hence the delay of applying an entry.
+	bandwidthCheckInterval = time.Minute
+
+	// bandwidthBurst is the burst in bytes of the rate limiters of the
+	// torrent client, which must exceed the size of a block.
+	bandwidthBurst = 256 * 1024
+)
+
+// bandwidthDays are the names of the days of a BandwidthEntry, indexed by
+// time.Weekday.
+var bandwidthDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// BandwidthEntry is an entry of the bandwidth schedule, which sets the rate
+// limits of the torrent client from Start to End (HH:MM, local time) of the
+// given days. An entry whose End is not after its Start wraps midnight, and
+// its days are the ones where it starts. The limits are in kbit/s, 0 is
+// unlimited.
+type BandwidthEntry struct {
+	Days     []string `json:"days"` // e.g. mon, sat; every day if empty
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	UpKbps   int      `json:"up-kbps"`
+	DownKbps int      `json:"down-kbps"`
+}
+
+// parseClock returns the minutes since midnight of given HH:MM time.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validate returns an error if the entry is invalid.
+func (e *BandwidthEntry) validate() error {
+	for _, d := range e.Days {
+		if dayIndex(d) < 0 {
+			return fmt.Errorf("invalid day '%s', expected one of %s", d, strings.Join(bandwidthDays, ","))
+		}
+	}
+	if _, err := parseClock(e.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(e.End); err != nil {
+		return err
+	}
+	if e.UpKbps < 0 || e.DownKbps < 0 {
+		return fmt.Errorf("negative rate limit up:%d down:%d", e.UpKbps, e.DownKbps)
+	}
+	return nil
+}
+
+func dayIndex(d string) int {
+	for i, name := range bandwidthDays {
+		if strings.EqualFold(d, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// onDay returns true if the entry applies to given day.
+func (e *BandwidthEntry) onDay(d time.Weekday) bool {
+	if len(e.Days) == 0 {
+		return true
+	}
+	for _, name := range e.Days {
+		if dayIndex(name) == int(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns true if the entry applies at given time, whose location is
+// the local timezone.
+func (e *BandwidthEntry) active(t time.Time) bool {
+	start, err := parseClock(e.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(e.End)
+	if err != nil {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	if start < end {
+		return e.onDay(t.Weekday()) && m >= start && m < end
+	}
+	// the entry wraps midnight, its end belongs to the next day
+	return (e.onDay(t.Weekday()) && m >= start) || (e.onDay(t.AddDate(0, 0, -1).Weekday()) && m < end)
+}
+
+// validateBandwidth returns an error if the rate limits or the bandwidth
+// schedule of given configurations are invalid.
+func (c *BitTorrentConfig) validateBandwidth() error {
+	if c.UploadKbps < 0 || c.DownloadKbps < 0 {
+		return fmt.Errorf("negative rate limit upload:%d download:%d", c.UploadKbps, c.DownloadKbps)
+	}
+	for i := range c.BandwidthSchedule {
+		if err := c.BandwidthSchedule[i].validate(); err != nil {
+			return fmt.Errorf("bandwidth schedule entry %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// BandwidthStatus is the rate limits of the torrent client in kbit/s, 0 is
+// unlimited. Entry is the index of the active entry of the schedule, or -1 if
+// the static limits apply.
+type BandwidthStatus struct {
+	Entry    int `json:"entry"`
+	UpKbps   int `json:"up-kbps"`
+	DownKbps int `json:"down-kbps"`
+}
+
+// BandwidthScheduler applies the bandwidth schedule to the rate limiters of
+// the torrent client. The first entry of the schedule that is active applies,
+// otherwise the static limits do, which is always the case if the schedule is
+// empty.
+type BandwidthScheduler struct {
+	sync.Mutex
+	up, down *rate.Limiter
+
+	upKbps, downKbps int // static limits
+	schedule         []BandwidthEntry
+	status           BandwidthStatus
+	applied          bool
+}
+
+// NewBandwidthScheduler returns a scheduler of the static limits and the
+// schedule of given configurations, whose limiters are unlimited until
+// Apply is called.
+func NewBandwidthScheduler(cfg BitTorrentConfig) *BandwidthScheduler {
+	s := &BandwidthScheduler{
+		up:   rate.NewLimiter(rate.Inf, bandwidthBurst),
+		down: rate.NewLimiter(rate.Inf, bandwidthBurst),
+	}
+	s.SetConfig(cfg)
+	return s
+}
+
+// SetConfig replaces the static limits and the schedule, which take effect
+// at the next evaluation.
+func (s *BandwidthScheduler) SetConfig(cfg BitTorrentConfig) {
+	s.Lock()
+	s.upKbps, s.downKbps = cfg.UploadKbps, cfg.DownloadKbps
+	s.schedule = append([]BandwidthEntry(nil), cfg.BandwidthSchedule...)
+	s.Unlock()
+}
+
+// current returns the limits that apply at given time. The caller must hold
+// the lock.
+func (s *BandwidthScheduler) current(t time.Time) BandwidthStatus {
+	for i := range s.schedule {
+		if e := &s.schedule[i]; e.active(t) {
+			return BandwidthStatus{Entry: i, UpKbps: e.UpKbps, DownKbps: e.DownKbps}
+		}
+	}
+	return BandwidthStatus{Entry: -1, UpKbps: s.upKbps, DownKbps: s.downKbps}
+}
+
+// Apply evaluates the schedule at given time, and updates the limiters if the
+// limits have changed.
+func (s *BandwidthScheduler) Apply(t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	st := s.current(t)
+	if s.applied && st == s.status {
+		return
+	}
+	s.up.SetLimit(kbpsLimit(st.UpKbps))
+	s.down.SetLimit(kbpsLimit(st.DownKbps))
+	s.status, s.applied = st, true
+	metrics.Set("bandwidth.entry", int64(st.Entry))
+	metrics.Set("bandwidth.up_kbps", int64(st.UpKbps))
+	metrics.Set("bandwidth.down_kbps", int64(st.DownKbps))
+	if st.Entry >= 0 {
+		log.Printf("bandwidth schedule entry %d applies, up:%d down:%d kbit/s", st.Entry,
+			st.UpKbps, st.DownKbps)
+	} else {
+		log.Printf("static bandwidth limits apply, up:%d down:%d kbit/s", st.UpKbps, st.DownKbps)
+	}
+}
+
+// Status returns the limits that are applied.
+func (s *BandwidthScheduler) Status() BandwidthStatus {
+	if s == nil {
+		return BandwidthStatus{Entry: -1}
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.status
+}
+
+// kbpsLimit returns the limit of a rate limiter of bytes of given kbit/s,
+// which is unlimited if 0.
+func kbpsLimit(kbps int) rate.Limit {
+	if kbps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(kbps * 1000 / 8)
+}
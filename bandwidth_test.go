@@ -0,0 +1,130 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestBandwidthEntryActive(t *testing.T) {
+	// 2018-06-04 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2018, 6, 4+day, hour, min, 0, 0, time.Local)
+	}
+	workday := BandwidthEntry{Days: []string{"mon", "Tue", "wed", "thu", "fri"}, Start: "08:00", End: "18:00"}
+	night := BandwidthEntry{Days: []string{"fri"}, Start: "22:00", End: "06:30"}
+	allDay := BandwidthEntry{Start: "00:00", End: "00:00"}
+	for _, tc := range []struct {
+		e      *BandwidthEntry
+		t      time.Time
+		active bool
+	}{
+		{&workday, at(0, 8, 0), true},
+		{&workday, at(0, 17, 59), true},
+		{&workday, at(0, 18, 0), false},
+		{&workday, at(0, 7, 59), false},
+		{&workday, at(5, 12, 0), false}, // Saturday
+		{&night, at(4, 22, 0), true},    // Friday
+		{&night, at(5, 6, 29), true},    // Saturday morning
+		{&night, at(5, 6, 30), false},
+		{&night, at(4, 6, 0), false}, // Friday morning
+		{&night, at(5, 23, 0), false},
+		{&allDay, at(2, 0, 0), true},
+		{&allDay, at(3, 23, 59), true},
+	} {
+		if active := tc.e.active(tc.t); active != tc.active {
+			t.Errorf("entry %+v at %s: active=%v, expected %v", *tc.e, tc.t.Format(time.RFC1123), active, tc.active)
+		}
+	}
+}
+
+func TestValidateBandwidth(t *testing.T) {
+	for _, tc := range []struct {
+		cfg BitTorrentConfig
+		ok  bool
+	}{
+		{BitTorrentConfig{}, true},
+		{BitTorrentConfig{UploadKbps: 100, BandwidthSchedule: []BandwidthEntry{
+			{Days: []string{"sat", "sun"}, Start: "00:00", End: "00:00"},
+			{Start: "19:00", End: "07:00", UpKbps: 10000}}}, true},
+		{BitTorrentConfig{DownloadKbps: -1}, false},
+		{BitTorrentConfig{BandwidthSchedule: []BandwidthEntry{{Days: []string{"monday"}, Start: "00:00", End: "01:00"}}}, false},
+		{BitTorrentConfig{BandwidthSchedule: []BandwidthEntry{{Start: "8:00pm", End: "01:00"}}}, false},
+		{BitTorrentConfig{BandwidthSchedule: []BandwidthEntry{{Start: "00:00", End: "24:00"}}}, false},
+		{BitTorrentConfig{BandwidthSchedule: []BandwidthEntry{{Start: "00:00", End: "01:00", UpKbps: -5}}}, false},
+	} {
+		if err := tc.cfg.validateBandwidth(); (err == nil) != tc.ok {
+			t.Errorf("bandwidth %+v: %v", tc.cfg, err)
+		}
+	}
+}
+
+func TestTorrentClientRateLimiters(t *testing.T) {
+	bt := BitTorrentConfig{Port: 6881, UploadKbps: 800, DownloadKbps: 1600}
+	a := &Agent{Config: &Config{BitTorrent: bt}, bandwidth: NewBandwidthScheduler(bt)}
+	cfg := a.torrentClientConfig()
+	if cfg.UploadRateLimiter != a.bandwidth.up || cfg.DownloadRateLimiter != a.bandwidth.down {
+		t.Fatal("rate limiters of the scheduler are not attached to the torrent client")
+	}
+
+	// the limits applied at runtime are the ones of the client
+	a.bandwidth.Apply(time.Now())
+	if cfg.UploadRateLimiter.Limit() != 100000 || cfg.DownloadRateLimiter.Limit() != 200000 {
+		t.Errorf("limits of the torrent client are %v/%v", cfg.UploadRateLimiter.Limit(),
+			cfg.DownloadRateLimiter.Limit())
+	}
+	a.bandwidth.SetConfig(BitTorrentConfig{})
+	a.bandwidth.Apply(time.Now())
+	if cfg.UploadRateLimiter.Limit() != rate.Inf || cfg.DownloadRateLimiter.Limit() != rate.Inf {
+		t.Error("reloaded limits are not applied to the torrent client")
+	}
+}
+
+func TestBandwidthScheduler(t *testing.T) {
+	s := NewBandwidthScheduler(BitTorrentConfig{
+		UploadKbps:   800,
+		DownloadKbps: 1600,
+		BandwidthSchedule: []BandwidthEntry{
+			{Start: "08:00", End: "18:00", UpKbps: 80, DownKbps: 160},
+			{Start: "07:00", End: "20:00", UpKbps: 8},
+		},
+	})
+	if s.up.Limit() != rate.Inf || s.down.Limit() != rate.Inf {
+		t.Error("limiters are limited before the schedule is applied")
+	}
+	day := time.Date(2018, 6, 4, 0, 0, 0, 0, time.Local)
+	for _, tc := range []struct {
+		t        time.Time
+		status   BandwidthStatus
+		up, down rate.Limit
+	}{
+		{day.Add(12 * time.Hour), BandwidthStatus{Entry: 0, UpKbps: 80, DownKbps: 160}, 10000, 20000},
+		{day.Add(19 * time.Hour), BandwidthStatus{Entry: 1, UpKbps: 8}, 1000, rate.Inf},
+		{day.Add(21 * time.Hour), BandwidthStatus{Entry: -1, UpKbps: 800, DownKbps: 1600}, 100000, 200000},
+	} {
+		s.Apply(tc.t)
+		if st := s.Status(); st != tc.status {
+			t.Errorf("status at %s is %+v, expected %+v", tc.t.Format("15:04"), st, tc.status)
+		}
+		if s.up.Limit() != tc.up || s.down.Limit() != tc.down {
+			t.Errorf("limits at %s are %v/%v, expected %v/%v", tc.t.Format("15:04"),
+				s.up.Limit(), s.down.Limit(), tc.up, tc.down)
+		}
+	}
+
+	// an empty schedule keeps the static limits, the reload takes effect
+	// at the next evaluation
+	s.SetConfig(BitTorrentConfig{UploadKbps: 8})
+	if st := s.Status(); st.UpKbps != 800 {
+		t.Errorf("reloaded limits are applied before the evaluation: %+v", st)
+	}
+	s.Apply(day.Add(12 * time.Hour))
+	if st := s.Status(); st != (BandwidthStatus{Entry: -1, UpKbps: 8}) || s.down.Limit() != rate.Inf {
+		t.Errorf("unexpected status %+v after reload", st)
+	}
+}
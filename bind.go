@@ -0,0 +1,72 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// resolveBind returns the network interface and the local address of given
+// interface name or local address. The address is an IPv4 if the interface
+// has one.
+func resolveBind(bind string) (string, net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", nil, err
+	}
+	if ip := net.ParseIP(bind); ip != nil {
+		for _, iface := range ifaces {
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+					return iface.Name, ip, nil
+				}
+			}
+		}
+		return "", nil, fmt.Errorf("bind-interface: address %s is not assigned to any interface", bind)
+	}
+	for _, iface := range ifaces {
+		if iface.Name != bind {
+			continue
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return "", nil, fmt.Errorf("bind-interface: interface %s is down", bind)
+		}
+		if ip := IPv4ofInterface(bind); ip != nil {
+			return bind, ip, nil
+		}
+		if ip := GlobalIPv6(bind); ip != nil {
+			return bind, ip, nil
+		}
+		return "", nil, fmt.Errorf("bind-interface: interface %s has no usable address", bind)
+	}
+	return "", nil, fmt.Errorf("bind-interface: interface %s does not exist", bind)
+}
+
+// bindControl returns a socket control function that binds sockets to given
+// network interface, or nil if the interface is empty. Binding to a device
+// requires privileges (CAP_NET_RAW on Linux), hence a failure is logged and
+// the socket is bound to the local address only.
+func bindControl(device string) func(network, address string, c syscall.RawConn) error {
+	if device == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = bindToDevice(fd, device)
+		}); cerr != nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Printf("WARNING: failed binding socket to device %s, only its address is bound: %v",
+				device, err)
+		}
+		return nil
+	}
+}
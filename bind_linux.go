@@ -0,0 +1,13 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import "syscall"
+
+// bindToDevice binds the socket to given network interface with
+// SO_BINDTODEVICE.
+func bindToDevice(fd uintptr, device string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// bindToDevice is not supported on this platform, hence the sockets are bound
+// to the local address of the interface only.
+func bindToDevice(fd uintptr, device string) error {
+	return errors.New("SO_BINDTODEVICE is not supported on this platform")
+}
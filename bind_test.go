@@ -0,0 +1,44 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestResolveBind(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+
+	if device, ip, err := resolveBind("lo"); err != nil || device != "lo" || !ip.IsLoopback() {
+		t.Errorf("expected loopback of lo, got %s %v %v", device, ip, err)
+	}
+	if device, _, err := resolveBind("127.0.0.1"); err != nil || device != lo.Name {
+		t.Errorf("expected interface lo of 127.0.0.1, got %s %v", device, err)
+	}
+	if _, _, err = resolveBind("nonexistent0"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("expected error on nonexistent interface, got %v", err)
+	}
+	if _, _, err = resolveBind("192.0.2.123"); err == nil {
+		t.Error("expected error on unassigned address")
+	}
+}
+
+func TestOverlayUDPConnBind(t *testing.T) {
+	// binding to a device may fail without privileges, but the socket must
+	// still be bound to the local address
+	conn, err := newOverlayUDPConn(nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, "lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := conn.conn.LocalAddr().(*net.UDPAddr); !addr.IP.IsLoopback() {
+		t.Errorf("expected socket bound to loopback, got %s", addr)
+	}
+}
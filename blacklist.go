@@ -0,0 +1,199 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blacklistMaxEntries is the number of tracked sources that triggers removing
+// the expired entries.
+const blacklistMaxEntries = 1024
+
+// BlacklistConfig holds configurations of the blacklist of sources that
+// repeatedly send invalid messages.
+type BlacklistConfig struct {
+	// Threshold is the number of failures within Window that blacklists a
+	// source. The blacklist is disabled when it is zero.
+	Threshold int `json:"threshold"`
+	Window    int `json:"window"`   // in seconds
+	Cooldown  int `json:"cooldown"` // in seconds
+}
+
+// DefaultBlacklistConfig returns default blacklist configurations.
+func DefaultBlacklistConfig() BlacklistConfig {
+	return BlacklistConfig{
+		Threshold: 10,
+		Window:    60,
+		Cooldown:  600,
+	}
+}
+
+// BlacklistEntry is the status of a source tracked by the blacklist.
+type BlacklistEntry struct {
+	Source   string    `json:"source"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+type blacklistEntry struct {
+	failures int
+	since    time.Time
+	until    time.Time
+}
+
+// Blacklist tracks validation failures per source, which is a PeerID or an
+// address, and blocks a source whose failures reach the threshold within the
+// window for a cooldown period. It is safe for concurrent use.
+type Blacklist struct {
+	sync.Mutex
+	cfg     BlacklistConfig
+	entries map[string]*blacklistEntry
+	now     func() time.Time
+}
+
+// NewBlacklist returns an empty Blacklist of given configurations.
+func NewBlacklist(cfg BlacklistConfig) *Blacklist {
+	return &Blacklist{
+		cfg:     cfg,
+		entries: make(map[string]*blacklistEntry),
+		now:     time.Now,
+	}
+}
+
+// peerSource returns the blacklist source of given PeerID.
+func peerSource(pid PeerID) string {
+	return "peer:" + pid.String()
+}
+
+// addrSource returns the blacklist source of given address, which is its IP
+// since the port can be changed freely by the sender.
+func addrSource(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return "addr:" + host
+}
+
+// Blocked returns true if one of given sources is blacklisted.
+func (b *Blacklist) Blocked(sources ...string) bool {
+	if b == nil || b.cfg.Threshold <= 0 {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	for _, source := range sources {
+		if e, ok := b.entries[source]; ok && now.Before(e.until) {
+			metrics.Inc("blacklist.dropped")
+			return true
+		}
+	}
+	return false
+}
+
+// Failure records a validation failure of given source, and blacklists the
+// source if its failures reach the threshold within the window.
+func (b *Blacklist) Failure(source string) {
+	if b == nil || b.cfg.Threshold <= 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	if len(b.entries) >= blacklistMaxEntries {
+		b.prune(now)
+	}
+	e, ok := b.entries[source]
+	if !ok || now.Sub(e.since) > time.Duration(b.cfg.Window)*time.Second {
+		if ok && now.Before(e.until) {
+			return
+		}
+		e = &blacklistEntry{since: now}
+		b.entries[source] = e
+	}
+	e.failures++
+	if e.failures >= b.cfg.Threshold && !now.Before(e.until) {
+		e.until = now.Add(time.Duration(b.cfg.Cooldown) * time.Second)
+		log.Printf("blacklisted %s for %ds after %d invalid messages",
+			source, b.cfg.Cooldown, e.failures)
+		metrics.Inc("blacklist.blocked")
+	}
+}
+
+// Success decays the failures of given sources, which have sent a valid
+// authenticated message.
+func (b *Blacklist) Success(sources ...string) {
+	if b == nil || b.cfg.Threshold <= 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	for _, source := range sources {
+		e, ok := b.entries[source]
+		if !ok || now.Before(e.until) {
+			continue
+		}
+		if e.failures--; e.failures <= 0 {
+			delete(b.entries, source)
+		}
+	}
+}
+
+// Remove removes given source from the blacklist. It returns false if the
+// source is not tracked.
+func (b *Blacklist) Remove(source string) bool {
+	if b == nil {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.entries[source]; !ok {
+		return false
+	}
+	delete(b.entries, source)
+	log.Printf("removed %s from the blacklist", source)
+	return true
+}
+
+// Entries returns the sources tracked by the blacklist, and removes the
+// entries that have expired.
+func (b *Blacklist) Entries() []BlacklistEntry {
+	entries := []BlacklistEntry{}
+	if b == nil {
+		return entries
+	}
+	b.Lock()
+	defer b.Unlock()
+	now := b.now()
+	b.prune(now)
+	for source, e := range b.entries {
+		entry := BlacklistEntry{Source: source, Failures: e.failures}
+		if now.Before(e.until) {
+			entry.Until = e.until
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Source < entries[j].Source })
+	metrics.Set("blacklist.entries", int64(len(entries)))
+	return entries
+}
+
+// prune removes the entries that are neither blocked nor within the window.
+// The caller must hold the lock.
+func (b *Blacklist) prune(now time.Time) {
+	window := time.Duration(b.cfg.Window) * time.Second
+	for source, e := range b.entries {
+		if !now.Before(e.until) && now.Sub(e.since) > window {
+			delete(b.entries, source)
+		}
+	}
+}
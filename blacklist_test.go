@@ -0,0 +1,68 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBlacklist(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	b := NewBlacklist(BlacklistConfig{Threshold: 3, Window: 60, Cooldown: 600})
+	b.now = func() time.Time { return now }
+
+	addr := addrSource(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9322})
+	if addr != "addr:10.0.0.1" {
+		t.Fatalf("unexpected source %s", addr)
+	}
+
+	// failures outside the window are forgotten
+	b.Failure(addr)
+	b.Failure(addr)
+	now = now.Add(61 * time.Second)
+	b.Failure(addr)
+	if b.Blocked(addr) {
+		t.Fatal("blocked although the failures are outside the window")
+	}
+
+	// successful messages decay the failures
+	b.Failure(addr)
+	b.Success(addr)
+	b.Failure(addr)
+	if b.Blocked(addr) {
+		t.Fatal("blocked although the failures have decayed")
+	}
+	b.Failure(addr)
+	if !b.Blocked(addr) {
+		t.Fatal("not blocked after reaching the threshold")
+	}
+	if entries := b.Entries(); len(entries) != 1 || entries[0].Until.IsZero() {
+		t.Errorf("unexpected entries %v", entries)
+	}
+
+	// the source is blocked until the cooldown has passed
+	b.Success(addr)
+	now = now.Add(599 * time.Second)
+	if !b.Blocked(addr) {
+		t.Fatal("not blocked within the cooldown")
+	}
+	now = now.Add(2 * time.Second)
+	if b.Blocked(addr) {
+		t.Fatal("blocked after the cooldown")
+	}
+
+	// manual removal
+	for i := 0; i < 3; i++ {
+		b.Failure(addr)
+	}
+	if !b.Remove(addr) || b.Blocked(addr) {
+		t.Error("failed removing the source")
+	}
+	if b.Remove(addr) {
+		t.Error("removed a source that is not tracked")
+	}
+}
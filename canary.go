@@ -0,0 +1,175 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	canaryDefaultTimeout      = 86400 // in seconds
+	canaryDefaultPollInterval = 60    // in seconds
+)
+
+// Canary holds the deployment of an update on non-canary agents until enough
+// canary agents have deployed it successfully. It is part of the signed
+// notification.
+type Canary struct {
+	Peers      []string `bencode:"peers" json:"peers"` // IDs of the canary agents
+	MinSuccess int      `bencode:"min_success" json:"min-success"`
+
+	// Override releases the deployment regardless of the canary reports.
+	// It is set by re-publishing the notification.
+	Override bool `bencode:"override,omitempty" json:"override,omitempty"`
+}
+
+// Validate returns an error if the canary configuration is invalid.
+func (c *Canary) Validate() error {
+	if c == nil {
+		return nil
+	}
+	for _, p := range c.Peers {
+		if _, err := hex.DecodeString(p); err != nil || len(p) != 2*len(PeerID{}) {
+			return fmt.Errorf("invalid canary peer ID: %s", p)
+		}
+	}
+	if c.MinSuccess < 1 || c.MinSuccess > len(c.Peers) {
+		return fmt.Errorf("invalid minimum successes %d of %d canaries", c.MinSuccess, len(c.Peers))
+	}
+	return nil
+}
+
+// Includes returns true if given peer is a canary.
+func (c *Canary) Includes(pid PeerID) bool {
+	if c == nil {
+		return false
+	}
+	id := pid.String()
+	for _, p := range c.Peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CanaryConfig holds configurations of the agent waiting for canaries.
+type CanaryConfig struct {
+	// Timeout is the time after the download is complete when the update
+	// is blocked if the canaries have not reported enough successes.
+	Timeout      int `json:"timeout"`       // in seconds
+	PollInterval int `json:"poll-interval"` // in seconds
+}
+
+// CanaryStatus is the deployment status of the canaries of an update, which
+// is aggregated by the server.
+type CanaryStatus struct {
+	UUID      string `json:"uuid"`
+	Version   uint64 `json:"version"`
+	Successes int    `json:"successes"`
+	Failures  int    `json:"failures"`
+}
+
+// canaryStatus returns the status of the canaries of given update version,
+// which are listed in the stored notification. The caller must hold the
+// lock.
+func (s *Server) canaryStatus(uuid string, version uint64) CanaryStatus {
+	cs := CanaryStatus{UUID: uuid, Version: version}
+	n, ok := s.updates[uuid]
+	ur, reported := s.reports[uuid]
+	if !ok || n.Canary == nil || !reported || ur.Version != version {
+		return cs
+	}
+	for _, pid := range n.Canary.Peers {
+		if r, ok := ur.Peers[pid]; ok {
+			if r.Success {
+				cs.Successes++
+			} else {
+				cs.Failures++
+			}
+		}
+	}
+	return cs
+}
+
+// fetchCanaryStatus gets the canary status of given update version from the
+// server.
+func (a *Agent) fetchCanaryStatus(uuid string, version uint64) (*CanaryStatus, error) {
+	url := fmt.Sprintf("http://%s/canary/%s?version=%d", a.server(), uuid, version)
+	code, body, err := a.httpClient.GetTimeout(nil, url, reportTimeout)
+	if err != nil {
+		return nil, err
+	} else if code != 200 {
+		return nil, fmt.Errorf("status code: %d", code)
+	}
+	var cs CanaryStatus
+	if err = json.Unmarshal(body, &cs); err != nil {
+		return nil, err
+	}
+	return &cs, nil
+}
+
+// canaryState returns UpdateWaiting if the canaries of given complete update
+// have not reported enough successes, or UpdateBlocked if they have not done
+// so before the timeout, with the reason. It returns an empty state if the
+// update can be deployed. The status is polled from the server, hence it must
+// be called without holding the lock of the update.
+func (a *Agent) canaryState(u *Update) (UpdateState, string) {
+	u.RLock()
+	c, uuid, version := u.Notification.Canary, u.Notification.UUID, u.Notification.Version
+	downloaded := u.Downloaded
+	complete := u.State == UpdateDownloaded || u.State == UpdateWaiting ||
+		u.State == UpdateBlocked || u.State == UpdateAwaitingApproval
+	cs, checked := u.canaryStatus, u.canaryChecked
+	u.RUnlock()
+	if c == nil || c.Override || c.MinSuccess <= 0 || c.Includes(a.ID) || !complete {
+		return "", ""
+	}
+
+	interval := time.Duration(a.Config.Canary.PollInterval) * time.Second
+	// the time of a failed attempt is kept as well, so that an unreachable
+	// server is not polled on every tick
+	if time.Since(checked) > interval && (cs.Version != version || cs.Successes < c.MinSuccess) {
+		if s, err := a.fetchCanaryStatus(uuid, version); err != nil {
+			log.Printf("failed getting canary status of uuid:%s version:%d - %v", uuid, version, err)
+		} else {
+			cs = *s
+		}
+		u.Lock()
+		u.canaryStatus, u.canaryChecked = cs, time.Now()
+		u.Unlock()
+	}
+	if cs.Version == version && cs.Successes >= c.MinSuccess {
+		return "", ""
+	}
+
+	timeout := time.Duration(a.Config.Canary.Timeout) * time.Second
+	if timeout > 0 && !downloaded.IsZero() && time.Since(downloaded) > timeout {
+		return UpdateBlocked, fmt.Sprintf("canaries have not reported %d successes within %v"+
+			" (successes:%d failures:%d)", c.MinSuccess, timeout, cs.Successes, cs.Failures)
+	}
+	return UpdateWaiting, fmt.Sprintf("waiting for %d successful canaries (successes:%d failures:%d)",
+		c.MinSuccess, cs.Successes, cs.Failures)
+}
+
+// serveCanaryStatus replies the canary status of the update whose UUID is
+// given in the path /canary/<uuid>.
+func (s *Server) serveCanaryStatus(ctx *fasthttp.RequestCtx, uuid string) {
+	version, err := ctx.QueryArgs().GetUint("version")
+	if err != nil {
+		ctx.SetStatusCode(400)
+		return
+	}
+	s.RLock()
+	cs := s.canaryStatus(uuid, uint64(version))
+	s.RUnlock()
+	doJSONWrite(ctx, 200, cs)
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCanaryValidate(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	c := &Canary{Peers: []string{pid.String()}, MinSuccess: 1}
+	if err := c.Validate(); err != nil {
+		t.Errorf("valid canary: %v", err)
+	}
+	if !c.Includes(pid) || c.Includes(PeerID{}) {
+		t.Error("wrong canary membership")
+	}
+	var none *Canary
+	if none.Validate() != nil || none.Includes(pid) {
+		t.Error("nil canary must be valid and empty")
+	}
+	for _, c := range []*Canary{
+		{Peers: []string{pid.String()}, MinSuccess: 2},
+		{Peers: []string{pid.String()}, MinSuccess: 0},
+		{Peers: []string{"xyz"}, MinSuccess: 1},
+		{Peers: []string{"0102"}, MinSuccess: 1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("invalid canary %+v passed validation", c)
+		}
+	}
+}
+
+func TestCanaryStatus(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	canaries := []string{"010203040506", "010203040507", "010203040508"}
+	s := &Server{
+		cfg: &ServerConfig{StunPassword: "secret"},
+		updates: map[string]*Notification{
+			uuid: {UUID: uuid, Version: 2, Canary: &Canary{Peers: canaries, MinSuccess: 2}},
+		},
+		reports:  make(map[string]*UpdateReports),
+		peerKeys: make(map[PeerID]ed25519.PublicKey),
+	}
+	keys := make(map[string]*PeerIdentity)
+	for _, p := range append(canaries, "0a0b0c0d0e0f") {
+		pub, key, _ := ed25519.GenerateKey(nil)
+		pid, _ := parsePeerID(p)
+		s.peerKeys[pid], keys[p] = pub, &PeerIdentity{key: key}
+	}
+	sign := func(pid string, ver uint64, success bool, password string, id *PeerIdentity) int {
+		body, _ := json.Marshal(DeployReport{PeerID: pid, UUID: uuid, Version: ver, Success: success,
+			Timestamp: time.Now()})
+		return s.serveReport(body, hmacSignature(body, password), id.signReport(body))
+	}
+	report := func(pid string, ver uint64, success bool, password string) int {
+		return sign(pid, ver, success, password, keys[pid])
+	}
+
+	if code := report(canaries[0], 2, true, "wrong"); code != 401 {
+		t.Errorf("unsigned report: status %d", code)
+	}
+
+	// a peer knowing the password cannot report for another one
+	if code := sign(canaries[0], 2, true, "secret", nil); code != 401 {
+		t.Errorf("report without peer signature: status %d", code)
+	}
+	if code := sign(canaries[0], 2, true, "secret", keys[canaries[1]]); code != 401 {
+		t.Errorf("report signed by another peer: status %d", code)
+	}
+	if code := sign("0f0e0d0c0b0a", 2, true, "secret", keys[canaries[0]]); code != 401 {
+		t.Errorf("report of a peer without pinned key: status %d", code)
+	}
+	report(canaries[0], 2, true, "secret")
+	report(canaries[1], 2, false, "secret")
+	report("0a0b0c0d0e0f", 2, true, "secret") // not a canary
+	if cs := s.canaryStatus(uuid, 2); cs.Successes != 1 || cs.Failures != 1 {
+		t.Errorf("wrong status %+v", cs)
+	}
+
+	// the latest report of a peer counts, and older versions are ignored
+	report(canaries[1], 2, true, "secret")
+	report(canaries[2], 1, true, "secret")
+	if cs := s.canaryStatus(uuid, 2); cs.Successes != 2 || cs.Failures != 0 {
+		t.Errorf("wrong status %+v", cs)
+	}
+	if cs := s.canaryStatus(uuid, 1); cs.Successes != 0 {
+		t.Errorf("wrong status of an old version %+v", cs)
+	}
+
+	// reports of unknown versions are refused, and a newer version resets
+	// the reports
+	if code := report(canaries[2], 3, true, "secret"); code != 404 {
+		t.Errorf("report of unknown version: status %d", code)
+	}
+	s.updates[uuid].Version = 3
+	report(canaries[2], 3, true, "secret")
+	if cs := s.canaryStatus(uuid, 2); cs.Successes != 0 {
+		t.Errorf("reports of an old version must be discarded %+v", cs)
+	}
+}
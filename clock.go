@@ -0,0 +1,182 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// buildTimestamp is the Unix time when the binary was built, which is set by
+// the build script, e.g. -ldflags "-X main.buildTimestamp=1530000000". A
+// clock behind it is certainly wrong.
+var buildTimestamp string
+
+const (
+	clockDefaultTolerance = 60 // in seconds
+
+	// unsyncedClockPrefix marks the log lines written while the clock is
+	// not known to be right.
+	unsyncedClockPrefix = "[unsynced clock] "
+)
+
+// attrServerTime is a comprehension-optional STUN attribute of the binding
+// responses, which carries the time of the server in Unix nanoseconds. It is
+// added before MESSAGE-INTEGRITY, hence it cannot be modified in transit.
+const attrServerTime stun.AttrType = 0x8f12
+
+// ServerTime is the time of the server when it sent a binding response.
+type ServerTime time.Time
+
+// AddTo adds ServerTime into STUN message.
+func (st ServerTime) AddTo(m *stun.Message) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Time(st).UnixNano()))
+	m.Add(attrServerTime, b)
+	return nil
+}
+
+// GetFrom gets ServerTime from STUN message.
+func (st *ServerTime) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrServerTime)
+	if err != nil {
+		return err
+	}
+	if len(b) != 8 {
+		return fmt.Errorf("length of server time (%d bytes) is not 8 bytes", len(b))
+	}
+	*st = ServerTime(time.Unix(0, int64(binary.BigEndian.Uint64(b))))
+	return nil
+}
+
+// ClockStatus is the state of the clock check.
+type ClockStatus struct {
+	Synced bool   `json:"synced"`
+	Source string `json:"source,omitempty"` // "build-time" or "server"
+
+	// Offset is how far the local clock is ahead of the server's, which is
+	// only set if the server has sent its time.
+	Offset  string    `json:"offset,omitempty"`
+	Checked time.Time `json:"checked,omitempty"` // of the offset
+}
+
+// ClockCheck tells whether the local clock can be trusted, e.g. a Raspberry
+// Pi without RTC boots in 1970 until NTP syncs its clock. The clock is synced
+// if the server confirmed it within the tolerance, or, until the server sends
+// its time, if it is after the build time of the binary. The timestamp-based
+// policies are deferred while the clock is not synced.
+type ClockCheck struct {
+	sync.Mutex
+	tolerance time.Duration
+	build     time.Time
+	now       func() time.Time
+
+	sent    time.Time     // of the latest binding request
+	offset  time.Duration // of the local clock from the server's
+	checked time.Time     // when the server time was received
+	synced  bool          // the state of the latest call of Synced
+}
+
+// NewClockCheck returns a clock check with given tolerance of the offset from
+// the server's clock, or clockDefaultTolerance if it is not positive.
+func NewClockCheck(tolerance time.Duration) *ClockCheck {
+	if tolerance <= 0 {
+		tolerance = clockDefaultTolerance * time.Second
+	}
+	c := &ClockCheck{tolerance: tolerance, now: time.Now, synced: true}
+	if ts, err := strconv.ParseInt(buildTimestamp, 10, 64); err == nil && ts > 0 {
+		c.build = time.Unix(ts, 0)
+	}
+	return c
+}
+
+// RequestSent records the time of a binding request, whose response carries
+// the server time.
+func (c *ClockCheck) RequestSent() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	c.sent = c.now()
+	c.Unlock()
+}
+
+// ServerTime records the time sent by the server in the response of the
+// latest binding request. The server time is taken in the middle of the round
+// trip, give or take half of it.
+func (c *ClockCheck) ServerTime(st time.Time) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := c.now()
+	rtt := time.Duration(0)
+	if !c.sent.IsZero() && !now.Before(c.sent) {
+		rtt = now.Sub(c.sent)
+	}
+	c.offset = now.Add(-rtt / 2).Sub(st)
+	c.checked = now
+}
+
+// Synced returns true if the local clock can be trusted. The transitions are
+// logged, and the log lines are prefixed while the clock is not synced.
+func (c *ClockCheck) Synced() bool {
+	if c == nil {
+		return true
+	}
+	c.Lock()
+	defer c.Unlock()
+	synced, source := c.state()
+	if synced != c.synced {
+		c.synced = synced
+		if synced {
+			log.SetPrefix("")
+			log.Printf("the clock is synced, source:%s", source)
+		} else {
+			log.Printf("WARNING: the clock is not synced, timestamp-based policies are deferred")
+			log.SetPrefix(unsyncedClockPrefix)
+		}
+	}
+	return synced
+}
+
+// state returns whether the clock is synced and the source of the decision.
+// The caller must hold the lock.
+func (c *ClockCheck) state() (bool, string) {
+	if !c.checked.IsZero() {
+		offset := c.offset
+		if offset < 0 {
+			offset = -offset
+		}
+		return offset <= c.tolerance, "server"
+	}
+	if !c.build.IsZero() {
+		return c.now().After(c.build), "build-time"
+	}
+	// neither the server nor the build time tells the clock is wrong
+	return true, ""
+}
+
+// Status returns the state of the clock check.
+func (c *ClockCheck) Status() ClockStatus {
+	if c == nil {
+		return ClockStatus{Synced: true}
+	}
+	c.Lock()
+	defer c.Unlock()
+	synced, source := c.state()
+	s := ClockStatus{Synced: synced, Source: source}
+	if !c.checked.IsZero() {
+		s.Offset, s.Checked = c.offset.String(), c.checked
+	}
+	return s
+}
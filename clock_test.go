@@ -0,0 +1,132 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestServerTimeAttribute(t *testing.T) {
+	for _, now := range []time.Time{
+		time.Unix(0, 0), // a server that booted without RTC
+		time.Date(2038, 1, 19, 3, 14, 8, 0, time.UTC), // past the 32-bit Unix time
+		time.Unix(1530000000, 123456789),
+	} {
+		msg, err := stun.Build(stun.TransactionID, stun.BindingSuccess, ServerTime(now),
+			stun.NewShortTermIntegrity(defaultStunPassword))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st ServerTime
+		if err = st.GetFrom(msg); err != nil || !time.Time(st).Equal(now) {
+			t.Errorf("server time is %v (%v), expected %v", time.Time(st), err, now)
+		}
+	}
+
+	// the binding responses carry the time of the server
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pid := PeerID{1}
+	s := &Server{
+		peers: SessionTable{pid: Session{conn.LocalAddr().(*net.UDPAddr)}},
+		cfg:   &ServerConfig{StunPassword: defaultStunPassword},
+	}
+	req, _ := stun.Build(stun.TransactionID, stun.BindingRequest, &pid)
+	before := time.Now()
+	var res stun.Message
+	if err = s.sendBindingSuccess(serverConn, pid, req, &res); err != nil {
+		t.Fatal(err)
+	}
+	var st ServerTime
+	if err = st.GetFrom(&res); err != nil {
+		t.Fatal(err)
+	} else if got := time.Time(st); got.Before(before) || got.After(time.Now()) {
+		t.Errorf("server time %v is not the time of the response", got)
+	}
+}
+
+func TestClockCheck(t *testing.T) {
+	defer log.SetPrefix("")
+	build := time.Unix(1530000000, 0)
+	now := time.Unix(5, 0) // a Raspberry Pi booting without RTC
+	c := NewClockCheck(time.Minute)
+	c.build, c.now = build, func() time.Time { return now }
+
+	if c.Synced() {
+		t.Error("clock behind the build time is synced")
+	}
+	if s := c.Status(); s.Synced || s.Source != "build-time" {
+		t.Errorf("unexpected status %+v", s)
+	}
+	if log.Prefix() != unsyncedClockPrefix {
+		t.Errorf("log lines are not marked while the clock is not synced")
+	}
+	now = build.Add(time.Hour) // NTP synced
+	if !c.Synced() || log.Prefix() != "" {
+		t.Error("clock after the build time is not synced")
+	}
+
+	// the server's clock is an hour behind, the local one is wrong although
+	// it is after the build time
+	c.RequestSent()
+	now = now.Add(2 * time.Second)
+	c.ServerTime(now.Add(-time.Hour))
+	if s := c.Status(); c.Synced() || s.Source != "server" || s.Offset != "59m59s" {
+		t.Errorf("clock ahead of the server is synced: %+v", s)
+	}
+
+	// the server's time was taken in the middle of the round trip
+	c.RequestSent()
+	sent := now
+	now = now.Add(4 * time.Second)
+	c.ServerTime(sent.Add(2 * time.Second))
+	if s := c.Status(); !c.Synced() || s.Offset != "0s" {
+		t.Errorf("clock agreeing with the server is not synced: %+v", s)
+	}
+
+	// a check without build time nor server time trusts the clock
+	if c = NewClockCheck(0); !c.Synced() || c.tolerance != clockDefaultTolerance*time.Second {
+		t.Error("clock is not synced by default")
+	}
+	if c = nil; !c.Synced() {
+		t.Error("clock is not synced without check")
+	}
+}
+
+func TestScheduledUnsyncedClock(t *testing.T) {
+	defer log.SetPrefix("")
+	created := time.Unix(1530000000, 0)
+	c := NewClockCheck(time.Minute)
+	now := created.Add(time.Hour)
+	c.now = func() time.Time { return now }
+	c.ServerTime(now.Add(-24 * time.Hour)) // the local clock is a day ahead
+
+	a := &Agent{Config: &Config{Schedule: ScheduleConfig{ClockSkew: 300, FallbackDelay: 3600}}, clock: c}
+	u := &Update{
+		agent:        a,
+		Notification: Notification{CreationDate: created.Unix(), NotBefore: created.Add(time.Minute).Unix()},
+		Downloaded:   time.Now(),
+	}
+	if at := u.scheduled(); !at.Equal(u.Downloaded.Add(time.Hour)) {
+		t.Errorf("update is scheduled for %v with an unsynced clock", at)
+	}
+	c.ServerTime(now)
+	if at := u.scheduled(); !at.Equal(time.Unix(u.Notification.NotBefore, 0)) {
+		t.Errorf("update is scheduled for %v with a synced clock", at)
+	}
+}
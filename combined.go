@@ -0,0 +1,49 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// embeddedServerConfig returns the configurations of the server run by the
+// combined command: the server defaults, with the public key and the STUN
+// password of the agent and a database in its data directory, overridden by
+// the embedded-server section. The server shares the logger of the agent.
+func (cfg *Config) embeddedServerConfig() (*ServerConfig, error) {
+	scfg := DefaultServerConfig()
+	scfg.Address = fmt.Sprintf(":%d", defaultServerPort)
+	scfg.Database = filepath.Join(cfg.DataDir, "server.db")
+	scfg.PublicKey = cfg.PublicKey
+	scfg.StunPassword = cfg.Overlay.StunPassword
+	if len(cfg.EmbeddedServer) > 0 {
+		if err := json.Unmarshal(cfg.EmbeddedServer, scfg); err != nil {
+			return nil, errors.Wrap(err, "invalid embedded-server config")
+		}
+	}
+	scfg.Log = cfg.logConfig()
+	return scfg, nil
+}
+
+// loopbackAddress returns the address where the agent reaches a server
+// listening on given address in the same process, i.e. on the loopback
+// interface if the server listens on every interface.
+func loopbackAddress(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid server address %s", addr)
+	}
+	if ip := net.ParseIP(host); host == "" || ip.Equal(net.IPv4zero) {
+		host = "127.0.0.1"
+	} else if ip.Equal(net.IPv6unspecified) {
+		host = "::1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
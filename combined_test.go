@@ -0,0 +1,53 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedServerConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DataDir = "/var/lib/p2pupdate"
+	cfg.Overlay.StunPassword = "secret"
+	scfg, err := cfg.embeddedServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scfg.Address != ":3478" || scfg.Database != filepath.Join(cfg.DataDir, "server.db") ||
+		scfg.StunPassword != "secret" || scfg.PublicKey != cfg.PublicKey {
+		t.Errorf("unexpected server config %+v", scfg)
+	}
+
+	cfg.EmbeddedServer = []byte(`{"address":"127.0.0.1:4000","session-page-size":10}`)
+	if scfg, err = cfg.embeddedServerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if scfg.Address != "127.0.0.1:4000" || scfg.SessionPageSize != 10 || scfg.StunPassword != "secret" {
+		t.Errorf("embedded-server section is not applied: %+v", scfg)
+	}
+	cfg.EmbeddedServer = []byte(`[]`)
+	if _, err = cfg.embeddedServerConfig(); err == nil {
+		t.Error("invalid embedded-server section is accepted")
+	}
+}
+
+func TestLoopbackAddress(t *testing.T) {
+	for addr, expected := range map[string]string{
+		":3478":          "127.0.0.1:3478",
+		"0.0.0.0:3478":   "127.0.0.1:3478",
+		"[::]:3478":      "[::1]:3478",
+		"10.0.0.1:3478":  "10.0.0.1:3478",
+		"localhost:3478": "localhost:3478",
+	} {
+		if got, err := loopbackAddress(addr); err != nil || got != expected {
+			t.Errorf("loopback address of %s is %s, expected %s: %v", addr, got, expected, err)
+		}
+	}
+	if _, err := loopbackAddress("3478"); err == nil {
+		t.Error("invalid address is accepted")
+	}
+}
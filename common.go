@@ -9,7 +9,9 @@ import (
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"regexp"
@@ -28,11 +30,17 @@ const (
 
 	// DefaultPieceLength is the default length of BitTorrent file-piece
 	DefaultPieceLength = 32 * 1024
+
+	// MinPieceLength and MaxPieceLength are the bounds of the length of
+	// BitTorrent file-piece
+	MinPieceLength = 16 * 1024
+	MaxPieceLength = 16 * 1024 * 1024
 )
 
 const (
-	signatureName = "org.fruit-testbed"
-	softwareName  = "fruit/p2p-update"
+	signatureName   = "org.fruit-testbed"
+	softwareName    = "fruit/p2p-update"
+	softwareVersion = "0.1.2"
 
 	defaultServerAddr = "fruit-testbed.org"
 	defaultServerPort = 3478
@@ -40,7 +48,13 @@ const (
 	defaultStunPassword   = "P2PupdateIsR0ck"
 	stunMaxPacketDataSize = 56 * 1024
 
+	// defaultTTL is the hop-count of overlay data messages at origin, and
+	// of messages sent by peers that do not support the TTL attribute.
+	defaultTTL = 4
+
 	defaultUnixSocket = "/var/run/p2pupdate.sock"
+	defaultDataDir    = "/var/lib/p2pupdate"
+	defaultLogFile    = "/var/log/p2pupdate.log"
 )
 
 var (
@@ -110,16 +124,154 @@ func (tp *TorrentPorts) AddTo(m *stun.Message) error {
 // GetFrom gets TorrentPorts from STUN message.
 func (tp *TorrentPorts) GetFrom(m *stun.Message) error {
 	b, err := m.Get(stun.AttrEvenPort)
-	if err == nil {
-		tp[0] = int(binary.LittleEndian.Uint32(b[:4]))
-		tp[1] = int(binary.LittleEndian.Uint32(b[4:]))
+	if err != nil {
+		return err
+	}
+	if len(b) != 8 {
+		return fmt.Errorf("length of torrent ports (%d bytes) is not 8 bytes", len(b))
+	}
+	tp[0] = int(binary.LittleEndian.Uint32(b[:4]))
+	tp[1] = int(binary.LittleEndian.Uint32(b[4:]))
+	return nil
+}
+
+// attrTorrentIPv6 is a comprehension-optional STUN attribute, hence it is
+// ignored by servers that do not support IPv6 torrent addresses.
+const attrTorrentIPv6 stun.AttrType = 0x8f06
+
+// TorrentIPv6 holds the global IPv6 address of torrent client. The address is
+// not translated, hence the peers should use the internal torrent port.
+type TorrentIPv6 net.IP
+
+// AddTo adds TorrentIPv6 into STUN message if it is an IPv6 address.
+func (ip TorrentIPv6) AddTo(m *stun.Message) error {
+	if len(ip) == net.IPv6len && net.IP(ip).To4() == nil {
+		m.Add(attrTorrentIPv6, ip)
+	}
+	return nil
+}
+
+// GetFrom gets TorrentIPv6 from STUN message.
+func (ip *TorrentIPv6) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrTorrentIPv6)
+	if err != nil {
+		return err
+	}
+	if len(b) != net.IPv6len {
+		return fmt.Errorf("length of torrent IPv6 (%d bytes) is not 16 bytes", len(b))
 	}
+	*ip = TorrentIPv6(append([]byte(nil), b...))
+	return nil
+}
+
+// attrTTL is a comprehension-optional STUN attribute holding the hop-count
+// of an overlay data message. It is added before MESSAGE-INTEGRITY, whose
+// integrity only comes from the shared STUN password: it cannot be modified
+// by outsiders, but every forwarder signs the message again with its own
+// TTL, hence any peer can raise it.
+const attrTTL stun.AttrType = 0x8f07
+
+// TTL is the hop-count of an overlay data message, which is decremented at
+// each forwarding hop. A message whose TTL is zero is dropped.
+type TTL uint8
+
+// AddTo adds TTL into STUN message.
+func (ttl TTL) AddTo(m *stun.Message) error {
+	m.Add(attrTTL, []byte{byte(ttl)})
+	return nil
+}
+
+// GetFrom gets TTL from STUN message.
+func (ttl *TTL) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrTTL)
+	if err != nil {
+		return err
+	}
+	if len(b) != 1 {
+		return fmt.Errorf("length of TTL (%d bytes) is not 1 byte", len(b))
+	}
+	*ttl = TTL(b[0])
+	return nil
+}
+
+// attrSessionOffset and attrSessionNext are comprehension-optional STUN
+// attributes of the paginated session table. A binding request carries the
+// offset of the requested page, and a binding success response carries the
+// offset of its page and, if the table has more entries, the offset of the
+// next page.
+const (
+	attrSessionOffset stun.AttrType = 0x8f08
+	attrSessionNext   stun.AttrType = 0x8f09
+)
+
+// SessionOffset is the offset of a page of the session table.
+type SessionOffset uint32
+
+// AddTo adds SessionOffset into STUN message.
+func (o SessionOffset) AddTo(m *stun.Message) error {
+	return addUint32(m, attrSessionOffset, uint32(o))
+}
+
+// GetFrom gets SessionOffset from STUN message.
+func (o *SessionOffset) GetFrom(m *stun.Message) error {
+	v, err := getUint32(m, attrSessionOffset)
+	*o = SessionOffset(v)
+	return err
+}
+
+// SessionNext is the offset of the next page of the session table.
+type SessionNext uint32
+
+// AddTo adds SessionNext into STUN message.
+func (o SessionNext) AddTo(m *stun.Message) error {
+	return addUint32(m, attrSessionNext, uint32(o))
+}
+
+// GetFrom gets SessionNext from STUN message.
+func (o *SessionNext) GetFrom(m *stun.Message) error {
+	v, err := getUint32(m, attrSessionNext)
+	*o = SessionNext(v)
 	return err
 }
 
-// Session is a peer's session
+func addUint32(m *stun.Message, t stun.AttrType, v uint32) error {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	m.Add(t, b)
+	return nil
+}
+
+func getUint32(m *stun.Message, t stun.AttrType) (uint32, error) {
+	b, err := m.Get(t)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 4 {
+		return 0, fmt.Errorf("length of %v (%d bytes) is not 4 bytes", t, len(b))
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+// Session is a peer's session, which consists of
+// [external-addr, internal-addr, torrent-external-addr, torrent-internal-addr]
+// and an optional torrent-ipv6-addr.
 type Session []*net.UDPAddr
 
+// TorrentAddrs returns the torrent addresses of the session.
+func (s Session) TorrentAddrs() []*net.UDPAddr {
+	if len(s) < 3 {
+		return nil
+	}
+	return s[2:]
+}
+
+// SameLAN returns true if the peer of this session is behind the same NAT as
+// given external address, and its internal address is a private one that can
+// be dialed directly on the LAN.
+func (s Session) SameLAN(external *net.UDPAddr) bool {
+	return len(s) >= 2 && external != nil && s[0].IP.Equal(external.IP) && isPrivateIP(s[1].IP)
+}
+
 // Equal returns true of this and given sessions are the same.
 func (s Session) Equal(ss Session) bool {
 	if len(s) != len(ss) {
@@ -133,8 +285,7 @@ func (s Session) Equal(ss Session) bool {
 	return true
 }
 
-// SessionTable is a map whose keys are Peer IDs
-// and values are pairs of [external-addr, internal-addr].
+// SessionTable is a map whose keys are Peer IDs and values are sessions.
 type SessionTable map[PeerID]Session
 
 // JSON marshals the SessionTable to JSON and then returns it.
@@ -189,34 +340,36 @@ func GetSessionTableFrom(m *stun.Message) (*SessionTable, error) {
 		err  error
 	)
 
-	if data, err = m.Get(stun.AttrData); err == nil {
+	if data, err = GetPayloadFrom(m); err == nil {
 		err = msgpack.Unmarshal(data, &st)
 	}
 	return &st, err
 }
 
+// validateMessage returns a ValidationError if given message is not of given
+// type, if any, or if its username, fingerprint or integrity is invalid.
 func validateMessage(m *stun.Message, t *stun.MessageType, password string) error {
 	var (
 		err error
 	)
 
 	if t != nil && (m.Type.Method != t.Method || m.Type.Class != t.Class) {
-		return fmt.Errorf("incorrect message type, expected %v but got %v",
-			*t, m.Type)
+		return &ValidationError{ValidationType, fmt.Errorf("incorrect message type, expected %v but got %v",
+			*t, m.Type)}
 	}
 
 	var username stun.Username
 	if err = username.GetFrom(m); err != nil {
-		return fmt.Errorf("invalid username: %v", err)
+		return &ValidationError{ValidationUsername, fmt.Errorf("invalid username: %v", err)}
 	}
 
 	if err = stun.Fingerprint.Check(m); err != nil {
-		return fmt.Errorf("fingerprint is incorrect: %v", err)
+		return &ValidationError{ValidationFingerprint, fmt.Errorf("fingerprint is incorrect: %v", err)}
 	}
 
 	i := stun.NewShortTermIntegrity(password)
 	if err = i.Check(m); err != nil {
-		return fmt.Errorf("Integrity bad: %v", err)
+		return &ValidationError{ValidationIntegrity, fmt.Errorf("Integrity bad: %v", err)}
 	}
 
 	return nil
@@ -229,30 +382,50 @@ func RaspberryPiSerial() (*PeerID, error) {
 		return nil, errors.Wrap(err, "cannot open /proc/cpuinfo")
 	}
 	defer file.Close()
+	return parseCPUInfoSerial(file)
+}
 
-	scanner := bufio.NewScanner(file)
+// parseCPUInfoSerial reads cpuinfo formatted data from given reader and returns
+// the low 6 bytes of the board serial number as a PeerID.
+//
+// The serial is parsed as a hexadecimal number, hence leading zeros do not
+// matter and odd-length serials (e.g. 000000000bc12345 trimmed to bc12345)
+// derive the same PeerID as their zero-padded form. Pi 4 serials such as
+// 10000000abc12345 are truncated to their low 6 bytes.
+func parseCPUInfoSerial(r io.Reader) (*PeerID, error) {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if len(line) > 10 && line[0:7] == "Serial\t" {
-			var (
-				pid    PeerID
-				serial []byte
-			)
-
-			s := strings.TrimLeft(strings.Split(line, " ")[1], "0")
-			if len(s)%2 == 1 {
-				s = fmt.Sprintf("0%s", s)
-			}
-			if serial, err = hex.DecodeString(s); err != nil {
-				return nil, errors.Wrapf(err, "failed converting %s to []byte", s)
-			}
-			j := len(pid) - 1
-			for i := len(serial) - 1; i >= 0 && j >= 0; i-- {
-				pid[j] = serial[i]
-				j--
-			}
-			return &pid, nil
+		if !strings.HasPrefix(line, "Serial") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+
+		var (
+			pid    PeerID
+			serial []byte
+			err    error
+		)
+
+		s := strings.TrimLeft(strings.TrimSpace(line[i+1:]), "0")
+		if len(s) > 16 {
+			return nil, fmt.Errorf("serial number %s is longer than 8 bytes", s)
 		}
+		if len(s)%2 == 1 {
+			s = fmt.Sprintf("0%s", s)
+		}
+		if serial, err = hex.DecodeString(s); err != nil {
+			return nil, errors.Wrapf(err, "failed converting %s to []byte", s)
+		}
+		j := len(pid) - 1
+		for i := len(serial) - 1; i >= 0 && j >= 0; i-- {
+			pid[j] = serial[i]
+			j--
+		}
+		return &pid, nil
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, errors.Wrap(err, "failed to read serial number")
@@ -260,9 +433,72 @@ func RaspberryPiSerial() (*PeerID, error) {
 	return nil, errors.New("cannot find serial number from /proc/cpuinfo")
 }
 
+// interfaceInfo holds a network interface and its addresses, which are used
+// to select the interface that identifies the local machine.
+type interfaceInfo struct {
+	net.Interface
+	Addrs []net.Addr
+}
+
+// virtualInterfacePrefixes are the name prefixes of loopback, bridge, veth,
+// tun/tap and container interfaces whose MAC addresses are not stable.
+var virtualInterfacePrefixes = []string{
+	"lo", "docker", "br-", "veth", "virbr", "tun", "tap", "utun", "vmnet",
+}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRoutableAddr(addrs []net.Addr) bool {
+	for _, addr := range addrs {
+		if ip, _, err := net.ParseCIDR(addr.String()); err == nil && ip.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+// selectInterface returns the interface whose MAC address should identify the
+// local machine, or nil if none of given interfaces is up with a MAC address.
+// Physical interfaces having a routable address are preferred, followed by any
+// physical interface. If there is none, then it falls back to the first
+// active interface.
+func selectInterface(ifaces []interfaceInfo) *interfaceInfo {
+	var physical, fallback *interfaceInfo
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if iface.Flags&net.FlagUp == 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		if fallback == nil {
+			fallback = iface
+		}
+		if iface.Flags&net.FlagLoopback != 0 || isVirtualInterface(iface.Name) {
+			continue
+		}
+		if hasRoutableAddr(iface.Addrs) {
+			return iface
+		}
+		if physical == nil {
+			physical = iface
+		}
+	}
+	if physical != nil {
+		return physical
+	}
+	return fallback
+}
+
 // ActiveMacAddress returns a MAC address of active network interface.
-// Note that ActiveMacAddress iterates the interfaces returned by `net.Interfaces`
-// from first to the last, and returns the first active interface.
+// Note that ActiveMacAddress prefers physical interfaces having a routable
+// address over loopback, bridge, veth, tun/tap, and docker interfaces
+// (see selectInterface).
 func ActiveMacAddress() ([]byte, error) {
 	var (
 		ifaces []net.Interface
@@ -271,11 +507,15 @@ func ActiveMacAddress() ([]byte, error) {
 	if ifaces, err = net.Interfaces(); err != nil {
 		return nil, err
 	}
+	infos := make([]interfaceInfo, 0, len(ifaces))
 	for _, i := range ifaces {
-		if i.Flags&net.FlagUp != 0 && bytes.Compare(i.HardwareAddr, nil) != 0 {
-			// Don't use random as we have a real address
-			return i.HardwareAddr, nil
-		}
+		info := interfaceInfo{Interface: i}
+		info.Addrs, _ = i.Addrs()
+		infos = append(infos, info)
+	}
+	if iface := selectInterface(infos); iface != nil {
+		log.Printf("using MAC address %s of interface %s", iface.HardwareAddr, iface.Name)
+		return iface.HardwareAddr, nil
 	}
 	return nil, errors.New("No active ethernet available")
 }
@@ -296,6 +536,65 @@ func IPv4ofInterface(name string) net.IP {
 	return nil
 }
 
+// GlobalIPv6 returns the first global unicast IPv6 of given interface, or of
+// any non-virtual interface if name is empty. It returns nil if there isn't.
+func GlobalIPv6(name string) net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		if name != "" && iface.Name != name {
+			continue
+		}
+		if name == "" && (isVirtualInterface(iface.Name) || iface.Flags&net.FlagUp == 0) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ip, _, err := net.ParseCIDR(addr.String())
+			if err == nil && ip.To4() == nil && ip.IsGlobalUnicast() && !isUniqueLocal(ip) {
+				return ip
+			}
+		}
+	}
+	return nil
+}
+
+// isUniqueLocal returns true if given IP is an IPv6 unique local address
+// (fc00::/7), which is not routable on the internet.
+func isUniqueLocal(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
+}
+
+// privateNetworks are the address ranges that are only reachable within a LAN,
+// including the shared address space of carrier-grade NATs.
+var privateNetworks = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10",
+		"169.254.0.0/16", "fc00::/7", "fe80::/10",
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPrivateIP returns true if given IP is in a private, shared or link-local
+// range.
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // LocalIPv4 returns a local IPv4 address that can be used to connect to internet.
 //
 // This function requires root privilege to work properly because it uses kernel
@@ -337,7 +636,8 @@ func LocalIPv4() net.IP {
 
 // LocalPeerID returns a PeerID of local machine.
 // If the machine is Raspberry Pi, then it returns the board serial number.
-// Otherwise, it returns the MAC address of the first active network interface.
+// Otherwise, it returns the MAC address of the first active network interface,
+// or else the hash of the machine ID or of the hostname.
 func LocalPeerID() (*PeerID, error) {
 	if serial, err := RaspberryPiSerial(); err == nil {
 		return serial, nil
@@ -350,7 +650,17 @@ func LocalPeerID() (*PeerID, error) {
 		}
 		return &pid, nil
 	}
-	return nil, errors.New("CPU serial and active ethernet are not available")
+
+	// e.g. laptops and CI runners on Wi-Fi or without /proc/cpuinfo
+	if id, err := machineID(); err == nil {
+		log.Println("using the hash of the machine ID as peer ID")
+		return hashPeerID(id), nil
+	}
+	if host, err := os.Hostname(); err == nil && len(host) > 0 {
+		log.Printf("using the hash of hostname %s as peer ID", host)
+		return hashPeerID(host), nil
+	}
+	return nil, errors.New("CPU serial, active ethernet, machine ID and hostname are not available")
 }
 
 // ExecEvery periodically executes function `f` every `t`. It returns a channel
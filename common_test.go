@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/gortc/stun"
+	"github.com/vmihailenco/msgpack"
+)
+
+const cpuinfoPi3 = `processor	: 0
+model name	: ARMv7 Processor rev 4 (v7l)
+BogoMIPS	: 38.40
+Features	: half thumb fastmult vfp edsp neon vfpv3 tls vfpv4 idiva idivt vfpd32 lpae evtstrm crc32
+CPU implementer	: 0x41
+CPU architecture: 7
+CPU variant	: 0x0
+CPU part	: 0xd03
+CPU revision	: 4
+
+Hardware	: BCM2835
+Revision	: a02082
+Serial		: %s
+`
+
+const cpuinfoPi4 = `processor	: 3
+model name	: ARMv7 Processor rev 3 (v7l)
+BogoMIPS	: 108.00
+Features	: half thumb fastmult vfp edsp neon vfpv3 tls vfpv4 idiva idivt vfpd32 lpae evtstrm crc32
+CPU implementer	: 0x41
+CPU architecture: 7
+CPU variant	: 0x0
+CPU part	: 0xd08
+CPU revision	: 3
+
+Hardware	: BCM2711
+Revision	: c03111
+Serial		: %s
+Model		: Raspberry Pi 4 Model B Rev 1.1
+`
+
+func TestParseCPUInfoSerial(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpuinfo string
+		serial  string
+		pid     string
+		fail    bool
+	}{
+		{"pi3", cpuinfoPi3, "00000000abc12345", "0000abc12345", false},
+		{"pi3 odd length", cpuinfoPi3, "000000000bc12345", "00000bc12345", false},
+		{"pi3 short", cpuinfoPi3, "0000000000000005", "000000000005", false},
+		{"pi3 all zeros", cpuinfoPi3, "0000000000000000", "000000000000", false},
+		{"pi4", cpuinfoPi4, "10000000abc12345", "0000abc12345", false},
+		{"pi4 full", cpuinfoPi4, "1000a1b2c3d4e5f6", "a1b2c3d4e5f6", false},
+		{"crlf", cpuinfoPi3, "00000000abc12345\r", "0000abc12345", false},
+		{"not hex", cpuinfoPi3, "00000000xyz12345", "", true},
+		{"too long", cpuinfoPi3, "1100000000abc12345", "", true},
+		{"no serial", "processor\t: 0\nHardware\t: BCM2835\n", "", "", true},
+	}
+
+	for _, test := range tests {
+		cpuinfo := test.cpuinfo
+		if strings.Contains(cpuinfo, "%s") {
+			cpuinfo = strings.Replace(cpuinfo, "%s", test.serial, 1)
+		}
+		pid, err := parseCPUInfoSerial(strings.NewReader(cpuinfo))
+		if test.fail {
+			if err == nil {
+				t.Errorf("%s: expected error, got PeerID %s", test.name, pid)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if pid.String() != test.pid {
+			t.Errorf("%s: expected PeerID %s, got %s", test.name, test.pid, pid)
+		}
+	}
+}
+
+func testInterface(name string, flags net.Flags, mac string, addrs ...string) interfaceInfo {
+	iface := interfaceInfo{
+		Interface: net.Interface{
+			Name:  name,
+			Flags: flags,
+		},
+	}
+	if mac != "" {
+		iface.HardwareAddr, _ = net.ParseMAC(mac)
+	}
+	for _, addr := range addrs {
+		ip, ipnet, _ := net.ParseCIDR(addr)
+		ipnet.IP = ip
+		iface.Addrs = append(iface.Addrs, ipnet)
+	}
+	return iface
+}
+
+func TestSelectInterface(t *testing.T) {
+	var (
+		up       = net.FlagUp | net.FlagBroadcast
+		loopback = testInterface("lo", net.FlagUp|net.FlagLoopback, "", "127.0.0.1/8")
+		docker   = testInterface("docker0", up, "02:42:ac:11:00:01", "172.17.0.1/16")
+		veth     = testInterface("veth12ab", up, "3a:1b:2c:3d:4e:5f", "fe80::381b:2cff:fe3d:4e5f/64")
+		eth0     = testInterface("eth0", up, "b8:27:eb:00:00:01", "192.168.1.10/24")
+		eth0Down = testInterface("eth0", net.FlagBroadcast, "b8:27:eb:00:00:01")
+		wlan0    = testInterface("wlan0", up, "b8:27:eb:00:00:02", "fe80::ba27:ebff:fe00:2/64")
+		wlan0IP  = testInterface("wlan0", up, "b8:27:eb:00:00:02", "10.0.0.5/8")
+	)
+
+	tests := []struct {
+		name     string
+		ifaces   []interfaceInfo
+		expected string
+	}{
+		{"docker first", []interfaceInfo{loopback, docker, veth, eth0}, "eth0"},
+		{"routable preferred", []interfaceInfo{loopback, wlan0, eth0}, "eth0"},
+		{"physical without address", []interfaceInfo{loopback, docker, wlan0}, "wlan0"},
+		{"down ignored", []interfaceInfo{eth0Down, wlan0IP}, "wlan0"},
+		{"fallback to first active", []interfaceInfo{loopback, veth, docker}, "veth12ab"},
+		{"nothing", []interfaceInfo{loopback, eth0Down}, ""},
+	}
+
+	for _, test := range tests {
+		iface := selectInterface(test.ifaces)
+		name := ""
+		if iface != nil {
+			name = iface.Name
+		}
+		if name != test.expected {
+			t.Errorf("%s: expected interface '%s', got '%s'", test.name, test.expected, name)
+		}
+	}
+}
+
+func TestSessionTableIPv6(t *testing.T) {
+	var (
+		pid   = PeerID{1, 2, 3, 4, 5, 6}
+		ipv6  = TorrentIPv6(net.ParseIP("2001:db8::1"))
+		ports = TorrentPorts{6881, 6881}
+		res   TorrentIPv6
+	)
+
+	m, err := stun.Build(stun.BindingRequest, &ports, ipv6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = res.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if !net.IP(res).Equal(net.IP(ipv6)) {
+		t.Errorf("expected torrent IPv6 %s, got %s", net.IP(ipv6), net.IP(res))
+	}
+
+	// an IPv4 address is never sent as torrent IPv6
+	m, _ = stun.Build(stun.BindingRequest, TorrentIPv6(net.ParseIP("10.0.0.1")))
+	if err = res.GetFrom(m); err == nil {
+		t.Error("IPv4 address must not be added as torrent IPv6")
+	}
+
+	st := SessionTable{pid: Session{
+		{IP: net.ParseIP("1.2.3.4"), Port: 3478},
+		{IP: net.ParseIP("10.0.0.1"), Port: 3478},
+		{IP: net.ParseIP("1.2.3.4"), Port: 6881},
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.IP(ipv6), Port: 6881},
+	}}
+	b, err := msgpack.Marshal(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded SessionTable
+	if err = msgpack.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	addrs := decoded[pid].TorrentAddrs()
+	if len(addrs) != 3 || addrs[2].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected torrent addresses: %v", addrs)
+	}
+	if js := string(st.JSON()); !strings.Contains(js, `"[2001:db8::1]:6881"`) {
+		t.Errorf("IPv6 address is not bracketed: %s", js)
+	}
+}
+
+func TestSessionSameLAN(t *testing.T) {
+	external := &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 3478}
+	sess := Session{
+		{IP: net.ParseIP("1.2.3.4"), Port: 3479},
+		{IP: net.ParseIP("192.168.1.20"), Port: 3478},
+	}
+	if !sess.SameLAN(external) {
+		t.Error("peer behind the same NAT is not on the same LAN")
+	}
+	if sess.SameLAN(&net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 3478}) {
+		t.Error("peer behind another NAT is on the same LAN")
+	}
+	if sess.SameLAN(nil) {
+		t.Error("unknown external address must not be on the same LAN")
+	}
+
+	// the internal address must be private to be dialed
+	sess[1].IP = net.ParseIP("8.8.8.8")
+	if sess.SameLAN(external) {
+		t.Error("peer with public internal address is on the same LAN")
+	}
+	for _, ip := range []string{"10.1.2.3", "172.31.0.1", "100.64.0.1", "169.254.1.1", "fd00::1", "fe80::1"} {
+		if !isPrivateIP(net.ParseIP(ip)) {
+			t.Errorf("%s is not private", ip)
+		}
+	}
+	for _, ip := range []string{"172.32.0.1", "100.128.0.1"} {
+		if isPrivateIP(net.ParseIP(ip)) {
+			t.Errorf("%s is private", ip)
+		}
+	}
+
+	// messages are sent to the internal address of a peer on the same LAN
+	// only, not to a public internal address
+	overlay := &OverlayConn{externalAddr: external}
+	if addr := overlay.peerAddr(sess); addr != sess[0] {
+		t.Errorf("message to a peer with a public internal address is sent to %s", addr)
+	}
+	sess[1] = &net.UDPAddr{IP: net.ParseIP("100.64.1.20"), Port: 3478}
+	if addr := overlay.peerAddr(sess); addr != sess[1] {
+		t.Errorf("message to a peer behind the same NAT is sent to %s", addr)
+	}
+	sess[0] = &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 3479}
+	if addr := overlay.peerAddr(sess); addr != sess[0] {
+		t.Errorf("message to a peer behind another NAT is sent to %s", addr)
+	}
+	if addr := (&OverlayConn{}).peerAddr(sess); addr != sess[0] {
+		t.Errorf("message with an unknown external address is sent to %s", addr)
+	}
+}
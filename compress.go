@@ -0,0 +1,140 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/gortc/stun"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	// defaultCompressThreshold is the size in bytes from which an overlay
+	// payload is compressed.
+	defaultCompressThreshold = 512
+
+	// maxDecompressedSize is the ceiling of a decompressed payload, which
+	// prevents a small message from exhausting the memory.
+	maxDecompressedSize = 1024 * 1024
+)
+
+// attrEncoding is a comprehension-optional STUN attribute holding the
+// one-byte encoding of AttrData. It is only added to the compressed
+// payloads, hence the raw ones are read by the peers that do not support it.
+const attrEncoding stun.AttrType = 0x8f0a
+
+// Encoding is the encoding of an overlay payload.
+type Encoding uint8
+
+// The encodings of overlay payloads.
+const (
+	EncodingRaw  Encoding = 0
+	EncodingZlib Encoding = 1
+)
+
+// CompressionConfig holds configurations of the compression of the overlay
+// payloads, i.e. data messages and session tables.
+type CompressionConfig struct {
+	// Disabled sends all payloads raw, e.g. for debugging. The compressed
+	// payloads are still read.
+	Disabled bool `json:"disabled"`
+
+	// Threshold is the size in bytes from which a payload is compressed,
+	// which is defaultCompressThreshold if 0.
+	Threshold int `json:"threshold"`
+}
+
+// EncodedPayload is an overlay payload with its encoding, which is written on
+// a STUN message as AttrData and attrEncoding.
+type EncodedPayload struct {
+	Data     []byte
+	Encoding Encoding
+}
+
+// AddTo adds the payload into STUN message.
+func (p EncodedPayload) AddTo(m *stun.Message) error {
+	m.Add(stun.AttrData, p.Data)
+	if p.Encoding != EncodingRaw {
+		m.Add(attrEncoding, []byte{byte(p.Encoding)})
+	}
+	return nil
+}
+
+// encode returns given payload compressed if it is above the threshold and
+// compression shrinks it, otherwise the raw payload.
+func (c CompressionConfig) encode(data []byte) EncodedPayload {
+	threshold := c.Threshold
+	if threshold <= 0 {
+		threshold = defaultCompressThreshold
+	}
+	if c.Disabled || len(data) < threshold {
+		return EncodedPayload{Data: data}
+	}
+	var b bytes.Buffer
+	w, _ := zlib.NewWriterLevel(&b, zlib.BestCompression)
+	if _, err := w.Write(data); err != nil {
+		return EncodedPayload{Data: data}
+	}
+	if err := w.Close(); err != nil || b.Len() >= len(data) {
+		return EncodedPayload{Data: data}
+	}
+	metrics.Add("overlay.compression_saved_bytes", int64(len(data)-b.Len()))
+	return EncodedPayload{Data: b.Bytes(), Encoding: EncodingZlib}
+}
+
+// encodeSessionTable returns the MessagePack of given session table, which
+// is encoded as the other payloads.
+func (c CompressionConfig) encodeSessionTable(st *SessionTable) (EncodedPayload, error) {
+	data, err := msgpack.Marshal(st)
+	if err != nil {
+		return EncodedPayload{}, err
+	}
+	return c.encode(data), nil
+}
+
+// decodePayload returns the decoded payload of given encoding. It returns an
+// error if the decoded payload exceeds maxDecompressedSize.
+func decodePayload(data []byte, enc Encoding) ([]byte, error) {
+	switch enc {
+	case EncodingRaw:
+		return data, nil
+	case EncodingZlib:
+		r, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxDecompressedSize {
+			return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxDecompressedSize)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown payload encoding %d", enc)
+}
+
+// GetPayloadFrom returns the decoded AttrData of given STUN message.
+func GetPayloadFrom(m *stun.Message) ([]byte, error) {
+	data, err := m.Get(stun.AttrData)
+	if err != nil {
+		return nil, err
+	}
+	enc := EncodingRaw
+	if b, err := m.Get(attrEncoding); err == nil {
+		if len(b) != 1 {
+			return nil, fmt.Errorf("length of encoding (%d bytes) is not 1 byte", len(b))
+		}
+		enc = Encoding(b[0])
+	}
+	return decodePayload(data, enc)
+}
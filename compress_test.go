@@ -0,0 +1,85 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"math/rand"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	var c CompressionConfig
+	compressible := func(n int) []byte { return bytes.Repeat([]byte("p2p-update "), n/11+1)[:n] }
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rand.New(rand.NewSource(int64(n))).Read(b)
+		return b
+	}
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		encoded Encoding
+	}{
+		{"empty", nil, EncodingRaw},
+		{"below threshold", compressible(defaultCompressThreshold - 1), EncodingRaw},
+		{"at threshold", compressible(defaultCompressThreshold), EncodingZlib},
+		{"above threshold", compressible(defaultCompressThreshold + 1), EncodingZlib},
+		{"incompressible", random(defaultCompressThreshold * 4), EncodingRaw},
+		{"datagram limit", compressible(stunMaxPacketDataSize), EncodingZlib},
+		{"above datagram limit", compressible(stunMaxPacketDataSize * 4), EncodingZlib},
+	} {
+		p := c.encode(tc.data)
+		if p.Encoding != tc.encoded {
+			t.Errorf("%s: encoding %d, expected %d", tc.name, p.Encoding, tc.encoded)
+		}
+		msg, err := stun.Build(stun.TransactionID, stunDataIndication, p, stun.Fingerprint)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		decoded := new(stun.Message)
+		if _, err = decoded.Write(msg.Raw); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		data, err := GetPayloadFrom(decoded)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !bytes.Equal(data, tc.data) {
+			t.Errorf("%s: payload is not the same after the round trip", tc.name)
+		}
+	}
+
+	// a payload above the datagram limit fits once compressed
+	if p := c.encode(compressible(stunMaxPacketDataSize * 4)); len(p.Data) > stunMaxPacketDataSize {
+		t.Errorf("compressed payload of %d bytes does not fit a datagram", len(p.Data))
+	}
+
+	c.Disabled = true
+	if p := c.encode(compressible(stunMaxPacketDataSize)); p.Encoding != EncodingRaw {
+		t.Error("compression is not disabled")
+	}
+}
+
+func TestDecompressionCeiling(t *testing.T) {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write(make([]byte, maxDecompressedSize+1))
+	w.Close()
+	if len(b.Bytes()) > stunMaxPacketDataSize {
+		t.Fatalf("bomb of %d bytes does not fit a datagram", b.Len())
+	}
+	if _, err := decodePayload(b.Bytes(), EncodingZlib); err == nil {
+		t.Error("payload decompressed beyond the ceiling")
+	}
+	if _, err := decodePayload([]byte("not zlib"), EncodingZlib); err == nil {
+		t.Error("invalid compressed payload is decoded")
+	}
+	if _, err := decodePayload(nil, Encoding(7)); err == nil {
+		t.Error("unknown encoding is decoded")
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// configMaxSize is the maximum size of the payload of a config update.
+const configMaxSize = 1024 * 1024
+
+// configHotFields are the fields of the config applied without restarting
+// the agent, on a config update or SIGHUP.
+var configHotFields = map[string]bool{
+	"log":                           true,
+	"log-file":                      true,
+	"bittorrent.upload-kbps":        true,
+	"bittorrent.download-kbps":      true,
+	"bittorrent.bandwidth-schedule": true,
+}
+
+// configPrecedence returns the sources of the configurations of given config
+// file, the lowest precedence first.
+func configPrecedence(filename string) []string {
+	return []string{
+		"defaults",
+		"file " + filename,
+		"distributed " + configOverlayFilename(filename) + " (deployed config updates)",
+		"environment " + strings.Join(proxyEnvVars, ", ") + " (only if proxy-url is empty)",
+	}
+}
+
+// configOverlayFilename returns the file of the configurations distributed by
+// the config updates, which is beside given config file, e.g.
+// config.distributed.json beside config.json.
+func configOverlayFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + ".distributed" + ext
+}
+
+// loadConfig returns the default configurations overridden by given config
+// file, and by given overlay if it is not empty.
+func loadConfig(filename string, overlay []byte) (Config, error) {
+	cfg := DefaultConfig()
+	cfg.filename = filename
+	f, err := os.Open(filename)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.NewDecoder(f).Decode(&cfg)
+	f.Close()
+	if err == nil && len(overlay) > 0 {
+		err = errors.Wrap(json.Unmarshal(overlay, &cfg), "distributed config")
+	}
+	if len(cfg.Servers) > 0 {
+		cfg.Server = cfg.Servers[0]
+	}
+	cfg.applyInstance()
+	return cfg, err
+}
+
+// mergeConfigOverlay returns given overlay merged with the partial config
+// document of given payload: its objects are merged recursively, its other
+// values replace the ones of the overlay, and null removes them, hence the
+// file config applies again. The payload must be a JSON object whose fields
+// are fields of the config.
+func mergeConfigOverlay(overlay, payload []byte) ([]byte, error) {
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, errors.Wrap(err, "invalid config document")
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(payload, &doc); err != nil || doc == nil {
+		return nil, errors.New("config document is not an object")
+	}
+	merged := make(map[string]interface{})
+	if len(overlay) > 0 {
+		if err := json.Unmarshal(overlay, &merged); err != nil {
+			return nil, errors.Wrap(err, "invalid distributed config")
+		}
+	}
+	mergeJSON(merged, doc)
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+func mergeJSON(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		s, ok := v.(map[string]interface{})
+		d, isObject := dst[k].(map[string]interface{})
+		if ok && isObject {
+			mergeJSON(d, s)
+		} else if ok {
+			d = make(map[string]interface{})
+			mergeJSON(d, s)
+			dst[k] = d
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// configChanges returns the fields of the config that differ in given
+// configs, e.g. "tags" or "bittorrent.port", sorted.
+func configChanges(old, cfg *Config) []string {
+	var a, b map[string]interface{}
+	if err := jsonRoundTrip(old, &a); err != nil {
+		return nil
+	}
+	if err := jsonRoundTrip(cfg, &b); err != nil {
+		return nil
+	}
+	var changes []string
+	for k, v := range b {
+		if reflect.DeepEqual(a[k], v) {
+			continue
+		}
+		// the fields of the bittorrent section are reloaded separately
+		va, okA := a[k].(map[string]interface{})
+		vb, okB := v.(map[string]interface{})
+		if k != "bittorrent" || !okA || !okB {
+			changes = append(changes, k)
+			continue
+		}
+		for kk, vv := range vb {
+			if !reflect.DeepEqual(va[kk], vv) {
+				changes = append(changes, k+"."+kk)
+			}
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func jsonRoundTrip(v interface{}, out *map[string]interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// applyConfig applies the fields of given config that are reloaded without
+// restarting the agent, and returns the changed fields that require a
+// restart, which keep their current value until then.
+func (a *Agent) applyConfig(cfg *Config) []string {
+	var restart []string
+	for _, field := range configChanges(a.Config, cfg) {
+		if !configHotFields[field] {
+			restart = append(restart, field)
+		}
+	}
+	a.Config.LogFile, a.Config.Log = cfg.LogFile, cfg.Log
+	a.Config.BitTorrent.UploadKbps = cfg.BitTorrent.UploadKbps
+	a.Config.BitTorrent.DownloadKbps = cfg.BitTorrent.DownloadKbps
+	a.Config.BitTorrent.BandwidthSchedule = cfg.BitTorrent.BandwidthSchedule
+	a.bandwidth.SetConfig(cfg.BitTorrent)
+	return restart
+}
+
+// deployConfig deploys a config update: its payload, a partial config
+// document, is merged into the distributed configurations, validated with
+// the config file like on start, then saved, and the fields reloaded on
+// SIGHUP are applied. A payload that is invalid is rejected without
+// changing the running config. It returns the changed fields that require
+// restarting the agent. The caller must hold the lock.
+func (u *Update) deployConfig() ([]string, error) {
+	a := u.agent
+	if len(a.Config.filename) == 0 {
+		return nil, errors.New("agent has no config file")
+	}
+	if len(u.Notification.Info.Files) > 0 || u.Notification.Info.Length > configMaxSize {
+		return nil, fmt.Errorf("payload must be a JSON file of at most %d bytes", configMaxSize)
+	}
+	filename, err := safeJoin(u.dataDir(), u.Notification.Info.Name)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	overlayFile := configOverlayFilename(a.Config.filename)
+	current, err := ioutil.ReadFile(overlayFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	overlay, err := mergeConfigOverlay(current, payload)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig(a.Config.filename, overlay)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "distributed config is invalid")
+	}
+
+	tmp := overlayFile + ".tmp"
+	if err = ioutil.WriteFile(tmp, overlay, 0640); err == nil {
+		err = os.Rename(tmp, overlayFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, errors.Wrapf(err, "failed saving %s", overlayFile)
+	}
+	restart := a.applyConfig(&cfg)
+	if err = SetupLogger(a.Config.logConfig()); err != nil {
+		log.Printf("failed reloading logger: %v", err)
+	}
+	u.logf("applied config update uuid:%s version:%d to %s", u.Notification.UUID,
+		u.Notification.Version, overlayFile)
+	if len(restart) > 0 {
+		u.logf("WARNING: config fields %s of update uuid:%s version:%d require restarting the agent",
+			strings.Join(restart, ", "), u.Notification.UUID, u.Notification.Version)
+	}
+	return restart, nil
+}
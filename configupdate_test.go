@@ -0,0 +1,97 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeConfigOverlay(t *testing.T) {
+	overlay, err := mergeConfigOverlay(nil, []byte(`{"tags":["rack-a"],"bittorrent":{"upload-kbps":100}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err = mergeConfigOverlay(overlay, []byte(`{"tags":null,"bittorrent":{"download-kbps":200}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err = json.Unmarshal(overlay, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"bittorrent": map[string]interface{}{"upload-kbps": 100.0, "download-kbps": 200.0},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected overlay %s", overlay)
+	}
+
+	for _, payload := range []string{``, `[]`, `null`, `{"tracker":"x"}`, `{"tags":"rack-a"}`, `{"log":`} {
+		if _, err = mergeConfigOverlay(overlay, []byte(payload)); err == nil {
+			t.Errorf("invalid payload %q is merged", payload)
+		}
+	}
+}
+
+func TestConfigChanges(t *testing.T) {
+	old, cfg := DefaultConfig(), DefaultConfig()
+	cfg.Tags = []string{"rack-a"}
+	cfg.BitTorrent.Port = 6882
+	cfg.BitTorrent.UploadKbps = 100
+	cfg.Log.Output = "syslog"
+	expected := []string{"bittorrent.port", "bittorrent.upload-kbps", "log", "tags"}
+	if changes := configChanges(&old, &cfg); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("changes are %v, expected %v", changes, expected)
+	}
+	if changes := configChanges(&old, &old); len(changes) > 0 {
+		t.Errorf("unchanged config has changes %v", changes)
+	}
+}
+
+func TestNewConfigDistributed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(filename, []byte(`{"data-dir":"/data","tags":["local"],"bittorrent":{"port":6000}}`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	overlayFile := configOverlayFilename(filename)
+	if overlayFile != filepath.Join(dir, "config.distributed.json") {
+		t.Errorf("unexpected distributed config file %s", overlayFile)
+	}
+
+	// the distributed config overrides the file
+	if err = ioutil.WriteFile(overlayFile, []byte(`{"tags":["fleet"],"bittorrent":{"upload-kbps":8}}`),
+		0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DataDir != "/data" || !reflect.DeepEqual(cfg.Tags, []string{"fleet"}) ||
+		cfg.BitTorrent.Port != 6000 || cfg.BitTorrent.UploadKbps != 8 ||
+		cfg.BitTorrent.Tracker != DefaultTracker {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+
+	// an invalid distributed config is ignored
+	if err = ioutil.WriteFile(overlayFile, []byte(`{"data-dir":""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = NewConfig(filename); err != nil || cfg.DataDir != "/data" ||
+		!reflect.DeepEqual(cfg.Tags, []string{"local"}) {
+		t.Errorf("invalid distributed config is applied: %+v %v", cfg, err)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/zeebo/bencode"
+	"golang.org/x/crypto/ssh"
+)
+
+// The actions of the control notices.
+const (
+	ControlStop  = "stop"
+	ControlStart = "start"
+)
+
+// The audit events of the control of the updates.
+const (
+	AuditRemoteStop  = "remote-stop"
+	AuditRemoteStart = "remote-start"
+	AuditLocalStart  = "local-start"
+)
+
+// controlRestartTimeout is how long a restart waits for the monitor of the
+// stopped update to exit.
+const controlRestartTimeout = 10 * time.Second
+
+// errUpdateStoppedRemotely is returned when a local start is refused because
+// the update has been stopped by an operator.
+var errUpdateStoppedRemotely = fmt.Errorf("update is stopped remotely and local start is not allowed (control.allow-local-start)")
+
+// ControlConfig holds configurations of the remote control of the updates.
+type ControlConfig struct {
+	// AllowLocalStart is true if a local start overrides the stop of an
+	// update by a control notice.
+	AllowLocalStart bool `json:"allow-local-start"`
+}
+
+// ControlNotice is a signed operator message that pauses (stop) or resumes
+// (start) the download, the seeding and the deployment of an update, unlike
+// an uninstall notice which removes it permanently. A stop without version
+// also applies to the versions received later, until a start.
+type ControlNotice struct {
+	Action     string               `bencode:"action" json:"action"`
+	UUID       string               `bencode:"uuid" json:"uuid"`
+	Version    uint64               `bencode:"version,omitempty" json:"version,omitempty"` // 0 means any version
+	Peers      []string             `bencode:"peers,omitempty" json:"peers,omitempty"`     // IDs of the targeted agents, empty means all
+	Timestamp  int64                `bencode:"timestamp" json:"timestamp"`                 // Unix time in nanoseconds
+	By         string               `bencode:"by,omitempty" json:"by,omitempty"`
+	Signatures map[string]Signature `bencode:"signatures,omitempty" json:"signatures,omitempty"`
+}
+
+// RemoteControl is the latest control of an update, which is kept in its
+// metadata so that a stopped update remains stopped after a restart of the
+// agent.
+type RemoteControl struct {
+	Action      string `json:"action"`
+	Version     uint64 `json:"version,omitempty"`
+	By          string `json:"by,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"` // of the key verifying the notice
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// ControlResult is the acknowledgement of a control notice by an agent.
+type ControlResult struct {
+	UUID    string `json:"uuid"`
+	Action  string `json:"action"`
+	Applied bool   `json:"applied"` // false if the notice does not target the agent or is old
+	Version uint64 `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Validate returns an error if the notice is invalid.
+func (cn *ControlNotice) Validate() error {
+	if cn.Action != ControlStop && cn.Action != ControlStart {
+		return fmt.Errorf("invalid control action %q", cn.Action)
+	}
+	if len(cn.UUID) == 0 {
+		return fmt.Errorf("control notice without UUID")
+	}
+	for _, p := range cn.Peers {
+		if _, err := parsePeerID(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignWith signs the notice using given signer.
+func (cn *ControlNotice) SignWith(signer Signer) error {
+	cn.Signatures = nil
+	data, err := json.Marshal(cn)
+	if err != nil {
+		return err
+	}
+	sig, err := signer.SignMessage(data)
+	if err != nil {
+		return err
+	}
+	cn.Signatures = map[string]Signature{signatureName: {Signature: sig}}
+	return nil
+}
+
+// Verify verifies the notice's signature using given public key.
+func (cn *ControlNotice) Verify(pub *rsa.PublicKey) error {
+	s, ok := cn.Signatures[signatureName]
+	if !ok {
+		return fmt.Errorf("signature is not available")
+	}
+	sigs := cn.Signatures
+	cn.Signatures = nil
+	defer func() { cn.Signatures = sigs }()
+	data, err := json.Marshal(cn)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], s.Signature)
+}
+
+// targets returns true if the notice applies to the agent of given ID.
+func (cn *ControlNotice) targets(pid PeerID) bool {
+	if len(cn.Peers) == 0 {
+		return true
+	}
+	id := pid.String()
+	for _, p := range cn.Peers {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the notice applies to given notification.
+func (cn *ControlNotice) matches(n *Notification) bool {
+	return n.UUID == cn.UUID && (cn.Version == 0 || n.Version == cn.Version)
+}
+
+// keyFingerprint returns the SHA256 fingerprint of given public key, in the
+// format of ssh-keygen -l.
+func keyFingerprint(pub *rsa.PublicKey) string {
+	if pub == nil {
+		return ""
+	}
+	k, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	return ssh.FingerprintSHA256(k)
+}
+
+// remotelyStopped returns true if the update has been stopped by a control
+// notice. The caller must hold the lock.
+func (u *Update) remotelyStopped() bool {
+	return u.Control != nil && u.Control.Action == ControlStop
+}
+
+// control applies given verified notice to the update of the default
+// namespace of its UUID. A notice older than the latest control of the
+// update is ignored, hence replaying a stop cannot cancel a later start.
+func (a *Agent) control(cn *ControlNotice) ControlResult {
+	r := ControlResult{UUID: cn.UUID, Action: cn.Action}
+	if !cn.targets(a.ID) {
+		return r
+	}
+	u := a.getUpdate(cn.UUID)
+	if u == nil {
+		log.Printf("nothing to %s uuid:%s version:%d", cn.Action, cn.UUID, cn.Version)
+		return r
+	}
+
+	u.Lock()
+	if !cn.matches(&u.Notification) || (u.Control != nil && cn.Timestamp <= u.Control.Timestamp) {
+		u.Unlock()
+		log.Printf("ignoring control notice action:%s uuid:%s version:%d", cn.Action, cn.UUID, cn.Version)
+		return r
+	}
+	fingerprint := keyFingerprint(a.PublicKey)
+	u.Control = &RemoteControl{
+		Action:      cn.Action,
+		Version:     cn.Version,
+		By:          cn.By,
+		Fingerprint: fingerprint,
+		Timestamp:   cn.Timestamp,
+	}
+	u.dirty = true
+	if err := u.flush(true); err != nil {
+		u.logf("WARNING: failed saving control of update uuid:%s - %v", cn.UUID, err)
+	}
+	r.Applied, r.Version = true, u.Notification.Version
+	stopped := u.Stopped
+	u.Unlock()
+
+	event := AuditRemoteStart
+	if cn.Action == ControlStop {
+		event = AuditRemoteStop
+		u.logf("update uuid:%s version:%d is stopped remotely by %s", cn.UUID, r.Version, cn.By)
+		u.Stop()
+	} else if stopped {
+		u.logf("update uuid:%s version:%d is started remotely by %s", cn.UUID, r.Version, cn.By)
+		if err := a.restartUpdate(u); err != nil {
+			r.Error = err.Error()
+			u.logf("failed restarting update uuid:%s version:%d - %v", cn.UUID, r.Version, err)
+		}
+	}
+	metrics.Inc("update.controls", "action", cn.Action)
+	a.audit(event, &u.Notification, cn.By, "key "+fingerprint)
+	return r
+}
+
+// startUpdate starts the stopped update of given key on request of the local
+// operator, which overrides a remote stop only if the configurations allow it.
+func (a *Agent) startUpdate(key string) error {
+	u := a.getUpdate(key)
+	if u == nil {
+		return errUpdateNotFound
+	}
+	u.Lock()
+	if u.remotelyStopped() {
+		if !a.Config.Control.AllowLocalStart {
+			u.Unlock()
+			return errUpdateStoppedRemotely
+		}
+		u.Control = &RemoteControl{Action: ControlStart, By: approvalLocal, Timestamp: time.Now().UnixNano()}
+		u.dirty = true
+	}
+	stopped := u.Stopped
+	u.Unlock()
+	if !stopped {
+		return nil
+	}
+	if err := a.restartUpdate(u); err != nil {
+		return err
+	}
+	a.audit(AuditLocalStart, &u.Notification, approvalLocal, "")
+	return nil
+}
+
+// restartUpdate starts again given stopped update, once its monitor has
+// exited. Nothing is done if the update has been replaced meanwhile.
+func (a *Agent) restartUpdate(u *Update) error {
+	for deadline := time.Now().Add(controlRestartTimeout); atomic.LoadInt64(&u.lastTick) != 0; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("monitor of the stopped update has not exited")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !a.deleteUpdateIf(u.key(), u) {
+		return nil
+	}
+	if err := u.Start(a); err != nil {
+		// the update remains listed as stopped
+		a.addUpdate(u)
+		return err
+	}
+	return nil
+}
+
+// broadcastControl applies given signed notice and broadcasts it over the
+// overlay.
+func (a *Agent) broadcastControl(cn *ControlNotice) (ControlResult, error) {
+	if err := cn.Validate(); err != nil {
+		return ControlResult{}, err
+	}
+	if err := cn.Verify(a.PublicKey); err != nil {
+		return ControlResult{}, errUpdateVerificationFailed
+	}
+	r := a.control(cn)
+	if a.Overlay == nil {
+		return r, errConnNotOpened
+	}
+	b, err := bencode.EncodeBytes(OperatorMessage{Control: cn})
+	if err != nil {
+		return r, err
+	}
+	_, err = a.Overlay.Write(b)
+	return r, err
+}
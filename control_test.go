@@ -0,0 +1,136 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlNotice(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn := ControlNotice{Action: ControlStop, UUID: UUIDShell, Version: 3, Peers: []string{"0a0b0c0d0e0f"},
+		Timestamp: time.Now().UnixNano(), By: "operator"}
+	if err = cn.Validate(); err != nil {
+		t.Errorf("valid notice: %v", err)
+	}
+	if err = cn.SignWith(KeySigner{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err = cn.Verify(&key.PublicKey); err != nil {
+		t.Errorf("valid notice: %v", err)
+	}
+	cn.Action = ControlStart
+	if err = cn.Verify(&key.PublicKey); err == nil {
+		t.Error("modified notice must fail the verification")
+	}
+
+	if !cn.targets(PeerID{0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}) || cn.targets(PeerID{1, 2, 3, 4, 5, 6}) {
+		t.Error("notice must only target the listed peers")
+	}
+	if !cn.matches(&Notification{UUID: UUIDShell, Version: 3}) ||
+		cn.matches(&Notification{UUID: UUIDShell, Version: 4}) ||
+		cn.matches(&Notification{UUID: UUIDApk, Version: 3}) {
+		t.Error("notice must only match its version")
+	}
+	cn.Version, cn.Peers = 0, nil
+	if !cn.targets(PeerID{1, 2, 3, 4, 5, 6}) || !cn.matches(&Notification{UUID: UUIDShell, Version: 4}) {
+		t.Error("notice without version and peers must apply to all of them")
+	}
+
+	for _, invalid := range []ControlNotice{
+		{Action: "pause", UUID: UUIDShell},
+		{Action: ControlStop},
+		{Action: ControlStop, UUID: UUIDShell, Peers: []string{"peer"}},
+	} {
+		if invalid.Validate() == nil {
+			t.Errorf("invalid notice %+v is accepted", invalid)
+		}
+	}
+}
+
+func TestControlUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	a := &Agent{Config: &cfg, PublicKey: &key.PublicKey, metadataDir: filepath.Join(dir, "notification"),
+		updates: make(map[string]*Update)}
+	if err = os.MkdirAll(a.metadataDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 2}, a)
+	u.ns = a.namespaces[0]
+	a.updates[u.key()] = u
+
+	now := time.Now()
+	stop := &ControlNotice{Action: ControlStop, UUID: UUIDShell, Timestamp: now.UnixNano(), By: "operator"}
+	if r := a.control(stop); !r.Applied || r.Version != 2 {
+		t.Fatalf("stop is not applied: %+v", r)
+	}
+	s := u.Status()
+	if !s.Stopped || s.RemoteStop == nil || s.RemoteStop.Fingerprint != keyFingerprint(&key.PublicKey) ||
+		!strings.Contains(s.Reason, "operator") {
+		t.Errorf("unexpected status %+v", s)
+	}
+	loaded, err := a.loadUpdate(u.metadataBucket(), u.metadataKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.remotelyStopped() {
+		t.Error("remote stop is not saved")
+	}
+
+	// a replayed start older than the stop is ignored
+	start := &ControlNotice{Action: ControlStart, UUID: UUIDShell, Timestamp: now.Add(-time.Minute).UnixNano()}
+	if r := a.control(start); r.Applied {
+		t.Errorf("old start is applied: %+v", r)
+	}
+	if r := a.control(&ControlNotice{Action: ControlStop, UUID: UUIDShell, Version: 1,
+		Timestamp: now.Add(time.Minute).UnixNano()}); r.Applied {
+		t.Errorf("stop of another version is applied: %+v", r)
+	}
+
+	if err = a.startUpdate(u.key()); err != errUpdateStoppedRemotely {
+		t.Errorf("local start overrides the remote stop: %v", err)
+	}
+	cfg.Control.AllowLocalStart = true
+	u.Stopped = false // not restarted by the test
+	if err = a.startUpdate(u.key()); err != nil {
+		t.Fatal(err)
+	}
+	if u.remotelyStopped() || u.Status().RemoteStop != nil {
+		t.Error("allowed local start does not override the remote stop")
+	}
+
+	entries, err := a.auditEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Event != AuditRemoteStop || entries[0].By != "operator" ||
+		!strings.Contains(entries[0].Detail, keyFingerprint(&key.PublicKey)) {
+		t.Errorf("unexpected audit entries %+v", entries)
+	}
+}
@@ -0,0 +1,618 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+// The patches of the delta updates are a sequence of operations, which copy
+// a range of the base or insert literal bytes, after a header with the sizes
+// of the base and of the target:
+//
+//	"P2PDELTA" <base size> <target size>
+//	'C' <offset> <length> | 'I' <length> <bytes> ...
+//	'E'
+//
+// where the integers are unsigned varints.
+const (
+	deltaMagic = "P2PDELTA"
+
+	deltaOpCopy   = 'C'
+	deltaOpInsert = 'I'
+	deltaOpEnd    = 'E'
+
+	// deltaBlockSize is the size of the blocks of the base matched in the
+	// target, hence the minimum length of a copy.
+	deltaBlockSize = 4096
+
+	// deltaMaxInsert is the maximum length of an insert written by the
+	// encoder, and deltaWindowSize the window of the target it scans.
+	deltaMaxInsert  = 1024 * 1024
+	deltaWindowSize = 4 * deltaMaxInsert
+
+	// deltaMaxCandidates is the maximum number of blocks of the base that
+	// are compared with a block of the target of the same checksum.
+	deltaMaxCandidates = 8
+
+	// deltaBufferSize is the size of the buffers of the patch application,
+	// whose memory does not depend on the size of the payloads.
+	deltaBufferSize = 64 * 1024
+
+	// deltaBaseDir is the directory of the bases in the data directory.
+	deltaBaseDir = ".delta-base"
+
+	deltaDefaultStallTime = 600 // in seconds
+)
+
+var (
+	errDeltaCorrupted    = errors.New("patch is corrupted")
+	errDeltaBaseMismatch = errors.New("base does not match the patch")
+)
+
+// DeltaConfig holds configurations of the delta updates. An agent keeps the
+// payload of the deployed version of an update as the base of the next one,
+// until the next one is deployed, and downloads the patch of a delta update
+// instead of its payload if it has the base. The full payload is downloaded
+// if the patch has made no progress for StallTime, or it cannot be applied.
+type DeltaConfig struct {
+	Disabled  bool `json:"disabled"`
+	StallTime int  `json:"stall-time"` // in seconds
+}
+
+// Delta describes the patch of a delta update, which rebuilds the payload of
+// the notification from the payload of a previous version, the base. Both
+// payloads are single files. The agents that do not have the base, or do not
+// support the delta updates, download the payload of the notification.
+type Delta struct {
+	Info       metainfo.Info `bencode:"info"`        // of the patch
+	BaseSHA256 string        `bencode:"base_sha256"` // of the base payload
+}
+
+// Validate returns an error if the delta of given notification is invalid,
+// or nil if it has none.
+func (d *Delta) Validate(mi *Notification) error {
+	if d == nil {
+		return nil
+	}
+	if len(mi.Info.Files) > 0 || len(d.Info.Files) > 0 {
+		return fmt.Errorf("delta update uuid:%s: the payload and the patch must be single files", mi.UUID)
+	}
+	if len(d.Info.Name) == 0 || d.Info.Name == mi.Info.Name || strings.ContainsAny(d.Info.Name, `/\`) ||
+		d.Info.Name == "." || d.Info.Name == ".." {
+		return fmt.Errorf("delta update uuid:%s: invalid patch name '%s'", mi.UUID, d.Info.Name)
+	}
+	if b, err := hex.DecodeString(d.BaseSHA256); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("delta update uuid:%s: invalid base sha256 '%s'", mi.UUID, d.BaseSHA256)
+	}
+	if len(mi.SHA256) == 0 {
+		return fmt.Errorf("delta update uuid:%s: the digest of the payload is required", mi.UUID)
+	}
+	return nil
+}
+
+// deltaMetainfo returns the torrent metainfo of the patch of the notification.
+func (mi *Notification) deltaMetainfo() (*metainfo.MetaInfo, error) {
+	n := *mi
+	n.Info = mi.Delta.Info
+	return n.torrentMetainfo()
+}
+
+// NewDelta generates the patch from given base file to given target file
+// into given patch file, and returns its description with given piece length
+// and patch name.
+func NewDelta(baseFile, targetFile, patchFile, name string, pieceLength int64) (*Delta, error) {
+	base, err := os.Open(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+	target, err := os.Open(targetFile)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	st, err := base.Stat()
+	if err != nil {
+		return nil, err
+	} else if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("base '%s' is not a regular file", baseFile)
+	}
+	tst, err := target.Stat()
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.OpenFile(patchFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = WriteDelta(out, base, st.Size(), target, tst.Size()); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed writing patch")
+	}
+
+	d := Delta{Info: metainfo.Info{PieceLength: pieceLength}}
+	if err = buildInfo(&d.Info, patchFile, []string{"."}); err != nil {
+		return nil, err
+	}
+	d.Info.Name = name
+	if d.BaseSHA256, err = fileDigest(baseFile); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// deltaSum is the rolling checksum of the blocks, as the weak checksum of
+// rsync.
+func deltaSum(block []byte) (a, b uint32) {
+	for i, x := range block {
+		a += uint32(x)
+		b += uint32(len(block)-i) * uint32(x)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// deltaEncoder writes the operations of a patch, merging the contiguous
+// copies.
+type deltaEncoder struct {
+	w       *bufio.Writer
+	copyOff int64
+	copyLen int64
+}
+
+func (e *deltaEncoder) uvarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.w.Write(b[:binary.PutUvarint(b[:], uint64(v))])
+}
+
+func (e *deltaEncoder) flushCopy() {
+	if e.copyLen > 0 {
+		e.w.WriteByte(deltaOpCopy)
+		e.uvarint(e.copyOff)
+		e.uvarint(e.copyLen)
+		e.copyLen = 0
+	}
+}
+
+func (e *deltaEncoder) copy(off, n int64) {
+	if e.copyLen > 0 && e.copyOff+e.copyLen == off {
+		e.copyLen += n
+		return
+	}
+	e.flushCopy()
+	e.copyOff, e.copyLen = off, n
+}
+
+func (e *deltaEncoder) insert(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	e.flushCopy()
+	e.w.WriteByte(deltaOpInsert)
+	e.uvarint(int64(len(b)))
+	e.w.Write(b)
+}
+
+// WriteDelta writes the patch from given base to given target into w, with
+// their sizes. The blocks of the base are indexed by their rolling checksum,
+// and the target is scanned for them byte by byte, hence the shifted content
+// is found as well.
+func WriteDelta(w io.Writer, base io.ReaderAt, baseSize int64, target io.Reader, targetSize int64) error {
+	index := make(map[uint32][]int64)
+	block := make([]byte, deltaBlockSize)
+	r := bufio.NewReaderSize(io.NewSectionReader(base, 0, baseSize), deltaBufferSize)
+	for off := int64(0); off+deltaBlockSize <= baseSize; off += deltaBlockSize {
+		if _, err := io.ReadFull(r, block); err != nil {
+			return err
+		}
+		a, b := deltaSum(block)
+		index[a|b<<16] = append(index[a|b<<16], off)
+	}
+
+	e := &deltaEncoder{w: bufio.NewWriterSize(w, deltaBufferSize)}
+	if err := writeDeltaHeader(e.w, baseSize, targetSize); err != nil {
+		return err
+	}
+	// match returns the offset of a block of the base equal to given one,
+	// preferably the one following the previous copy so that they merge.
+	// Only the first candidates are compared, since the blocks of an image
+	// may be the same, e.g. zeroes.
+	equal := func(off int64, b []byte) bool {
+		_, err := base.ReadAt(block, off)
+		return err == nil && bytes.Equal(block, b)
+	}
+	match := func(sum uint32, b []byte) (int64, bool) {
+		offsets := index[sum]
+		if len(offsets) == 0 {
+			return 0, false
+		}
+		if next := e.copyOff + e.copyLen; e.copyLen > 0 && next+deltaBlockSize <= baseSize && equal(next, b) {
+			return next, true
+		}
+		for i, off := range offsets {
+			if i == deltaMaxCandidates {
+				break
+			}
+			if equal(off, b) {
+				return off, true
+			}
+		}
+		return 0, false
+	}
+
+	// win[ls:pos] is the pending literal, and the checksum is the one of
+	// win[pos:pos+deltaBlockSize] if valid
+	win := make([]byte, 0, deltaWindowSize)
+	pos, ls, eof, read := 0, 0, false, int64(0)
+	var (
+		a, b  uint32
+		valid bool
+	)
+	for {
+		if pos-ls >= deltaMaxInsert {
+			e.insert(win[ls:pos])
+			ls = pos
+		}
+		for !eof && len(win)-pos <= deltaBlockSize {
+			if ls > 0 {
+				n := copy(win, win[ls:])
+				pos, ls, win = pos-ls, 0, win[:n]
+			}
+			n, err := target.Read(win[len(win):cap(win)])
+			win, read = win[:len(win)+n], read+int64(n)
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if len(win)-pos < deltaBlockSize {
+			break
+		}
+		if !valid {
+			a, b = deltaSum(win[pos : pos+deltaBlockSize])
+			valid = true
+		}
+		if off, ok := match(a|b<<16, win[pos:pos+deltaBlockSize]); ok {
+			e.insert(win[ls:pos])
+			e.copy(off, deltaBlockSize)
+			pos += deltaBlockSize
+			ls, valid = pos, false
+			continue
+		}
+		if len(win)-pos == deltaBlockSize {
+			break
+		}
+		out, in := uint32(win[pos]), uint32(win[pos+deltaBlockSize])
+		a = (a - out + in) & 0xffff
+		b = (b - deltaBlockSize*out + a) & 0xffff
+		pos++
+	}
+	if read != targetSize {
+		return fmt.Errorf("target size is %d, expected %d", read, targetSize)
+	}
+	e.insert(win[ls:])
+	e.flushCopy()
+	e.w.WriteByte(deltaOpEnd)
+	return e.w.Flush()
+}
+
+// writeDeltaHeader writes the header of a patch from a base of given size to
+// a target of given size.
+func writeDeltaHeader(w io.Writer, baseSize, targetSize int64) error {
+	b := make([]byte, 0, len(deltaMagic)+2*binary.MaxVarintLen64)
+	b = append(b, deltaMagic...)
+	var v [binary.MaxVarintLen64]byte
+	b = append(b, v[:binary.PutUvarint(v[:], uint64(baseSize))]...)
+	b = append(b, v[:binary.PutUvarint(v[:], uint64(targetSize))]...)
+	_, err := w.Write(b)
+	return err
+}
+
+// ApplyDelta writes the target rebuilt from given base of given size and
+// given patch into w, and returns its size. The memory it uses does not
+// depend on the size of the base, the patch or the target.
+func ApplyDelta(w io.Writer, base io.ReaderAt, baseSize int64, patch io.Reader) (int64, error) {
+	r := bufio.NewReaderSize(patch, deltaBufferSize)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return 0, errDeltaCorrupted
+	}
+	bs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, errDeltaCorrupted
+	}
+	ts, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, errDeltaCorrupted
+	}
+	if int64(bs) != baseSize {
+		return 0, errors.Wrapf(errDeltaBaseMismatch, "base size is %d, expected %d", baseSize, bs)
+	}
+
+	buf := make([]byte, deltaBufferSize)
+	var n int64
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return n, errDeltaCorrupted
+		}
+		var length uint64
+		switch op {
+		case deltaOpCopy:
+			off, err := binary.ReadUvarint(r)
+			if err != nil {
+				return n, errDeltaCorrupted
+			}
+			if length, err = binary.ReadUvarint(r); err != nil || off > bs || length > bs-off ||
+				length > ts-uint64(n) {
+				return n, errDeltaCorrupted
+			}
+			if _, err = io.CopyBuffer(w, io.NewSectionReader(base, int64(off), int64(length)), buf); err != nil {
+				return n, err
+			}
+		case deltaOpInsert:
+			if length, err = binary.ReadUvarint(r); err != nil || length > ts-uint64(n) {
+				return n, errDeltaCorrupted
+			}
+			if _, err = io.CopyBuffer(w, io.LimitReader(r, int64(length)), buf); err != nil {
+				return n, err
+			}
+		case deltaOpEnd:
+			if uint64(n) != ts {
+				return n, errDeltaCorrupted
+			}
+			return n, nil
+		default:
+			return n, errDeltaCorrupted
+		}
+		n += int64(length)
+	}
+}
+
+// applyDeltaFile rebuilds given target file from given base and patch files,
+// and returns its digest.
+func applyDeltaFile(baseFile, patchFile, targetFile string) (string, error) {
+	base, err := os.Open(baseFile)
+	if err != nil {
+		return "", err
+	}
+	defer base.Close()
+	st, err := base.Stat()
+	if err != nil {
+		return "", err
+	}
+	patch, err := os.Open(patchFile)
+	if err != nil {
+		return "", err
+	}
+	defer patch.Close()
+	out, err := os.OpenFile(targetFile, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	bw := bufio.NewWriterSize(io.MultiWriter(out, h), deltaBufferSize)
+	if _, err = ApplyDelta(bw, base, st.Size(), patch); err == nil {
+		err = bw.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// deltaState is the state of the patch of a delta update.
+type deltaState struct {
+	patching  bool      // the payload is rebuilt from the patch
+	running   bool      // the patch is being applied
+	progress  time.Time // when the completed bytes of the patch last changed
+	completed int64
+}
+
+// deltaBasePath returns the path of the base of given digest of the update.
+func (u *Update) deltaBasePath(sum string) string {
+	return filepath.Join(u.dataDir(), deltaBaseDir, u.Notification.UUID, sum)
+}
+
+// keepDeltaBase keeps the payload of the update as the base of its next
+// version, if it is a single file that has been deployed. It replaces the
+// previous base of the update. The update must be stopped, unless it is kept
+// seeding.
+func (u *Update) keepDeltaBase(a *Agent) {
+	u.Lock()
+	defer u.Unlock()
+	if a.Config.Delta.Disabled || u.State != UpdateDeployed || len(u.Notification.Info.Files) > 0 ||
+		len(u.Notification.SHA256) == 0 {
+		return
+	}
+	dst := u.deltaBasePath(u.Notification.SHA256)
+	os.RemoveAll(filepath.Dir(dst))
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err == nil && (u.retained || u.SupersededBy > 0) {
+		// the payload is kept for a rollback or seeding as well
+		err = os.Link(u.payloadPath(), dst)
+	} else if err == nil {
+		err = os.Rename(u.payloadPath(), dst)
+	}
+	if err != nil {
+		u.logf("WARNING: failed keeping the payload of update uuid:%s version:%d as delta base - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+		return
+	}
+	u.logf("kept the payload of update uuid:%s version:%d as delta base sha256:%s",
+		u.Notification.UUID, u.Notification.Version, u.Notification.SHA256)
+}
+
+// dropDeltaBase removes the base of the update, which is not needed anymore
+// once the update is deployed. The caller must hold the lock.
+func (u *Update) dropDeltaBase() {
+	if err := os.RemoveAll(filepath.Join(u.dataDir(), deltaBaseDir, u.Notification.UUID)); err != nil {
+		u.logf("WARNING: failed removing delta base of update uuid:%s - %v", u.Notification.UUID, err)
+	}
+}
+
+// startDelta adds the torrent of the patch of a delta update, if the agent
+// has the patch, e.g. it has submitted the update, hence it seeds it, or the
+// agent has the base and not the payload, hence it downloads the patch
+// rather than the payload. The caller must hold the lock.
+func (u *Update) startDelta(a *Agent) error {
+	d := u.Notification.Delta
+	if d == nil || a.Config.Delta.Disabled {
+		return nil
+	}
+	_, err := os.Stat(filepath.Join(u.dataDir(), d.Info.Name))
+	seed := err == nil
+	patching := false
+	if !seed && !u.DeltaFailed && (u.State == UpdatePending || u.State == UpdateDownloading) {
+		st, err := os.Stat(filepath.Join(u.dataDir(), u.Notification.Info.Name))
+		complete := err == nil && st.Size() == u.Notification.Info.Length
+		_, err = os.Stat(u.deltaBasePath(d.BaseSHA256))
+		patching = !complete && err == nil
+	}
+	if !seed && !patching {
+		return nil
+	}
+	mi, err := u.Notification.deltaMetainfo()
+	if err != nil {
+		return fmt.Errorf("failed generating patch metainfo: %v", err)
+	}
+	if u.patch, err = u.addTorrent(mi); err != nil {
+		return fmt.Errorf("failed adding patch torrent: %v", err)
+	}
+	u.delta = deltaState{patching: patching}
+	if patching {
+		u.logf("downloading the patch of update uuid:%s version:%d from base sha256:%s",
+			u.Notification.UUID, u.Notification.Version, d.BaseSHA256)
+	}
+	return nil
+}
+
+// checkDelta downloads the patch of the update, and applies it in the
+// background once it is complete. It returns true while the payload is
+// rebuilt from the patch, hence it must not be downloaded. The caller must
+// hold the lock.
+func (u *Update) checkDelta(a *Agent) bool {
+	ds := &u.delta
+	if u.patch == nil || !ds.patching {
+		return false
+	}
+	if ds.running {
+		return true
+	}
+	<-u.patch.GotInfo()
+	now, completed := time.Now(), u.patch.BytesCompleted()
+	if u.patch.BytesMissing() > 0 {
+		u.patch.DownloadAll()
+		stall := time.Duration(a.Config.Delta.StallTime) * time.Second
+		if ds.progress.IsZero() || completed != ds.completed {
+			ds.progress, ds.completed = now, completed
+		} else if stall > 0 && now.Sub(ds.progress) >= stall {
+			u.abandonDelta(fmt.Errorf("no progress of the patch since %s", ds.progress.Format(time.RFC3339)))
+			return false
+		}
+		return true
+	}
+	ds.running = true
+	tmpDir := filepath.Join(a.Config.DataDir, "delta", u.torrent.InfoHash().HexString())
+	go u.runDelta(u.Notification, tmpDir)
+	return true
+}
+
+// runDelta rebuilds the payload of given notification from its base and its
+// patch into given temporary directory, verifies its digest and copies it
+// into the storage, then verifies the torrent data so that the agent seeds
+// it and the monitor continues the lifecycle of the update. Any failure
+// falls back to the download of the payload.
+func (u *Update) runDelta(n Notification, tmpDir string) {
+	err := os.MkdirAll(tmpDir, 0755)
+	if err == nil {
+		err = u.rebuildPayload(&n, tmpDir)
+	}
+	os.RemoveAll(tmpDir)
+
+	u.Lock()
+	u.delta.running = false
+	t := u.torrent
+	if u.Stopped {
+		t = nil
+	} else if err != nil {
+		u.abandonDelta(err)
+		t = nil
+	} else {
+		u.delta.patching = false
+		metrics.Inc("update.deltas", "result", "applied", "namespace", u.ns.label())
+		u.logf("rebuilt the payload of update uuid:%s version:%d from the patch",
+			n.UUID, n.Version)
+	}
+	u.Unlock()
+	if t == nil {
+		return
+	}
+	t.VerifyData()
+	if t.BytesMissing() > 0 {
+		u.Lock()
+		u.abandonDelta(errors.New("rebuilt payload does not match the piece hashes"))
+		u.Unlock()
+	}
+}
+
+// rebuildPayload rebuilds the payload of given notification from its base
+// and its patch into given temporary directory, verifies its digest, then
+// copies it into the storage.
+func (u *Update) rebuildPayload(n *Notification, tmpDir string) error {
+	basePath := u.deltaBasePath(n.Delta.BaseSHA256)
+	if sum, err := fileDigest(basePath); err != nil {
+		return err
+	} else if sum != n.Delta.BaseSHA256 {
+		return errors.Wrapf(errDeltaBaseMismatch, "base is sha256:%s", sum)
+	}
+	tmp := filepath.Join(tmpDir, n.Info.Name)
+	sum, err := applyDeltaFile(basePath, filepath.Join(u.dataDir(), n.Delta.Info.Name), tmp)
+	if err != nil {
+		return err
+	} else if sum != n.SHA256 {
+		return errors.Wrapf(errDigestMismatch, "expected sha256:%s got sha256:%s", n.SHA256, sum)
+	}
+	return copyPayloadFile(tmp, payloadPath(u.dataDir(), &n.Info, nil), n.Info.Length)
+}
+
+// abandonDelta falls back to the download of the payload of the update since
+// its patch cannot be applied for given reason. The patch is still seeded if
+// it is complete. The caller must hold the lock.
+func (u *Update) abandonDelta(reason error) {
+	u.logf("WARNING: falling back to the download of the payload of update uuid:%s version:%d - %v",
+		u.Notification.UUID, u.Notification.Version, reason)
+	metrics.Inc("update.deltas", "result", "failed", "namespace", u.ns.label())
+	u.delta.patching = false
+	u.DeltaFailed = true
+	u.dirty = true
+	if u.patch != nil && u.patch.BytesMissing() > 0 {
+		u.patch.Drop()
+		u.patch = nil
+		os.Remove(filepath.Join(u.dataDir(), u.Notification.Delta.Info.Name))
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+// deltaTarget returns a modified copy of given base: a few bytes changed,
+// an insertion that shifts the rest and an appended tail.
+func deltaTarget(rnd *rand.Rand, base []byte) []byte {
+	target := append([]byte(nil), base[:100000]...)
+	target[5000], target[70000] = ^target[5000], ^target[70000]
+	insert := make([]byte, 777)
+	rnd.Read(insert)
+	target = append(target, insert...)
+	target = append(target, base[100000:]...)
+	tail := make([]byte, 3000)
+	rnd.Read(tail)
+	return append(target, tail...)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	base := make([]byte, 1<<20)
+	rnd.Read(base)
+	for i := 200000; i < 300000; i++ {
+		base[i] = 0 // repeated blocks
+	}
+	target := deltaTarget(rnd, base)
+
+	var patch bytes.Buffer
+	if err := WriteDelta(&patch, bytes.NewReader(base), int64(len(base)), bytes.NewReader(target),
+		int64(len(target))); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Len() > len(target)/10 {
+		t.Errorf("patch of %d bytes is too large for a target of %d bytes", patch.Len(), len(target))
+	}
+	var out bytes.Buffer
+	n, err := ApplyDelta(&out, bytes.NewReader(base), int64(len(base)), bytes.NewReader(patch.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(target)) || !bytes.Equal(out.Bytes(), target) {
+		t.Fatalf("rebuilt target of %d bytes differs from the target", n)
+	}
+
+	// an empty base inserts the whole target
+	patch.Reset()
+	if err = WriteDelta(&patch, bytes.NewReader(nil), 0, bytes.NewReader(target), int64(len(target))); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if _, err = ApplyDelta(&out, bytes.NewReader(nil), 0, &patch); err != nil || !bytes.Equal(out.Bytes(), target) {
+		t.Errorf("failed rebuilding the target without base: %v", err)
+	}
+}
+
+func TestApplyDeltaFailures(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	base := make([]byte, 256*1024)
+	rnd.Read(base)
+	target := deltaTarget(rnd, base)
+	var patch bytes.Buffer
+	if err := WriteDelta(&patch, bytes.NewReader(base), int64(len(base)), bytes.NewReader(target),
+		int64(len(target))); err != nil {
+		t.Fatal(err)
+	}
+
+	short := base[:len(base)-1]
+	if _, err := ApplyDelta(ioutil.Discard, bytes.NewReader(short), int64(len(short)),
+		bytes.NewReader(patch.Bytes())); errors.Cause(err) != errDeltaBaseMismatch {
+		t.Errorf("patch is applied to the wrong base: %v", err)
+	}
+	for _, p := range [][]byte{
+		patch.Bytes()[:patch.Len()-1],
+		patch.Bytes()[:patch.Len()/2],
+		append([]byte("P2PDELTX"), patch.Bytes()[8:]...),
+		nil,
+	} {
+		if _, err := ApplyDelta(ioutil.Discard, bytes.NewReader(base), int64(len(base)),
+			bytes.NewReader(p)); err != errDeltaCorrupted {
+			t.Errorf("corrupted patch of %d bytes is applied: %v", len(p), err)
+		}
+	}
+}
+
+func TestNewDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rnd := rand.New(rand.NewSource(3))
+	base := make([]byte, 512*1024)
+	rnd.Read(base)
+	target := deltaTarget(rnd, base)
+	baseFile, targetFile, patchFile := filepath.Join(dir, "v1.img"), filepath.Join(dir, "v2.img"),
+		filepath.Join(dir, "v2.img.patch")
+	if err = ioutil.WriteFile(baseFile, base, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(targetFile, target, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDelta(baseFile, targetFile, patchFile, "os-v2-v2.img.patch", 16*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseSum := sha256.Sum256(base)
+	if d.BaseSHA256 != hex.EncodeToString(baseSum[:]) || d.Info.Name != "os-v2-v2.img.patch" ||
+		d.Info.Length >= int64(len(target))/10 || d.Info.NumPieces() == 0 {
+		t.Errorf("unexpected delta %+v", d)
+	}
+	targetSum := sha256.Sum256(target)
+	sum, err := applyDeltaFile(baseFile, patchFile, filepath.Join(dir, "rebuilt.img"))
+	if err != nil || sum != hex.EncodeToString(targetSum[:]) {
+		t.Errorf("rebuilt file has sha256:%s: %v", sum, err)
+	}
+
+	n := Notification{UUID: "os", Info: metainfo.Info{Name: "os-v2-v2.img"}, SHA256: sum, Delta: d}
+	if err = d.Validate(&n); err != nil {
+		t.Error(err)
+	}
+	for _, invalid := range []func(n *Notification){
+		func(n *Notification) { n.SHA256 = "" },
+		func(n *Notification) { n.Info.Files = []metainfo.FileInfo{{Path: []string{"a"}}} },
+		func(n *Notification) { n.Delta.Info.Name = n.Info.Name },
+		func(n *Notification) { n.Delta.Info.Name = "../x" },
+		func(n *Notification) { n.Delta.BaseSHA256 = "abc" },
+	} {
+		m, dd := n, *d
+		m.Delta = &dd
+		invalid(&m)
+		if err = m.Delta.Validate(&m); err == nil {
+			t.Errorf("invalid delta %+v is valid", m)
+		}
+	}
+	if err = (*Delta)(nil).Validate(&n); err != nil {
+		t.Errorf("notification without delta is invalid: %v", err)
+	}
+}
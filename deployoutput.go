@@ -0,0 +1,206 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// deployDefaultMaxOutput is the default number of the last bytes of
+	// the output of the deployment scripts kept with the update.
+	deployDefaultMaxOutput = 64 << 10
+
+	// deployOutputDrain is the time given to the pipe of the output once
+	// the script has exited, e.g. to a daemon it has spawned, before the
+	// pipe is closed.
+	deployOutputDrain = 2 * time.Second
+
+	// deployLogDir is the directory, in the metadata directory of a
+	// namespace, of the output of the deployments of the updates.
+	deployLogDir = "deploy-logs"
+)
+
+// DeployOutput is the output, stdout and stderr, of the scripts of a
+// deployment, of which only the last bytes are kept so that a script writing
+// megabytes never blocks. It records the exit code of the last script, -1 if
+// it was killed, and whether it was killed by the timeout. It is safe for
+// concurrent use, and a nil output discards everything.
+type DeployOutput struct {
+	sync.Mutex
+	max      int
+	buf      []byte
+	dropped  int64
+	ExitCode int
+	TimedOut bool
+}
+
+// NewDeployOutput returns an output keeping the last max bytes, or
+// deployDefaultMaxOutput if max is not positive.
+func NewDeployOutput(max int) *DeployOutput {
+	if max <= 0 {
+		max = deployDefaultMaxOutput
+	}
+	return &DeployOutput{max: max}
+}
+
+// Write keeps the last bytes of p and of the previous writes.
+func (o *DeployOutput) Write(p []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	n := len(p)
+	if len(p) > o.max {
+		o.dropped += int64(len(p) - o.max)
+		p = p[len(p)-o.max:]
+	}
+	if over := len(o.buf) + len(p) - o.max; over > 0 {
+		o.dropped += int64(over)
+		o.buf = append(o.buf[:0], o.buf[over:]...)
+	}
+	o.buf = append(o.buf, p...)
+	return n, nil
+}
+
+// String returns the bytes kept, preceded by the number of bytes dropped if
+// the output was truncated.
+func (o *DeployOutput) String() string {
+	if o == nil {
+		return ""
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.dropped > 0 {
+		return fmt.Sprintf("[%d bytes truncated]\n%s", o.dropped, o.buf)
+	}
+	return string(o.buf)
+}
+
+// exited records the exit of a script with given error returned by Wait.
+func (o *DeployOutput) exited(err error) {
+	if o == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.ExitCode = 0
+	if ee, ok := err.(*exec.ExitError); ok {
+		o.ExitCode = ee.ExitCode()
+	} else if err != nil {
+		o.ExitCode = -1
+	}
+}
+
+// timedOut records that a script is killed by the timeout.
+func (o *DeployOutput) timedOut() {
+	if o == nil {
+		return
+	}
+	o.Lock()
+	o.TimedOut = true
+	o.Unlock()
+}
+
+// outputPipe is the pipe of the output of a script to a DeployOutput. Unlike
+// the pipe of exec.Cmd, Wait does not wait for it to be closed by every
+// process that inherited it, hence a daemon spawned by a script does not
+// block the deployment.
+type outputPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+// pipe redirects the stdout and stderr of given command, which is not
+// started yet, to the output. It returns nil if the output is nil.
+func (o *DeployOutput) pipe(cmd *exec.Cmd) (*outputPipe, error) {
+	if o == nil {
+		return nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	p := &outputPipe{r: r, w: w, done: make(chan struct{})}
+	go func() {
+		io.Copy(o, r)
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// started closes the end of the pipe held by the agent, once the command has
+// started or failed to start.
+func (p *outputPipe) started() {
+	if p != nil {
+		p.w.Close()
+	}
+}
+
+// close waits, for at most given duration, until every process has closed
+// the pipe, then closes it.
+func (p *outputPipe) close(d time.Duration) {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.done:
+	case <-time.After(d):
+	}
+	p.r.Close()
+}
+
+// deployLogPath returns the path of the log of the deployments of the update.
+func (u *Update) deployLogPath() string {
+	return filepath.Join(u.namespace().metadataDir, deployLogDir, u.metadataKey()+".log")
+}
+
+// recordDeployOutput saves the output of the scripts of a deployment with
+// the update and appends it to the log of its deployments. The caller must
+// hold the lock.
+func (u *Update) recordDeployOutput(out *DeployOutput, start time.Time, err error) {
+	u.DeployOutput = out.String()
+	u.DeployExitCode = out.ExitCode
+	u.DeployTimedOut = out.TimedOut
+
+	filename := u.deployLogPath()
+	f, ferr := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if os.IsNotExist(ferr) {
+		if ferr = os.MkdirAll(filepath.Dir(filename), 0750); ferr == nil {
+			f, ferr = os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		}
+	}
+	if ferr != nil {
+		u.logf("WARNING: failed writing deployment log %s - %v", filename, ferr)
+		return
+	}
+	defer f.Close()
+	result := "success"
+	switch {
+	case out.TimedOut:
+		result = fmt.Sprintf("timed out, exit code %d", out.ExitCode)
+	case err != nil:
+		result = fmt.Sprintf("failure, exit code %d - %v", out.ExitCode, err)
+	}
+	fmt.Fprintf(f, "=== %s deployment %d of version %d: %s\n%s",
+		start.Format(time.RFC3339), u.DeployFails+1, u.Notification.Version, result, u.DeployOutput)
+	if len(u.DeployOutput) > 0 && u.DeployOutput[len(u.DeployOutput)-1] != '\n' {
+		fmt.Fprintln(f)
+	}
+}
+
+// removeDeployLog removes the log of the deployments of the update. The
+// caller must hold the lock.
+func (u *Update) removeDeployLog() {
+	if err := os.Remove(u.deployLogPath()); err != nil && !os.IsNotExist(err) {
+		u.logf("WARNING: failed removing deployment log of update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeployOutputKeepsTail(t *testing.T) {
+	o := NewDeployOutput(8)
+	o.Write([]byte("abc"))
+	if s := o.String(); s != "abc" {
+		t.Errorf("unexpected output %q", s)
+	}
+	o.Write([]byte("defghij"))
+	if s := o.String(); s != "[2 bytes truncated]\ncdefghij" {
+		t.Errorf("unexpected truncated output %q", s)
+	}
+	n, err := o.Write([]byte(strings.Repeat("x", 20) + "12345678"))
+	if n != 28 || err != nil {
+		t.Errorf("large write returned %d, %v", n, err)
+	}
+	if s := o.String(); s != "[30 bytes truncated]\n12345678" {
+		t.Errorf("unexpected output of a large write %q", s)
+	}
+	if NewDeployOutput(0).max != deployDefaultMaxOutput {
+		t.Error("default maximum is not applied")
+	}
+	var none *DeployOutput
+	if none.String() != "" {
+		t.Error("nil output is not empty")
+	}
+}
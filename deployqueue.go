@@ -0,0 +1,269 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// deployDefaultConcurrency is the default number of deployments
+	// executed at the same time.
+	deployDefaultConcurrency = 1
+
+	// deployQueueStale is the time after which an update that has not
+	// polled the queue, e.g. whose monitor has stopped, leaves it.
+	deployQueueStale = 30 * time.Second
+)
+
+// DeployConfig holds the configurations of the deployments.
+type DeployConfig struct {
+	// Concurrency is the number of deployers executed at the same time,
+	// 1 by default so that two package managers or two scripts touching
+	// the same service never race.
+	Concurrency int `json:"concurrency"`
+
+	// ChmodEntrypoints makes the scripts of the payloads accessible only to
+	// the user of the agent (0700) before executing them.
+	ChmodEntrypoints bool `json:"chmod-entrypoints"`
+
+	// NoRollback deletes the previous version of a script update as soon
+	// as a new version arrives, rather than keeping it until the new one
+	// is deployed and deploying it again if the new one fails.
+	NoRollback bool `json:"no-rollback"`
+
+	// MaxOutput is the number of the last bytes of the output of the
+	// scripts kept with the update, 64 KiB by default.
+	MaxOutput int `json:"max-output"`
+
+	// MaxRetryInterval is the maximum time in seconds between two retries
+	// of a failed deployment, whose interval starts at 1 minute and
+	// doubles after every failure, 1 hour by default.
+	MaxRetryInterval int `json:"max-retry-interval"`
+
+	// DefaultTimeout is the execution timeout in seconds of the scripts
+	// of the updates whose notification has none, 600 by default.
+	DefaultTimeout int `json:"default-timeout"`
+
+	// User runs the scripts, by name or uid, rather than the user of the
+	// agent, with the supplementary Groups, by name or gid, or the groups
+	// of the user if it is empty. It is not supported on Windows.
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+
+	// Env is added to the environment of the scripts, which is otherwise
+	// limited to a few variables of the agent, e.g. PATH and LANG.
+	Env map[string]string `json:"env"`
+
+	// WorkDir holds the working directories of the scripts, one per
+	// update, the directory .deploy of the data directory by default.
+	WorkDir string `json:"work-dir"`
+}
+
+// validate returns an error if the configuration of the deployments is
+// invalid.
+func (c *DeployConfig) validate() error {
+	if c.User != "" && runtime.GOOS == "windows" {
+		return errors.New("user is not supported on Windows")
+	}
+	if c.User != "" && c.ChmodEntrypoints {
+		return errors.New("user and chmod-entrypoints are exclusive, the user could not read the scripts")
+	}
+	return validateDeployEnv(c.Env)
+}
+
+// DeployQueue serializes the deployments of the updates: an update deploys
+// once it holds one of its slots. The waiting updates are served by
+// priority, then by completion time. The monitors poll it, hence an update
+// never waits for a slot while holding its lock. It is safe for concurrent
+// use, and a nil queue is unlimited.
+type DeployQueue struct {
+	sync.Mutex
+	capacity int
+	running  map[string]deployRun    // by update key
+	waiting  map[string]deployWaiter // by update key
+	closed   bool
+}
+
+type deployRun struct {
+	start   time.Time
+	timeout time.Duration // of the scripts of the update
+}
+
+type deployWaiter struct {
+	rank      int       // of the priority of the update
+	completed time.Time // of the download of the update
+	seen      time.Time // when the update last polled the queue
+}
+
+// NewDeployQueue returns a queue of given number of slots, at least 1.
+func NewDeployQueue(capacity int) *DeployQueue {
+	if capacity < 1 {
+		capacity = deployDefaultConcurrency
+	}
+	return &DeployQueue{
+		capacity: capacity,
+		running:  make(map[string]deployRun),
+		waiting:  make(map[string]deployWaiter),
+	}
+}
+
+// Acquire returns true if the update of given key, priority, completion time
+// and script timeout gets a slot, which must then be released. Otherwise the
+// update waits in the queue until it polls again.
+func (q *DeployQueue) Acquire(key, priority string, completed time.Time, timeout time.Duration) bool {
+	if q == nil {
+		return true
+	}
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	q.waiting[key] = deployWaiter{rank: priorityRank(priority), completed: completed, seen: now}
+	defer q.updateGauges()
+	if q.closed || len(q.running) >= q.capacity || q.position(key, now) != 1 {
+		return false
+	}
+	delete(q.waiting, key)
+	q.running[key] = deployRun{start: now, timeout: timeout}
+	return true
+}
+
+// Release releases the slot of the update of given key.
+func (q *DeployQueue) Release(key string) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	delete(q.running, key)
+	q.updateGauges()
+}
+
+// Leave removes the update of given key from the queue, e.g. once it is
+// stopped or its deployment is held.
+func (q *DeployQueue) Leave(key string) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.waiting[key]; ok {
+		delete(q.waiting, key)
+		q.updateGauges()
+	}
+}
+
+// Reason returns the reason why the update of given key is waiting, which is
+// shown in its status.
+func (q *DeployQueue) Reason(key string) string {
+	if q == nil {
+		return ""
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return "queued for deploy, the agent is stopping"
+	}
+	return fmt.Sprintf("queued for deploy (position %d, %d running)", q.position(key, time.Now()),
+		len(q.running))
+}
+
+// position returns the position (from 1) of the update of given key among
+// the waiting updates, or 0 if it is not waiting. The stale ones are
+// removed. The caller must hold the lock.
+func (q *DeployQueue) position(key string, now time.Time) int {
+	w, ok := q.waiting[key]
+	if !ok {
+		return 0
+	}
+	pos := 1
+	for k, o := range q.waiting {
+		switch {
+		case k == key:
+		case now.Sub(o.seen) > deployQueueStale:
+			delete(q.waiting, k)
+		case o.rank > w.rank,
+			o.rank == w.rank && o.completed.Before(w.completed),
+			o.rank == w.rank && o.completed.Equal(w.completed) && k < key:
+			pos++
+		}
+	}
+	return pos
+}
+
+// Running returns the keys of the updates being deployed, sorted.
+func (q *DeployQueue) Running() []string {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	keys := make([]string, 0, len(q.running))
+	for k := range q.running {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Timeout returns the longest script timeout of the running deployments, or
+// given duration if it is longer.
+func (q *DeployQueue) Timeout(d time.Duration) time.Duration {
+	if q == nil {
+		return d
+	}
+	q.Lock()
+	defer q.Unlock()
+	for _, r := range q.running {
+		if r.timeout > d {
+			d = r.timeout
+		}
+	}
+	return d
+}
+
+// Close stops granting slots, the waiting updates are deployed after a
+// restart.
+func (q *DeployQueue) Close() {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	q.closed = true
+	q.Unlock()
+}
+
+// Wait waits until no deployment is running, or given duration has elapsed.
+// It returns false on timeout.
+func (q *DeployQueue) Wait(d time.Duration) bool {
+	for deadline := time.Now().Add(d); len(q.Running()) > 0; {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// updateGauges updates the gauges of the queue. The caller must hold the
+// lock.
+func (q *DeployQueue) updateGauges() {
+	metrics.Set("agent.deploys_running", int64(len(q.running)))
+	metrics.Set("agent.deploys_queued", int64(len(q.waiting)))
+}
+
+// deployQueued deploys the update holding a slot of the deployment queue,
+// which is released on every path, including a panic of the deployer. The
+// caller must hold the lock.
+func (u *Update) deployQueued(a *Agent) {
+	defer a.deploys.Release(u.key())
+	u.deploy()
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDeployer records the number of deployers running at the same time.
+type fakeDeployer struct {
+	running, max int32
+}
+
+func (d *fakeDeployer) deploy(filename string, timeout time.Duration) error {
+	n := atomic.AddInt32(&d.running, 1)
+	for {
+		max := atomic.LoadInt32(&d.max)
+		if n <= max || atomic.CompareAndSwapInt32(&d.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(time.Millisecond)
+	atomic.AddInt32(&d.running, -1)
+	return nil
+}
+
+func TestDeployQueueSerializes(t *testing.T) {
+	for _, capacity := range []int{1, 3} {
+		q, d := NewDeployQueue(capacity), &fakeDeployer{}
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				completed := time.Now()
+				for !q.Acquire(key, PriorityNormal, completed, time.Minute) {
+					time.Sleep(100 * time.Microsecond)
+				}
+				func() {
+					defer q.Release(key)
+					d.deploy(key, time.Second)
+				}()
+			}(fmt.Sprintf("update-%d", i))
+		}
+		wg.Wait()
+		if d.max != int32(capacity) {
+			t.Errorf("%d deployers ran at the same time, expected %d", d.max, capacity)
+		}
+		if r := q.Running(); len(r) > 0 {
+			t.Errorf("slots are not released: %v", r)
+		}
+	}
+}
+
+func TestDeployQueueOrder(t *testing.T) {
+	q := NewDeployQueue(1)
+	now := time.Now()
+	if !q.Acquire("running", PriorityNormal, now, time.Minute) {
+		t.Fatal("empty queue is not acquired")
+	}
+	// the waiting updates are served by priority, then by completion time
+	waiting := []struct {
+		key, priority string
+		completed     time.Time
+	}{
+		{"normal-late", PriorityNormal, now.Add(time.Minute)},
+		{"low", PriorityLow, now},
+		{"normal-early", PriorityNormal, now.Add(-time.Minute)},
+		{"critical", PriorityCritical, now.Add(time.Hour)},
+	}
+	for _, w := range waiting {
+		if q.Acquire(w.key, w.priority, w.completed, time.Minute) {
+			t.Fatalf("%s is acquired while a deployment is running", w.key)
+		}
+	}
+	if r := q.Reason("low"); r != "queued for deploy (position 4, 1 running)" {
+		t.Errorf("unexpected reason %q", r)
+	}
+	q.Release("running")
+	var order []string
+	for len(waiting) > 0 {
+		acquired := -1
+		for i, w := range waiting {
+			if q.Acquire(w.key, w.priority, w.completed, time.Minute) {
+				if acquired >= 0 {
+					t.Fatalf("%s and %s are both acquired", waiting[acquired].key, w.key)
+				}
+				acquired = i
+			}
+		}
+		if acquired < 0 {
+			t.Fatalf("no update is acquired after %v", order)
+		}
+		order = append(order, waiting[acquired].key)
+		q.Release(waiting[acquired].key)
+		waiting = append(waiting[:acquired], waiting[acquired+1:]...)
+	}
+	expected := []string{"critical", "normal-early", "normal-late", "low"}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("deployed in order %v, expected %v", order, expected)
+	}
+
+	// an update that left the queue does not hold it
+	if !q.Acquire("running", PriorityNormal, now, time.Minute) ||
+		q.Acquire("held", PriorityCritical, now, time.Minute) {
+		t.Fatal("unexpected acquisitions")
+	}
+	q.Leave("held")
+	q.Release("running")
+	if !q.Acquire("normal", PriorityNormal, now, time.Minute) {
+		t.Error("queue is held by an update that left it")
+	}
+	q.Release("normal")
+
+	// no slot is granted once the queue is closed
+	q.Close()
+	if q.Acquire("normal", PriorityNormal, now, time.Minute) {
+		t.Error("closed queue is acquired")
+	}
+	if !q.Wait(time.Second) {
+		t.Error("idle queue is not drained")
+	}
+	var nilQueue *DeployQueue
+	if !nilQueue.Acquire("x", PriorityLow, now, time.Minute) {
+		t.Error("nil queue is not acquired")
+	}
+
+	// the longest timeout of the running deployments applies
+	q = NewDeployQueue(2)
+	if !q.Acquire("short", PriorityNormal, now, time.Minute) || !q.Acquire("long", PriorityNormal, now, time.Hour) {
+		t.Fatal("unexpected acquisitions")
+	}
+	if d := q.Timeout(10 * time.Minute); d != time.Hour {
+		t.Errorf("expected the timeout of the longest deployment, got %v", d)
+	}
+	q.Release("long")
+	if d := q.Timeout(10 * time.Minute); d != 10*time.Minute {
+		t.Errorf("expected the default timeout, got %v", d)
+	}
+	if d := nilQueue.Timeout(time.Minute); d != time.Minute {
+		t.Errorf("expected the default timeout of a nil queue, got %v", d)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// deployWorkDir is the directory, in the data directory of a
+	// namespace, of the working directories of the deployments.
+	deployWorkDir = ".deploy"
+
+	// deployStageDir is the directory, in the working directory of a
+	// deployment run by a deploy user, of the copy of the payload.
+	deployStageDir = "payload"
+
+	// deployDefaultPath is the PATH of the scripts if the agent has none.
+	deployDefaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// DeployUser is the user running the deployment scripts, resolved from the
+// configuration when the update is deployed.
+type DeployUser struct {
+	Name   string
+	Home   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32 // supplementary groups
+}
+
+// lookupDeployUser returns the user of given name or uid, whose
+// supplementary groups are the given names or gids, or its own groups if
+// none is given.
+func lookupDeployUser(name string, groups []string) (*DeployUser, error) {
+	usr, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		usr, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("deploy user '%s' does not exist: %v", name, err)
+	}
+	du := &DeployUser{Name: usr.Username, Home: usr.HomeDir}
+	if du.Uid, err = parseID(usr.Uid); err != nil {
+		return nil, fmt.Errorf("deploy user '%s' has no numeric uid: %v", name, err)
+	}
+	if du.Gid, err = parseID(usr.Gid); err != nil {
+		return nil, fmt.Errorf("deploy user '%s' has no numeric gid: %v", name, err)
+	}
+	if len(groups) == 0 {
+		if groups, err = usr.GroupIds(); err != nil {
+			return nil, fmt.Errorf("failed listing the groups of deploy user '%s': %v", name, err)
+		}
+	}
+	for _, name := range groups {
+		g, err := user.LookupGroup(name)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("deploy group '%s' does not exist: %v", name, err)
+		}
+		gid, err := parseID(g.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("deploy group '%s' has no numeric gid: %v", name, err)
+		}
+		du.Groups = append(du.Groups, gid)
+	}
+	return du, nil
+}
+
+// parseID parses a numeric uid or gid.
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+// validateDeployEnv returns an error if a name of the environment of the
+// deployments is invalid.
+func validateDeployEnv(env map[string]string) error {
+	for k := range env {
+		if k == "" || strings.ContainsAny(k, "=\x00") {
+			return fmt.Errorf("invalid environment variable '%s'", k)
+		}
+	}
+	return nil
+}
+
+// environ returns the environment of the deployment scripts run by given
+// user, the agent if it is nil: the variables of the agent listed by
+// deployEnvKeys, the identity of the user and the Env of the configuration,
+// which overrides them.
+func (c *DeployConfig) environ(du *DeployUser) []string {
+	env := make(map[string]string)
+	for _, k := range deployEnvKeys {
+		if v, ok := os.LookupEnv(k); ok {
+			env[k] = v
+		}
+	}
+	if _, ok := env["PATH"]; !ok {
+		env["PATH"] = deployDefaultPath
+	}
+	if du != nil {
+		env["USER"], env["LOGNAME"], env["HOME"] = du.Name, du.Name, du.Home
+	}
+	for k, v := range c.Env {
+		env[k] = v
+	}
+	environ := make([]string, 0, len(env))
+	for k, v := range env {
+		environ = append(environ, k+"="+v)
+	}
+	sort.Strings(environ)
+	return environ
+}
+
+// workDirPath returns the path of the working directory of the deployment
+// scripts of the update.
+func (u *Update) workDirPath() string {
+	parent := u.agent.Config.Deploy.WorkDir
+	if parent == "" {
+		parent = filepath.Join(u.dataDir(), deployWorkDir)
+	}
+	return filepath.Join(parent, u.metadataKey())
+}
+
+// workDir returns the working directory of the deployment scripts of the
+// update, which is created, and owned by given user if it is not nil. Its
+// parents in the data directory are traversable by the user (see
+// grantParents).
+func (u *Update) workDir(du *DeployUser) (string, error) {
+	dir := u.workDirPath()
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err == nil {
+		if err = os.Mkdir(dir, 0750); os.IsExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed creating working directory: %v", err)
+	}
+	if du != nil {
+		if err := os.Chown(dir, int(du.Uid), int(du.Gid)); err != nil {
+			return "", fmt.Errorf("failed handing working directory over to %s: %v", du.Name, err)
+		}
+		if err := grantParents(du, dir, u.agent.Config.DataDir); err != nil {
+			return "", fmt.Errorf("failed granting working directory to %s: %v", du.Name, err)
+		}
+	}
+	return dir, nil
+}
+
+// removeWorkDir removes the working directory of the deployment scripts of
+// the update. The caller must hold the lock.
+func (u *Update) removeWorkDir() {
+	if err := os.RemoveAll(u.workDirPath()); err != nil {
+		u.logf("WARNING: failed removing working directory of update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+}
+
+// grantParents makes the parents of given path within given top directory,
+// e.g. the data directories that are private to the agent (0750), and the top
+// one traversable by the primary group of given deploy user. Those that are
+// not traversable by all are handed over to the group, which can neither list
+// nor write them. The directories above the top one are left as they are, as
+// are all of them if the path is outside the top one.
+func grantParents(du *DeployUser, path, top string) error {
+	top, err := filepath.Abs(top)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	for {
+		rel, err := filepath.Rel(top, dir)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil
+		}
+		st, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if perm := st.Mode().Perm(); perm&0001 == 0 {
+			if err = os.Chown(dir, -1, int(du.Gid)); err != nil {
+				return err
+			}
+			if err = os.Chmod(dir, perm&^0070|0010); err != nil {
+				return err
+			}
+		}
+		if dir == top {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// copyTree copies given file or directory to given path with their
+// permissions, the symbolic links being copied as links.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			return os.Mkdir(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(path, target, mode.Perm())
+		}
+		return fmt.Errorf("%s is not a regular file", path)
+	})
+}
+
+// copyFile copies given regular file to a new file of given permissions.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// handOver hands given directory and its entries over to given deploy user,
+// e.g. a payload extracted by the agent.
+func handOver(du *DeployUser, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(du.Uid), int(du.Gid))
+	})
+}
+
+// shellDeployer returns a deployer of the scripts of given type running as
+// the user of the configuration, in the working directory of the update,
+// with a sanitized environment. The payload of a deploy user is staged in
+// the working directory, which it owns, rather than opening the data
+// directory to it. The caller must hold the lock.
+func (u *Update) shellDeployer(script ScriptType) (ShellDeployer, error) {
+	cfg := &u.agent.Config.Deploy
+	sh := ShellDeployer{Script: script}
+	if cfg.User != "" {
+		du, err := lookupDeployUser(cfg.User, cfg.Groups)
+		if err != nil {
+			return sh, err
+		}
+		sh.User = du
+	}
+	dir, err := u.workDir(sh.User)
+	if err != nil {
+		return sh, err
+	}
+	sh.Dir, sh.Env = dir, cfg.environ(sh.User)
+	if sh.User != nil {
+		sh.Stage = filepath.Join(dir, deployStageDir)
+	}
+	return sh, nil
+}
+
+// staged returns the deployer of the copy in Stage of the payload of given
+// file, i.e. the entry of Root containing it, which is handed over to User,
+// and the path of the file in the copy. It returns this deployer and the file
+// if Stage is empty.
+func (sh ShellDeployer) staged(filename string) (ShellDeployer, string, error) {
+	if sh.Stage == "" {
+		return sh, filename, nil
+	}
+	root := sh.root(filename)
+	rel, err := filepath.Rel(root, filename)
+	if err != nil {
+		return sh, "", err
+	}
+	// a copy changed by a previous script is replaced
+	if err = os.RemoveAll(sh.Stage); err != nil {
+		return sh, "", err
+	}
+	top := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	if err = copyTree(filepath.Join(root, top), filepath.Join(sh.Stage, top)); err != nil {
+		return sh, "", fmt.Errorf("failed staging %s: %v", filename, err)
+	}
+	if err = handOver(sh.User, sh.Stage); err != nil {
+		return sh, "", fmt.Errorf("failed handing %s over to %s: %v", sh.Stage, sh.User.Name, err)
+	}
+	sh.Root, sh.Stage = sh.Stage, ""
+	return sh, filepath.Join(sh.Root, rel), nil
+}
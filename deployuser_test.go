@@ -0,0 +1,72 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+)
+
+func TestDeployEnviron(t *testing.T) {
+	os.Setenv("P2PUPDATE_SECRET", "secret")
+	defer os.Unsetenv("P2PUPDATE_SECRET")
+	cfg := DeployConfig{Env: map[string]string{"SERVICE": "greenhouse", "LANG": "C"}}
+
+	env := cfg.environ(&DeployUser{Name: "deploy", Home: "/home/deploy"})
+	vars := make(map[string]string)
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		vars[kv[:i]] = kv[i+1:]
+	}
+	if _, ok := vars["P2PUPDATE_SECRET"]; ok {
+		t.Error("variable of the agent is passed to the scripts")
+	}
+	for k, v := range map[string]string{"SERVICE": "greenhouse", "LANG": "C", "USER": "deploy",
+		"LOGNAME": "deploy", "HOME": "/home/deploy"} {
+		if vars[k] != v {
+			t.Errorf("expected %s=%s, got %q", k, v, vars[k])
+		}
+	}
+	if vars["PATH"] == "" {
+		t.Error("scripts have no PATH")
+	}
+
+	if err := validateDeployEnv(cfg.Env); err != nil {
+		t.Error(err)
+	}
+	for _, k := range []string{"", "A=B"} {
+		if err := validateDeployEnv(map[string]string{k: "x"}); err == nil {
+			t.Errorf("invalid variable '%s' is accepted", k)
+		}
+	}
+}
+
+func TestLookupDeployUser(t *testing.T) {
+	if _, err := lookupDeployUser("p2pupdate-no-such-user", nil); err == nil ||
+		!strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("unknown user is accepted: %v", err)
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, name := range []string{current.Username, current.Uid} {
+		du, err := lookupDeployUser(name, []string{current.Gid})
+		if err != nil {
+			t.Skip(err)
+		}
+		if uid, _ := parseID(current.Uid); du.Uid != uid || du.Name != current.Username {
+			t.Errorf("user %s: unexpected uid %d name %s", name, du.Uid, du.Name)
+		}
+		if gid, _ := parseID(current.Gid); len(du.Groups) != 1 || du.Groups[0] != gid {
+			t.Errorf("user %s: unexpected groups %v", name, du.Groups)
+		}
+	}
+	if _, err = lookupDeployUser(current.Username, []string{"p2pupdate-no-such-group"}); err == nil {
+		t.Error("unknown group is accepted")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// deployWindowReason is the prefix of the reason of the updates waiting for
+// the deploy window.
+const deployWindowReason = "waiting for deploy window"
+
+// DeployWindow is the daily window of the deployments of the agent, from
+// Start to End (HH:MM) in the time zone Timezone, the local one if it is
+// empty. A window whose End is not after its Start wraps midnight. The
+// complete updates wait for the window, while the downloads and the seeding
+// go on, and they are deployed at any time if no window is set.
+type DeployWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"` // e.g. Europe/London
+}
+
+// configured returns true if the window is set.
+func (w *DeployWindow) configured() bool {
+	return w.Start != "" || w.End != ""
+}
+
+// location returns the time zone of the window.
+func (w *DeployWindow) location() (*time.Location, error) {
+	if w.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone '%s': %v", w.Timezone, err)
+	}
+	return loc, nil
+}
+
+// validate returns an error if the window is set but invalid.
+func (w *DeployWindow) validate() error {
+	if !w.configured() {
+		return nil
+	}
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	_, err := w.location()
+	return err
+}
+
+// open returns true if the deployments are allowed at given time, or the
+// next opening of the window otherwise.
+func (w *DeployWindow) open(now time.Time) (bool, time.Time) {
+	if !w.configured() {
+		return true, time.Time{}
+	}
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return true, time.Time{}
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return true, time.Time{}
+	}
+	loc, err := w.location()
+	if err != nil {
+		return true, time.Time{}
+	}
+	t := now.In(loc)
+	m := t.Hour()*60 + t.Minute()
+	if start < end && m >= start && m < end {
+		return true, time.Time{}
+	}
+	// the window wraps midnight, its end belongs to the next day
+	if start >= end && (m >= start || m < end) {
+		return true, time.Time{}
+	}
+	next := time.Date(t.Year(), t.Month(), t.Day(), start/60, start%60, 0, 0, loc)
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, start/60, start%60, 0, 0, loc)
+	}
+	return false, next
+}
+
+// hold returns the reason why the updates must not be deployed at given
+// time, or an empty string if the window is open.
+func (w *DeployWindow) hold(now time.Time) string {
+	ok, next := w.open(now)
+	if ok {
+		return ""
+	}
+	zone := w.Timezone
+	if zone == "" {
+		zone = "local time"
+	}
+	return fmt.Sprintf("%s %s-%s %s, opening at %s", deployWindowReason, w.Start, w.End, zone,
+		next.Format(time.RFC3339))
+}
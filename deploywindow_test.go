@@ -0,0 +1,62 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeployWindow(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("time zone database is not available")
+	}
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2018, time.July, day, hour, min, 0, 0, london)
+	}
+	tests := []struct {
+		start, end string
+		now        time.Time
+		open       bool
+		next       time.Time
+	}{
+		{"02:00", "05:00", at(10, 3, 0), true, time.Time{}},
+		{"02:00", "05:00", at(10, 1, 59), false, at(10, 2, 0)},
+		{"02:00", "05:00", at(10, 5, 0), false, at(11, 2, 0)},
+		{"23:00", "02:00", at(10, 23, 30), true, time.Time{}},
+		{"23:00", "02:00", at(10, 1, 0), true, time.Time{}},
+		{"23:00", "02:00", at(10, 2, 0), false, at(10, 23, 0)},
+		{"23:00", "02:00", at(10, 22, 59), false, at(10, 23, 0)},
+		{"", "", at(10, 12, 0), true, time.Time{}},
+	}
+	for _, test := range tests {
+		w := DeployWindow{Start: test.start, End: test.end, Timezone: "Europe/London"}
+		if err := w.validate(); err != nil {
+			t.Fatal(err)
+		}
+		// the time of the agent is converted to the time zone of the window
+		open, next := w.open(test.now.UTC())
+		if open != test.open || !next.Equal(test.next) {
+			t.Errorf("%s-%s at %s: expected %v %s, got %v %s", test.start, test.end,
+				test.now.Format("15:04"), test.open, test.next, open, next)
+		}
+	}
+
+	w := DeployWindow{Start: "02:00", End: "05:00", Timezone: "Europe/London"}
+	if r := w.hold(at(10, 12, 0)); !strings.HasPrefix(r, deployWindowReason) {
+		t.Errorf("unexpected reason %q", r)
+	}
+	for _, invalid := range []DeployWindow{
+		{Start: "2am", End: "05:00"},
+		{Start: "02:00"},
+		{Start: "02:00", End: "05:00", Timezone: "Mars/Olympus"},
+	} {
+		if invalid.validate() == nil {
+			t.Errorf("invalid window %+v is accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+var errDigestMismatch = errors.New("payload digest mismatch")
+
+// PayloadDigest returns the hex SHA-256 digest of the payload at given path.
+// The digest of a directory is the digest of its manifest, which has a line
+// "<sha256>  <path>" per regular file sorted by the slash-separated path
+// relative to the directory, as the output of sha256sum.
+func PayloadDigest(path string) (string, error) {
+	files, _, err := payloadFiles(path, nil)
+	if err != nil {
+		return "", err
+	}
+	return payloadDigest(path, files)
+}
+
+// payloadDigest returns the digest of given payload files, which are
+// returned by payloadFiles, hence the excluded files are not in the manifest.
+func payloadDigest(root string, files []string) (string, error) {
+	if len(files) == 1 && files[0] == "." {
+		return fileDigest(root)
+	}
+	h := sha256.New()
+	for _, f := range files {
+		d, err := fileDigest(filepath.Join(root, filepath.FromSlash(f)))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s  %s\n", d, f)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyDigest verifies the digest of the downloaded payload against the
+// signed digest of the notification. It returns the digest of the payload,
+// which is empty if the notification has no digest, or errDigestMismatch.
+// The caller must hold the lock.
+func (u *Update) verifyDigest() (string, error) {
+	if len(u.Notification.SHA256) == 0 {
+		return "", nil
+	}
+	d, err := PayloadDigest(filepath.Join(u.dataDir(), u.Notification.Info.Name))
+	if err != nil {
+		return "", errors.Wrap(err, "failed computing payload digest")
+	}
+	if d != u.Notification.SHA256 {
+		return d, errors.Wrapf(errDigestMismatch, "expected sha256:%s got sha256:%s",
+			u.Notification.SHA256, d)
+	}
+	return d, nil
+}
+
+// checkDigest verifies the payload digest at given stage of the lifecycle and
+// records the outcome in the audit log. A mismatch is a verification failure
+// rather than a deployment failure, hence the update fails without retrying
+// the deployment. It returns false if the verification fails. The caller
+// must hold the lock.
+func (u *Update) checkDigest(stage string) bool {
+	d, err := u.verifyDigest()
+	if err == nil {
+		if len(d) > 0 {
+			u.agent.audit(AuditDigestVerified, &u.Notification, "",
+				fmt.Sprintf("%s sha256:%s", stage, d))
+		}
+		return true
+	}
+	u.logf("ERROR: %s verification failed uuid:%s version:%d - %v", stage,
+		u.Notification.UUID, u.Notification.Version, err)
+	u.agent.audit(AuditDigestMismatch, &u.Notification, "",
+		fmt.Sprintf("%s %v", stage, err))
+	metrics.Inc("update.verification_failures", "namespace", u.ns.label())
+	u.setState(UpdateFailed)
+	u.Reason = err.Error()
+	u.agent.notifyWebhooks(u, EventDeployFailure, err)
+	return false
+}
+
+// readNotificationFile reads a notification from given file, which is either
+// a torrent file or the JSON output of the submit command.
+func readNotificationFile(filename string) (*Notification, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := ReadNotification(bytes.NewReader(b)); err == nil && len(n.UUID) > 0 {
+		return n, nil
+	}
+	var u Update
+	if err = json.Unmarshal(b, &u); err != nil || len(u.Notification.UUID) == 0 {
+		return nil, fmt.Errorf("'%s' is neither a torrent file nor a submit output", filename)
+	}
+	return &u.Notification, nil
+}
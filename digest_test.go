@@ -0,0 +1,63 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPayloadDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+
+	write("payload/b.sh", "echo b")
+	write("payload/a/c.sh", "echo c")
+	if d, err := PayloadDigest(filepath.Join(dir, "payload", "b.sh")); err != nil || d != sum("echo b") {
+		t.Errorf("wrong file digest %s: %v", d, err)
+	}
+
+	// the manifest is sorted by the relative paths, as sha256sum output
+	manifest := sum("echo c") + "  a/c.sh\n" + sum("echo b") + "  b.sh\n"
+	d1, err := PayloadDigest(filepath.Join(dir, "payload"))
+	if err != nil || d1 != sum(manifest) {
+		t.Errorf("wrong directory digest %s: %v", d1, err)
+	}
+
+	// renaming a file changes the digest as well as modifying it
+	write("payload/a/c.sh", "echo C")
+	if d2, _ := PayloadDigest(filepath.Join(dir, "payload")); d2 == d1 {
+		t.Error("digest of a modified directory is unchanged")
+	}
+	os.Rename(filepath.Join(dir, "payload", "a", "c.sh"), filepath.Join(dir, "payload", "a", "d.sh"))
+	write("payload/a/d.sh", "echo c")
+	if d3, _ := PayloadDigest(filepath.Join(dir, "payload")); d3 == d1 {
+		t.Error("digest of a directory with a renamed file is unchanged")
+	}
+
+	if _, err := PayloadDigest(filepath.Join(dir, "missing")); err == nil {
+		t.Error("digest of a missing payload")
+	}
+}
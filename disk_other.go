@@ -0,0 +1,15 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// freeSpace is not supported on this platform.
+func freeSpace(path string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// diskDefaultMargin is the default free space in MB kept on the file system
+// of the data directory once the payload of an update is downloaded.
+const diskDefaultMargin = 200
+
+var errInsufficientSpace = errors.New("insufficient disk space")
+
+// freeSpaceOf returns the free space of the file system of given directory,
+// or of its closest existing parent if it does not exist yet.
+func freeSpaceOf(dir string) (uint64, error) {
+	for len(dir) > 1 {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return freeSpace(dir)
+}
+
+// payloadOnDisk returns the bytes of the payload of the update already
+// written in the data directory, e.g. by a download before a restart. The
+// caller must hold the lock.
+func (u *Update) payloadOnDisk() int64 {
+	var size int64
+	filepath.Walk(u.payloadPath(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// checkDiskSpace returns an error caused by errInsufficientSpace if the
+// payload of the update, which is not downloaded yet, does not fit in the
+// free space of the data directory with the margin of the configuration. A
+// negative margin disables the check, as does a platform whose free space is
+// unknown. The caller must hold the lock.
+func (u *Update) checkDiskSpace(a *Agent) error {
+	switch u.State {
+	case UpdatePending, UpdateDownloading, UpdateFailedDiskSpace:
+	default:
+		return nil
+	}
+	if a.Config.DiskMargin < 0 {
+		return nil
+	}
+	free, err := freeSpaceOf(u.dataDir())
+	if err != nil {
+		return nil
+	}
+	needed := u.Notification.Info.TotalLength() - u.payloadOnDisk()
+	if needed < 0 {
+		needed = 0
+	}
+	margin := uint64(a.Config.DiskMargin) << 20
+	if free >= uint64(needed)+margin {
+		return nil
+	}
+	return errors.Wrapf(errInsufficientSpace, "%d MB needed with a margin of %d MB but %d MB free in %s",
+		needed>>20, a.Config.DiskMargin, free>>20, u.dataDir())
+}
+
+// failDiskSpace marks the update as failed for lack of disk space with given
+// error of checkDiskSpace. It is not started, hence it is not retried until
+// it is started again, e.g. by a new notification of the same version or a
+// restart. The caller must hold the lock.
+func (u *Update) failDiskSpace(err error) error {
+	u.setState(UpdateFailedDiskSpace)
+	u.Reason = err.Error()
+	u.Stopped = true
+	if serr := u.save(); serr != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, serr)
+	}
+	return err
+}
+
+// retryDiskSpace starts again the update if it has failed for lack of disk
+// space, since space may have been freed meanwhile. It returns false if the
+// update has not failed so.
+func (a *Agent) retryDiskSpace(u *Update) (bool, error) {
+	u.RLock()
+	failed := u.State == UpdateFailedDiskSpace
+	u.RUnlock()
+	if !failed {
+		return false, nil
+	}
+	return true, a.restartUpdate(u)
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disk-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	free, err := freeSpaceOf(filepath.Join(dir, "not", "yet"))
+	if err != nil {
+		t.Skip(err)
+	}
+
+	a := &Agent{Config: &Config{DiskMargin: diskDefaultMargin}, dataDir: dir}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 1,
+		Info: metainfo.Info{Name: "app.bin", Length: 1 << 20}}, a)
+	if err = u.checkDiskSpace(a); err != nil {
+		t.Errorf("payload of 1 MB does not fit: %v", err)
+	}
+
+	// the payload does not fit with the margin
+	u.Notification.Info.Length = int64(free)
+	if err = u.checkDiskSpace(a); errors.Cause(err) != errInsufficientSpace {
+		t.Errorf("expected insufficient space, got %v", err)
+	}
+	u.State = UpdateFailedDiskSpace
+	if err = u.checkDiskSpace(a); err == nil {
+		t.Error("failed update is not checked again")
+	}
+
+	// the bytes already downloaded are not needed again
+	if err = ioutil.WriteFile(filepath.Join(dir, "app.bin"), make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if n := u.payloadOnDisk(); n != 4096 {
+		t.Errorf("expected 4096 bytes on disk, got %d", n)
+	}
+
+	u.State = UpdateDownloaded
+	if err = u.checkDiskSpace(a); err != nil {
+		t.Errorf("downloaded update is checked: %v", err)
+	}
+	u.State, a.Config.DiskMargin = UpdatePending, -1
+	if err = u.checkDiskSpace(a); err != nil {
+		t.Errorf("check is not disabled: %v", err)
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/dht"
+	"github.com/anacrolix/torrent/tracker"
+	"github.com/gortc/stun"
+	"github.com/valyala/fasthttp"
+)
+
+// The outcomes of a doctor check.
+const (
+	CheckPass = "pass"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// DoctorCheck is the outcome of a check of the doctor command. A failed
+// critical check means the agent cannot work.
+type DoctorCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Detail   string `json:"detail,omitempty"`
+	Hint     string `json:"hint,omitempty"`
+}
+
+// Doctor diagnoses the configuration and the connectivity of a node.
+type Doctor struct {
+	Config     Config
+	ConfigErr  error  // error of loading the config file
+	PrivateKey string // optional private key file matched with the public key
+	Timeout    time.Duration
+
+	pid *PeerID
+}
+
+// Run runs all checks in order.
+func (d *Doctor) Run() []DoctorCheck {
+	return []DoctorCheck{
+		d.checkConfig(),
+		d.checkKeys(),
+		d.checkPeerID(),
+		d.checkDirs(),
+		d.checkServer(),
+		d.checkSTUN(),
+		d.checkTracker(),
+		d.checkDHT(),
+		d.checkDisk(),
+	}
+}
+
+// doctorFailures returns the number of failed critical checks.
+func doctorFailures(checks []DoctorCheck) int {
+	n := 0
+	for _, c := range checks {
+		if c.Critical && c.Status == CheckFail {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *Doctor) checkConfig() DoctorCheck {
+	c := DoctorCheck{Name: "config", Critical: true}
+	if d.ConfigErr != nil {
+		c.Status, c.Detail = CheckFail, fmt.Sprintf("failed loading %s: %v", d.Config.filename, d.ConfigErr)
+		c.Hint = "fix the JSON, the default config is printed by 'agent --default-config'"
+	} else if err := d.Config.Validate(); err != nil {
+		c.Status, c.Detail = CheckFail, err.Error()
+		c.Hint = "fix the invalid value in " + d.Config.filename
+	} else {
+		c.Status, c.Detail = CheckPass, d.Config.filename
+	}
+	return c
+}
+
+func (d *Doctor) checkKeys() DoctorCheck {
+	c := DoctorCheck{Name: "keys", Critical: true}
+	pub, err := LoadPublicKey(d.Config.PublicKey.Filename)
+	if err != nil {
+		c.Status, c.Detail = CheckFail, err.Error()
+		c.Hint = "set public-key.filename to the PEM public key that signs the updates"
+		return c
+	}
+	c.Status, c.Detail = CheckPass, fmt.Sprintf("public key %s (%d bits)", d.Config.PublicKey.Filename, pub.N.BitLen())
+	if len(d.PrivateKey) == 0 {
+		return c
+	}
+	key, err := LoadPrivateKey(d.PrivateKey)
+	if err != nil {
+		c.Status, c.Detail = CheckFail, err.Error()
+		c.Hint = "give the PEM private key (RSA PRIVATE KEY) that signs the updates"
+	} else if key.PublicKey.N.Cmp(pub.N) != 0 || key.PublicKey.E != pub.E {
+		c.Status = CheckFail
+		c.Detail = fmt.Sprintf("private key %s does not match public key %s", d.PrivateKey, d.Config.PublicKey.Filename)
+		c.Hint = "the agents reject the updates signed with this private key, deploy the matching public key"
+	} else {
+		c.Detail += fmt.Sprintf(", matches private key %s", d.PrivateKey)
+	}
+	return c
+}
+
+func (d *Doctor) checkPeerID() DoctorCheck {
+	c := DoctorCheck{Name: "peer-id", Critical: true}
+	pid, err := LocalPeerID()
+	if err != nil {
+		c.Status, c.Detail = CheckFail, err.Error()
+		c.Hint = "the peer ID is derived from the serial of a Raspberry Pi or the MAC address" +
+			" of an active interface, bring up a network interface"
+		return c
+	}
+	d.pid = pid
+	c.Status, c.Detail = CheckPass, pid.String()
+	return c
+}
+
+// checkDirs checks that the directories are writable and not accessible by
+// other users, as created by the agent.
+func (d *Doctor) checkDirs() DoctorCheck {
+	c := DoctorCheck{Name: "directories", Critical: true, Status: CheckPass}
+	for _, dir := range []string{d.Config.DataDir, path.Join(d.Config.DataDir, "update"),
+		path.Join(d.Config.DataDir, "notification")} {
+		fi, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			c.Status, c.Detail = CheckWarn, fmt.Sprintf("%s does not exist", dir)
+			c.Hint = "the agent creates it on start, its parent must be writable"
+			return c
+		} else if err != nil {
+			c.Status, c.Detail, c.Hint = CheckFail, err.Error(), "check the permissions of "+dir
+			return c
+		} else if !fi.IsDir() {
+			c.Status, c.Detail, c.Hint = CheckFail, fmt.Sprintf("%s is not a directory", dir), "remove "+dir
+			return c
+		}
+		f, err := ioutil.TempFile(dir, ".doctor")
+		if err != nil {
+			c.Status, c.Detail = CheckFail, fmt.Sprintf("%s is not writable: %v", dir, err)
+			c.Hint = "run the agent as the owner of " + dir
+			return c
+		}
+		f.Close()
+		os.Remove(f.Name())
+		if mode := fi.Mode().Perm(); mode&0002 != 0 {
+			c.Status, c.Detail = CheckFail, fmt.Sprintf("%s is world-writable (%04o)", dir, mode)
+			c.Hint = "chmod 0750 " + dir
+			return c
+		} else if mode&0007 != 0 && c.Status == CheckPass {
+			c.Status, c.Detail = CheckWarn, fmt.Sprintf("%s is accessible by other users (%04o)", dir, mode)
+			c.Hint = "chmod 0750 " + dir
+		}
+	}
+	if c.Status == CheckPass {
+		c.Detail = d.Config.DataDir
+	}
+	return c
+}
+
+// checkServer checks that the server is reachable over TCP, and that the
+// local clock agrees with its clock.
+func (d *Doctor) checkServer() DoctorCheck {
+	c := DoctorCheck{Name: "server", Critical: true}
+	proxy, err := ProxyURL(d.Config.ProxyURL)
+	if err != nil {
+		c.Status, c.Detail = CheckSkip, err.Error()
+		return c
+	}
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI(fmt.Sprintf("http://%s", d.Config.Server))
+	start := time.Now()
+	if err = newHTTPClient(proxy).DoTimeout(req, res, d.Timeout); err != nil {
+		c.Status, c.Detail = CheckFail, fmt.Sprintf("failed connecting to %s: %v", d.Config.Server, err)
+		c.Hint = "check the server address, the firewall and the proxy"
+		return c
+	} else if res.StatusCode() != 200 {
+		c.Status, c.Detail = CheckFail, fmt.Sprintf("server %s replied status code %d", d.Config.Server, res.StatusCode())
+		c.Hint = "check that the server address is the one of the update server"
+		return c
+	}
+	now := start.Add(time.Since(start) / 2)
+	c.Status, c.Detail = CheckPass, fmt.Sprintf("%s reachable in %v", d.Config.Server, time.Since(start).Round(time.Millisecond))
+
+	date, err := time.Parse(time.RFC1123, string(res.Header.Peek("Date")))
+	if err != nil {
+		c.Detail += ", its clock is unknown"
+		return c
+	}
+	// the date has a resolution of a second
+	skew := now.Sub(date).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+	maxSkew := time.Duration(d.Config.Schedule.ClockSkew) * time.Second
+	switch {
+	case skew > maxSkew:
+		c.Status = CheckFail
+		c.Detail += fmt.Sprintf(", the local clock is %v off the server", skew)
+		c.Hint = "synchronise the clock with NTP, the scheduled deployments rely on it"
+	case skew > 2*time.Second:
+		c.Status = CheckWarn
+		c.Detail += fmt.Sprintf(", the local clock is %v off the server", skew)
+		c.Hint = "synchronise the clock with NTP"
+	default:
+		c.Detail += ", clock in sync"
+	}
+	return c
+}
+
+// checkSTUN checks the binding with the STUN service of the server. The
+// overlay of a running agent is queried rather than binding again, since a
+// binding with the same peer ID would replace the agent's session.
+func (d *Doctor) checkSTUN() DoctorCheck {
+	c := DoctorCheck{Name: "stun", Critical: true}
+	if d.Config.NoUDP || len(d.Config.ProxyURL) > 0 {
+		c.Status, c.Detail = CheckSkip, "the overlay is disabled"
+		return c
+	}
+	if state, addr, err := d.agentOverlay(); err == nil {
+		if addr == nil {
+			c.Status, c.Detail = CheckFail, fmt.Sprintf("running agent has not bound, overlay state is %s", state)
+			c.Hint = "check that UDP to the server port is allowed by the firewall"
+		} else {
+			c.Status, c.Detail = CheckPass, fmt.Sprintf("running agent is bound, mapped address %s", addr)
+		}
+		return c
+	}
+	if d.pid == nil {
+		c.Status, c.Detail = CheckSkip, "the peer ID is unknown"
+		return c
+	}
+	addr, err := d.bind()
+	if err != nil {
+		c.Status, c.Detail = CheckFail, fmt.Sprintf("binding with %s failed: %v", d.Config.Server, err)
+		c.Hint = "check that UDP to the server port is allowed by the firewall and the STUN password"
+		return c
+	}
+	c.Status, c.Detail = CheckPass, fmt.Sprintf("mapped address %s", addr)
+	return c
+}
+
+// agentOverlay returns the overlay state and the external address of the
+// agent running on this node.
+func (d *Doctor) agentOverlay() (string, *net.UDPAddr, error) {
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(res)
+	req.SetRequestURI(overlayURL)
+	if err := agentClient(d.Config.API.Address).DoTimeout(req, res, d.Timeout); err != nil {
+		return "", nil, err
+	} else if res.StatusCode() != 200 {
+		return "", nil, fmt.Errorf("status code: %d", res.StatusCode())
+	}
+	var overlay struct {
+		State        string       `json:"state"`
+		ExternalAddr *net.UDPAddr `json:"external-address"`
+	}
+	if err := json.Unmarshal(res.Body(), &overlay); err != nil {
+		return "", nil, err
+	}
+	return overlay.State, overlay.ExternalAddr, nil
+}
+
+// bind sends a binding request to the server, and returns the mapped
+// address of its reply.
+func (d *Doctor) bind() (*stun.XORMappedAddress, error) {
+	raddr, err := net.ResolveUDPAddr("udp", d.Config.Server)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	laddr := conn.LocalAddr().(*net.UDPAddr)
+	req, err := stun.Build(
+		stun.TransactionID,
+		stun.BindingRequest,
+		&stun.XORMappedAddress{IP: laddr.IP, Port: laddr.Port},
+		&TorrentPorts{d.Config.BitTorrent.Port, d.Config.BitTorrent.Port},
+		d.pid,
+		stun.NewShortTermIntegrity(d.Config.Overlay.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(d.Timeout))
+	if _, err = conn.WriteToUDP(req.Raw, raddr); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, d.Config.Overlay.ListeningBufferSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("no reply: %v", err)
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if err = res.Decode(); err != nil || res.TransactionID != req.TransactionID {
+			// e.g. an advertisement of the session table
+			continue
+		}
+		if err = validateMessage(res, &stun.BindingSuccess, d.Config.Overlay.StunPassword); err != nil {
+			return nil, err
+		}
+		var xorAddr stun.XORMappedAddress
+		if err = xorAddr.GetFrom(res); err != nil {
+			return nil, err
+		}
+		return &xorAddr, nil
+	}
+}
+
+// checkTracker announces a random torrent to the tracker. The announce is a
+// stopped event, hence the tracker does not list this node as a peer.
+func (d *Doctor) checkTracker() DoctorCheck {
+	c := DoctorCheck{Name: "tracker"}
+	if len(d.Config.BitTorrent.Tracker) == 0 {
+		c.Status, c.Detail = CheckSkip, "no tracker, the peers are found via DHT and the overlay"
+		return c
+	}
+	proxy, err := ProxyURL(d.Config.ProxyURL)
+	if err != nil {
+		c.Status, c.Detail = CheckSkip, err.Error()
+		return c
+	}
+	announce := tracker.Announce{
+		TrackerUrl: d.Config.BitTorrent.trackerURL(d.Config.BitTorrent.Tracker),
+		UserAgent:  softwareName,
+		HttpClient: newTrackerHTTPClient(proxy),
+		Request: tracker.AnnounceRequest{
+			Event:   tracker.Stopped,
+			NumWant: -1,
+			Port:    uint16(d.Config.BitTorrent.Port),
+		},
+	}
+	rand.Read(announce.Request.InfoHash[:])
+	rand.Read(announce.Request.PeerId[:])
+	tr := d.Config.BitTorrent.redactToken(announce.TrackerUrl)
+	if u, err := url.Parse(announce.TrackerUrl); err == nil && u.Scheme == "udp" && len(d.Config.ProxyURL) > 0 {
+		c.Status, c.Detail = CheckWarn, fmt.Sprintf("UDP tracker %s cannot be reached through the proxy", tr)
+		c.Hint = "use an HTTP tracker"
+		return c
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := announce.Do()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(d.Timeout):
+		err = fmt.Errorf("no reply within %v", d.Timeout)
+	}
+	if err != nil {
+		c.Status, c.Detail = CheckFail, d.Config.BitTorrent.announceError(d.Config.BitTorrent.Tracker, err).Error()
+		c.Hint = "check the tracker address and that it is reachable, or rely on DHT and the overlay"
+		if strings.HasPrefix(err.Error(), trackerForbidden) {
+			c.Hint = "check bittorrent.tracker-token"
+		}
+		return c
+	}
+	c.Status, c.Detail = CheckPass, tr
+	return c
+}
+
+// checkDHT bootstraps a throwaway DHT node from the global bootstrap nodes.
+func (d *Doctor) checkDHT() DoctorCheck {
+	c := DoctorCheck{Name: "dht"}
+	if d.Config.BitTorrent.NoDHT || d.Config.NoUDP || len(d.Config.ProxyURL) > 0 {
+		c.Status, c.Detail = CheckSkip, "DHT is disabled"
+		return c
+	}
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		c.Status, c.Detail = CheckFail, err.Error()
+		return c
+	}
+	s, err := dht.NewServer(&dht.ServerConfig{
+		Conn:          conn,
+		StartingNodes: dht.GlobalBootstrapAddrs,
+		Passive:       true,
+	})
+	if err != nil {
+		conn.Close()
+		c.Status, c.Detail = CheckFail, err.Error()
+		return c
+	}
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Bootstrap()
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(d.Timeout):
+		// the bootstrap traverses the network for long, the nodes found
+		// so far are enough
+	}
+	if n := s.NumNodes(); n > 0 {
+		c.Status, c.Detail = CheckPass, fmt.Sprintf("%d nodes", n)
+	} else {
+		c.Status, c.Detail = CheckFail, "no DHT node replied"
+		if err != nil {
+			c.Detail += ": " + err.Error()
+		}
+		c.Hint = "check that outgoing UDP is allowed, or disable DHT with bittorrent.no-dht" +
+			" and rely on the tracker and the overlay"
+	}
+	return c
+}
+
+// largestUpdate returns the size of the largest update of the metadata
+// store.
+func (d *Doctor) largestUpdate() (int64, error) {
+	store, err := viewMetadataStore(&d.Config)
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+	var largest int64
+	keys, err := store.List(MetadataUpdates)
+	for _, key := range keys {
+		var u struct {
+			Notification Notification `json:"notification"`
+		}
+		if b, err := store.Get(MetadataUpdates, key); err == nil && json.Unmarshal(b, &u) == nil {
+			if l := u.Notification.Info.TotalLength(); l > largest {
+				largest = l
+			}
+		}
+	}
+	return largest, err
+}
+
+// checkDisk checks that a new version of the largest known update fits in
+// the free space of the data directory.
+func (d *Doctor) checkDisk() DoctorCheck {
+	c := DoctorCheck{Name: "disk", Critical: true}
+	free, err := freeSpaceOf(d.Config.DataDir)
+	if err != nil {
+		c.Status, c.Detail = CheckSkip, err.Error()
+		return c
+	}
+
+	largest, err := d.largestUpdate()
+	c.Detail = fmt.Sprintf("%d MB free, the largest update is %d MB", free>>20, largest>>20)
+	if err != nil {
+		// e.g. the BoltDB store is locked by the running agent
+		c.Detail = fmt.Sprintf("%d MB free, the largest update is unknown: %v", free>>20, err)
+	}
+	if free < uint64(largest) {
+		c.Status = CheckFail
+		c.Hint = "free space in " + d.Config.DataDir + ", or delete unused updates"
+	} else {
+		c.Status = CheckPass
+	}
+	return c
+}
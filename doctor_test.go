@@ -0,0 +1,115 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeKeys(t *testing.T, dir, name string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(priv, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(priv+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY",
+		Bytes: pub}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return priv, priv + ".pub"
+}
+
+func TestDoctorKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	priv, pub := writeKeys(t, dir, "key")
+	other, _ := writeKeys(t, dir, "other")
+
+	d := Doctor{Config: DefaultConfig()}
+	d.Config.PublicKey.Filename = pub
+	for _, test := range []struct {
+		privateKey string
+		status     string
+	}{
+		{"", CheckPass},
+		{priv, CheckPass},
+		{other, CheckFail},
+		{pub, CheckFail},
+	} {
+		d.PrivateKey = test.privateKey
+		if c := d.checkKeys(); c.Status != test.status {
+			t.Errorf("private key '%s': %s instead of %s - %s", test.privateKey, c.Status, test.status, c.Detail)
+		}
+	}
+	d.Config.PublicKey.Filename = filepath.Join(dir, "missing.pub")
+	if c := d.checkKeys(); c.Status != CheckFail || !c.Critical {
+		t.Errorf("missing public key must fail: %+v", c)
+	}
+}
+
+func TestDoctorDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := Doctor{Config: DefaultConfig()}
+	d.Config.DataDir = dir
+	if c := d.checkDirs(); c.Status != CheckWarn {
+		t.Errorf("missing directories must warn: %+v", c)
+	}
+	for _, sub := range []string{"update", "notification"} {
+		if err = os.Mkdir(filepath.Join(dir, sub), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for mode, status := range map[os.FileMode]string{0750: CheckPass, 0755: CheckWarn, 0777: CheckFail} {
+		if err = os.Chmod(dir, mode); err != nil {
+			t.Fatal(err)
+		}
+		if c := d.checkDirs(); c.Status != status {
+			t.Errorf("mode %04o: %s instead of %s - %s", mode, c.Status, status, c.Detail)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("default config is invalid: %v", err)
+	}
+	for name, modify := range map[string]func(*Config){
+		"server without port": func(c *Config) { c.Server = "localhost" },
+		"empty data-dir":      func(c *Config) { c.DataDir = "" },
+		"no IP":               func(c *Config) { c.BitTorrent.DisableIPv4, c.BitTorrent.DisableIPv6 = true, true },
+		"piece length":        func(c *Config) { c.BitTorrent.PieceLength = 3000 },
+		"proxy scheme":        func(c *Config) { c.ProxyURL = "ftp://proxy" },
+	} {
+		cfg := DefaultConfig()
+		modify(&cfg)
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("%s: invalid config is accepted", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// errUnsafeEntrypoint is the cause of the deployment failures of payloads
+// that are not safe to execute. Like a digest mismatch, they fail the update
+// without retry.
+var errUnsafeEntrypoint = errors.New("unsafe deploy entrypoint")
+
+// resolveWithin returns given path with its symlinks resolved, or an error
+// caused by errUnsafeEntrypoint if it is outside given root once resolved,
+// or if it is a dangling symlink.
+func resolveWithin(root, filename string) (string, error) {
+	r, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	p, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return "", errors.Wrapf(errUnsafeEntrypoint, "%s cannot be resolved (%v)", filename, err)
+	}
+	rel, err := filepath.Rel(r, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Wrapf(errUnsafeEntrypoint, "%s resolves to %s outside %s", filename, p, root)
+	}
+	return p, nil
+}
+
+// checkEntrypoint returns the path of given script with its symlinks
+// resolved, or an error caused by errUnsafeEntrypoint unless it is a regular
+// file within given root, owned by the user of the agent and not
+// world-writable. The script is made accessible only to its owner if chmod
+// is true.
+func checkEntrypoint(root, filename string, chmod bool) (string, error) {
+	p, err := resolveWithin(root, filename)
+	if err != nil {
+		return "", err
+	}
+	st, err := os.Lstat(p)
+	if err != nil {
+		return "", err
+	}
+	if !st.Mode().IsRegular() {
+		return "", errors.Wrapf(errUnsafeEntrypoint, "%s is not a regular file", filename)
+	}
+	if err = checkPayloadMode(filename, st); err != nil {
+		return "", err
+	}
+	if chmod {
+		if err = os.Chmod(p, 0700); err != nil {
+			return "", err
+		}
+	}
+	return p, nil
+}
+
+// checkPayloadMode returns an error caused by errUnsafeEntrypoint if given
+// file of a payload is world-writable or not owned by the user of the agent,
+// hence it may have been replaced by another user.
+func checkPayloadMode(filename string, st os.FileInfo) error {
+	if st.Mode().Perm()&0002 != 0 {
+		return errors.Wrapf(errUnsafeEntrypoint, "%s is world-writable (%v)", filename, st.Mode().Perm())
+	}
+	if err := checkOwner(st); err != nil {
+		return errors.Wrapf(errUnsafeEntrypoint, "%s %v", filename, err)
+	}
+	return nil
+}
+
+// checkPayloadDir returns an error caused by errUnsafeEntrypoint if an entry
+// of given directory deployed as a payload, e.g. an extracted archive, is a
+// symlink resolved outside given root, or is world-writable or not owned by
+// the user of the agent.
+func checkPayloadDir(root, dir string) error {
+	return filepath.Walk(dir, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			_, err = resolveWithin(root, path)
+			return err
+		}
+		return checkPayloadMode(path, st)
+	})
+}
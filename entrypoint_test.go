@@ -0,0 +1,151 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestCheckEntrypoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entrypoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, outside := filepath.Join(dir, "data"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err = os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(filename string, mode os.FileMode) string {
+		if err := ioutil.WriteFile(filename, []byte("exit 0\n"), mode); err != nil {
+			t.Fatal(err)
+		}
+		// the mode is set again since WriteFile applies the umask
+		if err := os.Chmod(filename, mode); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	symlink := func(target, filename string) string {
+		if err := os.Symlink(target, filename); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	script := write(filepath.Join(root, "main.sh"), 0755)
+	if p, err := checkEntrypoint(root, script, true); err != nil {
+		t.Error(err)
+	} else if st, err := os.Stat(p); err != nil || st.Mode().Perm() != 0700 {
+		t.Errorf("entrypoint is not chmoded: %v %v", st.Mode(), err)
+	}
+	inner := symlink("main.sh", filepath.Join(root, "inner.sh"))
+	if _, err = checkEntrypoint(root, inner, false); err != nil {
+		t.Errorf("symlink within the payload is rejected: %v", err)
+	}
+
+	unsafe := map[string]string{
+		"escaping symlink": symlink(write(filepath.Join(outside, "evil.sh"), 0755),
+			filepath.Join(root, "escape.sh")),
+		"relative escaping symlink": symlink("../outside/evil.sh", filepath.Join(root, "relative.sh")),
+		"dangling symlink":          symlink("/nonexistent/evil.sh", filepath.Join(root, "dangling.sh")),
+		"world-writable script":     write(filepath.Join(root, "writable.sh"), 0777),
+		"directory":                 filepath.Join(root),
+	}
+	for name, filename := range unsafe {
+		if _, err = checkEntrypoint(root, filename, false); errors.Cause(err) != errUnsafeEntrypoint {
+			t.Errorf("%s is not rejected: %v", name, err)
+		}
+	}
+
+	// the deployer rejects them before executing them
+	sh := ShellDeployer{Root: root}
+	if err = sh.deploy(script, time.Second); err != nil {
+		t.Error(err)
+	}
+	for name, filename := range unsafe {
+		if name == "directory" {
+			continue
+		}
+		if err = sh.deploy(filename, time.Second); errors.Cause(err) != errUnsafeEntrypoint {
+			t.Errorf("%s is deployed: %v", name, err)
+		}
+	}
+}
+
+func TestDeployDirChecksEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "entrypoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	payload := filepath.Join(dir, "payload")
+	if err = os.Mkdir(payload, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(payload, "main.sh"), []byte("exit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sh := ShellDeployer{Root: dir}
+	if err = sh.deployDir(payload, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// a world-writable entry may be replaced while the script runs
+	data := filepath.Join(payload, "data.txt")
+	if err = ioutil.WriteFile(data, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chmod(data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err = sh.deployDir(payload, time.Second); errors.Cause(err) != errUnsafeEntrypoint {
+		t.Errorf("world-writable entry is deployed: %v", err)
+	}
+	if err = os.Chmod(data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an entry resolved outside the payload is rejected, even if main.sh is
+	// safe
+	if err = os.Symlink("/etc/passwd", filepath.Join(payload, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err = sh.deployDir(payload, time.Second); errors.Cause(err) != errUnsafeEntrypoint {
+		t.Errorf("escaping symlink is deployed: %v", err)
+	}
+}
+
+func TestCheckEntrypointOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of a file requires root")
+	}
+	dir, err := ioutil.TempDir("", "entrypoint-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "main.sh")
+	if err = ioutil.WriteFile(script, []byte("exit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chown(script, 65534, 65534); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = checkEntrypoint(dir, script, false); errors.Cause(err) != errUnsafeEntrypoint {
+		t.Errorf("script of another user is not rejected: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultEventsSize is the default number of events kept in memory.
+const DefaultEventsSize = 512
+
+// Types of the events of the agent
+const (
+	EventNotificationReceived = "notification-received"
+	EventNotificationRejected = "notification-rejected"
+	EventStateChanged         = "state-changed"
+	EventDeployAttempt        = "deploy-attempt"
+	EventOverlayError         = "overlay-error"
+	EventPeerConnected        = "peer-connected"
+	EventPeerDisconnected     = "peer-disconnected"
+	EventServerFailover       = "server-failover"
+	EventAddressChanged       = "address-changed"
+	EventRolledBack           = "rolled-back"
+)
+
+// AgentEvent is a structured record of something that happened in the agent.
+// Its fields are fixed rather than a map, so appending an event to the ring
+// does not allocate; the fields that do not apply to its type are empty.
+type AgentEvent struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	UUID    string    `json:"uuid,omitempty"`
+	Version uint64    `json:"version,omitempty"`
+	Trace   string    `json:"trace,omitempty"`
+	Peer    string    `json:"peer,omitempty"`
+	From    string    `json:"from,omitempty"` // previous state
+	To      string    `json:"to,omitempty"`   // new state
+	Error   string    `json:"error,omitempty"`
+	Reason  string    `json:"reason,omitempty"` // of a rejected notification
+}
+
+// EventPage is the events after a sequence number. Dropped is the number of
+// events after that sequence number that have been overwritten in the ring,
+// which a follower uses to detect a gap.
+type EventPage struct {
+	Last    uint64       `json:"last"` // sequence number of the latest event
+	Dropped uint64       `json:"dropped"`
+	Events  []AgentEvent `json:"events"`
+}
+
+// EventRing is a bounded in-memory ring buffer of the recent events, whose
+// slots are allocated once. The events are lost on restart, the audit log is
+// the persistent record of the operator decisions.
+type EventRing struct {
+	sync.Mutex
+	events []AgentEvent
+	seq    uint64 // sequence number of the latest event, starting from 1
+}
+
+// NewEventRing returns a ring of given size, or of DefaultEventsSize if it
+// is not positive.
+func NewEventRing(size int) *EventRing {
+	if size <= 0 {
+		size = DefaultEventsSize
+	}
+	return &EventRing{events: make([]AgentEvent, size)}
+}
+
+// Add appends given event to the ring, overwriting the oldest one if the
+// ring is full. Its sequence number and time are set. Nothing is done if the
+// ring is nil.
+func (r *EventRing) Add(e AgentEvent) {
+	if r == nil {
+		return
+	}
+	e.Time = time.Now()
+	r.Lock()
+	r.seq++
+	e.Seq = r.seq
+	r.events[r.seq%uint64(len(r.events))] = e
+	r.Unlock()
+}
+
+// Since returns the events whose sequence numbers are greater than given one,
+// in order.
+func (r *EventRing) Since(seq uint64) EventPage {
+	r.Lock()
+	defer r.Unlock()
+	p := EventPage{Last: r.seq}
+	if seq >= r.seq {
+		p.Events = []AgentEvent{}
+		return p
+	}
+	// the oldest event still in the ring
+	first := uint64(1)
+	if size := uint64(len(r.events)); r.seq > size {
+		first = r.seq - size + 1
+	}
+	if seq+1 < first {
+		p.Dropped = first - seq - 1
+		seq = first - 1
+	}
+	p.Events = make([]AgentEvent, 0, r.seq-seq)
+	for i := seq + 1; i <= r.seq; i++ {
+		p.Events = append(p.Events, r.events[i%uint64(len(r.events))])
+	}
+	return p
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEventRing(t *testing.T) {
+	r := NewEventRing(4)
+	if p := r.Since(0); p.Last != 0 || p.Dropped != 0 || len(p.Events) != 0 {
+		t.Fatalf("empty ring returned %+v", p)
+	}
+	for i := 0; i < 3; i++ {
+		r.Add(AgentEvent{Type: EventStateChanged, UUID: "foo", Version: uint64(i)})
+	}
+	p := r.Since(1)
+	if p.Last != 3 || p.Dropped != 0 || len(p.Events) != 2 {
+		t.Fatalf("since 1 returned %+v", p)
+	}
+	if p.Events[0].Seq != 2 || p.Events[1].Seq != 3 || p.Events[1].Version != 2 {
+		t.Errorf("unexpected events %+v", p.Events)
+	}
+	if p.Events[0].Time.IsZero() {
+		t.Error("event time is not set")
+	}
+
+	// the oldest events are overwritten
+	for i := 3; i < 10; i++ {
+		r.Add(AgentEvent{Type: EventStateChanged, UUID: "foo", Version: uint64(i)})
+	}
+	p = r.Since(3)
+	if p.Last != 10 || p.Dropped != 3 || len(p.Events) != 4 {
+		t.Fatalf("since 3 returned %+v", p)
+	}
+	for i, e := range p.Events {
+		if e.Seq != uint64(7+i) || e.Version != uint64(6+i) {
+			t.Errorf("event %d is %+v", i, e)
+		}
+	}
+	if p = r.Since(10); p.Dropped != 0 || len(p.Events) != 0 {
+		t.Errorf("since last returned %+v", p)
+	}
+	if p = r.Since(8); p.Dropped != 0 || len(p.Events) != 2 {
+		t.Errorf("since 8 returned %+v", p)
+	}
+}
+
+func TestEventRingNil(t *testing.T) {
+	var r *EventRing
+	r.Add(AgentEvent{Type: EventOverlayError})
+}
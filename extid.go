@@ -0,0 +1,224 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/vmihailenco/msgpack"
+)
+
+// attrExtendedPeerID, attrSessionExtIDs and attrAssignedPeerID are
+// comprehension-optional STUN attributes. A binding request carries the
+// extended ID of its sender, the session table sent by the server carries the
+// extended IDs of its peers, and a binding response carries the peer ID
+// assigned by the server to a peer whose ID collides with another one.
+const (
+	attrExtendedPeerID stun.AttrType = 0x8f0f
+	attrSessionExtIDs  stun.AttrType = 0x8f10
+	attrAssignedPeerID stun.AttrType = 0x8f11
+)
+
+// ExtendedPeerID is a 16-byte identifier of peer, which is the hash of its
+// machine ID and its PeerID. The 6-byte PeerID derived from a MAC address or
+// a truncated serial may collide, e.g. with virtualized MACs, while the
+// ExtendedPeerID is unlikely to.
+type ExtendedPeerID [16]byte
+
+func (ext ExtendedPeerID) String() string {
+	return hex.EncodeToString(ext[:])
+}
+
+// IsZero returns true if the ID is not set, e.g. for an old agent.
+func (ext ExtendedPeerID) IsZero() bool {
+	return ext == ExtendedPeerID{}
+}
+
+// AddTo adds ExtendedPeerID into STUN message if it is set.
+func (ext ExtendedPeerID) AddTo(m *stun.Message) error {
+	if !ext.IsZero() {
+		m.Add(attrExtendedPeerID, ext[:])
+	}
+	return nil
+}
+
+// GetFrom gets ExtendedPeerID from STUN message.
+func (ext *ExtendedPeerID) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrExtendedPeerID)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(ext) {
+		return fmt.Errorf("length of extended peer ID (%d bytes) is not %d bytes", len(b), len(ext))
+	}
+	copy(ext[:], b)
+	return nil
+}
+
+// LocalExtendedPeerID returns the ExtendedPeerID of local machine with given
+// PeerID. The machine ID distinguishes the machines whose PeerIDs collide,
+// otherwise the hostname does.
+func LocalExtendedPeerID(pid PeerID) (ExtendedPeerID, error) {
+	id, err := machineID()
+	if err != nil {
+		if id, err = os.Hostname(); err != nil || id == "" {
+			return ExtendedPeerID{}, fmt.Errorf("machine ID and hostname are not available")
+		}
+	}
+	return newExtendedPeerID(id, pid), nil
+}
+
+func newExtendedPeerID(id string, pid PeerID) ExtendedPeerID {
+	var ext ExtendedPeerID
+	h := sha256.New()
+	h.Write([]byte(id))
+	h.Write(pid[:])
+	copy(ext[:], h.Sum(nil))
+	return ext
+}
+
+// aliasPeerID returns the PeerID assigned to a peer whose PeerID collides
+// with another one, which is derived from its ExtendedPeerID. It is a locally
+// administered unicast address, so it does not collide with real MACs.
+func aliasPeerID(ext ExtendedPeerID) PeerID {
+	var pid PeerID
+	copy(pid[:], ext[:])
+	pid[0] = (pid[0] | 0x02) &^ 0x01
+	return pid
+}
+
+// torrentPeerID returns the BitTorrent peer ID of the torrent client of the
+// peer with given ExtendedPeerID, so that the torrent peers added from the
+// session table are annotated with the ID they send in their handshake.
+func torrentPeerID(ext ExtendedPeerID) [20]byte {
+	var id [20]byte
+	copy(id[:], "-FU-")
+	copy(id[4:], ext[:])
+	return id
+}
+
+// AssignedPeerID is the PeerID assigned by the server to a peer whose PeerID
+// collides with the one of another peer.
+type AssignedPeerID PeerID
+
+// AddTo adds AssignedPeerID into STUN message.
+func (pid AssignedPeerID) AddTo(m *stun.Message) error {
+	m.Add(attrAssignedPeerID, pid[:])
+	return nil
+}
+
+// GetFrom gets AssignedPeerID from STUN message.
+func (pid *AssignedPeerID) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrAssignedPeerID)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(pid) {
+		return fmt.Errorf("length of assigned peer ID (%d bytes) is not %d bytes", len(b), len(pid))
+	}
+	copy(pid[:], b)
+	return nil
+}
+
+// SessionExtIDs are the extended IDs of the peers of a session table. The
+// peers without extended ID are omitted.
+type SessionExtIDs map[PeerID]ExtendedPeerID
+
+// AddTo marshals SessionExtIDs as MessagePack data, then writes it on given
+// STUN message if there is any ID.
+func (se SessionExtIDs) AddTo(m *stun.Message) error {
+	if len(se) == 0 {
+		return nil
+	}
+	data, err := msgpack.Marshal(se)
+	if err == nil {
+		m.Add(attrSessionExtIDs, data)
+	}
+	return err
+}
+
+// GetFrom gets SessionExtIDs from STUN message.
+func (se *SessionExtIDs) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrSessionExtIDs)
+	if err != nil {
+		return err
+	}
+	ids := make(SessionExtIDs)
+	if err = msgpack.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	*se = ids
+	return nil
+}
+
+// setPeerExtID sets the extended ID of given peer, or removes it if it has
+// none.
+func setPeerExtID(se SessionExtIDs, pid PeerID, ext ExtendedPeerID) {
+	if !ext.IsZero() {
+		se[pid] = ext
+	} else {
+		delete(se, pid)
+	}
+}
+
+// PeerCollision is a PeerID registered by two peers with different extended
+// IDs. The first one keeps the PeerID and the other one is assigned Alias.
+type PeerCollision struct {
+	PeerID string    `json:"peer-id"`
+	Owner  string    `json:"owner"` // extended ID of the peer keeping the ID
+	Other  string    `json:"other"` // extended ID of the colliding peer
+	Alias  string    `json:"alias"` // PeerID assigned to the colliding peer
+	Time   time.Time `json:"time"`
+}
+
+// resolvePeerID returns the PeerID under which the peer with given PeerID
+// and extended ID is registered, i.e. its own one unless it collides with a
+// peer registered before with a different extended ID. A peer without
+// extended ID keeps its own PeerID. The caller must hold the lock.
+func (s *Server) resolvePeerID(pid PeerID, ext ExtendedPeerID) (PeerID, error) {
+	if ext.IsZero() {
+		return pid, nil
+	}
+	owner, ok := s.extIDs[pid]
+	if !ok || owner == ext {
+		s.extIDs[pid] = ext
+		return pid, nil
+	}
+	alias := aliasPeerID(ext)
+	if other, ok := s.extIDs[alias]; ok && other != ext {
+		return pid, fmt.Errorf("peer ID %s and its alias %s are both taken", pid, alias)
+	}
+	s.extIDs[alias] = ext
+	if _, ok := s.collisions[pid]; !ok {
+		log.Printf("WARNING: peer ID %s of extended ID %s collides with extended ID %s,"+
+			" assigned peer ID %s", pid, ext, owner, alias)
+	}
+	s.collisions[pid] = &PeerCollision{
+		PeerID: pid.String(),
+		Owner:  owner.String(),
+		Other:  ext.String(),
+		Alias:  alias.String(),
+		Time:   time.Now(),
+	}
+	return alias, nil
+}
+
+// sessionExtIDs returns the extended IDs of the peers of given session table.
+// The caller must hold the lock.
+func (s *Server) sessionExtIDs(st SessionTable) SessionExtIDs {
+	ids := make(SessionExtIDs)
+	for pid := range st {
+		if ext, ok := s.extIDs[pid]; ok {
+			ids[pid] = ext
+		}
+	}
+	return ids
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestExtendedPeerIDMessage(t *testing.T) {
+	ext := newExtendedPeerID("machine", PeerID{1, 2, 3, 4, 5, 6})
+	if ext == newExtendedPeerID("other-machine", PeerID{1, 2, 3, 4, 5, 6}) {
+		t.Fatal("machines with the same peer ID have the same extended ID")
+	}
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest, ext,
+		SessionExtIDs{PeerID{1}: ext}, AssignedPeerID{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		got      ExtendedPeerID
+		ids      SessionExtIDs
+		assigned AssignedPeerID
+	)
+	if err = got.GetFrom(msg); err != nil || got != ext {
+		t.Errorf("extended ID is %s (%v), expected %s", got, err, ext)
+	}
+	if err = ids.GetFrom(msg); err != nil || ids[PeerID{1}] != ext {
+		t.Errorf("session extended IDs are %v (%v)", ids, err)
+	}
+	if err = assigned.GetFrom(msg); err != nil || assigned != (AssignedPeerID{2}) {
+		t.Errorf("assigned peer ID is %v (%v)", assigned, err)
+	}
+
+	// the attributes are optional, e.g. for old agents and servers
+	msg, _ = stun.Build(stun.TransactionID, stun.BindingRequest, ExtendedPeerID{})
+	if err = got.GetFrom(msg); err != stun.ErrAttributeNotFound {
+		t.Errorf("expected attribute not found, got %v", err)
+	}
+	if id := torrentPeerID(ext); string(id[:4]) != "-FU-" || string(id[4:]) != string(ext[:]) {
+		t.Errorf("unexpected torrent peer ID %x", id)
+	}
+}
+
+func TestResolvePeerID(t *testing.T) {
+	s := &Server{
+		extIDs:     make(map[PeerID]ExtendedPeerID),
+		collisions: make(map[PeerID]*PeerCollision),
+	}
+	pid := PeerID{0, 0x1c, 0x42, 1, 2, 3}
+	a, b := newExtendedPeerID("a", pid), newExtendedPeerID("b", pid)
+
+	if id, err := s.resolvePeerID(pid, a); err != nil || id != pid {
+		t.Fatalf("first peer is registered as %s (%v)", id, err)
+	}
+	if id, err := s.resolvePeerID(pid, a); err != nil || id != pid {
+		t.Fatalf("first peer is registered again as %s (%v)", id, err)
+	}
+	alias := aliasPeerID(b)
+	if alias[0]&0x03 != 0x02 {
+		t.Errorf("alias %s is not a locally administered unicast address", alias)
+	}
+	if id, err := s.resolvePeerID(pid, b); err != nil || id != alias {
+		t.Fatalf("colliding peer is registered as %s (%v), expected %s", id, err, alias)
+	}
+	// the colliding peer keeps its alias once it uses it
+	if id, err := s.resolvePeerID(alias, b); err != nil || id != alias {
+		t.Errorf("colliding peer is registered as %s (%v) with its alias", id, err)
+	}
+	c, ok := s.collisions[pid]
+	if !ok || c.Owner != a.String() || c.Other != b.String() || c.Alias != alias.String() {
+		t.Errorf("unexpected collision %+v", c)
+	}
+	// a peer without extended ID cannot be disambiguated
+	if id, err := s.resolvePeerID(pid, ExtendedPeerID{}); err != nil || id != pid {
+		t.Errorf("old peer is registered as %s (%v)", id, err)
+	}
+}
+
+func TestPeerIDCollision(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	serverConn := listen()
+	defer serverConn.Close()
+	s := &Server{
+		ID:         PeerID{0, 0, 0, 0, 0, 2},
+		peers:      make(SessionTable),
+		tags:       make(SessionTags),
+		extIDs:     make(map[PeerID]ExtendedPeerID),
+		collisions: make(map[PeerID]*PeerCollision),
+		cfg:        &ServerConfig{StunPassword: defaultStunPassword},
+		udpConn:    serverConn,
+	}
+
+	// two overlays whose peer IDs collide
+	pid := PeerID{0, 0x1c, 0x42, 1, 2, 3}
+	overlays := make([]*OverlayConn, 2)
+	for i, id := range []string{"a", "b"} {
+		conn := listen()
+		defer conn.Close()
+		overlays[i] = &OverlayConn{
+			ID:             pid,
+			ExtID:          newExtendedPeerID(id, pid),
+			Config:         &OverlayConfig{StunPassword: defaultStunPassword},
+			conn:           &overlayUDPConn{conn: conn},
+			rendezvousAddr: serverConn.LocalAddr().(*net.UDPAddr),
+			peers:          make(SessionTable),
+			peerExtIDs:     make(SessionExtIDs),
+		}
+	}
+	// receive reads the messages sent to given overlay by the server
+	receive := func(overlay *OverlayConn, n int) {
+		for i := 0; i < n; i++ {
+			buf := make([]byte, 64*1024)
+			overlay.conn.conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := overlay.conn.conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg stun.Message
+			if _, err = msg.Write(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			if err = overlay.updateSessionTable(&msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, overlay := range overlays {
+		req, err := overlay.bindingRequestMessage(overlay.conn, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res stun.Message
+		if err = s.registerPeer(serverConn, overlay.conn.conn.LocalAddr(), req, &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first overlay receives its binding response and the advertisement
+	// of the second one, which receives its response and the session table
+	receive(overlays[0], 2)
+	receive(overlays[1], 2)
+
+	a, b := overlays[0], overlays[1]
+	alias := aliasPeerID(b.ExtID)
+	if a.LocalID() != pid || b.LocalID() != alias {
+		t.Fatalf("peer IDs are %s and %s, expected %s and %s", a.LocalID(), b.LocalID(), pid, alias)
+	}
+	if len(s.peers) != 2 || len(s.collisions) != 1 {
+		t.Errorf("server has %d peers and %d collisions", len(s.peers), len(s.collisions))
+	}
+	if ext, ok := a.ExtendedID(alias); !ok || ext != b.ExtID {
+		t.Errorf("extended ID of the colliding peer is %s", ext)
+	}
+	if ext, ok := b.ExtendedID(pid); !ok || ext != a.ExtID {
+		t.Errorf("extended ID of the first peer is %s", ext)
+	}
+}
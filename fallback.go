@@ -0,0 +1,377 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// The defaults of the HTTPS fallback.
+const (
+	fallbackDefaultStallTime = 300  // in seconds
+	fallbackDefaultInterval  = 900  // in seconds
+	fallbackDefaultRateLimit = 1024 // in KiB/s
+
+	fallbackHeaderTimeout = 30 * time.Second
+)
+
+// FallbackConfig holds configurations of the download of the updates over
+// HTTPS from the fallback URLs of their notifications, when the agent has had
+// neither torrent peer nor progress for StallTime. The attempts are at least
+// Interval apart. It must be disabled on the sites where HTTP egress is
+// forbidden.
+type FallbackConfig struct {
+	Disabled  bool `json:"disabled"`
+	StallTime int  `json:"stall-time"` // in seconds
+	Interval  int  `json:"interval"`   // in seconds
+
+	// RateLimit is the bandwidth of the fallback downloads of the agent in
+	// KiB/s, which is unlimited if 0.
+	RateLimit int `json:"rate-limit"`
+}
+
+// fallbackState is the state of the HTTPS fallback of an update.
+type fallbackState struct {
+	stalled   time.Time // since when there is no peer and no progress
+	completed int64     // bytes completed when stalled was set
+	attempted time.Time // of the latest download
+	running   bool
+}
+
+// validateFallbackURLs returns an error if any of given fallback URLs is not
+// an absolute HTTPS URL.
+func validateFallbackURLs(urls []string) error {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid fallback URL '%s': %v", s, err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid fallback URL '%s', expected an absolute HTTPS URL", s)
+		}
+	}
+	return nil
+}
+
+// fallbackFileURL returns the URL of a file of the payload of given info,
+// whose path is empty for a single-file payload. The URL of a single file is
+// the given URL, unless it ends with a slash. The files of a multi-file
+// payload are in the directory of its name.
+func fallbackFileURL(base string, info *metainfo.Info, path []string) string {
+	if len(info.Files) == 0 && !strings.HasSuffix(base, "/") {
+		return base
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(info.Name)}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// payloadPath returns the path of a file of the payload of given info in the
+// storage directory, which is the layout of the file storage of the torrent
+// client.
+func payloadPath(dir string, info *metainfo.Info, path []string) string {
+	return filepath.Join(append([]string{dir, info.Name}, path...)...)
+}
+
+// byteRateLimiter limits the rate of the bytes read by the readers sharing
+// it. A nil limiter is unlimited.
+type byteRateLimiter struct {
+	sync.Mutex
+	rate int64     // in bytes per second
+	next time.Time // when the bytes read so far are allowed
+}
+
+// newByteRateLimiter returns a limiter of given rate in bytes per second, or
+// nil if it is not positive.
+func newByteRateLimiter(rate int64) *byteRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteRateLimiter{rate: rate}
+}
+
+// wait sleeps until given number of bytes are allowed.
+func (l *byteRateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	d := l.next.Sub(now)
+	l.Unlock()
+	time.Sleep(d)
+}
+
+// rateLimitedReader is a reader whose rate is limited.
+type rateLimitedReader struct {
+	r io.Reader
+	l *byteRateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.wait(n)
+	return n, err
+}
+
+// fallbackClient returns the HTTP client of the fallback downloads, which
+// verifies the certificates of the servers and goes through the proxy if
+// any. It has no overall timeout since the payloads may be large.
+func fallbackClient(proxy *url.URL) *http.Client {
+	t := &http.Transport{
+		TLSHandshakeTimeout:   fallbackHeaderTimeout,
+		ResponseHeaderTimeout: fallbackHeaderTimeout,
+	}
+	if proxy != nil {
+		t.Proxy = proxyFunc(proxy)
+	}
+	return &http.Client{Transport: t}
+}
+
+// fetchFallbackFile downloads given URL into given file, which is resumed
+// from its current size with a range request. The file is downloaded again
+// if the server does not support ranges.
+func fetchFallbackFile(client *http.Client, limiter *byteRateLimiter, rawurl, filename string,
+	length int64) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > length {
+		if offset, err = 0, f.Truncate(0); err != nil {
+			return err
+		}
+	}
+	if offset == length {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
+			return fmt.Errorf("unexpected content range '%s' of %s", cr, rawurl)
+		}
+	case http.StatusOK:
+		if offset > 0 {
+			if err = f.Truncate(0); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	default:
+		return fmt.Errorf("unexpected status '%s' of %s", resp.Status, rawurl)
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(&rateLimitedReader{r: resp.Body, l: limiter}, length-offset))
+	if err != nil {
+		return err
+	}
+	if offset+n != length {
+		return fmt.Errorf("%s is truncated at %d of %d bytes", rawurl, offset+n, length)
+	}
+	return nil
+}
+
+// verifyPieces returns an error if the content of given files, which are the
+// files of the payload of given info in order, does not match its piece
+// hashes.
+func verifyPieces(info *metainfo.Info, filenames []string) error {
+	readers := make([]io.Reader, 0, len(filenames))
+	for _, filename := range filenames {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	r := io.MultiReader(readers...)
+	buf := make([]byte, info.PieceLength)
+	for i := 0; i < info.NumPieces(); i++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF && i == info.NumPieces()-1 {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed reading piece %d: %v", i, err)
+		}
+		sum := sha1.Sum(buf[:n])
+		if !bytes.Equal(sum[:], info.Pieces[i*20:(i+1)*20]) {
+			return fmt.Errorf("piece %d does not match its hash", i)
+		}
+	}
+	return nil
+}
+
+// downloadFallback downloads the payload of given info from the first of
+// given URLs that succeeds into given temporary directory, then verifies its
+// pieces and copies its files into given storage directory. The partial files
+// are kept in the temporary directory to resume the next attempt, unless they
+// are corrupted.
+func downloadFallback(client *http.Client, limiter *byteRateLimiter, info *metainfo.Info, urls []string,
+	tmpDir, dataDir string) error {
+	files := info.UpvertedFiles()
+	tmps := make([]string, len(files))
+	for i, fi := range files {
+		tmps[i] = payloadPath(tmpDir, info, fi.Path)
+		if err := os.MkdirAll(filepath.Dir(tmps[i]), 0755); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for _, base := range urls {
+		for i, fi := range files {
+			if err = fetchFallbackFile(client, limiter, fallbackFileURL(base, info, fi.Path),
+				tmps[i], fi.Length); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = verifyPieces(info, tmps); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	for i, fi := range files {
+		if err = copyPayloadFile(tmps[i], payloadPath(dataDir, info, fi.Path), fi.Length); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(tmpDir)
+}
+
+// copyPayloadFile copies a downloaded file into the storage, whose file may
+// be open by the torrent client, hence it is overwritten rather than
+// replaced.
+func copyPayloadFile(src, dst string, length int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Truncate(length)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkFallback starts the download of the update from its fallback URLs if
+// the torrent has had neither active peer nor progress for the stall time of
+// the configurations, and the previous attempt is older than their interval.
+// The caller must hold the lock.
+func (u *Update) checkFallback(a *Agent) {
+	cfg := a.Config.Fallback
+	if cfg.Disabled || len(u.Notification.FallbackURLs) == 0 || u.fallback.running {
+		return
+	}
+	now := time.Now()
+	completed := u.torrent.BytesCompleted()
+	if u.fallback.stalled.IsZero() || completed != u.fallback.completed ||
+		u.torrent.Stats().ActivePeers > 0 {
+		u.fallback.stalled, u.fallback.completed = now, completed
+		return
+	}
+	if now.Sub(u.fallback.stalled) < time.Duration(cfg.StallTime)*time.Second ||
+		now.Sub(u.fallback.attempted) < time.Duration(cfg.Interval)*time.Second {
+		return
+	}
+	u.logf("no torrent peer nor progress since %s, downloading update uuid:%s version:%d over HTTPS",
+		u.fallback.stalled.Format(time.RFC3339), u.Notification.UUID, u.Notification.Version)
+	u.startFallback(a)
+}
+
+// startFallback starts the download of the update from its fallback URLs in
+// the background. The caller must hold the lock.
+func (u *Update) startFallback(a *Agent) {
+	u.fallback.running, u.fallback.attempted = true, time.Now()
+	tmpDir := filepath.Join(a.Config.DataDir, "fallback", u.torrent.InfoHash().HexString())
+	go u.runFallback(a, u.Notification.Info, u.Notification.FallbackURLs, tmpDir)
+}
+
+// runFallback downloads the update from its fallback URLs into given
+// temporary directory, then verifies the torrent data so that the agent seeds
+// it and the monitor continues its lifecycle, starting with the verification
+// of the payload digest.
+func (u *Update) runFallback(a *Agent, info metainfo.Info, urls []string, tmpDir string) {
+	err := downloadFallback(fallbackClient(a.proxy), a.fallbackLimiter, &info, urls, tmpDir, u.dataDir())
+
+	u.Lock()
+	u.fallback.running = false
+	t := u.torrent
+	if u.Stopped {
+		t = nil
+	}
+	if err != nil {
+		metrics.Inc("fallback.downloads", "result", "failed")
+		u.logf("WARNING: failed downloading update uuid:%s version:%d over HTTPS: %v",
+			u.Notification.UUID, u.Notification.Version, err)
+		t = nil
+	} else {
+		metrics.Inc("fallback.downloads", "result", "ok")
+		u.logf("downloaded update uuid:%s version:%d over HTTPS fallback",
+			u.Notification.UUID, u.Notification.Version)
+	}
+	u.Unlock()
+	if t != nil {
+		t.VerifyData()
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// fallbackInfo returns the info of a single-file payload of given data.
+func fallbackInfo(name string, data []byte, pieceLength int64) *metainfo.Info {
+	info := &metainfo.Info{Name: name, PieceLength: pieceLength, Length: int64(len(data))}
+	for off := int64(0); off < int64(len(data)); off += pieceLength {
+		end := off + pieceLength
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sum := sha1.Sum(data[off:end])
+		info.Pieces = append(info.Pieces, sum[:]...)
+	}
+	return info
+}
+
+func TestValidateFallbackURLs(t *testing.T) {
+	if err := validateFallbackURLs([]string{"https://example.com/update.bin", "https://example.com/d/"}); err != nil {
+		t.Error(err)
+	}
+	for _, s := range []string{"http://example.com/update.bin", "https:///update.bin", "/update.bin", "%"} {
+		if validateFallbackURLs([]string{s}) == nil {
+			t.Errorf("fallback URL '%s' is valid", s)
+		}
+	}
+}
+
+func TestFallbackFileURL(t *testing.T) {
+	single := &metainfo.Info{Name: "up date.bin"}
+	multi := &metainfo.Info{Name: "update", Files: []metainfo.FileInfo{{Path: []string{"bin", "a b"}}}}
+	for _, tc := range []struct {
+		base string
+		info *metainfo.Info
+		path []string
+		url  string
+	}{
+		{"https://h/x.bin", single, nil, "https://h/x.bin"},
+		{"https://h/d/", single, nil, "https://h/d/up%20date.bin"},
+		{"https://h/d", multi, []string{"bin", "a b"}, "https://h/d/update/bin/a%20b"},
+		{"https://h/d/", multi, []string{"bin", "a b"}, "https://h/d/update/bin/a%20b"},
+	} {
+		if url := fallbackFileURL(tc.base, tc.info, tc.path); url != tc.url {
+			t.Errorf("URL of %v from %s is %s, expected %s", tc.path, tc.base, url, tc.url)
+		}
+	}
+}
+
+func TestDownloadFallback(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4100)
+	info := fallbackInfo("update.bin", data, 16*1024)
+
+	var ranges int32
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/update.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+		}
+		http.ServeContent(w, r, "update.bin", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpDir, dataDir := filepath.Join(dir, "tmp"), filepath.Join(dir, "data")
+
+	// the first attempt was interrupted
+	if err = os.MkdirAll(tmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(tmpDir, "update.bin"), data[:10000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	urls := []string{srv.URL + "/missing.bin", srv.URL + "/"}
+	if err = downloadFallback(srv.Client(), nil, info, urls, tmpDir, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(dataDir, "update.bin")); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("unexpected payload in the storage (%d bytes): %v", len(got), err)
+	}
+	if atomic.LoadInt32(&ranges) != 1 {
+		t.Errorf("the download was not resumed with a range request")
+	}
+	if _, err = os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory is not removed: %v", err)
+	}
+
+	// the server certificate must be verified
+	if err = downloadFallback(fallbackClient(nil), nil, info, urls, tmpDir, dataDir); err == nil ||
+		!strings.Contains(err.Error(), "certificate") {
+		t.Errorf("untrusted certificate is accepted: %v", err)
+	}
+}
+
+func TestDownloadFallbackCorrupted(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 40000)
+	info := fallbackInfo("update.bin", data, 16*1024)
+	corrupted := append([]byte{}, data...)
+	corrupted[20000] = 'y'
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(corrupted)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpDir, dataDir := filepath.Join(dir, "tmp"), filepath.Join(dir, "data")
+
+	err = downloadFallback(srv.Client(), nil, info, []string{srv.URL + "/update.bin"}, tmpDir, dataDir)
+	if err == nil || !strings.Contains(err.Error(), "piece 1") {
+		t.Errorf("corrupted piece is not detected: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dataDir, "update.bin")); !os.IsNotExist(err) {
+		t.Errorf("corrupted payload is written in the storage: %v", err)
+	}
+	if _, err = os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("corrupted download is kept: %v", err)
+	}
+}
+
+func TestByteRateLimiter(t *testing.T) {
+	if newByteRateLimiter(0) != nil {
+		t.Error("limiter of rate 0 is not unlimited")
+	}
+	l := newByteRateLimiter(100 * 1024)
+	start := time.Now()
+	n, err := ioutil.ReadAll(&rateLimitedReader{r: bytes.NewReader(make([]byte, 20*1024)), l: l})
+	if err != nil || len(n) != 20*1024 {
+		t.Fatalf("read %d bytes: %v", len(n), err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("20 KiB are read in %s at 100 KiB/s", d)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	fleetDefaultWindow = 3600 // in seconds
+	fleetMaxErrors     = 100  // distinct error strings kept per update version
+	fleetTopErrors     = 10
+
+	// fleetUntagged groups the reports of the peers without tags, it is not
+	// a valid tag.
+	fleetUntagged = "(untagged)"
+)
+
+// fleetDurationBuckets are the upper bounds (in seconds) of the buckets of the
+// deployment duration histogram, the last bucket has no upper bound.
+var fleetDurationBuckets = []float64{1, 5, 10, 30, 60, 300, 600}
+
+// ErrorCount is the number of failed deployments with an error.
+type ErrorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+// ReasonCount is the number of notifications refused by the agents for a
+// reason.
+type ReasonCount struct {
+	Reason RejectReason `json:"reason"`
+	Count  int          `json:"count"`
+}
+
+// FleetStats is the aggregate of the deployment reports of an update version
+// within a window, which is restricted to the peers of a tag if it is set.
+type FleetStats struct {
+	UUID      string       `json:"uuid"`
+	Version   uint64       `json:"version"`
+	Title     string       `json:"title,omitempty"`
+	Tag       string       `json:"tag,omitempty"`
+	Successes int          `json:"successes"`
+	Failures  int          `json:"failures"`
+	Durations []int        `json:"durations"` // counts of fleetDurationBuckets
+	TopErrors []ErrorCount `json:"top-errors,omitempty"`
+
+	// OtherErrors is the number of failures whose errors are not tracked
+	// since fleetMaxErrors distinct errors have been seen.
+	OtherErrors int `json:"other-errors,omitempty"`
+
+	// Rejections is the number of agents that refused the notification,
+	// which are not counted as deployments, by reason in RejectReasons.
+	Rejections    int           `json:"rejections"`
+	RejectReasons []ReasonCount `json:"reject-reasons,omitempty"`
+
+	errors  map[string]int
+	reasons map[RejectReason]int
+}
+
+// add adds given report to the aggregate.
+func (fs *FleetStats) add(r *DeployReport) {
+	if r.Reject != "" {
+		fs.Rejections++
+		if fs.reasons == nil {
+			fs.reasons = make(map[RejectReason]int)
+		}
+		if _, ok := fs.reasons[r.Reject]; ok || len(fs.reasons) < fleetMaxErrors {
+			fs.reasons[r.Reject]++
+		} else {
+			fs.reasons[RejectOther]++
+		}
+		return
+	}
+	i := sort.SearchFloat64s(fleetDurationBuckets, r.Duration)
+	fs.Durations[i]++
+	if r.Success {
+		fs.Successes++
+		return
+	}
+	fs.Failures++
+	if _, ok := fs.errors[r.Error]; ok || len(fs.errors) < fleetMaxErrors {
+		fs.errors[r.Error]++
+	} else {
+		fs.OtherErrors++
+	}
+}
+
+// summary returns a copy of the aggregate with its top errors.
+func (fs *FleetStats) summary() FleetStats {
+	s := *fs
+	s.Durations = append([]int(nil), fs.Durations...)
+	s.TopErrors = make([]ErrorCount, 0, len(fs.errors))
+	for e, n := range fs.errors {
+		s.TopErrors = append(s.TopErrors, ErrorCount{Error: e, Count: n})
+	}
+	sort.Slice(s.TopErrors, func(i, j int) bool {
+		if s.TopErrors[i].Count == s.TopErrors[j].Count {
+			return s.TopErrors[i].Error < s.TopErrors[j].Error
+		}
+		return s.TopErrors[i].Count > s.TopErrors[j].Count
+	})
+	if len(s.TopErrors) > fleetTopErrors {
+		s.TopErrors = s.TopErrors[:fleetTopErrors]
+	}
+	s.RejectReasons = make([]ReasonCount, 0, len(fs.reasons))
+	for r, n := range fs.reasons {
+		s.RejectReasons = append(s.RejectReasons, ReasonCount{Reason: r, Count: n})
+	}
+	sort.Slice(s.RejectReasons, func(i, j int) bool {
+		if s.RejectReasons[i].Count == s.RejectReasons[j].Count {
+			return s.RejectReasons[i].Reason < s.RejectReasons[j].Reason
+		}
+		return s.RejectReasons[i].Count > s.RejectReasons[j].Count
+	})
+	s.errors, s.reasons = nil, nil
+	return s
+}
+
+// FleetWindow is the aggregates of the deployment reports within a window.
+type FleetWindow struct {
+	Start   time.Time    `json:"start"`
+	Updates []FleetStats `json:"updates"`
+}
+
+// FleetSummary is the fleet-wide deployment statistics, which are
+// aggregated in the current window and the previous one. The aggregates are
+// by update version, or by update version and tag if GroupBy is "tag".
+type FleetSummary struct {
+	Window   int          `json:"window"` // in seconds
+	GroupBy  string       `json:"group-by,omitempty"`
+	Buckets  []float64    `json:"duration-buckets"`
+	Current  FleetWindow  `json:"current"`
+	Previous *FleetWindow `json:"previous,omitempty"`
+}
+
+// FleetAggregator aggregates the deployment reports incrementally as they
+// arrive. The aggregates are rotated every window, hence its memory is
+// bounded by the update versions reported within two windows.
+type FleetAggregator struct {
+	window        time.Duration
+	start         time.Time
+	current       map[string]*FleetStats // by uuid/version, and uuid/version/tag
+	previous      map[string]*FleetStats
+	previousStart time.Time
+}
+
+// NewFleetAggregator returns a FleetAggregator of given window in seconds.
+func NewFleetAggregator(window int) *FleetAggregator {
+	if window <= 0 {
+		window = fleetDefaultWindow
+	}
+	return &FleetAggregator{
+		window:  time.Duration(window) * time.Second,
+		start:   time.Now(),
+		current: make(map[string]*FleetStats),
+	}
+}
+
+// rotate starts a new window if the current one has ended.
+func (fa *FleetAggregator) rotate(now time.Time) {
+	if now.Sub(fa.start) < fa.window {
+		return
+	}
+	if now.Sub(fa.start) < 2*fa.window {
+		fa.previous, fa.previousStart = fa.current, fa.start
+	} else {
+		fa.previous = nil
+	}
+	fa.current = make(map[string]*FleetStats)
+	fa.start = now
+}
+
+// Add adds given report to the aggregate of its update version, and to the
+// aggregates of given tags of its peer.
+func (fa *FleetAggregator) Add(r *DeployReport, now time.Time, tags ...string) {
+	fa.rotate(now)
+	fa.stats(r, "").add(r)
+	if len(tags) == 0 {
+		tags = []string{fleetUntagged}
+	}
+	for _, tag := range tags {
+		fa.stats(r, tag).add(r)
+	}
+}
+
+// stats returns the aggregate of the update version of given report and given
+// tag in the current window, which is created if it does not exist.
+func (fa *FleetAggregator) stats(r *DeployReport, tag string) *FleetStats {
+	key := fmt.Sprintf("%s/%d", r.UUID, r.Version)
+	if tag != "" {
+		key += "/" + tag
+	}
+	fs, ok := fa.current[key]
+	if !ok {
+		fs = &FleetStats{
+			UUID:      r.UUID,
+			Version:   r.Version,
+			Title:     sanitizeText(r.Title, false),
+			Tag:       tag,
+			Durations: make([]int, len(fleetDurationBuckets)+1),
+			errors:    make(map[string]int),
+		}
+		fa.current[key] = fs
+	}
+	return fs
+}
+
+// Summary returns the aggregates of the current and previous windows.
+func (fa *FleetAggregator) Summary(now time.Time) FleetSummary {
+	return fa.summary(now, false)
+}
+
+// SummaryByTag returns the aggregates of the current and previous windows by
+// tag, a peer with several tags is counted in each of them.
+func (fa *FleetAggregator) SummaryByTag(now time.Time) FleetSummary {
+	return fa.summary(now, true)
+}
+
+func (fa *FleetAggregator) summary(now time.Time, byTag bool) FleetSummary {
+	fa.rotate(now)
+	s := FleetSummary{
+		Window:  int(fa.window / time.Second),
+		Buckets: fleetDurationBuckets,
+		Current: fleetWindow(fa.start, fa.current, byTag),
+	}
+	if byTag {
+		s.GroupBy = "tag"
+	}
+	if fa.previous != nil {
+		w := fleetWindow(fa.previousStart, fa.previous, byTag)
+		s.Previous = &w
+	}
+	return s
+}
+
+func fleetWindow(start time.Time, stats map[string]*FleetStats, byTag bool) FleetWindow {
+	w := FleetWindow{Start: start, Updates: make([]FleetStats, 0, len(stats))}
+	for _, fs := range stats {
+		if (fs.Tag != "") == byTag {
+			w.Updates = append(w.Updates, fs.summary())
+		}
+	}
+	sort.Slice(w.Updates, func(i, j int) bool {
+		a, b := w.Updates[i], w.Updates[j]
+		if a.UUID != b.UUID {
+			return a.UUID < b.UUID
+		}
+		if a.Version != b.Version {
+			return a.Version > b.Version
+		}
+		return a.Tag < b.Tag
+	})
+	return w
+}
+
+// WriteSummary renders the statistics of the current window as a table.
+func (s *FleetSummary) WriteSummary(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "window: %ds since %s\n", s.Window, s.Current.Start.Format(time.RFC3339))
+	// the tag is an additional column when the statistics are grouped by tag
+	head, indent := "UUID\tVERSION\t", "\t\t\t"
+	if s.GroupBy == "tag" {
+		head, indent = head+"TAG\t", indent+"\t"
+	}
+	fmt.Fprintln(tw, head+"SUCCESS\tFAILURE\tREJECTED\tDURATIONS")
+	for _, fs := range s.Current.Updates {
+		buckets := make([]string, 0, len(fs.Durations))
+		for i, n := range fs.Durations {
+			if n == 0 {
+				continue
+			}
+			if i < len(s.Buckets) {
+				buckets = append(buckets, fmt.Sprintf("<=%gs:%d", s.Buckets[i], n))
+			} else {
+				buckets = append(buckets, fmt.Sprintf(">%gs:%d", s.Buckets[len(s.Buckets)-1], n))
+			}
+		}
+		id := fmt.Sprintf("%s\t%d\t", fs.UUID, fs.Version)
+		if s.GroupBy == "tag" {
+			id += fs.Tag + "\t"
+		}
+		fmt.Fprintf(tw, "%s%d\t%d\t%d\t%s\n", id, fs.Successes, fs.Failures, fs.Rejections,
+			strings.Join(buckets, " "))
+		for _, e := range fs.TopErrors {
+			fmt.Fprintf(tw, "%s%d\t%s\n", indent, e.Count, e.Error)
+		}
+		if fs.OtherErrors > 0 {
+			fmt.Fprintf(tw, "%s%d\t(other errors)\n", indent, fs.OtherErrors)
+		}
+		// the reasons are under the column of the rejections
+		for _, r := range fs.RejectReasons {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", indent, r.Count, r.Reason)
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFleetAggregator(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	fa := NewFleetAggregator(3600)
+	now := fa.start
+
+	for i := 0; i < 5; i++ {
+		fa.Add(&DeployReport{UUID: uuid, Version: 2, Success: true, Duration: 3}, now)
+	}
+	fa.Add(&DeployReport{UUID: uuid, Version: 2, Error: "exit status 1", Duration: 0.5}, now)
+	fa.Add(&DeployReport{UUID: uuid, Version: 2, Error: "exit status 1", Duration: 700}, now)
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Error: "timeout", Duration: 30}, now)
+
+	s := fa.Summary(now)
+	if len(s.Current.Updates) != 2 || s.Previous != nil {
+		t.Fatalf("wrong summary %+v", s)
+	}
+	fs := s.Current.Updates[0]
+	if fs.Version != 2 || fs.Successes != 5 || fs.Failures != 2 {
+		t.Errorf("wrong stats %+v", fs)
+	}
+	if fs.Durations[0] != 1 || fs.Durations[1] != 5 || fs.Durations[len(fs.Durations)-1] != 1 {
+		t.Errorf("wrong durations %v", fs.Durations)
+	}
+	if len(fs.TopErrors) != 1 || fs.TopErrors[0].Count != 2 {
+		t.Errorf("wrong top errors %+v", fs.TopErrors)
+	}
+	if fs := s.Current.Updates[1]; fs.Version != 1 || fs.Durations[3] != 1 {
+		t.Errorf("wrong stats %+v", fs)
+	}
+
+	var b bytes.Buffer
+	if err := s.WriteSummary(&b); err != nil || !strings.Contains(b.String(), "exit status 1") {
+		t.Errorf("wrong rendered summary %s - %v", b.String(), err)
+	}
+
+	// the distinct errors are bounded
+	for i := 0; i < fleetMaxErrors+10; i++ {
+		fa.Add(&DeployReport{UUID: uuid, Version: 3, Error: fmt.Sprintf("error %d", i)}, now)
+	}
+	for _, fs := range fa.Summary(now).Current.Updates {
+		if fs.Version == 3 && (fs.OtherErrors != 10 || len(fs.TopErrors) != fleetTopErrors) {
+			t.Errorf("wrong bounded errors %d %d", fs.OtherErrors, len(fs.TopErrors))
+		}
+	}
+
+	// the window is rotated
+	s = fa.Summary(now.Add(time.Hour))
+	if len(s.Current.Updates) != 0 || s.Previous == nil || len(s.Previous.Updates) != 3 {
+		t.Errorf("wrong rotated summary %+v", s)
+	}
+	if s = fa.Summary(now.Add(3 * time.Hour)); s.Previous != nil {
+		t.Errorf("the previous window has expired %+v", s)
+	}
+}
+
+func TestFleetAggregatorByTag(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	fa := NewFleetAggregator(3600)
+	now := fa.start
+
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Success: true}, now, "greenhouse", "rack-a")
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Error: "exit status 1"}, now, "greenhouse")
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Success: true}, now)
+
+	if s := fa.Summary(now); len(s.Current.Updates) != 1 || s.Current.Updates[0].Successes != 2 ||
+		s.Current.Updates[0].Failures != 1 || s.GroupBy != "" {
+		t.Fatalf("wrong summary %+v", s)
+	}
+	s := fa.SummaryByTag(now)
+	expected := []struct {
+		tag                 string
+		successes, failures int
+	}{
+		{fleetUntagged, 1, 0},
+		{"greenhouse", 1, 1},
+		{"rack-a", 1, 0},
+	}
+	if len(s.Current.Updates) != len(expected) || s.GroupBy != "tag" {
+		t.Fatalf("wrong summary by tag %+v", s)
+	}
+	for i, e := range expected {
+		fs := s.Current.Updates[i]
+		if fs.Tag != e.tag || fs.Successes != e.successes || fs.Failures != e.failures {
+			t.Errorf("stats %d: %+v, expected %+v", i, fs, e)
+		}
+	}
+	var b bytes.Buffer
+	if err := s.WriteSummary(&b); err != nil || !strings.Contains(b.String(), "TAG") {
+		t.Errorf("wrong table: %v\n%s", err, b.String())
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package main
+
+import "os"
+
+// lockFile does nothing since advisory locks are not supported on this
+// platform, hence concurrent submissions must be avoided.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// tryLockFile does nothing, hence concurrent agents using the same data
+// directory are not detected.
+func tryLockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing.
+func unlockFile(f *os.File) error {
+	return nil
+}
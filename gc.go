@@ -0,0 +1,343 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The defaults of the compaction of the metadata.
+const (
+	gcDefaultInterval           = 24 * 3600      // in seconds
+	gcDefaultTombstoneRetention = 30 * 24 * 3600 // in seconds
+	gcDefaultAuditMaxSize       = 1024 * 1024    // in bytes
+	gcDefaultAuditKeep          = 1000           // entries
+)
+
+// The kinds of the items removed by the compaction.
+const (
+	GCMetadata = "metadata"
+	GCAudit    = "audit"
+	GCPayload  = "payload"
+)
+
+// AuditCheckpoint is the audit event replacing the compacted entries.
+const AuditCheckpoint = "checkpoint"
+
+// GCConfig holds configurations of the compaction of the metadata and of the
+// data directories of the agent, which runs on start and every Interval. The
+// metadata and the payloads of the live updates are never removed.
+type GCConfig struct {
+	Disabled bool `json:"disabled"`
+	Interval int  `json:"interval"` // in seconds
+
+	// TombstoneRetention is how long the metadata of a rejected or
+	// uninstalled update are kept once it is tombstoned.
+	TombstoneRetention int `json:"tombstone-retention"` // in seconds
+
+	// Archive is true if the removed metadata and audit entries are moved
+	// into the archive directory of the data directory rather than
+	// deleted.
+	Archive bool `json:"archive"`
+
+	// AuditMaxSize is the size of the audit log beyond which its entries
+	// are compacted into a checkpoint, except the latest AuditKeep ones.
+	AuditMaxSize int64 `json:"audit-max-size"` // in bytes
+	AuditKeep    int   `json:"audit-keep"`
+
+	// PayloadMinAge is the time since the last modification of a file of
+	// the data directory that belongs to no update before it is removed.
+	PayloadMinAge int `json:"payload-min-age"` // in seconds
+
+	// DryRun only logs the items that the periodic compaction would
+	// remove.
+	DryRun bool `json:"dry-run"`
+}
+
+// GCItem is an item removed, or to be removed by a dry run, by the
+// compaction.
+type GCItem struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// GCResult is the result of a compaction of the metadata.
+type GCResult struct {
+	DryRun   bool     `json:"dry-run"`
+	Archived bool     `json:"archived"`
+	Items    []GCItem `json:"items"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// AuditCheckpointData are the data of a checkpoint of the audit log, which
+// replaces the compacted entries. SHA256 is the digest of their lines, the
+// first of which is the previous checkpoint if any, hence the checkpoints
+// are chained. Signature is the Ed25519 signature of the digest by the peer
+// identity of the agent, if it is available.
+type AuditCheckpointData struct {
+	Entries   int       `json:"entries"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	SHA256    string    `json:"sha256"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// verify returns an error if given compacted lines of the audit log do not
+// match the checkpoint, or its signature is not of given public key.
+func (c *AuditCheckpointData) verify(compacted []byte, pub ed25519.PublicKey) error {
+	digest := sha256.Sum256(compacted)
+	if hex.EncodeToString(digest[:]) != c.SHA256 {
+		return errors.New("digest of the compacted entries does not match the checkpoint")
+	}
+	if pub == nil {
+		return nil
+	}
+	sig, err := hex.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(pub, digest[:], sig) {
+		return errors.New("invalid signature of the checkpoint")
+	}
+	return nil
+}
+
+// tombstoneTime returns the value of the time of a tombstone.
+func tombstoneTime(t time.Time) []byte {
+	b, _ := json.Marshal(t.UTC())
+	return b
+}
+
+// parseMetadataKey returns the UUID and the version of given key of update
+// metadata, or false if it is not one.
+func parseMetadataKey(key string) (string, uint64, bool) {
+	i := strings.LastIndex(key, "-v")
+	if i <= 0 {
+		return "", 0, false
+	}
+	version, err := strconv.ParseUint(key[i+2:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return key[:i], version, true
+}
+
+// startGC compacts the metadata now and every interval of the
+// configurations, unless it is disabled.
+func (a *Agent) startGC() {
+	cfg := a.Config.GC
+	if cfg.Disabled {
+		return
+	}
+	go a.logGC()
+	if cfg.Interval > 0 {
+		a.gcQuit = ExecEvery(time.Duration(cfg.Interval)*time.Second, a.logGC)
+	}
+}
+
+// logGC compacts the metadata and the data directories, and logs the
+// result.
+func (a *Agent) logGC() {
+	res := a.gc(a.Config.GC.DryRun)
+	for _, item := range res.Items {
+		if res.DryRun {
+			log.Printf("compaction would remove %s %s: %s", item.Kind, item.Name, item.Detail)
+		} else if item.Kind == GCPayload {
+			log.Printf("compaction removed %s %s: %s", item.Kind, item.Name, item.Detail)
+		}
+	}
+	if len(res.Items) > 0 && !res.DryRun {
+		log.Printf("compacted metadata, %d items removed", len(res.Items))
+	}
+	for _, err := range res.Errors {
+		log.Printf("WARNING: metadata compaction - %s", err)
+	}
+}
+
+// gc removes the metadata of the updates tombstoned for longer than the
+// retention and the payloads of no update (see gcPayloads), and compacts the
+// audit log beyond its maximum size. A dry run only returns what would be
+// removed.
+func (a *Agent) gc(dryRun bool) GCResult {
+	res := GCResult{DryRun: dryRun, Archived: a.Config.GC.Archive, Items: []GCItem{}}
+	now := time.Now()
+	if err := a.gcTombstoned(now, dryRun, &res); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	if err := a.gcAudit(now, dryRun, &res); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	if err := a.gcPayloads(now, dryRun, &res); err != nil {
+		res.Errors = append(res.Errors, err.Error())
+	}
+	if !dryRun {
+		metrics.Add("gc.removed", int64(len(res.Items)))
+	}
+	return res
+}
+
+// gcTombstoned removes the metadata of the updates whose versions were
+// tombstoned for longer than the retention, e.g. left by a crash or by an
+// update which failed to reload. The time of a tombstone written without it
+// is recorded, hence its retention starts now.
+func (a *Agent) gcTombstoned(now time.Time, dryRun bool, res *GCResult) error {
+	retention := time.Duration(a.Config.GC.TombstoneRetention) * time.Second
+	a.RLock()
+	tombstones := make(map[string]uint64, len(a.tombstones))
+	for k, v := range a.tombstones {
+		tombstones[k] = v
+	}
+	updates := make([]*Update, 0, len(a.updates))
+	for _, u := range a.updates {
+		updates = append(updates, u)
+	}
+	namespaces := append([]*Namespace{}, a.namespaces...)
+	a.RUnlock()
+	live := make(map[string]bool)
+	for _, u := range updates {
+		u.RLock()
+		live[u.metadataBucket()+"/"+u.metadataKey()] = true
+		u.RUnlock()
+	}
+
+	store := a.metadata()
+	for _, ns := range namespaces {
+		bucket := updatesBucket(ns.Name)
+		keys, err := store.List(bucket)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			uuid, version, ok := parseMetadataKey(key)
+			if !ok || live[bucket+"/"+key] {
+				continue
+			}
+			ukey := updateKey(ns.Name, uuid)
+			if v, ok := tombstones[ukey]; !ok || version > v {
+				continue
+			}
+			var since time.Time
+			b, err := store.Get(MetadataTombstoned, ukey)
+			if err == errMetadataNotFound {
+				if !dryRun {
+					err = store.Put(MetadataTombstoned, ukey, tombstoneTime(now))
+				}
+				if err != nil {
+					return err
+				}
+				continue
+			} else if err != nil {
+				return err
+			} else if err = json.Unmarshal(b, &since); err != nil {
+				return errors.Wrapf(err, "invalid tombstone time of %s", ukey)
+			}
+			if now.Sub(since) < retention {
+				continue
+			}
+			res.Items = append(res.Items, GCItem{Kind: GCMetadata, Name: bucket + "/" + key,
+				Detail: fmt.Sprintf("tombstoned since %s", since.Format(time.RFC3339))})
+			if dryRun {
+				continue
+			}
+			if a.Config.GC.Archive {
+				if b, err = store.Get(bucket, key); err == nil {
+					err = a.archive(filepath.Join(filepath.FromSlash(bucket), key), b)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if err = store.Delete(bucket, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gcAudit compacts the entries of the audit log, except the latest ones,
+// into a checkpoint if the log exceeds its maximum size.
+func (a *Agent) gcAudit(now time.Time, dryRun bool, res *GCResult) error {
+	cfg := a.Config.GC
+	a.auditLock.Lock()
+	defer a.auditLock.Unlock()
+	b, err := ioutil.ReadFile(a.auditFilename())
+	if os.IsNotExist(err) || (err == nil && int64(len(b)) <= cfg.AuditMaxSize) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	keep := cfg.AuditKeep
+	if keep >= len(lines) {
+		keep = len(lines) / 2
+	}
+	n := len(lines) - keep
+	if n < 2 {
+		return nil
+	}
+	compacted := bytes.Join(lines[:n], nil)
+	var first, last AuditEntry
+	if err = json.Unmarshal(lines[0], &first); err != nil {
+		return errors.Wrap(err, "invalid audit entry")
+	}
+	if err = json.Unmarshal(lines[n-1], &last); err != nil {
+		return errors.Wrap(err, "invalid audit entry")
+	}
+	digest := sha256.Sum256(compacted)
+	c := &AuditCheckpointData{Entries: n, First: first.Timestamp, Last: last.Timestamp,
+		SHA256: hex.EncodeToString(digest[:])}
+	if a.Identity != nil {
+		c.Signature = hex.EncodeToString(ed25519.Sign(a.Identity.key, digest[:]))
+	}
+	res.Items = append(res.Items, GCItem{Kind: GCAudit, Name: a.auditFilename(),
+		Detail: fmt.Sprintf("%d entries from %s to %s", n, c.First.Format(time.RFC3339),
+			c.Last.Format(time.RFC3339))})
+	if dryRun {
+		return nil
+	}
+	if cfg.Archive {
+		if err = a.archive(fmt.Sprintf("audit-%s.log", c.SHA256[:16]), compacted); err != nil {
+			return err
+		}
+	}
+	checkpoint, err := json.Marshal(AuditEntry{
+		Timestamp:  now,
+		Event:      AuditCheckpoint,
+		Detail:     fmt.Sprintf("%d entries sha256:%s", n, c.SHA256),
+		Checkpoint: c,
+
+		UnsyncedClock: !a.clock.Synced(),
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileSync(a.auditFilename(),
+		bytes.Join(append([][]byte{append(checkpoint, '\n')}, lines[n:]...), nil))
+}
+
+// archive writes given data into given file of the archive directory.
+func (a *Agent) archive(name string, b []byte) error {
+	filename := filepath.Join(a.Config.DataDir, "archive", name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+	return writeFileSync(filename, b)
+}
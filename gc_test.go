@@ -0,0 +1,262 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestGCTombstoned(t *testing.T) {
+	const (
+		rejected = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+		running  = "3f8cd1a8-2c5e-4d1b-9a0e-6d2b7c1e4f90"
+		imported = "0b7a1c52-6f3e-4c8d-a2b9-5e1d7f3c8a46"
+	)
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	cfg.GC.Archive = true
+	a := &Agent{Config: &cfg, metadataDir: filepath.Join(dir, "notification"), updates: make(map[string]*Update)}
+	if err = os.MkdirAll(a.metadataDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	live := &Update{Notification: Notification{UUID: running, Version: 1}, agent: a, ns: a.namespaces[0]}
+	a.updates[live.key()] = live
+	for _, key := range []string{rejected + "-v3", rejected + "-v7", running + "-v1", imported + "-v2"} {
+		if err = a.metadata().Put(MetadataUpdates, key, []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for uuid, version := range map[string]uint64{rejected: 5, running: 1, imported: 2} {
+		if err = a.addTombstone(uuid, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a tombstone imported without its time
+	if err = a.metadata().Delete(MetadataTombstoned, imported); err != nil {
+		t.Fatal(err)
+	}
+
+	// the retention has not passed
+	if res := a.gc(false); len(res.Items) != 0 || len(res.Errors) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if _, err = a.metadata().Get(MetadataTombstoned, imported); err != nil {
+		t.Errorf("time of the tombstone is not recorded - %v", err)
+	}
+
+	old := tombstoneTime(time.Now().Add(-time.Duration(cfg.GC.TombstoneRetention+60) * time.Second))
+	for _, uuid := range []string{rejected, running} {
+		if err = a.metadata().Put(MetadataTombstoned, uuid, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res := a.gc(true)
+	if len(res.Items) != 1 || res.Items[0].Name != MetadataUpdates+"/"+rejected+"-v3" {
+		t.Fatalf("unexpected dry run %+v", res)
+	}
+	if _, err = a.metadata().Get(MetadataUpdates, rejected+"-v3"); err != nil {
+		t.Error("dry run removed the metadata")
+	}
+	if res = a.gc(false); len(res.Items) != 1 || len(res.Errors) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	keys, err := a.metadata().List(MetadataUpdates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the live update and the version above the tombstone are kept
+	if len(keys) != 3 || keys[0] != imported+"-v2" || keys[1] != running+"-v1" || keys[2] != rejected+"-v7" {
+		t.Errorf("unexpected metadata %v", keys)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "archive", MetadataUpdates, rejected+"-v3")); err != nil {
+		t.Errorf("metadata are not archived - %v", err)
+	}
+}
+
+func TestGCPayloads(t *testing.T) {
+	const (
+		running = "3f8cd1a8-2c5e-4d1b-9a0e-6d2b7c1e4f90"
+		gone    = "0b7a1c52-6f3e-4c8d-a2b9-5e1d7f3c8a46"
+	)
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	a := &Agent{Config: &cfg, dataDir: filepath.Join(dir, "update"), updates: make(map[string]*Update)}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	live := &Update{Notification: Notification{UUID: running, Version: 1,
+		Info: metainfo.Info{Name: "app-v1"}}, agent: a, ns: a.namespaces[0]}
+	a.updates[live.key()] = live
+
+	old := time.Now().Add(-time.Duration(cfg.GC.PayloadMinAge+60) * time.Second)
+	for name, modified := range map[string]time.Time{
+		"app-v1/main.sh":       old,
+		"orphan.img":           old,
+		"partial/main.sh":      old,
+		"partial/lib/fresh.sh": time.Now(),
+		"fresh.img":            time.Now(),
+		filepath.Join(previousDir, running, "app-v0"): old,
+		filepath.Join(previousDir, gone, "old-v3"):    old,
+		filepath.Join(deployWorkDir, "state"):         old,
+	} {
+		filename := filepath.Join(a.dataDir, name)
+		if err = os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filename, []byte("payload"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(filename, modified, modified)
+	}
+	// the directories are old, only their fresh files are not
+	filepath.Walk(a.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chtimes(path, old, old)
+		}
+		return nil
+	})
+
+	removed := func(res GCResult) []string {
+		var names []string
+		for _, item := range res.Items {
+			if item.Kind == GCPayload {
+				names = append(names, item.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	expected := []string{"update/" + previousDir + "/" + gone, "update/orphan.img"}
+	if names := removed(a.gc(true)); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected dry run removing %v, got %v", expected, names)
+	}
+	if _, err = os.Stat(filepath.Join(a.dataDir, "orphan.img")); err != nil {
+		t.Error("dry run removed the payload")
+	}
+	if names := removed(a.gc(false)); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v removed, got %v", expected, names)
+	}
+	for _, name := range []string{"app-v1", "partial", "fresh.img", previousDir + "/" + running, deployWorkDir} {
+		if _, err = os.Stat(filepath.Join(a.dataDir, name)); err != nil {
+			t.Errorf("%s is removed", name)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(a.dataDir, "orphan.img")); !os.IsNotExist(err) {
+		t.Error("orphan payload is not removed")
+	}
+}
+
+func TestGCAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	cfg.GC.Archive = true
+	cfg.GC.AuditMaxSize = 512
+	cfg.GC.AuditKeep = 2
+	a := &Agent{Config: &cfg, Identity: &PeerIdentity{key: key}}
+
+	n := &Notification{UUID: UUIDShell, Version: 1}
+	for i := 0; i < 3; i++ {
+		a.audit(AuditApproved, n, approvalLocal, "")
+	}
+	if res := a.gc(false); len(res.Items) != 0 {
+		t.Fatalf("audit log below the maximum size is compacted: %+v", res)
+	}
+	for i := 0; i < 5; i++ {
+		a.audit(AuditApproved, n, approvalLocal, "")
+	}
+	if res := a.gc(true); len(res.Items) != 1 || res.Items[0].Kind != GCAudit {
+		t.Fatalf("unexpected dry run %+v", res)
+	}
+	if entries, _ := a.auditEntries(); len(entries) != 8 {
+		t.Fatalf("dry run compacted the audit log")
+	}
+	if res := a.gc(false); len(res.Items) != 1 || len(res.Errors) != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	entries, err := a.auditEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := entries[0].Checkpoint
+	if len(entries) != 3 || entries[0].Event != AuditCheckpoint || c == nil || c.Entries != 6 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	compacted, err := ioutil.ReadFile(filepath.Join(dir, "archive", "audit-"+c.SHA256[:16]+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.verify(compacted, pub); err != nil {
+		t.Error(err)
+	}
+	if err = c.verify(bytes.Replace(compacted, []byte(approvalLocal), []byte("remote"), 1), pub); err == nil {
+		t.Error("modified entries are verified")
+	}
+
+	// the next checkpoint covers the previous one
+	for i := 0; i < 8; i++ {
+		a.audit(AuditApproved, n, approvalLocal, "")
+	}
+	if res := a.gc(false); len(res.Items) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	entries, _ = a.auditEntries()
+	compacted, err = ioutil.ReadFile(filepath.Join(dir, "archive", "audit-"+entries[0].Checkpoint.SHA256[:16]+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(compacted, []byte(c.SHA256)) {
+		t.Error("checkpoint is not chained to the previous one")
+	}
+}
+
+func TestParseMetadataKey(t *testing.T) {
+	uuid, version, ok := parseMetadataKey(UUIDShell + "-v12")
+	if !ok || uuid != UUIDShell || version != 12 {
+		t.Errorf("unexpected key %s %d %v", uuid, version, ok)
+	}
+	for _, key := range []string{"-v1", UUIDShell, UUIDShell + "-vx", "journal.tmp"} {
+		if _, _, ok = parseMetadataKey(key); ok {
+			t.Errorf("%s is parsed", key)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gcDefaultPayloadMinAge is the default time in seconds since the last
+// modification of an unreferenced payload before it is removed.
+const gcDefaultPayloadMinAge = 24 * 3600
+
+// payloadRefs are the files of the data directory of a namespace that belong
+// to the updates: the payloads and patches by name, and the previous versions
+// and the delta bases by UUID.
+type payloadRefs struct {
+	names map[string]bool
+	uuids map[string]bool
+}
+
+// gcPayloads removes the files of the data directories of the namespaces
+// that belong to no update, e.g. left by an interrupted update or by metadata
+// deleted by hand, once they have not been modified for the minimum age of
+// the configuration. The updates are listed first, then the files are
+// removed while the agent lock is held, unless an update has been added
+// meanwhile, so that the payload of an update being started is never
+// removed. The payloads are never archived.
+func (a *Agent) gcPayloads(now time.Time, dryRun bool, res *GCResult) error {
+	minAge := time.Duration(a.Config.GC.PayloadMinAge) * time.Second
+	a.RLock()
+	updates := make(map[*Update]bool, len(a.updates))
+	for _, u := range a.updates {
+		updates[u] = true
+	}
+	for _, versions := range a.kept {
+		for _, u := range versions {
+			updates[u] = true
+		}
+	}
+	namespaces := append([]*Namespace{a.defaultNamespace()}, a.namespaces...)
+	a.RUnlock()
+
+	refs := make(map[string]*payloadRefs)
+	for _, ns := range namespaces {
+		refs[ns.dataDir] = &payloadRefs{names: make(map[string]bool), uuids: make(map[string]bool)}
+	}
+	for u := range updates {
+		u.RLock()
+		r := refs[u.dataDir()]
+		if r != nil {
+			r.names[u.Notification.Info.Name] = true
+			if d := u.Notification.Delta; d != nil {
+				r.names[d.Info.Name] = true
+			}
+			if p := u.Previous; p != nil {
+				r.names[p.Notification.Info.Name] = true
+			}
+			r.uuids[u.Notification.UUID] = true
+		}
+		u.RUnlock()
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	for _, u := range a.updates {
+		if !updates[u] {
+			// the next compaction will know its files
+			return nil
+		}
+	}
+	for _, versions := range a.kept {
+		for _, u := range versions {
+			if !updates[u] {
+				return nil
+			}
+		}
+	}
+	for dir, r := range refs {
+		for _, f := range unreferencedPayloads(dir, r) {
+			filename := filepath.Join(dir, f)
+			modified, size := latestModification(filename)
+			if modified.IsZero() || now.Sub(modified) < minAge {
+				continue
+			}
+			name := filename
+			if rel, err := filepath.Rel(a.Config.DataDir, filename); err == nil {
+				name = filepath.ToSlash(rel)
+			}
+			res.Items = append(res.Items, GCItem{Kind: GCPayload, Name: name,
+				Detail: fmt.Sprintf("unreferenced, %d bytes, modified %s", size, modified.Format(time.RFC3339))})
+			if dryRun {
+				continue
+			}
+			if err := os.RemoveAll(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unreferencedPayloads returns the paths, relative to given data directory,
+// of the payloads, patches, previous versions and delta bases that belong to
+// none of the given references. The other hidden files, e.g. the working
+// directories of the deployments, are not payloads.
+func unreferencedPayloads(dir string, r *payloadRefs) []string {
+	var paths []string
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		switch name := f.Name(); {
+		case name == previousDir || name == deltaBaseDir:
+			subdirs, _ := ioutil.ReadDir(filepath.Join(dir, name))
+			for _, s := range subdirs {
+				if !r.uuids[s.Name()] {
+					paths = append(paths, filepath.Join(name, s.Name()))
+				}
+			}
+		case strings.HasPrefix(name, "."):
+		case !r.names[name]:
+			paths = append(paths, name)
+		}
+	}
+	return paths
+}
+
+// latestModification returns the latest modification time of given file, or
+// of the files of given directory, and their total size.
+func latestModification(filename string) (time.Time, int64) {
+	var (
+		latest time.Time
+		size   int64
+	)
+	filepath.Walk(filename, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return latest, size
+}
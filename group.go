@@ -0,0 +1,106 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// UpdateGroup makes an update a member of a group of updates, which are
+// downloaded in parallel but deployed in the order of their sequence numbers.
+// It is part of the signed notification.
+type UpdateGroup struct {
+	ID       string `bencode:"id" json:"id"`
+	Sequence int    `bencode:"sequence" json:"sequence"` // from 1 to Size
+	Size     int    `bencode:"size" json:"size"`
+}
+
+// Validate returns an error if the group is invalid.
+func (g *UpdateGroup) Validate() error {
+	if g == nil {
+		return nil
+	}
+	if g.ID == "" {
+		return fmt.Errorf("group ID is empty")
+	}
+	if g.Size < 1 || g.Sequence < 1 || g.Sequence > g.Size {
+		return fmt.Errorf("invalid sequence %d of group %s of size %d", g.Sequence, g.ID, g.Size)
+	}
+	return nil
+}
+
+// GroupStatus is the structured status of a group of updates.
+type GroupStatus struct {
+	ID      string         `json:"id"`
+	Size    int            `json:"size"`
+	Members []UpdateStatus `json:"members"`
+}
+
+// groupMembers returns the updates of given group ID in given namespace by
+// their sequence.
+func (a *Agent) groupMembers(namespace, id string) map[int]*Update {
+	a.RLock()
+	defer a.RUnlock()
+	members := make(map[int]*Update)
+	for _, u := range a.updates {
+		if g := u.Notification.Group; g != nil && g.ID == id && u.Namespace == namespace {
+			members[g.Sequence] = u
+		}
+	}
+	return members
+}
+
+// groupState returns UpdateWaiting if a predecessor of given group member in
+// given namespace has not been deployed, or UpdateBlocked if a predecessor has failed, with
+// the reason. It returns an empty state if the member can be deployed. The
+// lock of the member must not be held by the caller's predecessors, hence
+// the members are locked in the order of their sequence.
+func (a *Agent) groupState(namespace string, g *UpdateGroup) (UpdateState, string) {
+	if g == nil || g.Sequence <= 1 {
+		return "", ""
+	}
+	members := a.groupMembers(namespace, g.ID)
+	for seq := 1; seq < g.Sequence; seq++ {
+		m, ok := members[seq]
+		if !ok {
+			return UpdateWaiting, fmt.Sprintf("waiting for group %s member %d/%d", g.ID, seq, g.Size)
+		}
+		m.RLock()
+		state, uuid := m.State, m.Notification.UUID
+		m.RUnlock()
+		switch state {
+		case UpdateDeployed:
+		case UpdateFailed, UpdateFailedDownload, UpdateFailedDiskSpace, UpdateBlocked:
+			return UpdateBlocked, fmt.Sprintf("group %s member %d/%d uuid:%s is %s",
+				g.ID, seq, g.Size, uuid, state)
+		default:
+			return UpdateWaiting, fmt.Sprintf("waiting for group %s member %d/%d uuid:%s",
+				g.ID, seq, g.Size, uuid)
+		}
+	}
+	return "", ""
+}
+
+// groupStatus returns the status of the group of given ID in given namespace,
+// or false if the agent does not have any member of the group.
+func (a *Agent) groupStatus(namespace, id string) (GroupStatus, bool) {
+	members := a.groupMembers(namespace, id)
+	if len(members) == 0 {
+		return GroupStatus{}, false
+	}
+	gs := GroupStatus{ID: id, Members: make([]UpdateStatus, 0, len(members))}
+	for _, u := range members {
+		s := u.Status()
+		if s.Group != nil && s.Group.Size > gs.Size {
+			gs.Size = s.Group.Size
+		}
+		gs.Members = append(gs.Members, s)
+	}
+	sort.Slice(gs.Members, func(i, j int) bool {
+		return gs.Members[i].Group.Sequence < gs.Members[j].Group.Sequence
+	})
+	return gs, true
+}
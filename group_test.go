@@ -0,0 +1,66 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestGroupState(t *testing.T) {
+	a := &Agent{updates: make(map[string]*Update)}
+	member := func(uuid string, seq int, state UpdateState) *Update {
+		u := &Update{
+			Notification: Notification{
+				UUID:  uuid,
+				Group: &UpdateGroup{ID: "release", Sequence: seq, Size: 3},
+			},
+			State: state,
+		}
+		a.updates[uuid] = u
+		return u
+	}
+	first := member("a", 1, UpdateDeploying)
+	second := member("b", 2, UpdateDownloaded)
+	third := member("c", 3, UpdateDownloaded)
+
+	if state, _ := a.groupState("", first.Notification.Group); state != "" {
+		t.Errorf("first member must not wait, got %s", state)
+	}
+	if state, _ := a.groupState("", second.Notification.Group); state != UpdateWaiting {
+		t.Errorf("expected second member waiting, got %s", state)
+	}
+
+	first.State = UpdateDeployed
+	if state, _ := a.groupState("", second.Notification.Group); state != "" {
+		t.Errorf("second member must not wait, got %s", state)
+	}
+
+	// a failed predecessor blocks its successors
+	second.State = UpdateFailed
+	if state, reason := a.groupState("", third.Notification.Group); state != UpdateBlocked || reason == "" {
+		t.Errorf("expected third member blocked, got %s %q", state, reason)
+	}
+
+	// a missing predecessor is waited for
+	delete(a.updates, "a")
+	if state, _ := a.groupState("", third.Notification.Group); state != UpdateWaiting {
+		t.Errorf("expected third member waiting, got %s", state)
+	}
+
+	gs, ok := a.groupStatus("", "release")
+	if !ok || gs.Size != 3 || len(gs.Members) != 2 || gs.Members[0].UUID != "b" {
+		t.Errorf("unexpected group status %+v", gs)
+	}
+
+	for _, g := range []*UpdateGroup{
+		{ID: "", Sequence: 1, Size: 1},
+		{ID: "x", Sequence: 0, Size: 1},
+		{ID: "x", Sequence: 2, Size: 1},
+	} {
+		if g.Validate() == nil {
+			t.Errorf("group %+v must be invalid", g)
+		}
+	}
+}
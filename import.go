@@ -0,0 +1,200 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+var (
+	errImportMismatch   = errors.New("file does not match any piece of the update")
+	errImportNotRunning = errors.New("update is not running")
+)
+
+// ImportResult reports the import of a local copy of the payload of an
+// update.
+type ImportResult struct {
+	UUID     string `json:"uuid"`
+	Version  uint64 `json:"version"`
+	Pieces   int    `json:"pieces"` // verified pieces imported
+	Total    int    `json:"total"`
+	Bytes    int64  `json:"bytes"`
+	Linked   bool   `json:"linked"`   // hard-linked rather than copied
+	Complete bool   `json:"complete"` // after the check of the torrent client
+}
+
+// importPieces imports the pieces of given local file or directory that
+// match the piece hashes of given info into the payload of the info in given
+// directory. A single-file payload which fully matches is hard-linked if its
+// destination does not exist yet, otherwise the verified pieces are copied,
+// hence the source is never modified, and the missing pieces are downloaded
+// as usual. It returns errImportMismatch if no piece matches, in which case
+// nothing is written. It returns the number of pieces and bytes imported.
+func importPieces(src, dir string, info *metainfo.Info, link bool) (int, int64, bool, error) {
+	st, err := os.Stat(src)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(info.Files) == 0 && st.IsDir() {
+		return 0, 0, false, fmt.Errorf("%s is a directory but the payload is a single file", src)
+	} else if len(info.Files) > 0 && !st.IsDir() {
+		return 0, 0, false, fmt.Errorf("%s is a file but the payload is a directory", src)
+	}
+	dst := filepath.Join(dir, info.Name)
+	if link {
+		_, err = os.Stat(dst)
+		link = len(info.Files) == 0 && st.Size() == info.Length && os.IsNotExist(err)
+	}
+
+	// the source is read with the layout of the payload under its own name
+	srcInfo := *info
+	srcInfo.Name = filepath.Base(src)
+	r := newPieceIO(filepath.Dir(src), &srcInfo, false)
+	defer r.Close()
+	var w *pieceIO
+	if !link {
+		w = newPieceIO(dir, info, true)
+	}
+
+	verified := make([]bool, info.NumPieces())
+	var (
+		pieces int
+		size   int64
+	)
+	buf := make([]byte, info.PieceLength)
+	for i := range verified {
+		b := buf[:info.Piece(i).Length()]
+		if r.at(b, int64(i)*info.PieceLength) != nil {
+			continue
+		}
+		if sum := sha1.Sum(b); !bytes.Equal(sum[:], info.Pieces[i*20:(i+1)*20]) {
+			continue
+		}
+		verified[i] = true
+		pieces++
+		size += int64(len(b))
+		if w != nil {
+			if err = w.at(b, int64(i)*info.PieceLength); err != nil {
+				w.Close()
+				return 0, 0, false, err
+			}
+		}
+	}
+	if pieces == 0 {
+		if w != nil {
+			w.Close()
+		}
+		return 0, 0, false, errImportMismatch
+	}
+	if w != nil {
+		err = w.Close()
+		return pieces, size, false, err
+	}
+
+	if pieces == len(verified) {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return 0, 0, false, err
+		}
+		if os.Link(src, dst) == nil {
+			return pieces, size, true, nil
+		}
+		// e.g. the source is on another file system
+	}
+	w = newPieceIO(dir, info, true)
+	for i, ok := range verified {
+		if !ok {
+			continue
+		}
+		b := buf[:info.Piece(i).Length()]
+		if err = r.at(b, int64(i)*info.PieceLength); err == nil {
+			err = w.at(b, int64(i)*info.PieceLength)
+		}
+		if err != nil {
+			w.Close()
+			return 0, 0, false, err
+		}
+	}
+	return pieces, size, false, w.Close()
+}
+
+// importPayload imports given local file or directory into the payload of
+// the running update of given key, then lets the torrent client check all
+// its pieces, so that the update is seeded and deployed once it is complete
+// without downloading the verified pieces.
+func (a *Agent) importPayload(key, filename string) (*ImportResult, error) {
+	u := a.getUpdate(key)
+	if u == nil {
+		return nil, errUpdateNotFound
+	}
+	u.RLock()
+	t, dir, info := u.torrent, u.dataDir(), u.Notification.Info
+	res := &ImportResult{UUID: u.Notification.UUID, Version: u.Notification.Version,
+		Total: info.NumPieces()}
+	running := !u.deleted && !u.Stopped && t != nil
+	u.RUnlock()
+	if !running {
+		return nil, errImportNotRunning
+	}
+
+	// the lock is not held while reading the file, as for the fallback
+	var err error
+	if res.Pieces, res.Bytes, res.Linked, err = importPieces(filename, dir, &info, true); err != nil {
+		metrics.Inc("update.imports", "result", "failed")
+		u.logf("WARNING: failed importing %s into update uuid:%s version:%d - %v",
+			filename, res.UUID, res.Version, err)
+		return nil, err
+	}
+
+	// the pieces of a lazily verified payload are not trusted anymore
+	u.Lock()
+	if u.lazy {
+		a.completion.trust(t.InfoHash(), false)
+		u.lazy = false
+	}
+	u.Unlock()
+	t.VerifyData()
+	res.Complete = t.BytesMissing() == 0
+	metrics.Inc("update.imports", "result", "ok")
+	metrics.Add("update.imported_bytes", res.Bytes, "namespace", u.ns.label())
+	u.logf("imported %d of %d pieces (%d bytes) of update uuid:%s version:%d from %s, complete:%v",
+		res.Pieces, res.Total, res.Bytes, res.UUID, res.Version, filename, res.Complete)
+	return res, nil
+}
+
+// importPreimaged imports the payload of the update from the import
+// directory of the config, where it is named as the payload, before its
+// torrent is added, which checks the imported pieces. It is skipped if the
+// payload of the update exists already. The caller must hold the lock.
+func (u *Update) importPreimaged() {
+	if len(u.agent.Config.ImportDir) == 0 {
+		return
+	}
+	info := u.Notification.Info
+	src := filepath.Join(u.agent.Config.ImportDir, info.Name)
+	if _, err := os.Stat(src); err != nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(u.dataDir(), info.Name)); !os.IsNotExist(err) {
+		return
+	}
+	pieces, size, linked, err := importPieces(src, u.dataDir(), &info, true)
+	if err != nil {
+		metrics.Inc("update.imports", "result", "failed")
+		u.logf("WARNING: failed importing %s into update uuid:%s version:%d - %v",
+			src, u.Notification.UUID, u.Notification.Version, err)
+		return
+	}
+	metrics.Inc("update.imports", "result", "ok")
+	metrics.Add("update.imported_bytes", size, "namespace", u.ns.label())
+	u.logf("imported %d of %d pieces (%d bytes, linked:%v) of update uuid:%s version:%d from %s",
+		pieces, info.NumPieces(), size, linked, u.Notification.UUID, u.Notification.Version, src)
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportPieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const pieceLength = 16 * 1024
+	data := make([]byte, 4*pieceLength+100)
+	rand.New(rand.NewSource(5)).Read(data)
+	info := fallbackInfo("app.bin", data, pieceLength)
+	src := filepath.Join(dir, "sdcard.img")
+	if err = ioutil.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a full match is linked
+	pieces, size, linked, err := importPieces(src, filepath.Join(dir, "full"), info, true)
+	if err != nil || pieces != 5 || size != int64(len(data)) || !linked {
+		t.Fatalf("imported %d pieces of %d bytes linked:%v - %v", pieces, size, linked, err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "full", "app.bin")); !bytes.Equal(got, data) {
+		t.Error("imported payload differs")
+	}
+
+	// a partial match only copies the verified pieces
+	partial := append([]byte(nil), data[:3*pieceLength]...)
+	partial[pieceLength] = ^partial[pieceLength]
+	if err = ioutil.WriteFile(src, partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+	pieces, size, linked, err = importPieces(src, filepath.Join(dir, "partial"), info, true)
+	if err != nil || pieces != 2 || size != 2*pieceLength || linked {
+		t.Fatalf("imported %d pieces of %d bytes linked:%v - %v", pieces, size, linked, err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "partial", "app.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:pieceLength], data[:pieceLength]) ||
+		!bytes.Equal(got[2*pieceLength:3*pieceLength], data[2*pieceLength:3*pieceLength]) ||
+		bytes.Equal(got[pieceLength:2*pieceLength], partial[pieceLength:2*pieceLength]) {
+		t.Error("unexpected imported pieces")
+	}
+
+	// a mismatch is rejected without writing anything nor changing the
+	// source
+	other := make([]byte, len(data))
+	if err = ioutil.WriteFile(src, other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = importPieces(src, filepath.Join(dir, "mismatch"), info, true); err != errImportMismatch {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "mismatch")); !os.IsNotExist(err) {
+		t.Error("payload of mismatched file is written")
+	}
+	if got, _ = ioutil.ReadFile(src); !bytes.Equal(got, other) {
+		t.Error("source is modified")
+	}
+
+	if _, _, _, err = importPieces(dir, filepath.Join(dir, "dir"), info, true); err == nil {
+		t.Error("directory is imported into a single-file payload")
+	}
+}
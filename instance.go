@@ -0,0 +1,173 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// instanceLockFilename is the lock file of the agent in its metadata
+// directory, which records the instance holding it.
+const instanceLockFilename = "agent.lock"
+
+var instanceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,31}$`)
+
+// validateInstance returns an error if given instance name is not empty and
+// is not 1-32 letters, digits, dots, dashes or underscores, hence it cannot
+// be used in the default paths.
+func validateInstance(name string) error {
+	if name != "" && !instanceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q: 1-32 letters, digits, '.', '-' or '_' expected", name)
+	}
+	return nil
+}
+
+// instanceDataDir returns the default data directory of given instance.
+func instanceDataDir(name string) string {
+	if name == "" {
+		return defaultDataDir
+	}
+	return defaultDataDir + "-" + name
+}
+
+// instanceUnixSocket returns the default API socket of given instance.
+func instanceUnixSocket(name string) string {
+	if name == "" {
+		return defaultUnixSocket
+	}
+	return fmt.Sprintf("/var/run/p2pupdate-%s.sock", name)
+}
+
+// instanceLogFile returns the default log file of given instance.
+func instanceLogFile(name string) string {
+	if name == "" {
+		return defaultLogFile
+	}
+	return fmt.Sprintf("/var/log/p2pupdate-%s.log", name)
+}
+
+// applyInstance replaces the default data directory, API socket and log file
+// by the ones of the instance of the config, so that several instances do not
+// share them. The paths set by the config are kept.
+func (cfg *Config) applyInstance() {
+	if cfg.Instance == "" {
+		return
+	}
+	if cfg.DataDir == defaultDataDir {
+		cfg.DataDir = instanceDataDir(cfg.Instance)
+	}
+	if cfg.API.Address == defaultUnixSocket {
+		cfg.API.Address = instanceUnixSocket(cfg.Instance)
+	}
+	if cfg.LogFile == defaultLogFile {
+		cfg.LogFile = instanceLogFile(cfg.Instance)
+	}
+}
+
+// instancePeerID returns the PeerID of given instance on the machine of given
+// hardware PeerID, which is the hash of both, or the hardware PeerID itself
+// if the instance has no name. It is a locally administered unicast address
+// as aliasPeerID, so it does not collide with real MACs.
+func instancePeerID(pid PeerID, name string) PeerID {
+	if name == "" {
+		return pid
+	}
+	h := sha256.New()
+	h.Write(pid[:])
+	h.Write([]byte(name))
+	var ipid PeerID
+	copy(ipid[:], h.Sum(nil))
+	ipid[0] = (ipid[0] | 0x02) &^ 0x01
+	return ipid
+}
+
+// InstanceLock is the lock of the metadata directory held by a running agent,
+// which records its instance, process and ports for the other instances.
+type InstanceLock struct {
+	Instance string `json:"instance"`
+	PID      int    `json:"pid"`
+	DataDir  string `json:"data-dir"`
+	API      string `json:"api"`
+	Port     int    `json:"bittorrent-port,omitempty"`
+
+	file *os.File
+}
+
+// lockInstance locks the metadata directory of given config, or returns an
+// error naming the live instance holding it.
+func lockInstance(cfg *Config, metadataDir string) (*InstanceLock, error) {
+	filename := filepath.Join(metadataDir, instanceLockFilename)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening lock file %s", filename)
+	}
+	if err = tryLockFile(f); err != nil {
+		var holder InstanceLock
+		b, _ := ioutil.ReadAll(f)
+		f.Close()
+		if json.Unmarshal(b, &holder) == nil && holder.PID > 0 {
+			return nil, fmt.Errorf("data directory %s is used by agent instance %q (pid %d),"+
+				" set a distinct instance or data-dir", cfg.DataDir, holder.Instance, holder.PID)
+		}
+		return nil, errors.Wrapf(err, "data directory %s is used by another agent, failed locking %s",
+			cfg.DataDir, filename)
+	}
+	l := &InstanceLock{
+		Instance: cfg.Instance,
+		PID:      os.Getpid(),
+		DataDir:  cfg.DataDir,
+		API:      cfg.API.Address,
+		Port:     cfg.BitTorrent.Port,
+		file:     f,
+	}
+	if err = f.Truncate(0); err == nil {
+		err = json.NewEncoder(f).Encode(l)
+	}
+	if err != nil {
+		l.Close()
+		return nil, errors.Wrapf(err, "failed writing lock file %s", filename)
+	}
+	return l, nil
+}
+
+// Close releases the lock, which is emptied for the next instance.
+func (l *InstanceLock) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	unlockFile(l.file)
+	return l.file.Close()
+}
+
+// checkInstanceAddrs returns an error if another live agent serves the API
+// socket of given config, which would be replaced, or listens on its torrent
+// port.
+func checkInstanceAddrs(cfg *Config) error {
+	if conn, err := net.Dial("unix", cfg.API.Address); err == nil {
+		conn.Close()
+		return fmt.Errorf("API socket %s is served by another agent, set a distinct instance or api.address",
+			cfg.API.Address)
+	}
+	if port := cfg.BitTorrent.Port; port > 0 {
+		l, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+		if err != nil {
+			return errors.Wrapf(err, "bittorrent port %d is used, e.g. by another agent instance,"+
+				" set a distinct bittorrent.port", port)
+		}
+		l.Close()
+	}
+	return nil
+}
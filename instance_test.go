@@ -0,0 +1,160 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestValidateInstance(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"":                                   true,
+		"fleet-a":                            true,
+		"dev_2.test":                         true,
+		"-a":                                 false,
+		"a/b":                                false,
+		"a b":                                false,
+		"0123456789012345678901234567890123": false,
+	} {
+		if err := validateInstance(name); (err == nil) != valid {
+			t.Errorf("instance %q: unexpected error %v", name, err)
+		}
+	}
+}
+
+func TestApplyInstance(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.applyInstance()
+	if cfg.DataDir != defaultDataDir || cfg.API.Address != defaultUnixSocket {
+		t.Errorf("paths without instance are changed: %s %s", cfg.DataDir, cfg.API.Address)
+	}
+	cfg.Instance = "b"
+	cfg.LogFile = "/tmp/agent.log"
+	cfg.applyInstance()
+	if cfg.DataDir != "/var/lib/p2pupdate-b" || cfg.API.Address != "/var/run/p2pupdate-b.sock" {
+		t.Errorf("unexpected paths of instance: %s %s", cfg.DataDir, cfg.API.Address)
+	}
+	if cfg.LogFile != "/tmp/agent.log" {
+		t.Errorf("configured log file is replaced by %s", cfg.LogFile)
+	}
+}
+
+func TestInstancePeerID(t *testing.T) {
+	pid := PeerID{0xb8, 0x27, 0xeb, 0x01, 0x02, 0x03}
+	if instancePeerID(pid, "") != pid {
+		t.Error("PeerID without instance is changed")
+	}
+	a, b := instancePeerID(pid, "a"), instancePeerID(pid, "b")
+	if a == pid || a == b || a != instancePeerID(pid, "a") {
+		t.Errorf("unexpected PeerIDs %s %s of %s", a, b, pid)
+	}
+	if a[0]&0x03 != 0x02 {
+		t.Errorf("PeerID %s is not a locally administered unicast address", a)
+	}
+}
+
+func TestLockInstance(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locks are not supported")
+	}
+	dir, err := ioutil.TempDir("", "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.Instance, cfg.DataDir = "a", dir
+	l, err := lockInstance(&cfg, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := cfg
+	other.Instance = "b"
+	if _, err = lockInstance(&other, dir); err == nil {
+		t.Fatal("directory locked by a live instance is locked again")
+	}
+	l.Close()
+	if l, err = lockInstance(&other, dir); err != nil {
+		t.Fatalf("released directory is not locked: %v", err)
+	}
+	l.Close()
+}
+
+// TestAgentInstances runs two instances on the loopback with a server in the
+// same process, which register as distinct peers although they share the
+// hardware ID.
+func TestAgentInstances(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, pub := writeKeys(t, dir, "key")
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	conn.Close()
+	scfg := DefaultServerConfig()
+	scfg.Address = addr
+	scfg.Database = filepath.Join(dir, "server.db")
+	scfg.PublicKey.Filename = pub
+	s, err := NewServer(*scfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serveUDP()
+	defer s.Stop()
+
+	var agents []*Agent
+	for _, name := range []string{"a", "b"} {
+		cfg := DefaultConfig()
+		cfg.Instance = name
+		cfg.LogFile = ""
+		cfg.Server = addr
+		cfg.Address = "127.0.0.1:"
+		cfg.DataDir = filepath.Join(dir, name)
+		cfg.API.Address = filepath.Join(dir, name+".sock")
+		cfg.PublicKey.Filename = pub
+		cfg.BitTorrent.NoDHT = true
+		a, err := NewAgent(cfg)
+		if err != nil {
+			t.Fatalf("failed creating instance %s: %v", name, err)
+		}
+		defer a.Stop()
+		agents = append(agents, a)
+	}
+	if agents[0].ID == agents[1].ID {
+		t.Fatalf("instances have the same PeerID %s", agents[0].ID)
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		s.RLock()
+		_, a := s.peers[agents[0].ID]
+		_, b := s.peers[agents[1].ID]
+		collisions := len(s.collisions)
+		s.RUnlock()
+		if a && b {
+			if collisions > 0 {
+				t.Errorf("instances collide on the server")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("instances are not registered: a=%v b=%v", a, b)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// keepVersions returns the number of versions of an update kept by the
+// agent, the current one included, which is at least 1.
+func (cfg *Config) keepVersions() int {
+	if cfg.KeepVersions < 1 {
+		return 1
+	}
+	return cfg.KeepVersions
+}
+
+// keepsVersion returns true if given older version of the update is kept
+// seeding rather than deleted once this version starts. A version with the
+// same torrent as this one is not, since both would share it. The caller
+// must hold the lock.
+func (u *Update) keepsVersion(a *Agent, old *Update) bool {
+	if a.Config.keepVersions() < 2 || a.Config.Proxy {
+		return false
+	}
+	old.RLock()
+	defer old.RUnlock()
+	ih, err := u.Notification.InfoHash()
+	if err != nil {
+		return false
+	}
+	oldIH, err := old.Notification.InfoHash()
+	return err == nil && ih != oldIH && !old.Stopped
+}
+
+// markSuperseded marks the update as superseded by given version, hence it
+// only seeds: its monitor exits and it is never deployed again. Its payload
+// is moved to the directory of its version (see versionDir), apart from the
+// payload of the newer versions which may have the same name. The update
+// must be stopped, and the caller must hold the lock.
+func (u *Update) markSuperseded(version uint64) error {
+	dst := u.previousPath()
+	os.RemoveAll(filepath.Dir(dst))
+	err := os.MkdirAll(filepath.Dir(dst), 0750)
+	if err == nil {
+		err = os.Rename(u.payloadPath(), dst)
+	}
+	if err != nil {
+		return err
+	}
+	u.SupersededBy = version
+	u.Reason = ""
+	if err = u.save(); err != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+	u.logf("keeping update uuid:%s version:%d seeding, superseded by version %d",
+		u.Notification.UUID, u.Notification.Version, version)
+	return nil
+}
+
+// keepVersion adds given superseded version to the versions kept seeding for
+// its update, and deletes the oldest ones beyond the configuration. It returns
+// false if the given version is not kept itself, e.g. once the configuration
+// keeps less versions on start, which the caller must delete.
+func (a *Agent) keepVersion(u *Update) bool {
+	key := u.key()
+	a.Lock()
+	if a.kept == nil {
+		a.kept = make(map[string][]*Update)
+	}
+	kept := append(a.kept[key], u)
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i].Notification.Version > kept[j].Notification.Version
+	})
+	var evicted []*Update
+	if n := a.Config.keepVersions() - 1; len(kept) > n {
+		kept, evicted = kept[:n], kept[n:]
+	}
+	if len(kept) > 0 {
+		a.kept[key] = kept
+	} else {
+		delete(a.kept, key)
+	}
+	a.Unlock()
+	ok := true
+	for _, old := range evicted {
+		if old == u {
+			ok = false
+			continue
+		}
+		a.deleteKept(old)
+	}
+	return ok
+}
+
+// keptVersions returns the versions kept seeding, newest first for each
+// update.
+func (a *Agent) keptVersions() []*Update {
+	a.RLock()
+	defer a.RUnlock()
+	var kept []*Update
+	for _, versions := range a.kept {
+		kept = append(kept, versions...)
+	}
+	return kept
+}
+
+// keptDeployed returns the newest version kept for the update of given key
+// that has been deployed, or nil if there is none. The kept versions are
+// locked after the agent lock is released, since they are locked before it
+// on start (see keepVersion).
+func (a *Agent) keptDeployed(key string) *Update {
+	a.RLock()
+	kept := append([]*Update(nil), a.kept[key]...)
+	a.RUnlock()
+	for _, u := range kept {
+		u.RLock()
+		deployed := u.State == UpdateDeployed
+		u.RUnlock()
+		if deployed {
+			return u
+		}
+	}
+	return nil
+}
+
+// hasKeptDeployed returns true if a deployed version of the update of given
+// key is kept, which it can be rolled back to.
+func (a *Agent) hasKeptDeployed(key string) bool {
+	return a.keptDeployed(key) != nil
+}
+
+// takeKept removes and returns the newest version kept for the update of
+// given key that has been deployed, or nil if there is none.
+func (a *Agent) takeKept(key string) *Update {
+	u := a.keptDeployed(key)
+	if u == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	for i, k := range a.kept[key] {
+		if k == u {
+			a.kept[key] = append(a.kept[key][:i:i], a.kept[key][i+1:]...)
+			if len(a.kept[key]) == 0 {
+				delete(a.kept, key)
+			}
+			return u
+		}
+	}
+	// evicted meanwhile
+	return nil
+}
+
+// dropKept deletes all the versions kept for the update of given key, e.g.
+// once it is uninstalled.
+func (a *Agent) dropKept(key string) {
+	a.Lock()
+	kept := a.kept[key]
+	delete(a.kept, key)
+	a.Unlock()
+	for _, u := range kept {
+		a.deleteKept(u)
+	}
+}
+
+// evictOldestKept deletes the oldest version kept among all updates, e.g.
+// to free disk space, and returns false if no version is kept.
+func (a *Agent) evictOldestKept() bool {
+	a.Lock()
+	var (
+		oldest *Update
+		key    string
+	)
+	for k, versions := range a.kept {
+		last := versions[len(versions)-1]
+		if oldest == nil || last.Notification.CreationDate < oldest.Notification.CreationDate {
+			oldest, key = last, k
+		}
+	}
+	if oldest != nil {
+		if versions := a.kept[key][:len(a.kept[key])-1]; len(versions) > 0 {
+			a.kept[key] = versions
+		} else {
+			delete(a.kept, key)
+		}
+	}
+	a.Unlock()
+	if oldest == nil {
+		return false
+	}
+	a.deleteKept(oldest)
+	return true
+}
+
+// deleteKept stops and deletes given version, which is not kept anymore.
+func (a *Agent) deleteKept(u *Update) {
+	u.logf("dropping kept update uuid:%s version:%d", u.Notification.UUID, u.Notification.Version)
+	u.Stop()
+	if err := u.Delete(); err != nil {
+		u.logf("WARNING: failed to delete update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+}
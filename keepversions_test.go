@@ -0,0 +1,186 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestKeepVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keepversions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Agent{
+		Config:      &Config{KeepVersions: 3},
+		updates:     make(map[string]*Update),
+		dataDir:     filepath.Join(dir, "update"),
+		metadataDir: filepath.Join(dir, "notification"),
+	}
+	for _, d := range []string{a.dataDir, a.metadataDir} {
+		if err = os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	newNamedUpdate := func(version uint64, state UpdateState, created int64, name string) *Update {
+		u := NewUpdate(Notification{UUID: UUIDShell, Version: version, CreationDate: created,
+			Info: metainfo.Info{Name: name, Length: int64(version)}}, a)
+		u.ns, u.State, u.Stopped = a.namespaces[0], state, true
+		content := fmt.Sprintf("%s v%d", name, version)
+		if err := ioutil.WriteFile(filepath.Join(a.dataDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	newUpdate := func(version uint64, state UpdateState, created int64) *Update {
+		return newNamedUpdate(version, state, created, fmt.Sprintf("update-v%d.tar", version))
+	}
+
+	// a version with the same torrent is not kept, unlike one with the same
+	// payload name
+	v1, v2 := newUpdate(1, UpdateDeployed, 100), newUpdate(2, UpdateDeployed, 200)
+	v3 := newUpdate(3, UpdatePending, 300)
+	v1.Stopped, v2.Stopped = false, false
+	same := NewUpdate(Notification{UUID: UUIDShell, Version: 3, Info: v2.Notification.Info}, a)
+	if same.keepsVersion(a, v2) {
+		t.Error("version with the same torrent is kept")
+	}
+	sameName := NewUpdate(Notification{UUID: UUIDShell, Version: 3,
+		Info: metainfo.Info{Name: v2.Notification.Info.Name, Length: 3}}, a)
+	if !sameName.keepsVersion(a, v2) {
+		t.Error("version with the same payload name is not kept")
+	}
+	if !v3.keepsVersion(a, v2) {
+		t.Error("older version is not kept")
+	}
+	a.Config.KeepVersions = 1
+	if v3.keepsVersion(a, v2) {
+		t.Error("older version is kept by default")
+	}
+	a.Config.KeepVersions = 3
+
+	// the oldest versions fall off the kept ones
+	for _, u := range []*Update{v1, v2} {
+		u.Stopped = true
+		if err = u.markSuperseded(u.Notification.Version + 1); err != nil {
+			t.Fatal(err)
+		}
+		if !a.keepVersion(u) {
+			t.Fatalf("version %d is not kept", u.Notification.Version)
+		}
+	}
+	if kept := a.kept[v1.key()]; len(kept) != 2 || kept[0] != v2 || kept[1] != v1 {
+		t.Fatalf("kept versions are not sorted newest first: %v", kept)
+	}
+	v0 := newUpdate(0, UpdateDeployed, 50)
+	v0.SupersededBy = 1
+	if a.keepVersion(v0) {
+		t.Error("version reloaded beyond the kept ones is kept")
+	}
+	if kept := a.kept[v1.key()]; len(kept) != 2 || kept[0] != v2 || kept[1] != v1 {
+		t.Fatalf("kept versions are changed by an older one: %v", kept)
+	}
+	v3.Stopped = true
+	if err = v3.markSuperseded(4); err != nil {
+		t.Fatal(err)
+	}
+	if !a.keepVersion(v3) {
+		t.Fatal("version 3 is not kept")
+	}
+	if kept := a.kept[v1.key()]; len(kept) != 2 || kept[0] != v3 || kept[1] != v2 {
+		t.Fatalf("oldest version is not dropped: %v", kept)
+	}
+	if _, err = os.Stat(v1.payloadPath()); !os.IsNotExist(err) {
+		t.Errorf("payload of the dropped version is not removed: %v", err)
+	}
+	if _, err = a.loadUpdate(v1.metadataBucket(), v1.metadataKey()); err == nil {
+		t.Error("metadata of the dropped version are not deleted")
+	}
+	if _, err = os.Stat(v2.payloadPath()); err != nil {
+		t.Errorf("payload of a kept version is removed: %v", err)
+	}
+
+	// the newest deployed version is rolled back to
+	if !a.hasKeptDeployed(v2.key()) {
+		t.Fatal("deployed kept version is not found")
+	}
+	if prev := a.takeKept(v2.key()); prev != v2 {
+		t.Fatalf("expected version 2 to be rolled back to, got %v", prev)
+	}
+	if a.hasKeptDeployed(v2.key()) || a.takeKept(v2.key()) != nil {
+		t.Error("pending kept version is rolled back to")
+	}
+
+	// the oldest version among all updates is evicted first
+	other := NewUpdate(Notification{UUID: "other", Version: 1, CreationDate: 250,
+		Info: metainfo.Info{Name: "other.tar"}}, a)
+	other.ns, other.Stopped = a.namespaces[0], true
+	a.keepVersion(other)
+	if !a.evictOldestKept() || len(a.kept[other.key()]) != 0 || len(a.kept[v3.key()]) != 1 {
+		t.Errorf("oldest kept version is not evicted: %v", a.kept)
+	}
+	if !a.evictOldestKept() || a.evictOldestKept() || len(a.kept) != 0 {
+		t.Errorf("kept versions are not all evicted: %v", a.kept)
+	}
+
+	// the versions whose payloads have the same name are kept in the
+	// directories of their versions
+	var versions []*Update
+	for v := uint64(5); v <= 7; v++ {
+		// the payload of the older version is moved before the new one
+		// is written
+		if len(versions) > 0 {
+			old := versions[len(versions)-1]
+			next := NewUpdate(Notification{UUID: UUIDShell, Version: v,
+				Info: metainfo.Info{Name: "update.tar", Length: int64(v)}}, a)
+			old.Stopped = false
+			if !next.keepsVersion(a, old) {
+				t.Fatalf("version %d with the same payload name is not kept", old.Notification.Version)
+			}
+			old.Stopped = true
+			if err = old.markSuperseded(v); err != nil {
+				t.Fatal(err)
+			}
+			if !a.keepVersion(old) {
+				t.Fatalf("version %d is not kept", old.Notification.Version)
+			}
+		}
+		versions = append(versions, newNamedUpdate(v, UpdateDeployed, int64(v*100), "update.tar"))
+	}
+	if kept := a.kept[versions[0].key()]; len(kept) != 2 || kept[0] != versions[1] || kept[1] != versions[0] {
+		t.Fatalf("versions with the same payload name are not all kept: %v", kept)
+	}
+	for _, u := range versions {
+		expected := fmt.Sprintf("update.tar v%d", u.Notification.Version)
+		if b, err := ioutil.ReadFile(u.payloadPath()); err != nil || string(b) != expected {
+			t.Errorf("payload of version %d is %q: %v", u.Notification.Version, b, err)
+		}
+	}
+	if versions[0].payloadPath() != filepath.Join(a.dataDir, previousDir, UUIDShell, "v5", "update.tar") {
+		t.Errorf("payload of a kept version is at %s", versions[0].payloadPath())
+	}
+
+	// a dropped version removes the directory of its version only
+	a.dropKept(versions[0].key())
+	if _, err = os.Stat(versions[0].versionDir()); !os.IsNotExist(err) {
+		t.Errorf("directory of a dropped version is not removed: %v", err)
+	}
+	if _, err = os.Stat(versions[2].payloadPath()); err != nil {
+		t.Errorf("payload of the current version is removed: %v", err)
+	}
+}
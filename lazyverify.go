@@ -0,0 +1,282 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// markerSampleSize is the size of the head and of the tail of each payload
+// file that are hashed by a clean marker.
+const markerSampleSize = 64 * 1024
+
+// CleanMarker records that the payload of an update was complete and verified
+// when the agent was stopped gracefully. On reload, the torrent client skips
+// the verification of the pieces if the payload still matches the marker.
+type CleanMarker struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod-time"`
+	Sample  string    `json:"sample"` // SHA-256 of the sampled bytes
+}
+
+// StartupStatus reports the reload of the updates on start, and the
+// verification of their payloads.
+type StartupStatus struct {
+	Total    int  `json:"total"`  // metadata files to reload
+	Loaded   int  `json:"loaded"` // of the total, including the failed ones
+	Failed   int  `json:"failed"`
+	Reloaded bool `json:"reloaded"`
+
+	Duration     float64 `json:"duration"` // in seconds, until all pieces are checked
+	Lazy         int     `json:"lazy"`     // updates whose verification is skipped
+	Full         int     `json:"full"`     // updates that are fully checked
+	SkippedBytes int64   `json:"skipped-bytes"`
+	Done         bool    `json:"done"`
+}
+
+// payloadMarker returns the clean marker of the payload at given path, i.e.
+// its total size, the latest modification time of its files, and the digest
+// of the head and the tail of each file.
+func payloadMarker(root string) (*CleanMarker, error) {
+	files, _, err := payloadFiles(root, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &CleanMarker{}
+	h := sha256.New()
+	buf := make([]byte, markerSampleSize)
+	for _, name := range files {
+		filename := filepath.Join(root, filepath.FromSlash(name))
+		st, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		m.Size += st.Size()
+		if st.ModTime().After(m.ModTime) {
+			m.ModTime = st.ModTime()
+		}
+		if err = sampleFile(h, filename, st.Size(), buf); err != nil {
+			return nil, err
+		}
+	}
+	m.ModTime = m.ModTime.UTC()
+	m.Sample = hex.EncodeToString(h.Sum(nil))
+	return m, nil
+}
+
+func sampleFile(w io.Writer, filename string, size int64, buf []byte) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Fprintf(w, "%d\n", size)
+	offsets := []int64{0}
+	if tail := size - int64(len(buf)); tail > 0 {
+		offsets = append(offsets, tail)
+	}
+	for _, off := range offsets {
+		n, err := f.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		w.Write(buf[:n])
+	}
+	return nil
+}
+
+// matches returns true if given marker of the payload on disk is the same as
+// this one.
+func (m *CleanMarker) matches(current *CleanMarker) bool {
+	return current != nil && m.Size == current.Size &&
+		m.ModTime.Equal(current.ModTime) && m.Sample == current.Sample
+}
+
+// lazyCompletion is the piece completion of the torrent client, which is not
+// persisted: the pieces of a trusted torrent are complete unless they have
+// been checked since, while the pieces of the others are unknown and
+// checked when the torrent is added.
+type lazyCompletion struct {
+	storage.PieceCompletion
+
+	mu      sync.Mutex
+	trusted map[metainfo.Hash]bool
+}
+
+func newLazyCompletion() *lazyCompletion {
+	return &lazyCompletion{
+		PieceCompletion: storage.NewMapPieceCompletion(),
+		trusted:         make(map[metainfo.Hash]bool),
+	}
+}
+
+func (c *lazyCompletion) Get(pk metainfo.PieceKey) (storage.Completion, error) {
+	comp, err := c.PieceCompletion.Get(pk)
+	if err != nil || comp.Ok {
+		return comp, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.trusted[pk.InfoHash] {
+		return storage.Completion{Complete: true, Ok: true}, nil
+	}
+	return comp, nil
+}
+
+// trust sets whether the pieces of given torrent are complete without being
+// checked.
+func (c *lazyCompletion) trust(ih metainfo.Hash, trusted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if trusted {
+		c.trusted[ih] = true
+	} else {
+		delete(c.trusted, ih)
+	}
+}
+
+// useCleanMarker consumes the clean marker of the update: the verification
+// of its pieces is skipped if its payload matches the marker. The marker is
+// removed from the metadata before the torrent is started, hence the payload
+// is fully checked on the next start unless the agent is stopped gracefully
+// again. The caller must hold the lock.
+func (u *Update) useCleanMarker(ih metainfo.Hash) {
+	marker := u.VerifiedClean
+	if marker == nil {
+		return
+	}
+	u.VerifiedClean = nil
+	if err := u.save(); err != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+		return
+	}
+	current, err := payloadMarker(u.payloadPath())
+	if err != nil || !marker.matches(current) {
+		u.logf("payload of update uuid:%s version:%d has changed since the shutdown,"+
+			" it is fully checked", u.Notification.UUID, u.Notification.Version)
+		return
+	}
+	u.agent.completion.trust(ih, true)
+	u.lazy = true
+	u.logf("payload of update uuid:%s version:%d is clean since the shutdown,"+
+		" skipped verification of %d bytes", u.Notification.UUID, u.Notification.Version, marker.Size)
+}
+
+// verifyLazy fully checks the pieces of the update whose verification was
+// skipped on start, since a deployment must never execute unchecked files.
+// It returns false if a piece is corrupted, which is then downloaded again.
+// The caller must hold the lock.
+func (u *Update) verifyLazy() bool {
+	if !u.lazy {
+		return true
+	}
+	start := time.Now()
+	u.agent.completion.trust(u.torrent.InfoHash(), false)
+	u.lazy = false
+	u.torrent.VerifyData()
+	if missing := u.torrent.BytesMissing(); missing > 0 {
+		u.logf("ERROR: payload of update uuid:%s version:%d is corrupted, %d bytes are downloaded again",
+			u.Notification.UUID, u.Notification.Version, missing)
+		u.Missing = missing
+		u.setState(UpdateDownloading)
+		return false
+	}
+	u.logf("fully verified payload of update uuid:%s version:%d in %s before deployment",
+		u.Notification.UUID, u.Notification.Version, time.Since(start))
+	return true
+}
+
+// markClean sets the clean marker of the complete updates, which is called
+// when the agent is stopped gracefully before the updates are flushed.
+func (a *Agent) markClean() {
+	a.RLock()
+	updates := make([]*Update, 0, len(a.updates))
+	for _, u := range a.updates {
+		updates = append(updates, u)
+	}
+	a.RUnlock()
+	for _, u := range updates {
+		u.Lock()
+		if u.checked() {
+			m, err := payloadMarker(u.payloadPath())
+			if err != nil {
+				u.logf("WARNING: failed marking payload of update uuid:%s version:%d clean - %v",
+					u.Notification.UUID, u.Notification.Version, err)
+			} else {
+				u.VerifiedClean = m
+				u.dirty = true
+			}
+		}
+		u.Unlock()
+	}
+}
+
+// checked returns true if the payload of the update is complete and none of
+// its pieces is being checked. The caller must hold the lock.
+func (u *Update) checked() bool {
+	switch u.State {
+	case UpdatePending, UpdateDownloading, UpdateFailed, UpdateFailedDownload, UpdateFailedDiskSpace:
+		return false
+	}
+	if u.torrent == nil {
+		return u.Missing == 0
+	}
+	if u.torrent.BytesMissing() > 0 {
+		return false
+	}
+	for _, r := range u.torrent.PieceStateRuns() {
+		if r.Checking {
+			return false
+		}
+	}
+	return true
+}
+
+// watchStartup measures the time until the pieces of the updates loaded on
+// start are checked, which is logged and reported by the agent status.
+func (a *Agent) watchStartup(start time.Time) {
+	for !a.stopped() {
+		a.RLock()
+		updates := make([]*Update, 0, len(a.updates))
+		for _, u := range a.updates {
+			updates = append(updates, u)
+		}
+		a.RUnlock()
+		done := true
+		for _, u := range updates {
+			u.RLock()
+			if u.torrent != nil {
+				for _, r := range u.torrent.PieceStateRuns() {
+					done = done && !r.Checking
+				}
+			}
+			u.RUnlock()
+		}
+		if done {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	a.Lock()
+	a.startup.Duration = time.Since(start).Seconds()
+	a.startup.Done = true
+	s := a.startup
+	a.Unlock()
+	log.Printf("startup verification completed in %.1fs: %d updates (%d bytes) skipped by clean markers,"+
+		" %d fully checked", s.Duration, s.Lazy, s.SkippedBytes, s.Full)
+	metrics.Set("agent.startup_verification_ms", int64(s.Duration*1000))
+}
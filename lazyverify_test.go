@@ -0,0 +1,97 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestPayloadMarker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	payload := filepath.Join(dir, "payload")
+	if err = os.MkdirAll(payload, 0750); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 3*markerSampleSize)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	files := map[string][]byte{
+		"main.sh": []byte("#!/bin/sh\necho ok\n"),
+		"data":    big,
+	}
+	for name, b := range files {
+		if err = ioutil.WriteFile(filepath.Join(payload, name), b, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := payloadMarker(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Size != int64(len(big)+len(files["main.sh"])) {
+		t.Errorf("wrong size %d", m.Size)
+	}
+	if current, err := payloadMarker(payload); err != nil || !m.matches(current) {
+		t.Errorf("unchanged payload does not match its marker: %v", err)
+	}
+
+	// a modified tail with the same size and modification time is detected
+	// by the sample
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for name := range files {
+		if err = os.Chtimes(filepath.Join(payload, name), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err = payloadMarker(payload); err != nil {
+		t.Fatal(err)
+	}
+	big[len(big)-1]++
+	if err = ioutil.WriteFile(filepath.Join(payload, "data"), big, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(filepath.Join(payload, "data"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := payloadMarker(payload); err != nil || m.matches(current) {
+		t.Errorf("modified payload matches its marker: %v", err)
+	}
+	if m.matches(nil) {
+		t.Error("missing payload matches the marker")
+	}
+}
+
+func TestLazyCompletion(t *testing.T) {
+	c := newLazyCompletion()
+	ih := metainfo.Hash{1}
+	pk := metainfo.PieceKey{InfoHash: ih, Index: 0}
+	if comp, _ := c.Get(pk); comp.Ok {
+		t.Error("completion of an untrusted piece must be unknown")
+	}
+	c.trust(ih, true)
+	if comp, _ := c.Get(pk); !comp.Ok || !comp.Complete {
+		t.Errorf("trusted piece is not complete: %+v", comp)
+	}
+	// a checked piece is not trusted anymore
+	c.Set(pk, false)
+	if comp, _ := c.Get(pk); !comp.Ok || comp.Complete {
+		t.Errorf("checked piece is complete: %+v", comp)
+	}
+	c.trust(ih, false)
+	if comp, _ := c.Get(metainfo.PieceKey{InfoHash: ih, Index: 1}); comp.Ok {
+		t.Error("completion of an untrusted piece must be unknown")
+	}
+}
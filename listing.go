@@ -0,0 +1,185 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// stateSeeding matches the updates that are being seeded, whatever their
+// lifecycle state.
+const stateSeeding = "seeding"
+
+// Sort keys of the update listing
+const (
+	sortUUID        = "uuid"
+	sortDeployed    = "deployed"
+	sortDeployFails = "deploy-fails"
+	sortVersion     = "version"
+)
+
+// UpdateFilter selects, sorts and paginates the updates of the listing.
+//
+// The pages are ordered by UUID, which never changes, so that the output
+// does not shift between pages while the monitors mutate the updates. The
+// other sort keys are mutable, hence they only select the first Limit
+// updates and cannot be paginated.
+type UpdateFilter struct {
+	UUIDs          []string
+	States         []string // lifecycle states or "seeding"
+	DeployedBefore time.Time
+	DeployedAfter  time.Time
+	MinDeployFails int
+	Sort           string
+	Descending     bool
+	Limit          int
+	After          string // UUID of the last update of the previous page
+}
+
+// UpdateList is a page of the update listing.
+type UpdateList struct {
+	Updates []UpdateStatus `json:"updates"`
+	Next    string         `json:"next,omitempty"` // cursor of the next page
+}
+
+// ParseUpdateFilter parses the filter from given query arguments.
+func ParseUpdateFilter(args *fasthttp.Args) (*UpdateFilter, error) {
+	f := &UpdateFilter{Sort: sortUUID}
+	if v := args.Peek("uuid"); len(v) > 0 {
+		f.UUIDs = strings.Split(string(v), ",")
+	}
+	if v := args.Peek("state"); len(v) > 0 {
+		f.States = strings.Split(string(v), ",")
+	}
+	var err error
+	for name, t := range map[string]*time.Time{
+		"deployed-before": &f.DeployedBefore,
+		"deployed-after":  &f.DeployedAfter,
+	} {
+		if v := args.Peek(name); len(v) > 0 {
+			if *t, err = time.Parse(time.RFC3339, string(v)); err != nil {
+				return nil, fmt.Errorf("invalid %s: %v", name, err)
+			}
+		}
+	}
+	for name, n := range map[string]*int{
+		"min-deploy-fails": &f.MinDeployFails,
+		"limit":            &f.Limit,
+	} {
+		if v := args.Peek(name); len(v) > 0 {
+			if *n, err = strconv.Atoi(string(v)); err != nil || *n < 0 {
+				return nil, fmt.Errorf("invalid %s: %s", name, v)
+			}
+		}
+	}
+	if v := args.Peek("sort"); len(v) > 0 {
+		f.Sort = string(v)
+		if f.Descending = strings.HasPrefix(f.Sort, "-"); f.Descending {
+			f.Sort = f.Sort[1:]
+		}
+	}
+	switch f.Sort {
+	case sortUUID, sortDeployed, sortDeployFails, sortVersion:
+	default:
+		return nil, fmt.Errorf("invalid sort key: %s", f.Sort)
+	}
+	f.After = string(args.Peek("after"))
+	if len(f.After) > 0 && (f.Sort != sortUUID || f.Descending) {
+		return nil, fmt.Errorf("only the listing sorted by uuid can be paginated")
+	}
+	return f, nil
+}
+
+// match returns true if given update status passes the filter.
+func (f *UpdateFilter) match(s *UpdateStatus) bool {
+	if len(f.UUIDs) > 0 && !containsString(f.UUIDs, s.UUID) {
+		return false
+	}
+	if len(f.States) > 0 && !containsString(f.States, string(s.State)) &&
+		!(s.Seeding && containsString(f.States, stateSeeding)) {
+		return false
+	}
+	if !f.DeployedBefore.IsZero() && (s.Deployed.IsZero() || !s.Deployed.Before(f.DeployedBefore)) {
+		return false
+	}
+	if !f.DeployedAfter.IsZero() && !s.Deployed.After(f.DeployedAfter) {
+		return false
+	}
+	return s.DeployFails >= f.MinDeployFails
+}
+
+// less returns true if update status a is ordered before b.
+func (f *UpdateFilter) less(a, b *UpdateStatus) bool {
+	var less, equal bool
+	switch f.Sort {
+	case sortDeployed:
+		less, equal = a.Deployed.Before(b.Deployed), a.Deployed.Equal(b.Deployed)
+	case sortDeployFails:
+		less, equal = a.DeployFails < b.DeployFails, a.DeployFails == b.DeployFails
+	case sortVersion:
+		less, equal = a.Version < b.Version, a.Version == b.Version
+	default:
+		less, equal = a.UUID < b.UUID, a.UUID == b.UUID
+	}
+	if equal {
+		// the UUID breaks the ties, hence the order is stable
+		less = a.UUID < b.UUID
+	}
+	if f.Descending {
+		return !less && a.UUID != b.UUID
+	}
+	return less
+}
+
+// Apply returns the page of given update statuses selected by the filter.
+func (f *UpdateFilter) Apply(statuses []UpdateStatus) UpdateList {
+	l := UpdateList{Updates: make([]UpdateStatus, 0, len(statuses))}
+	for i := range statuses {
+		if f.match(&statuses[i]) && (len(f.After) == 0 || statuses[i].UUID > f.After) {
+			l.Updates = append(l.Updates, statuses[i])
+		}
+	}
+	sort.Slice(l.Updates, func(i, j int) bool { return f.less(&l.Updates[i], &l.Updates[j]) })
+	if f.Limit > 0 && len(l.Updates) > f.Limit {
+		l.Updates = l.Updates[:f.Limit]
+		if f.Sort == sortUUID && !f.Descending {
+			l.Next = l.Updates[f.Limit-1].UUID
+		}
+	}
+	return l
+}
+
+// updateStatuses returns the statuses of all updates. The updates are
+// collected under the read lock of the agent, then their statuses are taken
+// without holding it since a monitor may hold the lock of its update while
+// locking the agent.
+func (a *Agent) updateStatuses() []UpdateStatus {
+	a.RLock()
+	updates := make([]*Update, 0, len(a.updates))
+	for _, u := range a.updates {
+		updates = append(updates, u)
+	}
+	a.RUnlock()
+	statuses := make([]UpdateStatus, 0, len(updates))
+	for _, u := range updates {
+		statuses = append(statuses, u.Status())
+	}
+	return statuses
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
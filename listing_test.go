@@ -0,0 +1,71 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestUpdateFilter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	statuses := []UpdateStatus{
+		{UUID: "c", State: UpdateFailed, DeployFails: 4},
+		{UUID: "a", State: UpdateDeployed, Deployed: now.Add(-time.Hour), Seeding: true},
+		{UUID: "d", State: UpdateDownloading},
+		{UUID: "b", State: UpdateDeployed, Deployed: now, DeployFails: 1},
+	}
+	list := func(query string) UpdateList {
+		var args fasthttp.Args
+		args.Parse(query)
+		f, err := ParseUpdateFilter(&args)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		return f.Apply(statuses)
+	}
+	uuids := func(l UpdateList) string {
+		s := ""
+		for _, u := range l.Updates {
+			s += u.UUID
+		}
+		return s
+	}
+
+	for query, expected := range map[string]string{
+		"":                             "abcd",
+		"state=failed":                 "c",
+		"state=seeding,failed":         "ac",
+		"uuid=b,d":                     "bd",
+		"min-deploy-fails=1":           "bc",
+		"sort=-deploy-fails":           "cbda",
+		"sort=deployed&state=deployed": "ab",
+		"deployed-before=" + now.Format(time.RFC3339):                  "a",
+		"deployed-after=" + now.Add(-time.Minute).Format(time.RFC3339): "b",
+	} {
+		if l := list(query); uuids(l) != expected {
+			t.Errorf("%s: got %s, expected %s", query, uuids(l), expected)
+		}
+	}
+
+	// the pages are stable
+	l := list("limit=3")
+	if uuids(l) != "abc" || l.Next != "c" {
+		t.Errorf("wrong first page %s next:%s", uuids(l), l.Next)
+	}
+	if l = list("limit=3&after=" + l.Next); uuids(l) != "d" || l.Next != "" {
+		t.Errorf("wrong last page %s next:%s", uuids(l), l.Next)
+	}
+
+	for _, query := range []string{"sort=state", "limit=-1", "sort=deployed&after=a", "deployed-after=yesterday"} {
+		var args fasthttp.Args
+		args.Parse(query)
+		if _, err := ParseUpdateFilter(&args); err == nil {
+			t.Errorf("%s: invalid filter is accepted", query)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	defaultLogTag        = "p2pupdate"
+	defaultLogMaxSize    = 10 // in megabytes
+	defaultLogMaxBackups = 1
+
+	// defaultStatusHeartbeat is the interval of the status lines of the
+	// updates whose status does not change.
+	defaultStatusHeartbeat = 600 // in seconds
+)
+
+// LogConfig holds configurations of the logger, which is shared by all
+// components of the process.
+type LogConfig struct {
+	// Output is one of:
+	// - "stderr" (default)
+	// - "file:<path>", with size-based rotation
+	// - "syslog", the local syslog daemon
+	// - "syslog:<network>://<host:port>", a remote syslog server, e.g.
+	//   syslog:udp://10.0.0.1:514
+	Output string `json:"output"`
+
+	// Facility and Tag of syslog messages
+	Facility string `json:"facility,omitempty"`
+	Tag      string `json:"tag,omitempty"`
+
+	// Rotation of the log file
+	MaxSize    int `json:"max-size,omitempty"` // in megabytes
+	MaxBackups int `json:"max-backups,omitempty"`
+
+	// Debug logs the status of every update on each monitor tick, otherwise
+	// it is only logged when it changes and every StatusHeartbeat, and the
+	// successful deliveries of the webhooks.
+	Debug           bool `json:"debug,omitempty"`
+	StatusHeartbeat int  `json:"status-heartbeat,omitempty"` // in seconds
+}
+
+var (
+	logMutex  sync.Mutex
+	logCloser io.Closer
+)
+
+// SetupLogger routes the output of the standard logger to the output of given
+// configurations. It can be invoked again, e.g. on SIGHUP, to switch or reopen
+// the output.
+func SetupLogger(cfg LogConfig) error {
+	w, flags, err := newLogWriter(cfg)
+	if err != nil {
+		return err
+	}
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	log.SetOutput(w)
+	log.SetFlags(flags)
+	if logCloser != nil {
+		logCloser.Close()
+	}
+	logCloser = nil
+	if c, ok := w.(io.Closer); ok && w != io.Writer(os.Stderr) {
+		logCloser = c
+	}
+	return nil
+}
+
+func newLogWriter(cfg LogConfig) (io.Writer, int, error) {
+	output := strings.TrimSpace(cfg.Output)
+	switch {
+	case output == "" || output == "stderr":
+		return os.Stderr, log.LstdFlags, nil
+
+	case strings.HasPrefix(output, "file:"):
+		filename := output[len("file:"):]
+		if filename == "" {
+			return nil, 0, fmt.Errorf("log output %s does not have a path", output)
+		}
+		maxSize, maxBackups := cfg.MaxSize, cfg.MaxBackups
+		if maxSize <= 0 {
+			maxSize = defaultLogMaxSize
+		}
+		if maxBackups <= 0 {
+			maxBackups = defaultLogMaxBackups
+		}
+		return &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+			MaxAge:     28,
+			Compress:   true,
+		}, log.LstdFlags, nil
+
+	case output == "syslog" || strings.HasPrefix(output, "syslog:"):
+		return newSyslogWriter(cfg, output)
+	}
+	return nil, 0, fmt.Errorf("unknown log output: %s", output)
+}
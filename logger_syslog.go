@@ -0,0 +1,62 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/url"
+	"strings"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":   syslog.LOG_KERN,
+	"user":   syslog.LOG_USER,
+	"daemon": syslog.LOG_DAEMON,
+	"syslog": syslog.LOG_SYSLOG,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// newSyslogWriter returns a writer to the local or remote syslog of given
+// output.
+func newSyslogWriter(cfg LogConfig, output string) (io.Writer, int, error) {
+	facility := syslog.LOG_DAEMON
+	if cfg.Facility != "" {
+		f, ok := syslogFacilities[strings.ToLower(cfg.Facility)]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown syslog facility: %s", cfg.Facility)
+		}
+		facility = f
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = defaultLogTag
+	}
+	var network, raddr string
+	if output != "syslog" {
+		u, err := url.Parse(output[len("syslog:"):])
+		if err != nil || u.Host == "" {
+			return nil, 0, fmt.Errorf("invalid remote syslog address: %s", output)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed connecting to syslog: %v", err)
+	}
+	// syslog records the timestamp
+	return w, 0, nil
+}
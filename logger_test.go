@@ -0,0 +1,75 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupLoggerFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetupLogger(LogConfig{})
+
+	filename := filepath.Join(dir, "agent.log")
+	if err = SetupLogger(LogConfig{Output: "file:" + filename, MaxSize: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// write ~1.5MB, which must rotate the 1MB log file once
+	line := strings.Repeat("x", 1023)
+	for i := 0; i < 1536; i++ {
+		log.Println(line)
+	}
+
+	var files []os.FileInfo
+	for i := 0; i < 50; i++ {
+		if files, err = ioutil.ReadDir(dir); err != nil {
+			t.Fatal(err)
+		}
+		if len(files) >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected the log file and a backup, got %d files", len(files))
+	}
+	for _, fi := range files {
+		if fi.Size() > 1024*1024 {
+			t.Errorf("file %s is larger than max size: %d", fi.Name(), fi.Size())
+		}
+	}
+
+	// switching output must release the log file
+	if err = SetupLogger(LogConfig{Output: "stderr"}); err != nil {
+		t.Fatal(err)
+	}
+	if logCloser != nil {
+		t.Error("stderr must not be closed by the logger")
+	}
+}
+
+func TestSetupLoggerInvalidOutput(t *testing.T) {
+	for _, cfg := range []LogConfig{
+		{Output: "file:"},
+		{Output: "journal"},
+		{Output: "syslog:udp"},
+		{Output: "syslog", Facility: "local9"},
+	} {
+		if err := SetupLogger(cfg); err == nil {
+			t.Errorf("expected error on output %q facility %q", cfg.Output, cfg.Facility)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// newSyslogWriter returns an error since Windows has no syslog, where a file
+// output is used instead.
+func newSyslogWriter(cfg LogConfig, output string) (io.Writer, int, error) {
+	return nil, 0, fmt.Errorf("log output %s is not supported on windows, use file:<path>", output)
+}
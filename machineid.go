@@ -0,0 +1,64 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+)
+
+// errNoMachineID means the platform has no machine ID, or it is unreadable.
+var errNoMachineID = errors.New("machine ID is not available")
+
+// hashPeerID returns the PeerID of the first bytes of the SHA-256 digest of
+// given identifier, e.g. a machine ID or a hostname.
+func hashPeerID(id string) *PeerID {
+	var pid PeerID
+	sum := sha256.Sum256([]byte(id))
+	copy(pid[:], sum[:])
+	return &pid
+}
+
+// parseIOPlatformUUID returns the IOPlatformUUID of the output of macOS
+// `ioreg -rd1 -c IOPlatformExpertDevice`, e.g.
+//
+//	"IOPlatformUUID" = "564D8E1A-7D3F-4C6B-9E4A-1F2B3C4D5E6F"
+func parseIOPlatformUUID(r io.Reader) (string, error) {
+	return parseMachineID(r, `"IOPlatformUUID"`, "=")
+}
+
+// parseMachineGuid returns the MachineGuid of the output of Windows
+// `reg query HKLM\SOFTWARE\Microsoft\Cryptography /v MachineGuid`, e.g.
+//
+//	MachineGuid    REG_SZ    5b1e4f8a-0c3d-4e2f-9a1b-2c3d4e5f6a7b
+func parseMachineGuid(r io.Reader) (string, error) {
+	return parseMachineID(r, "MachineGuid", "REG_SZ")
+}
+
+// parseMachineID returns the value after given separator of the first line
+// starting with given key.
+func parseMachineID(r io.Reader, key, sep string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, key) {
+			continue
+		}
+		i := strings.Index(line, sep)
+		if i < 0 {
+			continue
+		}
+		if id := strings.Trim(strings.TrimSpace(line[i+len(sep):]), `"`); len(id) > 0 {
+			return id, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errNoMachineID
+}
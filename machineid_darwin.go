@@ -0,0 +1,22 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// machineID returns the hardware UUID of the Mac.
+func machineID() (string, error) {
+	out, err := exec.Command("ioreg", "-rd1", "-c", "IOPlatformExpertDevice").Output()
+	if err != nil {
+		return "", err
+	}
+	return parseIOPlatformUUID(bytes.NewReader(out))
+}
@@ -0,0 +1,25 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// machineID returns the systemd or D-Bus machine ID.
+func machineID() (string, error) {
+	for _, filename := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if b, err := ioutil.ReadFile(filename); err == nil {
+			if id := strings.TrimSpace(string(b)); len(id) > 0 {
+				return id, nil
+			}
+		}
+	}
+	return "", errNoMachineID
+}
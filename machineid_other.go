@@ -0,0 +1,13 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package main
+
+// machineID is not supported on this platform, hence the hostname is used.
+func machineID() (string, error) {
+	return "", errNoMachineID
+}
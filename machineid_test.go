@@ -0,0 +1,44 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseMachineID(t *testing.T) {
+	ioreg := `+-o J293AP  <class IOPlatformExpertDevice, id 0x100000110, registered>
+    {
+      "IOPlatformSerialNumber" = "C02ABCDEFGH"
+      "IOPlatformUUID" = "564D8E1A-7D3F-4C6B-9E4A-1F2B3C4D5E6F"
+    }
+`
+	if id, err := parseIOPlatformUUID(strings.NewReader(ioreg)); err != nil ||
+		id != "564D8E1A-7D3F-4C6B-9E4A-1F2B3C4D5E6F" {
+		t.Errorf("IOPlatformUUID is '%s' (%v)", id, err)
+	}
+
+	reg := "\r\nHKEY_LOCAL_MACHINE\\SOFTWARE\\Microsoft\\Cryptography\r\n" +
+		"    MachineGuid    REG_SZ    5b1e4f8a-0c3d-4e2f-9a1b-2c3d4e5f6a7b\r\n\r\n"
+	if id, err := parseMachineGuid(strings.NewReader(reg)); err != nil ||
+		id != "5b1e4f8a-0c3d-4e2f-9a1b-2c3d4e5f6a7b" {
+		t.Errorf("MachineGuid is '%s' (%v)", id, err)
+	}
+
+	if _, err := parseMachineGuid(strings.NewReader("ERROR: not found\r\n")); err != errNoMachineID {
+		t.Errorf("expected no machine ID, got %v", err)
+	}
+}
+
+func TestHashPeerID(t *testing.T) {
+	a, b := hashPeerID("host-a"), hashPeerID("host-b")
+	if *a == *b {
+		t.Error("peer IDs of different hosts are equal")
+	}
+	if *a != *hashPeerID("host-a") {
+		t.Error("peer ID of a host is not stable")
+	}
+}
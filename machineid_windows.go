@@ -0,0 +1,23 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// machineID returns the MachineGuid generated when Windows was installed.
+func machineID() (string, error) {
+	out, err := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Cryptography`,
+		"/v", "MachineGuid").Output()
+	if err != nil {
+		return "", err
+	}
+	return parseMachineGuid(bytes.NewReader(out))
+}
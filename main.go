@@ -5,18 +5,26 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"gopkg.in/natefinch/lumberjack.v2"
-
 	"github.com/pkg/errors"
 	"github.com/valyala/fasthttp"
 	"github.com/zeebo/bencode"
@@ -34,30 +42,234 @@ func submitCmd(ctx *cli.Context) error {
 		return fmt.Errorf("UUID is empty")
 	}
 
-	ver := ctx.Uint64("version")
-	if ver <= 0 {
-		ver = uint64(time.Now().UTC().Unix())
+	// a reproducible notification must not depend on the local clock or
+	// on the previous submissions
+	reproducible := ctx.Bool("reproducible")
+	if v, err := strconv.ParseUint(ctx.String("version"), 10, 64); reproducible && (err != nil || v == 0) {
+		return fmt.Errorf("--reproducible requires a version number since the default version" +
+			" depends on the previous submissions or the current time")
+	}
+	ver, registry, err := resolveVersion(ctx.String("version"), uuid, ctx.String("version-registry"),
+		ctx.Bool("allow-downgrade"), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if registry != nil {
+		defer registry.Close()
+	}
+	fmt.Fprintf(os.Stderr, "version:%d\n", ver)
+	var creationDate int64
+	if cd := ctx.String("creation-date"); len(cd) > 0 {
+		t, err := time.Parse(time.RFC3339, cd)
+		if err != nil {
+			return fmt.Errorf("invalid creation date: %v", err)
+		}
+		creationDate = t.Unix()
 	}
 
-	key, err := LoadPrivateKey(ctx.String("private-key"))
+	seed := ctx.Bool("seed")
+	if seed && ctx.Bool("follow") {
+		return fmt.Errorf("--seed and --follow are mutually exclusive")
+	}
+	seedCfg := DefaultConfig()
+	if cf := ctx.String("config-file"); seed && len(cf) > 0 {
+		if seedCfg, err = NewConfig(cf); err != nil {
+			return err
+		}
+	}
+
+	tracker := ctx.String("tracker")
+	if ctx.Bool("no-tracker") {
+		if ctx.IsSet("tracker") {
+			return fmt.Errorf("--tracker and --no-tracker are mutually exclusive")
+		}
+		tracker = ""
+	} else if len(tracker) == 0 {
+		return fmt.Errorf("tracker is empty, use --no-tracker to publish a trackerless update")
+	} else if ctx.Bool("tracker-token-placeholder") {
+		if tracker, err = withTokenPlaceholder(tracker); err != nil {
+			return err
+		}
+	}
+
+	pieceLength, err := ParsePieceLength(ctx.String("piece-length"))
 	if err != nil {
-		return errors.Wrap(err, "failed loading private key")
+		return err
+	}
+
+	excludes, err := excludePatterns(ctx)
+	if err != nil {
+		return err
+	}
+	if reproducible {
+		if err = checkReproducible(filename, excludes); err != nil {
+			return err
+		}
+	}
+	if ctx.Bool("verbose") {
+		_, skipped, err := payloadFiles(filename, excludes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "excludes: %s\n", strings.Join(excludes, " "))
+		for _, f := range skipped {
+			fmt.Fprintf(os.Stderr, "excluded: %s\n", f)
+		}
+	}
+
+	signer, err := loadSigner(ctx)
+	if err != nil {
+		return err
 	}
 
 	mi, err := NewNotification(
 		filename,
 		uuid,
 		ver,
-		ctx.String("tracker"),
-		ctx.Int64("piece-length"),
-		key)
+		tracker,
+		pieceLength,
+		excludes)
 	if err != nil {
 		return err
 	}
 
+	// the creation date is omitted from a reproducible notification unless
+	// it is overridden
+	if creationDate > 0 {
+		mi.CreationDate = creationDate
+		mi.CreationTime = time.Unix(creationDate, 0).UnixNano()
+	} else if reproducible {
+		mi.CreationDate, mi.CreationTime = 0, 0
+	}
+
+	// the optional fields must be signed as well
+	if group := ctx.String("group"); len(group) > 0 {
+		mi.Group = &UpdateGroup{
+			ID:       group,
+			Sequence: ctx.Int("group-sequence"),
+			Size:     ctx.Int("group-size"),
+		}
+		if err = mi.Group.Validate(); err != nil {
+			return err
+		}
+	}
+	if p := ctx.Int("rollout-percent"); p < 1 || p > 100 {
+		return fmt.Errorf("invalid rollout percentage: %d", p)
+	} else if p < 100 {
+		mi.RolloutPercent = p
+	}
+	if tags := ctx.StringSlice("tag"); len(tags) > 0 {
+		if err = validateTagSelectors(tags); err != nil {
+			return err
+		}
+		mi.Tags = tags
+	}
+	if platforms := ctx.StringSlice("platform"); len(platforms) > 0 {
+		if err = validatePlatforms(platforms); err != nil {
+			return err
+		}
+		mi.Platforms = platforms
+	}
+	if urls := ctx.StringSlice("fallback-url"); len(urls) > 0 {
+		if err = validateFallbackURLs(urls); err != nil {
+			return err
+		}
+		mi.FallbackURLs = urls
+	}
+	// the trace ID is random unless it is given, hence a reproducible
+	// notification has none by default
+	mi.TraceID = ctx.String("trace-id")
+	if err = validateTraceID(mi.TraceID); err != nil {
+		return err
+	}
+	if len(mi.TraceID) == 0 && !reproducible {
+		if mi.TraceID, err = newTraceID(); err != nil {
+			return errors.Wrap(err, "failed generating trace ID")
+		}
+	}
+	if p := ctx.String("priority"); p != PriorityNormal {
+		if err = validatePriority(p); err != nil {
+			return err
+		}
+		mi.Priority = p
+	}
+	mi.Title, mi.Notes = ctx.String("title"), ctx.String("notes")
+	if filename := ctx.String("notes-file"); len(filename) > 0 {
+		if len(mi.Notes) > 0 {
+			return fmt.Errorf("--notes and --notes-file are mutually exclusive")
+		}
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		mi.Notes = strings.TrimSpace(string(b))
+	}
+	if err = validateReleaseNotes(mi.Title, mi.Notes); err != nil {
+		return err
+	}
+	if nb := ctx.String("not-before"); len(nb) > 0 {
+		t, err := time.Parse(time.RFC3339, nb)
+		if err != nil {
+			return fmt.Errorf("invalid not-before time: %v", err)
+		}
+		mi.NotBefore = t.Unix()
+	}
+	if timeout := ctx.Int("script-timeout"); timeout < 0 {
+		return fmt.Errorf("invalid script timeout: %d", timeout)
+	} else if timeout > 0 {
+		mi.Timeout = timeout
+	}
+	var deltaSource string
+	if base := ctx.String("delta-from"); len(base) > 0 {
+		if st, err := os.Stat(filename); err != nil {
+			return err
+		} else if !st.Mode().IsRegular() {
+			return fmt.Errorf("--delta-from requires a payload that is a single file")
+		}
+		if deltaSource = ctx.String("delta-output"); len(deltaSource) == 0 {
+			deltaSource = filename + ".patch"
+		}
+		if mi.Delta, err = NewDelta(base, filename, deltaSource, mi.Info.Name+".patch",
+			mi.Info.PieceLength); err != nil {
+			return errors.Wrap(err, "failed generating delta")
+		}
+		if deltaSource, err = filepath.Abs(deltaSource); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "delta:%s %d/%d bytes\n", deltaSource, mi.Delta.Info.Length, mi.Info.Length)
+	}
+	// the agents would refuse a payload that may escape their data
+	// directory
+	if err = mi.validatePaths(); err != nil {
+		return err
+	}
+	if peers := ctx.StringSlice("canary-peer"); len(peers) > 0 {
+		mi.Canary = &Canary{
+			Peers:      peers,
+			MinSuccess: ctx.Int("canary-min-success"),
+			Override:   ctx.Bool("canary-override"),
+		}
+		if err = mi.Canary.Validate(); err != nil {
+			return err
+		}
+	}
+	if err = mi.SignWith(signer); err != nil {
+		return errors.Wrap(err, "failed signing notification")
+	}
+	// the digests are printed on STDERR since STDOUT may be the output
+	fmt.Fprintf(os.Stderr, "sha256:%s\n", mi.SHA256)
+	if ih, err := mi.InfoHash(); err == nil {
+		fmt.Fprintf(os.Stderr, "infohash:%s\n", ih.HexString())
+	}
+	if len(mi.TraceID) > 0 {
+		fmt.Fprintf(os.Stderr, "trace:%s\n", mi.TraceID)
+	}
+
 	u := Update{
-		Source:       filename,
-		Notification: *mi,
+		Source:        filename,
+		DeltaSource:   deltaSource,
+		SchemaVersion: SchemaVersion,
+		Notification:  *mi,
 	}
 
 	if output := ctx.String("output"); output != "" {
@@ -71,12 +283,18 @@ func submitCmd(ctx *cli.Context) error {
 			defer w.Close()
 		}
 		if ctx.Bool("torrent-file") {
-			return bencode.NewEncoder(w).Encode(&u.Notification)
+			err = bencode.NewEncoder(w).Encode(&u.Notification)
+		} else {
+			err = json.NewEncoder(w).Encode(&u)
 		}
-		return json.NewEncoder(w).Encode(&u)
+		if err != nil || !seed {
+			return err
+		}
+		return seedPayload(seedCfg.BitTorrent, &u.Notification, filename,
+			seedOptions{Duration: ctx.Duration("seed-for"), Ratio: ctx.Float64("seed-ratio")}, os.Stderr)
 	}
 
-	if err = submitToAgent(&u, ctx.String("unix-socket")); err != nil {
+	if err = submitToAgent(&u, agentSocket(ctx)); err != nil {
 		return errors.Wrap(err, "failed submitting to agent")
 	}
 	if serverAddr := ctx.String("server"); len(serverAddr) > 0 {
@@ -84,9 +302,92 @@ func submitCmd(ctx *cli.Context) error {
 			return errors.Wrap(err, "failed submitting to server")
 		}
 	}
+	if registry != nil {
+		if err = registry.Record(uuid, ver); err != nil {
+			return errors.Wrap(err, "submitted, but failed recording the version")
+		}
+	}
+	if ctx.Bool("follow") {
+		return watchProgress(ctx.String("server"), ctx.String("stun-password"), uuid, ver,
+			time.Duration(ctx.Int("timeout"))*time.Second, ctx.Int("quorum"), os.Stderr)
+	}
+	if seed {
+		return seedPayload(seedCfg.BitTorrent, &u.Notification, filename,
+			seedOptions{Duration: ctx.Duration("seed-for"), Ratio: ctx.Float64("seed-ratio")}, os.Stderr)
+	}
+	return nil
+}
+
+// watchCmd renders the progress of the update of the first argument until the
+// timeout or the quorum.
+func watchCmd(ctx *cli.Context) error {
+	uuid := ctx.Args().First()
+	if len(uuid) == 0 {
+		return fmt.Errorf("UUID is empty")
+	}
+	return watchProgress(ctx.String("server"), ctx.String("stun-password"), uuid, ctx.Uint64("version"),
+		time.Duration(ctx.Int("timeout"))*time.Second, ctx.Int("quorum"), os.Stderr)
+}
+
+// optionalValue is the value of a flag which may be given without a value,
+// e.g. --ssh-agent or --ssh-agent=fingerprint.
+type optionalValue struct {
+	set   bool
+	value string
+}
+
+func (o *optionalValue) Set(s string) error {
+	o.set = true
+	if s != "true" {
+		o.value = s
+	}
 	return nil
 }
 
+func (o *optionalValue) String() string { return o.value }
+
+// IsBoolFlag allows the flag without a value.
+func (o *optionalValue) IsBoolFlag() bool { return true }
+
+// loadSigner returns the signer given by the flags, which is ssh-agent, a
+// PKCS#11 token or, by default, the private key file.
+func loadSigner(ctx *cli.Context) (Signer, error) {
+	timeout := time.Duration(ctx.Int("sign-timeout")) * time.Second
+	sshAgent, _ := ctx.Generic("ssh-agent").(*optionalValue)
+	useAgent := sshAgent != nil && sshAgent.set
+	pkcs11 := ctx.String("pkcs11")
+	switch {
+	case useAgent && len(pkcs11) > 0:
+		return nil, fmt.Errorf("--ssh-agent and --pkcs11 are mutually exclusive")
+	case (useAgent || len(pkcs11) > 0) && ctx.IsSet("private-key"):
+		return nil, fmt.Errorf("--private-key cannot be used with an external signer")
+	case useAgent:
+		return SSHAgentSigner{
+			Socket:      os.Getenv("SSH_AUTH_SOCK"),
+			Fingerprint: sshAgent.value,
+			Timeout:     timeout,
+		}, nil
+	case len(pkcs11) > 0:
+		return ParsePKCS11Signer(pkcs11, timeout)
+	}
+	key, err := LoadPrivateKey(ctx.String("private-key"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed loading private key")
+	}
+	return KeySigner{Key: key}, nil
+}
+
+// excludePatterns returns the exclude patterns of a directory payload given
+// by the flags, which include the default ones unless they are disabled.
+func excludePatterns(ctx *cli.Context) ([]string, error) {
+	var excludes []string
+	if !ctx.Bool("no-default-excludes") {
+		excludes = append(excludes, DefaultExcludes...)
+	}
+	excludes = append(excludes, ctx.StringSlice("exclude")...)
+	return excludes, ValidateExcludes(excludes)
+}
+
 func submitToServer(u *Update, addr string) error {
 	req := fasthttp.AcquireRequest()
 	req.SetRequestURI(fmt.Sprintf("http://%s", addr))
@@ -104,12 +405,42 @@ func submitToServer(u *Update, addr string) error {
 	return nil
 }
 
-func submitToAgent(u *Update, addr string) error {
-	client := fasthttp.Client{
+// agentSocket returns the API socket of the agent given by --unix-socket, or
+// the default socket of the instance given by --instance.
+func agentSocket(ctx *cli.Context) string {
+	if name := ctx.GlobalString("instance"); len(name) > 0 && !ctx.IsSet("unix-socket") {
+		return instanceUnixSocket(name)
+	}
+	return ctx.String("unix-socket")
+}
+
+// selectInstance sets the instance of given config to the one given by
+// --instance, whose default paths apply.
+func selectInstance(ctx *cli.Context, cfg *Config) error {
+	name := ctx.GlobalString("instance")
+	if len(name) == 0 {
+		return nil
+	}
+	if len(cfg.Instance) > 0 && cfg.Instance != name {
+		return fmt.Errorf("instance %s differs from the instance %s of the config file", name, cfg.Instance)
+	}
+	cfg.Instance = name
+	cfg.applyInstance()
+	return nil
+}
+
+// agentClient returns an HTTP client of the agent's REST API at given unix
+// socket.
+func agentClient(addr string) *fasthttp.Client {
+	return &fasthttp.Client{
 		Dial: func(_ string) (net.Conn, error) {
 			return net.Dial("unix", addr)
 		},
 	}
+}
+
+func submitToAgent(u *Update, addr string) error {
+	client := agentClient(addr)
 	req := fasthttp.AcquireRequest()
 	req.SetRequestURI(updateURL)
 	req.Header.SetMethod("POST")
@@ -126,153 +457,1888 @@ func submitToAgent(u *Update, addr string) error {
 	return nil
 }
 
-func serverCmd(ctx *cli.Context) error {
+func blacklistCmd(ctx *cli.Context) error {
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	if source := ctx.String("clear"); len(source) > 0 {
+		req.SetRequestURI(blacklistURL + "?source=" + url.QueryEscape(source))
+		req.Header.SetMethod("DELETE")
+	} else {
+		req.SetRequestURI(blacklistURL)
+		req.Header.SetMethod("GET")
+	}
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+		return fmt.Errorf("blacklist - failed http request: %v", err)
+	}
+	switch res.StatusCode() {
+	case 200:
+	case 404:
+		return fmt.Errorf("blacklist - source '%s' is not in the blacklist", ctx.String("clear"))
+	default:
+		return fmt.Errorf("blacklist - status code: %d", res.StatusCode())
+	}
+	os.Stdout.Write(res.Body())
+	return nil
+}
+
+// validationFailuresCmd lists the sources of the most invalid messages
+// received by the server, or by the agent if no server is given.
+func validationFailuresCmd(ctx *cli.Context) error {
 	var (
-		wg  sync.WaitGroup
-		s   *Server
-		err error
+		code int
+		body []byte
 	)
-
-	cfg := DefaultServerConfig()
-	if addr := ctx.String("address"); addr != "" {
-		cfg.Address = addr
+	query := fmt.Sprintf("?top=%d", ctx.Int("top"))
+	if server := ctx.String("server"); len(server) > 0 {
+		var err error
+		code, body, err = fasthttp.GetTimeout(nil, "http://"+server+"/validation-failures"+query, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("validation-failures - failed http request: %v", err)
+		}
+	} else {
+		client := agentClient(agentSocket(ctx))
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		req.SetRequestURI(validationFailuresURL + query)
+		req.Header.SetMethod("GET")
+		if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+			return fmt.Errorf("validation-failures - failed http request: %v", err)
+		}
+		code, body = res.StatusCode(), res.Body()
 	}
-	if t := ctx.Int("advertise-session"); t > 0 {
-		cfg.SessionAdvertiseTime = t
+	if code != 200 {
+		return fmt.Errorf("validation-failures - status code: %d", code)
 	}
-	if db := ctx.String("database"); db != "" {
-		cfg.Database = db
+	if ctx.Bool("json") {
+		os.Stdout.Write(body)
+		return nil
 	}
-	if t := ctx.Int("snapshot-time"); t > 0 {
-		cfg.SnapshotTime = t
+	var offenders []ValidationOffender
+	if err := json.Unmarshal(body, &offenders); err != nil {
+		return fmt.Errorf("validation-failures - failed decoding offenders: %v", err)
 	}
-	if f := ctx.String("public-key"); f != "" {
-		cfg.PublicKey.Filename = f
+	return writeOffenders(os.Stdout, offenders)
+}
+
+// decisionCmd returns the action of a command that makes given decision
+// (approve or reject) on the update of the first argument awaiting approval,
+// or deploys it if it is staged (deploy).
+func decisionCmd(decision string) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		uuid := ctx.Args().First()
+		if len(uuid) == 0 {
+			return fmt.Errorf("%s - uuid is required", decision)
+		}
+		uri := fmt.Sprintf("%s/%s/%s", updateURL, uuid, decision)
+		if version := ctx.Args().Get(1); len(version) > 0 && decision != "reject" {
+			if _, err := strconv.ParseUint(version, 10, 64); err != nil {
+				return fmt.Errorf("%s - invalid version: %s", decision, version)
+			}
+			uri += "?version=" + version
+		}
+		client := agentClient(agentSocket(ctx))
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		req.SetRequestURI(uri)
+		req.Header.SetMethod("POST")
+		if err := client.DoDeadline(req, res, time.Now().Add(30*time.Second)); err != nil {
+			return fmt.Errorf("%s - failed http request: %v", decision, err)
+		}
+		switch res.StatusCode() {
+		case 200:
+		case 404:
+			return fmt.Errorf("%s - update uuid:%s does not exist", decision, uuid)
+		default:
+			return fmt.Errorf("%s - status code: %d %s", decision, res.StatusCode(), res.Body())
+		}
+		return nil
 	}
-	if pwd := ctx.String("stun-password"); len(pwd) > 0 {
-		cfg.StunPassword = pwd
+}
+
+// maintenanceCmd shows the maintenance status of the agent, or sets or lifts
+// the maintenance mode of the agent or, with a signed notice, of the fleet.
+func maintenanceCmd(ctx *cli.Context) error {
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	mode := ctx.Args().First()
+	switch {
+	case len(mode) == 0:
+		req.SetRequestURI(maintenanceURL)
+		req.Header.SetMethod("GET")
+	case mode != "on" && mode != "off":
+		return fmt.Errorf("maintenance - invalid mode '%s', it must be on or off", mode)
+	case ctx.Bool("fleet"):
+		key, err := LoadPrivateKey(ctx.String("private-key"))
+		if err != nil {
+			return errors.Wrap(err, "failed loading private key")
+		}
+		by := "operator"
+		if u, err := user.Current(); err == nil {
+			by = u.Username
+		}
+		mn := MaintenanceNotice{Active: mode == "on", Timestamp: time.Now().UnixNano(), By: by}
+		if err = mn.Sign(key); err != nil {
+			return err
+		}
+		req.SetRequestURI(maintenanceBroadcastURL)
+		req.Header.SetMethod("POST")
+		if err = json.NewEncoder(req.BodyWriter()).Encode(&mn); err != nil {
+			return err
+		}
+	default:
+		req.SetRequestURI(maintenanceURL + "?active=" + mode)
+		req.Header.SetMethod("POST")
+	}
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+		return fmt.Errorf("maintenance - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("maintenance - status code: %d", res.StatusCode())
 	}
+	os.Stdout.Write(res.Body())
+	return nil
+}
 
-	if f := ctx.String("log-file"); len(f) > 0 {
-		log.SetOutput(&lumberjack.Logger{
-			Filename:   f,
-			MaxSize:    10,
-			MaxBackups: 1,
-			MaxAge:     28,
-			Compress:   true,
-		})
+// uninstallCmd signs an uninstall notice of an update, which is applied by
+// the agent and broadcast to the fleet.
+func uninstallCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("uninstall requires the uuid of the update")
+	}
+	signer, err := loadSigner(ctx)
+	if err != nil {
+		return err
+	}
+	by := "operator"
+	if u, err := user.Current(); err == nil {
+		by = u.Username
+	}
+	un := UninstallNotice{
+		UUID:       ctx.Args().First(),
+		MaxVersion: ctx.Uint64("max-version"),
+		Cleanup:    ctx.String("cleanup"),
+		Timestamp:  time.Now().UnixNano(),
+		By:         by,
+	}
+	if err = un.Validate(); err != nil {
+		return err
+	}
+	if err = un.SignWith(signer); err != nil {
+		return errors.Wrap(err, "failed signing uninstall notice")
 	}
 
-	if s, err = NewServer(*cfg); err != nil {
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(uninstallURL)
+	req.Header.SetMethod("POST")
+	if err = json.NewEncoder(req.BodyWriter()).Encode(&un); err != nil {
 		return err
 	}
-	wg.Add(1)
-	go s.run(&wg)
-	wg.Wait()
-	log.Println("Server is exiting.")
+	// the cleanup script may run as long as a deployment
+	timeout := cleanupTimeout(client, un.UUID)
+	if err = client.DoDeadline(req, res, time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("uninstall - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("uninstall - status code: %d", res.StatusCode())
+	}
+	os.Stdout.Write(res.Body())
 	return nil
 }
 
-func agentCmd(ctx *cli.Context) error {
-	if ctx.Bool("default-config") {
-		return json.NewEncoder(os.Stdout).Encode(DefaultConfig())
+// cleanupTimeout returns how long the agent may take to uninstall the update
+// of given UUID: the script timeout of its last deployment, or
+// ShellExecutionTimeout if it is unknown, plus a few seconds.
+func cleanupTimeout(client *fasthttp.Client, uuid string) time.Duration {
+	var u struct {
+		DeployTimeout int `json:"deploy-timeout"`
+	}
+	timeout := ShellExecutionTimeout
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(fmt.Sprintf("%s/%s", updateURL, uuid))
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err == nil &&
+		res.StatusCode() == 200 && json.Unmarshal(res.Body(), &u) == nil && u.DeployTimeout > 0 {
+		timeout = u.DeployTimeout
 	}
+	return time.Duration(timeout+5) * time.Second
+}
 
-	var (
-		a   *Agent
-		cfg Config
-		err error
-	)
+// controlCmd returns the action of a command that signs a control notice of
+// given action (stop or start), which is applied by the local agent and
+// broadcast to the fleet. A local start only starts the update of the local
+// agent, without signing.
+func controlCmd(action string) func(*cli.Context) error {
+	return func(ctx *cli.Context) error {
+		uuid := ctx.String("uuid")
+		if len(uuid) == 0 {
+			return fmt.Errorf("control %s - uuid is required", action)
+		}
+		client := agentClient(agentSocket(ctx))
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		req.Header.SetMethod("POST")
+		if action == ControlStart && ctx.Bool("local") {
+			req.SetRequestURI(fmt.Sprintf("%s/%s/start", updateURL, uuid))
+		} else {
+			signer, err := loadSigner(ctx)
+			if err != nil {
+				return err
+			}
+			by := "operator"
+			if u, err := user.Current(); err == nil {
+				by = u.Username
+			}
+			cn := ControlNotice{
+				Action:    action,
+				UUID:      uuid,
+				Version:   ctx.Uint64("version"),
+				Peers:     ctx.StringSlice("peer"),
+				Timestamp: time.Now().UnixNano(),
+				By:        by,
+			}
+			if err = cn.Validate(); err != nil {
+				return err
+			}
+			if err = cn.SignWith(signer); err != nil {
+				return errors.Wrap(err, "failed signing control notice")
+			}
+			req.SetRequestURI(controlURL)
+			if err = json.NewEncoder(req.BodyWriter()).Encode(&cn); err != nil {
+				return err
+			}
+		}
+		// a start waits for the monitor of the stopped update to exit
+		if err := client.DoDeadline(req, res, time.Now().Add(controlRestartTimeout+5*time.Second)); err != nil {
+			return fmt.Errorf("control %s - failed http request: %v", action, err)
+		}
+		switch res.StatusCode() {
+		case 200:
+		case 404:
+			return fmt.Errorf("control %s - update uuid:%s does not exist", action, uuid)
+		default:
+			return fmt.Errorf("control %s - status code: %d %s", action, res.StatusCode(), res.Body())
+		}
+		os.Stdout.Write(res.Body())
+		return nil
+	}
+}
 
-	if cfg, err = NewConfig(ctx.String("config-file")); err != nil {
-		return err
-	} else if a, err = NewAgent(cfg); err != nil {
+// sendCmd sends a signed maintenance notice, or a ping, to every peer of the
+// agent's session table or to given peers, e.g. the failed ones of a
+// previous send.
+func sendCmd(ctx *cli.Context) error {
+	sr := SendRequest{
+		Peers:       ctx.StringSlice("peer"),
+		Concurrency: ctx.Int("concurrency"),
+		Timeout:     ctx.Int("timeout"),
+	}
+	if ctx.Bool("broadcast") == (len(sr.Peers) > 0) {
+		return fmt.Errorf("send requires either --broadcast or --peer")
+	}
+	switch mode := ctx.String("maintenance"); mode {
+	case "":
+	case "on", "off":
+		key, err := LoadPrivateKey(ctx.String("private-key"))
+		if err != nil {
+			return errors.Wrap(err, "failed loading private key")
+		}
+		by := "operator"
+		if u, err := user.Current(); err == nil {
+			by = u.Username
+		}
+		sr.Maintenance = &MaintenanceNotice{Active: mode == "on", Timestamp: time.Now().UnixNano(), By: by}
+		if err = sr.Maintenance.Sign(key); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("send - invalid maintenance mode '%s', it must be on or off", mode)
+	}
+
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(sendURL)
+	req.Header.SetMethod("POST")
+	if err := json.NewEncoder(req.BodyWriter()).Encode(&sr); err != nil {
 		return err
 	}
-	a.Wait()
-	log.Println("Agent has stopped.")
+	timeout := time.Duration(sr.Timeout+5) * time.Second
+	if err := client.DoDeadline(req, res, time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("send - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("send - status code: %d", res.StatusCode())
+	}
+	if ctx.Bool("json") {
+		os.Stdout.Write(res.Body())
+	}
+	var r SendResult
+	if err := json.Unmarshal(res.Body(), &r); err != nil {
+		return fmt.Errorf("send - invalid response: %v", err)
+	}
+	if !ctx.Bool("json") {
+		for _, p := range r.Peers {
+			if p.OK {
+				relay := ""
+				if p.Relayed {
+					relay = " (relayed)"
+				}
+				fmt.Printf("ok   %s %s %.1fms%s\n", p.PeerID, p.Address, p.RTT, relay)
+			} else {
+				fmt.Printf("FAIL %s %s %s\n", p.PeerID, p.Address, p.Error)
+			}
+		}
+		fmt.Printf("sent: %d, failed: %d\n", r.Sent, r.Failed)
+	}
+	if failed := r.FailedPeers(); len(failed) > 0 {
+		return cli.NewExitError(fmt.Sprintf("failed peers, retry with: --peer %s",
+			strings.Join(failed, " --peer ")), 1)
+	}
 	return nil
 }
 
-func main() {
-	app := cli.NewApp()
-
-	app.Usage = "Peer-to-peer secure update"
-	app.Version = "0.1.2"
-	app.EnableBashCompletion = true
+// fetchCmd copies a file of a complete or deployed update from the agent to
+// a local file, or to STDOUT, and verifies its size and SHA-256 against the
+// listing of the agent.
+func fetchCmd(ctx *cli.Context) error {
+	uuid, path, out := ctx.String("uuid"), ctx.String("path"), ctx.String("out")
+	if len(uuid) == 0 || len(path) == 0 {
+		return fmt.Errorf("fetch - uuid and path are required")
+	}
+	uri := fmt.Sprintf("%s/%s/files", updateURL, uuid)
+	query := ""
+	if ns := ctx.String("namespace"); len(ns) > 0 {
+		query = "?namespace=" + url.QueryEscape(ns)
+	}
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(uri + query)
+	req.Header.SetMethod("GET")
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Minute)); err != nil {
+		return fmt.Errorf("fetch - failed http request: %v", err)
+	}
+	switch res.StatusCode() {
+	case 200:
+	case 404:
+		return fmt.Errorf("fetch - update uuid:%s does not exist", uuid)
+	default:
+		return fmt.Errorf("fetch - status code: %d %s", res.StatusCode(), res.Body())
+	}
+	var files []ArtifactFile
+	if err := json.Unmarshal(res.Body(), &files); err != nil {
+		return fmt.Errorf("fetch - invalid response: %v", err)
+	}
+	var file *ArtifactFile
+	for i := range files {
+		if files[i].Path == path {
+			file = &files[i]
+		}
+	}
+	if file == nil {
+		return fmt.Errorf("fetch - %s is not a file of update uuid:%s", path, uuid)
+	}
 
-	homeDir := "~/"
-	if user, err := user.Current(); err == nil {
-		homeDir = user.HomeDir
+	// the file is streamed rather than buffered by the fasthttp client
+	addr := agentSocket(ctx)
+	hc := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", addr)
+		},
+	}}
+	escaped := strings.Split(path, "/")
+	for i := range escaped {
+		escaped[i] = url.PathEscape(escaped[i])
+	}
+	resp, err := hc.Get(uri + "/" + strings.Join(escaped, "/") + query)
+	if err != nil {
+		return fmt.Errorf("fetch - failed http request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("fetch - status code: %d", resp.StatusCode)
 	}
 
-	app.Commands = []cli.Command{
-		{
-			Name:   "submit",
-			Usage:  "submit a new update",
+	w, tmp := io.Writer(os.Stdout), ""
+	if out != "-" {
+		tmp = out + ".part"
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return fmt.Errorf("fetch - %v", err)
+		}
+		defer os.Remove(tmp)
+		defer f.Close()
+		w = f
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return fmt.Errorf("fetch - failed copying %s: %v", path, err)
+	}
+	if n != file.Size || hex.EncodeToString(h.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("fetch - %s has changed during the copy", path)
+	}
+	if len(tmp) > 0 {
+		if f, ok := w.(*os.File); ok {
+			if err = f.Close(); err != nil {
+				return fmt.Errorf("fetch - %v", err)
+			}
+		}
+		if err = os.Rename(tmp, out); err != nil {
+			return fmt.Errorf("fetch - %v", err)
+		}
+	}
+	return nil
+}
+
+// importCmd imports a local copy of the payload of an update into the agent,
+// which seeds it without downloading the verified pieces.
+func importCmd(ctx *cli.Context) error {
+	uuid, filename := ctx.String("uuid"), ctx.String("file")
+	if len(uuid) == 0 || len(filename) == 0 {
+		return fmt.Errorf("import - uuid and file are required")
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("import - %v", err)
+	}
+	uri := fmt.Sprintf("%s/%s/import?file=%s", updateURL, uuid, url.QueryEscape(abs))
+	if ns := ctx.String("namespace"); len(ns) > 0 {
+		uri += "&namespace=" + url.QueryEscape(ns)
+	}
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(uri)
+	req.Header.SetMethod("POST")
+	// all the pieces are hashed before the agent responds
+	if err := client.DoDeadline(req, res, time.Now().Add(time.Hour)); err != nil {
+		return fmt.Errorf("import - failed http request: %v", err)
+	}
+	switch res.StatusCode() {
+	case 200:
+	case 404:
+		return fmt.Errorf("import - update uuid:%s does not exist", uuid)
+	default:
+		return fmt.Errorf("import - status code: %d %s", res.StatusCode(), res.Body())
+	}
+	var r ImportResult
+	if err := json.Unmarshal(res.Body(), &r); err != nil {
+		return fmt.Errorf("import - invalid response: %v", err)
+	}
+	fmt.Printf("%s version:%d imported %d of %d pieces (%d bytes) linked:%v complete:%v\n",
+		r.UUID, r.Version, r.Pieces, r.Total, r.Bytes, r.Linked, r.Complete)
+	return nil
+}
+
+// reannounceCmd forces the agent to re-announce an update, or all of them, to
+// the trackers and the DHT and to add the overlay peers, and shows how many
+// peers were obtained.
+func reannounceCmd(ctx *cli.Context) error {
+	uri := reannounceURL
+	if uuid := ctx.String("uuid"); len(uuid) > 0 {
+		uri += "?uuid=" + url.QueryEscape(uuid)
+	}
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(uri)
+	req.Header.SetMethod("POST")
+	if err := client.DoDeadline(req, res, time.Now().Add(reannounceTimeout*4)); err != nil {
+		return fmt.Errorf("reannounce - failed http request: %v", err)
+	}
+	switch res.StatusCode() {
+	case 200:
+	case 404:
+		return fmt.Errorf("reannounce - update uuid:%s does not exist", ctx.String("uuid"))
+	default:
+		return fmt.Errorf("reannounce - status code: %d", res.StatusCode())
+	}
+	if ctx.Bool("json") {
+		os.Stdout.Write(res.Body())
+		return nil
+	}
+	var results []ReannounceResult
+	if err := json.Unmarshal(res.Body(), &results); err != nil {
+		return fmt.Errorf("reannounce - invalid response: %v", err)
+	}
+	for _, r := range results {
+		switch {
+		case r.Limited:
+			fmt.Printf("%s rate-limited, retry after %s\n", r.UUID, r.Retry.Format(time.RFC3339))
+		default:
+			fmt.Printf("%s new:%d tracker:%d dht:%d overlay:%d\n", r.UUID, r.New, r.Tracker, r.DHT, r.Overlay)
+		}
+		for _, e := range r.Errors {
+			fmt.Printf("%s error: %s\n", r.UUID, e)
+		}
+	}
+	return nil
+}
+
+// gcCmd compacts the metadata of the agent, and shows the removed items, or
+// the ones that would be removed with --dry-run.
+func gcCmd(ctx *cli.Context) error {
+	uri := gcURL
+	if ctx.Bool("dry-run") {
+		uri += "?dry-run=true"
+	}
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(uri)
+	req.Header.SetMethod("POST")
+	if err := client.DoDeadline(req, res, time.Now().Add(time.Minute)); err != nil {
+		return fmt.Errorf("gc - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("gc - status code: %d", res.StatusCode())
+	}
+	if ctx.Bool("json") {
+		os.Stdout.Write(res.Body())
+		return nil
+	}
+	var result GCResult
+	if err := json.Unmarshal(res.Body(), &result); err != nil {
+		return fmt.Errorf("gc - invalid response: %v", err)
+	}
+	action := "removed"
+	switch {
+	case result.DryRun:
+		action = "would remove"
+	case result.Archived:
+		action = "archived"
+	}
+	for _, item := range result.Items {
+		fmt.Printf("%s %s %s: %s\n", action, item.Kind, item.Name, item.Detail)
+	}
+	for _, e := range result.Errors {
+		fmt.Printf("error: %s\n", e)
+	}
+	return nil
+}
+
+// fleetStatusCmd shows the fleet-wide deployment statistics of the server.
+func fleetStatusCmd(ctx *cli.Context) error {
+	uri := fmt.Sprintf("http://%s/fleet-status", ctx.String("server"))
+	if groupBy := ctx.String("group-by"); len(groupBy) > 0 {
+		uri += "?group-by=" + url.QueryEscape(groupBy)
+	}
+	code, body, err := fasthttp.GetTimeout(nil, uri, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("fleet-status - failed http request: %v", err)
+	}
+	if code != 200 {
+		return fmt.Errorf("fleet-status - status code: %d", code)
+	}
+	if !ctx.Bool("summary") {
+		os.Stdout.Write(body)
+		return nil
+	}
+	var summary FleetSummary
+	if err = json.Unmarshal(body, &summary); err != nil {
+		return fmt.Errorf("fleet-status - failed decoding statistics: %v", err)
+	}
+	return summary.WriteSummary(os.Stdout)
+}
+
+// inspectCmd prints the content of a notification file, which is a torrent
+// file or the JSON output of the submit command.
+func inspectCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("inspect requires a notification file")
+	}
+	n, err := readNotificationFile(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("uuid: %s\n", n.UUID)
+	fmt.Printf("version: %d\n", n.Version)
+	fmt.Printf("title: %s\n", n.title())
+	fmt.Printf("schema-version: %d\n", n.SchemaVersion)
+	fmt.Printf("name: %s\n", n.Info.Name)
+	fmt.Printf("length: %d\n", n.Info.TotalLength())
+	fmt.Printf("piece-length: %d\n", n.Info.PieceLength)
+	fmt.Printf("created: %s\n", time.Unix(n.CreationDate, 0).UTC().Format(time.RFC3339))
+	if n.Trackerless() {
+		fmt.Println("tracker: (trackerless)")
+	} else {
+		fmt.Printf("tracker: %s\n", n.Announce)
+	}
+	if len(n.SHA256) > 0 {
+		fmt.Printf("sha256: %s\n", n.SHA256)
+	} else {
+		fmt.Println("sha256: (none)")
+	}
+	if notes := n.notes(); len(notes) > 0 {
+		fmt.Printf("notes:\n  %s\n", strings.Replace(notes, "\n", "\n  ", -1))
+	} else {
+		fmt.Println("notes:")
+	}
+	return nil
+}
+
+// verifyCmd computes and prints the digest of a payload. If a notification
+// is given, its signature and digest are verified against the payload.
+func verifyCmd(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return fmt.Errorf("verify requires an update file or directory")
+	}
+	excludes, err := excludePatterns(ctx)
+	if err != nil {
+		return err
+	}
+	files, _, err := payloadFiles(ctx.Args().First(), excludes)
+	if err != nil {
+		return err
+	}
+	digest, err := payloadDigest(ctx.Args().First(), files)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("sha256:%s  %s\n", digest, ctx.Args().First())
+
+	filename := ctx.String("notification")
+	if len(filename) == 0 {
+		return nil
+	}
+	n, err := readNotificationFile(filename)
+	if err != nil {
+		return err
+	}
+	pub, err := LoadPublicKey(ctx.String("public-key"))
+	if err != nil {
+		return errors.Wrap(err, "failed loading public key")
+	}
+	fmt.Printf("schema-version: %d\n", n.SchemaVersion)
+	if err = n.Verify(pub); err != nil {
+		return errors.Wrap(errUpdateVerificationFailed, err.Error())
+	}
+	// the title is only printed once it is known to be signed
+	fmt.Printf("uuid:%s version:%d title:%s\n", n.UUID, n.Version, n.title())
+	if err = checkSchema(n.SchemaVersion); err != nil {
+		return err
+	}
+	if len(n.SHA256) == 0 {
+		return fmt.Errorf("notification has no payload digest")
+	}
+	if n.SHA256 != digest {
+		return errors.Wrapf(errDigestMismatch, "notification has sha256:%s", n.SHA256)
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+// updatesCmd lists the statuses of the agent's updates selected by the
+// filter flags.
+func updatesCmd(ctx *cli.Context) error {
+	q := url.Values{}
+	for _, name := range []string{"uuid", "state", "deployed-before", "deployed-after", "sort", "after"} {
+		if v := ctx.String(name); len(v) > 0 {
+			q.Set(name, v)
+		}
+	}
+	for _, name := range []string{"min-deploy-fails", "limit"} {
+		if v := ctx.Int(name); v > 0 {
+			q.Set(name, strconv.Itoa(v))
+		}
+	}
+	client := agentClient(agentSocket(ctx))
+	req := fasthttp.AcquireRequest()
+	res := fasthttp.AcquireResponse()
+	req.SetRequestURI(updatesURL + "?" + q.Encode())
+	req.Header.SetMethod("GET")
+	if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+		return fmt.Errorf("updates - failed http request: %v", err)
+	}
+	if res.StatusCode() != 200 {
+		return fmt.Errorf("updates - status code: %d %s", res.StatusCode(), res.Body())
+	}
+	os.Stdout.Write(res.Body())
+	return nil
+}
+
+// eventsCmd prints the recent events of the agent, one JSON object per line.
+// With --follow, it keeps polling the new events and reports the events that
+// were dropped from the ring between two polls.
+func eventsCmd(ctx *cli.Context) error {
+	client := agentClient(agentSocket(ctx))
+	since := ctx.Uint64("since")
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		req := fasthttp.AcquireRequest()
+		res := fasthttp.AcquireResponse()
+		req.SetRequestURI(fmt.Sprintf("%s?since=%d", eventsURL, since))
+		req.Header.SetMethod("GET")
+		if err := client.DoDeadline(req, res, time.Now().Add(5*time.Second)); err != nil {
+			return fmt.Errorf("events - failed http request: %v", err)
+		}
+		if res.StatusCode() != 200 {
+			return fmt.Errorf("events - status code: %d %s", res.StatusCode(), res.Body())
+		}
+		var page EventPage
+		if err := json.Unmarshal(res.Body(), &page); err != nil {
+			return fmt.Errorf("events - invalid response: %v", err)
+		}
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(res)
+		if page.Dropped > 0 {
+			fmt.Fprintf(os.Stderr, "events - %d events after %d were dropped\n", page.Dropped, since)
+		}
+		for _, e := range page.Events {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		if page.Last < since {
+			// the agent has restarted, its sequence numbers start again
+			fmt.Fprintf(os.Stderr, "events - the agent has restarted\n")
+		}
+		since = page.Last
+		if !ctx.Bool("follow") {
+			return nil
+		}
+		time.Sleep(time.Duration(ctx.Int("interval")) * time.Second)
+	}
+}
+
+func serverCmd(ctx *cli.Context) error {
+	var (
+		wg  sync.WaitGroup
+		s   *Server
+		err error
+	)
+
+	cfg := DefaultServerConfig()
+	if addr := ctx.String("address"); addr != "" {
+		cfg.Address = addr
+	}
+	if t := ctx.Int("advertise-session"); t > 0 {
+		cfg.SessionAdvertiseTime = t
+	}
+	if db := ctx.String("database"); db != "" {
+		cfg.Database = db
+	}
+	if t := ctx.Int("snapshot-time"); t > 0 {
+		cfg.SnapshotTime = t
+	}
+	if n := ctx.Int("session-page-size"); n > 0 {
+		cfg.SessionPageSize = n
+	}
+	if n := ctx.Int("report-window"); n > 0 {
+		cfg.ReportWindow = n
+	}
+	if f := ctx.String("public-key"); f != "" {
+		cfg.PublicKey.Filename = f
+	}
+	if pwd := ctx.String("stun-password"); len(pwd) > 0 {
+		cfg.StunPassword = pwd
+	}
+
+	if o := ctx.String("log-output"); len(o) > 0 {
+		cfg.Log.Output = o
+	} else if f := ctx.String("log-file"); len(f) > 0 {
+		cfg.Log.Output = "file:" + f
+	}
+	cfg.Log.Facility = ctx.String("log-facility")
+	cfg.Log.Tag = ctx.String("log-tag")
+	if err = SetupLogger(cfg.Log); err != nil {
+		return err
+	}
+
+	if s, err = NewServer(*cfg); err != nil {
+		return err
+	}
+	wg.Add(1)
+	go s.run(&wg)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range c {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			// reopen the log output, e.g. after logrotate
+			if err := SetupLogger(cfg.Log); err != nil {
+				log.Printf("failed reloading logger: %v", err)
+			}
+		}
+		s.Stop()
+		log.Println("Server is exiting.")
+		os.Exit(0)
+	}()
+
+	wg.Wait()
+	log.Println("Server is exiting.")
+	return nil
+}
+
+// combinedCmd runs the server and an agent talking to it over the loopback
+// interface in a single process, e.g. on a box that is both the rendezvous
+// server and a proxy seeding every update. The agent handles the signals,
+// and the server is stopped once the agent has stopped.
+func combinedCmd(ctx *cli.Context) error {
+	cfg, err := NewConfig(ctx.String("config-file"))
+	if err != nil {
+		return err
+	}
+	if err = selectInstance(ctx, &cfg); err != nil {
+		return err
+	}
+	scfg, err := cfg.embeddedServerConfig()
+	if err != nil {
+		return err
+	}
+	if cfg.Server, err = loopbackAddress(scfg.Address); err != nil {
+		return err
+	}
+	cfg.Servers = nil
+	if err = SetupLogger(scfg.Log); err != nil {
+		return err
+	}
+
+	s, err := NewServer(*scfg)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.run(&wg)
+
+	a, err := NewAgent(cfg)
+	if err != nil {
+		s.Stop()
+		return err
+	}
+	a.Wait()
+	log.Println("Agent has stopped.")
+	s.Stop()
+	log.Println("Server is exiting.")
+	return nil
+}
+
+func importStateFile(cfg Config, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	imported, skipped, err := ImportState(cfg, f)
+	if err != nil {
+		return errors.Wrapf(err, "failed importing state %s", filename)
+	}
+	log.Printf("imported %d files of state %s, skipped %d", len(imported), filename, len(skipped))
+	return nil
+}
+
+func exportCmd(ctx *cli.Context) error {
+	cfg, err := NewConfig(ctx.String("config-file"))
+	if err != nil {
+		return err
+	}
+	if err = selectInstance(ctx, &cfg); err != nil {
+		return err
+	}
+	out := ctx.String("out")
+	if len(out) == 0 {
+		return fmt.Errorf("output file is required")
+	}
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	manifest, err := ExportState(cfg, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return errors.Wrap(err, "failed exporting state")
+	}
+	fmt.Fprintf(os.Stderr, "exported %d files to %s\n", len(manifest.Files), out)
+	return nil
+}
+
+// configShowCmd prints the sources of the configurations of the agent by
+// precedence, the distributed configurations and the effective ones.
+func configShowCmd(ctx *cli.Context) error {
+	filename := ctx.String("config-file")
+	cfg, err := NewConfig(filename)
+	if err != nil {
+		return err
+	}
+	var distributed map[string]interface{}
+	if b, err := ioutil.ReadFile(configOverlayFilename(filename)); err == nil {
+		if err = json.Unmarshal(b, &distributed); err != nil {
+			return fmt.Errorf("invalid distributed config: %v", err)
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Precedence  []string               `json:"precedence"` // the lowest first
+		Distributed map[string]interface{} `json:"distributed,omitempty"`
+		Config      Config                 `json:"config"`
+	}{configPrecedence(filename), distributed, cfg.redacted()})
+}
+
+// peerCertNewCACmd generates the CA key issuing the peer certificates.
+func peerCertNewCACmd(ctx *cli.Context) error {
+	out := ctx.String("out")
+	if len(out) == 0 {
+		return fmt.Errorf("output file is required")
+	}
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("file %s already exists", out)
+	}
+	if _, err := generatePeerKey(out); err != nil {
+		return errors.Wrap(err, "failed generating CA key")
+	}
+	fmt.Fprintf(os.Stderr, "wrote CA key %s and its public key %s.pub\n", out, out)
+	return nil
+}
+
+// peerCertIssueCmd issues the certificate of a peer ID and its public key
+// with the CA key.
+func peerCertIssueCmd(ctx *cli.Context) error {
+	for _, name := range []string{"ca-key", "peer-id", "public-key", "out"} {
+		if len(ctx.String(name)) == 0 {
+			return fmt.Errorf("--%s is required", name)
+		}
+	}
+	caKey, err := loadPeerKey(ctx.String("ca-key"))
+	if err != nil {
+		return err
+	}
+	pid, err := parsePeerID(ctx.String("peer-id"))
+	if err != nil {
+		return err
+	}
+	pub, err := loadEd25519PublicKey(ctx.String("public-key"))
+	if err != nil {
+		return err
+	}
+	b, err := encodePeerCert(newPeerCert(pid, pub, caKey, true))
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(ctx.String("out"), b, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "issued certificate of peer %s to %s\n", pid, ctx.String("out"))
+	return nil
+}
+
+func doctorCmd(ctx *cli.Context) error {
+	cfg, err := NewConfig(ctx.String("config-file"))
+	if err == nil {
+		err = selectInstance(ctx, &cfg)
+	}
+	d := Doctor{
+		Config:     cfg,
+		ConfigErr:  err,
+		PrivateKey: ctx.String("private-key"),
+		Timeout:    time.Duration(ctx.Int("timeout")) * time.Second,
+	}
+	checks := d.Run()
+	if ctx.Bool("json") {
+		if err = json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+			return err
+		}
+	} else {
+		for _, c := range checks {
+			fmt.Printf("[%s] %s: %s\n", strings.ToUpper(c.Status), c.Name, c.Detail)
+			if len(c.Hint) > 0 && c.Status != CheckPass {
+				fmt.Printf("       hint: %s\n", c.Hint)
+			}
+		}
+	}
+	if n := doctorFailures(checks); n > 0 {
+		return cli.NewExitError(fmt.Sprintf("%d critical checks failed", n), 1)
+	}
+	return nil
+}
+
+func agentCmd(ctx *cli.Context) error {
+	if ctx.Bool("default-config") {
+		return json.NewEncoder(os.Stdout).Encode(DefaultConfig())
+	}
+
+	var (
+		a   *Agent
+		cfg Config
+		err error
+	)
+
+	if cfg, err = NewConfig(ctx.String("config-file")); err != nil {
+		return err
+	}
+	if err = selectInstance(ctx, &cfg); err != nil {
+		return err
+	}
+	if filename := ctx.String("import"); len(filename) > 0 {
+		if err = importStateFile(cfg, filename); err == errStateNotEmpty {
+			log.Printf("not importing %s: %v", filename, err)
+		} else if err != nil {
+			return err
+		}
+	}
+	if a, err = NewAgent(cfg); err != nil {
+		return err
+	}
+	if ctx.Bool("once") {
+		if remaining := a.RunOnce(time.Duration(ctx.Int("max-duration")) * time.Second); remaining > 0 {
+			return cli.NewExitError(fmt.Sprintf("%d updates remain", remaining), ExitWorkRemains)
+		}
+		return nil
+	}
+	a.Wait()
+	log.Println("Agent has stopped.")
+	return nil
+}
+
+func main() {
+	app := cli.NewApp()
+
+	app.Usage = "Peer-to-peer secure update"
+	app.Version = softwareVersion
+	app.EnableBashCompletion = true
+
+	homeDir := "~/"
+	if user, err := user.Current(); err == nil {
+		homeDir = user.HomeDir
+	}
+
+	// the flags of the commands signing with a private key file or with an
+	// external signer
+	signerFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "private-key, k",
+			Value: fmt.Sprintf("%s/.ssh/id_rsa", homeDir),
+			Usage: "Private key for signing",
+		},
+		cli.GenericFlag{
+			Name:  "ssh-agent",
+			Value: &optionalValue{},
+			Usage: "Sign with the RSA key of ssh-agent, or with the key of given fingerprint (--ssh-agent=SHA256:...)",
+		},
+		cli.StringFlag{
+			Name:  "pkcs11",
+			Usage: "Sign with the key of a PKCS#11 token given as module:slot:id, using pkcs11-tool",
+		},
+		cli.IntFlag{
+			Name:  "sign-timeout",
+			Value: int(DefaultSignTimeout / time.Second),
+			Usage: "Time (in seconds) to wait for ssh-agent or the token to sign",
+		},
+	}
+
+	// the flags of the commands controlling an update
+	controlFlags := append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "uuid, u",
+			Usage: "UUID of the update",
+		},
+		cli.Uint64Flag{
+			Name:  "version",
+			Usage: "Only control this version, 0 means any version including the later ones",
+		},
+		cli.StringSliceFlag{
+			Name:  "peer",
+			Usage: "ID of a targeted agent (repeatable), all of them if absent",
+		},
+		cli.StringFlag{
+			Name:  "unix-socket, x",
+			Value: defaultUnixSocket,
+			Usage: "Agent's unix socket file",
+		},
+	}, signerFlags...)
+
+	// the flags of the commands following the progress of an update
+	watchFlags := []cli.Flag{
+		cli.IntFlag{
+			Name:  "timeout",
+			Value: 600,
+			Usage: "Time (in seconds) to follow the progress",
+		},
+		cli.IntFlag{
+			Name:  "quorum",
+			Usage: "Stop following once given number of peers have deployed the update",
+		},
+		cli.StringFlag{
+			Name:  "stun-password",
+			Value: defaultStunPassword,
+			Usage: "STUN password shared by the server and the agents",
+		},
+	}
+
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "instance",
+			Usage: "Name of the agent instance among several ones on the host, which selects its default data directory and unix socket",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "submit",
+			Usage:  "submit a new update",
 			Action: submitCmd,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "Update file or directory",
+				},
+				cli.StringFlag{
+					Name: "version, v",
+					Usage: "Update version, or 'auto' to increment the last submitted version of the UUID," +
+						" which is the default if the version registry exists (0 equals to current Unix timestamp)",
+				},
+				cli.StringFlag{
+					Name:  "version-registry",
+					Value: DefaultVersionRegistry(homeDir),
+					Usage: "File recording the last submitted version of each UUID",
+				},
+				cli.BoolFlag{
+					Name:  "allow-downgrade",
+					Usage: "Allow a version lower than the last submitted one",
+				},
+				cli.StringFlag{
+					Name:  "uuid, u",
+					Value: UUIDShell,
+					Usage: "Target resource UUID",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude, e",
+					Usage: "Glob pattern of the files excluded from a directory, repeatable",
+				},
+				cli.BoolFlag{
+					Name:  "no-default-excludes",
+					Usage: "Do not exclude " + strings.Join(DefaultExcludes, ", ") + " by default",
+				},
+				cli.StringFlag{
+					Name:  "creation-date",
+					Usage: "Creation date (RFC3339) instead of the current time",
+				},
+				cli.BoolFlag{
+					Name:  "reproducible",
+					Usage: "Omit the creation date and require the version, so that the torrent is reproducible",
+				},
+				cli.BoolFlag{
+					Name:  "verbose",
+					Usage: "Print the exclusions and the excluded files",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Usage: "output notification file, or - for STDOUT",
+				},
+				cli.StringFlag{
+					Name:  "tracker, r",
+					Value: DefaultTracker,
+					Usage: "BitTorrent tracker address",
+				},
+				cli.BoolFlag{
+					Name:  "no-tracker",
+					Usage: "Publish a trackerless update whose peers are found via the DHT and the overlay",
+				},
+				cli.BoolFlag{
+					Name: "tracker-token-placeholder",
+					Usage: "Announce the {token} placeholder instead of a tracker passkey, which the agents" +
+						" substitute with their bittorrent.tracker-token",
+				},
+				cli.StringFlag{
+					Name:  "piece-length, l",
+					Value: strconv.Itoa(DefaultPieceLength/1024) + "k",
+					Usage: "Piece length in bytes or with suffix k or m, a power of two from 16k to 16m",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+				cli.StringFlag{
+					Name:  "server, s",
+					Value: fmt.Sprintf("%s:%d", defaultServerAddr, defaultServerPort),
+					Usage: "Server address",
+				},
+				cli.BoolFlag{
+					Name:  "torrent-file, t",
+					Usage: "Generate BitTorrent file (use with -o option)",
+				},
+				cli.StringFlag{
+					Name:  "group",
+					Usage: "ID of the group whose members are deployed in order",
+				},
+				cli.IntFlag{
+					Name:  "group-sequence",
+					Usage: "Sequence number (from 1) of the update in the group",
+				},
+				cli.IntFlag{
+					Name:  "group-size",
+					Usage: "Number of updates in the group",
+				},
+				cli.IntFlag{
+					Name:  "rollout-percent",
+					Value: 100,
+					Usage: "Percentage of the agents that deploy the update, re-submit the same" +
+						" version with a higher percentage to widen the rollout",
+				},
+				cli.StringSliceFlag{
+					Name: "tag",
+					Usage: "Tag selector of the agents that deploy the update, e.g. greenhouse, rack-a|rack-b" +
+						" or !lab (repeatable, all selectors must match)",
+				},
+				cli.StringSliceFlag{
+					Name: "platform",
+					Usage: "Platform of the agents that deploy the update, e.g. linux/arm/v6, or linux/arm" +
+						" for all its variants (repeatable, all platforms by default)",
+				},
+				cli.StringSliceFlag{
+					Name: "fallback-url",
+					Usage: "HTTPS URL of the payload, which the agents download from when they have no" +
+						" torrent peer (repeatable, tried in order, a URL ending with / is the directory of the payload)",
+				},
+				cli.StringFlag{
+					Name:  "priority",
+					Value: PriorityNormal,
+					Usage: "Priority of the update: low, normal or critical, the agents pause the downloads" +
+						" of lower priority until it is downloaded",
+				},
+				cli.StringFlag{
+					Name:  "title",
+					Usage: fmt.Sprintf("Human-readable title of the update (at most %d bytes)", notificationMaxTitle),
+				},
+				cli.StringFlag{
+					Name:  "notes",
+					Usage: fmt.Sprintf("Release notes of the update (at most %d bytes)", notificationMaxNotes),
+				},
+				cli.StringFlag{
+					Name:  "notes-file",
+					Usage: "File of the release notes of the update, instead of --notes",
+				},
+				cli.IntFlag{
+					Name: "script-timeout",
+					Usage: "Execution timeout in seconds of each script of the update, the default" +
+						" timeout of the agents (600 seconds unless configured) if it is not set",
+				},
+				cli.StringFlag{
+					Name: "not-before",
+					Usage: "Time (RFC3339) before which the agents must not deploy the update, re-submit" +
+						" the same version with another time to reschedule",
+				},
+				cli.StringFlag{
+					Name: "delta-from",
+					Usage: "Previous version of the payload, a single file, from which the agents having it" +
+						" rebuild the payload with a patch instead of downloading it",
+				},
+				cli.StringFlag{
+					Name:  "delta-output",
+					Usage: "File of the patch of --delta-from, <payload>.patch by default",
+				},
+				cli.StringSliceFlag{
+					Name:  "canary-peer",
+					Usage: "ID of a canary agent that deploys the update before the others (repeatable)",
+				},
+				cli.IntFlag{
+					Name:  "canary-min-success",
+					Value: 1,
+					Usage: "Number of successful canaries required before the others deploy the update",
+				},
+				cli.BoolFlag{
+					Name: "canary-override",
+					Usage: "Release the update to all agents regardless of the canaries, re-submit" +
+						" the same version with this flag to override a blocked canary deployment",
+				},
+				cli.StringFlag{
+					Name:  "trace-id",
+					Usage: "Trace ID written in the logs of the update, random by default (none with --reproducible)",
+				},
+				cli.BoolFlag{
+					Name:  "follow",
+					Usage: "Follow the progress of the update reported by the agents to the server",
+				},
+				cli.BoolFlag{
+					Name: "seed",
+					Usage: "Seed the payload from this machine after submitting it, until --seed-for," +
+						" --seed-ratio or an interrupt",
+				},
+				cli.DurationFlag{
+					Name:  "seed-for",
+					Usage: "Duration of --seed, e.g. 2h, until interrupted if 0",
+				},
+				cli.Float64Flag{
+					Name:  "seed-ratio",
+					Usage: "Ratio of the uploaded bytes to the payload size which ends --seed, none if 0",
+				},
+				cli.StringFlag{
+					Name:  "config-file, c",
+					Usage: "Agent config file whose bittorrent port and limits apply to --seed",
+				},
+			}, append(signerFlags, watchFlags...)...),
+		},
+		{
+			Name:      "watch",
+			Usage:     "follow the progress of an update reported by the agents to the server",
+			ArgsUsage: "<uuid>",
+			Action:    watchCmd,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "server, s",
+					Value: fmt.Sprintf("%s:%d", defaultServerAddr, defaultServerPort),
+					Usage: "Server address",
+				},
+				cli.Uint64Flag{
+					Name:  "version, v",
+					Usage: "Version of the update, the latest one reported if 0",
+				},
+			}, watchFlags...),
+		},
+		{
+			Name:   "agent",
+			Usage:  "agent mode",
+			Action: agentCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config-file, c",
+					Value: "config.json",
+					Usage: "Path of config file",
+				},
+				cli.BoolFlag{
+					Name:  "default-config, d",
+					Usage: "Print default config to STDOUT",
+				},
+				cli.BoolFlag{
+					Name: "once",
+					Usage: "Pull the pending updates, download and deploy them, then exit with code 75" +
+						" if updates remain, e.g. when run by cron",
+				},
+				cli.IntFlag{
+					Name:  "max-duration",
+					Value: DefaultOnceDuration,
+					Usage: "Time budget in seconds of --once",
+				},
+				cli.StringFlag{
+					Name:  "import",
+					Usage: "State archive created by the export command, imported on first start",
+				},
+			},
+		},
+		{
+			Name:   "combined",
+			Usage:  "server and agent modes in a single process, the agent using the embedded-server section of its config",
+			Action: combinedCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config-file, c",
+					Value: "config.json",
+					Usage: "Path of config file",
+				},
+			},
+		},
+		{
+			Name:   "export",
+			Usage:  "export the state of the agent, e.g. to replace its node, excluding the payloads",
+			Action: exportCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "config-file, c",
+					Value: "config.json",
+					Usage: "Path of config file",
+				},
+				cli.StringFlag{
+					Name:  "out, o",
+					Usage: "Output file, e.g. state.tar.gz",
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "show the configurations of the agent",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "print the precedence of the config sources and the effective configurations",
+					Action: configShowCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "config-file, c",
+							Value: "config.json",
+							Usage: "Path of config file",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "peer-cert",
+			Usage: "issue the certificates binding the peer IDs to the keys of the agents",
+			Subcommands: []cli.Command{
+				{
+					Name:   "new-ca",
+					Usage:  "generate the CA key and its public key (.pub) given to the server",
+					Action: peerCertNewCACmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "out, o",
+							Value: "peer-ca.key",
+							Usage: "Output file of the CA key",
+						},
+					},
+				},
+				{
+					Name:   "issue",
+					Usage:  "issue the certificate of a peer, set as cert-file of its peer-identity config",
+					Action: peerCertIssueCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "ca-key",
+							Value: "peer-ca.key",
+							Usage: "CA key file",
+						},
+						cli.StringFlag{
+							Name:  "peer-id",
+							Usage: "Peer ID in hexadecimal, e.g. as logged by the agent",
+						},
+						cli.StringFlag{
+							Name:  "public-key",
+							Usage: "Public key file of the peer, e.g. peer.key.pub in its data directory",
+						},
+						cli.StringFlag{
+							Name:  "out, o",
+							Usage: "Output file of the certificate",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:   "doctor",
+			Usage:  "diagnose the configuration and the connectivity of the agent",
+			Action: doctorCmd,
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "file, f",
-					Usage: "Update file or directory",
+					Name:  "config-file, c",
+					Value: "config.json",
+					Usage: "Path of config file",
+				},
+				cli.StringFlag{
+					Name:  "private-key",
+					Usage: "Private key file that must match the public key of the config",
+				},
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: 10,
+					Usage: "Timeout in seconds of each network check",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the checks as JSON",
+				},
+			},
+		},
+		{
+			Name:   "updates",
+			Usage:  "list the updates of the agent, e.g. the failed ones with --state failed",
+			Action: updatesCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "uuid",
+					Usage: "Comma-separated UUIDs of the updates",
+				},
+				cli.StringFlag{
+					Name:  "state",
+					Usage: "Comma-separated states of the updates, e.g. failed,blocked or seeding",
+				},
+				cli.StringFlag{
+					Name:  "deployed-before",
+					Usage: "Updates deployed before given time (RFC3339)",
+				},
+				cli.StringFlag{
+					Name:  "deployed-after",
+					Usage: "Updates deployed after given time (RFC3339)",
+				},
+				cli.IntFlag{
+					Name:  "min-deploy-fails",
+					Usage: "Updates that failed to deploy at least given times",
+				},
+				cli.StringFlag{
+					Name:  "sort",
+					Usage: "Sort key (uuid, deployed, deploy-fails or version), prefixed by - for descending order",
 				},
+				cli.IntFlag{
+					Name:  "limit",
+					Usage: "Maximum number of updates",
+				},
+				cli.StringFlag{
+					Name:  "after",
+					Usage: "Cursor of the page (the 'next' of the previous page)",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:   "events",
+			Usage:  "print the recent events of the agent, e.g. state changes and overlay errors",
+			Action: eventsCmd,
+			Flags: []cli.Flag{
 				cli.Uint64Flag{
-					Name:  "version, v",
-					Usage: "Update version, 0 equals to current Unix timestamp",
+					Name:  "since",
+					Usage: "Print the events after given sequence number",
+				},
+				cli.BoolFlag{
+					Name:  "follow, f",
+					Usage: "Keep printing the new events",
+				},
+				cli.IntFlag{
+					Name:  "interval",
+					Value: 1,
+					Usage: "Polling interval in seconds with --follow",
 				},
 				cli.StringFlag{
-					Name:  "uuid, u",
-					Value: UUIDShell,
-					Usage: "Target resource UUID",
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:   "blacklist",
+			Usage:  "list or clear the sources blacklisted by the agent",
+			Action: blacklistCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "clear",
+					Usage: "Remove given source, e.g. peer:<id> or addr:<ip>, from the blacklist",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:   "validation-failures",
+			Usage:  "list the sources of the most invalid messages received by the agent or the server",
+			Action: validationFailuresCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "server, s",
+					Usage: "Server address, e.g. localhost:3478, instead of the agent",
+				},
+				cli.IntFlag{
+					Name:  "top",
+					Value: 10,
+					Usage: "Maximum number of sources, all of them if zero",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the sources as JSON",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:      "approve",
+			Usage:     "approve the deployment of an update awaiting approval",
+			ArgsUsage: "<uuid> [version]",
+			Action:    decisionCmd("approve"),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:      "deploy",
+			Usage:     "deploy an update staged by an agent in stage-only mode",
+			ArgsUsage: "<uuid> [version]",
+			Action:    decisionCmd("deploy"),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:      "reject",
+			Usage:     "permanently reject an update, which is deleted and never accepted again",
+			ArgsUsage: "<uuid>",
+			Action:    decisionCmd("reject"),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:      "maintenance",
+			Usage:     "show, set (on) or lift (off) the maintenance mode that pauses deployments",
+			ArgsUsage: "[on|off]",
+			Action:    maintenanceCmd,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "fleet",
+					Usage: "Broadcast a signed maintenance notice to all agents",
 				},
 				cli.StringFlag{
 					Name:  "private-key, k",
 					Value: fmt.Sprintf("%s/.ssh/id_rsa", homeDir),
-					Usage: "Private key for signing",
+					Usage: "The private key file for signing the fleet maintenance notice",
 				},
 				cli.StringFlag{
-					Name:  "output, o",
-					Usage: "output notification file, or - for STDOUT",
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
 				},
+			},
+		},
+		{
+			Name:   "reannounce",
+			Usage:  "re-announce an update, or all of them, to find new peers immediately",
+			Action: reannounceCmd,
+			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "tracker, r",
-					Value: DefaultTracker,
-					Usage: "BitTorrent tracker address",
+					Name:  "uuid",
+					Usage: "UUID of the update, all updates if empty",
 				},
-				cli.Int64Flag{
-					Name:  "piece-length, l",
-					Value: DefaultPieceLength,
-					Usage: "Piece length",
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the results in JSON",
 				},
 				cli.StringFlag{
 					Name:  "unix-socket, x",
 					Value: defaultUnixSocket,
 					Usage: "Agent's unix socket file",
 				},
+			},
+		},
+		{
+			Name:   "gc",
+			Usage:  "compact the metadata of the agent, e.g. of the tombstoned updates and the audit log",
+			Action: gcCmd,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only show what would be removed",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result in JSON",
+				},
 				cli.StringFlag{
-					Name:  "server, s",
-					Value: fmt.Sprintf("%s:%d", defaultServerAddr, defaultServerPort),
-					Usage: "Server address",
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:   "fetch",
+			Usage:  "copy a file delivered by a complete or deployed update from the agent",
+			Action: fetchCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "uuid",
+					Usage: "UUID of the update",
+				},
+				cli.StringFlag{
+					Name:  "namespace",
+					Usage: "Namespace of the update, the default one if empty",
+				},
+				cli.StringFlag{
+					Name:  "path",
+					Usage: "Path of the file in the payload, as listed by GET /update/<uuid>/files",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Value: "-",
+					Usage: "Destination file, or - for STDOUT",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			},
+		},
+		{
+			Name:   "import",
+			Usage:  "import a local copy of the payload of an update into the agent rather than downloading it",
+			Action: importCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "uuid",
+					Usage: "UUID of the update",
+				},
+				cli.StringFlag{
+					Name:  "namespace",
+					Usage: "Namespace of the update, the default one if empty",
+				},
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "Local file, or directory of a multi-file payload, which is never modified",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
 				},
+			},
+		},
+		{
+			Name:   "send",
+			Usage:  "send a signed maintenance notice or a ping to the peers of the agent's session table",
+			Action: sendCmd,
+			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:  "torrent-file, t",
-					Usage: "Generate BitTorrent file (use with -o option)",
+					Name:  "broadcast",
+					Usage: "Send to every peer of the session table",
+				},
+				cli.StringSliceFlag{
+					Name:  "peer",
+					Usage: "ID of a peer to send to, e.g. a failed one of a broadcast (repeatable)",
+				},
+				cli.StringFlag{
+					Name:  "maintenance",
+					Usage: "Send a maintenance notice, on or off, rather than a ping",
+				},
+				cli.StringFlag{
+					Name:  "private-key, k",
+					Value: fmt.Sprintf("%s/.ssh/id_rsa", homeDir),
+					Usage: "The private key file for signing the maintenance notice",
+				},
+				cli.IntFlag{
+					Name:  "concurrency",
+					Value: DefaultSendConcurrency,
+					Usage: "Number of peers sent to at the same time",
+				},
+				cli.IntFlag{
+					Name:  "timeout",
+					Value: DefaultSendTimeout,
+					Usage: "Deadline in seconds of the whole send",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result as JSON",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
 				},
 			},
 		},
 		{
-			Name:   "agent",
-			Usage:  "agent mode",
-			Action: agentCmd,
+			Name:      "uninstall",
+			Usage:     "remove an update from the fleet and run its cleanup script",
+			ArgsUsage: "<uuid>",
+			Action:    uninstallCmd,
+			Flags: append([]cli.Flag{
+				cli.Uint64Flag{
+					Name:  "max-version",
+					Usage: "Remove the versions up to this one, 0 means any version",
+				},
+				cli.StringFlag{
+					Name:  "cleanup",
+					Usage: "Cleanup script in the payload directory, executed where the update has been deployed",
+				},
+				cli.StringFlag{
+					Name:  "unix-socket, x",
+					Value: defaultUnixSocket,
+					Usage: "Agent's unix socket file",
+				},
+			}, signerFlags...),
+		},
+		{
+			Name:  "control",
+			Usage: "stop or start an update fleet-wide, without removing it",
+			Subcommands: []cli.Command{
+				{
+					Name:   ControlStop,
+					Usage:  "sign and broadcast a notice stopping the download, the seeding and the deployment of an update",
+					Action: controlCmd(ControlStop),
+					Flags:  controlFlags,
+				},
+				{
+					Name:   ControlStart,
+					Usage:  "sign and broadcast a notice starting an update stopped remotely",
+					Action: controlCmd(ControlStart),
+					Flags: append([]cli.Flag{
+						cli.BoolFlag{
+							Name:  "local",
+							Usage: "Only start the update of the local agent, which must allow it (control.allow-local-start) if the update is stopped remotely",
+						},
+					}, controlFlags...),
+				},
+			},
+		},
+		{
+			Name:      "inspect",
+			Usage:     "print the content of a notification file",
+			ArgsUsage: "<notification file>",
+			Action:    inspectCmd,
+		},
+		{
+			Name:      "verify",
+			Usage:     "print the digest of an update, and verify it against a notification",
+			ArgsUsage: "<update file or directory>",
+			Action:    verifyCmd,
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "config-file, c",
-					Value: "config.json",
-					Usage: "Path of config file",
+					Name:  "notification, n",
+					Usage: "Notification file (torrent file or submit output) to verify against",
+				},
+				cli.StringSliceFlag{
+					Name:  "exclude, e",
+					Usage: "Glob pattern of the files excluded from a directory, repeatable",
 				},
 				cli.BoolFlag{
-					Name:  "default-config, d",
-					Usage: "Print default config to STDOUT",
+					Name:  "no-default-excludes",
+					Usage: "Do not exclude " + strings.Join(DefaultExcludes, ", ") + " by default",
+				},
+				cli.StringFlag{
+					Name:  "public-key, k",
+					Value: fmt.Sprintf("%s/.ssh/id_rsa.pub", homeDir),
+					Usage: "Public key for verification",
+				},
+			},
+		},
+		{
+			Name:   "fleet-status",
+			Usage:  "show the fleet-wide deployment statistics aggregated by the server",
+			Action: fleetStatusCmd,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "server, s",
+					Value: fmt.Sprintf("%s:%d", defaultServerAddr, defaultServerPort),
+					Usage: "Server address",
+				},
+				cli.BoolFlag{
+					Name:  "summary",
+					Usage: "Render the statistics of the current window as a table",
+				},
+				cli.StringFlag{
+					Name:  "group-by",
+					Usage: "Group the statistics by 'tag' of the agents",
 				},
 			},
 		},
@@ -301,6 +2367,16 @@ func main() {
 					Value: 10,
 					Usage: "Snapshot database interval (in second)",
 				},
+				cli.IntFlag{
+					Name:  "session-page-size",
+					Value: defaultSessionPageSize,
+					Usage: "Maximum number of session table entries in a binding response (0 to fill it)",
+				},
+				cli.IntFlag{
+					Name:  "report-window",
+					Value: fleetDefaultWindow,
+					Usage: "Window (in seconds) of the fleet-wide deployment statistics",
+				},
 				cli.StringFlag{
 					Name:  "public-key, k",
 					Value: fmt.Sprintf("%s/.ssh/id_rsa.pub", homeDir),
@@ -315,6 +2391,20 @@ func main() {
 					Value: "/var/log/p2pupdate-server.log",
 					Usage: "Log file",
 				},
+				cli.StringFlag{
+					Name:  "log-output",
+					Usage: "Log output: stderr, file:<path>, syslog or syslog:<udp|tcp>://<host:port> (overrides log-file)",
+				},
+				cli.StringFlag{
+					Name:  "log-facility",
+					Value: "daemon",
+					Usage: "Syslog facility",
+				},
+				cli.StringFlag{
+					Name:  "log-tag",
+					Value: defaultLogTag,
+					Usage: "Syslog tag",
+				},
 			},
 		},
 	}
@@ -0,0 +1,275 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zeebo/bencode"
+)
+
+// Sources of the maintenance mode
+const (
+	MaintenanceConfig    = "config"
+	MaintenanceLocal     = "local"
+	MaintenanceBroadcast = "broadcast"
+)
+
+var errMaintenanceNoticeIsOld = errors.New("maintenance notice is not newer than the current one")
+
+// MaintenanceNotice is a signed operator message that sets or lifts the
+// maintenance mode of the fleet. It is broadcast over the overlay, and a
+// notice is applied only if it is newer than the last applied one, hence an
+// old notice cannot be replayed.
+type MaintenanceNotice struct {
+	Active     bool                 `bencode:"active" json:"active"`
+	Timestamp  int64                `bencode:"timestamp" json:"timestamp"` // Unix time in nanoseconds
+	By         string               `bencode:"by,omitempty" json:"by,omitempty"`
+	Signatures map[string]Signature `bencode:"signatures,omitempty" json:"signatures,omitempty"`
+}
+
+// OperatorMessage is an overlay message of an operator, which is
+// distinguished from a notification by not having a UUID.
+type OperatorMessage struct {
+	Maintenance *MaintenanceNotice `bencode:"maintenance,omitempty"`
+	Uninstall   *UninstallNotice   `bencode:"uninstall,omitempty"`
+	Control     *ControlNotice     `bencode:"control,omitempty"`
+}
+
+// Sign signs the notice using given private key.
+func (mn *MaintenanceNotice) Sign(key *rsa.PrivateKey) error {
+	mn.Signatures = nil
+	data, err := json.Marshal(mn)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(data)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	mn.Signatures = map[string]Signature{signatureName: {Signature: sig}}
+	return nil
+}
+
+// Verify verifies the notice's signature using given public key.
+func (mn *MaintenanceNotice) Verify(pub *rsa.PublicKey) error {
+	s, ok := mn.Signatures[signatureName]
+	if !ok {
+		return fmt.Errorf("signature is not available")
+	}
+	sigs := mn.Signatures
+	mn.Signatures = nil
+	defer func() { mn.Signatures = sigs }()
+	data, err := json.Marshal(mn)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], s.Signature)
+}
+
+// MaintenanceState is the maintenance mode set by a source.
+type MaintenanceState struct {
+	Active bool      `json:"active"`
+	By     string    `json:"by,omitempty"`
+	Since  time.Time `json:"since,omitempty"`
+
+	// Timestamp is the timestamp of the last applied notice.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// MaintenanceStatus is the structured status of the maintenance mode. The
+// agent is in maintenance if any source has set it.
+type MaintenanceStatus struct {
+	Active    bool             `json:"active"`
+	Config    bool             `json:"config"`
+	Local     MaintenanceState `json:"local"`
+	Broadcast MaintenanceState `json:"broadcast"`
+}
+
+// Maintenance holds the maintenance mode of the agent, which pauses the
+// deployments while the updates are still downloaded and seeded.
+type Maintenance struct {
+	sync.RWMutex
+	status   MaintenanceStatus
+	filename string
+	lifted   chan struct{} // closed when the maintenance mode is lifted
+}
+
+// NewMaintenance returns a Maintenance whose local and broadcast states are
+// persisted in given file.
+func NewMaintenance(config bool, filename string) (*Maintenance, error) {
+	m := &Maintenance{
+		filename: filename,
+		lifted:   make(chan struct{}),
+	}
+	f, err := os.Open(filename)
+	if err == nil {
+		defer f.Close()
+		err = json.NewDecoder(f).Decode(&m.status)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	m.status.Config = config
+	m.status.Active = m.active()
+	return m, err
+}
+
+// active returns true if any source has set the maintenance mode. The caller
+// must hold the lock.
+func (m *Maintenance) active() bool {
+	return m.status.Config || m.status.Local.Active || m.status.Broadcast.Active
+}
+
+// Status returns the maintenance status.
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.RLock()
+	defer m.RUnlock()
+	return m.status
+}
+
+// Reason returns why the deployments are paused, or an empty string if the
+// agent is not in maintenance.
+func (m *Maintenance) Reason() string {
+	m.RLock()
+	defer m.RUnlock()
+	switch {
+	case m.status.Local.Active:
+		return fmt.Sprintf("maintenance set by %s at %s", m.status.Local.By,
+			m.status.Local.Since.Format(time.RFC3339))
+	case m.status.Broadcast.Active:
+		return fmt.Sprintf("maintenance set by %s (broadcast) at %s", m.status.Broadcast.By,
+			m.status.Broadcast.Since.Format(time.RFC3339))
+	case m.status.Config:
+		return "maintenance set by config"
+	}
+	return ""
+}
+
+// Lifted returns a channel that is closed when the maintenance mode is
+// lifted.
+func (m *Maintenance) Lifted() <-chan struct{} {
+	m.RLock()
+	defer m.RUnlock()
+	return m.lifted
+}
+
+// SetLocal sets or lifts the maintenance mode of the local operator.
+func (m *Maintenance) SetLocal(active bool, by string) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.set(&m.status.Local, MaintenanceState{Active: active, By: by, Since: time.Now()})
+}
+
+// Apply applies given verified notice of the operator broadcast. It returns
+// errMaintenanceNoticeIsOld if the notice is not newer than the last one.
+func (m *Maintenance) Apply(mn *MaintenanceNotice) error {
+	m.Lock()
+	defer m.Unlock()
+	if mn.Timestamp <= m.status.Broadcast.Timestamp {
+		return errMaintenanceNoticeIsOld
+	}
+	return m.set(&m.status.Broadcast, MaintenanceState{
+		Active:    mn.Active,
+		By:        mn.By,
+		Since:     time.Unix(0, mn.Timestamp),
+		Timestamp: mn.Timestamp,
+	})
+}
+
+// set sets given state of a source and persists the status. The monitors of
+// the updates are woken up if the maintenance mode is lifted. The caller
+// must hold the lock.
+func (m *Maintenance) set(state *MaintenanceState, s MaintenanceState) error {
+	wasActive := m.active()
+	*state = s
+	m.status.Active = m.active()
+	if wasActive && !m.status.Active {
+		close(m.lifted)
+		m.lifted = make(chan struct{})
+	}
+	log.Printf("maintenance:%v (active:%v by:%s)", m.status.Active, s.Active, s.By)
+
+	f, err := os.OpenFile(m.filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(&m.status)
+}
+
+// maintenanceFilename returns the file of the persisted maintenance mode.
+func (a *Agent) maintenanceFilename() string {
+	return filepath.Join(a.Config.DataDir, "maintenance.json")
+}
+
+// readOperatorMessage verifies and applies an operator message received from
+// the overlay with given TTL, then forwards it to the other peers.
+func (a *Agent) readOperatorMessage(data []byte, ttl TTL) error {
+	var msg OperatorMessage
+	if err := bencode.DecodeBytes(data, &msg); err != nil {
+		return err
+	}
+	switch {
+	case msg.Maintenance != nil:
+		if err := msg.Maintenance.Verify(a.PublicKey); err != nil {
+			return errUpdateVerificationFailed
+		}
+		if err := a.maintenance.Apply(msg.Maintenance); err == errMaintenanceNoticeIsOld {
+			return nil
+		} else if err != nil {
+			log.Printf("WARNING: failed saving maintenance mode - %v", err)
+		}
+	case msg.Uninstall != nil:
+		if msg.Uninstall.Validate() != nil || msg.Uninstall.Verify(a.PublicKey) != nil {
+			return errUpdateVerificationFailed
+		}
+		a.uninstall(msg.Uninstall)
+	case msg.Control != nil:
+		if msg.Control.Validate() != nil || msg.Control.Verify(a.PublicKey) != nil {
+			return errUpdateVerificationFailed
+		}
+		a.control(msg.Control)
+	default:
+		return errUpdateVerificationFailed
+	}
+	_, err := a.Overlay.Forward(data, ttl)
+	if err == errTTLExpired {
+		return nil
+	}
+	return err
+}
+
+// broadcastMaintenance applies given signed notice and broadcasts it over the
+// overlay.
+func (a *Agent) broadcastMaintenance(mn *MaintenanceNotice) error {
+	if err := mn.Verify(a.PublicKey); err != nil {
+		return errUpdateVerificationFailed
+	}
+	if err := a.maintenance.Apply(mn); err != nil {
+		return err
+	}
+	if a.Overlay == nil {
+		return errConnNotOpened
+	}
+	b, err := bencode.EncodeBytes(OperatorMessage{Maintenance: mn})
+	if err != nil {
+		return err
+	}
+	_, err = a.Overlay.Write(b)
+	return err
+}
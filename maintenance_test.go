@@ -0,0 +1,85 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceNotice(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mn := MaintenanceNotice{Active: true, Timestamp: time.Now().UnixNano(), By: "operator"}
+	if err = mn.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err = mn.Verify(&key.PublicKey); err != nil {
+		t.Errorf("valid notice: %v", err)
+	}
+	mn.Active = false
+	if err = mn.Verify(&key.PublicKey); err == nil {
+		t.Error("modified notice must fail the verification")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "maintenance.json")
+
+	m, err := NewMaintenance(false, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Status().Active || m.Reason() != "" {
+		t.Fatal("maintenance is not active by default")
+	}
+	now := time.Now().UnixNano()
+	if err = m.Apply(&MaintenanceNotice{Active: true, Timestamp: now, By: "operator"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Apply(&MaintenanceNotice{Active: false, Timestamp: now}); err != errMaintenanceNoticeIsOld {
+		t.Errorf("replayed notice must be ignored: %v", err)
+	}
+	m.SetLocal(true, approvalLocal)
+
+	// the states survive a restart
+	if m, err = NewMaintenance(false, filename); err != nil {
+		t.Fatal(err)
+	}
+	s := m.Status()
+	if !s.Active || !s.Local.Active || !s.Broadcast.Active || s.Broadcast.By != "operator" {
+		t.Errorf("wrong status %+v", s)
+	}
+
+	// lifting all sources wakes up the monitors
+	lifted := m.Lifted()
+	m.SetLocal(false, approvalLocal)
+	select {
+	case <-lifted:
+		t.Fatal("maintenance is still set by the broadcast")
+	default:
+	}
+	m.Apply(&MaintenanceNotice{Active: false, Timestamp: now + 1})
+	select {
+	case <-lifted:
+	default:
+		t.Error("maintenance is lifted")
+	}
+	if m.Status().Active {
+		t.Error("maintenance is lifted")
+	}
+}
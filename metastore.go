@@ -0,0 +1,529 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// The backends of the metadata store.
+const (
+	MetadataStoreFile = "file" // a file per update, the default
+	MetadataStoreBolt = "bolt" // a single BoltDB file
+)
+
+// The buckets of the metadata store. The metadata of the updates of a
+// namespace are in their own bucket (see updatesBucket).
+const (
+	MetadataUpdates    = "updates"    // by <uuid>-v<version>
+	MetadataTombstones = "tombstones" // the latest rejected version by update key
+	MetadataTombstoned = "tombstoned" // when the latest version was rejected, by update key
+)
+
+const (
+	metadataJournalName = "metadata.journal"
+	metadataBoltName    = "metadata.db"
+
+	// metadataMigrated is the key of the marker of the migration of the
+	// file layout into the BoltDB store, in bucket metadataMeta
+	metadataMeta     = "meta"
+	metadataMigrated = "migrated"
+)
+
+var errMetadataNotFound = errors.New("metadata not found")
+
+// MetadataOp is an operation of a batch of the metadata store, which puts
+// Value under Key in Bucket, or deletes Key if Value is nil.
+type MetadataOp struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Value  []byte `json:"value"`
+}
+
+// MetadataStore stores the metadata of the agent, e.g. of its updates and
+// their tombstones, as values by key in buckets. Its crash-safety semantics
+// are the same for every backend:
+//
+//   - Put and Delete of a key are atomic, a reader after a crash sees either
+//     the previous or the new value, never a torn one;
+//   - Batch applies its operations atomically, a reader after a crash, i.e.
+//     once the store is opened again, sees either none or all of them.
+//
+// The deployment outcome of an update, i.e. its state, failures and pending
+// report, is a single value, and the tombstone of a rejected or uninstalled
+// update is a batch with the deletion of its metadata. A MetadataStore is
+// safe for concurrent use.
+type MetadataStore interface {
+	// Get returns the value of given key, or errMetadataNotFound.
+	Get(bucket, key string) ([]byte, error)
+	Put(bucket, key string, value []byte) error
+	// Delete deletes given key, which may not exist.
+	Delete(bucket, key string) error
+	// List returns the keys of given bucket in order.
+	List(bucket string) ([]string, error)
+	Batch(ops []MetadataOp) error
+	Close() error
+}
+
+// updatesBucket returns the bucket of the update metadata of given
+// namespace.
+func updatesBucket(namespace string) string {
+	if namespace == "" {
+		return MetadataUpdates
+	}
+	return MetadataUpdates + "/" + namespace
+}
+
+// validateMetadataStore returns an error if given backend is unknown.
+func validateMetadataStore(backend string) error {
+	switch backend {
+	case "", MetadataStoreFile, MetadataStoreBolt:
+		return nil
+	}
+	return fmt.Errorf("unknown metadata store '%s', expected %s or %s", backend,
+		MetadataStoreFile, MetadataStoreBolt)
+}
+
+// openMetadataStore opens the metadata store of given configurations, whose
+// update buckets are in given directories with the file layout. The file
+// layout is migrated into the BoltDB store the first time it is opened, and
+// it is not used anymore afterwards.
+func openMetadataStore(cfg *Config, dirs map[string]string) (MetadataStore, error) {
+	files, err := newFileMetadataStore(cfg.DataDir, dirs)
+	if err != nil || cfg.MetadataStore != MetadataStoreBolt {
+		return files, err
+	}
+	db, err := newBoltMetadataStore(filepath.Join(cfg.DataDir, metadataBoltName))
+	if err != nil {
+		return nil, err
+	}
+	if err = db.migrate(files, dirs); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "failed migrating metadata files")
+	}
+	return db, nil
+}
+
+// viewMetadataStore opens the metadata store of given configurations to
+// read it while the agent may be running. The journal of the file layout is
+// not replayed since the agent may be writing it, and the BoltDB store cannot
+// be opened until the agent stops.
+func viewMetadataStore(cfg *Config) (MetadataStore, error) {
+	if cfg.MetadataStore == MetadataStoreBolt {
+		return openMetadataStore(cfg, cfg.metadataDirs())
+	}
+	return &fileMetadataStore{dataDir: cfg.DataDir, dirs: cfg.metadataDirs()}, nil
+}
+
+// metadataDirs returns the directories of the update buckets of given
+// configurations with the file layout, which are the ones of the namespaces
+// of an agent (see initNamespaces).
+func (cfg *Config) metadataDirs() map[string]string {
+	dirs := make(map[string]string)
+	dirs[MetadataUpdates] = filepath.Join(cfg.DataDir, "notification")
+	for _, ns := range cfg.Namespaces {
+		dirs[updatesBucket(ns.Name)] = filepath.Join(cfg.DataDir, "namespace", ns.Name, "notification")
+	}
+	return dirs
+}
+
+// metadataDirs returns the directories of the update buckets of the agent
+// with the file layout.
+func (a *Agent) metadataDirs() map[string]string {
+	dirs := make(map[string]string)
+	dirs[MetadataUpdates] = a.defaultNamespace().metadataDir
+	for _, ns := range a.namespaces {
+		dirs[updatesBucket(ns.Name)] = ns.metadataDir
+	}
+	return dirs
+}
+
+// metadata returns the metadata store of the agent, which has the file
+// layout of its directories unless a store has been opened on start.
+func (a *Agent) metadata() MetadataStore {
+	a.storeOnce.Do(func() {
+		if a.store == nil {
+			a.store = &fileMetadataStore{dataDir: a.Config.DataDir, dirs: a.metadataDirs()}
+		}
+	})
+	return a.store
+}
+
+// fileMetadataStore is the file layout of the metadata: a file per key in
+// the directory of an update bucket, and a JSON object of the tombstones.
+// A value is written into a temporary file which is synced and renamed. A
+// batch is written into a journal first, which is replayed when the store is
+// opened if the agent has crashed while applying it.
+type fileMetadataStore struct {
+	journal sync.Mutex // of the batches
+	objects sync.Mutex // of the JSON object files
+	dataDir string
+	dirs    map[string]string // by update bucket
+}
+
+// newFileMetadataStore returns the file store of given data directory and
+// directories of the update buckets, and replays its journal if any.
+func newFileMetadataStore(dataDir string, dirs map[string]string) (*fileMetadataStore, error) {
+	s := &fileMetadataStore{dataDir: dataDir, dirs: dirs}
+	b, err := ioutil.ReadFile(s.journalFilename())
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ops []MetadataOp
+	if err = json.Unmarshal(b, &ops); err != nil {
+		// the journal is renamed once complete, hence it is not torn
+		return nil, errors.Wrap(err, "invalid metadata journal")
+	}
+	log.Printf("replaying %d operations of the metadata journal", len(ops))
+	if err = s.apply(ops); err != nil {
+		return nil, errors.Wrap(err, "failed replaying metadata journal")
+	}
+	return s, os.Remove(s.journalFilename())
+}
+
+func (s *fileMetadataStore) journalFilename() string {
+	return filepath.Join(s.dataDir, metadataJournalName)
+}
+
+func (s *fileMetadataStore) tombstonesFilename() string {
+	return filepath.Join(s.dataDir, "tombstones.json")
+}
+
+// objectFilename returns the JSON object file of given bucket, or an empty
+// string if its values are files.
+func (s *fileMetadataStore) objectFilename(bucket string) string {
+	switch bucket {
+	case MetadataTombstones:
+		return s.tombstonesFilename()
+	case MetadataTombstoned:
+		return filepath.Join(s.dataDir, "tombstoned.json")
+	}
+	return ""
+}
+
+// path returns the file of given key, or the JSON object file of the bucket
+// if object is true.
+func (s *fileMetadataStore) path(bucket, key string) (filename string, object bool, err error) {
+	if filename = s.objectFilename(bucket); len(filename) > 0 {
+		return filename, true, nil
+	}
+	dir, ok := s.dirs[bucket]
+	if !ok {
+		return "", false, fmt.Errorf("unknown metadata bucket '%s'", bucket)
+	}
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", false, fmt.Errorf("invalid metadata key '%s'", key)
+	}
+	return filepath.Join(dir, key), false, nil
+}
+
+func (s *fileMetadataStore) Get(bucket, key string) ([]byte, error) {
+	filename, object, err := s.path(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if object {
+		s.objects.Lock()
+		defer s.objects.Unlock()
+		values, err := readMetadataObject(filename)
+		if err != nil {
+			return nil, err
+		}
+		if v, ok := values[key]; ok {
+			return v, nil
+		}
+		return nil, errMetadataNotFound
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, errMetadataNotFound
+	}
+	return b, err
+}
+
+func (s *fileMetadataStore) Put(bucket, key string, value []byte) error {
+	return s.apply([]MetadataOp{{Bucket: bucket, Key: key, Value: value}})
+}
+
+func (s *fileMetadataStore) Delete(bucket, key string) error {
+	return s.apply([]MetadataOp{{Bucket: bucket, Key: key}})
+}
+
+func (s *fileMetadataStore) List(bucket string) ([]string, error) {
+	if filename := s.objectFilename(bucket); len(filename) > 0 {
+		s.objects.Lock()
+		values, err := readMetadataObject(filename)
+		s.objects.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+	dir, ok := s.dirs[bucket]
+	if !ok {
+		return nil, fmt.Errorf("unknown metadata bucket '%s'", bucket)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		// the temporary file of an interrupted write is not a value
+		if !f.IsDir() && !strings.HasSuffix(f.Name(), ".tmp") {
+			keys = append(keys, f.Name())
+		}
+	}
+	return keys, nil
+}
+
+func (s *fileMetadataStore) Batch(ops []MetadataOp) error {
+	for _, op := range ops {
+		if _, _, err := s.path(op.Bucket, op.Key); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	s.journal.Lock()
+	defer s.journal.Unlock()
+	if err = writeFileSync(s.journalFilename(), b); err != nil {
+		return err
+	}
+	if err = s.apply(ops); err != nil {
+		// the journal is replayed when the store is opened again
+		return err
+	}
+	return os.Remove(s.journalFilename())
+}
+
+func (s *fileMetadataStore) Close() error {
+	return nil
+}
+
+// apply applies given operations in order.
+func (s *fileMetadataStore) apply(ops []MetadataOp) error {
+	for _, op := range ops {
+		filename, object, err := s.path(op.Bucket, op.Key)
+		if err != nil {
+			return err
+		}
+		switch {
+		case object:
+			s.objects.Lock()
+			err = updateMetadataObject(filename, op.Key, op.Value)
+			s.objects.Unlock()
+		case op.Value == nil:
+			if err = os.Remove(filename); os.IsNotExist(err) {
+				err = nil
+			}
+		default:
+			err = writeFileSync(filename, op.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetadataObject returns the values of given JSON object file, which
+// is empty if it does not exist.
+func readMetadataObject(filename string) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return values, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return values, json.Unmarshal(b, &values)
+}
+
+// updateMetadataObject puts given value under given key of given JSON object
+// file, or deletes the key if the value is nil.
+func updateMetadataObject(filename, key string, value []byte) error {
+	values, err := readMetadataObject(filename)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(values, key)
+	} else if !json.Valid(value) {
+		return fmt.Errorf("value of '%s' is not JSON", key)
+	} else {
+		values[key] = value
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filename, b)
+}
+
+// writeFileSync writes given file atomically, i.e. into a temporary file
+// which is synced and renamed.
+func writeFileSync(filename string, b []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// boltMetadataStore is the metadata store of a single BoltDB file, whose
+// buckets are the ones of the store. A batch is a single transaction.
+type boltMetadataStore struct {
+	db *bolt.DB
+}
+
+// newBoltMetadataStore opens the BoltDB store of given file, which fails if
+// another process, e.g. a running agent, uses it.
+func newBoltMetadataStore(filename string) (*boltMetadataStore, error) {
+	db, err := bolt.Open(filename, 0640, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening metadata store %s", filename)
+	}
+	return &boltMetadataStore{db: db}, nil
+}
+
+func (s *boltMetadataStore) Get(bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			if v := b.Get([]byte(key)); v != nil {
+				// the value is only valid within the transaction
+				value = append([]byte{}, v...)
+				return nil
+			}
+		}
+		return errMetadataNotFound
+	})
+	return value, err
+}
+
+func (s *boltMetadataStore) Put(bucket, key string, value []byte) error {
+	return s.Batch([]MetadataOp{{Bucket: bucket, Key: key, Value: value}})
+}
+
+func (s *boltMetadataStore) Delete(bucket, key string) error {
+	return s.Batch([]MetadataOp{{Bucket: bucket, Key: key}})
+}
+
+func (s *boltMetadataStore) List(bucket string) ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *boltMetadataStore) Batch(ops []MetadataOp) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			if op.Key == "" {
+				return fmt.Errorf("invalid metadata key '%s'", op.Key)
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(op.Bucket))
+			if err != nil {
+				return err
+			}
+			if op.Value == nil {
+				err = b.Delete([]byte(op.Key))
+			} else {
+				err = b.Put([]byte(op.Key), op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltMetadataStore) Close() error {
+	return s.db.Close()
+}
+
+// migrate copies the values of the buckets of given file store, unless they
+// have been migrated already. The values and the marker of the migration are
+// a single batch, hence an interrupted migration is done again.
+func (s *boltMetadataStore) migrate(files MetadataStore, dirs map[string]string) error {
+	if _, err := s.Get(metadataMeta, metadataMigrated); err == nil {
+		return nil
+	} else if err != errMetadataNotFound {
+		return err
+	}
+	buckets := []string{MetadataTombstones, MetadataTombstoned}
+	for bucket := range dirs {
+		buckets = append(buckets, bucket)
+	}
+	var ops []MetadataOp
+	for _, bucket := range buckets {
+		keys, err := files.List(bucket)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			value, err := files.Get(bucket, key)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, MetadataOp{Bucket: bucket, Key: key, Value: value})
+		}
+	}
+	marker := []byte(time.Now().UTC().Format(time.RFC3339))
+	if err := s.Batch(append(ops, MetadataOp{Bucket: metadataMeta, Key: metadataMigrated, Value: marker})); err != nil {
+		return err
+	}
+	if len(ops) > 0 {
+		log.Printf("migrated %d metadata files into the metadata store, they are not used anymore", len(ops))
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// memMetadataStore is an in-memory MetadataStore of the tests.
+type memMetadataStore struct {
+	sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemMetadataStore() *memMetadataStore {
+	return &memMetadataStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memMetadataStore) Get(bucket, key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if v, ok := s.buckets[bucket][key]; ok {
+		return append([]byte{}, v...), nil
+	}
+	return nil, errMetadataNotFound
+}
+
+func (s *memMetadataStore) Put(bucket, key string, value []byte) error {
+	return s.Batch([]MetadataOp{{Bucket: bucket, Key: key, Value: value}})
+}
+
+func (s *memMetadataStore) Delete(bucket, key string) error {
+	return s.Batch([]MetadataOp{{Bucket: bucket, Key: key}})
+}
+
+func (s *memMetadataStore) List(bucket string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	keys := []string{}
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *memMetadataStore) Batch(ops []MetadataOp) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, op := range ops {
+		b, ok := s.buckets[op.Bucket]
+		if !ok {
+			b = make(map[string][]byte)
+			s.buckets[op.Bucket] = b
+		}
+		if op.Value == nil {
+			delete(b, op.Key)
+		} else {
+			b[op.Key] = append([]byte{}, op.Value...)
+		}
+	}
+	return nil
+}
+
+func (s *memMetadataStore) Close() error {
+	return nil
+}
+
+// testMetadataStores returns a store of every backend in given directory.
+func testMetadataStores(t *testing.T, dir string) map[string]MetadataStore {
+	dirs := map[string]string{MetadataUpdates: filepath.Join(dir, "notification")}
+	if err := os.MkdirAll(dirs[MetadataUpdates], 0750); err != nil {
+		t.Fatal(err)
+	}
+	files, err := newFileMetadataStore(dir, dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newBoltMetadataStore(filepath.Join(dir, metadataBoltName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]MetadataStore{
+		MetadataStoreFile: files,
+		MetadataStoreBolt: db,
+		"memory":          newMemMetadataStore(),
+	}
+}
+
+func TestMetadataStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, s := range testMetadataStores(t, dir) {
+		if _, err = s.Get(MetadataUpdates, "a-v1"); err != errMetadataNotFound {
+			t.Errorf("%s: missing key: %v", name, err)
+		}
+		for _, key := range []string{"b-v1", "a-v2", "a-v1"} {
+			if err = s.Put(MetadataUpdates, key, []byte(`{"key":"`+key+`"}`)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if err = s.Put(MetadataTombstones, "a", []byte("3")); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err = s.Delete(MetadataUpdates, "b-v1"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if err = s.Delete(MetadataUpdates, "c-v1"); err != nil {
+			t.Errorf("%s: deleting a missing key: %v", name, err)
+		}
+		if keys, err := s.List(MetadataUpdates); err != nil || !reflect.DeepEqual(keys, []string{"a-v1", "a-v2"}) {
+			t.Errorf("%s: wrong keys %v (%v)", name, keys, err)
+		}
+		if b, err := s.Get(MetadataUpdates, "a-v2"); err != nil || string(b) != `{"key":"a-v2"}` {
+			t.Errorf("%s: wrong value %s (%v)", name, b, err)
+		}
+		if b, err := s.Get(MetadataTombstones, "a"); err != nil || string(b) != "3" {
+			t.Errorf("%s: wrong tombstone %s (%v)", name, b, err)
+		}
+
+		// a tombstone replaces the metadata of its update at once
+		err = s.Batch([]MetadataOp{
+			{Bucket: MetadataTombstones, Key: "a", Value: []byte("4")},
+			{Bucket: MetadataUpdates, Key: "a-v2"},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err = s.Get(MetadataUpdates, "a-v2"); err != errMetadataNotFound {
+			t.Errorf("%s: batch has not deleted the metadata: %v", name, err)
+		}
+		if b, _ := s.Get(MetadataTombstones, "a"); string(b) != "4" {
+			t.Errorf("%s: batch has not put the tombstone: %s", name, b)
+		}
+		if err = s.Close(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestFileMetadataStoreCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dirs := map[string]string{MetadataUpdates: dir}
+	s, err := newFileMetadataStore(dir, dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(MetadataUpdates, "a-v1", []byte(`{"state":"downloaded"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(MetadataUpdates, "../escape", []byte("{}")); err == nil {
+		t.Error("key outside the bucket is written")
+	}
+	if err = s.Batch([]MetadataOp{{Bucket: "unknown", Key: "a"}}); err == nil {
+		t.Error("batch of an unknown bucket is applied")
+	}
+	if _, err = os.Stat(s.journalFilename()); !os.IsNotExist(err) {
+		t.Errorf("journal of a refused batch is written: %v", err)
+	}
+
+	// the agent crashed while writing a value, whose temporary file is not
+	// a value and the previous value is kept
+	tmp := filepath.Join(dir, "a-v1.tmp")
+	if err = ioutil.WriteFile(tmp, []byte(`{"state":"depl`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.List(MetadataUpdates); !reflect.DeepEqual(keys, []string{"a-v1"}) {
+		t.Errorf("temporary file is listed: %v", keys)
+	}
+
+	// the agent crashed while applying a batch, which is applied entirely
+	// once the store is opened again
+	ops := []MetadataOp{
+		{Bucket: MetadataTombstones, Key: "a", Value: []byte("1")},
+		{Bucket: MetadataUpdates, Key: "a-v1"},
+	}
+	b, _ := json.Marshal(ops)
+	if err = ioutil.WriteFile(s.journalFilename(), b, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newFileMetadataStore(dir, dirs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(MetadataUpdates, "a-v1"); err != errMetadataNotFound {
+		t.Errorf("journal is not replayed: %v", err)
+	}
+	if b, err := s.Get(MetadataTombstones, "a"); err != nil || string(b) != "1" {
+		t.Errorf("journal is not replayed: %s (%v)", b, err)
+	}
+	if _, err = os.Stat(s.journalFilename()); !os.IsNotExist(err) {
+		t.Errorf("replayed journal is not removed: %v", err)
+	}
+
+	// the tombstones of the previous releases are read
+	if err = ioutil.WriteFile(s.tombstonesFilename(), []byte(`{"b":5}`+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := s.Get(MetadataTombstones, "b"); err != nil || string(b) != "5" {
+		t.Errorf("wrong tombstone %s (%v)", b, err)
+	}
+}
+
+func TestBoltMetadataStoreCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, metadataBoltName)
+	s, err := newBoltMetadataStore(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put(MetadataUpdates, "a-v1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	// a batch failing in the middle is rolled back entirely
+	err = s.Batch([]MetadataOp{
+		{Bucket: MetadataUpdates, Key: "a-v1"},
+		{Bucket: MetadataTombstones, Key: "", Value: []byte("1")},
+	})
+	if err == nil {
+		t.Fatal("invalid batch is applied")
+	}
+	if _, err = s.Get(MetadataUpdates, "a-v1"); err != nil {
+		t.Errorf("failed batch is partially applied: %v", err)
+	}
+	// the store is locked by the agent
+	if _, err = newBoltMetadataStore(filename); err == nil {
+		t.Error("store is opened twice")
+	}
+	s.Close()
+	if s, err = newBoltMetadataStore(filename); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if keys, _ := s.List(MetadataUpdates); !reflect.DeepEqual(keys, []string{"a-v1"}) {
+		t.Errorf("value is not persisted: %v", keys)
+	}
+}
+
+func TestMetadataStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metastore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultConfig()
+	cfg.DataDir = dir
+	cfg.Namespaces = []NamespaceConfig{{Name: "lab"}}
+	dirs := cfg.metadataDirs()
+	for _, d := range dirs {
+		if err = os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := openMetadataStore(&cfg, dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files.Put(MetadataUpdates, "a-v1", []byte(`{"a":1}`))
+	files.Put(updatesBucket("lab"), "b-v2", []byte(`{"b":2}`))
+	files.Put(MetadataTombstones, "c", []byte("7"))
+
+	cfg.MetadataStore = MetadataStoreBolt
+	db, err := openMetadataStore(&cfg, dirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range [][3]string{
+		{MetadataUpdates, "a-v1", `{"a":1}`},
+		{updatesBucket("lab"), "b-v2", `{"b":2}`},
+		{MetadataTombstones, "c", "7"},
+	} {
+		if b, err := db.Get(kv[0], kv[1]); err != nil || string(b) != kv[2] {
+			t.Errorf("%s/%s is not migrated: %s (%v)", kv[0], kv[1], b, err)
+		}
+	}
+	db.Delete(MetadataUpdates, "a-v1")
+	db.Close()
+
+	// the migration is one-way, it is not done again
+	files.Put(MetadataUpdates, "d-v1", []byte(`{}`))
+	if db, err = openMetadataStore(&cfg, dirs); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if keys, _ := db.List(MetadataUpdates); len(keys) != 0 {
+		t.Errorf("files are migrated again: %v", keys)
+	}
+}
+
+func TestAgentMetadataStore(t *testing.T) {
+	store := newMemMetadataStore()
+	a := &Agent{Config: &Config{}, updates: make(map[string]*Update), store: store}
+	if err := a.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 2}, a)
+	u.State = UpdateDeployed
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := a.loadUpdate(MetadataUpdates, u.metadataKey())
+	if err != nil || loaded.State != UpdateDeployed || loaded.Notification.Version != 2 {
+		t.Fatalf("wrong update %+v (%v)", loaded, err)
+	}
+
+	// the tombstone and the deletion of the metadata are a single batch
+	if err = a.tombstoneUpdate(UUIDShell, 2, u); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.List(MetadataUpdates); len(keys) != 0 {
+		t.Errorf("metadata of the tombstoned update remain: %v", keys)
+	}
+	if err = u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := store.List(MetadataUpdates); len(keys) != 0 {
+		t.Errorf("metadata of the tombstoned update are saved again: %v", keys)
+	}
+	a = &Agent{Config: &Config{}, store: store}
+	if err = a.loadTombstones(); err != nil || a.tombstones[UUIDShell] != 2 {
+		t.Errorf("wrong tombstones %v (%v)", a.tombstones, err)
+	}
+}
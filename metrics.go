@@ -0,0 +1,103 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics is the registry shared by all components of the process.
+var metrics = NewMetrics()
+
+// Metrics is a registry of counters and gauges. A metric is identified by its
+// name and optional labels, which are given as key-value pairs, for example:
+// `metrics.Inc("webhook.deliveries", "result", "success")`.
+type Metrics struct {
+	sync.RWMutex
+	counters map[string]*int64
+	gauges   map[string]*int64
+}
+
+// NewMetrics returns an empty Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]*int64),
+		gauges:   make(map[string]*int64),
+	}
+}
+
+// metricKey returns the registry key of given name and labels, which has
+// format `name{key1=value1,key2=value2}`.
+func metricKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b bytes.Buffer
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteByte('=')
+		b.WriteString(labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func (m *Metrics) get(values map[string]*int64, key string) *int64 {
+	m.RLock()
+	v, ok := values[key]
+	m.RUnlock()
+	if ok {
+		return v
+	}
+	m.Lock()
+	defer m.Unlock()
+	if v, ok = values[key]; !ok {
+		v = new(int64)
+		values[key] = v
+	}
+	return v
+}
+
+// Inc increments the counter of given name and labels by one.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add adds delta to the counter of given name and labels.
+func (m *Metrics) Add(name string, delta int64, labels ...string) {
+	atomic.AddInt64(m.get(m.counters, metricKey(name, labels)), delta)
+}
+
+// Set sets the gauge of given name and labels.
+func (m *Metrics) Set(name string, value int64, labels ...string) {
+	atomic.StoreInt64(m.get(m.gauges, metricKey(name, labels)), value)
+}
+
+// Counters returns a snapshot of all counters.
+func (m *Metrics) Counters() map[string]int64 {
+	return m.snapshot(m.counters)
+}
+
+// Gauges returns a snapshot of all gauges.
+func (m *Metrics) Gauges() map[string]int64 {
+	return m.snapshot(m.gauges)
+}
+
+func (m *Metrics) snapshot(values map[string]*int64) map[string]int64 {
+	m.RLock()
+	defer m.RUnlock()
+	s := make(map[string]int64, len(values))
+	for k, v := range values {
+		s[k] = atomic.LoadInt64(v)
+	}
+	return s
+}
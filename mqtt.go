@@ -0,0 +1,322 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	mqttKeepAlive     = 60 // in seconds
+	mqttMaxBackoff    = 5 * time.Minute
+	mqttDialTimeout   = 10 * time.Second
+	mqttDefaultPrefix = "p2pupdate"
+
+	mqttPacketConnect    = 0x10
+	mqttPacketConnack    = 0x20
+	mqttPacketPublish    = 0x30
+	mqttPacketPingreq    = 0xc0
+	mqttPacketDisconnect = 0xe0
+
+	mqttFlagRetain       = 0x01
+	mqttFlagCleanSession = 0x02
+	mqttFlagWill         = 0x04
+	mqttFlagWillRetain   = 0x20
+	mqttFlagPassword     = 0x40
+	mqttFlagUsername     = 0x80
+)
+
+// MQTTConfig holds configurations of MQTT status publishing.
+type MQTTConfig struct {
+	// Broker is the broker URL, e.g. tcp://host:1883 or ssl://host:8883.
+	// MQTT publishing is disabled when it is empty.
+	Broker   string `json:"broker"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// CACert is a PEM file of CA certificates to verify the broker. The
+	// system's CA certificates are used if it is empty.
+	CACert             string `json:"ca-cert,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure-skip-verify,omitempty"`
+
+	TopicPrefix string `json:"topic-prefix"`
+	Heartbeat   int    `json:"heartbeat"` // in seconds
+}
+
+// MQTTClient is a minimal MQTT 3.1.1 client that publishes retained messages
+// with QoS 0. It keeps the latest payload of every topic, and republishes them
+// after reconnecting to the broker.
+type MQTTClient struct {
+	sync.Mutex
+
+	cfg         MQTTConfig
+	clientID    string
+	willTopic   string
+	willPayload []byte
+
+	latest map[string][]byte
+	dirty  map[string]bool
+	notify chan struct{}
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// NewMQTTClient creates an MQTTClient and starts its connection goroutine.
+// The broker publishes willPayload on willTopic when the client disconnects
+// unexpectedly.
+func NewMQTTClient(cfg MQTTConfig, clientID, willTopic string, willPayload []byte) *MQTTClient {
+	c := &MQTTClient{
+		cfg:         cfg,
+		clientID:    clientID,
+		willTopic:   willTopic,
+		willPayload: willPayload,
+		latest:      make(map[string][]byte),
+		dirty:       make(map[string]bool),
+		notify:      make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Publish publishes a retained payload on given topic. It never blocks: the
+// message is sent by the connection goroutine once the broker is reachable.
+func (c *MQTTClient) Publish(topic string, payload []byte) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	c.latest[topic] = payload
+	c.dirty[topic] = true
+	c.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Stop flushes pending messages, disconnects from the broker, and stops the
+// connection goroutine.
+func (c *MQTTClient) Stop() {
+	if c == nil {
+		return
+	}
+	close(c.quit)
+	select {
+	case <-c.done:
+	case <-time.After(mqttDialTimeout):
+	}
+}
+
+func (c *MQTTClient) run() {
+	defer close(c.done)
+	backoff := time.Second
+	for {
+		conn, err := c.connect()
+		if err == nil {
+			log.Printf("mqtt - connected to %s", c.cfg.Broker)
+			backoff = time.Second
+			err = c.serve(conn)
+			conn.Close()
+			if err == nil {
+				return
+			}
+		}
+		log.Printf("mqtt - connection to %s failed (retry in %v): %v", c.cfg.Broker, backoff, err)
+		select {
+		case <-c.quit:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+func (c *MQTTClient) dial() (net.Conn, error) {
+	u, err := url.Parse(c.cfg.Broker)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", u.Host)
+	case "ssl", "tls", "mqtts":
+		tc := &tls.Config{InsecureSkipVerify: c.cfg.InsecureSkipVerify}
+		if c.cfg.CACert != "" {
+			pem, err := ioutil.ReadFile(c.cfg.CACert)
+			if err != nil {
+				return nil, err
+			}
+			tc.RootCAs = x509.NewCertPool()
+			if !tc.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate in %s", c.cfg.CACert)
+			}
+		}
+		return tls.DialWithDialer(dialer, "tcp", u.Host, tc)
+	}
+	return nil, fmt.Errorf("unsupported broker scheme: %s", u.Scheme)
+}
+
+func (c *MQTTClient) connect() (net.Conn, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	if _, err = conn.Write(c.connectPacket()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var ack [4]byte
+	if _, err = io.ReadFull(conn, ack[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack[0] != mqttPacketConnack || ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by broker, return code %d", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	// every retained message has to be republished on a new connection
+	c.Lock()
+	for topic := range c.latest {
+		c.dirty[topic] = true
+	}
+	c.Unlock()
+	return conn, nil
+}
+
+// serve publishes dirty topics until the connection fails, which returns an
+// error, or the client is stopped, which returns nil.
+func (c *MQTTClient) serve(conn net.Conn) error {
+	readErr := make(chan error, 1)
+	go func() {
+		// discard PINGRESP and anything else sent by the broker
+		_, err := io.Copy(ioutil.Discard, conn)
+		if err == nil {
+			err = io.EOF
+		}
+		readErr <- err
+	}()
+
+	ticker := time.NewTicker(mqttKeepAlive * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		if err := c.flush(conn); err != nil {
+			return err
+		}
+		select {
+		case <-c.notify:
+		case <-ticker.C:
+			if _, err := conn.Write([]byte{mqttPacketPingreq, 0}); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-c.quit:
+			c.flush(conn)
+			conn.Write([]byte{mqttPacketDisconnect, 0})
+			return nil
+		}
+	}
+}
+
+func (c *MQTTClient) flush(conn net.Conn) error {
+	c.Lock()
+	packets := make([][]byte, 0, len(c.dirty))
+	for topic := range c.dirty {
+		packets = append(packets, mqttPublishPacket(topic, c.latest[topic]))
+	}
+	c.dirty = make(map[string]bool)
+	c.Unlock()
+
+	w := bufio.NewWriter(conn)
+	for _, p := range packets {
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (c *MQTTClient) connectPacket() []byte {
+	var (
+		body  bytes.Buffer
+		flags byte = mqttFlagCleanSession
+	)
+	if c.willTopic != "" {
+		flags |= mqttFlagWill | mqttFlagWillRetain
+	}
+	if c.cfg.Username != "" {
+		flags |= mqttFlagUsername
+		if c.cfg.Password != "" {
+			flags |= mqttFlagPassword
+		}
+	}
+	mqttWriteString(&body, []byte("MQTT"))
+	body.WriteByte(4) // protocol level 3.1.1
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(mqttKeepAlive))
+	mqttWriteString(&body, []byte(c.clientID))
+	if c.willTopic != "" {
+		mqttWriteString(&body, []byte(c.willTopic))
+		mqttWriteString(&body, c.willPayload)
+	}
+	if flags&mqttFlagUsername != 0 {
+		mqttWriteString(&body, []byte(c.cfg.Username))
+	}
+	if flags&mqttFlagPassword != 0 {
+		mqttWriteString(&body, []byte(c.cfg.Password))
+	}
+	return mqttPacket(mqttPacketConnect, body.Bytes())
+}
+
+func mqttPublishPacket(topic string, payload []byte) []byte {
+	var body bytes.Buffer
+	mqttWriteString(&body, []byte(topic))
+	body.Write(payload)
+	return mqttPacket(mqttPacketPublish|mqttFlagRetain, body.Bytes())
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	var p bytes.Buffer
+	p.WriteByte(header)
+	// remaining length is encoded with 7 bits per byte
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		p.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+	p.Write(body)
+	return p.Bytes()
+}
+
+func mqttWriteString(w *bytes.Buffer, s []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.Write(s)
+}
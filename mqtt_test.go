@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func TestMQTTClientPublish(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cfg := MQTTConfig{
+		Broker:   "tcp://" + l.Addr().String(),
+		Username: "user",
+		Password: "secret",
+	}
+	c := NewMQTTClient(cfg, "p2pupdate-test", "fruit/test/agent", []byte(`{"status":"offline"}`))
+	payload := make([]byte, 300) // remaining length needs two bytes
+	c.Publish("fruit/test/updates/x", payload)
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	header, body, err := readMQTTPacket(r)
+	if err != nil || header != mqttPacketConnect {
+		t.Fatalf("expected CONNECT, got %x: %v", header, err)
+	}
+	flags := body[7]
+	if flags != mqttFlagCleanSession|mqttFlagWill|mqttFlagWillRetain|mqttFlagUsername|mqttFlagPassword {
+		t.Errorf("unexpected connect flags %x", flags)
+	}
+	conn.Write([]byte{mqttPacketConnack, 2, 0, 0})
+
+	header, body, err = readMQTTPacket(r)
+	if err != nil || header != mqttPacketPublish|mqttFlagRetain {
+		t.Fatalf("expected retained PUBLISH, got %x: %v", header, err)
+	}
+	n := int(binary.BigEndian.Uint16(body[:2]))
+	if topic := string(body[2 : 2+n]); topic != "fruit/test/updates/x" {
+		t.Errorf("unexpected topic %s", topic)
+	}
+	if len(body[2+n:]) != len(payload) {
+		t.Errorf("expected payload of %d bytes, got %d", len(payload), len(body[2+n:]))
+	}
+
+	go c.Stop()
+	if header, _, err = readMQTTPacket(r); err != nil || header != mqttPacketDisconnect {
+		t.Errorf("expected DISCONNECT, got %x: %v", header, err)
+	}
+}
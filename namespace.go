@@ -0,0 +1,224 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/pkg/errors"
+)
+
+// defaultNamespaceLabel is the label of the default namespace in the metrics.
+const defaultNamespaceLabel = "default"
+
+// rNamespace is the format of a namespace name, which is a directory name.
+var rNamespace = regexp.MustCompile("^[a-z0-9][a-z0-9_-]{0,31}$")
+
+// NamespaceConfig holds configurations of a namespace, i.e. an isolated
+// stream of updates signed by its own key. The namespaces of an agent share
+// its torrent client, its overlay and its REST API.
+type NamespaceConfig struct {
+	Name string `json:"name"`
+
+	// Public key verifying the notifications of the namespace
+	PublicKey Key `json:"public-key"`
+
+	// Trackers are announced in addition to the tracker of the
+	// notifications of the namespace.
+	Trackers []string `json:"trackers,omitempty"`
+
+	// UUIDs are the update UUIDs accepted by the namespace, any UUID if it
+	// is empty.
+	UUIDs []string `json:"uuids,omitempty"`
+}
+
+// validateNamespaces returns an error if a namespace is invalid or if two
+// namespaces have the same name.
+func validateNamespaces(namespaces []NamespaceConfig) error {
+	names := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		if !rNamespace.MatchString(ns.Name) {
+			return fmt.Errorf("invalid namespace name '%s', expected up to 32 lowercase letters,"+
+				" digits, dashes or underscores", ns.Name)
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("duplicated namespace '%s'", ns.Name)
+		}
+		names[ns.Name] = true
+		if len(ns.PublicKey.Filename) == 0 {
+			return fmt.Errorf("namespace %s: public key is not set", ns.Name)
+		}
+	}
+	return nil
+}
+
+// Namespace is an isolated stream of updates, whose payloads and metadata
+// are stored in its own directories. The default namespace, whose name is
+// empty, is the one of the top-level configurations.
+type Namespace struct {
+	Name string
+
+	publicKey   *rsa.PublicKey
+	trackers    []string
+	uuids       []string
+	dataDir     string
+	metadataDir string
+
+	// storage of the payloads, or nil for the default storage of the
+	// torrent client
+	storage storage.ClientImpl
+}
+
+// label returns the label of the namespace in the metrics.
+func (ns *Namespace) label() string {
+	if ns == nil || ns.Name == "" {
+		return defaultNamespaceLabel
+	}
+	return ns.Name
+}
+
+// accepts returns true if given notification is verified by the key of the
+// namespace and its UUID is allowed.
+func (ns *Namespace) accepts(n *Notification) bool {
+	if len(ns.uuids) > 0 && !containsString(ns.uuids, n.UUID) {
+		return false
+	}
+	return n.Verify(ns.publicKey) == nil
+}
+
+// initNamespaces creates the default namespace and the configured ones, with
+// their directories under <data-dir>/namespace/<name>.
+func (a *Agent) initNamespaces() error {
+	a.namespaces = []*Namespace{{
+		publicKey:   a.PublicKey,
+		dataDir:     a.dataDir,
+		metadataDir: a.metadataDir,
+	}}
+	for _, cfg := range a.Config.Namespaces {
+		pub, err := LoadPublicKey(cfg.PublicKey.Filename)
+		if err != nil {
+			return errors.Wrapf(err, "namespace %s: failed loading public key file %s",
+				cfg.Name, cfg.PublicKey.Filename)
+		}
+		dir := filepath.Join(a.Config.DataDir, "namespace", cfg.Name)
+		ns := &Namespace{
+			Name:        cfg.Name,
+			publicKey:   pub,
+			trackers:    cfg.Trackers,
+			uuids:       cfg.UUIDs,
+			dataDir:     filepath.Join(dir, "update"),
+			metadataDir: filepath.Join(dir, "notification"),
+		}
+		for _, d := range []string{ns.dataDir, ns.metadataDir} {
+			if err = os.MkdirAll(d, 0750); err != nil {
+				return errors.Wrapf(err, "namespace %s: failed creating directory %s", cfg.Name, d)
+			}
+		}
+		ns.storage = a.Config.BitTorrent.newStorage(ns.dataDir, a.completion)
+		a.namespaces = append(a.namespaces, ns)
+	}
+	return nil
+}
+
+// defaultNamespace returns the default namespace, which is the one of the
+// top-level configurations until the namespaces are created.
+func (a *Agent) defaultNamespace() *Namespace {
+	if len(a.namespaces) > 0 {
+		return a.namespaces[0]
+	}
+	return &Namespace{publicKey: a.PublicKey, dataDir: a.dataDir, metadataDir: a.metadataDir}
+}
+
+// namespace returns the namespace of given name, or nil if it does not exist.
+func (a *Agent) namespace(name string) *Namespace {
+	if name == "" {
+		return a.defaultNamespace()
+	}
+	for _, ns := range a.namespaces {
+		if ns.Name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// routeNotification returns the namespace of given notification, i.e. the
+// first namespace that accepts it, the configured ones in order and then the
+// default one.
+func (a *Agent) routeNotification(n *Notification) (*Namespace, error) {
+	for _, ns := range a.namespaces {
+		if ns.Name != "" && ns.accepts(n) {
+			return ns, nil
+		}
+	}
+	ns := a.defaultNamespace()
+	if err := n.Verify(ns.publicKey); err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// updateKey returns the key of the update of given UUID in given namespace,
+// which is the UUID in the default namespace. The updates of different keys
+// are never compared.
+func updateKey(namespace, uuid string) string {
+	if namespace == "" {
+		return uuid
+	}
+	return namespace + "/" + uuid
+}
+
+// key returns the key of the update in the agent.
+func (u *Update) key() string {
+	return updateKey(u.Namespace, u.Notification.UUID)
+}
+
+// namespace returns the namespace of the update, which is the default one
+// until the notification is routed.
+func (u *Update) namespace() *Namespace {
+	if u.ns != nil {
+		return u.ns
+	}
+	return u.agent.defaultNamespace()
+}
+
+// addTorrent adds the torrent of given metainfo to the client of the agent,
+// with the storage and the trackers of the namespace of the update. A
+// torrent of the same infohash in another namespace is never shared, and a
+// version kept seeding has the storage of the directory of its version.
+func (u *Update) addTorrent(mi *metainfo.MetaInfo) (*torrent.Torrent, error) {
+	cl, ns := u.agent.torrentClient, u.namespace()
+	mi = u.agent.Config.BitTorrent.tokenizeMetaInfo(mi)
+	if len(u.agent.namespaces) <= 1 && u.SupersededBy == 0 {
+		return cl.AddTorrent(mi)
+	}
+	// the previous version of the update has been dropped already
+	if _, ok := cl.Torrent(mi.HashInfoBytes()); ok {
+		return nil, fmt.Errorf("torrent %s is already used by another namespace", mi.HashInfoBytes().HexString())
+	}
+	spec := torrent.TorrentSpecFromMetaInfo(mi)
+	spec.Storage = ns.storage
+	if u.SupersededBy > 0 {
+		// a kept version seeds from the directory of its version
+		spec.Storage = u.agent.Config.BitTorrent.newStorage(u.versionDir(), u.agent.completion)
+	}
+	if len(ns.trackers) > 0 {
+		spec.Trackers = append(spec.Trackers, u.agent.Config.BitTorrent.trackerURLs(ns.trackers))
+	}
+	t, _, err := cl.AddTorrentSpec(spec)
+	return t, err
+}
+
+// dataDir returns the directory of the payload of the update.
+func (u *Update) dataDir() string {
+	return u.namespace().dataDir
+}
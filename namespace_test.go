@@ -0,0 +1,111 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestValidateNamespaces(t *testing.T) {
+	key := Key{Filename: "/etc/p2pupdate/lab.pub"}
+	for _, tc := range []struct {
+		namespaces []NamespaceConfig
+		valid      bool
+	}{
+		{nil, true},
+		{[]NamespaceConfig{{Name: "lab-a", PublicKey: key}, {Name: "lab_b", PublicKey: key}}, true},
+		{[]NamespaceConfig{{Name: "", PublicKey: key}}, false},
+		{[]NamespaceConfig{{Name: "../lab", PublicKey: key}}, false},
+		{[]NamespaceConfig{{Name: "Lab", PublicKey: key}}, false},
+		{[]NamespaceConfig{{Name: "lab"}}, false},
+		{[]NamespaceConfig{{Name: "lab", PublicKey: key}, {Name: "lab", PublicKey: key}}, false},
+	} {
+		if err := validateNamespaces(tc.namespaces); (err == nil) != tc.valid {
+			t.Errorf("namespaces %+v: valid %v, expected %v (%v)", tc.namespaces, err == nil, tc.valid, err)
+		}
+	}
+}
+
+func TestRouteNotification(t *testing.T) {
+	keys := make([]*rsa.PrivateKey, 3)
+	for i := range keys {
+		var err error
+		if keys[i], err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := &Agent{
+		updates: make(map[string]*Update),
+		namespaces: []*Namespace{
+			{publicKey: &keys[0].PublicKey},
+			{Name: "lab-a", publicKey: &keys[1].PublicKey, uuids: []string{UUIDShell}},
+			{Name: "lab-b", publicKey: &keys[1].PublicKey},
+		},
+	}
+	notification := func(uuid string, key *rsa.PrivateKey) *Notification {
+		n := &Notification{
+			UUID:    uuid,
+			Version: 1,
+			Info:    metainfo.Info{Name: "update", PieceLength: 1024, Length: 1},
+		}
+		if err := n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		n         *Notification
+		namespace string
+		ok        bool
+	}{
+		{notification(UUIDShell, keys[0]), "", true},
+		{notification(UUIDShell, keys[1]), "lab-a", true},
+		{notification(UUIDApk, keys[1]), "lab-b", true},
+		{notification(UUIDShell, keys[2]), "", false},
+	} {
+		ns, err := a.routeNotification(tc.n)
+		if !tc.ok {
+			if err == nil {
+				t.Errorf("uuid:%s is routed to '%s' without a verifying key", tc.n.UUID, ns.Name)
+			}
+			continue
+		}
+		if err != nil || ns.Name != tc.namespace {
+			t.Errorf("uuid:%s is routed to %+v (%v), expected '%s'", tc.n.UUID, ns, err, tc.namespace)
+		}
+	}
+
+	// the same UUID in two namespaces is two independent updates
+	u1 := &Update{Notification: *notification(UUIDShell, keys[0]), agent: a}
+	u2 := &Update{Notification: *notification(UUIDShell, keys[1]), agent: a}
+	u2.Notification.Version = 5
+	if err := u1.Verify(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := u2.Verify(a); err == nil {
+		t.Fatal("modified notification is verified")
+	}
+	u2.Notification.Version = 1
+	if err := u2.Verify(a); err != nil {
+		t.Fatal(err)
+	}
+	if u1.key() == u2.key() || u2.Namespace != "lab-a" {
+		t.Fatalf("keys %s and %s of the namespaces are not independent", u1.key(), u2.key())
+	}
+	if _, err := a.addUpdate(u1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.addUpdate(u2); err != nil {
+		t.Errorf("update of another namespace is compared: %v", err)
+	}
+	if a.getUpdate(UUIDShell) != u1 || a.getUpdate(updateKey("lab-a", UUIDShell)) != u2 {
+		t.Error("updates are not found by their keys")
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
-	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	torrentbencode "github.com/anacrolix/torrent/bencode"
@@ -33,6 +36,75 @@ type Notification struct {
 	// Fields proposed by Herry et.al. (see DOMINO workshop paper)
 	UUID    string `bencode:"uuid,omitempty"`
 	Version uint64 `bencode:"version,omitempty"`
+
+	// SchemaVersion is the version of the notification's format (see
+	// SchemaVersion), which is 0 for the notifications without it.
+	SchemaVersion int `bencode:"schema_version,omitempty" json:",omitempty"`
+
+	// Optional fields, which are omitted when empty to keep the signatures
+	// of older notifications valid.
+	Group *UpdateGroup `bencode:"group,omitempty" json:",omitempty"`
+
+	// RolloutPercent limits the deployment to the agents whose rollout
+	// bucket is below it. Zero means the whole fleet.
+	RolloutPercent int `bencode:"rollout_percent,omitempty" json:",omitempty"`
+
+	// Tags are the tag selectors of the agents that deploy the update,
+	// e.g. greenhouse, rack-a|rack-b or !lab (see MatchTags).
+	Tags []string `bencode:"tags,omitempty" json:",omitempty"`
+
+	// Platforms are the platforms of the agents that deploy the update,
+	// e.g. linux/arm/v6 or linux/arm for all its variants (see
+	// MatchPlatform). The other agents refuse it, unless they seed it.
+	Platforms []string `bencode:"platforms,omitempty" json:",omitempty"`
+
+	// Canary holds the deployment on the other agents until the canary
+	// agents have reported enough successful deployments.
+	Canary *Canary `bencode:"canary,omitempty" json:",omitempty"`
+
+	// CreationTime is the creation time in Unix nanoseconds, which orders
+	// the re-publications of the same version within the same second of
+	// CreationDate (see Supersedes).
+	CreationTime int64 `bencode:"creation_time,omitempty" json:",omitempty"`
+
+	// NotBefore is the Unix time before which the update must not be
+	// deployed, although it is downloaded and seeded immediately.
+	NotBefore int64 `bencode:"not_before,omitempty" json:",omitempty"`
+
+	// Timeout is the execution timeout in seconds of each script of the
+	// update, which overrides Deploy.DefaultTimeout of the agents.
+	Timeout int `bencode:"timeout,omitempty" json:",omitempty"`
+
+	// SHA256 is the hex SHA-256 digest of the whole payload (see
+	// PayloadDigest), which is verified after the download and before the
+	// deployment in addition to the piece hashes.
+	SHA256 string `bencode:"sha256,omitempty" json:",omitempty"`
+
+	// TraceID is generated by the submitter and written in the logs,
+	// audit entries, reports and webhooks related to the update on every
+	// hop, so that they can be correlated.
+	TraceID string `bencode:"trace_id,omitempty" json:",omitempty"`
+
+	// FallbackURLs are the HTTPS URLs of the payload, which the agents
+	// download from when they have no torrent peer for a while, e.g. the
+	// tracker is down (see FallbackConfig). A URL ending with a slash is
+	// the directory of the payload, as the webseeds of BEP 19.
+	FallbackURLs []string `bencode:"fallback_urls,omitempty" json:",omitempty"`
+
+	// Priority is low, normal (the default) or critical. The downloads of
+	// the updates of higher priority preempt the others.
+	Priority string `bencode:"priority,omitempty" json:",omitempty"`
+
+	// Delta is the patch that rebuilds the payload from the payload of a
+	// previous version, which the agents having it download instead of
+	// the payload.
+	Delta *Delta `bencode:"delta,omitempty" json:",omitempty"`
+
+	// Title and Notes are the human-readable title and release notes of
+	// the update, whose sizes are limited (see validateReleaseNotes). They
+	// are sanitized before being written since they may contain anything.
+	Title string `bencode:"title,omitempty" json:",omitempty"`
+	Notes string `bencode:"notes,omitempty" json:",omitempty"`
 }
 
 // Signature holds data signature
@@ -43,25 +115,73 @@ type Signature struct {
 	Signature   []byte `bencode:"signature,omitempty"`
 }
 
-// NewNotification creates a new Notification instance of given update's filename.
+// ParsePieceLength parses a piece length in bytes, with an optional suffix k
+// (KiB) or m (MiB), e.g. 32k or 1m. It must be a power of two between
+// MinPieceLength and MaxPieceLength.
+func ParsePieceLength(s string) (int64, error) {
+	v, unit := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	switch {
+	case strings.HasSuffix(v, "k"):
+		v, unit = v[:len(v)-1], 1024
+	case strings.HasSuffix(v, "m"):
+		v, unit = v[:len(v)-1], 1024*1024
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid piece length: %s", s)
+	}
+	n *= unit
+	if err = validatePieceLength(n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// validatePieceLength returns an error if given piece length is not a power
+// of two between MinPieceLength and MaxPieceLength.
+func validatePieceLength(n int64) error {
+	if n < MinPieceLength || n > MaxPieceLength || n&(n-1) != 0 {
+		return fmt.Errorf("piece length %d must be a power of two between %d and %d",
+			n, MinPieceLength, MaxPieceLength)
+	}
+	return nil
+}
+
+// NewNotification creates a new Notification instance of given update's
+// filename. The files of a directory matching any of given exclude patterns
+// are left out of the torrent and the payload digest. Apart from the creation
+// date, the notification only depends on the arguments, the base name of
+// filename and the content of its files, hence the unsigned notification and
+// its infohash are reproducible. The notification must be signed by the
+// caller once its optional fields are set.
 func NewNotification(filename, uuid string, ver uint64, tracker string,
-	pieceLength int64, privkey *rsa.PrivateKey) (*Notification, error) {
+	pieceLength int64, excludes []string) (*Notification, error) {
+	if err := validatePieceLength(pieceLength); err != nil {
+		return nil, err
+	}
+	now := time.Now()
 	mi := Notification{
-		UUID:         uuid,
-		Version:      ver,
-		Announce:     tracker,
-		CreatedBy:    softwareName,
-		Encoding:     "UTF-8",
-		CreationDate: time.Now().Unix(),
+		UUID:          uuid,
+		Version:       ver,
+		SchemaVersion: SchemaVersion,
+		Announce:      tracker,
+		CreatedBy:     softwareName,
+		Encoding:      "UTF-8",
+		CreationDate:  now.Unix(),
+		CreationTime:  now.UnixNano(),
 		Info: metainfo.Info{
 			PieceLength: pieceLength,
 		},
 	}
-	if err := mi.Info.BuildFromFilePath(filename); err != nil {
+	files, _, err := payloadFiles(filename, excludes)
+	if err != nil {
+		return nil, err
+	}
+	if err = buildInfo(&mi.Info, filename, files); err != nil {
 		return nil, err
 	}
 	mi.Info.Name = fmt.Sprintf("%s-v%d-%s", mi.UUID, mi.Version, mi.Info.Name)
-	if err := mi.Sign(privkey); err != nil {
+	if mi.SHA256, err = payloadDigest(filename, files); err != nil {
 		return nil, err
 	}
 	return &mi, nil
@@ -105,6 +225,12 @@ func (mi *Notification) Write(w io.Writer) error {
 // Sign signs the Notification using given private key file.
 // Reference: https://stackoverflow.com/questions/10782826/digital-signature-for-a-file-using-openssl
 func (mi *Notification) Sign(key *rsa.PrivateKey) error {
+	return mi.SignWith(KeySigner{Key: key})
+}
+
+// SignWith signs the Notification using given signer, which may hold the
+// private key outside of this process.
+func (mi *Notification) SignWith(signer Signer) error {
 	var (
 		data, sig []byte
 		err       error
@@ -114,9 +240,7 @@ func (mi *Notification) Sign(key *rsa.PrivateKey) error {
 	if data, err = json.Marshal(mi); err != nil {
 		return err
 	}
-	hashed := sha256.Sum256(data)
-	sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
-	if err != nil {
+	if sig, err = signer.SignMessage(data); err != nil {
 		return err
 	}
 	mi.Signatures = make(map[string]Signature)
@@ -147,6 +271,56 @@ func (mi *Notification) Verify(pub *rsa.PublicKey) error {
 	return fmt.Errorf("signature is not available")
 }
 
+// Supersedes returns true if this notification replaces given notification of
+// the same UUID, version and content, i.e. it was re-published later with
+// different optional fields, such as a wider rollout. The creation times
+// order them if both have one, otherwise the creation dates do, which are in
+// whole seconds.
+func (mi *Notification) Supersedes(old *Notification) bool {
+	later := mi.CreationDate > old.CreationDate
+	if mi.CreationTime > 0 && old.CreationTime > 0 {
+		later = mi.CreationTime > old.CreationTime
+	}
+	if mi.UUID != old.UUID || mi.Version != old.Version || !later || mi.SHA256 != old.SHA256 {
+		return false
+	}
+	b1, err1 := torrentbencode.Marshal(mi.Info)
+	b2, err2 := torrentbencode.Marshal(old.Info)
+	return err1 == nil && err2 == nil && bytes.Equal(b1, b2)
+}
+
+// InRollout returns true if an agent of given rollout bucket should deploy
+// the update.
+func (mi *Notification) InRollout(bucket int) bool {
+	return mi.RolloutPercent <= 0 || bucket < mi.RolloutPercent
+}
+
+// rolloutBucket returns the stable rollout bucket, from 0 to 99, of given peer
+// for given update UUID. The buckets of a peer differ across UUIDs, hence the
+// same peers are not always in the early waves.
+func rolloutBucket(pid PeerID, uuid string) int {
+	h := sha256.New()
+	h.Write(pid[:])
+	h.Write([]byte(uuid))
+	return int(binary.BigEndian.Uint64(h.Sum(nil)[:8]) % 100)
+}
+
+// Trackerless returns true if the update is published without a tracker,
+// hence its peers are only found via the DHT and the overlay.
+func (mi *Notification) Trackerless() bool {
+	return len(mi.Announce) == 0
+}
+
+// InfoHash returns the BitTorrent infohash of the notification, which only
+// depends on the info dictionary.
+func (mi *Notification) InfoHash() (metainfo.Hash, error) {
+	mm, err := mi.torrentMetainfo()
+	if err != nil {
+		return metainfo.Hash{}, err
+	}
+	return mm.HashInfoBytes(), nil
+}
+
 // torrentMetainfo returns the anacrolix's torrent Metainfo.
 func (mi *Notification) torrentMetainfo() (*metainfo.MetaInfo, error) {
 	mm := metainfo.MetaInfo{
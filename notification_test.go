@@ -0,0 +1,183 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/zeebo/bencode"
+)
+
+func TestNotificationRollout(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Notification{
+		UUID:           "f5adf0cb-b0e1-5a22-97f1-09092f566438",
+		Version:        1,
+		CreationDate:   1500000000,
+		Info:           metainfo.Info{Name: "update", PieceLength: 1024, Length: 1},
+		RolloutPercent: 5,
+	}
+	if err = old.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the signature covers the rollout
+	n := old
+	n.RolloutPercent = 25
+	if err = n.Verify(&key.PublicKey); err == nil {
+		t.Fatal("modified rollout must fail the verification")
+	}
+	n.CreationDate++
+	if err = n.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if !n.Supersedes(&old) || old.Supersedes(&n) {
+		t.Error("re-published notification must supersede the older one")
+	}
+
+	// the creation times order the re-publications of the same second
+	n.CreationDate, old.CreationTime, n.CreationTime = old.CreationDate, 1500000000000000000, 1500000000000000001
+	if !n.Supersedes(&old) || old.Supersedes(&n) {
+		t.Error("notification re-published within the same second must supersede the older one")
+	}
+	n.Info.Length++
+	if n.Supersedes(&old) {
+		t.Error("notification of different content must not supersede")
+	}
+
+	// the buckets are stable and spread over 0-99
+	count := 0
+	for i := 0; i < 1000; i++ {
+		pid := PeerID{0, 0, 0, 0, byte(i >> 8), byte(i)}
+		b := rolloutBucket(pid, old.UUID)
+		if b != rolloutBucket(pid, old.UUID) || b < 0 || b > 99 {
+			t.Fatalf("invalid bucket %d", b)
+		}
+		if old.InRollout(b) {
+			count++
+		}
+	}
+	if count < 20 || count > 80 {
+		t.Errorf("%d of 1000 peers are in 5%% rollout", count)
+	}
+	if !(&Notification{}).InRollout(99) {
+		t.Error("notification without rollout must be deployed everywhere")
+	}
+}
+
+func TestNotificationTrackerless(t *testing.T) {
+	n := Notification{Announce: DefaultTracker}
+	if n.Trackerless() {
+		t.Error("update with a tracker is not trackerless")
+	}
+	n.Announce = ""
+	if !n.Trackerless() {
+		t.Error("update without a tracker is trackerless")
+	}
+	mi, err := n.torrentMetainfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mi.Announce) > 0 || len(mi.AnnounceList) > 0 {
+		t.Errorf("trackerless metainfo announces to %s %v", mi.Announce, mi.AnnounceList)
+	}
+	if info, err := mi.UnmarshalInfo(); err != nil || info.Private != nil {
+		t.Errorf("trackerless metainfo must not be private - %v", err)
+	}
+}
+
+func TestParsePieceLength(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"32k":     32 * 1024,
+		"1M":      1024 * 1024,
+		"16384":   16 * 1024,
+		" 16m ":   16 * 1024 * 1024,
+		"65536":   64 * 1024,
+		"2m":      2 * 1024 * 1024,
+		"1048576": 1024 * 1024,
+	} {
+		if n, err := ParsePieceLength(s); err != nil || n != expected {
+			t.Errorf("%s: got %d, expected %d - %v", s, n, expected, err)
+		}
+	}
+	for _, s := range []string{"", "k", "8k", "32m", "48k", "1g", "-32k", "32kb"} {
+		if n, err := ParsePieceLength(s); err == nil {
+			t.Errorf("%s: invalid piece length is parsed as %d", s, n)
+		}
+	}
+}
+
+func TestNotificationReproducible(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "p2pupdate-reproducible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// two checkouts of the same sources whose files are created in
+	// different orders
+	names := []string{"main.sh", "lib/b.sh", "lib/a.sh", "z.txt"}
+	build := func(checkout string, order []int) *Notification {
+		root := filepath.Join(tmp, checkout, "payload")
+		for _, i := range order {
+			p := filepath.Join(root, filepath.FromSlash(names[i]))
+			os.MkdirAll(filepath.Dir(p), 0755)
+			if err := ioutil.WriteFile(p, bytes.Repeat([]byte(names[i]), 5000), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := NewNotification(root, UUIDShell, 7, "", MinPieceLength, DefaultExcludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.CreationDate = 0
+		if err = n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		// the signatures differ per key
+		n.Signatures = nil
+		return n
+	}
+	n1, n2 := build("a", []int{0, 1, 2, 3}), build("b", []int{3, 2, 1, 0})
+
+	b1, err1 := bencode.EncodeBytes(n1)
+	b2, err2 := bencode.EncodeBytes(n2)
+	if err1 != nil || err2 != nil || !bytes.Equal(b1, b2) {
+		t.Errorf("unsigned notifications differ: %v %v", err1, err2)
+	}
+	h1, err1 := n1.InfoHash()
+	h2, err2 := n2.InfoHash()
+	if err1 != nil || err2 != nil || h1 != h2 {
+		t.Errorf("infohashes differ %s %s: %v %v", h1.HexString(), h2.HexString(), err1, err2)
+	}
+
+	root := filepath.Join(tmp, "a", "payload")
+	if err = checkReproducible(root, nil); err != nil {
+		t.Errorf("regular payload is not reproducible: %v", err)
+	}
+	if err = os.Symlink("z.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkReproducible(root, nil); err == nil {
+		t.Error("symlink must not be reproducible")
+	}
+	if err = checkReproducible(root, []string{"link"}); err != nil {
+		t.Errorf("excluded symlink must be ignored: %v", err)
+	}
+}
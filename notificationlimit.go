@@ -0,0 +1,167 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// The defaults of the rate limit of the notifications of a peer.
+	notificationDefaultRate    = 1
+	notificationDefaultBurst   = 10
+	notificationDefaultSustain = 30 // in seconds
+
+	// notificationMaxSources is the number of tracked peers that triggers
+	// removing the idle ones.
+	notificationMaxSources = 1024
+)
+
+// NotificationRateConfig holds the configurations of the rate limit of the
+// signed messages, i.e. notifications and operator messages, that a peer
+// sends to the agent, whose verification is expensive on small devices. The
+// messages of the server are not limited.
+type NotificationRateConfig struct {
+	// Rate is the number of messages per second of a peer, unlimited if 0,
+	// and Burst the size of its token bucket.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	// Sustain is the time in seconds after which a peer over the limit
+	// feeds the blacklist with every dropped message.
+	Sustain int `json:"sustain"`
+}
+
+// DefaultNotificationRateConfig returns the default rate limit of the
+// notifications of a peer.
+func DefaultNotificationRateConfig() NotificationRateConfig {
+	return NotificationRateConfig{
+		Rate:    notificationDefaultRate,
+		Burst:   notificationDefaultBurst,
+		Sustain: notificationDefaultSustain,
+	}
+}
+
+// notificationLimiter limits the signed messages per peer. It is safe for
+// concurrent use, and a nil notificationLimiter limits nothing.
+type notificationLimiter struct {
+	sync.Mutex
+	cfg     NotificationRateConfig
+	sources map[PeerID]*notificationSource
+}
+
+type notificationSource struct {
+	limiter *rate.Limiter
+	seen    time.Time
+	over    time.Time // since when the peer is over the limit, zero otherwise
+}
+
+func newNotificationLimiter(cfg NotificationRateConfig) *notificationLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = notificationDefaultBurst
+	}
+	return &notificationLimiter{
+		cfg:     cfg,
+		sources: make(map[PeerID]*notificationSource),
+	}
+}
+
+// Allow returns true if a message of given peer can be verified now, or else
+// how long the peer has been over the limit.
+func (l *notificationLimiter) Allow(pid PeerID, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	if len(l.sources) >= notificationMaxSources {
+		// a peer idle for that long has a full bucket again
+		idle := time.Duration(float64(l.cfg.Burst) / l.cfg.Rate * float64(time.Second))
+		for k, s := range l.sources {
+			if now.Sub(s.seen) > idle {
+				delete(l.sources, k)
+			}
+		}
+	}
+	s, ok := l.sources[pid]
+	if !ok {
+		if len(l.sources) >= notificationMaxSources {
+			return false, 0
+		}
+		s = &notificationSource{limiter: rate.NewLimiter(rate.Limit(l.cfg.Rate), l.cfg.Burst)}
+		l.sources[pid] = s
+	}
+	s.seen = now
+	if s.limiter.AllowN(now, 1) {
+		s.over = time.Time{}
+		return true, 0
+	}
+	if s.over.IsZero() {
+		s.over = now
+	}
+	return false, now.Sub(s.over)
+}
+
+// admitMessage returns true if the signed message of given overlay message
+// can be verified now. Otherwise it is dropped and counted, and the sender
+// fails in the blacklist if it has been over the limit for the sustained
+// period.
+func (a *Agent) admitMessage(msg *OverlayMessage) bool {
+	if msg.FromServer {
+		return true
+	}
+	ok, over := a.notificationLimiter.Allow(msg.Sender, time.Now())
+	if ok {
+		return true
+	}
+	metrics.Inc("overlay.messages", "type", "rate-limited")
+	if over == 0 {
+		log.Printf("readOverlay - peer %s exceeds the rate of notifications, dropping its messages", msg.Sender)
+	} else if over >= time.Duration(a.Config.Overlay.NotificationRate.Sustain)*time.Second {
+		a.Overlay.Blacklist().Failure(peerSource(msg.Sender))
+	}
+	return false
+}
+
+// knownNotification returns true if given notification is the one of an
+// update, which has been verified already, hence the copies gossiped by the
+// peers are dropped cheaply.
+func (a *Agent) knownNotification(n *Notification) bool {
+	sig, ok := n.Signatures[signatureName]
+	if !ok {
+		return false
+	}
+	a.RLock()
+	updates := make([]*Update, 0, len(a.updates))
+	for _, u := range a.updates {
+		updates = append(updates, u)
+	}
+	a.RUnlock()
+	for _, u := range updates {
+		u.RLock()
+		known, ok := u.Notification.Signatures[signatureName]
+		same := ok && u.Notification.UUID == n.UUID && u.Notification.Version == n.Version &&
+			bytes.Equal(known.Signature, sig.Signature)
+		u.RUnlock()
+		if same {
+			return true
+		}
+	}
+	return false
+}
+
+// sameUDPAddr returns true if given addresses are the same.
+func sameUDPAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNotificationLimiter(t *testing.T) {
+	l := newNotificationLimiter(NotificationRateConfig{Rate: 1, Burst: 2})
+	a, b := PeerID{1}, PeerID{2}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(a, now); !ok {
+			t.Fatal("burst is limited")
+		}
+	}
+	if ok, over := l.Allow(a, now); ok || over != 0 {
+		t.Errorf("peer over the limit is allowed (%v, %v)", ok, over)
+	}
+	if ok, over := l.Allow(a, now.Add(500*time.Millisecond)); ok || over != 500*time.Millisecond {
+		t.Errorf("unexpected time over the limit %v", over)
+	}
+	if ok, _ := l.Allow(b, now); !ok {
+		t.Error("peers share a bucket")
+	}
+	if ok, _ := l.Allow(a, now.Add(time.Second)); !ok {
+		t.Error("peer is limited once its bucket is refilled")
+	}
+	if ok, over := l.Allow(a, now.Add(time.Second)); ok || over != 0 {
+		t.Errorf("time over the limit is not reset (%v, %v)", ok, over)
+	}
+	if newNotificationLimiter(NotificationRateConfig{}) != nil {
+		t.Error("limiter without rate is not disabled")
+	}
+	var unlimited *notificationLimiter
+	if ok, _ := unlimited.Allow(a, now); !ok {
+		t.Error("nil limiter limits")
+	}
+}
+
+func TestAdmitMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Overlay.NotificationRate = NotificationRateConfig{Rate: 0.001, Burst: 1, Sustain: 0}
+	cfg.Overlay.Blacklist.Threshold = 3
+	a := &Agent{
+		Config:              &cfg,
+		Overlay:             &OverlayConn{blacklist: NewBlacklist(cfg.Overlay.Blacklist)},
+		notificationLimiter: newNotificationLimiter(cfg.Overlay.NotificationRate),
+	}
+	msg := &OverlayMessage{Sender: PeerID{1}}
+	if !a.admitMessage(msg) {
+		t.Fatal("first message is dropped")
+	}
+	// the sustained period is zero, hence every dropped message fails
+	for i := 0; i < 4; i++ {
+		if a.admitMessage(msg) {
+			t.Fatal("message over the limit is admitted")
+		}
+	}
+	if !a.Overlay.Blacklist().Blocked(peerSource(msg.Sender)) {
+		t.Error("peer over the limit is not blacklisted")
+	}
+
+	// the burst of the server replaying its notifications is not limited
+	fromServer := &OverlayMessage{Sender: PeerID{2}, Replay: true, FromServer: true}
+	for i := 0; i < 10; i++ {
+		if !a.admitMessage(fromServer) {
+			t.Fatal("message of the server is dropped")
+		}
+	}
+	// while the replay flag of a peer is not trusted
+	replayed := &OverlayMessage{Sender: PeerID{3}, Replay: true}
+	if !a.admitMessage(replayed) || a.admitMessage(replayed) {
+		t.Error("replayed message of a peer is not limited")
+	}
+
+	server := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3478}
+	if !sameUDPAddr(server, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3478}) ||
+		sameUDPAddr(server, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3479}) ||
+		sameUDPAddr(server, nil) {
+		t.Error("server address is not matched")
+	}
+}
+
+func TestKnownNotification(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := Notification{UUID: "4d4e1a1c-7f3c-4d2a-9d3e-2b3c4d5e6f70", Version: 2}
+	if err = n.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{updates: map[string]*Update{n.UUID: {Notification: n}}}
+	copied := n
+	if !a.knownNotification(&copied) {
+		t.Error("copy of a verified notification is unknown")
+	}
+	// a re-published notification, e.g. with a wider rollout, is verified
+	republished := n
+	republished.RolloutPercent = 50
+	if err = republished.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	newer := n
+	newer.Version = 3
+	unsigned := n
+	unsigned.Signatures = nil
+	for _, other := range []Notification{republished, newer, unsigned} {
+		if a.knownNotification(&other) {
+			t.Errorf("notification %+v is known", other)
+		}
+	}
+}
+
+// BenchmarkNotificationFlood measures the cost per message of a peer
+// flooding the agent with notifications signed by another key, each of which
+// would be verified without the rate limit.
+func BenchmarkNotificationFlood(b *testing.B) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := Notification{UUID: "4d4e1a1c-7f3c-4d2a-9d3e-2b3c4d5e6f70", Version: 1}
+	if err = n.Sign(forger); err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name string
+		rate NotificationRateConfig
+	}{
+		{"unlimited", NotificationRateConfig{}},
+		{"limited", DefaultNotificationRateConfig()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.Overlay.NotificationRate = bench.rate
+			a := &Agent{
+				Config:              &cfg,
+				Overlay:             &OverlayConn{},
+				notificationLimiter: newNotificationLimiter(bench.rate),
+			}
+			msg := &OverlayMessage{Sender: PeerID{1}}
+			verified := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if a.admitMessage(msg) {
+					n.Verify(&key.PublicKey)
+					verified++
+				}
+			}
+			b.ReportMetric(float64(verified)/float64(b.N), "verifications/op")
+		})
+	}
+}
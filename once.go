@@ -0,0 +1,86 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// DefaultOnceDuration is the default time budget of a single run in
+	// seconds.
+	DefaultOnceDuration = 600
+
+	// ExitWorkRemains is the exit code of a single run that left updates
+	// to be downloaded or deployed, i.e. EX_TEMPFAIL of sysexits.h.
+	ExitWorkRemains = 75
+)
+
+// RunOnce runs the agent once for the nodes woken up by cron: it pulls the
+// notifications stored on the server, downloads and deploys what it can
+// within given budget, saves the state of the updates and stops the agent.
+// The torrent client keeps the completion of the pieces in the data
+// directory, hence a partial download resumes on the next run. The updates
+// are only seeded during the run. It returns the number of updates that
+// still have to be downloaded or deployed.
+func (a *Agent) RunOnce(budget time.Duration) int {
+	deadline := time.Now().Add(budget)
+	log.Printf("running once for at most %v", budget)
+	if err := a.readTCP(); err != nil {
+		log.Printf("WARNING: only the known updates are processed - %v", err)
+	}
+
+	busy, remaining := a.onceWork()
+	for busy > 0 && time.Now().Before(deadline) && !a.stopped() {
+		select {
+		case <-a.quit:
+		case <-time.After(time.Second):
+		}
+		busy, remaining = a.onceWork()
+	}
+	if busy > 0 {
+		log.Printf("time budget of %v exhausted, %d updates in progress", budget, busy)
+	}
+
+	// a deployment in progress completes before its update stops
+	for _, uuid := range a.getUpdateUUIDs() {
+		u := a.getUpdate(uuid)
+		if u == nil {
+			continue
+		}
+		u.Stop()
+		if err := u.Save(); err != nil {
+			log.Printf("failed saving update uuid:%s - %v", uuid, err)
+		}
+	}
+	_, remaining = a.onceWork()
+	a.torrentClient.Close()
+	a.Stop()
+	log.Printf("ran once, %d updates remain", remaining)
+	return remaining
+}
+
+// onceWork returns the number of updates that are progressing, i.e. being
+// downloaded or deployed, and the number of updates whose work remains,
+// including the ones held until a later run.
+func (a *Agent) onceWork() (busy int, remaining int) {
+	for _, s := range a.updateStatuses() {
+		switch s.State {
+		case UpdatePending, UpdateDownloading:
+			busy++
+			remaining++
+		case UpdateDownloaded, UpdateDeploying:
+			// a proxy does not deploy the updates
+			if !a.Config.Proxy {
+				busy++
+				remaining++
+			}
+		case UpdateWaiting, UpdateBlocked, UpdateAwaitingApproval:
+			remaining++
+		}
+	}
+	return busy, remaining
+}
@@ -5,6 +5,8 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -18,24 +20,55 @@ import (
 
 var (
 	errConnNotOpened = errors.New("connection is not opened")
+	errPeerNotFound  = errors.New("peer is not in the session table")
 	errNotReady      = errors.New("overlay is not ready")
 	errBufferFull    = errors.New("data buffer is full")
+	errOverlayClosed = errors.New("overlay is closed")
+	errTTLExpired    = errors.New("TTL of the message has expired")
+	errBlacklisted   = errors.New("sender is blacklisted")
 )
 
+// OverlayMessage is a data message received from the overlay.
+type OverlayMessage struct {
+	Data   []byte
+	Sender PeerID
+	TTL    TTL
+	Replay ReplayFlag // replayed by the server
+
+	// FromServer=true if the message is sent from the address of the
+	// server, e.g. replayed or queued, which is not rate-limited
+	FromServer bool
+
+	// the message is answered if it is a data request, or a message queued
+	// by the server whose ID is not zero, hence its transaction ID and the
+	// address of its sender are kept
+	ID          MessageID
+	Request     bool
+	Transaction [stun.TransactionIDSize]byte
+	Addr        *net.UDPAddr
+}
+
 type overlayUDPConn struct {
+	sync.Mutex
 	conn           *net.UDPConn
 	rendezvousAddr *net.UDPAddr
 }
 
-func newOverlayUDPConn(rendezvousAddr, localAddr *net.UDPAddr) (*overlayUDPConn, error) {
+func newOverlayUDPConn(rendezvousAddr, localAddr *net.UDPAddr, device string) (*overlayUDPConn, error) {
 	var (
-		conn *net.UDPConn
-		err  error
+		conn  *net.UDPConn
+		laddr string
 	)
 
-	if conn, err = net.ListenUDP("udp", localAddr); err != nil {
+	if localAddr != nil {
+		laddr = localAddr.String()
+	}
+	lc := net.ListenConfig{Control: bindControl(device)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", laddr)
+	if err != nil {
 		return nil, errors.Wrap(err, "failed creating UDP connection")
 	}
+	conn = pc.(*net.UDPConn)
 	log.Println("connection is opened at", conn.LocalAddr().String())
 	return &overlayUDPConn{
 		conn:           conn,
@@ -54,7 +87,18 @@ func (oc *overlayUDPConn) Write(p []byte) (n int, err error) {
 	if oc.conn == nil {
 		return -1, errConnNotOpened
 	}
-	return oc.conn.WriteToUDP(p, oc.rendezvousAddr)
+	oc.Lock()
+	addr := oc.rendezvousAddr
+	oc.Unlock()
+	return oc.conn.WriteToUDP(p, addr)
+}
+
+// setRendezvousAddr sets the address of the server that the STUN client
+// writes to, on failover.
+func (oc *overlayUDPConn) setRendezvousAddr(addr *net.UDPAddr) {
+	oc.Lock()
+	oc.rendezvousAddr = addr
+	oc.Unlock()
 }
 
 func (oc *overlayUDPConn) Close() error {
@@ -68,6 +112,7 @@ func (oc *overlayUDPConn) Close() error {
 type OverlayConfig struct {
 	Address             string        `json:"address,omitempty"`
 	Server              string        `json:"server,omitempty"`
+	Servers             []string      `json:"servers,omitempty"`
 	StunPassword        string        `json:"stun-password"`
 	BindingWait         time.Duration `json:"binding-wait"`
 	BindingMaxErrors    int           `json:"binding-max-errors"`
@@ -77,7 +122,39 @@ type OverlayConfig struct {
 	ErrorBackoff        time.Duration `json:"error-backoff"`
 	ChannelLifespan     time.Duration `json:"channel-lifespan"`
 
+	// ServerPolicy is the registration with the servers if there are
+	// several, ServerPolicyStandby or ServerPolicyAll. The standby servers
+	// receive a keep-alive every StandbyInterval seconds, which is
+	// standbyIntervalFactor times ChannelLifespan if 0.
+	ServerPolicy    string        `json:"server-policy"`
+	StandbyInterval time.Duration `json:"standby-interval"`
+
+	// TTL is the hop-count of data messages originated by this peer
+	TTL TTL `json:"ttl"`
+
+	// Blacklist of peers that repeatedly send invalid messages
+	Blacklist BlacklistConfig `json:"blacklist"`
+
+	// Probe is the liveness probing of the peers in use
+	Probe ProbeConfig `json:"probe"`
+
+	// Compression of the data messages
+	Compression CompressionConfig `json:"compression"`
+
+	// NotificationRate limits the signed messages of a peer verified by the
+	// agent
+	NotificationRate NotificationRateConfig `json:"notification-rate"`
+
+	// AddressChange limits the reactions to the changes of the external
+	// address
+	AddressChange AddressChangeConfig `json:"address-change"`
+
 	torrentPorts TorrentPorts
+	torrentIPv6  TorrentIPv6
+	bindDevice   string
+	tags         PeerTags
+	extID        ExtendedPeerID
+	identity     *PeerIdentity
 }
 
 // OverlayConn is an implementation of net.Conn interface for a overlay network
@@ -86,14 +163,36 @@ type OverlayConfig struct {
 type OverlayConn struct {
 	sync.RWMutex
 
+	// ID is the short form of the peer ID on the wire, which is replaced by
+	// the one assigned by the server if it collides with another peer, hence
+	// it is read with LocalID.
 	ID     PeerID
+	ExtID  ExtendedPeerID
 	Reopen bool
 	Config *OverlayConfig
 
-	rendezvousAddr *net.UDPAddr
+	idLock sync.Mutex
+
+	// Events records the errors of the overlay and the changes of the
+	// session table if it is set.
+	Events *EventRing
+
+	// Clock is checked with the time sent by the server if it is set.
+	Clock *ClockCheck
+
+	// AddressChanged is called when the external address has changed, if
+	// it is set.
+	AddressChanged func(old, new *net.UDPAddr)
+
+	rendezvousAddr *net.UDPAddr // of the primary server
 	localAddr      *net.UDPAddr
 	externalAddr   *net.UDPAddr
-	xorAddr        stun.XORMappedAddress
+	addrChanges    addressChanges
+
+	servers    []*rendezvousServer // in order of preference
+	primary    int                 // index of the primary server
+	serverData map[[sha256.Size]byte]relayedData
+	xorAddr    stun.XORMappedAddress
 
 	automata *Automata
 	conn     *overlayUDPConn
@@ -104,21 +203,38 @@ type OverlayConn struct {
 	msg            []byte
 	senderAddr     *net.UDPAddr
 	peers          SessionTable
-	peerDataChan   chan []byte
+	pendingPeers   SessionTable // the pages of a session table refresh
+	peerTags       SessionTags
+	pendingTags    SessionTags
+	peerExtIDs     SessionExtIDs
+	pendingExtIDs  SessionExtIDs
+	peerKeys       SessionKeys // to verify the messages of the peers
+	pendingKeys    SessionKeys
+	pendingOffset  int
+	peerDataChan   chan OverlayMessage
+	blacklist      *Blacklist
+	validation     *ValidationStats
+	liveness       map[PeerID]*PeerLiveness
+	pings          map[[stun.TransactionIDSize]byte]chan struct{} // awaited ping responses
+	reports        map[[stun.TransactionIDSize]byte]chan error    // awaited report responses
 
 	readDeadline  *time.Time
 	writeDeadline *time.Time
 
 	stopSendingKeepAlive chan struct{}
+	stopProbing          chan struct{}
+	done                 chan struct{}
+	closeOnce            sync.Once
 }
 
 // NewOverlayConn creates an overlay peer-to-peer connection that implements STUN
 // punching hole technique to directly communicate to peers behind NATs.
 func NewOverlayConn(cfg OverlayConfig) (*OverlayConn, error) {
 	var (
-		serverAddr, localAddr *net.UDPAddr
-		pid                   *PeerID
-		err                   error
+		servers   []*rendezvousServer
+		localAddr *net.UDPAddr
+		pid       *PeerID
+		err       error
 	)
 
 	j, _ := json.Marshal(cfg)
@@ -127,21 +243,40 @@ func NewOverlayConn(cfg OverlayConfig) (*OverlayConn, error) {
 	if pid, err = LocalPeerID(); err != nil {
 		return nil, errors.Wrap(err, "failed to get local ID")
 	}
-	log.Printf("local peer ID: %s", pid.String())
-	if serverAddr, err = net.ResolveUDPAddr("udp", cfg.Server); err != nil {
-		return nil, fmt.Errorf("Cannot resolve server address: %v", err)
+	ext := cfg.extID
+	if ext.IsZero() {
+		if ext, err = LocalExtendedPeerID(*pid); err != nil {
+			log.Printf("WARNING: extended peer ID is not available: %v", err)
+		}
+	}
+	log.Printf("local peer ID: %s extended:%s", pid, ext)
+	names := cfg.Servers
+	if len(names) == 0 {
+		names = []string{cfg.Server}
+	}
+	if servers, err = newRendezvousServers(names); err != nil {
+		return nil, err
 	}
 	if localAddr, err = net.ResolveUDPAddr("udp", cfg.Address); err != nil {
 		return nil, fmt.Errorf("Cannot resolve local address: %v", err)
 	}
 	overlay := &OverlayConn{
 		ID:             *pid,
+		ExtID:          ext,
 		Reopen:         true,
 		Config:         &cfg,
-		rendezvousAddr: serverAddr,
+		rendezvousAddr: servers[0].addr,
 		localAddr:      localAddr,
+		servers:        servers,
 		peers:          make(SessionTable),
-		peerDataChan:   make(chan []byte, 16),
+		peerTags:       make(SessionTags),
+		peerExtIDs:     make(SessionExtIDs),
+		peerKeys:       make(SessionKeys),
+		peerDataChan:   make(chan OverlayMessage, 16),
+		blacklist:      NewBlacklist(cfg.Blacklist),
+		validation:     NewValidationStats("overlay.validation_failures"),
+		liveness:       make(map[PeerID]*PeerLiveness),
+		done:           make(chan struct{}),
 	}
 	overlay.createAutomata()
 	overlay.automata.Event(eventOpen)
@@ -149,20 +284,14 @@ func NewOverlayConn(cfg OverlayConfig) (*OverlayConn, error) {
 	j, _ = json.Marshal(overlay.Config)
 	log.Printf("created overlayconn with config: %s", string(j))
 
-	msg, err := stun.Build(
-		stun.TransactionID,
-		stunChannelBindIndication,
-		&overlay.ID,
-		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
-		stun.Fingerprint,
-	)
-	if err != nil {
-		return nil, err
-	}
-
 	overlay.stopSendingKeepAlive = ExecEvery(
 		time.Duration(cfg.ChannelLifespan)*time.Second,
-		overlay.sendKeepAlive(msg))
+		overlay.sendKeepAlive)
+	if cfg.Probe.Interval > 0 {
+		overlay.stopProbing = ExecEvery(
+			time.Duration(cfg.Probe.Interval)*time.Second,
+			overlay.probePeers)
+	}
 
 	return overlay, nil
 }
@@ -188,6 +317,11 @@ func (overlay *OverlayConn) createAutomata() {
 			Transition{Src: stateProcessingMessage, Event: eventError, Dest: stateMessageError},
 			Transition{Src: stateMessageError, Event: eventUnderLimit, Dest: stateListening},
 			Transition{Src: stateMessageError, Event: eventOverLimit, Dest: stateBinding},
+			Transition{Src: stateOpening, Event: eventClose, Dest: stateClosed},
+			Transition{Src: stateBinding, Event: eventClose, Dest: stateClosed},
+			Transition{Src: stateBindError, Event: eventClose, Dest: stateClosed},
+			Transition{Src: stateProcessingMessage, Event: eventClose, Dest: stateClosed},
+			Transition{Src: stateMessageError, Event: eventClose, Dest: stateClosed},
 		},
 		callbacks{
 			stateOpening:           overlay.opening,
@@ -218,22 +352,37 @@ func (overlay *OverlayConn) closed([]interface{}) {
 	overlay.conn = nil
 	overlay.stun = nil
 	overlay.errCount = 0
+	reopen := overlay.Reopen
 	overlay.Unlock()
 	log.Println("closed")
 
-	if overlay.Reopen {
+	if reopen {
 		log.Println("reopen")
 		overlay.automata.Event(eventOpen)
 	} else {
-		overlay.stopSendingKeepAlive <- struct{}{}
 		log.Println("overlay is stopped")
 	}
 }
 
+// isClosing returns true if Close has been invoked.
+func (overlay *OverlayConn) isClosing() bool {
+	select {
+	case <-overlay.done:
+		return true
+	default:
+		return false
+	}
+}
+
 func (overlay *OverlayConn) opening([]interface{}) {
 	var err error
 
-	if overlay.conn, err = newOverlayUDPConn(overlay.rendezvousAddr, overlay.localAddr); err != nil {
+	if overlay.isClosing() {
+		overlay.automata.Event(eventClose)
+		return
+	}
+	if overlay.conn, err = newOverlayUDPConn(overlay.rendezvousAddr, overlay.localAddr,
+		overlay.Config.bindDevice); err != nil {
 		log.Printf("failed opening UDP connection (backing off for %v): %v",
 			overlay.Config.ErrorBackoff*time.Second, err)
 		time.Sleep(overlay.Config.ErrorBackoff * time.Second)
@@ -263,16 +412,26 @@ func (overlay *OverlayConn) binding([]interface{}) {
 		err error
 	)
 
+	overlay.RLock()
+	conn, client := overlay.conn, overlay.stun
+	overlay.RUnlock()
+	if conn == nil || client == nil || overlay.isClosing() {
+		overlay.automata.Event(eventClose)
+		return
+	}
+
 	deadline := time.Now().Add(overlay.Config.BindingWait * time.Second)
 
 	handler := stun.HandlerFunc(func(e stun.Event) {
 		if e.Error != nil {
 			log.Println("bindingError", e.Error)
+			overlay.Events.Add(AgentEvent{Type: EventOverlayError, Error: e.Error.Error()})
 			overlay.automata.Event(eventError)
 		} else if e.Message == nil {
 			log.Println("bindingError", errors.New("bindReq received an empty message"))
 			overlay.automata.Event(eventError)
 		} else if err := validateMessage(e.Message, &stun.BindingSuccess, overlay.Config.StunPassword); err != nil {
+			overlay.validation.Failure(addrSource(overlay.rendezvousAddr), err)
 			log.Println("bindingError", errors.Wrap(err, "bindReq received an invalid message:"))
 			overlay.automata.Event(eventError)
 		} else if err = overlay.xorAddr.GetFrom(e.Message); err != nil {
@@ -282,30 +441,35 @@ func (overlay *OverlayConn) binding([]interface{}) {
 			log.Println("failed updating session table:", err)
 			overlay.automata.Event(eventError)
 		} else {
-			overlay.externalAddr, _ = net.ResolveUDPAddr("udp", overlay.xorAddr.String())
+			addr, _ := net.ResolveUDPAddr("udp", overlay.xorAddr.String())
+			overlay.setExternalAddr(addr, false)
 			log.Println("XORMappedAddress", overlay.xorAddr)
-			log.Println("LocalAddr", overlay.conn.conn.LocalAddr())
+			log.Println("LocalAddr", conn.conn.LocalAddr())
 			log.Println("bindingSuccess")
+			overlay.primaryReplied()
 			overlay.channelExpired = time.Now().Add(overlay.Config.ChannelLifespan * time.Second)
 			overlay.automata.Event(eventSuccess)
 		}
 	})
 
-	if err = overlay.conn.conn.SetDeadline(deadline); err != nil {
+	if err = conn.conn.SetDeadline(deadline); err != nil {
 		log.Println("failed setting connection read/write deadline")
 		overlay.automata.Event(eventError)
-	} else if msg, err = overlay.bindingRequestMessage(); err != nil {
+	} else if msg, err = overlay.bindingRequestMessage(conn, 0); err != nil {
 		log.Println("failed building bindingRequestMessage", err)
 		overlay.automata.Event(eventError)
-	} else if err = overlay.stun.Start(msg, deadline, handler); err != nil {
+	} else if err = client.Start(msg, deadline, handler); err != nil {
 		log.Println("binding failed:", err)
+		overlay.Events.Add(AgentEvent{Type: EventOverlayError, Error: err.Error()})
 		overlay.automata.Event(eventError)
 	}
 }
 
-func (overlay *OverlayConn) bindingRequestMessage() (*stun.Message, error) {
+// bindingRequestMessage builds a binding request that asks the server for the
+// page of the session table at given offset.
+func (overlay *OverlayConn) bindingRequestMessage(conn *overlayUDPConn, offset SessionOffset) (*stun.Message, error) {
 	var (
-		laddr   = overlay.conn.conn.LocalAddr()
+		laddr   = conn.conn.LocalAddr()
 		addr    *net.UDPAddr
 		xorAddr stun.XORMappedAddress
 		err     error
@@ -317,12 +481,19 @@ func (overlay *OverlayConn) bindingRequestMessage() (*stun.Message, error) {
 	xorAddr.IP = addr.IP
 	xorAddr.Port = addr.Port
 
+	overlay.Clock.RequestSent()
 	return stun.Build(
 		stun.TransactionID,
 		stun.BindingRequest,
 		xorAddr,
 		&overlay.Config.torrentPorts,
-		&overlay.ID,
+		overlay.Config.torrentIPv6,
+		overlay.Config.tags,
+		overlay.ExtID,
+		offset,
+		overlay.localIDAttr(),
+		overlay.Config.identity.Cert(),
+		overlay.Config.identity.Signature(),
 		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
 		stun.Fingerprint,
 	)
@@ -332,9 +503,15 @@ func (overlay *OverlayConn) bindError([]interface{}) {
 	overlay.errCount++
 	if overlay.errCount >= overlay.Config.BindingMaxErrors {
 		overlay.errCount = 0
-		time.Sleep(overlay.Config.ErrorBackoff * time.Second)
+		// the next server is tried even if it is not known to be reachable
+		if !overlay.failover(true) {
+			time.Sleep(overlay.Config.ErrorBackoff * time.Second)
+		}
 		overlay.automata.Event(eventOverLimit)
 	} else {
+		if overlay.failover(false) {
+			overlay.errCount = 0
+		}
 		overlay.automata.Event(eventUnderLimit)
 	}
 }
@@ -348,12 +525,22 @@ func (overlay *OverlayConn) listening([]interface{}) {
 		err  error
 	)
 
-	if err = overlay.conn.conn.SetDeadline(overlay.channelExpired); err != nil {
+	overlay.RLock()
+	conn := overlay.conn
+	overlay.RUnlock()
+	if conn == nil || overlay.isClosing() {
+		overlay.automata.Event(eventClose)
+		return
+	}
+
+	if err = conn.conn.SetDeadline(overlay.channelExpired); err != nil {
 		log.Printf("failed to set read deadline: %v", err)
 		overlay.automata.Event(eventError)
-	} else if n, addr, err = overlay.conn.conn.ReadFromUDP(buf); err != nil {
+	} else if n, addr, err = conn.conn.ReadFromUDP(buf); err != nil {
 		log.Printf("failed to read the message: %v", err)
-		if time.Now().After(overlay.channelExpired) {
+		if overlay.isClosing() {
+			overlay.automata.Event(eventClose)
+		} else if time.Now().After(overlay.channelExpired) {
 			overlay.automata.Event(eventChannelExpired)
 		} else {
 			overlay.automata.Event(eventError)
@@ -366,17 +553,47 @@ func (overlay *OverlayConn) listening([]interface{}) {
 }
 
 func (overlay *OverlayConn) parseHeader(req *stun.Message) (*PeerID, error) {
+	addr := addrSource(overlay.senderAddr)
+	if overlay.blacklist.Blocked(addr) {
+		return nil, errBlacklisted
+	}
 	if !stun.IsMessage(overlay.msg) {
-		return nil, fmt.Errorf("!!! %s sent a message that is not a STUN message", overlay.senderAddr)
+		overlay.blacklist.Failure(addr)
+		err := fmt.Errorf("!!! %s sent a message that is not a STUN message", overlay.senderAddr)
+		overlay.validation.Failure(addr, &ValidationError{ValidationMalformed, err})
+		return nil, err
 	} else if _, err := req.Write(overlay.msg); err != nil {
+		overlay.blacklist.Failure(addr)
+		overlay.validation.Failure(addr, &ValidationError{ValidationMalformed, err})
 		return nil, fmt.Errorf("failed to read message from %s: %v", overlay.senderAddr, err)
-	} else if err := validateMessage(req, nil, overlay.Config.StunPassword); err != nil {
-		return nil, fmt.Errorf("%s sent invalid STUN message: %v", overlay.senderAddr, err)
 	}
 
+	// the peer ID is checked before the validation to drop the messages of
+	// blacklisted peers cheaply
 	pid := new(PeerID)
 	if err := pid.GetFrom(req); err != nil {
+		overlay.blacklist.Failure(addr)
+		overlay.validation.Failure(addr, &ValidationError{ValidationUsername, err})
 		return nil, fmt.Errorf("failed to get peerID of %s: %v", overlay.senderAddr, err)
+	} else if overlay.blacklist.Blocked(peerSource(*pid)) {
+		return nil, errBlacklisted
+	}
+	if err := validateMessage(req, nil, overlay.Config.StunPassword); err != nil {
+		overlay.blacklist.Failure(addr)
+		overlay.validation.Failure(peerSource(*pid), err)
+		return nil, fmt.Errorf("%s sent invalid STUN message: %v", overlay.senderAddr, err)
+	}
+	// the messages of a peer whose key is known must be signed by it
+	overlay.RLock()
+	key := overlay.peerKeys[*pid]
+	overlay.RUnlock()
+	if key != nil {
+		if err := verifyPeerSignature(req, key); err != nil {
+			overlay.blacklist.Failure(addr)
+			overlay.validation.Failure(peerSource(*pid), &ValidationError{ValidationSignature, err})
+			metrics.Inc("overlay.peer_signature_failures")
+			return nil, fmt.Errorf("%s sent a message claiming peer ID %s: %v", overlay.senderAddr, pid, err)
+		}
 	}
 	return pid, nil
 }
@@ -388,23 +605,37 @@ func (overlay *OverlayConn) processingMessage([]interface{}) {
 		err error
 	)
 
-	if pid, err = overlay.parseHeader(&req); err != nil {
+	if pid, err = overlay.parseHeader(&req); err == errBlacklisted {
+		// dropped silently, the blacklisting has been logged once
+		overlay.automata.Event(eventSuccess)
+		return
+	} else if err != nil {
 		log.Println(err)
 		overlay.automata.Event(eventError)
 		return
 	}
+	overlay.serverReplied(overlay.senderAddr)
 
 	err = fmt.Errorf("!! %s[%s] sent a bad message - type:%v", pid, overlay.senderAddr, req.Type)
 	switch req.Type.Method {
 	case stun.MethodBinding:
 		switch req.Type.Class {
 		case stun.ClassSuccessResponse, stun.ClassIndication:
-			err = overlay.updateSessionTable(&req)
+			overlay.RLock()
+			standby := overlay.standbyAt(overlay.senderAddr)
+			overlay.RUnlock()
+			if standby != nil {
+				err = overlay.updateServerSession(&req, standby)
+			} else {
+				err = overlay.updateSessionTable(&req)
+			}
 		}
 	case stun.MethodData:
 		switch req.Type.Class {
-		case stun.ClassIndication:
+		case stun.ClassIndication, stun.ClassRequest:
 			err = overlay.peerDataIndication(pid, overlay.senderAddr, &req)
+		case stun.ClassSuccessResponse, stun.ClassErrorResponse:
+			err = overlay.peerDataResponse(pid, overlay.senderAddr, &req)
 		}
 	case stun.MethodChannelBind:
 		switch req.Type.Class {
@@ -412,16 +643,30 @@ func (overlay *OverlayConn) processingMessage([]interface{}) {
 			log.Printf("<- %s[%s] received channel bind indication", pid, overlay.senderAddr)
 			err = nil
 		}
+	case methodPing:
+		switch req.Type.Class {
+		case stun.ClassRequest:
+			err = overlay.pingRequest(pid, &req)
+		case stun.ClassSuccessResponse:
+			err = overlay.pingResponse(pid, &req)
+		}
 	}
 
 	if err == nil {
+		overlay.blacklist.Success(addrSource(overlay.senderAddr), peerSource(*pid))
 		overlay.automata.Event(eventSuccess)
 	} else {
+		if err != errBufferFull {
+			overlay.blacklist.Failure(peerSource(*pid))
+		}
 		log.Println(err)
+		overlay.Events.Add(AgentEvent{Type: EventOverlayError, Peer: pid.String(), Error: err.Error()})
 		overlay.automata.Event(eventError)
 	}
 }
 
+// peerDataIndication delivers the payload of a data indication, or of a data
+// request which is answered once its notification is handled.
 func (overlay *OverlayConn) peerDataIndication(pid *PeerID, addr *net.UDPAddr, req *stun.Message) error {
 	// TODO: handle multi-packets payload
 	var (
@@ -429,15 +674,52 @@ func (overlay *OverlayConn) peerDataIndication(pid *PeerID, addr *net.UDPAddr, r
 		err  error
 	)
 
-	if data, err = req.Get(stun.AttrData); err != nil {
-		return fmt.Errorf("%s[%s] sent an invalid data request", pid, addr)
+	if data, err = GetPayloadFrom(req); err != nil {
+		return fmt.Errorf("%s[%s] sent an invalid data request: %v", pid, addr, err)
 	}
-	select {
-	case overlay.peerDataChan <- data:
+	ttl := TTL(defaultTTL)
+	if err = ttl.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return fmt.Errorf("%s[%s] sent an invalid TTL: %v", pid, addr, err)
+	}
+	if ttl == 0 {
+		log.Printf("<- %s[%s] dropped data message whose TTL is zero", pid, addr)
+		metrics.Inc("overlay.messages", "type", "expired")
 		return nil
-	default:
-		return errBufferFull
 	}
+	var replay ReplayFlag
+	if err = replay.GetFrom(req); err != nil {
+		return fmt.Errorf("%s[%s] sent an invalid replay flag: %v", pid, addr, err)
+	}
+	var id MessageID
+	if err = id.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return fmt.Errorf("%s[%s] sent an invalid message ID: %v", pid, addr, err)
+	}
+	// the message of a peer relayed by the server is still the peer's one
+	overlay.RLock()
+	relayed := overlay.relayedBy(addr, *pid)
+	overlay.RUnlock()
+	// the payload is copied since the message buffer is reused
+	msg := OverlayMessage{Data: append([]byte(nil), data...), Sender: *pid, TTL: ttl, Replay: replay,
+		FromServer: !relayed && overlay.isServer(addr), ID: id,
+		Request: req.Type.Class == stun.ClassRequest, Transaction: req.TransactionID, Addr: addr}
+	if msg.FromServer && overlay.relayedByAnotherServer(addr, data) {
+		log.Printf("<- %s[%s] dropped data message relayed by another server", pid, addr)
+		metrics.Inc("overlay.messages", "type", "duplicate")
+	} else {
+		select {
+		case overlay.peerDataChan <- msg:
+		default:
+			return errBufferFull
+		}
+	}
+	// a message queued by the server is acknowledged once it is delivered,
+	// otherwise the server sends it again
+	if id != 0 {
+		if err = overlay.SendAck(id, addr); err != nil {
+			log.Printf("-> %s[%s] failed acknowledging message id:%d - %v", pid, addr, id, err)
+		}
+	}
+	return nil
 }
 
 func (overlay *OverlayConn) updateSessionTable(req *stun.Message) error {
@@ -445,50 +727,171 @@ func (overlay *OverlayConn) updateSessionTable(req *stun.Message) error {
 	if err != nil {
 		return errors.Wrap(err, "updateSessionTable - failed getting session table from message")
 	}
+	// the tags are optional since old servers do not send them
+	var tags SessionTags
+	if err = tags.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrap(err, "updateSessionTable - failed getting peer tags from message")
+	}
+	// and so are the extended IDs
+	var extIDs SessionExtIDs
+	if err = extIDs.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrap(err, "updateSessionTable - failed getting extended peer IDs from message")
+	}
+	// and so are the keys of the peers
+	var keys SessionKeys
+	if err = keys.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrap(err, "updateSessionTable - failed getting peer keys from message")
+	}
+	if req.Type == stun.BindingSuccess {
+		var assigned AssignedPeerID
+		if assigned.GetFrom(req) == nil {
+			overlay.assignID(PeerID(assigned))
+		}
+		// a keep-alive response maps the current external address
+		var mapped stun.XORMappedAddress
+		if mapped.GetFrom(req) == nil {
+			overlay.setExternalAddr(&net.UDPAddr{IP: mapped.IP, Port: mapped.Port}, true)
+		}
+		// old servers do not send their time
+		var st ServerTime
+		if st.GetFrom(req) == nil {
+			overlay.Clock.ServerTime(time.Time(st))
+			overlay.Clock.Synced()
+		}
+	}
 	overlay.Lock()
 	defer overlay.Unlock()
+
+	var offset SessionOffset
+	if req.Type != stun.BindingSuccess || offset.GetFrom(req) != nil {
+		// an advertisement, or a response of a server that does not paginate
+		for id, sess := range *st {
+			if _, ok := overlay.peers[id]; !ok {
+				overlay.Events.Add(AgentEvent{Type: EventPeerConnected, Peer: id.String()})
+			}
+			overlay.peers[id] = sess
+			setPeerTags(overlay.peerTags, id, tags[id])
+			setPeerExtID(overlay.peerExtIDs, id, extIDs[id])
+			setPeerKey(overlay.peerKeys, id, keys[id])
+		}
+		return nil
+	}
+
+	// a page of a refresh, which is assembled before replacing the table
+	if offset == 0 {
+		overlay.pendingPeers, overlay.pendingTags = make(SessionTable), make(SessionTags)
+		overlay.pendingExtIDs, overlay.pendingKeys = make(SessionExtIDs), make(SessionKeys)
+	} else if overlay.pendingPeers == nil || int(offset) != overlay.pendingOffset {
+		log.Printf("ignored session table page at offset %d, expected %d", offset, overlay.pendingOffset)
+		return nil
+	}
 	for id, sess := range *st {
-		overlay.peers[id] = sess
+		overlay.pendingPeers[id] = sess
+		setPeerTags(overlay.pendingTags, id, tags[id])
+		setPeerExtID(overlay.pendingExtIDs, id, extIDs[id])
+		setPeerKey(overlay.pendingKeys, id, keys[id])
 	}
+	var next SessionNext
+	if next.GetFrom(req) == nil && int(next) > int(offset) {
+		overlay.pendingOffset = int(next)
+		return overlay.requestSessionPage(SessionOffset(next))
+	}
+	overlay.mergeServerSessions(overlay.pendingPeers, overlay.pendingTags, overlay.pendingExtIDs, overlay.pendingKeys)
+	overlay.peerEvents(overlay.peers, overlay.pendingPeers)
+	overlay.peers, overlay.pendingPeers, overlay.pendingOffset = overlay.pendingPeers, nil, 0
+	overlay.peerTags, overlay.pendingTags = overlay.pendingTags, nil
+	overlay.peerExtIDs, overlay.pendingExtIDs = overlay.pendingExtIDs, nil
+	overlay.peerKeys, overlay.pendingKeys = overlay.pendingKeys, nil
 	return nil
 }
 
-func (overlay *OverlayConn) sendKeepAlive(msg *stun.Message) func() {
-	return func() {
-		log.Println("sending keep alive packet")
-		overlay.RLock()
-		defer overlay.RUnlock()
-		if overlay.conn == nil {
-			return
-		}
-		// send to server
-		if bindMsg, err := overlay.bindingRequestMessage(); err == nil {
-			overlay.conn.conn.WriteToUDP(bindMsg.Raw, overlay.rendezvousAddr)
-		}
-
-		// send to peers
-		state := overlay.automata.Current()
-		switch state {
-		case stateListening, stateProcessingMessage, stateMessageError:
-			for id, addrs := range overlay.peers {
-				if id == overlay.ID {
-					continue
-				}
-				addr := addrs[0]
-				if addr.IP.Equal(overlay.externalAddr.IP) {
-					addr = addrs[1]
-				}
-				_, err := overlay.conn.conn.WriteToUDP(msg.Raw, addr)
-				if err != nil {
-					log.Printf("WARNING: failed binding channel to %s[%s][%s] - %v",
-						id, addrs[0].String(), addrs[1].String(), err)
-				}
+// peerEvents records the peers that joined or left the session table when it
+// is refreshed from old to new.
+func (overlay *OverlayConn) peerEvents(old, new SessionTable) {
+	if overlay.Events == nil {
+		return
+	}
+	for id := range new {
+		if _, ok := old[id]; !ok {
+			overlay.Events.Add(AgentEvent{Type: EventPeerConnected, Peer: id.String()})
+		}
+	}
+	for id := range old {
+		if _, ok := new[id]; !ok {
+			overlay.Events.Add(AgentEvent{Type: EventPeerDisconnected, Peer: id.String()})
+		}
+	}
+}
+
+// requestSessionPage asks the primary server for the page of the session
+// table at given offset. The caller must hold the lock.
+func (overlay *OverlayConn) requestSessionPage(offset SessionOffset) error {
+	return overlay.requestServerPage(overlay.rendezvousAddr, offset)
+}
+
+// requestServerPage asks the server of given address for the page of the
+// session table at given offset. The caller must hold the lock.
+func (overlay *OverlayConn) requestServerPage(addr *net.UDPAddr, offset SessionOffset) error {
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	msg, err := overlay.bindingRequestMessage(overlay.conn, offset)
+	if err != nil {
+		return errors.Wrap(err, "failed building session table request")
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+	return err
+}
+
+// sendKeepAlive sends a binding request to the servers and a channel bind
+// indication to the peers, which is built on every run since the peer ID may
+// have been assigned by the server in the meantime. It fails over to another
+// server first if the primary has not answered the previous keep-alive.
+func (overlay *OverlayConn) sendKeepAlive() {
+	log.Println("sending keep alive packet")
+	now := time.Now()
+	overlay.Lock()
+	overlay.checkServers(now)
+	overlay.keepAliveServers(now)
+	overlay.Unlock()
+
+	pid := overlay.LocalID()
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunChannelBindIndication,
+		&pid,
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		log.Printf("failed building channel bind indication: %v", err)
+		return
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return
+	}
+
+	// send to peers
+	state := overlay.automata.Current()
+	switch state {
+	case stateListening, stateProcessingMessage, stateMessageError:
+		for id, addrs := range overlay.peers {
+			if id == pid {
+				continue
+			}
+			_, err := overlay.conn.conn.WriteToUDP(msg.Raw, overlay.peerAddr(addrs))
+			if err != nil {
+				log.Printf("WARNING: failed binding channel to %s[%s][%s] - %v",
+					id, addrs[0].String(), addrs[1].String(), err)
 			}
-		default:
-			log.Printf("overlay is at state %s", state.String())
 		}
-		log.Println("sent keep alive packet")
+	default:
+		log.Printf("overlay is at state %s", state.String())
 	}
+	log.Println("sent keep alive packet")
 }
 
 func (overlay *OverlayConn) messageError([]interface{}) {
@@ -504,7 +907,7 @@ func (overlay *OverlayConn) messageError([]interface{}) {
 // Ready returns true if the overlay connection is ready to read or write packets,
 // otherwise false.
 func (overlay *OverlayConn) Ready() bool {
-	switch overlay.automata.current {
+	switch overlay.automata.Current() {
 	case stateListening, stateProcessingMessage, stateMessageError:
 		return true
 	}
@@ -513,16 +916,36 @@ func (overlay *OverlayConn) Ready() bool {
 
 // ReadMsg returns a multicast message sent by other peer.
 func (overlay *OverlayConn) ReadMsg() ([]byte, error) {
+	if !overlay.Ready() {
+		return nil, errNotReady
+	}
+	msg, err := overlay.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+// ReadMessage returns a multicast message sent by other peer, including its
+// sender and TTL.
+func (overlay *OverlayConn) ReadMessage() (*OverlayMessage, error) {
 	if !overlay.Ready() {
 		return nil, errNotReady
 	}
 	deadline := overlay.readDeadline
 	if deadline == nil {
-		return <-overlay.peerDataChan, nil
+		select {
+		case msg := <-overlay.peerDataChan:
+			return &msg, nil
+		case <-overlay.done:
+			return nil, errOverlayClosed
+		}
 	}
 	select {
-	case data := <-overlay.peerDataChan:
-		return data, nil
+	case msg := <-overlay.peerDataChan:
+		return &msg, nil
+	case <-overlay.done:
+		return nil, errOverlayClosed
 	case <-time.After(deadline.Sub(time.Now())):
 	}
 	return nil, errNotReady
@@ -538,18 +961,25 @@ func (overlay *OverlayConn) Read(b []byte) (int, error) {
 	}
 
 	var (
-		data     []byte
+		msg      OverlayMessage
 		deadline = overlay.readDeadline
 	)
 
 	if deadline == nil {
-		data = <-overlay.peerDataChan
+		select {
+		case msg = <-overlay.peerDataChan:
+		case <-overlay.done:
+			return 0, errOverlayClosed
+		}
 	} else {
 		select {
-		case data = <-overlay.peerDataChan:
+		case msg = <-overlay.peerDataChan:
+		case <-overlay.done:
+			return 0, errOverlayClosed
 		case <-time.After(deadline.Sub(time.Now())):
 		}
 	}
+	data := msg.Data
 	if len(data) > len(b) {
 		return copy(b, data),
 			fmt.Errorf("data (%d bytes) is not fit on given buffer 'b'", len(data))
@@ -560,16 +990,33 @@ func (overlay *OverlayConn) Read(b []byte) (int, error) {
 // Write sends a multicast message to other nodes
 // TODO: handle multi-packets payload
 func (overlay *OverlayConn) Write(b []byte) (int, error) {
-	if len(b) > stunMaxPacketDataSize {
-		return 0, fmt.Errorf("data is too large, maximum %d bytes",
-			stunMaxPacketDataSize)
+	return overlay.write(b, overlay.originTTL())
+}
+
+// Forward sends a multicast message that was received with given TTL to other
+// nodes. It returns errTTLExpired without sending the message if the TTL
+// reaches zero.
+func (overlay *OverlayConn) Forward(b []byte, ttl TTL) (int, error) {
+	if ttl <= 1 {
+		metrics.Inc("overlay.messages", "type", "expired")
+		return 0, errTTLExpired
 	}
+	return overlay.write(b, ttl-1)
+}
+
+func (overlay *OverlayConn) originTTL() TTL {
+	if overlay.Config.TTL == 0 {
+		return defaultTTL
+	}
+	return overlay.Config.TTL
+}
 
+func (overlay *OverlayConn) write(b []byte, ttl TTL) (int, error) {
 	// TODO: apply writeDeadline
 	current := overlay.automata.Current()
 	switch current {
 	case stateListening, stateProcessingMessage:
-		if _, err := overlay.multicastMessage(b); err != nil {
+		if _, err := overlay.multicastMessage(b, ttl); err != nil {
 			return 0, err
 		}
 		return len(b), nil
@@ -578,34 +1025,49 @@ func (overlay *OverlayConn) Write(b []byte) (int, error) {
 	}
 }
 
-func (overlay *OverlayConn) multicastMessage(data PeerMessage) (int, error) {
+// dataMessage builds a data indication of given payload and TTL. The payload
+// is compressed if it is worth it, and it must not exceed the data size of a
+// packet once encoded.
+func (overlay *OverlayConn) dataMessage(data []byte, ttl TTL) (*stun.Message, error) {
+	payload := overlay.Config.Compression.encode(data)
+	if len(payload.Data) > stunMaxPacketDataSize {
+		return nil, fmt.Errorf("data is too large, maximum %d bytes", stunMaxPacketDataSize)
+	}
+	return stun.Build(
+		stun.TransactionID,
+		stunDataIndication,
+		payload,
+		ttl,
+		overlay.localIDAttr(),
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+}
+
+func (overlay *OverlayConn) multicastMessage(data []byte, ttl TTL) (int, error) {
 	var (
 		msg  *stun.Message
 		addr *net.UDPAddr
 		err  error
 	)
 
-	msg, err = stun.Build(
-		stun.TransactionID,
-		stunDataIndication,
-		data,
-		&overlay.ID,
-		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
-		stun.Fingerprint,
-	)
+	msg, err = overlay.dataMessage(data, ttl)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed create data request message")
 	}
 
+	pid := overlay.LocalID()
 	overlay.RLock()
 	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return 0, errConnNotOpened
+	}
 	for id, addrs := range overlay.peers {
-		if id == overlay.ID {
+		if id == pid {
 			continue
 		}
-		if addr = addrs[0]; addr.IP.Equal(overlay.externalAddr.IP) {
-			addr = addrs[1]
-		}
+		addr = overlay.peerAddr(addrs)
 		if err == nil {
 			_, err = overlay.conn.conn.WriteTo(msg.Raw, addr)
 		}
@@ -620,16 +1082,148 @@ func (overlay *OverlayConn) multicastMessage(data PeerMessage) (int, error) {
 	return len(data), nil
 }
 
-// Close closes the overlay.
+// SendTo sends a data message to given peer of the session table only,
+// directly or through the relay of the server. Its TTL is one, hence the peer
+// does not forward it.
+func (overlay *OverlayConn) SendTo(pid PeerID, b []byte, relay bool) error {
+	msg, err := overlay.dataMessage(b, 1)
+	if err != nil {
+		return errors.Wrap(err, "failed create data request message")
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	sess, ok := overlay.peers[pid]
+	if !ok {
+		return errPeerNotFound
+	} else if overlay.conn == nil {
+		return errConnNotOpened
+	} else if relay {
+		return overlay.relayTo(pid, msg.Raw)
+	}
+	_, err = overlay.conn.conn.WriteTo(msg.Raw, overlay.peerAddr(sess))
+	return err
+}
+
+// Close closes the overlay and stops its keep-alive goroutine. The overlay
+// will not be reopened, and calling Close more than once is harmless.
 func (overlay *OverlayConn) Close() error {
-	return overlay.automata.Event(eventClose)
+	overlay.Lock()
+	overlay.Reopen = false
+	overlay.Unlock()
+
+	closing := false
+	overlay.closeOnce.Do(func() {
+		closing = true
+		close(overlay.done)
+		if overlay.stopSendingKeepAlive != nil {
+			close(overlay.stopSendingKeepAlive)
+		}
+		if overlay.stopProbing != nil {
+			close(overlay.stopProbing)
+		}
+	})
+	if !closing {
+		return nil
+	}
+	if err := overlay.automata.Event(eventClose); err != nil {
+		// The automata is closed or is blocked inside a callback (e.g.
+		// listening), which will observe isClosing() and raise eventClose.
+		log.Printf("overlay close is deferred: %v", err)
+	}
+	return nil
 }
 
 // InternalAddr returns the internal address of this overlay.
 func (overlay *OverlayConn) InternalAddr() net.Addr {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return nil
+	}
 	return overlay.conn.conn.LocalAddr()
 }
 
+// Peers returns a copy of the session table of this overlay.
+func (overlay *OverlayConn) Peers() SessionTable {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	st := make(SessionTable, len(overlay.peers))
+	for id, sess := range overlay.peers {
+		st[id] = sess
+	}
+	return st
+}
+
+// Tags returns the tags of given peer, which are registered to the server.
+func (overlay *OverlayConn) Tags(pid PeerID) PeerTags {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	return overlay.peerTags[pid]
+}
+
+// ExtendedID returns the extended ID of given peer, which is registered to
+// the server, or false if the peer or the server does not support it.
+func (overlay *OverlayConn) ExtendedID(pid PeerID) (ExtendedPeerID, bool) {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	ext, ok := overlay.peerExtIDs[pid]
+	return ext, ok
+}
+
+// LocalID returns the peer ID of this overlay on the wire.
+func (overlay *OverlayConn) LocalID() PeerID {
+	overlay.idLock.Lock()
+	defer overlay.idLock.Unlock()
+	return overlay.ID
+}
+
+// localIDAttr returns a copy of the peer ID of this overlay, which is added
+// to the messages it sends.
+func (overlay *OverlayConn) localIDAttr() *PeerID {
+	pid := overlay.LocalID()
+	return &pid
+}
+
+// assignID replaces the peer ID of this overlay by the one assigned by the
+// server, since its own one collides with another peer.
+func (overlay *OverlayConn) assignID(pid PeerID) {
+	overlay.idLock.Lock()
+	defer overlay.idLock.Unlock()
+	if pid != overlay.ID {
+		log.Printf("WARNING: peer ID %s collides with another peer, server assigned peer ID %s"+
+			" to extended:%s", overlay.ID, pid, overlay.ExtID)
+		overlay.ID = pid
+	}
+}
+
+// SameLAN returns true if the peer of given session is behind the same NAT as
+// this overlay, hence it is reachable directly at its internal address.
+func (overlay *OverlayConn) SameLAN(sess Session) bool {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	return sess.SameLAN(overlay.externalAddr)
+}
+
+// peerAddr returns the address of given peer's session to send messages to,
+// which is the internal address if the peer is on the same LAN. The caller
+// must hold the lock.
+func (overlay *OverlayConn) peerAddr(sess Session) *net.UDPAddr {
+	if sess.SameLAN(overlay.externalAddr) {
+		return sess[1]
+	}
+	return sess[0]
+}
+
+// Blacklist returns the blacklist of peers that send invalid messages.
+func (overlay *OverlayConn) Blacklist() *Blacklist {
+	return overlay.blacklist
+}
+
+// Validation returns the validation failures of the received messages.
+func (overlay *OverlayConn) Validation() *ValidationStats {
+	return overlay.validation
+}
+
 // ExternalAddr returns the external address of this overlay
 func (overlay *OverlayConn) ExternalAddr() net.Addr {
 	return overlay.externalAddr
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestOverlayConnCloseDoesNotLeakGoroutines(t *testing.T) {
+	cfg := OverlayConfig{
+		Address:             "127.0.0.1:0",
+		Server:              "127.0.0.1:9",
+		StunPassword:        defaultStunPassword,
+		BindingWait:         1,
+		BindingMaxErrors:    5,
+		ListeningWait:       30,
+		ListeningMaxErrors:  10,
+		ListeningBufferSize: 64 * 1024,
+		ErrorBackoff:        1,
+		ChannelLifespan:     60,
+	}
+
+	// warm up lazily started runtime and library goroutines
+	overlay, err := NewOverlayConn(cfg)
+	if err != nil {
+		t.Skipf("cannot create overlay: %v", err)
+	}
+	overlay.Close()
+	time.Sleep(2 * time.Second)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		if overlay, err = NewOverlayConn(cfg); err != nil {
+			t.Fatalf("failed creating overlay: %v", err)
+		}
+		overlay.Close()
+		overlay.Close()
+		if _, err = overlay.Read(make([]byte, 16)); err == nil {
+			t.Errorf("expected Read to fail after Close")
+		}
+	}
+	time.Sleep(2 * time.Second)
+
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Errorf("goroutines grew from %d to %d after 10 open/close cycles", before, after)
+	}
+}
+
+// receive parses a raw data message as it is done by processingMessage, and
+// returns the message delivered to the reader.
+func (overlay *OverlayConn) receive(t *testing.T, raw []byte) *OverlayMessage {
+	var req stun.Message
+	overlay.msg, overlay.senderAddr = raw, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	pid, err := overlay.parseHeader(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = overlay.peerDataIndication(pid, overlay.senderAddr, &req); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-overlay.peerDataChan:
+		return &msg
+	default:
+		return nil
+	}
+}
+
+func TestOverlayTTLLoop(t *testing.T) {
+	nodes := make([]*OverlayConn, 3)
+	for i := range nodes {
+		nodes[i] = &OverlayConn{
+			ID:           PeerID{0, 0, 0, 0, 0, byte(i + 1)},
+			Config:       &OverlayConfig{StunPassword: defaultStunPassword, TTL: 3},
+			peerDataChan: make(chan OverlayMessage, 1),
+		}
+	}
+	payload := []byte("notification")
+
+	// node 0 originates the message, then each node forwards it to the next
+	// one in the loop 0 -> 1 -> 2 -> 0 -> ...
+	msg, err := nodes[0].dataMessage(payload, nodes[0].originTTL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hops := 0
+	for i := 1; hops < 10; i = (i + 1) % len(nodes) {
+		received := nodes[i].receive(t, msg.Raw)
+		if received == nil {
+			break
+		}
+		hops++
+		if !bytes.Equal(received.Data, payload) {
+			t.Fatalf("hop %d: unexpected payload %q", hops, received.Data)
+		}
+		if received.TTL <= 1 {
+			if _, err = nodes[i].Forward(received.Data, received.TTL); err != errTTLExpired {
+				t.Fatalf("hop %d: expected TTL expired, got %v", hops, err)
+			}
+			break
+		}
+		if msg, err = nodes[i].dataMessage(received.Data, received.TTL-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hops != 3 {
+		t.Errorf("expected the message to die after 3 hops, got %d", hops)
+	}
+
+	// a message with TTL zero is dropped on receive
+	if msg, err = nodes[0].dataMessage(payload, 0); err != nil {
+		t.Fatal(err)
+	}
+	if received := nodes[1].receive(t, msg.Raw); received != nil {
+		t.Error("message with TTL zero must be dropped")
+	}
+
+	// a message without TTL has the default TTL
+	msg, err = stun.Build(stun.TransactionID, stunDataIndication, PeerMessage(payload),
+		&nodes[0].ID, stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := nodes[1].receive(t, msg.Raw); received == nil || received.TTL != defaultTTL {
+		t.Errorf("expected default TTL of message without TTL, got %v", received)
+	}
+
+	// TTL cannot be inflated in transit
+	msg, _ = nodes[0].dataMessage(payload, 1)
+	raw := append([]byte(nil), msg.Raw...)
+	if i := bytes.Index(raw, []byte{0x8f, 0x07, 0x00, 0x01, 0x01}); i < 0 {
+		t.Fatal("TTL attribute not found")
+	} else {
+		raw[i+4] = 0xff
+	}
+	var req stun.Message
+	nodes[1].msg = raw
+	if _, err = nodes[1].parseHeader(&req); err == nil {
+		t.Error("message with modified TTL must be invalid")
+	}
+}
+
+func TestOverlayProbe(t *testing.T) {
+	nodes := make([]*OverlayConn, 2)
+	for i := range nodes {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		nodes[i] = &OverlayConn{
+			ID: PeerID{0, 0, 0, 0, 0, byte(i + 1)},
+			Config: &OverlayConfig{
+				StunPassword: defaultStunPassword,
+				Probe:        ProbeConfig{Interval: 60, MaxPeers: 1, MaxFailures: 2},
+			},
+			automata: NewAutomata(stateListening, nil, nil),
+			conn:     &overlayUDPConn{conn: conn},
+			peers:    make(SessionTable),
+			liveness: make(map[PeerID]*PeerLiveness),
+		}
+	}
+	a, b := nodes[0], nodes[1]
+	addrB := b.conn.conn.LocalAddr().(*net.UDPAddr)
+	a.peers[b.ID] = Session{addrB, addrB}
+
+	// receive reads a message of given node and processes it
+	receive := func(node *OverlayConn) {
+		buf := make([]byte, 1500)
+		node.conn.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := node.conn.conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req stun.Message
+		node.msg, node.senderAddr = buf[:n], addr
+		pid, err := node.parseHeader(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch req.Type {
+		case stunPingRequest:
+			err = node.pingRequest(pid, &req)
+		case stunPingResponse:
+			err = node.pingResponse(pid, &req)
+		default:
+			t.Fatalf("unexpected message type %v", req.Type)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// peers that are not in use are not probed
+	a.probePeers()
+	if _, ok := a.Liveness(b.ID); ok {
+		t.Fatal("probed a peer that is not in use")
+	}
+
+	a.Want(b.ID)
+	a.probePeers()
+	receive(b)
+	receive(a)
+	if l, ok := a.Liveness(b.ID); !ok || l.Down || l.LastSeen.IsZero() {
+		t.Fatalf("peer is not alive after replying the ping: %+v", l)
+	}
+
+	// unanswered pings mark the peer down until it replies again
+	for i := 0; i < 3; i++ {
+		a.probePeers()
+	}
+	if a.Alive(b.ID) {
+		t.Fatal("peer is alive after failing the probes")
+	}
+	receive(b)
+	receive(b)
+	receive(b)
+	receive(a)
+	receive(a)
+	receive(a)
+	if !a.Alive(b.ID) {
+		t.Fatal("peer is down after replying the ping")
+	}
+}
+
+func TestOverlayProbeRelay(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	// the address of b that a sees, which drops its pings
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+
+	nodes := make([]*OverlayConn, 2)
+	for i := range nodes {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		nodes[i] = &OverlayConn{
+			ID: PeerID{0, 0, 0, 0, 0, byte(i + 1)},
+			Config: &OverlayConfig{
+				StunPassword: defaultStunPassword,
+				Probe:        ProbeConfig{Interval: 60, MaxPeers: 1, MaxFailures: 1},
+			},
+			automata:       NewAutomata(stateListening, nil, nil),
+			conn:           &overlayUDPConn{conn: conn},
+			rendezvousAddr: serverAddr,
+			peers:          make(SessionTable),
+			liveness:       make(map[PeerID]*PeerLiveness),
+		}
+	}
+	a, b := nodes[0], nodes[1]
+	addrA := a.conn.conn.LocalAddr().(*net.UDPAddr)
+	addrB := b.conn.conn.LocalAddr().(*net.UDPAddr)
+	unreachable := blackhole.LocalAddr().(*net.UDPAddr)
+	a.peers[b.ID] = Session{unreachable, unreachable}
+	b.peers[a.ID] = Session{addrA, addrA}
+	s := &Server{
+		ID:    PeerID{0, 0, 0, 0, 0, 9},
+		peers: SessionTable{a.ID: Session{addrA, addrA}, b.ID: Session{addrB, addrB}},
+		cfg:   &ServerConfig{StunPassword: defaultStunPassword},
+	}
+
+	// serve relays a message received by the server
+	serve := func() {
+		buf := make([]byte, 1500)
+		serverConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := serverConn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req stun.Message
+		if _, err = req.Write(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if req.Type != stunRelayIndication {
+			t.Fatalf("unexpected message type %v", req.Type)
+		}
+		if err = s.processMessage(serverConn, addr, &req, new(stun.Message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// receive reads a message of given node and processes it
+	receive := func(node *OverlayConn) {
+		buf := make([]byte, 1500)
+		node.conn.conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := node.conn.conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !addr.IP.Equal(serverAddr.IP) || addr.Port != serverAddr.Port {
+			t.Fatalf("message is not relayed by the server: %s", addr)
+		}
+		var req stun.Message
+		node.msg, node.senderAddr = buf[:n], addr
+		pid, err := node.parseHeader(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch req.Type {
+		case stunPingRequest:
+			err = node.pingRequest(pid, &req)
+		case stunPingResponse:
+			err = node.pingResponse(pid, &req)
+		default:
+			t.Fatalf("unexpected message type %v", req.Type)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the direct ping is lost, and the peer is reached through the relay
+	// without failing
+	a.Want(b.ID)
+	a.probePeers()
+	a.relayProbes()
+	serve()
+	receive(b)
+	serve()
+	receive(a)
+	l, ok := a.Liveness(b.ID)
+	if !ok || l.Down || l.Failures != 0 || l.LastSeen.IsZero() || !l.Relayed {
+		t.Fatalf("peer reachable through the relay is not alive: %+v", l)
+	}
+
+	// a peer that replies neither directly nor through the relay fails
+	a.probePeers()
+	a.relayProbes()
+	serve()
+	a.probePeers()
+	if a.Alive(b.ID) {
+		t.Fatal("peer is alive after failing the probes through the relay")
+	}
+
+	// the server relays the messages of a peer only
+	forged, err := stun.Build(stun.TransactionID, stunPingRequest, &b.ID,
+		stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Lock()
+	err = a.relayTo(b.ID, forged.Raw)
+	a.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := serverConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req stun.Message
+	if _, err = req.Write(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.processMessage(serverConn, addr, &req, new(stun.Message)); err == nil {
+		t.Error("relayed a message of another peer")
+	}
+}
+
+func TestSessionTablePagination(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	overlay := &OverlayConn{
+		ID:             PeerID{0, 0, 0, 0, 0, 1},
+		Config:         &OverlayConfig{StunPassword: defaultStunPassword},
+		conn:           &overlayUDPConn{conn: conn},
+		rendezvousAddr: serverConn.LocalAddr().(*net.UDPAddr),
+		peers:          SessionTable{PeerID{9}: nil},
+	}
+	s := &Server{
+		ID:    PeerID{0, 0, 0, 0, 0, 2},
+		peers: make(SessionTable),
+		cfg:   &ServerConfig{StunPassword: defaultStunPassword, SessionPageSize: 2},
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	s.peers[overlay.ID] = Session{local, local}
+	for i := 0; i < 5; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 3478}
+		s.peers[PeerID{0, 0, 0, 1, 0, byte(i)}] = Session{addr, addr}
+	}
+
+	// serve answers a binding request received by the server
+	serve := func() {
+		buf := make([]byte, 64*1024)
+		serverConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req, res stun.Message
+		if _, err = req.Write(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.sendBindingSuccess(serverConn, overlay.ID, &req, &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// receive reads a response and returns it
+	receive := func() *stun.Message {
+		buf := make([]byte, 64*1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := new(stun.Message)
+		if _, err = res.Write(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// the client iterates the pages, and replaces its table at the end
+	if err = overlay.requestSessionPage(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		serve()
+		if err = overlay.updateSessionTable(receive()); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 && len(overlay.peers) != 1 {
+			t.Fatalf("the table is replaced before receiving all pages")
+		}
+	}
+	if len(overlay.peers) != 5 || overlay.pendingPeers != nil {
+		t.Fatalf("unexpected assembled table: %v", overlay.peers)
+	}
+
+	// a client that does not send the offset gets the first page and the
+	// marker of more pages
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest, &overlay.ID,
+		stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteToUDP(req.Raw, overlay.rendezvousAddr)
+	serve()
+	res := receive()
+	var next SessionNext
+	if st, err := GetSessionTableFrom(res); err != nil || len(*st) != 2 {
+		t.Errorf("unexpected first page: %v %v", st, err)
+	} else if err = next.GetFrom(res); err != nil || next != 2 {
+		t.Errorf("unexpected next page offset %d: %v", next, err)
+	}
+
+	// a page of the default size holds all the entries that fit
+	s.cfg.SessionPageSize = 0
+	conn.WriteToUDP(req.Raw, overlay.rendezvousAddr)
+	serve()
+	res = receive()
+	if st, err := GetSessionTableFrom(res); err != nil || len(*st) != 5 {
+		t.Errorf("unexpected page of the default size: %v %v", st, err)
+	} else if err = next.GetFrom(res); err == nil {
+		t.Errorf("unexpected next page offset %d of the last page", next)
+	}
+
+	// and is filled with large entries until the response is safe from
+	// fragmentation
+	for i := 0; i < 50; i++ {
+		addr := &net.UDPAddr{IP: net.IPv6loopback, Port: 3478 + i}
+		s.peers[PeerID{0, 0, 0, 2, 0, byte(i)}] = Session{addr, addr, addr, addr, addr}
+	}
+	conn.WriteToUDP(req.Raw, overlay.rendezvousAddr)
+	serve()
+	if res = receive(); len(res.Raw) > sessionPageMaxSize {
+		t.Errorf("binding response of %d bytes exceeds %d bytes", len(res.Raw), sessionPageMaxSize)
+	}
+	st, err := GetSessionTableFrom(res)
+	if err != nil || len(*st) <= 5 {
+		t.Fatalf("unexpected page of the default size: %v %v", st, err)
+	} else if err = next.GetFrom(res); err != nil || int(next) != len(*st) {
+		t.Errorf("unexpected next page offset %d: %v", next, err)
+	}
+	// one more entry does not fit
+	s.cfg.SessionPageSize = len(*st) + 1
+	conn.WriteToUDP(req.Raw, overlay.rendezvousAddr)
+	serve()
+	if filled, err := GetSessionTableFrom(receive()); err != nil || len(*filled) != len(*st) {
+		t.Errorf("unexpected page of %d entries: %v %v", s.cfg.SessionPageSize, filled, err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// The default limits of the datagrams accepted by the server. The largest
+// attributes sent by the agents are their certificates and rejections, and
+// a binding request carries about 10 attributes.
+const (
+	defaultMaxDatagramSize  = 2048
+	defaultMaxAttributeSize = 1024
+	defaultMaxAttributes    = 32
+)
+
+// udpMaxDatagramSize is the size of the read buffer of the server, which is
+// larger than the accepted datagrams so that the oversized ones are not
+// silently truncated.
+const udpMaxDatagramSize = 64 * 1024
+
+// stunHeaderSize is the size of the header of a STUN message, and
+// stunAttrHeaderSize the size of the type and length of an attribute.
+const (
+	stunHeaderSize     = 20
+	stunAttrHeaderSize = 4
+)
+
+// PacketLimits are the limits of the datagrams accepted by the server, which
+// are checked before decoding them. The defaults apply to the zero values.
+type PacketLimits struct {
+	MaxDatagramSize  int `json:"max-datagram-size"`  // in bytes
+	MaxAttributeSize int `json:"max-attribute-size"` // in bytes, excluding its header
+	MaxAttributes    int `json:"max-attributes"`     // per message
+}
+
+func (l PacketLimits) maxDatagramSize() int {
+	if l.MaxDatagramSize > 0 {
+		return l.MaxDatagramSize
+	}
+	return defaultMaxDatagramSize
+}
+
+func (l PacketLimits) maxAttributeSize() int {
+	if l.MaxAttributeSize > 0 {
+		return l.MaxAttributeSize
+	}
+	return defaultMaxAttributeSize
+}
+
+func (l PacketLimits) maxAttributes() int {
+	if l.MaxAttributes > 0 {
+		return l.MaxAttributes
+	}
+	return defaultMaxAttributes
+}
+
+// check returns a ValidationError if given datagram exceeds the limits or is
+// not a well-formed STUN message, by walking its attributes without decoding
+// them.
+func (l PacketLimits) check(b []byte) error {
+	if len(b) > l.maxDatagramSize() {
+		return &ValidationError{ValidationOversized,
+			fmt.Errorf("datagram of %d bytes exceeds %d bytes", len(b), l.maxDatagramSize())}
+	}
+	if !stun.IsMessage(b) {
+		return &ValidationError{ValidationMalformed, errors.New("not STUN")}
+	}
+	if size := int(binary.BigEndian.Uint16(b[2:4])); stunHeaderSize+size != len(b) {
+		return &ValidationError{ValidationMalformed,
+			fmt.Errorf("message length %d does not match the datagram of %d bytes", size, len(b))}
+	}
+	count := 0
+	for off := stunHeaderSize; off < len(b); {
+		if len(b)-off < stunAttrHeaderSize {
+			return &ValidationError{ValidationMalformed, errors.New("truncated attribute header")}
+		}
+		t := stun.AttrType(binary.BigEndian.Uint16(b[off : off+2]))
+		size := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		if count++; count > l.maxAttributes() {
+			return &ValidationError{ValidationAttributes,
+				fmt.Errorf("message has more than %d attributes", l.maxAttributes())}
+		}
+		if size > l.maxAttributeSize() {
+			return &ValidationError{ValidationOversized,
+				fmt.Errorf("attribute %v of %d bytes exceeds %d bytes", t, size, l.maxAttributeSize())}
+		}
+		off += stunAttrHeaderSize
+		if len(b)-off < size {
+			return &ValidationError{ValidationMalformed, fmt.Errorf("truncated attribute %v", t)}
+		}
+		// the padding of the last attribute may be omitted
+		if off += size + (4-size%4)%4; off > len(b) {
+			off = len(b)
+		}
+	}
+	return nil
+}
+
+// decodePacket checks the limits of given datagram, then decodes it into given
+// message. A panic of the decoder is returned as a ValidationError.
+func (s *Server) decodePacket(b []byte, req *stun.Message) (err error) {
+	if err = s.cfg.Packets.check(b); err != nil {
+		return err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered("decoding", r)
+		}
+	}()
+	req.Reset()
+	if _, err = req.Write(b); err != nil {
+		return &ValidationError{ValidationMalformed, err}
+	}
+	return nil
+}
+
+// handlePacket processes a decoded message, and returns the panic of its
+// processing as a ValidationError, so that a malformed message cannot stop
+// the server.
+func (s *Server) handlePacket(c net.PacketConn, addr net.Addr, req, res *stun.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.recovered("processing", r)
+			s.blacklist.Failure(addrSource(addr))
+			s.validation.Failure(addrSource(addr), err)
+		}
+	}()
+	return s.processMessage(c, addr, req, res)
+}
+
+// recovered logs and counts a recovered panic of given stage of the
+// processing of a datagram.
+func (s *Server) recovered(stage string, r interface{}) error {
+	metrics.Inc("server.panics", "stage", stage)
+	log.Printf("ERROR: recovered panic %s a message - %v\n%s", stage, r, debug.Stack())
+	return &ValidationError{ValidationPanic, fmt.Errorf("panic %s the message: %v", stage, r)}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// newPacketTestServer returns a server answering on a UDP socket of the
+// loopback, the socket, and a function closing it.
+func newPacketTestServer(tb testing.TB) (*Server, *net.UDPConn, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cfg := DefaultServerConfig()
+	// the fuzzed sender is never blacklisted
+	cfg.Blacklist.Threshold = 0
+	s := &Server{
+		Addr:      conn.LocalAddr().(*net.UDPAddr),
+		ID:        PeerID{0, 0, 0, 0, 0, 2},
+		peers:     make(SessionTable),
+		tags:      make(SessionTags),
+		cfg:       cfg,
+		blacklist: NewBlacklist(cfg.Blacklist),
+		interop:   newInteropLimiter(cfg.Interop),
+		fleet:     NewFleetAggregator(cfg.ReportWindow),
+		udpConn:   conn,
+
+		extIDs:      make(map[PeerID]ExtendedPeerID),
+		collisions:  make(map[PeerID]*PeerCollision),
+		seen:        make(map[PeerID]time.Time),
+		queues:      make(map[PeerID][]*queuedMessage),
+		subscribers: make(map[string]map[string]*subscriber),
+		validation:  NewValidationStats("server.validation_failures"),
+		peerKeys:    make(map[PeerID]ed25519.PublicKey),
+		updates:     make(map[string]*Notification),
+		reports:     make(map[string]*UpdateReports),
+	}
+	return s, conn, func() { conn.Close() }
+}
+
+// clientPackets returns the datagrams sent to given server socket by the
+// client code: a binding request, a progress indication, an ack and a
+// rejection.
+func clientPackets(tb testing.TB, server *net.UDPConn) [][]byte {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	addr := server.LocalAddr().(*net.UDPAddr)
+	overlay := &OverlayConn{
+		ID:             PeerID{0, 0, 0, 0, 0, 1},
+		ExtID:          ExtendedPeerID{1},
+		Config:         &OverlayConfig{StunPassword: defaultStunPassword, tags: PeerTags{"arch-arm", "site-a"}},
+		conn:           &overlayUDPConn{conn: conn, rendezvousAddr: addr},
+		rendezvousAddr: addr,
+	}
+	overlay.Config.torrentPorts = [2]int{6881, 6882}
+	overlay.Config.torrentIPv6 = TorrentIPv6(net.ParseIP("2001:db8::1"))
+
+	msg, err := overlay.bindingRequestMessage(overlay.conn, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err = conn.WriteToUDP(msg.Raw, addr); err != nil {
+		tb.Fatal(err)
+	}
+	if err = overlay.SendProgress(&UpdateProgress{UUID: UUIDShell, Version: 1, Percent: 50,
+		State: UpdateDownloading}); err != nil {
+		tb.Fatal(err)
+	}
+	if err = overlay.SendAck(MessageID(1), addr); err != nil {
+		tb.Fatal(err)
+	}
+	if err = overlay.SendDataResponse(&OverlayMessage{ID: MessageID(2), Addr: addr},
+		&Rejection{UUID: UUIDShell, Version: 1, Reason: RejectVersionTooOld, Detail: "version 2 is running"}); err != nil {
+		tb.Fatal(err)
+	}
+
+	var packets [][]byte
+	buf := make([]byte, udpMaxDatagramSize)
+	for i := 0; i < 4; i++ {
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := server.Read(buf)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		packets = append(packets, append([]byte(nil), buf[:n]...))
+	}
+	return packets
+}
+
+// resealPacket returns given datagram with its integrity and fingerprint
+// recomputed, so that its attributes are parsed, or nil if it is not
+// decoded.
+func resealPacket(b []byte) []byte {
+	var req stun.Message
+	if _, err := req.Write(append([]byte(nil), b...)); err != nil {
+		return nil
+	}
+	m := &stun.Message{Type: req.Type, TransactionID: req.TransactionID}
+	m.WriteHeader()
+	for _, a := range req.Attributes {
+		if a.Type != stun.AttrMessageIntegrity && a.Type != stun.AttrFingerprint {
+			m.Add(a.Type, a.Value)
+		}
+	}
+	if stun.NewShortTermIntegrity(defaultStunPassword).AddTo(m) != nil || stun.Fingerprint.AddTo(m) != nil {
+		return nil
+	}
+	return m.Raw
+}
+
+// receivePacket processes given datagram as the server does, and fails if it
+// panics.
+func receivePacket(t *testing.T, s *Server, conn *net.UDPConn, b []byte) {
+	req, res := new(stun.Message), new(stun.Message)
+	err := s.decodePacket(b, req)
+	if err == nil {
+		err = s.handlePacket(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, req, res)
+	}
+	if validationReason(err) == ValidationPanic {
+		t.Fatal(err)
+	}
+}
+
+func FuzzServerPacket(f *testing.F) {
+	s, conn, closeServer := newPacketTestServer(f)
+	defer closeServer()
+	// the seeds are valid messages of the clients
+	for i, b := range clientPackets(f, conn) {
+		if err := s.decodePacket(b, new(stun.Message)); err != nil {
+			f.Fatalf("seed %d is invalid: %v", i, err)
+		}
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		receivePacket(t, s, conn, b)
+		if sealed := resealPacket(b); sealed != nil {
+			receivePacket(t, s, conn, sealed)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestPacketLimits(t *testing.T) {
+	var l PacketLimits
+	valid := stun.MustBuild(stun.TransactionID, stun.BindingRequest, &PeerID{1},
+		&TorrentPorts{6881, 6881}, stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err := l.check(valid.Raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// a message of the attributes with given sizes
+	build := func(sizes ...int) []byte {
+		m := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+		for _, size := range sizes {
+			m.Add(attrTags, bytes.Repeat([]byte{'a'}, size))
+		}
+		return m.Raw
+	}
+	truncated := build(16)[:stunHeaderSize+8]
+	binary.BigEndian.PutUint16(truncated[2:4], 8)
+	for name, expected := range map[string]struct {
+		b      []byte
+		reason string
+	}{
+		"oversized datagram":  {make([]byte, defaultMaxDatagramSize+1), ValidationOversized},
+		"not STUN":            {[]byte("GET / HTTP/1.1\r\n\r\n"), ValidationMalformed},
+		"oversized attribute": {build(defaultMaxAttributeSize + 1), ValidationOversized},
+		"attribute count":     {build(make([]int, defaultMaxAttributes+1)...), ValidationAttributes},
+		"truncated attribute": {truncated, ValidationMalformed},
+	} {
+		err := l.check(expected.b)
+		if err == nil || validationReason(err) != expected.reason {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	// the length of the header must match the datagram
+	b := build(16)
+	binary.BigEndian.PutUint16(b[2:4], 4)
+	if err := l.check(b); validationReason(err) != ValidationMalformed {
+		t.Errorf("unexpected error %v of a wrong message length", err)
+	}
+
+	// the limits are configurable
+	l.MaxAttributes = 2
+	if err := l.check(build(1, 1, 1)); validationReason(err) != ValidationAttributes {
+		t.Errorf("unexpected error %v with a configured limit", err)
+	}
+}
+
+func TestTorrentPortsLength(t *testing.T) {
+	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	m.Add(stun.AttrEvenPort, []byte{1, 2, 3})
+	var tp TorrentPorts
+	if err := tp.GetFrom(m); err == nil {
+		t.Error("short torrent ports are decoded")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/pkg/errors"
+)
+
+// windowsReservedNames are the device names reserved on Windows, with or
+// without extension, e.g. CON or nul.txt.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validatePathComponent returns an error if given component of a path of a
+// payload is empty, is "." or "..", contains a separator, a control or a
+// character reserved on Windows, ends with a dot or a space, or is a device
+// name reserved on Windows, hence it may be written outside the data
+// directory or not on every platform.
+func validatePathComponent(c string) error {
+	switch {
+	case len(c) == 0:
+		return errors.New("empty path component")
+	case c == "." || c == "..":
+		return fmt.Errorf("path component %q", c)
+	case strings.ContainsAny(c, `/\<>:"|?*`):
+		return fmt.Errorf("path component %q contains a reserved character", c)
+	case strings.IndexFunc(c, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		return fmt.Errorf("path component %q contains a control character", c)
+	case strings.HasSuffix(c, ".") || strings.HasSuffix(c, " "):
+		return fmt.Errorf("path component %q ends with a dot or a space", c)
+	}
+	base := strings.ToUpper(c)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if windowsReservedNames[base] {
+		return fmt.Errorf("path component %q is a reserved name", c)
+	}
+	return nil
+}
+
+// validateInfoPaths returns an error if the name or a file path of given
+// metainfo is not a relative path of valid components, see
+// validatePathComponent.
+func validateInfoPaths(info *metainfo.Info) error {
+	if err := validatePathComponent(info.Name); err != nil {
+		return errors.Wrap(err, "invalid name")
+	}
+	for _, f := range info.Files {
+		if len(f.Path) == 0 {
+			return errors.New("invalid file: empty path")
+		}
+		for _, c := range f.Path {
+			if err := validatePathComponent(c); err != nil {
+				return errors.Wrapf(err, "invalid file %s", strings.Join(f.Path, "/"))
+			}
+		}
+	}
+	return nil
+}
+
+// validatePaths returns an error if a path of the payload or of the patch of
+// the notification may escape the data directory, see validateInfoPaths.
+func (mi *Notification) validatePaths() error {
+	if err := validateInfoPaths(&mi.Info); err != nil {
+		return errors.Wrapf(err, "update uuid:%s", mi.UUID)
+	}
+	if mi.Delta != nil {
+		if err := validateInfoPaths(&mi.Delta.Info); err != nil {
+			return errors.Wrapf(err, "patch of update uuid:%s", mi.UUID)
+		}
+	}
+	return nil
+}
+
+// safeJoin returns given path components, e.g. of a metainfo, joined within
+// given directory, or an error if a component is not valid, see
+// validatePathComponent.
+func safeJoin(dir string, path ...string) (string, error) {
+	for _, c := range path {
+		if err := validatePathComponent(c); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(append([]string{dir}, path...)...), nil
+}
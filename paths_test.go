@@ -0,0 +1,103 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestValidateInfoPaths(t *testing.T) {
+	valid := []metainfo.Info{
+		{Name: "update.bin", Length: 1},
+		{Name: "up date.v2", Files: []metainfo.FileInfo{
+			{Path: []string{"main.sh"}, Length: 1},
+			{Path: []string{"lib", ".hidden", "a.txt"}, Length: 1},
+		}},
+	}
+	for _, info := range valid {
+		if err := validateInfoPaths(&info); err != nil {
+			t.Errorf("valid info %s is rejected: %v", info.Name, err)
+		}
+	}
+
+	hostile := map[string]metainfo.Info{
+		"empty name":       {Name: ""},
+		"parent name":      {Name: ".."},
+		"dot name":         {Name: "."},
+		"relative name":    {Name: "../../etc/cron.d/x"},
+		"absolute name":    {Name: "/etc/cron.d/x"},
+		"windows name":     {Name: `..\..\Windows\x.bat`},
+		"drive name":       {Name: `C:x.bat`},
+		"reserved name":    {Name: "con.txt"},
+		"trailing dot":     {Name: "update."},
+		"control name":     {Name: "update\x00.sh"},
+		"parent component": {Name: "update", Files: []metainfo.FileInfo{{Path: []string{"..", "..", "x"}}}},
+		"absolute file":    {Name: "update", Files: []metainfo.FileInfo{{Path: []string{"/etc/passwd"}}}},
+		"empty component":  {Name: "update", Files: []metainfo.FileInfo{{Path: []string{"a", "", "b"}}}},
+		"empty file path":  {Name: "update", Files: []metainfo.FileInfo{{Path: nil}}},
+		"reserved file":    {Name: "update", Files: []metainfo.FileInfo{{Path: []string{"LPT1"}}}},
+	}
+	for name, info := range hostile {
+		if err := validateInfoPaths(&info); err == nil {
+			t.Errorf("%s is not rejected", name)
+		}
+	}
+
+	// the patch of a delta update is validated as well
+	mi := Notification{UUID: UUIDShell, Info: valid[0],
+		Delta: &Delta{Info: metainfo.Info{Name: "../update.bin.patch"}}}
+	if err := mi.validatePaths(); err == nil {
+		t.Error("escaping patch is not rejected")
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	if p, err := safeJoin("/data", "update", "lib", "a.txt"); err != nil ||
+		p != filepath.Join("/data", "update", "lib", "a.txt") {
+		t.Errorf("unexpected path %s: %v", p, err)
+	}
+	for _, path := range [][]string{{"update", ".."}, {"..", "etc"}, {"/etc"}, {""}} {
+		if p, err := safeJoin("/data", path...); err == nil {
+			t.Errorf("%q is joined as %s", path, p)
+		}
+	}
+}
+
+func TestUnzipRejectsEscapingEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unzip-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "update.zip")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for _, name := range []string{"main.sh", "../escaped.sh"} {
+		if _, err = w.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dest := filepath.Join(dir, "dest")
+	if _, err = Unzip(archive, dest); err == nil {
+		t.Error("escaping entry is extracted")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escaped.sh")); !os.IsNotExist(err) {
+		t.Errorf("escaping entry is written: %v", err)
+	}
+}
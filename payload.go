@@ -0,0 +1,161 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// DefaultExcludes are the patterns excluded from a directory payload unless
+// they are disabled, i.e. version control data, editor swap files and build
+// caches.
+var DefaultExcludes = []string{".git", "*.swp", "__pycache__"}
+
+// deployEntrypoints are the files at the root of a directory payload which
+// are executed by the deployers, hence they must never be excluded.
+var deployEntrypoints = []string{"main.sh", "deploy.json"}
+
+// excluded returns true if given slash-separated path relative to the
+// payload root matches any of the patterns. A pattern with a slash matches
+// the relative path or any of its parent directories, otherwise it matches
+// any element of the path, so that excluding a directory excludes its
+// content.
+func excluded(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		elems := strings.Split(rel, "/")
+		for i, e := range elems {
+			if strings.Contains(p, "/") {
+				e = strings.Join(elems[:i+1], "/")
+			}
+			if ok, _ := path.Match(strings.Trim(p, "/"), e); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ValidateExcludes returns an error if any of given patterns is malformed.
+func ValidateExcludes(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern '%s': %v", p, err)
+		}
+	}
+	return nil
+}
+
+// payloadFiles returns the regular files of the payload at given root, which
+// are sorted by their slash-separated paths relative to the root, and the
+// paths excluded by given patterns. The root is returned as "." if it is a
+// file, which is never excluded. It returns an error if a pattern excludes a
+// deploy entrypoint.
+func payloadFiles(root string, patterns []string) (files, skipped []string, err error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !st.IsDir() {
+		return []string{"."}, nil, nil
+	}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(rel, patterns) {
+			if containsString(deployEntrypoints, rel) {
+				return fmt.Errorf("exclude patterns remove the deploy entrypoint %s", rel)
+			}
+			skipped = append(skipped, rel)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(files)
+	return files, skipped, nil
+}
+
+// buildInfo builds the torrent info of given payload files, which are
+// returned by payloadFiles. The info only depends on the content of the
+// files, their paths and the piece length, hence it is reproducible.
+func buildInfo(info *metainfo.Info, root string, files []string) error {
+	info.Name = filepath.Base(root)
+	info.Length = 0
+	info.Files = nil
+	for _, f := range files {
+		st, err := os.Stat(filepath.Join(root, filepath.FromSlash(f)))
+		if err != nil {
+			return err
+		}
+		if f == "." {
+			info.Length = st.Size()
+			continue
+		}
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Path:   strings.Split(f, "/"),
+			Length: st.Size(),
+		})
+	}
+	err := info.GeneratePieces(func(fi metainfo.FileInfo) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(root, filepath.Join(fi.Path...)))
+	})
+	if err != nil {
+		return fmt.Errorf("error generating pieces: %v", err)
+	}
+	return nil
+}
+
+// checkReproducible returns an error if the payload at given root has a file
+// which is neither a directory nor a regular file, such as a symlink, that
+// is not excluded. Such files are left out of the torrent, although they may
+// be regular files in another checkout of the same sources, e.g. symlinks on
+// a filesystem without them.
+func checkReproducible(root string, patterns []string) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if excluded(rel, patterns) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file, which is not reproducible", rel)
+		}
+		return nil
+	})
+}
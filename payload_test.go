@@ -0,0 +1,85 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestExcluded(t *testing.T) {
+	for rel, expected := range map[string]bool{
+		".git":                 true,
+		".git/config":          true,
+		"src/.main.sh.swp":     true,
+		"lib/__pycache__/a.py": true,
+		"main.sh":              false,
+		"build/cache/x":        true,
+		"src/build/cache/x":    false,
+	} {
+		if excluded(rel, append(DefaultExcludes, "build/cache")) != expected {
+			t.Errorf("%s: excluded must be %v", rel, expected)
+		}
+	}
+	if ValidateExcludes([]string{"[a-"}) == nil {
+		t.Error("malformed pattern is accepted")
+	}
+}
+
+func TestPayloadFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-payload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"main.sh", ".git/HEAD", "lib/b.sh", "lib/.b.sh.swp", "lib/a.sh"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, skipped, err := payloadFiles(dir, DefaultExcludes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(files, " "); s != "lib/a.sh lib/b.sh main.sh" {
+		t.Errorf("wrong files %s", s)
+	}
+	if s := strings.Join(skipped, " "); s != ".git lib/.b.sh.swp" {
+		t.Errorf("wrong excluded files %s", s)
+	}
+	if _, _, err = payloadFiles(dir, []string{"*.sh"}); err == nil {
+		t.Error("excluding the entrypoint must fail")
+	}
+
+	// the torrent is reproducible, and the excluded files are not in it
+	build := func() []byte {
+		info := metainfo.Info{PieceLength: MinPieceLength}
+		if err := buildInfo(&info, dir, files); err != nil {
+			t.Fatal(err)
+		}
+		b, err := bencode.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b := build()
+	if !bytes.Equal(b, build()) {
+		t.Error("torrent info is not reproducible")
+	}
+	if bytes.Contains(b, []byte(".git")) || bytes.Contains(b, []byte("swp")) {
+		t.Error("excluded files are in the torrent info")
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// attrPeerCert, attrPeerSignature and attrSessionKeys are
+// comprehension-optional STUN attributes. A binding request carries the
+// certificate of its sender, the messages of a peer carry its signature, and
+// the session table sent by the server carries the public keys of its peers.
+const (
+	attrPeerCert      stun.AttrType = 0x8f15
+	attrPeerSignature stun.AttrType = 0x8f16
+	attrSessionKeys   stun.AttrType = 0x8f17
+)
+
+const (
+	peerCertVersion = 1
+	peerCertSize    = 2 + len(PeerID{}) + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// the prefixes of the signed data, so that a certificate signature
+	// cannot be replayed as a message signature and conversely
+	peerCertDomain      = "p2pupdate peer certificate\x00"
+	peerSignatureDomain = "p2pupdate peer signature\x00"
+
+	peerCertPEMType = "P2PUPDATE PEER CERTIFICATE"
+)
+
+// PeerCert binds a PeerID to the Ed25519 public key of a peer. It is either
+// issued by the fleet CA key, or self-signed by the peer, in which case the
+// server pins its key on first contact.
+type PeerCert struct {
+	PeerID    PeerID
+	PublicKey ed25519.PublicKey
+	CA        bool // issued by the CA key
+	Signature []byte
+}
+
+// newPeerCert returns the certificate of given PeerID and public key signed
+// by given key, which is the CA key if ca is true, or else the private key of
+// the peer.
+func newPeerCert(pid PeerID, pub ed25519.PublicKey, key ed25519.PrivateKey, ca bool) *PeerCert {
+	c := &PeerCert{PeerID: pid, PublicKey: pub, CA: ca}
+	c.Signature = ed25519.Sign(key, c.signedData())
+	return c
+}
+
+func (c *PeerCert) signedData() []byte {
+	var b bytes.Buffer
+	b.WriteString(peerCertDomain)
+	b.WriteByte(peerCertVersion)
+	if c.CA {
+		b.WriteByte(1)
+	} else {
+		b.WriteByte(0)
+	}
+	b.Write(c.PeerID[:])
+	b.Write(c.PublicKey)
+	return b.Bytes()
+}
+
+// Verify returns an error if the certificate is not signed by given CA key,
+// or if it is self-signed and ca is nil.
+func (c *PeerCert) Verify(ca ed25519.PublicKey) error {
+	signer := c.PublicKey
+	if c.CA {
+		if ca == nil {
+			return errors.New("certificate is issued by a CA that is not configured")
+		}
+		signer = ca
+	} else if ca != nil {
+		return errors.New("certificate is self-signed")
+	}
+	if len(signer) != ed25519.PublicKeySize || !ed25519.Verify(signer, c.signedData(), c.Signature) {
+		return errors.New("certificate signature is invalid")
+	}
+	return nil
+}
+
+// MarshalBinary encodes the certificate as version, flags, PeerID, public
+// key and signature.
+func (c *PeerCert) MarshalBinary() ([]byte, error) {
+	if len(c.PublicKey) != ed25519.PublicKeySize || len(c.Signature) != ed25519.SignatureSize {
+		return nil, errors.New("incomplete peer certificate")
+	}
+	b := c.signedData()[len(peerCertDomain):]
+	return append(b, c.Signature...), nil
+}
+
+// UnmarshalBinary decodes a certificate encoded by MarshalBinary.
+func (c *PeerCert) UnmarshalBinary(b []byte) error {
+	if len(b) != peerCertSize {
+		return fmt.Errorf("length of peer certificate (%d bytes) is not %d bytes", len(b), peerCertSize)
+	}
+	if b[0] != peerCertVersion || b[1] > 1 {
+		return fmt.Errorf("unsupported peer certificate version %d", b[0])
+	}
+	c.CA = b[1] == 1
+	b = b[2:]
+	copy(c.PeerID[:], b)
+	b = b[len(c.PeerID):]
+	c.PublicKey = ed25519.PublicKey(append([]byte(nil), b[:ed25519.PublicKeySize]...))
+	c.Signature = append([]byte(nil), b[ed25519.PublicKeySize:]...)
+	return nil
+}
+
+// AddTo adds PeerCert into STUN message.
+func (c *PeerCert) AddTo(m *stun.Message) error {
+	b, err := c.MarshalBinary()
+	if err == nil {
+		m.Add(attrPeerCert, b)
+	}
+	return err
+}
+
+// GetFrom gets PeerCert from STUN message.
+func (c *PeerCert) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrPeerCert)
+	if err != nil {
+		return err
+	}
+	return c.UnmarshalBinary(b)
+}
+
+// peerSignature signs the STUN message it is added to with the key of the
+// peer. It must be added before MESSAGE-INTEGRITY and FINGERPRINT.
+type peerSignature struct {
+	key ed25519.PrivateKey
+}
+
+// signedMessageData returns the data of given raw message that is signed,
+// i.e. its type, transaction ID and the attributes before the signature,
+// whose offset is given. The length is excluded since the attributes that
+// follow change it.
+func signedMessageData(raw []byte, offset int) []byte {
+	var b bytes.Buffer
+	b.WriteString(peerSignatureDomain)
+	b.Write(raw[0:2])
+	b.Write(raw[4:offset])
+	return b.Bytes()
+}
+
+// AddTo adds the signature of the message into it, nothing if there is no
+// key.
+func (s peerSignature) AddTo(m *stun.Message) error {
+	if s.key == nil {
+		return nil
+	}
+	m.Add(attrPeerSignature, ed25519.Sign(s.key, signedMessageData(m.Raw, len(m.Raw))))
+	return nil
+}
+
+// verifyPeerSignature returns an error if given message is not signed by
+// given key.
+func verifyPeerSignature(m *stun.Message, key ed25519.PublicKey) error {
+	offset := 20 // header
+	for _, a := range m.Attributes {
+		if a.Type == attrPeerSignature {
+			if len(a.Value) != ed25519.SignatureSize || len(key) != ed25519.PublicKeySize ||
+				!ed25519.Verify(key, signedMessageData(m.Raw, offset), a.Value) {
+				return errors.New("peer signature is invalid")
+			}
+			return nil
+		}
+		offset += 4 + (int(a.Length)+3)&^3
+	}
+	return errors.New("peer signature is missing")
+}
+
+// SessionKeys are the public keys of the peers of a session table. The peers
+// without key are omitted.
+type SessionKeys map[PeerID][]byte
+
+// AddTo marshals SessionKeys as MessagePack data, then writes it on given
+// STUN message if there is any key.
+func (sk SessionKeys) AddTo(m *stun.Message) error {
+	if len(sk) == 0 {
+		return nil
+	}
+	data, err := msgpack.Marshal(sk)
+	if err == nil {
+		m.Add(attrSessionKeys, data)
+	}
+	return err
+}
+
+// GetFrom gets SessionKeys from STUN message.
+func (sk *SessionKeys) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrSessionKeys)
+	if err != nil {
+		return err
+	}
+	keys := make(SessionKeys)
+	if err = msgpack.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	*sk = keys
+	return nil
+}
+
+// setPeerKey sets the public key of given peer, or removes it if it has
+// none.
+func setPeerKey(sk SessionKeys, pid PeerID, key []byte) {
+	if len(key) == ed25519.PublicKeySize {
+		sk[pid] = key
+	} else {
+		delete(sk, pid)
+	}
+}
+
+// PeerIdentityConfig holds the configurations of the identity of the agent,
+// i.e. its key and the certificate binding its PeerID to the key.
+type PeerIdentityConfig struct {
+	// Disabled=true sends neither certificate nor signature, e.g. to a
+	// server that does not pin the keys.
+	Disabled bool `json:"disabled"`
+
+	// KeyFile is the private key of the agent, peer.key in the data
+	// directory by default, which is generated if it does not exist. Its
+	// public key is written beside it (.pub) so that the CA can issue a
+	// certificate.
+	KeyFile string `json:"key-file"`
+
+	// CertFile is the certificate issued by the CA (see the peer-cert
+	// command), otherwise the agent sends a self-signed certificate.
+	CertFile string `json:"cert-file"`
+}
+
+// PeerIdentity is the key and certificate of the agent. A nil identity
+// neither signs nor certifies anything.
+type PeerIdentity struct {
+	key  ed25519.PrivateKey
+	cert *PeerCert
+}
+
+// peerKeyFilename returns the private key file of the agent.
+func (cfg *Config) peerKeyFilename() string {
+	if cfg.PeerIdentity.KeyFile != "" {
+		return cfg.PeerIdentity.KeyFile
+	}
+	return filepath.Join(cfg.DataDir, "peer.key")
+}
+
+// loadPeerIdentity returns the identity of the agent of given PeerID, or nil
+// if it is disabled. The key is generated if it does not exist and create
+// is true.
+func loadPeerIdentity(cfg *Config, pid PeerID, create bool) (*PeerIdentity, error) {
+	if cfg.PeerIdentity.Disabled {
+		return nil, nil
+	}
+	filename := cfg.peerKeyFilename()
+	key, err := loadPeerKey(filename)
+	if os.IsNotExist(errors.Cause(err)) && create {
+		if key, err = generatePeerKey(filename); err == nil {
+			log.Printf("generated peer key %s", filename)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if cfg.PeerIdentity.CertFile == "" {
+		return &PeerIdentity{key: key, cert: newPeerCert(pid, pub, key, false)}, nil
+	}
+	cert, err := loadPeerCert(cfg.PeerIdentity.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cert.PublicKey, pub) {
+		return nil, fmt.Errorf("certificate %s is not issued for key %s", cfg.PeerIdentity.CertFile, filename)
+	}
+	if cert.PeerID != pid {
+		return nil, fmt.Errorf("certificate %s is issued for peer ID %s, not %s",
+			cfg.PeerIdentity.CertFile, cert.PeerID, pid)
+	}
+	return &PeerIdentity{key: key, cert: cert}, nil
+}
+
+// Cert returns the setter of the certificate of the identity.
+func (id *PeerIdentity) Cert() stun.Setter {
+	if id == nil {
+		return peerSignature{}
+	}
+	return id.cert
+}
+
+// Signature returns the setter of the signature of the messages of the
+// identity.
+func (id *PeerIdentity) Signature() stun.Setter {
+	if id == nil {
+		return peerSignature{}
+	}
+	return peerSignature{key: id.key}
+}
+
+// loadPeerKey reads an Ed25519 private key from given PEM file.
+func loadPeerKey(filename string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reading key file %s", filename)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("failed decoding private key in file %s", filename)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing private key in file %s: %v", filename, err)
+	}
+	if key, ok := key.(ed25519.PrivateKey); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key type in file %s is not Ed25519", filename)
+}
+
+// generatePeerKey generates an Ed25519 key, then writes it into given PEM
+// file, and its public key beside it (.pub).
+func generatePeerKey(filename string) (ed25519.PrivateKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pubDer, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filename+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}),
+		0644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// loadEd25519PublicKey reads an Ed25519 public key from given PEM file, e.g.
+// the CA key or the key of a peer.
+func loadEd25519PublicKey(filename string) (ed25519.PublicKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading file %s: %v", filename, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("failed decoding public key in file %s", filename)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing public key in file %s: %v", filename, err)
+	}
+	if pub, ok := pub.(ed25519.PublicKey); ok {
+		return pub, nil
+	}
+	return nil, fmt.Errorf("key type in file %s is not Ed25519", filename)
+}
+
+// loadPeerCert reads a peer certificate from given PEM file.
+func loadPeerCert(filename string) (*PeerCert, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading file %s: %v", filename, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != peerCertPEMType {
+		return nil, fmt.Errorf("failed decoding peer certificate in file %s", filename)
+	}
+	var c PeerCert
+	if err = c.UnmarshalBinary(block.Bytes); err != nil {
+		return nil, errors.Wrapf(err, "invalid peer certificate in file %s", filename)
+	}
+	return &c, nil
+}
+
+// encodePeerCert returns given certificate as a PEM block.
+func encodePeerCert(c *PeerCert) ([]byte, error) {
+	b, err := c.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: peerCertPEMType, Bytes: b}), nil
+}
+
+// parsePeerID parses a PeerID in hexadecimal.
+func parsePeerID(s string) (PeerID, error) {
+	var pid PeerID
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(pid) {
+		return pid, fmt.Errorf("invalid peer ID %q", s)
+	}
+	copy(pid[:], b)
+	return pid, nil
+}
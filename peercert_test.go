@@ -0,0 +1,249 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestPeerCert(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	caPub, caKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	self := newPeerCert(pid, pub, key, false)
+	if err := self.Verify(nil); err != nil {
+		t.Errorf("self-signed certificate is invalid: %v", err)
+	}
+	if err := self.Verify(caPub); err == nil {
+		t.Error("self-signed certificate is accepted with a CA")
+	}
+	issued := newPeerCert(pid, pub, caKey, true)
+	if err := issued.Verify(caPub); err != nil {
+		t.Errorf("issued certificate is invalid: %v", err)
+	}
+	if err := issued.Verify(nil); err == nil {
+		t.Error("issued certificate is accepted without CA")
+	}
+	if err := newPeerCert(pid, pub, key, true).Verify(caPub); err == nil {
+		t.Error("certificate issued by the peer key is accepted as CA certificate")
+	}
+
+	m := stun.MustBuild(stun.TransactionID, stun.BindingRequest, issued)
+	var got PeerCert
+	if err := got.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if got.PeerID != pid || !got.CA || got.Verify(caPub) != nil {
+		t.Errorf("unexpected certificate %+v", got)
+	}
+	b, _ := issued.MarshalBinary()
+	b[2] ^= 1
+	if err := got.UnmarshalBinary(b); err != nil || got.Verify(caPub) == nil {
+		t.Error("certificate of another peer ID is accepted")
+	}
+	if err := got.UnmarshalBinary(b[1:]); err == nil {
+		t.Error("truncated certificate is decoded")
+	}
+}
+
+func TestPeerSignature(t *testing.T) {
+	pid := PeerID{1}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	m := stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid, peerSignature{key},
+		stun.NewShortTermIntegrity("secret"), stun.Fingerprint)
+
+	// decode the raw message as the receiver does
+	var got stun.Message
+	if _, err := got.Write(m.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPeerSignature(&got, pub); err != nil {
+		t.Errorf("signature is invalid: %v", err)
+	}
+	if err := verifyPeerSignature(&got, other); err == nil {
+		t.Error("signature is accepted with another key")
+	}
+	tampered := make([]byte, len(m.Raw))
+	copy(tampered, m.Raw)
+	tampered[24] ^= 1 // the PeerID
+	got = stun.Message{}
+	if _, err := got.Write(tampered); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPeerSignature(&got, pub); err == nil {
+		t.Error("signature of a tampered message is accepted")
+	}
+	unsigned := stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid, peerSignature{})
+	if err := verifyPeerSignature(unsigned, pub); err == nil {
+		t.Error("unsigned message is accepted")
+	}
+}
+
+func TestLoadPeerIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{DataDir: dir}
+	pid := PeerID{7}
+	if _, err = loadPeerIdentity(cfg, pid, false); err == nil {
+		t.Error("missing key is loaded")
+	}
+	id, err := loadPeerIdentity(cfg, pid, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.cert.CA || id.cert.PeerID != pid || id.cert.Verify(nil) != nil {
+		t.Errorf("unexpected self-signed certificate %+v", id.cert)
+	}
+	pub, err := loadEd25519PublicKey(filepath.Join(dir, "peer.key.pub"))
+	if err != nil || !pub.Equal(id.cert.PublicKey) {
+		t.Fatalf("public key file does not match the key: %v", err)
+	}
+
+	// a certificate issued by the CA with the peer-cert command
+	caFile := filepath.Join(dir, "ca.key")
+	caKey, err := generatePeerKey(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := encodePeerCert(newPeerCert(pid, pub, caKey, true))
+	cfg.PeerIdentity.CertFile = filepath.Join(dir, "peer.crt")
+	if err = ioutil.WriteFile(cfg.PeerIdentity.CertFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if id, err = loadPeerIdentity(cfg, pid, false); err != nil || !id.cert.CA {
+		t.Errorf("issued certificate is not loaded: %v", err)
+	}
+	if _, err = loadPeerIdentity(cfg, PeerID{8}, false); err == nil {
+		t.Error("certificate of another peer ID is loaded")
+	}
+	cfg.PeerIdentity.Disabled = true
+	if id, err = loadPeerIdentity(cfg, pid, false); err != nil || id != nil {
+		t.Error("disabled identity is loaded")
+	}
+}
+
+func TestServerPeerIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerpin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultServerConfig()
+	cfg.Database = filepath.Join(dir, "server.db")
+	s := &Server{cfg: cfg}
+	if err = s.loadPeerIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	pid := PeerID{1}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	id := &PeerIdentity{key: key, cert: newPeerCert(pid, pub, key, false)}
+	binding := func(id *PeerIdentity) *stun.Message {
+		return stun.MustBuild(stun.TransactionID, stun.BindingRequest, &pid, id.Cert(), id.Signature())
+	}
+
+	// an old agent without certificate is accepted until its key is pinned
+	if err = s.checkPeerCert(binding(nil), pid, pid); err != nil {
+		t.Errorf("peer without certificate is rejected: %v", err)
+	}
+	if err = s.checkPeerCert(binding(id), pid, pid); err != nil {
+		t.Fatalf("first contact is rejected: %v", err)
+	}
+	if !s.peerKeys[pid].Equal(pub) {
+		t.Fatal("key is not pinned")
+	}
+	if err = s.checkPeerCert(binding(id), pid, pid); err != nil {
+		t.Errorf("pinned peer is rejected: %v", err)
+	}
+
+	// another agent claiming the PeerID
+	otherPub, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	spoof := &PeerIdentity{key: otherKey, cert: newPeerCert(pid, otherPub, otherKey, false)}
+	if err = s.checkPeerCert(binding(spoof), pid, pid); err == nil {
+		t.Error("certificate of another key is accepted")
+	}
+	if err = s.checkPeerCert(binding(nil), pid, pid); err == nil {
+		t.Error("pinned peer without certificate is accepted")
+	}
+	stolen := &PeerIdentity{key: otherKey, cert: id.cert}
+	if err = s.checkPeerCert(binding(stolen), pid, pid); err == nil {
+		t.Error("certificate signed by another key is accepted")
+	}
+
+	// the other messages must be signed by the pinned key
+	m := stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid, id.Signature())
+	if err = s.checkPeerMessage(m, pid); err != nil {
+		t.Errorf("signed message is rejected: %v", err)
+	}
+	m = stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid, spoof.Signature())
+	if err = s.checkPeerMessage(m, pid); err == nil {
+		t.Error("message signed by another key is accepted")
+	}
+
+	// forged messages claiming the peer ID blacklist their sender, not the
+	// peer
+	s.blacklist = NewBlacklist(BlacklistConfig{Threshold: 3, Window: 60, Cooldown: 600})
+	s.validation = NewValidationStats("test.validation_failures")
+	attacker := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 9), Port: 3478}
+	for i := 0; i < 5; i++ {
+		m = stun.MustBuild(stun.TransactionID, stunProgressIndication, stun.NewUsername(signatureName), &pid,
+			spoof.Signature(), stun.NewShortTermIntegrity(cfg.StunPassword), stun.Fingerprint)
+		if err = s.processMessage(nil, attacker, m, new(stun.Message)); err == nil {
+			t.Fatal("forged message is processed")
+		}
+	}
+	if s.blacklist.Blocked(peerSource(pid)) {
+		t.Error("peer ID claimed by forged messages is blacklisted")
+	}
+	if !s.blacklist.Blocked(addrSource(attacker)) {
+		t.Error("sender of forged messages is not blacklisted")
+	}
+	s.blacklist, s.validation = nil, nil
+	if keys := s.sessionKeys(SessionTable{pid: Session{}, PeerID{2}: Session{}}); len(keys) != 1 {
+		t.Errorf("unexpected session keys %v", keys)
+	}
+
+	// the pinned keys are persistent
+	s = &Server{cfg: cfg}
+	if err = s.loadPeerIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.peerKeys[pid].Equal(pub) {
+		t.Error("pinned key is not loaded")
+	}
+
+	// in CA mode, a certificate issued by the CA replaces the pinned key
+	caFile := filepath.Join(dir, "ca.key")
+	caKey, err := generatePeerKey(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.PeerIdentity = PeerIdentityServerConfig{Mode: PeerIdentityCA, CAKey: caFile + ".pub"}
+	if err = s.loadPeerIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.checkPeerCert(binding(id), pid, pid); err == nil {
+		t.Error("self-signed certificate is accepted in CA mode")
+	}
+	issued := &PeerIdentity{key: otherKey, cert: newPeerCert(pid, otherPub, caKey, true)}
+	if err = s.checkPeerCert(binding(issued), pid, pid); err != nil {
+		t.Errorf("issued certificate is rejected: %v", err)
+	}
+	if !s.peerKeys[pid].Equal(otherPub) {
+		t.Error("pinned key is not replaced by the issued one")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// The modes of verification of the peer certificates by the server.
+const (
+	PeerIdentityTOFU = "tofu" // the key of a self-signed certificate is pinned on first contact
+	PeerIdentityCA   = "ca"   // the certificates must be issued by the CA key
+	PeerIdentityOff  = "off"
+)
+
+// PeerIdentityServerConfig holds the configurations of the verification of
+// the peer certificates by the server.
+type PeerIdentityServerConfig struct {
+	Mode  string `json:"mode"`
+	CAKey string `json:"ca-key"` // Ed25519 public key file of the fleet CA
+
+	// Required=true rejects the peers without certificate, e.g. old agents,
+	// otherwise only the peers whose key is pinned must sign.
+	Required bool `json:"required"`
+}
+
+// loadPeerIdentity loads the CA key and the pinned keys of the peers.
+func (s *Server) loadPeerIdentity() error {
+	cfg := s.cfg.PeerIdentity
+	switch cfg.Mode {
+	case "", PeerIdentityTOFU, PeerIdentityOff:
+	case PeerIdentityCA:
+		if cfg.CAKey == "" {
+			return errors.New("peer identity mode ca requires a ca-key")
+		}
+	default:
+		return fmt.Errorf("invalid peer identity mode %q", cfg.Mode)
+	}
+	if cfg.CAKey != "" {
+		key, err := loadEd25519PublicKey(cfg.CAKey)
+		if err != nil {
+			return err
+		}
+		s.caKey = key
+	}
+	s.peerKeys = make(map[PeerID]ed25519.PublicKey)
+	b, err := ioutil.ReadFile(s.peerKeysFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var keys map[string][]byte
+	if err = json.Unmarshal(b, &keys); err != nil {
+		return errors.Wrapf(err, "invalid peer keys file %s", s.peerKeysFilename())
+	}
+	for k, v := range keys {
+		if pid, err := parsePeerID(k); err == nil && len(v) == ed25519.PublicKeySize {
+			s.peerKeys[pid] = v
+		}
+	}
+	return nil
+}
+
+// peerKeysFilename returns the file of the pinned keys of the peers.
+func (s *Server) peerKeysFilename() string {
+	return s.cfg.Database + ".peer-keys"
+}
+
+// pinPeerKey pins the key of given peer and saves the pinned keys. The
+// caller must hold the lock.
+func (s *Server) pinPeerKey(pid PeerID, key ed25519.PublicKey) {
+	if _, ok := s.peerKeys[pid]; ok {
+		log.Printf("replaced the pinned key of peer %s by the key of its CA certificate", pid)
+		metrics.Inc("server.peer_identity", "result", "replaced")
+	} else {
+		log.Printf("pinned the key of peer %s", pid)
+		metrics.Inc("server.peer_identity", "result", "pinned")
+	}
+	if s.peerKeys == nil {
+		s.peerKeys = make(map[PeerID]ed25519.PublicKey)
+	}
+	s.peerKeys[pid] = key
+	keys := make(map[string][]byte, len(s.peerKeys))
+	for k, v := range s.peerKeys {
+		keys[k.String()] = v
+	}
+	b, err := json.Marshal(keys)
+	if err == nil {
+		tmp := s.peerKeysFilename() + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0640); err == nil {
+			err = os.Rename(tmp, s.peerKeysFilename())
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: failed saving the pinned peer keys: %v", err)
+	}
+}
+
+// rejectPeer logs and counts the rejection of a message claiming given
+// PeerID, and returns the error.
+func rejectPeer(pid PeerID, err error) error {
+	log.Printf("WARNING: rejected message claiming peer ID %s: %v", pid, err)
+	metrics.Inc("server.peer_identity", "result", "rejected")
+	return errors.Wrapf(err, "peer %s", pid)
+}
+
+// checkPeerCert returns an error unless the binding request of given
+// requested and registered PeerIDs carries a valid certificate of the
+// requested one and is signed by its key, which must be the key pinned for
+// the registered one. A key is pinned on first contact, and replaced by the
+// key of a certificate issued by the CA, e.g. a reprovisioned peer. A peer
+// without certificate is accepted unless its key is pinned or a certificate
+// is required. The caller must hold the lock.
+func (s *Server) checkPeerCert(req *stun.Message, requested, pid PeerID) error {
+	cfg := s.cfg.PeerIdentity
+	if cfg.Mode == PeerIdentityOff {
+		return nil
+	}
+	pinned := s.peerKeys[pid]
+	var cert PeerCert
+	if err := cert.GetFrom(req); err == stun.ErrAttributeNotFound {
+		if pinned != nil || cfg.Required {
+			return rejectPeer(pid, errors.New("certificate is missing"))
+		}
+		return nil
+	} else if err != nil {
+		return rejectPeer(pid, err)
+	}
+	if cert.PeerID != requested {
+		return rejectPeer(pid, fmt.Errorf("certificate is issued for peer ID %s", cert.PeerID))
+	}
+	ca := s.caKey
+	if !cert.CA {
+		if cfg.Mode == PeerIdentityCA {
+			return rejectPeer(pid, errors.New("certificate is self-signed"))
+		}
+		ca = nil
+	}
+	if err := cert.Verify(ca); err != nil {
+		return rejectPeer(pid, err)
+	}
+	if err := verifyPeerSignature(req, cert.PublicKey); err != nil {
+		return rejectPeer(pid, err)
+	}
+	switch {
+	case pinned == nil, cert.CA && !bytes.Equal(pinned, cert.PublicKey):
+		s.pinPeerKey(pid, cert.PublicKey)
+	case !bytes.Equal(pinned, cert.PublicKey):
+		return rejectPeer(pid, errors.New("key differs from the pinned key"))
+	}
+	return nil
+}
+
+// checkPeerMessage returns an error if given message, other than a binding
+// request, claims given PeerID whose key is pinned but is not signed by it,
+// or if a certificate is required and the peer has none.
+func (s *Server) checkPeerMessage(req *stun.Message, pid PeerID) error {
+	if s.cfg.PeerIdentity.Mode == PeerIdentityOff {
+		return nil
+	}
+	s.RLock()
+	key := s.peerKeys[pid]
+	s.RUnlock()
+	if key == nil {
+		if s.cfg.PeerIdentity.Required {
+			return rejectPeer(pid, errors.New("peer has no pinned key"))
+		}
+		return nil
+	}
+	if err := verifyPeerSignature(req, key); err != nil {
+		return rejectPeer(pid, err)
+	}
+	return nil
+}
+
+// sessionKeys returns the public keys of the peers of given session table.
+// The caller must hold the lock.
+func (s *Server) sessionKeys(st SessionTable) SessionKeys {
+	keys := make(SessionKeys)
+	for pid := range st {
+		if key, ok := s.peerKeys[pid]; ok {
+			keys[pid] = key
+		}
+	}
+	return keys
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var errUpdatePlatformMismatch = errors.New("update does not target the platform of the agent")
+
+var (
+	// cpuModelVariant matches the ARM version of the model name of a CPU
+	// in /proc/cpuinfo, e.g. ARMv6-compatible processor rev 7 (v6l).
+	cpuModelVariant = regexp.MustCompile(`ARMv(\d+)`)
+
+	platformPattern = regexp.MustCompile(`^[a-z0-9_]+/[a-z0-9_]+(/v[0-9]+)?$`)
+)
+
+// LocalPlatform returns the platform of the machine, e.g. linux/arm/v6 on a
+// Raspberry Pi Zero and linux/arm/v7 on a Pi 3 running a 32-bit system, which
+// is GOOS/GOARCH of the agent and, on ARM, the version of the CPU read from
+// /proc/cpuinfo since an ARMv6 binary of the agent runs on both.
+func LocalPlatform() string {
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	if !strings.HasPrefix(runtime.GOARCH, "arm") {
+		return platform
+	}
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return platform
+	}
+	defer file.Close()
+	if v := parseCPUInfoVariant(file); len(v) > 0 {
+		platform += "/" + v
+	}
+	return platform
+}
+
+// parseCPUInfoVariant reads cpuinfo formatted data from given reader and
+// returns the ARM version of the CPU, e.g. v7, or an empty string if it is
+// not found. The model name wins over the CPU architecture, which is 7 on the
+// ARMv6 CPU of the Raspberry Pi Zero.
+func parseCPUInfoVariant(r io.Reader) string {
+	var arch string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "model name", "Processor":
+			if m := cpuModelVariant.FindStringSubmatch(value); m != nil {
+				return "v" + m[1]
+			}
+		case "CPU architecture":
+			if arch == "" && len(value) > 0 && strings.Trim(value, "0123456789") == "" {
+				arch = "v" + value
+			}
+		}
+	}
+	return arch
+}
+
+// validatePlatforms returns an error if a platform of a notification is not
+// os/arch or os/arch/variant, e.g. linux/arm/v6.
+func validatePlatforms(platforms []string) error {
+	for _, p := range platforms {
+		if !platformPattern.MatchString(p) {
+			return fmt.Errorf("invalid platform '%s', expected os/arch[/variant], e.g. linux/arm/v6", p)
+		}
+	}
+	return nil
+}
+
+// MatchPlatform returns true if the update of the notification targets given
+// platform of an agent, which is always the case if it has no platform. A
+// platform without variant, e.g. linux/arm, targets all its variants.
+func (mi *Notification) MatchPlatform(platform string) bool {
+	if len(mi.Platforms) == 0 {
+		return true
+	}
+	for _, p := range mi.Platforms {
+		if p == platform || strings.HasPrefix(platform, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlatform returns an error if the update does not target the platform
+// of the agent, unless the agent seeds such updates without deploying them,
+// i.e. it is a proxy or it seeds the foreign updates.
+func (a *Agent) checkPlatform(n *Notification) error {
+	if n.MatchPlatform(a.platform) || a.Config.Proxy || a.Config.SeedForeign {
+		return nil
+	}
+	return errors.Wrapf(errUpdatePlatformMismatch, "platform %s is not in [%s]", a.platform,
+		strings.Join(n.Platforms, " "))
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseCPUInfoVariant(t *testing.T) {
+	for _, test := range []struct {
+		name, cpuinfo, variant string
+	}{
+		{"Pi Zero", "processor\t: 0\nmodel name\t: ARMv6-compatible processor rev 7 (v6l)\n" +
+			"BogoMIPS\t: 697.95\nCPU architecture: 7\n", "v6"},
+		{"Pi 3", "processor\t: 0\nmodel name\t: ARMv7 Processor rev 4 (v7l)\n" +
+			"CPU architecture: 7\n", "v7"},
+		{"old kernel", "Processor\t: ARMv6-compatible processor rev 7 (v6l)\n", "v6"},
+		{"no model", "processor\t: 0\nCPU architecture: 8\n", "v8"},
+		{"x86", "processor\t: 0\nmodel name\t: Intel(R) Core(TM) i5\n", ""},
+	} {
+		if v := parseCPUInfoVariant(strings.NewReader(test.cpuinfo)); v != test.variant {
+			t.Errorf("%s: expected variant %q, got %q", test.name, test.variant, v)
+		}
+	}
+}
+
+func TestMatchPlatform(t *testing.T) {
+	for _, test := range []struct {
+		platforms []string
+		platform  string
+		match     bool
+	}{
+		{nil, "linux/arm/v6", true},
+		{[]string{"linux/arm/v6"}, "linux/arm/v6", true},
+		{[]string{"linux/arm/v6"}, "linux/arm/v7", false},
+		{[]string{"linux/arm"}, "linux/arm/v7", true},
+		{[]string{"linux/arm"}, "linux/arm64", false},
+		{[]string{"linux/amd64", "linux/arm/v7"}, "linux/arm/v7", true},
+		{[]string{"linux/arm/v7"}, "linux/arm", false},
+	} {
+		mi := Notification{Platforms: test.platforms}
+		if m := mi.MatchPlatform(test.platform); m != test.match {
+			t.Errorf("platform %s of %v: expected %t, got %t", test.platform, test.platforms, test.match, m)
+		}
+	}
+}
+
+func TestValidatePlatforms(t *testing.T) {
+	if err := validatePlatforms([]string{"linux/arm/v6", "linux/amd64", "darwin/arm64"}); err != nil {
+		t.Error(err)
+	}
+	for _, p := range []string{"linux", "linux/arm/6", "Linux/arm", "linux/arm/v6/x", ""} {
+		if err := validatePlatforms([]string{p}); err == nil {
+			t.Errorf("invalid platform '%s' is accepted", p)
+		}
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	n := &Notification{UUID: UUIDShell, Version: 1, Platforms: []string{"linux/arm/v6"}}
+	a := &Agent{Config: &Config{}, platform: "linux/amd64"}
+	if err := a.checkPlatform(n); errors.Cause(err) != errUpdatePlatformMismatch {
+		t.Errorf("expected platform mismatch, got %v", err)
+	}
+	a.Config.SeedForeign = true
+	if err := a.checkPlatform(n); err != nil {
+		t.Errorf("foreign update is not seeded: %v", err)
+	}
+	a.Config.SeedForeign, a.Config.Proxy = false, true
+	if err := a.checkPlatform(n); err != nil {
+		t.Errorf("foreign update is not seeded by the proxy: %v", err)
+	}
+	a.Config.Proxy, a.platform = false, "linux/arm/v6"
+	if err := a.checkPlatform(n); err != nil {
+		t.Error(err)
+	}
+}
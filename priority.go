@@ -0,0 +1,147 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The priorities of the updates. A notification without priority is normal.
+const (
+	PriorityLow      = "low"
+	PriorityNormal   = "normal"
+	PriorityCritical = "critical"
+)
+
+// preemptedMaxConns is the maximum number of peer connections of a torrent
+// preempted by an update of higher priority, which keeps it in its swarm
+// while leaving the bandwidth to the preempting update.
+const preemptedMaxConns = 4
+
+// validatePriority returns an error if given priority of a notification is
+// not supported.
+func validatePriority(p string) error {
+	switch p {
+	case "", PriorityLow, PriorityNormal, PriorityCritical:
+		return nil
+	}
+	return fmt.Errorf("invalid priority '%s', it must be %s, %s or %s", p, PriorityLow, PriorityNormal,
+		PriorityCritical)
+}
+
+// priorityRank returns the rank of given priority, the higher the more urgent.
+func priorityRank(p string) int {
+	switch p {
+	case PriorityLow:
+		return 0
+	case PriorityCritical:
+		return 2
+	}
+	return 1
+}
+
+// priority returns the priority of the update, which is normal if the
+// notification has none.
+func (mi *Notification) priority() string {
+	if len(mi.Priority) == 0 {
+		return PriorityNormal
+	}
+	return mi.Priority
+}
+
+// PriorityTracker tracks the updates being downloaded and their priorities,
+// so that the monitor of an update finds whether it is preempted without
+// locking the other updates. It is safe for concurrent use.
+type PriorityTracker struct {
+	sync.Mutex
+	downloads map[string]priorityDownload // by update key
+}
+
+type priorityDownload struct {
+	uuid string
+	rank int
+}
+
+// Set records whether the update of given key, UUID and priority is being
+// downloaded.
+func (pt *PriorityTracker) Set(key, uuid, priority string, downloading bool) {
+	if pt == nil {
+		return
+	}
+	pt.Lock()
+	defer pt.Unlock()
+	if !downloading {
+		delete(pt.downloads, key)
+		return
+	}
+	if pt.downloads == nil {
+		pt.downloads = make(map[string]priorityDownload)
+	}
+	pt.downloads[key] = priorityDownload{uuid: uuid, rank: priorityRank(priority)}
+}
+
+// Preempting returns the UUID of the download that preempts the downloads of
+// given priority, i.e. the most urgent one of higher priority, or an empty
+// string if there is none. Hence the downloads of the same priority share the
+// bandwidth as usual.
+func (pt *PriorityTracker) Preempting(priority string) string {
+	if pt == nil {
+		return ""
+	}
+	pt.Lock()
+	defer pt.Unlock()
+	rank, uuid := priorityRank(priority), ""
+	for _, d := range pt.downloads {
+		if d.rank > rank || (d.rank == rank && len(uuid) > 0 && d.uuid < uuid) {
+			rank, uuid = d.rank, d.uuid
+		}
+	}
+	return uuid
+}
+
+// preemptState is the state of the preemption of an update by the download
+// of an update of higher priority.
+type preemptState struct {
+	by    string    // UUID of the preempting update, empty if not preempted
+	since time.Time // of the preemption
+	conns int       // maximum peer connections of the torrent before it
+}
+
+// checkPreemption pauses the download of the update while an update of
+// higher priority is being downloaded: its pieces are not requested anymore
+// and its peer connections are reduced. The previous state is restored once
+// the preempting update is complete. It returns true if the update is
+// preempted. The caller must hold the lock.
+func (u *Update) checkPreemption(a *Agent) bool {
+	by, p := a.priorities.Preempting(u.Notification.priority()), &u.preempted
+	if len(by) == 0 {
+		if len(p.by) > 0 {
+			u.torrent.SetMaxEstablishedConns(p.conns)
+			u.logf("update uuid:%s version:%d is resumed, it was preempted by uuid:%s for %s",
+				u.Notification.UUID, u.Notification.Version, p.by, time.Since(p.since).Round(time.Second))
+			metrics.Set("update.preempted", 0, "uuid", u.Notification.UUID, "namespace", u.ns.label())
+			// the pause was not a stall of the torrent
+			u.reannounced.progress, u.fallback.stalled, u.delta.progress = time.Time{}, time.Time{}, time.Time{}
+			*p = preemptState{}
+		}
+		return false
+	}
+	if len(p.by) == 0 {
+		p.conns, p.since = u.torrent.SetMaxEstablishedConns(preemptedMaxConns), time.Now()
+		u.torrent.CancelPieces(0, u.torrent.NumPieces())
+		if u.patch != nil {
+			u.patch.CancelPieces(0, u.patch.NumPieces())
+		}
+		metrics.Set("update.preempted", 1, "uuid", u.Notification.UUID, "namespace", u.ns.label())
+	}
+	if p.by != by {
+		u.logf("update uuid:%s version:%d priority:%s is preempted by uuid:%s", u.Notification.UUID,
+			u.Notification.Version, u.Notification.priority(), by)
+		p.by = by
+	}
+	return true
+}
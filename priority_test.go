@@ -0,0 +1,59 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestValidatePriority(t *testing.T) {
+	for _, p := range []string{"", PriorityLow, PriorityNormal, PriorityCritical} {
+		if err := validatePriority(p); err != nil {
+			t.Errorf("priority '%s' is invalid: %v", p, err)
+		}
+	}
+	for _, p := range []string{"high", "Critical", " low"} {
+		if err := validatePriority(p); err == nil {
+			t.Errorf("priority '%s' is valid", p)
+		}
+	}
+	if p := (&Notification{}).priority(); p != PriorityNormal {
+		t.Errorf("notification without priority is %s", p)
+	}
+}
+
+func TestPriorityTracker(t *testing.T) {
+	var pt PriorityTracker
+	pt.Set("bulk", "b", PriorityLow, true)
+	pt.Set("app", "a", "", true)
+	if by := pt.Preempting(PriorityNormal); by != "" {
+		t.Errorf("normal download is preempted by %s", by)
+	}
+	if by := pt.Preempting(PriorityLow); by != "a" {
+		t.Errorf("low download is preempted by '%s', expected a", by)
+	}
+
+	pt.Set("fix-2", "f2", PriorityCritical, true)
+	pt.Set("fix-1", "f1", PriorityCritical, true)
+	for _, p := range []string{PriorityLow, PriorityNormal} {
+		if by := pt.Preempting(p); by != "f1" {
+			t.Errorf("%s download is preempted by '%s', expected f1", p, by)
+		}
+	}
+	if by := pt.Preempting(PriorityCritical); by != "" {
+		t.Errorf("critical download is preempted by %s", by)
+	}
+
+	// the preemption ends once the critical updates are downloaded
+	pt.Set("fix-1", "", "", false)
+	pt.Set("fix-2", "f2", PriorityCritical, false)
+	if by := pt.Preempting(PriorityNormal); by != "" {
+		t.Errorf("normal download is still preempted by %s", by)
+	}
+
+	var nilTracker *PriorityTracker
+	nilTracker.Set("app", "a", PriorityCritical, true)
+	if by := nilTracker.Preempting(PriorityLow); by != "" {
+		t.Errorf("nil tracker preempts by %s", by)
+	}
+}
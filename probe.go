@@ -0,0 +1,313 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// methodPing is a private STUN method of the liveness probes between agents.
+const methodPing stun.Method = 0x0f1
+
+var (
+	stunPingRequest  = stun.NewType(methodPing, stun.ClassRequest)
+	stunPingResponse = stun.NewType(methodPing, stun.ClassSuccessResponse)
+)
+
+// probeRelayTimeout is how long a peer may take to reply a direct ping before
+// it is pinged again through the relay of the server.
+const probeRelayTimeout = 3 * time.Second
+
+// ProbeConfig holds configurations of the liveness probes of overlay peers.
+// Only the peers that the agent is trying to use are probed, at most MaxPeers
+// of them every Interval, and those that do not reply are pinged once more
+// through the server.
+type ProbeConfig struct {
+	Interval    int `json:"interval"` // in seconds, zero disables the probes
+	MaxPeers    int `json:"max-peers"`
+	MaxFailures int `json:"max-failures"` // consecutive failures to mark a peer down
+}
+
+// DefaultProbeConfig returns default probe configurations.
+func DefaultProbeConfig() ProbeConfig {
+	return ProbeConfig{
+		Interval:    60,
+		MaxPeers:    8,
+		MaxFailures: 3,
+	}
+}
+
+// PeerLiveness is the liveness of an overlay peer in the local peer state.
+type PeerLiveness struct {
+	Down     bool      `json:"down"`
+	RTT      float64   `json:"rtt-ms,omitempty"`
+	Failures int       `json:"failures"`
+	LastSeen time.Time `json:"last-seen,omitempty"`
+	Relayed  bool      `json:"relayed,omitempty"` // replied through the server only
+
+	wanted   time.Time
+	probed   time.Time
+	pending  bool
+	viaRelay bool // the pending ping is sent through the server
+	txID     [stun.TransactionIDSize]byte
+}
+
+// Want marks given peer as one that the agent is trying to use, so its
+// liveness is probed.
+func (overlay *OverlayConn) Want(pid PeerID) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	l, ok := overlay.liveness[pid]
+	if !ok {
+		l = new(PeerLiveness)
+		overlay.liveness[pid] = l
+	}
+	l.wanted = time.Now()
+}
+
+// Alive returns false if given peer has failed the probes and has not replied
+// since, otherwise true.
+func (overlay *OverlayConn) Alive(pid PeerID) bool {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	l, ok := overlay.liveness[pid]
+	return !ok || !l.Down
+}
+
+// Liveness returns the liveness of given peer, or false if it is not probed.
+func (overlay *OverlayConn) Liveness(pid PeerID) (PeerLiveness, bool) {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if l, ok := overlay.liveness[pid]; ok {
+		return *l, true
+	}
+	return PeerLiveness{}, false
+}
+
+// probePeers sends a ping to the wanted peers, after counting the unanswered
+// pings of the previous round as failures. The peers that do not reply
+// within probeRelayTimeout are pinged again through the server by
+// relayProbes.
+func (overlay *OverlayConn) probePeers() {
+	cfg := overlay.Config.Probe
+	interval := time.Duration(cfg.Interval) * time.Second
+	now := time.Now()
+
+	overlay.Lock()
+	defer overlay.Unlock()
+	if overlay.conn == nil || !overlay.Ready() {
+		return
+	}
+
+	var candidates []PeerID
+	for pid, l := range overlay.liveness {
+		sess, ok := overlay.peers[pid]
+		if !ok || now.Sub(l.wanted) > 2*interval {
+			// the peer has left or is no longer used
+			delete(overlay.liveness, pid)
+			continue
+		}
+		if l.pending {
+			l.pending = false
+			l.Failures++
+			metrics.Inc("overlay.probes", "result", "timeout")
+			if l.Failures >= cfg.MaxFailures && !l.Down {
+				l.Down = true
+				log.Printf("peer %s[%s] is down after %d failed probes",
+					pid, overlay.peerAddr(sess), l.Failures)
+			}
+		}
+		candidates = append(candidates, pid)
+	}
+
+	// the peers probed least recently go first
+	sort.Slice(candidates, func(i, j int) bool {
+		return overlay.liveness[candidates[i]].probed.Before(overlay.liveness[candidates[j]].probed)
+	})
+	if len(candidates) > cfg.MaxPeers {
+		candidates = candidates[:cfg.MaxPeers]
+	}
+	for _, pid := range candidates {
+		if err := overlay.sendProbe(pid, false, now); err != nil {
+			log.Printf("failed building ping message: %v", err)
+			return
+		}
+	}
+	if len(candidates) > 0 && overlay.rendezvousAddr != nil {
+		time.AfterFunc(probeRelayTimeout, overlay.relayProbes)
+	}
+}
+
+// relayProbes pings again through the server the peers that have not replied
+// the direct ping of the current round, before their failure is counted.
+func (overlay *OverlayConn) relayProbes() {
+	now := time.Now()
+	overlay.Lock()
+	defer overlay.Unlock()
+	if overlay.conn == nil || !overlay.Ready() {
+		return
+	}
+	for pid, l := range overlay.liveness {
+		if !l.pending || l.viaRelay {
+			continue
+		}
+		if _, ok := overlay.peers[pid]; !ok {
+			continue
+		}
+		if err := overlay.sendProbe(pid, true, now); err != nil {
+			log.Printf("failed building ping message: %v", err)
+			return
+		}
+	}
+}
+
+// sendProbe sends a ping to given peer, directly or through the server, and
+// marks it pending. It only returns an error if the message cannot be built.
+// The caller must hold the lock.
+func (overlay *OverlayConn) sendProbe(pid PeerID, relay bool, now time.Time) error {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunPingRequest,
+		overlay.localIDAttr(),
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	addr := overlay.peerAddr(overlay.peers[pid])
+	if relay {
+		addr = overlay.rendezvousAddr
+		err = overlay.relayTo(pid, msg.Raw)
+	} else {
+		_, err = overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+	}
+	if err != nil {
+		log.Printf("WARNING: failed sending ping to %s[%s] - %v", pid, addr, err)
+	}
+	l := overlay.liveness[pid]
+	l.pending, l.viaRelay, l.probed, l.txID = true, relay, now, msg.TransactionID
+	if relay {
+		metrics.Inc("overlay.probes", "result", "relayed")
+	} else {
+		metrics.Inc("overlay.probes", "result", "sent")
+	}
+	return nil
+}
+
+// pingRequest replies a ping request sent by given peer.
+func (overlay *OverlayConn) pingRequest(pid *PeerID, req *stun.Message) error {
+	res, err := stun.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stunPingResponse,
+		overlay.localIDAttr(),
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	// a ping relayed by the server is replied through it
+	if overlay.relayedBy(overlay.senderAddr, *pid) {
+		return overlay.relayTo(*pid, res.Raw)
+	}
+	_, err = overlay.conn.conn.WriteToUDP(res.Raw, overlay.senderAddr)
+	return err
+}
+
+// pingResponse marks the peer that replied a ping as alive.
+func (overlay *OverlayConn) pingResponse(pid *PeerID, res *stun.Message) error {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if done, ok := overlay.pings[res.TransactionID]; ok {
+		close(done)
+		delete(overlay.pings, res.TransactionID)
+	}
+	l, ok := overlay.liveness[*pid]
+	if !ok || !l.pending || l.txID != res.TransactionID {
+		// a late or unsolicited response is harmless
+		return nil
+	}
+	now := time.Now()
+	l.pending = false
+	l.Failures = 0
+	l.LastSeen = now
+	l.Relayed = overlay.relayedBy(overlay.senderAddr, *pid)
+	l.RTT = float64(now.Sub(l.probed)) / float64(time.Millisecond)
+	metrics.Inc("overlay.probes", "result", "pong")
+	if l.Down {
+		l.Down = false
+		log.Printf("peer %s is up again", pid)
+	}
+	return nil
+}
+
+// Ping sends a ping to given peer of the session table, directly or through
+// the relay of the server, and waits for its response until the timeout. It
+// returns the address of the peer and the round-trip time.
+func (overlay *OverlayConn) Ping(pid PeerID, timeout time.Duration, relay bool) (*net.UDPAddr, time.Duration, error) {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunPingRequest,
+		overlay.localIDAttr(),
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	done := make(chan struct{})
+
+	overlay.Lock()
+	sess, ok := overlay.peers[pid]
+	if !ok {
+		overlay.Unlock()
+		return nil, 0, errPeerNotFound
+	} else if overlay.conn == nil {
+		overlay.Unlock()
+		return nil, 0, errConnNotOpened
+	}
+	addr := overlay.peerAddr(sess)
+	if overlay.pings == nil {
+		overlay.pings = make(map[[stun.TransactionIDSize]byte]chan struct{})
+	}
+	overlay.pings[msg.TransactionID] = done
+	start := time.Now()
+	if relay {
+		err = overlay.relayTo(pid, msg.Raw)
+	} else {
+		_, err = overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+	}
+	overlay.Unlock()
+	defer func() {
+		overlay.Lock()
+		delete(overlay.pings, msg.TransactionID)
+		overlay.Unlock()
+	}()
+	if err != nil {
+		return addr, 0, err
+	}
+
+	select {
+	case <-done:
+		return addr, time.Since(start), nil
+	case <-time.After(timeout):
+		return addr, 0, fmt.Errorf("no ping response within %v", timeout)
+	}
+}
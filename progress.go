@@ -0,0 +1,423 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// methodProgress and methodSubscribe are private STUN methods. An agent sends
+// progress indications of its updates to the server, which forwards them as
+// they are to the clients that have subscribed to their UUIDs.
+const (
+	methodProgress  stun.Method = 0x0f2
+	methodSubscribe stun.Method = 0x0f3
+)
+
+var (
+	stunProgressIndication = stun.NewType(methodProgress, stun.ClassIndication)
+	stunSubscribeRequest   = stun.NewType(methodSubscribe, stun.ClassRequest)
+	stunSubscribeResponse  = stun.NewType(methodSubscribe, stun.ClassSuccessResponse)
+)
+
+// attrProgress carries the progress of an update, and attrSubscription the
+// UUID subscribed by a client.
+const (
+	attrProgress     stun.AttrType = 0x8f0d
+	attrSubscription stun.AttrType = 0x8f0e
+)
+
+const (
+	// progressMinInterval is the minimum interval between two progress
+	// indications of an update whose state has not changed, on top of
+	// sending them only when the progress crosses a progressBucket.
+	progressMinInterval = 5 * time.Second
+
+	// subscriptionLifetime is how long the server keeps a subscription,
+	// which the client refreshes every subscriptionRefresh.
+	subscriptionLifetime = 30 * time.Second
+	subscriptionRefresh  = 10 * time.Second
+
+	// maxSubscriptions bounds the subscriptions of the server, since each of
+	// them multiplies the forwarded indications.
+	maxSubscriptions = 64
+
+	// watchUsername is the STUN username of a subscribing client, which is
+	// not a peer of the overlay.
+	watchUsername = "p2pupdate-watch"
+)
+
+// UpdateProgress is the lightweight progress of an update in an agent, which
+// is identified by the username of the indication.
+type UpdateProgress struct {
+	UUID    string      `msgpack:"u" json:"uuid"`
+	Version uint64      `msgpack:"v" json:"version"`
+	Percent int         `msgpack:"p" json:"percent"` // rounded down to progressBucket
+	State   UpdateState `msgpack:"s" json:"state"`
+}
+
+// AddTo adds the progress to STUN message.
+func (p *UpdateProgress) AddTo(m *stun.Message) error {
+	data, err := msgpack.Marshal(p)
+	if err == nil {
+		m.Add(attrProgress, data)
+	}
+	return err
+}
+
+// GetFrom gets the progress from STUN message.
+func (p *UpdateProgress) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrProgress)
+	if err != nil {
+		return err
+	}
+	if err = msgpack.Unmarshal(data, p); err != nil {
+		return err
+	}
+	if p.UUID == "" {
+		return errors.New("progress without uuid")
+	}
+	return nil
+}
+
+// Subscription is the UUID whose progress indications a client receives.
+type Subscription string
+
+// AddTo adds the subscription to STUN message.
+func (s Subscription) AddTo(m *stun.Message) error {
+	m.Add(attrSubscription, []byte(s))
+	return nil
+}
+
+// GetFrom gets the subscription from STUN message.
+func (s *Subscription) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrSubscription)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("empty subscription")
+	}
+	*s = Subscription(data)
+	return nil
+}
+
+// progressLog decides when the progress of an update is sent: when its state
+// changes, or when it crosses a progressBucket but not more often than
+// progressMinInterval.
+type progressLog struct {
+	last UpdateProgress
+	sent time.Time
+}
+
+// shouldSend returns true if given progress must be sent at given time, which
+// is then recorded as sent.
+func (l *progressLog) shouldSend(p UpdateProgress, now time.Time) bool {
+	switch {
+	case p == l.last:
+		return false
+	case p.State == l.last.State && now.Sub(l.sent) < progressMinInterval:
+		return false
+	}
+	l.last, l.sent = p, now
+	return true
+}
+
+// sendProgress sends the progress of the update to the server if it has
+// changed enough since it was last sent. The caller must hold the lock.
+func (u *Update) sendProgress() {
+	overlay := u.agent.Overlay
+	if overlay == nil || !overlay.Ready() {
+		return
+	}
+	p := UpdateProgress{
+		UUID:    u.Notification.UUID,
+		Version: u.Notification.Version,
+		Percent: int(u.fingerprint().Progress),
+		State:   u.State,
+	}
+	if !u.progressLog.shouldSend(p, time.Now()) {
+		return
+	}
+	if err := overlay.SendProgress(&p); err != nil {
+		log.Printf("failed sending progress uuid:%s version:%d - %v", p.UUID, p.Version, err)
+	}
+}
+
+// SendProgress sends given progress of an update to the server.
+func (overlay *OverlayConn) SendProgress(p *UpdateProgress) error {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunProgressIndication,
+		overlay.localIDAttr(),
+		p,
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	return err
+}
+
+// subscriber is a client subscribed to the progress of an update.
+type subscriber struct {
+	addr    net.Addr
+	expires time.Time
+}
+
+// subscribe registers the client of given address to the progress of the
+// UUID of the request, or refreshes its subscription, and responds.
+func (s *Server) subscribe(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	var uuid Subscription
+	if err := uuid.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting subscription")
+	}
+	now := time.Now()
+	s.Lock()
+	s.pruneSubscribers(now)
+	subs, ok := s.subscribers[string(uuid)]
+	if !ok {
+		subs = make(map[string]*subscriber)
+		s.subscribers[string(uuid)] = subs
+	}
+	sub, ok := subs[addr.String()]
+	if !ok {
+		if s.countSubscribers() >= maxSubscriptions {
+			s.Unlock()
+			return fmt.Errorf("subscription of %s to %s exceeds the maximum of %d", addr, uuid, maxSubscriptions)
+		}
+		sub = &subscriber{addr: addr}
+		subs[addr.String()] = sub
+		log.Printf("%s subscribed to the progress of uuid:%s", addr, uuid)
+	}
+	sub.expires = now.Add(subscriptionLifetime)
+	s.Unlock()
+
+	err := res.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stunSubscribeResponse,
+		&s.ID,
+		uuid,
+		stun.NewShortTermIntegrity(s.cfg.StunPassword),
+		stun.Fingerprint,
+	)
+	if err == nil {
+		_, err = conn.WriteTo(res.Raw, addr)
+	}
+	return err
+}
+
+// forwardProgress forwards a progress indication of a peer to the clients
+// that have subscribed to its UUID. Only the peers of the session table are
+// forwarded.
+func (s *Server) forwardProgress(conn net.PacketConn, req *stun.Message) error {
+	var (
+		pid PeerID
+		p   UpdateProgress
+	)
+	if err := pid.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting peer ID")
+	}
+	if err := p.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting progress")
+	}
+	now := time.Now()
+	s.RLock()
+	defer s.RUnlock()
+	if _, ok := s.peers[pid]; !ok {
+		return fmt.Errorf("progress of %s which is not in the session table", pid)
+	}
+	metrics.Inc("server.progress", "type", "received")
+	for _, sub := range s.subscribers[p.UUID] {
+		if now.After(sub.expires) {
+			continue
+		}
+		if _, err := conn.WriteTo(req.Raw, sub.addr); err != nil {
+			log.Printf("failed forwarding progress of %s to %s - %v", pid, sub.addr, err)
+			continue
+		}
+		metrics.Inc("server.progress", "type", "forwarded")
+	}
+	return nil
+}
+
+// pruneSubscribers removes the expired subscriptions. The caller must hold
+// the lock.
+func (s *Server) pruneSubscribers(now time.Time) {
+	for uuid, subs := range s.subscribers {
+		for addr, sub := range subs {
+			if now.After(sub.expires) {
+				delete(subs, addr)
+			}
+		}
+		if len(subs) == 0 {
+			delete(s.subscribers, uuid)
+		}
+	}
+}
+
+// countSubscribers returns the number of subscriptions. The caller must hold
+// the lock.
+func (s *Server) countSubscribers() int {
+	n := 0
+	for _, subs := range s.subscribers {
+		n += len(subs)
+	}
+	return n
+}
+
+// ProgressSummary is the latest progress of each peer of an update version,
+// as seen by a subscribed client.
+type ProgressSummary struct {
+	UUID    string
+	Version uint64 // the latest version seen if it was not given
+	peers   map[PeerID]UpdateProgress
+}
+
+// NewProgressSummary returns a summary of given update version, or of its
+// latest version if it is 0.
+func NewProgressSummary(uuid string, version uint64) *ProgressSummary {
+	return &ProgressSummary{UUID: uuid, Version: version, peers: make(map[PeerID]UpdateProgress)}
+}
+
+// Add records the progress of given peer. The progress of an older version
+// is ignored, and a newer one discards the others when the version was not
+// given. It returns false if the progress is ignored.
+func (ps *ProgressSummary) Add(pid PeerID, p UpdateProgress, fixed bool) bool {
+	if p.UUID != ps.UUID || p.Version < ps.Version || (fixed && p.Version != ps.Version) {
+		return false
+	}
+	if p.Version > ps.Version {
+		ps.Version = p.Version
+		ps.peers = make(map[PeerID]UpdateProgress)
+	}
+	ps.peers[pid] = p
+	return true
+}
+
+// Counts returns the number of peers downloading the update, waiting to
+// deploy it, having deployed it and having failed.
+func (ps *ProgressSummary) Counts() (downloading, waiting, deployed, failed int) {
+	for _, p := range ps.peers {
+		switch p.State {
+		case UpdatePending, UpdateDownloading:
+			downloading++
+		case UpdateDeployed:
+			deployed++
+		case UpdateFailed, UpdateFailedDownload, UpdateFailedDiskSpace, UpdateBlocked:
+			failed++
+		default:
+			waiting++
+		}
+	}
+	return
+}
+
+// WriteLine renders the summary on one line, which overwrites the previous
+// one on a terminal.
+func (ps *ProgressSummary) WriteLine(w io.Writer) {
+	downloading, waiting, deployed, failed := ps.Counts()
+	fmt.Fprintf(w, "\ruuid:%s version:%d peers:%d downloading:%d waiting:%d deployed:%d failed:%d ",
+		ps.UUID, ps.Version, len(ps.peers), downloading, waiting, deployed, failed)
+}
+
+// watchProgress subscribes to the progress of given update at the server and
+// renders its summary until the timeout, or until quorum peers have deployed
+// it if quorum is positive. The latest version is watched if version is 0.
+func watchProgress(server, password, uuid string, version uint64, timeout time.Duration,
+	quorum int, w io.Writer) error {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return errors.Wrapf(err, "invalid server address %s", server)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var (
+		summary    = NewProgressSummary(uuid, version)
+		deadline   = time.Now().Add(timeout)
+		subscribed time.Time
+		confirmed  bool
+		buf        = make([]byte, 2048)
+		msg        = new(stun.Message)
+	)
+	defer fmt.Fprintln(w)
+	for time.Now().Before(deadline) {
+		if time.Since(subscribed) >= subscriptionRefresh {
+			req, err := stun.Build(
+				stun.TransactionID,
+				stunSubscribeRequest,
+				stun.NewUsername(watchUsername),
+				Subscription(uuid),
+				stun.NewShortTermIntegrity(password),
+				stun.Fingerprint,
+			)
+			if err != nil {
+				return err
+			}
+			if _, err = conn.WriteToUDP(req.Raw, raddr); err != nil {
+				return errors.Wrap(err, "failed subscribing")
+			}
+			subscribed = time.Now()
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return err
+		}
+		msg.Reset()
+		if _, err = msg.Write(buf[:n]); err != nil || validateMessage(msg, nil, password) != nil {
+			continue
+		}
+		switch msg.Type {
+		case stunSubscribeResponse:
+			if !confirmed {
+				confirmed = true
+				summary.WriteLine(w)
+			}
+		case stunProgressIndication:
+			var (
+				pid PeerID
+				p   UpdateProgress
+			)
+			if pid.GetFrom(msg) != nil || p.GetFrom(msg) != nil || !summary.Add(pid, p, version > 0) {
+				continue
+			}
+			summary.WriteLine(w)
+			if _, _, deployed, _ := summary.Counts(); quorum > 0 && deployed >= quorum {
+				return nil
+			}
+		}
+	}
+	if !confirmed {
+		return fmt.Errorf("server %s did not confirm the subscription", server)
+	}
+	if quorum > 0 {
+		return fmt.Errorf("timeout before %d peers deployed the update", quorum)
+	}
+	return nil
+}
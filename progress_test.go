@@ -0,0 +1,112 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestUpdateProgressMessage(t *testing.T) {
+	pid := PeerID{1, 2, 3}
+	p := UpdateProgress{UUID: "foo", Version: 3, Percent: 40, State: UpdateDownloading}
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunProgressIndication,
+		&pid,
+		&p,
+		stun.NewShortTermIntegrity(defaultStunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = validateMessage(msg, &stunProgressIndication, defaultStunPassword); err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+	var (
+		gotPid PeerID
+		got    UpdateProgress
+	)
+	if err = gotPid.GetFrom(msg); err != nil || gotPid != pid {
+		t.Errorf("peer ID is %s (%v), expected %s", gotPid, err, pid)
+	}
+	if err = got.GetFrom(msg); err != nil || got != p {
+		t.Errorf("progress is %+v (%v), expected %+v", got, err, p)
+	}
+
+	// the progress and the subscription are optional attributes
+	msg, _ = stun.Build(stun.TransactionID, stunSubscribeRequest, stun.NewUsername(watchUsername))
+	if err = got.GetFrom(msg); err != stun.ErrAttributeNotFound {
+		t.Errorf("expected attribute not found, got %v", err)
+	}
+	var sub Subscription
+	if err = sub.GetFrom(msg); err != stun.ErrAttributeNotFound {
+		t.Errorf("expected attribute not found, got %v", err)
+	}
+	msg, _ = stun.Build(stun.TransactionID, stunSubscribeRequest, Subscription("foo"))
+	if err = sub.GetFrom(msg); err != nil || sub != "foo" {
+		t.Errorf("subscription is '%s' (%v)", sub, err)
+	}
+}
+
+func TestProgressLog(t *testing.T) {
+	var (
+		l   progressLog
+		now = time.Now()
+		p   = UpdateProgress{UUID: "foo", Version: 1, State: UpdateDownloading}
+	)
+	if !l.shouldSend(p, now) {
+		t.Error("first progress is not sent")
+	}
+	if l.shouldSend(p, now.Add(time.Minute)) {
+		t.Error("unchanged progress is sent")
+	}
+	p.Percent = 10
+	if l.shouldSend(p, now.Add(time.Second)) {
+		t.Error("progress is sent within the minimum interval")
+	}
+	if !l.shouldSend(p, now.Add(progressMinInterval)) {
+		t.Error("progress is not sent after the minimum interval")
+	}
+	p.State = UpdateDownloaded
+	if !l.shouldSend(p, now.Add(progressMinInterval+time.Second)) {
+		t.Error("state change is not sent immediately")
+	}
+}
+
+func TestProgressSummary(t *testing.T) {
+	ps := NewProgressSummary("foo", 0)
+	add := func(id byte, version uint64, state UpdateState) bool {
+		return ps.Add(PeerID{id}, UpdateProgress{UUID: "foo", Version: version, State: state}, false)
+	}
+	add(1, 1, UpdateDeployed)
+	add(2, 2, UpdateDownloading)
+	if ps.Version != 2 {
+		t.Fatalf("version is %d, expected the latest 2", ps.Version)
+	}
+	if add(1, 1, UpdateDeployed) {
+		t.Error("progress of an older version is added")
+	}
+	add(3, 2, UpdateDeployed)
+	add(4, 2, UpdateFailed)
+	add(5, 2, UpdateWaiting)
+	add(2, 2, UpdateDownloaded)
+	downloading, waiting, deployed, failed := ps.Counts()
+	if downloading != 0 || waiting != 2 || deployed != 1 || failed != 1 {
+		t.Errorf("counts are %d %d %d %d", downloading, waiting, deployed, failed)
+	}
+	if ps.Add(PeerID{6}, UpdateProgress{UUID: "bar", Version: 2}, false) {
+		t.Error("progress of another update is added")
+	}
+
+	// a given version is never replaced
+	ps = NewProgressSummary("foo", 2)
+	if ps.Add(PeerID{1}, UpdateProgress{UUID: "foo", Version: 3}, true) || ps.Version != 2 {
+		t.Error("progress of another version is added")
+	}
+}
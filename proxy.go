@@ -0,0 +1,213 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+const proxyDialTimeout = 30 * time.Second
+
+// proxyEnvVars are the standard environment variables of the proxy, which are
+// used when the proxy is not set in the configurations.
+var proxyEnvVars = []string{
+	"HTTPS_PROXY", "https_proxy",
+	"HTTP_PROXY", "http_proxy",
+	"ALL_PROXY", "all_proxy",
+}
+
+// ProxyURL returns the URL of the proxy, i.e. the given configured URL or the
+// standard environment variables. It returns nil if there is no proxy. The
+// supported schemes are http, https, socks5 and socks5h. The destinations
+// excluded by the standard environment variable NO_PROXY are reached
+// directly anyway (see proxyBypass).
+func ProxyURL(configured string) (*url.URL, error) {
+	raw := configured
+	for _, env := range proxyEnvVars {
+		if raw != "" {
+			break
+		}
+		raw = os.Getenv(env)
+	}
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL does not have a host: %s", raw)
+	}
+	return u, nil
+}
+
+// redactProxyURL returns the URL of the proxy without its password, or an
+// empty string if there is no proxy.
+func redactProxyURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	if r.User != nil {
+		r.User = url.User(r.User.Username())
+	}
+	return r.String()
+}
+
+// proxyBypass returns a function that returns true if given destination is
+// reached directly rather than through given proxy, i.e. if it is excluded by
+// the standard environment variable NO_PROXY or it is a loopback address.
+func proxyBypass(u *url.URL) func(dest *url.URL) bool {
+	cfg := httpproxy.FromEnvironment()
+	cfg.HTTPProxy, cfg.HTTPSProxy = u.String(), u.String()
+	proxyFor := cfg.ProxyFunc()
+	return func(dest *url.URL) bool {
+		p, err := proxyFor(dest)
+		return err == nil && p == nil
+	}
+}
+
+// proxyFunc returns the proxy function of an http.Transport which goes
+// through given proxy unless the destination bypasses it.
+func proxyFunc(u *url.URL) func(*http.Request) (*url.URL, error) {
+	bypass := proxyBypass(u)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypass(req.URL) {
+			return nil, nil
+		}
+		return u, nil
+	}
+}
+
+// newHTTPClient returns a fasthttp client that connects through given proxy,
+// or directly if the proxy is nil or the destination bypasses it.
+func newHTTPClient(u *url.URL) *fasthttp.Client {
+	c := &fasthttp.Client{Name: softwareName}
+	if u != nil {
+		dial, bypass := proxyDialer(u), proxyBypass(u)
+		direct := &net.Dialer{Timeout: proxyDialTimeout}
+		c.Dial = func(addr string) (net.Conn, error) {
+			// the scheme does not matter since it has the same proxy
+			if bypass(&url.URL{Scheme: "https", Host: addr}) {
+				return direct.Dial("tcp", addr)
+			}
+			return dial(addr)
+		}
+	}
+	return c
+}
+
+// newTrackerHTTPClient returns the HTTP client used by the torrent client to
+// announce to trackers.
+func newTrackerHTTPClient(u *url.URL) *http.Client {
+	if u == nil {
+		return nil
+	}
+	return &http.Client{
+		Timeout: proxyDialTimeout,
+		Transport: &http.Transport{
+			Proxy:               proxyFunc(u),
+			TLSHandshakeTimeout: proxyDialTimeout,
+		},
+	}
+}
+
+// proxyDialer returns a function that opens a TCP connection to given address
+// through the proxy.
+func proxyDialer(u *url.URL) func(addr string) (net.Conn, error) {
+	direct := &net.Dialer{Timeout: proxyDialTimeout}
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		var auth *proxy.Auth
+		if u.User != nil {
+			auth = &proxy.Auth{User: u.User.Username()}
+			auth.Password, _ = u.User.Password()
+		}
+		return func(addr string) (net.Conn, error) {
+			d, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+			if err != nil {
+				return nil, err
+			}
+			return d.Dial("tcp", addr)
+		}
+	}
+	return func(addr string) (net.Conn, error) {
+		return httpConnect(direct, u, addr)
+	}
+}
+
+// httpConnect opens a tunnel to given address with HTTP method CONNECT.
+func httpConnect(direct *net.Dialer, u *url.URL, addr string) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(direct, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = direct.Dial("tcp", u.Host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + credential + "\r\n"
+	}
+	req += "\r\n"
+
+	conn.SetDeadline(time.Now().Add(proxyDialTimeout))
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	// the response of a successful CONNECT has no body
+	res, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed reading response of proxy %s: %v", u.Host, err)
+	}
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", u.Host, addr, res.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the server has sent data right after the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose data has been partly read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
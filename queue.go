@@ -0,0 +1,412 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+// methodAck is a private STUN method. An agent acknowledges with an ack
+// indication each queued message that the server has delivered to it.
+const methodAck stun.Method = 0x0f4
+
+var stunAckIndication = stun.NewType(methodAck, stun.ClassIndication)
+
+// attrMessageID carries the ID of a queued message, in its data indication
+// and in the ack indication of the agent.
+const attrMessageID stun.AttrType = 0x8f14
+
+// The defaults of the queues of the messages to the peers.
+const (
+	queueDefaultMaxMessages   = 64
+	queueDefaultMaxBytes      = 64 * 1024
+	queueDefaultTTL           = 24 * 3600 // in seconds
+	queueDefaultOfflineAfter  = 60        // in seconds
+	queueDefaultMaxAttempts   = 5
+	queueDefaultRetryInterval = 10 // in seconds
+)
+
+var (
+	errQueueUnknownPeer = errors.New("the peer is not registered")
+	errQueueFull        = errors.New("the queue of the peer is full")
+	errQueueDisabled    = errors.New("the queues are disabled")
+)
+
+// QueueConfig holds configurations of the queues of the messages addressed to
+// the peers, which hold the messages of the peers that are offline until they
+// register again. A queue holds at most MaxMessages messages and MaxBytes
+// bytes of payload, and a message is dropped if it is not delivered within TTL
+// or it is not acknowledged after MaxAttempts deliveries. The queues are
+// disabled if MaxMessages is 0.
+type QueueConfig struct {
+	MaxMessages   int `json:"max-messages"`
+	MaxBytes      int `json:"max-bytes"`
+	TTL           int `json:"ttl"`            // in seconds
+	OfflineAfter  int `json:"offline-after"`  // in seconds since the latest binding
+	MaxAttempts   int `json:"max-attempts"`   // of the delivery of a message
+	RetryInterval int `json:"retry-interval"` // in seconds
+}
+
+// MessageID is the ID of a queued message.
+type MessageID uint64
+
+// AddTo adds MessageID into STUN message.
+func (id MessageID) AddTo(m *stun.Message) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	m.Add(attrMessageID, b)
+	return nil
+}
+
+// GetFrom gets MessageID from STUN message.
+func (id *MessageID) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrMessageID)
+	if err != nil {
+		return err
+	} else if len(b) != 8 {
+		return fmt.Errorf("length of message ID (%d bytes) is not 8 bytes", len(b))
+	}
+	*id = MessageID(binary.BigEndian.Uint64(b))
+	return nil
+}
+
+// queuedMessage is a message waiting in the queue of a peer.
+type queuedMessage struct {
+	ID       MessageID
+	Type     string
+	Data     []byte
+	Queued   time.Time
+	Expires  time.Time
+	Attempts int
+	Sent     time.Time // of the latest attempt
+}
+
+// PeerQueue is the occupancy of the queue of a peer.
+type PeerQueue struct {
+	Messages int       `json:"messages"`
+	Bytes    int       `json:"bytes"`
+	Oldest   time.Time `json:"oldest"`
+	Attempts int       `json:"attempts"` // of the message at the head
+	Online   bool      `json:"online"`
+}
+
+// enqueue appends given message to the queue of given peer, and delivers it
+// if the peer is online and its queue was empty. The peer must be registered.
+func (s *Server) enqueue(pid PeerID, typ string, data []byte) (MessageID, error) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	cfg := s.cfg.Queue
+	if cfg.MaxMessages <= 0 {
+		return 0, errQueueDisabled
+	}
+	if _, ok := s.peers[pid]; !ok {
+		return 0, errQueueUnknownPeer
+	}
+	if s.queues == nil {
+		s.queues = make(map[PeerID][]*queuedMessage)
+	}
+	s.expireMessages(pid, now)
+	q := s.queues[pid]
+	size := len(data)
+	for _, m := range q {
+		size += len(m.Data)
+	}
+	if len(q) >= cfg.MaxMessages || (cfg.MaxBytes > 0 && size > cfg.MaxBytes) {
+		metrics.Inc("server.queue", "result", "rejected")
+		return 0, errQueueFull
+	}
+	if s.nextMessageID == 0 {
+		// the IDs of the messages queued before a restart are not reused,
+		// since their late acks would remove the new messages
+		s.nextMessageID = MessageID(now.UnixNano())
+	}
+	s.nextMessageID++
+	m := &queuedMessage{
+		ID:      s.nextMessageID,
+		Type:    typ,
+		Data:    append([]byte(nil), data...),
+		Queued:  now,
+		Expires: now.Add(time.Duration(cfg.TTL) * time.Second),
+	}
+	s.queues[pid] = append(q, m)
+	metrics.Inc("server.queue", "result", "queued")
+	s.updateQueueGauges()
+	log.Printf("queued message type:%s id:%d for peer %s", m.Type, m.ID, pid)
+	s.deliverQueued(pid, now)
+	return m.ID, nil
+}
+
+// acknowledge removes the message of given ID from the queue of given peer,
+// and delivers its next message.
+func (s *Server) acknowledge(pid PeerID, id MessageID) {
+	s.Lock()
+	defer s.Unlock()
+	q := s.queues[pid]
+	for i, m := range q {
+		if m.ID != id {
+			continue
+		}
+		s.queues[pid] = append(q[:i], q[i+1:]...)
+		if len(s.queues[pid]) == 0 {
+			delete(s.queues, pid)
+		}
+		metrics.Inc("server.queue", "result", "delivered")
+		s.updateQueueGauges()
+		log.Printf("<- peer %s acknowledged message type:%s id:%d after %d attempts", pid, m.Type, m.ID,
+			m.Attempts)
+		s.deliverQueued(pid, time.Now())
+		return
+	}
+}
+
+// ackMessage handles an ack indication of a peer.
+func (s *Server) ackMessage(req *stun.Message) error {
+	var (
+		pid PeerID
+		id  MessageID
+	)
+	if err := pid.GetFrom(req); err != nil {
+		return err
+	}
+	if err := id.GetFrom(req); err != nil {
+		return fmt.Errorf("invalid ack of %s: %v", pid, err)
+	}
+	s.acknowledge(pid, id)
+	return nil
+}
+
+// peerOnline returns true if given peer has sent a binding within the offline
+// time of the configurations. The caller must hold the lock.
+func (s *Server) peerOnline(pid PeerID, now time.Time) bool {
+	last, ok := s.seen[pid]
+	return ok && now.Sub(last) <= time.Duration(s.cfg.Queue.OfflineAfter)*time.Second
+}
+
+// deliverQueued sends the message at the head of the queue of given peer if
+// it is online, and the message has not been sent within the retry interval.
+// The messages are delivered one at a time, hence in order. A message that
+// has not been acknowledged after the maximum attempts is dropped. The caller
+// must hold the lock.
+func (s *Server) deliverQueued(pid PeerID, now time.Time) {
+	cfg := s.cfg.Queue
+	for len(s.queues[pid]) > 0 {
+		m := s.queues[pid][0]
+		if !s.peerOnline(pid, now) ||
+			now.Sub(m.Sent) < time.Duration(cfg.RetryInterval)*time.Second {
+			return
+		}
+		if cfg.MaxAttempts > 0 && m.Attempts >= cfg.MaxAttempts {
+			log.Printf("dropped message type:%s id:%d for peer %s, unacknowledged after %d attempts",
+				m.Type, m.ID, pid, m.Attempts)
+			metrics.Inc("server.queue", "result", "undelivered")
+			s.dropHead(pid)
+			continue
+		}
+		session, ok := s.peers[pid]
+		if !ok || s.udpConn == nil {
+			return
+		}
+		m.Attempts++
+		m.Sent = now
+		if err := s.sendQueued(m, session[0]); err != nil {
+			log.Printf("WARNING: failed sending message type:%s id:%d to %s[%s] - %v", m.Type, m.ID,
+				pid, session[0], err)
+		} else {
+			log.Printf("-> sent message type:%s id:%d to %s[%s], attempt %d", m.Type, m.ID, pid,
+				session[0], m.Attempts)
+		}
+		return
+	}
+}
+
+// sendQueued sends given queued message to given address in a data indication
+// with TTL 1, hence the peer does not forward it.
+func (s *Server) sendQueued(m *queuedMessage, addr *net.UDPAddr) error {
+	msg := stunMessagePool.Get().(*stun.Message)
+	defer stunMessagePool.Put(msg)
+	msg.Reset()
+	err := msg.Build(
+		stun.TransactionID,
+		stunDataIndication,
+		s.cfg.Compression.encode(m.Data),
+		TTL(1),
+		m.ID,
+		&s.ID,
+		stun.NewShortTermIntegrity(s.cfg.StunPassword),
+		stun.Fingerprint,
+	)
+	if err == nil {
+		_, err = s.udpConn.WriteToUDP(msg.Raw, addr)
+	}
+	return err
+}
+
+// dropHead removes the message at the head of the queue of given peer. The
+// caller must hold the lock.
+func (s *Server) dropHead(pid PeerID) {
+	if q := s.queues[pid]; len(q) > 1 {
+		s.queues[pid] = q[1:]
+	} else {
+		delete(s.queues, pid)
+	}
+	s.updateQueueGauges()
+}
+
+// expireMessages drops the expired messages of the queue of given peer. The
+// caller must hold the lock.
+func (s *Server) expireMessages(pid PeerID, now time.Time) {
+	q := s.queues[pid]
+	kept := q[:0]
+	for _, m := range q {
+		if now.Before(m.Expires) {
+			kept = append(kept, m)
+			continue
+		}
+		log.Printf("dropped expired message type:%s id:%d for peer %s, queued at %s", m.Type, m.ID, pid,
+			m.Queued.Format(time.RFC3339))
+		metrics.Inc("server.queue", "result", "expired")
+	}
+	if len(kept) == len(q) {
+		return
+	}
+	if len(kept) == 0 {
+		delete(s.queues, pid)
+	} else {
+		s.queues[pid] = kept
+	}
+	s.updateQueueGauges()
+}
+
+// flushQueues drops the expired messages, and retries the delivery of the
+// messages of the online peers.
+func (s *Server) flushQueues() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for pid := range s.queues {
+		s.expireMessages(pid, now)
+		s.deliverQueued(pid, now)
+	}
+}
+
+// peerQueued delivers the queued messages of given peer, which has just
+// registered or refreshed its binding.
+func (s *Server) peerQueued(pid PeerID) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	if len(s.queues[pid]) > 0 {
+		s.expireMessages(pid, now)
+		s.deliverQueued(pid, now)
+	}
+}
+
+// updateQueueGauges sets the gauges of the occupancy of the queues. The caller
+// must hold the lock.
+func (s *Server) updateQueueGauges() {
+	var messages, size int
+	for _, q := range s.queues {
+		messages += len(q)
+		for _, m := range q {
+			size += len(m.Data)
+		}
+	}
+	metrics.Set("server.queue_messages", int64(messages))
+	metrics.Set("server.queue_bytes", int64(size))
+	metrics.Set("server.queue_peers", int64(len(s.queues)))
+}
+
+// queueStatus returns the occupancy of the queues by peer ID.
+func (s *Server) queueStatus(now time.Time) map[string]PeerQueue {
+	s.RLock()
+	defer s.RUnlock()
+	status := make(map[string]PeerQueue, len(s.queues))
+	for pid, q := range s.queues {
+		pq := PeerQueue{Messages: len(q), Online: s.peerOnline(pid, now)}
+		for _, m := range q {
+			pq.Bytes += len(m.Data)
+		}
+		if len(q) > 0 {
+			pq.Oldest, pq.Attempts = q[0].Queued, q[0].Attempts
+		}
+		status[pid.String()] = pq
+	}
+	return status
+}
+
+// serveQueues returns the occupancy of the queues of the peers.
+func (s *Server) serveQueues(ctx *fasthttp.RequestCtx) {
+	doJSONWrite(ctx, 200, s.queueStatus(time.Now()))
+}
+
+// serveQueueMessage queues the body of the request, e.g. a bencoded operator
+// message, for the peer of given path '/peers/<peer-id>/messages'. The query
+// argument 'type' names the message in the logs.
+func (s *Server) serveQueueMessage(ctx *fasthttp.RequestCtx, path string) {
+	var pid PeerID
+	b, err := hex.DecodeString(strings.TrimSuffix(strings.TrimPrefix(path, "/peers/"), "/messages"))
+	if err != nil || len(b) != len(pid) {
+		ctx.SetStatusCode(400)
+		return
+	}
+	copy(pid[:], b)
+	body := ctx.PostBody()
+	if len(body) == 0 || len(body) > stunMaxPacketDataSize {
+		ctx.SetStatusCode(400)
+		return
+	}
+	typ := string(ctx.QueryArgs().Peek("type"))
+	if typ == "" {
+		typ = "data"
+	}
+	id, err := s.enqueue(pid, typ, body)
+	switch err {
+	case nil:
+		doJSONWrite(ctx, 200, struct {
+			ID MessageID `json:"id"`
+		}{id})
+	case errQueueUnknownPeer:
+		ctx.SetStatusCode(404)
+	case errQueueFull:
+		ctx.SetStatusCode(507)
+	default:
+		ctx.SetStatusCode(503)
+	}
+}
+
+// SendAck acknowledges the queued message of given ID to the server of given
+// address that sent it.
+func (overlay *OverlayConn) SendAck(id MessageID, addr *net.UDPAddr) error {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunAckIndication,
+		overlay.localIDAttr(),
+		id,
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, addr)
+	return err
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestEnqueueBounds(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	s := &Server{
+		peers: SessionTable{pid: Session{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}},
+		cfg:   &ServerConfig{Queue: QueueConfig{MaxMessages: 2, MaxBytes: 10, TTL: 60}},
+	}
+	if _, err := s.enqueue(PeerID{6, 5, 4, 3, 2, 1}, "data", []byte("a")); err != errQueueUnknownPeer {
+		t.Errorf("message to an unknown peer is queued: %v", err)
+	}
+	first, err := s.enqueue(pid, "data", []byte("abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.enqueue(pid, "data", []byte("abcdefg")); err != errQueueFull {
+		t.Errorf("queue exceeding the max bytes: %v", err)
+	}
+	second, err := s.enqueue(pid, "data", []byte("efg"))
+	if err != nil || second <= first {
+		t.Fatalf("unexpected second message %d: %v", second, err)
+	}
+	if _, err = s.enqueue(pid, "data", []byte("h")); err != errQueueFull {
+		t.Errorf("queue exceeding the max messages: %v", err)
+	}
+	if st := s.queueStatus(time.Now())[pid.String()]; st.Messages != 2 || st.Bytes != 7 || st.Online {
+		t.Errorf("unexpected queue status %+v", st)
+	}
+
+	s.acknowledge(pid, second)
+	if q := s.queues[pid]; len(q) != 1 || q[0].ID != first {
+		t.Errorf("acknowledged message is not removed: %v", q)
+	}
+
+	s.cfg.Queue.MaxMessages = 0
+	if _, err = s.enqueue(pid, "data", []byte("h")); err != errQueueDisabled {
+		t.Errorf("message is queued while the queues are disabled: %v", err)
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	pid := PeerID{1, 2, 3, 4, 5, 6}
+	s := &Server{
+		peers: SessionTable{pid: Session{&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}}},
+		cfg:   &ServerConfig{Queue: QueueConfig{MaxMessages: 4, TTL: 60}},
+	}
+	if _, err := s.enqueue(pid, "maintenance", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.enqueue(pid, "uninstall", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	s.queues[pid][0].Expires = time.Now().Add(-time.Second)
+	s.flushQueues()
+	if q := s.queues[pid]; len(q) != 1 || q[0].Type != "uninstall" {
+		t.Errorf("expired message is not dropped: %v", q)
+	}
+	s.queues[pid][0].Expires = time.Now().Add(-time.Second)
+	s.flushQueues()
+	if _, ok := s.queues[pid]; ok {
+		t.Error("empty queue is kept")
+	}
+}
+
+func TestQueueDelivery(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	serverConn, peerConn := listen(), listen()
+	defer serverConn.Close()
+	defer peerConn.Close()
+
+	pid := PeerID{0, 0x1c, 0x42, 1, 2, 3}
+	s := &Server{
+		ID:    PeerID{0, 0, 0, 0, 0, 2},
+		peers: SessionTable{pid: Session{peerConn.LocalAddr().(*net.UDPAddr)}},
+		cfg: &ServerConfig{
+			StunPassword: defaultStunPassword,
+			Queue: QueueConfig{
+				MaxMessages:   queueDefaultMaxMessages,
+				TTL:           queueDefaultTTL,
+				OfflineAfter:  queueDefaultOfflineAfter,
+				MaxAttempts:   2,
+				RetryInterval: queueDefaultRetryInterval,
+			},
+		},
+		udpConn: serverConn,
+	}
+	// the peer is offline, hence the messages are held
+	for _, data := range []string{"first", "second"} {
+		if _, err := s.enqueue(pid, "data", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if q := s.queues[pid]; q[0].Attempts != 0 {
+		t.Fatalf("message is sent to an offline peer")
+	}
+
+	overlay := &OverlayConn{
+		ID:           pid,
+		Config:       &OverlayConfig{StunPassword: defaultStunPassword},
+		peerDataChan: make(chan OverlayMessage, 1),
+	}
+	buf := make([]byte, 64*1024)
+	receive := func() (*OverlayMessage, MessageID) {
+		peerConn.SetReadDeadline(time.Now().Add(time.Second))
+		size, err := peerConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m stun.Message
+		m.Raw = append([]byte(nil), buf[:size]...)
+		var id MessageID
+		if err = m.Decode(); err != nil {
+			t.Fatal(err)
+		} else if err = id.GetFrom(&m); err != nil {
+			t.Fatal(err)
+		}
+		return overlay.receive(t, buf[:size]), id
+	}
+
+	// the peer comes back, and gets the messages in order, one at a time
+	s.peerSeen(pid, time.Now())
+	s.peerQueued(pid)
+	msg, id := receive()
+	if msg == nil || string(msg.Data) != "first" || msg.TTL != 1 || msg.Sender != s.ID {
+		t.Fatalf("unexpected first message %+v", msg)
+	}
+	ack, err := stun.Build(stun.TransactionID, stunAckIndication, &pid, id,
+		stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.ackMessage(ack); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ = receive(); msg == nil || string(msg.Data) != "second" {
+		t.Fatalf("unexpected second message %+v", msg)
+	}
+
+	// the unacknowledged message is dropped after the max attempts
+	s.queues[pid][0].Sent = time.Time{}
+	s.flushQueues()
+	receive()
+	s.queues[pid][0].Sent = time.Time{}
+	s.flushQueues()
+	if _, ok := s.queues[pid]; ok {
+		t.Error("unacknowledged message is kept after the max attempts")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/tracker"
+)
+
+// The defaults of the re-announces.
+const (
+	reannounceDefaultStallTime   = 120 // in seconds
+	reannounceDefaultMinInterval = 30  // in seconds
+
+	// reannounceTimeout is the deadline of the announce to a tracker and of
+	// the collection of the DHT peers.
+	reannounceTimeout = 15 * time.Second
+)
+
+// ReannounceConfig holds configurations of the re-announces of the updates,
+// which find the peers of a swarm without waiting for the next announce, e.g.
+// when a stalled swarm has got a new seed.
+type ReannounceConfig struct {
+	// StallTime is how long an update may be without progress before it is
+	// re-announced automatically, which is disabled if 0.
+	StallTime int `json:"stall-time"` // in seconds
+
+	// MinInterval is the minimum interval between two re-announces of an
+	// update, so that a script in a loop cannot hammer the trackers.
+	MinInterval int `json:"min-interval"` // in seconds
+}
+
+// ReannounceResult is the result of the re-announce of an update. Tracker,
+// DHT and Overlay are the numbers of the peers obtained from each source, and
+// New is the number of them that the torrent did not know.
+type ReannounceResult struct {
+	UUID    string   `json:"uuid"`
+	Tracker int      `json:"tracker"`
+	DHT     int      `json:"dht"`
+	Overlay int      `json:"overlay"`
+	New     int      `json:"new"`
+	Errors  []string `json:"errors,omitempty"`
+
+	// Limited is true if the update was re-announced less than the minimum
+	// interval ago, hence it is not re-announced before Retry.
+	Limited bool      `json:"limited,omitempty"`
+	Retry   time.Time `json:"retry,omitempty"`
+}
+
+// reannounceState is the state of the re-announces of an update.
+type reannounceState struct {
+	last      time.Time // of the latest re-announce
+	running   bool
+	progress  time.Time // when the completed bytes last changed
+	completed int64
+}
+
+// reannounce re-announces the updates of given UUID, or all of them if it is
+// empty. It returns false if there is no such update.
+func (a *Agent) reannounce(uuid string) ([]ReannounceResult, bool) {
+	a.RLock()
+	all := make([]*Update, 0, len(a.updates))
+	for _, u := range a.updates {
+		all = append(all, u)
+	}
+	a.RUnlock()
+	var updates []*Update
+	for _, u := range all {
+		u.RLock()
+		match := uuid == "" || u.Notification.UUID == uuid
+		u.RUnlock()
+		if match {
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) == 0 && uuid != "" {
+		return nil, false
+	}
+
+	results := make([]ReannounceResult, len(updates))
+	var wg sync.WaitGroup
+	for i, u := range updates {
+		wg.Add(1)
+		go func(i int, u *Update) {
+			defer wg.Done()
+			results[i] = u.reannounce(a)
+		}(i, u)
+	}
+	wg.Wait()
+	return results, true
+}
+
+// checkReannounce re-announces the update in the background if it has made
+// no progress for the stall time of the configurations, and it has not been
+// re-announced for that time. The caller must hold the lock.
+func (u *Update) checkReannounce(a *Agent) {
+	stall := time.Duration(a.Config.Reannounce.StallTime) * time.Second
+	now, completed := time.Now(), u.torrent.BytesCompleted()
+	r := &u.reannounced
+	if r.progress.IsZero() || completed != r.completed {
+		r.progress, r.completed = now, completed
+		return
+	}
+	if stall <= 0 || r.running || now.Sub(r.progress) < stall || now.Sub(r.last) < stall {
+		return
+	}
+	u.logf("no progress of update uuid:%s version:%d since %s, re-announcing it",
+		u.Notification.UUID, u.Notification.Version, r.progress.Format(time.RFC3339))
+	go u.reannounce(a)
+}
+
+// reannounce announces the update to its trackers and to the DHT if it is
+// enabled, and adds the peers they return and the overlay peers to its
+// torrent. It is not re-announced if it was less than the minimum interval
+// ago, or it is being re-announced.
+func (u *Update) reannounce(a *Agent) ReannounceResult {
+	minInterval := time.Duration(a.Config.Reannounce.MinInterval) * time.Second
+	u.Lock()
+	res := ReannounceResult{UUID: u.Notification.UUID}
+	r := &u.reannounced
+	if u.Stopped || u.torrent == nil {
+		u.Unlock()
+		res.Errors = append(res.Errors, "the update is stopped")
+		return res
+	}
+	if next := r.last.Add(minInterval); r.running || time.Now().Before(next) {
+		u.Unlock()
+		res.Limited, res.Retry = true, next
+		return res
+	}
+	r.running, r.last = true, time.Now()
+	t := u.torrent
+	trackers := append([]string{}, u.namespace().trackers...)
+	if len(u.Notification.Announce) > 0 {
+		trackers = append([]string{u.Notification.Announce}, trackers...)
+	}
+	u.Unlock()
+	defer func() {
+		u.Lock()
+		r.running = false
+		u.Unlock()
+	}()
+
+	known := make(map[string]bool)
+	for _, p := range t.KnownSwarm() {
+		known[net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))] = true
+	}
+	var peers []torrent.Peer
+	add := func(ip net.IP, port int) {
+		if ip == nil || port == 0 {
+			return
+		}
+		key := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		if !known[key] {
+			known[key] = true
+			res.New++
+		}
+		peers = append(peers, torrent.Peer{IP: ip, Port: port})
+	}
+
+	for _, tr := range trackers {
+		trPeers, err := a.announceTracker(tr, t)
+		if err != nil {
+			u.logf("WARNING: update uuid:%s %v", res.UUID, err)
+			res.Errors = append(res.Errors, err.Error())
+			continue
+		}
+		for _, p := range trPeers {
+			add(p.IP, p.Port)
+			res.Tracker++
+		}
+	}
+	for _, s := range a.torrentClient.DhtServers() {
+		ann, err := s.Announce(t.InfoHash(), a.Config.BitTorrent.Port, true)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("DHT announce failed: %v", err))
+			continue
+		}
+		timeout := time.After(reannounceTimeout)
+	collect:
+		for {
+			select {
+			case pv, ok := <-ann.Peers:
+				if !ok {
+					break collect
+				}
+				for _, p := range pv.Peers {
+					add(p.IP, p.Port)
+					res.DHT++
+				}
+			case <-timeout:
+				break collect
+			}
+		}
+		ann.Close()
+	}
+	for _, p := range a.overlayTorrentPeers() {
+		add(p.IP, p.Port)
+		res.Overlay++
+	}
+	t.AddPeers(peers)
+
+	metrics.Inc("torrent.reannounces", "uuid", res.UUID)
+	u.logf("re-announced update uuid:%s, peers tracker:%d dht:%d overlay:%d new:%d", res.UUID,
+		res.Tracker, res.DHT, res.Overlay, res.New)
+	return res
+}
+
+// announceTracker announces given torrent to given tracker, and returns the
+// peers it replied.
+func (a *Agent) announceTracker(tr string, t *torrent.Torrent) ([]tracker.Peer, error) {
+	if u, err := url.Parse(tr); err == nil && u.Scheme == "udp" && a.proxy != nil {
+		return nil, fmt.Errorf("UDP tracker %s cannot be reached through the proxy", tr)
+	}
+	announce := tracker.Announce{
+		TrackerUrl: a.Config.BitTorrent.trackerURL(tr),
+		UserAgent:  softwareName,
+		HttpClient: newTrackerHTTPClient(a.proxy),
+		Request: tracker.AnnounceRequest{
+			InfoHash: t.InfoHash(),
+			PeerId:   a.torrentClient.PeerID(),
+			Left:     uint64(t.BytesMissing()),
+			NumWant:  -1,
+			Port:     uint16(a.Config.BitTorrent.Port),
+		},
+	}
+	done := make(chan error, 1)
+	var resp tracker.AnnounceResponse
+	go func() {
+		var err error
+		resp, err = announce.Do()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, a.Config.BitTorrent.announceError(tr, err)
+		}
+		return resp.Peers, nil
+	case <-time.After(reannounceTimeout):
+		return nil, fmt.Errorf("announce to %s: no reply within %v", a.Config.BitTorrent.redactToken(tr), reannounceTimeout)
+	}
+}
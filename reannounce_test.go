@@ -0,0 +1,53 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+)
+
+func TestReannounceUnknownUpdate(t *testing.T) {
+	a := &Agent{Config: &Config{}, updates: make(map[string]*Update)}
+	if _, ok := a.reannounce("f5adf0cb-b0e1-5a22-97f1-09092f566438"); ok {
+		t.Error("unknown update is re-announced")
+	}
+	if results, ok := a.reannounce(""); !ok || len(results) != 0 {
+		t.Errorf("unexpected results without update: %v %v", results, ok)
+	}
+}
+
+func TestReannounceRateLimited(t *testing.T) {
+	cfg := DefaultConfig()
+	a := &Agent{Config: &cfg, updates: make(map[string]*Update)}
+	u := &Update{
+		Notification: Notification{UUID: "f5adf0cb-b0e1-5a22-97f1-09092f566438"},
+		torrent:      &torrent.Torrent{},
+		agent:        a,
+	}
+	a.updates[u.key()] = u
+
+	last := time.Now().Add(-time.Second)
+	u.reannounced.last = last
+	results, ok := a.reannounce(u.Notification.UUID)
+	if !ok || len(results) != 1 {
+		t.Fatalf("unexpected results: %v %v", results, ok)
+	}
+	retry := last.Add(reannounceDefaultMinInterval * time.Second)
+	if r := results[0]; !r.Limited || !r.Retry.Equal(retry) {
+		t.Errorf("re-announce within the minimum interval is not limited: %+v", r)
+	}
+	if u.reannounced.last != last {
+		t.Error("limited re-announce has reset the interval")
+	}
+
+	u.reannounced.last = time.Time{}
+	u.Stopped = true
+	if r := u.reannounce(a); r.Limited || len(r.Errors) == 0 {
+		t.Errorf("stopped update is re-announced: %+v", r)
+	}
+}
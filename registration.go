@@ -0,0 +1,170 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	registrationDefaultInterval   = 3600 // in seconds
+	registrationDefaultMaxBackoff = 3600 // in seconds
+	registrationTimeout           = 30 * time.Second
+	registrationMinBackoff        = time.Minute
+)
+
+// RegistrationConfig holds configurations of the registration to the
+// management API.
+type RegistrationConfig struct {
+	// URL of the endpoint, e.g. https://fruit-testbed.org/api/node. The
+	// registration is disabled when it is empty.
+	URL   string `json:"url"`
+	Token string `json:"token,omitempty"` // bearer token
+
+	Interval int `json:"interval"` // in seconds
+	// MaxBackoff caps the backoff of the failed registrations, including the
+	// one asked by the management API with Retry-After.
+	MaxBackoff int `json:"max-backoff"` // in seconds
+}
+
+// Registration is the JSON document sent to the management API.
+type Registration struct {
+	AgentStatus
+	UpdateStatuses []UpdateStatus `json:"update-statuses"`
+}
+
+// registrationError is returned when the management API rejects a
+// registration. retryAfter is non-zero if the API asked for a backoff.
+type registrationError struct {
+	code       int
+	retryAfter time.Duration
+}
+
+func (e *registrationError) Error() string {
+	return fmt.Sprintf("status code: %d", e.code)
+}
+
+func (a *Agent) registration() Registration {
+	r := Registration{AgentStatus: a.agentStatus("online")}
+	for _, uuid := range a.getUpdateUUIDs() {
+		if u := a.getUpdate(uuid); u != nil {
+			r.UpdateStatuses = append(r.UpdateStatuses, u.Status())
+		}
+	}
+	return r
+}
+
+// startRegistration registers the agent to the management API on startup and
+// then every interval. Failures are logged and retried with backoff, they
+// never affect the updates.
+func (a *Agent) startRegistration() {
+	var (
+		interval   = time.Duration(a.Config.Registration.Interval) * time.Second
+		maxBackoff = time.Duration(a.Config.Registration.MaxBackoff) * time.Second
+		backoff    = registrationMinBackoff
+		wait       time.Duration
+	)
+	if interval <= 0 {
+		interval = registrationDefaultInterval * time.Second
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = registrationDefaultMaxBackoff * time.Second
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	for {
+		err := a.register(maxBackoff)
+		switch e := err.(type) {
+		case nil:
+			backoff = registrationMinBackoff
+			wait = interval
+		case *registrationError:
+			if wait = e.retryAfter; wait == 0 {
+				wait = backoff
+			}
+		default:
+			wait = backoff
+		}
+		if err != nil {
+			log.Printf("registration - failed (retry in %v): %v", wait, err)
+			metrics.Inc("registration.attempts", "result", "error")
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		select {
+		case <-a.quit:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// register registers the agent to the management API. The backoff that the
+// API asks for on failure is capped by given maximum.
+func (a *Agent) register(maxBackoff time.Duration) error {
+	body, err := json.Marshal(a.registration())
+	if err != nil {
+		return err
+	}
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(a.Config.Registration.URL)
+	req.Header.SetMethod("PUT")
+	req.Header.SetContentType("application/json")
+	if len(a.Config.Registration.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+a.Config.Registration.Token)
+	}
+	req.SetBody(body)
+
+	if err = a.httpClient.DoTimeout(req, res, registrationTimeout); err != nil {
+		return err
+	}
+	if code := res.StatusCode(); code < 200 || code > 299 {
+		e := &registrationError{code: code}
+		if code == 429 || code >= 500 {
+			e.retryAfter = parseRetryAfter(string(res.Header.Peek("Retry-After")), time.Now(), maxBackoff)
+		}
+		return e
+	}
+	metrics.Inc("registration.attempts", "result", "success")
+	return nil
+}
+
+// parseRetryAfter returns the duration of HTTP header Retry-After, which is
+// either a number of seconds or an HTTP date, capped by given maximum, or 0
+// if it is invalid.
+func parseRetryAfter(v string, now time.Time, max time.Duration) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if s < 0 {
+			return 0
+		} else if s > int64(max/time.Second) {
+			return max
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		if d := t.Sub(now); d < max {
+			return d
+		}
+		return max
+	}
+	return 0
+}
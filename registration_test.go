@@ -0,0 +1,31 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Fri, 01 Jun 2018 12:05:00 GMT", 5 * time.Minute},
+		{"Fri, 01 Jun 2018 11:00:00 GMT", 0},
+		{"soon", 0},
+		{"999999999", time.Hour},
+		{"Sat, 01 Jun 2019 12:00:00 GMT", time.Hour},
+	} {
+		if d := parseRetryAfter(tc.value, now, time.Hour); d != tc.expected {
+			t.Errorf("Retry-After %q: expected %v, got %v", tc.value, tc.expected, d)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack"
+)
+
+// attrRejection is a comprehension-optional STUN attribute of the data error
+// response of an agent that refuses a notification.
+const attrRejection stun.AttrType = 0x8f18
+
+var (
+	stunDataRequest = stun.NewType(stun.MethodData, stun.ClassRequest)
+	stunDataSuccess = stun.NewType(stun.MethodData, stun.ClassSuccessResponse)
+	stunDataError   = stun.NewType(stun.MethodData, stun.ClassErrorResponse)
+)
+
+// rejectionMaxDetail is the maximum length of the detail of a rejection sent
+// to the server.
+const rejectionMaxDetail = 256
+
+// RejectReason is the reason why an agent refuses a notification, which is
+// the same in its logs, events, audit entries and responses.
+type RejectReason string
+
+// The reasons of the refusal of a notification.
+const (
+	RejectDuplicate          RejectReason = "duplicate" // the update is known, which is not reported
+	RejectVersionTooOld      RejectReason = "version-too-old"
+	RejectRejectedByOperator RejectReason = "rejected-by-operator"
+	RejectRolledBack         RejectReason = "rolled-back"
+	RejectPlatformMismatch   RejectReason = "platform-mismatch"
+	RejectVerificationFailed RejectReason = "verification-failed"
+	RejectUUIDNotAllowed     RejectReason = "uuid-not-allowed" // by the namespace whose key signed it
+	RejectUnsupportedSchema  RejectReason = "unsupported-schema"
+	RejectInvalid            RejectReason = "invalid"
+	RejectDiskFull           RejectReason = "disk-full"
+	RejectOther              RejectReason = "other"
+)
+
+// invalidNotification marks given error of the validation of a notification.
+type invalidNotification struct {
+	error
+}
+
+// Cause returns the validation error.
+func (e invalidNotification) Cause() error {
+	return e.error
+}
+
+// rejectReason returns the reason of the refusal of a notification that
+// failed starting with given error.
+func rejectReason(err error) RejectReason {
+	if _, ok := err.(invalidNotification); ok {
+		return RejectInvalid
+	}
+	switch cause := errors.Cause(err); cause {
+	case errUpdateIsAlreadyExist:
+		return RejectDuplicate
+	case errUpdateIsOlder:
+		return RejectVersionTooOld
+	case errUpdateIsRejected:
+		return RejectRejectedByOperator
+	case errUpdateIsRolledBack:
+		return RejectRolledBack
+	case errUpdatePlatformMismatch:
+		return RejectPlatformMismatch
+	case errUpdateVerificationFailed:
+		return RejectVerificationFailed
+	case errSchemaUnsupported:
+		return RejectUnsupportedSchema
+	case errInsufficientSpace:
+		return RejectDiskFull
+	default:
+		switch e := cause.(type) {
+		case *os.PathError:
+			cause = e.Err
+		case *os.LinkError:
+			cause = e.Err
+		case *os.SyscallError:
+			cause = e.Err
+		}
+		if cause == syscall.ENOSPC {
+			return RejectDiskFull
+		}
+	}
+	return RejectOther
+}
+
+// Rejection is the refusal of a notification by an agent, which it sends in
+// a data error response to the server that relayed the notification, or to
+// the peer that sent it in a data request.
+type Rejection struct {
+	UUID    string
+	Version uint64
+	Reason  RejectReason
+	Detail  string
+}
+
+// AddTo marshals Rejection as MessagePack data, then writes it on given STUN
+// message.
+func (r *Rejection) AddTo(m *stun.Message) error {
+	data, err := msgpack.Marshal(r)
+	if err == nil {
+		m.Add(attrRejection, data)
+	}
+	return err
+}
+
+// GetFrom gets Rejection from STUN message.
+func (r *Rejection) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrRejection)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(data, r)
+}
+
+// newRejection returns the rejection of given notification that failed
+// starting with given error. A notification whose signature does not verify
+// is not allowed if a namespace whose UUIDs exclude it has signed it.
+func (a *Agent) newRejection(n *Notification, err error) *Rejection {
+	r := &Rejection{UUID: n.UUID, Version: n.Version, Reason: rejectReason(err), Detail: err.Error()}
+	if r.Reason == RejectVerificationFailed {
+		for _, ns := range a.namespaces {
+			if ns.publicKey != nil && len(ns.uuids) > 0 && !containsString(ns.uuids, n.UUID) &&
+				n.Verify(ns.publicKey) == nil {
+				r.Reason = RejectUUIDNotAllowed
+				r.Detail = fmt.Sprintf("uuid is not allowed by namespace '%s'", ns.Name)
+				break
+			}
+		}
+	}
+	if len(r.Detail) > rejectionMaxDetail {
+		r.Detail = r.Detail[:rejectionMaxDetail]
+	}
+	return r
+}
+
+// audited returns true if the refusal is recorded in the audit log, i.e. the
+// notification is refused for a reason other than being outdated, and the
+// same refusal has not been recorded since the agent started, since the
+// notifications are gossiped and polled repeatedly.
+func (a *Agent) audited(r *Rejection) bool {
+	switch r.Reason {
+	case RejectDuplicate, RejectVersionTooOld, RejectRejectedByOperator, RejectRolledBack,
+		RejectPlatformMismatch:
+		return false
+	}
+	key := fmt.Sprintf("%s/%d/%s", r.UUID, r.Version, r.Reason)
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.rejections[key]; ok {
+		return false
+	}
+	if a.rejections == nil || len(a.rejections) >= rejectionMaxAudited {
+		a.rejections = make(map[string]struct{})
+	}
+	a.rejections[key] = struct{}{}
+	return true
+}
+
+// rejectionMaxAudited is the number of refusals remembered by the agent,
+// which are forgotten at once beyond.
+const rejectionMaxAudited = 1024
+
+// respondData answers given data message if it is a data request or a
+// message relayed by the server, with a data error response carrying given
+// rejection, or a data success response to a request if it is nil or a
+// duplicate. The messages relayed by the server are acknowledged on receipt,
+// hence they are answered only if they are refused.
+func (a *Agent) respondData(msg *OverlayMessage, r *Rejection) {
+	if r != nil && r.Reason == RejectDuplicate {
+		r = nil
+	}
+	if !msg.Request && (msg.ID == 0 || r == nil) {
+		return
+	}
+	if err := a.Overlay.SendDataResponse(msg, r); err != nil {
+		log.Printf("-> %s[%s] failed answering data message - %v", msg.Sender, msg.Addr, err)
+	}
+}
+
+// SendDataResponse answers given data message with a data error response
+// carrying given rejection, or a data success response if it is nil.
+func (overlay *OverlayConn) SendDataResponse(msg *OverlayMessage, r *Rejection) error {
+	typ := stunDataSuccess
+	if r != nil {
+		typ = stunDataError
+	}
+	setters := []stun.Setter{stun.NewTransactionIDSetter(msg.Transaction), typ, overlay.localIDAttr()}
+	if r != nil {
+		setters = append(setters, r)
+	}
+	if msg.ID != 0 {
+		setters = append(setters, msg.ID)
+	}
+	setters = append(setters,
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return err
+	}
+	overlay.RLock()
+	defer overlay.RUnlock()
+	if overlay.conn == nil {
+		return errConnNotOpened
+	}
+	_, err = overlay.conn.conn.WriteToUDP(res.Raw, msg.Addr)
+	return err
+}
+
+// peerDataResponse logs the response of a peer to a data request of this
+// agent.
+func (overlay *OverlayConn) peerDataResponse(pid *PeerID, addr *net.UDPAddr, res *stun.Message) error {
+	if overlay.reportResponse(res) || res.Type.Class == stun.ClassSuccessResponse {
+		return nil
+	}
+	var r Rejection
+	if err := r.GetFrom(res); err != nil {
+		return fmt.Errorf("%s[%s] sent an invalid rejection: %v", pid, addr, err)
+	}
+	log.Printf("<- %s[%s] rejected notification uuid:%s version:%d reason:%s - %s", pid, addr,
+		r.UUID, r.Version, r.Reason, r.Detail)
+	return nil
+}
+
+// rejectSuffix returns the suffix of a log message of a notification that is
+// refused for given reason.
+func rejectSuffix(reason RejectReason) string {
+	if reason == "" {
+		return ""
+	}
+	return "reject:" + string(reason) + " "
+}
+
+// recordRejection records the rejection of a notification that the server
+// relayed to a peer, which is aggregated with the deployment reports.
+func (s *Server) recordRejection(req *stun.Message) error {
+	var (
+		pid PeerID
+		r   Rejection
+	)
+	if err := pid.GetFrom(req); err != nil {
+		return err
+	}
+	if err := r.GetFrom(req); err != nil {
+		return fmt.Errorf("invalid rejection of %s: %v", pid, err)
+	}
+	if r.UUID == "" || r.Reason == "" {
+		return fmt.Errorf("incomplete rejection of %s", pid)
+	}
+	code := s.addReport(DeployReport{
+		PeerID:    pid.String(),
+		UUID:      r.UUID,
+		Version:   r.Version,
+		Error:     sanitizeText(r.Detail, false),
+		Reject:    RejectReason(sanitizeText(string(r.Reason), false)),
+		Timestamp: time.Now(),
+	})
+	log.Printf("<- peer %s rejected notification uuid:%s version:%d reason:%s - %s (%d)", pid, r.UUID,
+		r.Version, r.Reason, r.Detail, code)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+	pkgerrors "github.com/pkg/errors"
+)
+
+func TestRejectReason(t *testing.T) {
+	for err, reason := range map[error]RejectReason{
+		errUpdateIsAlreadyExist:     RejectDuplicate,
+		errUpdateIsOlder:            RejectVersionTooOld,
+		errUpdateIsRejected:         RejectRejectedByOperator,
+		errUpdateIsRolledBack:       RejectRolledBack,
+		errUpdatePlatformMismatch:   RejectPlatformMismatch,
+		errInsufficientSpace:        RejectDiskFull,
+		errUpdateVerificationFailed: RejectVerificationFailed,
+		pkgerrors.Wrapf(errSchemaUnsupported, "version %d", 9):         RejectUnsupportedSchema,
+		invalidNotification{errors.New("invalid trace ID")}:            RejectInvalid,
+		&os.PathError{Op: "write", Path: "/data", Err: syscall.ENOSPC}: RejectDiskFull,
+		errors.New("failed adding torrent"):                            RejectOther,
+	} {
+		if got := rejectReason(err); got != reason {
+			t.Errorf("reason of '%v' is %s, expected %s", err, got, reason)
+		}
+	}
+}
+
+func TestRejectionAttribute(t *testing.T) {
+	r := Rejection{UUID: "4d4e1a1c-7f3c-4d2a-9d3e-2b3c4d5e6f70", Version: 2,
+		Reason: RejectVersionTooOld, Detail: "update is older"}
+	m := stun.MustBuild(stun.TransactionID, stunDataError, &r, MessageID(7))
+	var got Rejection
+	if err := got.GetFrom(m); err != nil {
+		t.Fatal(err)
+	}
+	if got != r {
+		t.Errorf("rejection is %+v, expected %+v", got, r)
+	}
+	if err := got.GetFrom(stun.MustBuild(stun.TransactionID, stunDataSuccess)); err != stun.ErrAttributeNotFound {
+		t.Errorf("rejection of a success response: %v", err)
+	}
+}
+
+func TestFleetRejections(t *testing.T) {
+	fa := NewFleetAggregator(60)
+	now := time.Now()
+	uuid := "4d4e1a1c-7f3c-4d2a-9d3e-2b3c4d5e6f70"
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Success: true, Duration: 2}, now)
+	for i := 0; i < 3; i++ {
+		fa.Add(&DeployReport{UUID: uuid, Version: 1, Reject: RejectVerificationFailed}, now)
+	}
+	fa.Add(&DeployReport{UUID: uuid, Version: 1, Reject: RejectDiskFull, Error: "no space left"}, now)
+
+	s := fa.Summary(now)
+	fs := s.Current.Updates[0]
+	if fs.Successes != 1 || fs.Failures != 0 || fs.Rejections != 4 {
+		t.Fatalf("unexpected stats %+v", fs)
+	}
+	if len(fs.RejectReasons) != 2 || fs.RejectReasons[0] != (ReasonCount{RejectVerificationFailed, 3}) {
+		t.Errorf("unexpected reasons %v", fs.RejectReasons)
+	}
+	if n := fs.Durations[1]; n != 1 {
+		t.Errorf("rejections are counted in the durations: %v", fs.Durations)
+	}
+	var b bytes.Buffer
+	if err := s.WriteSummary(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "REJECTED") || !strings.Contains(b.String(), "verification-failed") {
+		t.Errorf("unexpected summary:\n%s", b.String())
+	}
+}
+
+func TestUpdateReportsRejection(t *testing.T) {
+	var ur UpdateReports
+	r := DeployReport{PeerID: "01", UUID: "a", Version: 1, Reject: RejectInvalid, Timestamp: time.Now()}
+	if !ur.add(r) {
+		t.Fatal("rejection is ignored")
+	}
+	// the copies of the notification relayed again are refused again
+	r.Timestamp = r.Timestamp.Add(time.Second)
+	if ur.add(r) {
+		t.Error("same rejection is added again")
+	}
+	r.Reject = RejectDiskFull
+	if !ur.add(r) {
+		t.Error("rejection of another reason is ignored")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// methodRelay is a private STUN method. An agent sends a relay indication to
+// its primary server to reach a peer that it cannot reach directly, e.g. a
+// peer behind a symmetric NAT, and the server forwards the relayed message
+// as is to the external address of the peer.
+const methodRelay stun.Method = 0x0f5
+
+var stunRelayIndication = stun.NewType(methodRelay, stun.ClassIndication)
+
+const (
+	// attrRelayTo carries the peer ID of the destination of a relayed
+	// message.
+	attrRelayTo stun.AttrType = 0x8f1a
+	// attrRelayMessage carries the relayed message.
+	attrRelayMessage stun.AttrType = 0x8f1b
+)
+
+var errRelayNotFound = errors.New("no server to relay the message")
+
+// relayDestination is the peer ID of the destination of a relayed message.
+type relayDestination PeerID
+
+// AddTo adds relayDestination into STUN message.
+func (dest relayDestination) AddTo(m *stun.Message) error {
+	m.Add(attrRelayTo, dest[:])
+	return nil
+}
+
+// GetFrom gets relayDestination from STUN message.
+func (dest *relayDestination) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrRelayTo)
+	if err != nil {
+		return err
+	} else if len(b) != len(dest) {
+		return fmt.Errorf("length of relay destination (%d bytes) is not %d bytes", len(b), len(dest))
+	}
+	copy(dest[:], b)
+	return nil
+}
+
+// relayedMessage is a message relayed by the server.
+type relayedMessage []byte
+
+// AddTo adds relayedMessage into STUN message.
+func (rm relayedMessage) AddTo(m *stun.Message) error {
+	m.Add(attrRelayMessage, rm)
+	return nil
+}
+
+// GetFrom gets relayedMessage from STUN message.
+func (rm *relayedMessage) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrRelayMessage)
+	if err != nil {
+		return err
+	}
+	*rm = append((*rm)[:0], b...)
+	return nil
+}
+
+// relayTo sends given message to given peer through the primary server. The
+// caller must hold the lock.
+func (overlay *OverlayConn) relayTo(pid PeerID, raw []byte) error {
+	if overlay.conn == nil {
+		return errConnNotOpened
+	} else if overlay.rendezvousAddr == nil {
+		return errRelayNotFound
+	}
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunRelayIndication,
+		overlay.localIDAttr(),
+		relayDestination(pid),
+		relayedMessage(raw),
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	return err
+}
+
+// relayedBy returns true if the message of given peer sent from given address
+// has been relayed by a server, i.e. the address is one of a server and the
+// sender is a peer of the session table rather than the server itself. The
+// caller must hold the lock.
+func (overlay *OverlayConn) relayedBy(addr *net.UDPAddr, pid PeerID) bool {
+	if _, ok := overlay.peers[pid]; !ok {
+		return false
+	}
+	return sameUDPAddr(addr, overlay.rendezvousAddr) || overlay.serverAt(addr) != nil
+}
+
+// relayMessage forwards the message of a relay indication sent by given peer
+// to the external address of its destination. Both peers must be in the
+// session table, and the relayed message must be one of the sender which
+// passes the validation of its own messages, lest the destination blames
+// the server for it.
+func (s *Server) relayMessage(conn net.PacketConn, pid PeerID, req *stun.Message) error {
+	var (
+		dest relayDestination
+		raw  relayedMessage
+	)
+	if err := dest.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting relay destination")
+	}
+	if err := raw.GetFrom(req); err != nil {
+		return errors.Wrap(err, "failed getting relayed message")
+	}
+	m := &stun.Message{Raw: raw}
+	if err := m.Decode(); err != nil {
+		return errors.Wrap(err, "failed decoding relayed message")
+	}
+	var sender PeerID
+	if err := sender.GetFrom(m); err != nil || sender != pid {
+		return fmt.Errorf("%s relayed a message of another peer", pid)
+	}
+	if err := validateMessage(m, nil, s.cfg.StunPassword); err != nil {
+		return errors.Wrap(err, "invalid relayed message")
+	}
+	if err := s.checkPeerMessage(m, pid); err != nil {
+		return errors.Wrap(err, "invalid relayed message")
+	}
+
+	s.RLock()
+	_, ok := s.peers[pid]
+	session, found := s.peers[PeerID(dest)]
+	s.RUnlock()
+	if !ok {
+		return fmt.Errorf("relay of %s which is not in the session table", pid)
+	} else if !found {
+		metrics.Inc("server.relay", "result", "unknown-peer")
+		log.Printf("dropped message relayed by %s to %s which is not in the session table", pid, PeerID(dest))
+		return nil
+	}
+	if _, err := conn.WriteTo(raw, session[0]); err != nil {
+		return errors.Wrapf(err, "failed relaying message of %s to %s[%s]", pid, PeerID(dest), session[0])
+	}
+	metrics.Inc("server.relay", "result", "forwarded")
+	return nil
+}
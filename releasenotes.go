@@ -0,0 +1,71 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The maximum sizes in bytes of the title and the notes of a notification,
+// which keep it within the datagrams of the overlay.
+const (
+	notificationMaxTitle = 128
+	notificationMaxNotes = 2048
+)
+
+// validateReleaseNotes returns an error if given title or notes of a
+// notification are too large or not UTF-8.
+func validateReleaseNotes(title, notes string) error {
+	switch {
+	case len(title) > notificationMaxTitle:
+		return fmt.Errorf("title of %d bytes exceeds %d bytes", len(title), notificationMaxTitle)
+	case len(notes) > notificationMaxNotes:
+		return fmt.Errorf("notes of %d bytes exceed %d bytes", len(notes), notificationMaxNotes)
+	case !utf8.ValidString(title) || !utf8.ValidString(notes):
+		return fmt.Errorf("title and notes must be UTF-8")
+	}
+	return nil
+}
+
+// sanitizeText returns given text without its control characters, including
+// the bidirectional overrides, so that it cannot forge log lines or terminal
+// output. The newlines and tabs are kept if multiline is true, and the
+// invalid UTF-8 sequences are replaced.
+func sanitizeText(s string, multiline bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case multiline && (r == '\n' || r == '\t'):
+			return r
+		case r == utf8.RuneError:
+			return '?'
+		case unicode.IsControl(r), r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// title returns the sanitized title of the update, which is written on a
+// single line.
+func (mi *Notification) title() string {
+	return sanitizeText(mi.Title, false)
+}
+
+// notes returns the sanitized release notes of the update.
+func (mi *Notification) notes() string {
+	return sanitizeText(mi.Notes, true)
+}
+
+// titleSuffix returns the suffix of the log lines of an update of given
+// sanitized title, which is empty without title.
+func titleSuffix(title string) string {
+	if len(title) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" title:%q", title)
+}
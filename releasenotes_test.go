@@ -0,0 +1,50 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReleaseNotes(t *testing.T) {
+	if err := validateReleaseNotes("", ""); err != nil {
+		t.Errorf("notification without title is invalid: %v", err)
+	}
+	if err := validateReleaseNotes("Fix the heater controller", "- fix\n- feature"); err != nil {
+		t.Error(err)
+	}
+	for _, c := range [][2]string{
+		{strings.Repeat("x", notificationMaxTitle+1), ""},
+		{"", strings.Repeat("x", notificationMaxNotes+1)},
+		{"\xff", ""},
+	} {
+		if err := validateReleaseNotes(c[0], c[1]); err == nil {
+			t.Errorf("title of %d bytes and notes of %d bytes are valid", len(c[0]), len(c[1]))
+		}
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	n := Notification{
+		Title: "v2\n2018/01/01 00:00:00 forged line\x1b[31m\u202eevil",
+		Notes: "- fix\r\n\t- feature\x00",
+	}
+	if title := n.title(); title != "v22018/01/01 00:00:00 forged line[31mevil" {
+		t.Errorf("unexpected title %q", title)
+	}
+	if notes := n.notes(); notes != "- fix\n\t- feature" {
+		t.Errorf("unexpected notes %q", notes)
+	}
+	if s := sanitizeText("caf\xe9", false); s != "caf?" {
+		t.Errorf("invalid UTF-8 is sanitized as %q", s)
+	}
+	if s := titleSuffix((&Notification{}).title()); s != "" {
+		t.Errorf("suffix without title is %q", s)
+	}
+	if s := titleSuffix("heater fix"); s != ` title:"heater fix"` {
+		t.Errorf("unexpected suffix %q", s)
+	}
+}
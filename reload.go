@@ -0,0 +1,202 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reloadCheckPoll is the interval of polling the piece check of a reloaded
+// update.
+const reloadCheckPoll = 200 * time.Millisecond
+
+// corruptDir is the directory, in the data directory, of the update metadata
+// that cannot be decoded, which are set aside when they are reloaded.
+const corruptDir = "corrupt"
+
+// reloadWorkers returns the number of updates reloaded at the same time,
+// which is 2 by default on ARM since hashing the pieces is expensive.
+func (cfg *Config) reloadWorkers() int {
+	if cfg.ReloadWorkers > 0 {
+		return cfg.ReloadWorkers
+	}
+	if strings.HasPrefix(runtime.GOARCH, "arm") {
+		return 2
+	}
+	if n := runtime.NumCPU(); n < 4 {
+		return n
+	}
+	return 4
+}
+
+// reloadJob is the key of the metadata of an update to reload.
+type reloadJob struct {
+	bucket, key string
+}
+
+// loadUpdates loads existing updates of all namespaces from the metadata
+// store. They are reloaded by a bounded pool of workers, each of them
+// loading the metadata, starting the update and waiting until its pieces are
+// checked before reloading the next one. A failed update is skipped.
+func (a *Agent) loadUpdates() {
+	log.Println("Loading updates from local database")
+	start := time.Now()
+
+	var jobs []reloadJob
+	for _, ns := range a.namespaces {
+		bucket := updatesBucket(ns.Name)
+		keys, err := a.metadata().List(bucket)
+		if err != nil {
+			log.Fatalf("cannot list update metadata of bucket %s: %v", bucket, err)
+		}
+		for _, key := range keys {
+			jobs = append(jobs, reloadJob{bucket, key})
+		}
+	}
+	a.Lock()
+	a.startup.Total = len(jobs)
+	a.Unlock()
+
+	queue := make(chan reloadJob)
+	var wg sync.WaitGroup
+	for i := a.Config.reloadWorkers(); i > 0; i-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				a.reloadProgress(j.key, a.reloadUpdate(j.bucket, j.key))
+			}
+		}()
+	}
+	for _, j := range jobs {
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+
+	a.Lock()
+	a.startup.Reloaded = true
+	n := len(a.updates)
+	a.Unlock()
+	log.Printf("Loaded %d updates in %s", n, time.Since(start))
+	go a.watchStartup(start)
+}
+
+// reloadUpdate loads the update of given key of the metadata store and
+// starts it, then waits until its pieces are checked. The metadata that
+// cannot be decoded are set aside.
+func (a *Agent) reloadUpdate(bucket, key string) error {
+	u, err := a.loadUpdate(bucket, key)
+	if isCorruptMetadata(err) {
+		if serr := a.setAside(bucket, key); serr != nil {
+			log.Printf("WARNING: failed setting aside corrupt update metadata %s/%s - %v", bucket, key, serr)
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+	if u.RolledBack != nil {
+		// the record of a failed version, which is replaced by the
+		// previous one
+		return nil
+	}
+	if err = u.Verify(a); err != nil {
+		return err
+	}
+	if err = u.Start(a); err != nil {
+		return err
+	}
+	u.RLock()
+	lazy, size := u.lazy, u.Notification.Info.TotalLength()
+	u.RUnlock()
+	a.Lock()
+	if lazy {
+		a.startup.Lazy++
+		a.startup.SkippedBytes += size
+	} else {
+		a.startup.Full++
+	}
+	a.Unlock()
+	for !a.stopped() && !u.piecesChecked() {
+		time.Sleep(reloadCheckPoll)
+	}
+	return nil
+}
+
+// isCorruptMetadata returns true if given error of loadUpdate means that the
+// metadata are not valid JSON, unlike e.g. an unsupported schema, which a
+// newer agent can load.
+func isCorruptMetadata(err error) bool {
+	switch err.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return true
+	}
+	return false
+}
+
+// setAside moves the metadata of given key into the corrupt directory of the
+// data directory, where they are kept for inspection rather than reloaded.
+func (a *Agent) setAside(bucket, key string) error {
+	b, err := a.metadata().Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(a.Config.DataDir, corruptDir, filepath.FromSlash(bucket),
+		key+"."+time.Now().UTC().Format("20060102T150405Z"))
+	if err = os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+	if err = writeFileSync(filename, b); err != nil {
+		return err
+	}
+	log.Printf("WARNING: set aside corrupt update metadata %s/%s as %s", bucket, key, filename)
+	return a.metadata().Delete(bucket, key)
+}
+
+// piecesChecked returns true if none of the pieces of the update is being
+// checked, or if the update is not running.
+func (u *Update) piecesChecked() bool {
+	u.RLock()
+	defer u.RUnlock()
+	if u.torrent == nil {
+		return true
+	}
+	select {
+	case <-u.torrent.GotInfo():
+	default:
+		return false
+	}
+	for _, r := range u.torrent.PieceStateRuns() {
+		if r.Checking {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadProgress records that given metadata file is reloaded, or failed
+// with given error, and reports the progress.
+func (a *Agent) reloadProgress(name string, err error) {
+	a.Lock()
+	a.startup.Loaded++
+	if err != nil {
+		a.startup.Failed++
+	}
+	loaded, total := a.startup.Loaded, a.startup.Total
+	a.Unlock()
+	if err != nil {
+		log.Printf("failed reloading update metadata %s: %v", name, err)
+	}
+	log.Printf("reloaded %d of %d updates", loaded, total)
+	sdNotify(fmt.Sprintf("STATUS=reloaded %d of %d updates", loaded, total))
+}
@@ -0,0 +1,203 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadSetsAsideCorruptMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newMemMetadataStore()
+	a := &Agent{Config: &Config{DataDir: dir}, updates: make(map[string]*Update), store: store}
+
+	corrupt := []byte(`{"notification":{"uuid":`)
+	store.Put(MetadataUpdates, "corrupt-v1", corrupt)
+	store.Put(MetadataUpdates, "newer-v1", []byte(fmt.Sprintf(`{"schema-version":%d}`, SchemaVersion+1)))
+
+	if err = a.reloadUpdate(MetadataUpdates, "corrupt-v1"); err == nil {
+		t.Fatal("corrupt metadata are reloaded")
+	}
+	if _, err = store.Get(MetadataUpdates, "corrupt-v1"); err != errMetadataNotFound {
+		t.Errorf("corrupt metadata are kept in the store: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, corruptDir, MetadataUpdates, "corrupt-v1.*"))
+	if len(files) != 1 {
+		t.Fatalf("expected the corrupt metadata set aside, got %v", files)
+	}
+	if b, _ := ioutil.ReadFile(files[0]); string(b) != string(corrupt) {
+		t.Errorf("unexpected corrupt metadata set aside %q", b)
+	}
+
+	// the metadata of a newer agent are kept for a later upgrade
+	if err = a.reloadUpdate(MetadataUpdates, "newer-v1"); err == nil {
+		t.Fatal("metadata of an unsupported schema are reloaded")
+	}
+	if _, err = store.Get(MetadataUpdates, "newer-v1"); err != nil {
+		t.Errorf("metadata of an unsupported schema are set aside: %v", err)
+	}
+}
+
+func TestReloadResumesUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privFile, pub := writeKeys(t, dir, "key")
+	key, err := LoadPrivateKey(privFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.LogFile = ""
+	cfg.NoUDP = true
+	cfg.Address = "127.0.0.1:"
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.API.Address = filepath.Join(dir, "agent.sock")
+	cfg.PublicKey.Filename = pub
+	cfg.BitTorrent.Port = 0
+
+	// notification returns the signed notification of a payload of 4 pieces
+	// starting with given script
+	src := filepath.Join(dir, "src")
+	if err = os.MkdirAll(src, 0750); err != nil {
+		t.Fatal(err)
+	}
+	notification := func(uuid, name, script string) (*Notification, []byte) {
+		payload := []byte(script + "#" + strings.Repeat("x", 4*MinPieceLength-len(script)-2) + "\n")
+		filename := filepath.Join(src, name)
+		if err := ioutil.WriteFile(filename, payload, 0640); err != nil {
+			t.Fatal(err)
+		}
+		n, err := NewNotification(filename, uuid, 1, "", MinPieceLength, DefaultExcludes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return n, payload
+	}
+	// prepare returns the update of given notification, routed to its
+	// namespace, with given part of the payload in the data directory
+	prepare := func(a *Agent, n *Notification, payload []byte, complete int) *Update {
+		u := NewUpdate(*n, a)
+		if err := u.Verify(a); err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, len(payload))
+		copy(part, payload[:complete])
+		if err := ioutil.WriteFile(u.payloadPath(), part, 0640); err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// waitFor polls given condition until it holds, and fails the test if
+	// it does not within given timeout
+	waitFor := func(what string, timeout time.Duration, cond func() bool) {
+		for deadline := time.Now().Add(timeout); !cond(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s within %v", what, timeout)
+			}
+			time.Sleep(reloadCheckPoll)
+		}
+	}
+
+	a, err := NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an update is stopped in the middle of its download, with 2 of its
+	// pieces
+	np, payload := notification("reload-partial", "partial.bin", "")
+	partial := prepare(a, np, payload, 2*MinPieceLength)
+	if err = partial.Start(a); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("pieces of the partial update are not checked", 10*time.Second, partial.piecesChecked)
+	partial.RLock()
+	missing := partial.torrent.BytesMissing()
+	partial.RUnlock()
+	if missing != 2*MinPieceLength {
+		t.Fatalf("expected %d bytes missing, got %d", 2*MinPieceLength, missing)
+	}
+	// an update has been deployed by its script
+	marker := filepath.Join(dir, "deployed")
+	nd, payload := notification(UUIDShell, "deploy.sh", "#!/bin/sh\ntouch "+marker+"\n")
+	deployed := prepare(a, nd, payload, len(payload))
+	deployed.State, deployed.Deployed = UpdateDeployed, time.Now()
+	if err = deployed.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the agent is stopped once the monitor of the update has exited
+	partial.Stop()
+	waitFor("monitor of the partial update has not exited", 10*time.Second, func() bool {
+		return atomic.LoadInt64(&partial.lastTick) == 0
+	})
+	a.Stop()
+	a.torrentClient.Close()
+
+	a, err = NewAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		a.Stop()
+		a.torrentClient.Close()
+	}()
+	// the completed pieces of the partial payload are kept
+	u := a.getUpdate(partial.key())
+	if u == nil {
+		t.Fatal("partial update is not reloaded")
+	}
+	u.RLock()
+	running, state := u.torrent != nil, u.State
+	if running {
+		missing = u.torrent.BytesMissing()
+	}
+	u.RUnlock()
+	if !running || missing != 2*MinPieceLength || state == UpdateDeployed {
+		t.Errorf("partial update is reloaded running:%v state:%s with %d bytes missing", running, state, missing)
+	}
+	// the deployed update seeds without running its script again
+	if u = a.getUpdate(deployed.key()); u == nil {
+		t.Fatal("deployed update is not reloaded")
+	}
+	// a tick of the monitor, i.e. an iteration which starts after the
+	// current one
+	var tick int64
+	waitFor("monitor of the deployed update has not started", 10*time.Second, func() bool {
+		tick = atomic.LoadInt64(&u.lastTick)
+		return tick != 0
+	})
+	waitFor("monitor of the deployed update has not ticked", 10*time.Second, func() bool {
+		return atomic.LoadInt64(&u.lastTick) > tick
+	})
+	u.RLock()
+	running, state = u.torrent != nil, u.State
+	if running {
+		missing = u.torrent.BytesMissing()
+	}
+	u.RUnlock()
+	if !running || missing != 0 || state != UpdateDeployed {
+		t.Errorf("deployed update is reloaded running:%v state:%s with %d bytes missing", running, state, missing)
+	}
+	if _, err = os.Stat(marker); !os.IsNotExist(err) {
+		t.Errorf("script of the deployed update is run again: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// attrReplay is a comprehension-optional STUN attribute of the data
+// indications sent by the server, which marks a notification replayed to a
+// peer that has registered or come back after an absence.
+const attrReplay stun.AttrType = 0x8f13
+
+// The defaults of the replay of the notifications.
+const (
+	replayDefaultMaxUpdates = 32
+	replayDefaultMaxAge     = 7 * 24 * 3600 // in seconds
+	replayDefaultAbsentTime = 600           // in seconds
+)
+
+// ReplayConfig holds configurations of the replay of the recent notifications
+// to the peers that register for the first time, or after having been absent
+// for AbsentTime, e.g. a node that was powered off while an update was
+// announced. The replayed notifications are the MaxUpdates latest ones that
+// were created within MaxAge. The replay is disabled if MaxUpdates is 0.
+type ReplayConfig struct {
+	MaxUpdates int `json:"max-updates"`
+	MaxAge     int `json:"max-age"`     // in seconds
+	AbsentTime int `json:"absent-time"` // in seconds
+}
+
+// ReplayFlag marks a replayed notification.
+type ReplayFlag bool
+
+// AddTo adds ReplayFlag into STUN message if it is set.
+func (r ReplayFlag) AddTo(m *stun.Message) error {
+	if r {
+		m.Add(attrReplay, []byte{1})
+	}
+	return nil
+}
+
+// GetFrom gets ReplayFlag from STUN message, which is false if the attribute
+// is not found.
+func (r *ReplayFlag) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrReplay)
+	if err == stun.ErrAttributeNotFound {
+		*r = false
+		return nil
+	} else if err != nil {
+		return err
+	}
+	*r = len(b) == 1 && b[0] == 1
+	return nil
+}
+
+// replaySet returns the notifications to replay at given time among given
+// ones, the latest first.
+func replaySet(updates map[string]*Notification, cfg ReplayConfig, now time.Time) []*Notification {
+	if cfg.MaxUpdates <= 0 {
+		return nil
+	}
+	set := make([]*Notification, 0, len(updates))
+	for _, n := range updates {
+		if cfg.MaxAge > 0 && n.CreationDate > 0 &&
+			now.Sub(time.Unix(n.CreationDate, 0)) > time.Duration(cfg.MaxAge)*time.Second {
+			continue
+		}
+		set = append(set, n)
+	}
+	sort.Slice(set, func(i, j int) bool {
+		if set[i].CreationDate != set[j].CreationDate {
+			return set[i].CreationDate > set[j].CreationDate
+		}
+		return set[i].UUID < set[j].UUID
+	})
+	if len(set) > cfg.MaxUpdates {
+		set = set[:cfg.MaxUpdates]
+	}
+	return set
+}
+
+// peerSeen records a binding of given peer at given time, and returns true if
+// the recent notifications must be replayed to it, i.e. it has never been
+// seen or it has been absent for the absent time of the configurations.
+func (s *Server) peerSeen(pid PeerID, now time.Time) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.seen == nil {
+		s.seen = make(map[PeerID]time.Time)
+	}
+	last, ok := s.seen[pid]
+	s.seen[pid] = now
+	return !ok || now.Sub(last) > time.Duration(s.cfg.Replay.AbsentTime)*time.Second
+}
+
+// replayNotifications sends the recent notifications to given peer. They are
+// sent with TTL 1, hence the peer does not forward them, and the notifications
+// that the peer already has are ignored by it.
+func (s *Server) replayNotifications(pid PeerID) {
+	s.RLock()
+	set := replaySet(s.updates, s.cfg.Replay, time.Now())
+	var addr *net.UDPAddr
+	if session, ok := s.peers[pid]; ok {
+		addr = session[0]
+	}
+	s.RUnlock()
+	if len(set) == 0 || addr == nil {
+		return
+	}
+
+	msg := stunMessagePool.Get().(*stun.Message)
+	defer stunMessagePool.Put(msg)
+	sent := 0
+	for _, n := range set {
+		err := s.buildNotificationMessage(msg, n, 1, true)
+		if err == nil {
+			_, err = s.udpConn.WriteToUDP(msg.Raw, addr)
+		}
+		if err != nil {
+			metrics.Inc("server.replays", "result", "failed")
+			log.Printf("WARNING: failed replaying notification uuid:%s version:%d to %s[%s] - %v",
+				n.UUID, n.Version, pid, addr, err)
+			continue
+		}
+		metrics.Inc("server.replays", "result", "sent")
+		sent++
+	}
+	log.Printf("-> replayed %d of %d notifications to %s[%s]", sent, len(set), pid, addr)
+}
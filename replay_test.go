@@ -0,0 +1,125 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/gortc/stun"
+	"github.com/zeebo/bencode"
+)
+
+func TestReplaySet(t *testing.T) {
+	now := time.Now()
+	updates := map[string]*Notification{
+		"a": {UUID: "a", CreationDate: now.Add(-time.Hour).Unix()},
+		"b": {UUID: "b", CreationDate: now.Add(-2 * time.Hour).Unix()},
+		"c": {UUID: "c", CreationDate: now.Add(-10 * 24 * time.Hour).Unix()},
+		"d": {UUID: "d", CreationDate: now.Add(-time.Minute).Unix()},
+		"e": {UUID: "e"}, // without creation date
+	}
+	cfg := ReplayConfig{MaxUpdates: 3, MaxAge: replayDefaultMaxAge}
+	set := replaySet(updates, cfg, now)
+	if len(set) != 3 || set[0].UUID != "d" || set[1].UUID != "a" || set[2].UUID != "b" {
+		t.Errorf("unexpected replay set %v", set)
+	}
+	cfg.MaxUpdates = 10
+	if set = replaySet(updates, cfg, now); len(set) != 4 || set[3].UUID != "e" {
+		t.Errorf("notifications older than the max age must not be replayed: %v", set)
+	}
+	cfg.MaxAge = 0
+	if set = replaySet(updates, cfg, now); len(set) != 5 {
+		t.Errorf("all notifications must be replayed without max age: %v", set)
+	}
+	if set = replaySet(updates, ReplayConfig{}, now); len(set) != 0 {
+		t.Errorf("replay is not disabled: %v", set)
+	}
+}
+
+func TestPeerSeen(t *testing.T) {
+	s := &Server{cfg: &ServerConfig{Replay: ReplayConfig{AbsentTime: 60}}}
+	pid, now := PeerID{1, 2, 3, 4, 5, 6}, time.Now()
+	for _, tc := range []struct {
+		t      time.Time
+		replay bool
+	}{
+		{now, true}, // first registration
+		{now.Add(10 * time.Second), false},
+		{now.Add(69 * time.Second), false},
+		{now.Add(130 * time.Second), true}, // back after an absence
+		{now.Add(140 * time.Second), false},
+	} {
+		if replay := s.peerSeen(pid, tc.t); replay != tc.replay {
+			t.Errorf("binding at %s: replay=%v, expected %v", tc.t.Sub(now), replay, tc.replay)
+		}
+	}
+}
+
+func TestReplayNotifications(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	serverConn, peerConn := listen(), listen()
+	defer serverConn.Close()
+	defer peerConn.Close()
+
+	pid := PeerID{0, 0x1c, 0x42, 1, 2, 3}
+	n := &Notification{
+		UUID:         "f5adf0cb-b0e1-5a22-97f1-09092f566438",
+		Version:      2,
+		Info:         metainfo.Info{Name: "update", PieceLength: 1024, Length: 1},
+		CreationDate: time.Now().Unix(),
+	}
+	s := &Server{
+		ID:      PeerID{0, 0, 0, 0, 0, 2},
+		peers:   SessionTable{pid: Session{peerConn.LocalAddr().(*net.UDPAddr)}},
+		updates: map[string]*Notification{n.UUID: n},
+		cfg: &ServerConfig{
+			StunPassword: defaultStunPassword,
+			TTL:          defaultTTL,
+			Replay:       ReplayConfig{MaxUpdates: replayDefaultMaxUpdates},
+		},
+		udpConn: serverConn,
+	}
+	s.replayNotifications(pid)
+
+	buf := make([]byte, 64*1024)
+	peerConn.SetReadDeadline(time.Now().Add(time.Second))
+	size, err := peerConn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay := &OverlayConn{
+		ID:           pid,
+		Config:       &OverlayConfig{StunPassword: defaultStunPassword},
+		peerDataChan: make(chan OverlayMessage, 1),
+	}
+	msg := overlay.receive(t, buf[:size])
+	if msg == nil || !bool(msg.Replay) || msg.TTL != 1 || msg.Sender != s.ID {
+		t.Fatalf("unexpected replayed message %+v", msg)
+	}
+	var received Notification
+	if err = bencode.DecodeBytes(msg.Data, &received); err != nil || received.UUID != n.UUID ||
+		received.Version != n.Version {
+		t.Errorf("unexpected replayed notification %+v: %v", received, err)
+	}
+
+	// the notifications sent on submission are not replays
+	var m stun.Message
+	if err = s.buildNotificationMessage(&m, n, defaultTTL, false); err != nil {
+		t.Fatal(err)
+	}
+	var flag ReplayFlag
+	if err = flag.GetFrom(&m); err != nil || flag {
+		t.Errorf("notification is marked as a replay: %v", err)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	reportTimeout       = 10 * time.Second
+	reportRetryInterval = time.Minute
+
+	// reportPeerSignatureHeader carries the signature of a report posted
+	// over HTTP by the key of the peer identity of the sender.
+	reportPeerSignatureHeader = "X-P2PUpdate-Peer-Signature"
+
+	// reportSignatureDomain separates the signatures of the reports from
+	// the ones of the overlay messages made by the same key.
+	reportSignatureDomain = "p2pupdate deploy report\x00"
+)
+
+var errReportSignature = errors.New("invalid peer signature of the report")
+
+// signReport returns the hex signature of given report body by the key of the
+// identity, or an empty string if the identity is nil.
+func (id *PeerIdentity) signReport(body []byte) string {
+	if id == nil {
+		return ""
+	}
+	return hex.EncodeToString(ed25519.Sign(id.key, append([]byte(reportSignatureDomain), body...)))
+}
+
+// verifyReportSignature returns an error if given hex signature of given
+// report body is not made by given key.
+func verifyReportSignature(body []byte, signature string, key ed25519.PublicKey) error {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize || len(key) != ed25519.PublicKeySize ||
+		!ed25519.Verify(key, append([]byte(reportSignatureDomain), body...), sig) {
+		return errReportSignature
+	}
+	return nil
+}
+
+// DeployReport is the result of a deployment attempt, which is sent by every
+// agent to the server.
+type DeployReport struct {
+	PeerID    string    `json:"peer-id"`
+	UUID      string    `json:"uuid"`
+	Version   uint64    `json:"version"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	ExitCode  int       `json:"exit-code,omitempty"` // of the last script, -1 if it was killed
+	Duration  float64   `json:"duration"`            // in seconds
+	SHA256    string    `json:"sha256,omitempty"`    // verified payload digest
+	TraceID   string    `json:"trace-id,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// RestartRequired are the config fields changed by a config update that
+	// require restarting the agent.
+	RestartRequired []string `json:"restart-required,omitempty"`
+
+	// Reject is the reason why the agent refused the notification, if it
+	// did not start the update.
+	Reject RejectReason `json:"reject,omitempty"`
+}
+
+// UpdateReports holds the latest deployment report of each peer for the
+// latest version of an update.
+type UpdateReports struct {
+	Version uint64                  `json:"version"`
+	Peers   map[string]DeployReport `json:"peers"`
+}
+
+// add adds given report. Reports of older versions and reports that have been
+// added are ignored, and a report of a newer version discards the reports of
+// the current version. It returns false if the report is ignored.
+func (ur *UpdateReports) add(r DeployReport) bool {
+	if r.Version < ur.Version {
+		return false
+	}
+	if old, ok := ur.Peers[r.PeerID]; ok && r.Version == ur.Version && old.Timestamp.Equal(r.Timestamp) {
+		// the agent has re-sent the report since it missed the response
+		return false
+	} else if ok && r.Version == ur.Version && r.Reject != "" && old.Reject == r.Reject {
+		// the agent has refused a copy of the notification again
+		return false
+	}
+	if r.Version > ur.Version || ur.Peers == nil {
+		ur.Version = r.Version
+		ur.Peers = make(map[string]DeployReport)
+	}
+	ur.Peers[r.PeerID] = r
+	return true
+}
+
+// sendDeployReport sends given report to the server over the overlay, or
+// posts it if the overlay is not ready or the server has not answered.
+func (a *Agent) sendDeployReport(r *DeployReport) error {
+	if a.Overlay != nil && a.Overlay.Ready() {
+		err := a.Overlay.SendReport(r, reportStunTimeout)
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed sending deploy report uuid:%s version:%d over the overlay - %v%s",
+			r.UUID, r.Version, err, traceSuffix(r.TraceID))
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(fmt.Sprintf("http://%s/report", a.server()))
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	req.Header.Set(webhookSignatureHeader, hmacSignature(body, a.Config.Overlay.StunPassword))
+	if sig := a.Identity.signReport(body); sig != "" {
+		req.Header.Set(reportPeerSignatureHeader, sig)
+	}
+	req.SetBody(body)
+	if err = a.httpClient.DoTimeout(req, res, reportTimeout); err != nil {
+		return err
+	}
+	if code := res.StatusCode(); code != 200 {
+		return fmt.Errorf("status code: %d", code)
+	}
+	return nil
+}
+
+// deliverReport sends the pending deployment report of given update, if any,
+// and clears it once the server has received it. It must be called without
+// holding the lock of the update.
+func (a *Agent) deliverReport(u *Update) {
+	u.RLock()
+	r, due := u.PendingReport, time.Now().After(u.reportRetry)
+	u.RUnlock()
+	if r == nil || !due {
+		return
+	}
+	err := a.sendDeployReport(r)
+
+	u.Lock()
+	defer u.Unlock()
+	if err != nil {
+		log.Printf("failed sending deploy report uuid:%s version:%d - %v%s", r.UUID, r.Version, err,
+			traceSuffix(r.TraceID))
+		u.reportRetry = time.Now().Add(reportRetryInterval)
+		return
+	}
+	log.Printf("sent deploy report uuid:%s version:%d success:%v%s", r.UUID, r.Version, r.Success,
+		traceSuffix(r.TraceID))
+	if u.PendingReport == r {
+		u.PendingReport = nil
+		u.save()
+	}
+}
+
+// serveReport stores a deployment report posted by an agent, which must be
+// signed with the STUN password shared by the agents and the server, and by
+// the key pinned for the peer ID of the report (see checkPeerCert), since the
+// password does not tell the agents apart, e.g. to forge the successes of the
+// canaries. The peers whose key is not pinned report over the overlay only
+// (see receiveReport). It returns the HTTP status code of the response.
+func (s *Server) serveReport(body []byte, signature, peerSignature string) int {
+	if !hmac.Equal([]byte(signature), []byte(hmacSignature(body, s.cfg.StunPassword))) {
+		return 401
+	}
+	var r DeployReport
+	if err := json.Unmarshal(body, &r); err != nil || r.UUID == "" || r.PeerID == "" {
+		return 400
+	}
+	pid, err := parsePeerID(r.PeerID)
+	if err != nil {
+		return 400
+	}
+	s.RLock()
+	key := s.peerKeys[pid]
+	s.RUnlock()
+	if key == nil {
+		log.Printf("WARNING: refused deploy report of %s uuid:%s version:%d - peer has no pinned key",
+			r.PeerID, r.UUID, r.Version)
+		return 401
+	}
+	if err = verifyReportSignature(body, peerSignature, key); err != nil {
+		log.Printf("WARNING: refused deploy report of %s uuid:%s version:%d - %v", r.PeerID, r.UUID,
+			r.Version, err)
+		metrics.Inc("server.peer_identity", "result", "rejected")
+		return 401
+	}
+	return s.addReport(r)
+}
+
+// addReport adds given deployment report of a peer, and returns the HTTP
+// status code of its outcome.
+func (s *Server) addReport(r DeployReport) int {
+	s.Lock()
+	defer s.Unlock()
+	if n, ok := s.updates[r.UUID]; !ok || r.Version > n.Version {
+		return 404
+	}
+	ur, ok := s.reports[r.UUID]
+	if !ok {
+		ur = new(UpdateReports)
+		s.reports[r.UUID] = ur
+	}
+	if !ur.add(r) {
+		return 200
+	}
+	s.lastModified = time.Now()
+	log.Printf("deploy report of %s uuid:%s version:%d success:%v exit:%d %s%s%s",
+		r.PeerID, r.UUID, r.Version, r.Success, r.ExitCode, rejectSuffix(r.Reject), r.Error, traceSuffix(r.TraceID))
+
+	// only the peers in the session table are aggregated, hence a peer that
+	// knows the STUN password but has never joined the overlay cannot skew
+	// the statistics
+	var pid PeerID
+	if b, err := hex.DecodeString(r.PeerID); err == nil && len(b) == len(pid) {
+		copy(pid[:], b)
+		if _, ok := s.peers[pid]; ok {
+			s.fleet.Add(&r, time.Now(), s.tags[pid]...)
+		}
+	}
+	return 200
+}
+
+// reportsFilename returns the file of the deployment reports, which is next
+// to the update database.
+func (s *Server) reportsFilename() string {
+	return s.cfg.Database + ".reports"
+}
+
+// saveReports writes the deployment reports. The caller must hold the lock.
+func (s *Server) saveReports() error {
+	f, err := os.OpenFile(s.reportsFilename(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(s.reports)
+}
+
+// loadReports reads the deployment reports when the server is created.
+func (s *Server) loadReports() error {
+	s.reports = make(map[string]*UpdateReports)
+	f, err := os.Open(s.reportsFilename())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(&s.reports)
+}
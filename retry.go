@@ -0,0 +1,78 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// deployRetryInterval is the time before the first retry of a failed
+	// deployment, which doubles after every failure.
+	deployRetryInterval = time.Minute
+
+	// deployDefaultMaxRetryInterval is the default maximum time in seconds
+	// between two retries of a failed deployment.
+	deployDefaultMaxRetryInterval = 3600
+
+	// deployRetryLogEvery is the number of the retries of an update that
+	// has failed more than DeployFailsLimit times per logged retry.
+	deployRetryLogEvery = 24
+)
+
+// retryInterval returns the time before the next deployment of the update
+// after its failures: deployRetryInterval doubled after every failure, up to
+// the maximum of the configuration.
+func (u *Update) retryInterval() time.Duration {
+	max := time.Duration(deployDefaultMaxRetryInterval) * time.Second
+	if u.agent != nil && u.agent.Config.Deploy.MaxRetryInterval > 0 {
+		max = time.Duration(u.agent.Config.Deploy.MaxRetryInterval) * time.Second
+	}
+	d := deployRetryInterval
+	for i := 1; i < u.DeployFails && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// scheduleRetry schedules the next deployment of the update, which has just
+// failed. The caller must hold the lock.
+func (u *Update) scheduleRetry() {
+	u.NextDeploy = time.Now().Add(u.retryInterval())
+	if u.logRetry() {
+		u.logf("retrying deployment of update uuid:%s version:%d at %s after %d failures",
+			u.Notification.UUID, u.Notification.Version, u.NextDeploy.Format(time.RFC3339), u.DeployFails)
+	}
+}
+
+// retryHold returns the reason why the deployment of the update must not be
+// retried yet, or an empty string. The caller must hold the lock.
+func (u *Update) retryHold() string {
+	if u.NextDeploy.IsZero() || !time.Now().Before(u.NextDeploy) {
+		return ""
+	}
+	return fmt.Sprintf("retrying deployment at %s after %d failures",
+		u.NextDeploy.Format(time.RFC3339), u.DeployFails)
+}
+
+// retriesFailed returns true if the update has failed its deployment more
+// than DeployFailsLimit times, but it is still retried at the maximum
+// interval since it has no previous version to roll back to. The caller must
+// hold the lock.
+func (u *Update) retriesFailed() bool {
+	return u.State == UpdateFailed && u.DeployFails > DeployFailsLimit &&
+		u.Previous == nil && u.RolledBack == nil
+}
+
+// logRetry returns true if the current deployment of the update is logged:
+// past DeployFailsLimit, only one retry out of deployRetryLogEvery is. The
+// caller must hold the lock.
+func (u *Update) logRetry() bool {
+	return u.DeployFails <= DeployFailsLimit || (u.DeployFails-DeployFailsLimit-1)%deployRetryLogEvery == 0
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryInterval(t *testing.T) {
+	u := &Update{agent: &Agent{Config: &Config{Deploy: DeployConfig{MaxRetryInterval: 600}}}}
+	for fails, d := range map[int]time.Duration{
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		3:  4 * time.Minute,
+		4:  8 * time.Minute,
+		5:  10 * time.Minute,
+		60: 10 * time.Minute,
+	} {
+		u.DeployFails = fails
+		if i := u.retryInterval(); i != d {
+			t.Errorf("%d failures: expected retry after %v, got %v", fails, d, i)
+		}
+	}
+	u.agent = nil
+	if i := u.retryInterval(); i != deployDefaultMaxRetryInterval*time.Second {
+		t.Errorf("default maximum is not applied: %v", i)
+	}
+}
+
+func TestRetryHold(t *testing.T) {
+	u := &Update{State: UpdateDownloaded, DeployFails: 1}
+	if r := u.retryHold(); r != "" {
+		t.Errorf("update without retry is held: %s", r)
+	}
+	u.scheduleRetry()
+	if r := u.retryHold(); r == "" {
+		t.Error("retry is not held until its time")
+	}
+	u.NextDeploy = time.Now().Add(-time.Second)
+	if r := u.retryHold(); r != "" {
+		t.Errorf("due retry is held: %s", r)
+	}
+
+	// failed updates are retried unless they are rolled back
+	u.State, u.DeployFails = UpdateFailed, DeployFailsLimit+1
+	if !u.retriesFailed() {
+		t.Error("failed update is not retried")
+	}
+	u.Previous = &Update{}
+	if u.retriesFailed() {
+		t.Error("failed update with a previous version is retried")
+	}
+	u.Previous, u.RolledBack = nil, &Rollback{}
+	if u.retriesFailed() {
+		t.Error("rolled back update is retried")
+	}
+
+	logged := 0
+	for u.DeployFails = DeployFailsLimit + 1; u.DeployFails <= DeployFailsLimit+2*deployRetryLogEvery; u.DeployFails++ {
+		if u.logRetry() {
+			logged++
+		}
+	}
+	if logged != 2 {
+		t.Errorf("%d retries past the limit are logged", logged)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// pieceIO reads and writes the pieces of a torrent in the files of its
+// payload in a directory.
+type pieceIO struct {
+	dir     string
+	info    *metainfo.Info
+	files   []metainfo.FileInfo
+	offsets []int64 // of the files in the torrent
+	write   bool
+	handles map[int]*os.File
+}
+
+func newPieceIO(dir string, info *metainfo.Info, write bool) *pieceIO {
+	p := &pieceIO{dir: dir, info: info, files: info.UpvertedFiles(), write: write,
+		handles: make(map[int]*os.File)}
+	var off int64
+	for _, fi := range p.files {
+		p.offsets = append(p.offsets, off)
+		off += fi.Length
+	}
+	return p
+}
+
+func (p *pieceIO) file(i int) (*os.File, error) {
+	if f, ok := p.handles[i]; ok {
+		return f, nil
+	}
+	path := payloadPath(p.dir, p.info, p.files[i].Path)
+	var (
+		f   *os.File
+		err error
+	)
+	if p.write {
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+		}
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.handles[i] = f
+	return f, nil
+}
+
+// at reads or writes given bytes at given offset of the torrent.
+func (p *pieceIO) at(b []byte, off int64) error {
+	for i, fi := range p.files {
+		start, end := p.offsets[i], p.offsets[i]+fi.Length
+		if len(b) == 0 {
+			return nil
+		} else if off >= end || fi.Length == 0 {
+			continue
+		}
+		n := int64(len(b))
+		if n > end-off {
+			n = end - off
+		}
+		f, err := p.file(i)
+		if err != nil {
+			return err
+		}
+		if p.write {
+			_, err = f.WriteAt(b[:n], off-start)
+		} else {
+			_, err = f.ReadAt(b[:n], off-start)
+		}
+		if err != nil {
+			return err
+		}
+		b, off = b[n:], off+n
+	}
+	if len(b) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (p *pieceIO) Close() error {
+	var err error
+	for _, f := range p.handles {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// reusePieces copies the pieces of the payload of given old info in given
+// old directory that are identical to pieces of the new info into the
+// payload of the new info in given new directory, which must not exist yet.
+// Each piece is copied only if its data matches the hash of the new piece,
+// and the torrent client checks them again when the torrent is added, hence
+// a piece is never complete without matching its hash. It returns the
+// number of pieces and bytes copied.
+func reusePieces(oldDir string, oldInfo *metainfo.Info, newDir string, newInfo *metainfo.Info) (int, int64, error) {
+	if oldInfo.PieceLength != newInfo.PieceLength {
+		return 0, 0, fmt.Errorf("piece length changed from %d to %d", oldInfo.PieceLength,
+			newInfo.PieceLength)
+	}
+	oldPieces := make(map[string]int, oldInfo.NumPieces())
+	for j := oldInfo.NumPieces() - 1; j >= 0; j-- {
+		oldPieces[string(oldInfo.Pieces[j*20:(j+1)*20])] = j
+	}
+	src, dst := newPieceIO(oldDir, oldInfo, false), newPieceIO(newDir, newInfo, true)
+	defer src.Close()
+
+	var (
+		pieces int
+		size   int64
+		err    error
+	)
+	buf := make([]byte, newInfo.PieceLength)
+	for i := 0; i < newInfo.NumPieces() && err == nil; i++ {
+		piece, hash := newInfo.Piece(i), newInfo.Pieces[i*20:(i+1)*20]
+		j, ok := oldPieces[string(hash)]
+		if !ok || oldInfo.Piece(j).Length() != piece.Length() {
+			continue
+		}
+		b := buf[:piece.Length()]
+		if src.at(b, int64(j)*oldInfo.PieceLength) != nil {
+			continue
+		}
+		if sum := sha1.Sum(b); !bytes.Equal(sum[:], hash) {
+			continue
+		}
+		if err = dst.at(b, int64(i)*newInfo.PieceLength); err == nil {
+			pieces++
+			size += piece.Length()
+		}
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	return pieces, size, err
+}
+
+// reusePiecesOf copies the identical pieces of the payload of given previous
+// version of the update into the payload of the update, before its torrent
+// is added. It is skipped if the payload of the update exists already, or
+// the update is rebuilt from the previous version by a patch. The previous
+// version must be stopped, and the caller must hold the lock.
+func (u *Update) reusePiecesOf(old *Update) {
+	old.RLock()
+	oldInfo, oldSum, oldDir := old.Notification.Info, old.Notification.SHA256, filepath.Dir(old.payloadPath())
+	old.RUnlock()
+	if d := u.Notification.Delta; d != nil && d.BaseSHA256 == oldSum {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(u.dataDir(), u.Notification.Info.Name)); !os.IsNotExist(err) {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(oldDir, oldInfo.Name)); err != nil {
+		return
+	}
+	pieces, size, err := reusePieces(oldDir, &oldInfo, u.dataDir(), &u.Notification.Info)
+	if err != nil {
+		u.logf("WARNING: failed reusing the pieces of the previous version of update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+	total := u.Notification.Info.NumPieces()
+	percent := 0
+	if total > 0 {
+		percent = pieces * 100 / total
+	}
+	metrics.Set("update.reused_pieces_percent", int64(percent), "uuid", u.Notification.UUID)
+	metrics.Add("update.reused_bytes", size, "namespace", u.ns.label())
+	u.logf("reused %d of %d pieces (%d%%, %d bytes) of update uuid:%s version:%d from version %d",
+		pieces, total, percent, size, u.Notification.UUID, u.Notification.Version, old.Notification.Version)
+}
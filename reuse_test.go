@@ -0,0 +1,77 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReusePieces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "p2pupdate-reuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, newDir := filepath.Join(dir, "v1"), filepath.Join(dir, "v2")
+	if err = os.MkdirAll(oldDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	const pieceLength = 16 * 1024
+	rnd := rand.New(rand.NewSource(4))
+	old := make([]byte, 10*pieceLength+100)
+	rnd.Read(old)
+	data := append([]byte(nil), old[:8*pieceLength]...)
+	data[3*pieceLength] = ^data[3*pieceLength]                // changed piece
+	data = append(data, old[9*pieceLength:10*pieceLength]...) // moved piece
+	tail := make([]byte, 500)
+	rnd.Read(tail)
+	data = append(data, tail...)
+	if err = ioutil.WriteFile(filepath.Join(oldDir, "app.bin"), old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldInfo, newInfo := fallbackInfo("app.bin", old, pieceLength), fallbackInfo("app.bin", data, pieceLength)
+
+	// the piece 5 of the previous version is corrupted on disk
+	f, err := os.OpenFile(filepath.Join(oldDir, "app.bin"), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{^old[5*pieceLength]}, 5*pieceLength)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pieces, size, err := reusePieces(oldDir, oldInfo, newDir, newInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pieces != 7 || size != 7*pieceLength {
+		t.Errorf("reused %d pieces of %d bytes, expected 7", pieces, size)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(newDir, "app.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < newInfo.NumPieces(); i++ {
+		p := newInfo.Piece(i)
+		off, end := p.Offset(), p.Offset()+p.Length()
+		reused := end <= int64(len(got)) && bytes.Equal(got[off:end], data[off:end])
+		if expected := i != 3 && i != 5 && i != 9; reused != expected {
+			t.Errorf("piece %d is reused:%v, expected %v", i, reused, expected)
+		}
+	}
+
+	newInfo.PieceLength *= 2
+	if _, _, err = reusePieces(oldDir, oldInfo, filepath.Join(dir, "v3"), newInfo); err == nil {
+		t.Errorf("pieces of another length are reused")
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// previousDir is the directory, in the data directory of a namespace, of the
+// payloads of the deployed versions kept until their next version is
+// deployed, and of the older versions kept seeding.
+const previousDir = ".previous"
+
+// Rollback is the rollback of an update version, which failed its deployment
+// more than DeployFailsLimit times, to the previous version.
+type Rollback struct {
+	Version uint64    `json:"version"` // of the previous version deployed again
+	Time    time.Time `json:"time"`
+	Reason  string    `json:"reason,omitempty"` // of the last deployment failure
+}
+
+// versionDir returns the directory of the payload of the update once it is
+// kept, which is one per version since the versions of an update may have
+// payloads of the same name.
+func (u *Update) versionDir() string {
+	return filepath.Join(u.dataDir(), previousDir, u.Notification.UUID, fmt.Sprintf("v%d", u.Notification.Version))
+}
+
+// previousPath returns the path of the payload of the update once it is kept
+// as the previous version of the next one, or seeding.
+func (u *Update) previousPath() string {
+	return filepath.Join(u.versionDir(), u.Notification.Info.Name)
+}
+
+// payloadPath returns the path of the payload of the update.
+func (u *Update) payloadPath() string {
+	if u.retained || u.SupersededBy > 0 {
+		return u.previousPath()
+	}
+	return filepath.Join(u.dataDir(), u.Notification.Info.Name)
+}
+
+// keepPrevious keeps given previous version of the update, which has been
+// stopped, with its payload until this version is deployed, if it has been
+// deployed by a script. A previous version that has not been deployed hands
+// over the one it keeps, if any. It returns false if the previous version is
+// not kept, hence it must be deleted. The caller must hold the lock.
+func (u *Update) keepPrevious(a *Agent, old *Update) bool {
+	old.Lock()
+	defer old.Unlock()
+	_, script := scriptTypes[old.Notification.UUID]
+	if a.Config.Proxy || a.Config.Deploy.NoRollback || !script || old.State != UpdateDeployed {
+		if u.Previous == nil && old.Previous != nil {
+			u.Previous, old.Previous = old.Previous, nil
+		}
+		return false
+	}
+	dst := old.previousPath()
+	os.RemoveAll(filepath.Dir(dst))
+	old.Previous = nil
+	err := os.MkdirAll(filepath.Dir(dst), 0750)
+	if err == nil {
+		err = os.Rename(old.payloadPath(), dst)
+	}
+	if err != nil {
+		u.logf("WARNING: failed keeping the payload of update uuid:%s version:%d for a rollback - %v",
+			old.Notification.UUID, old.Notification.Version, err)
+		return false
+	}
+	old.retained = true
+	u.Previous = old
+	u.logf("kept update uuid:%s version:%d until version %d is deployed",
+		old.Notification.UUID, old.Notification.Version, u.Notification.Version)
+	return true
+}
+
+// dropPrevious removes the previous version kept by the update, which is not
+// needed anymore, e.g. once the update is deployed. The caller must hold the
+// lock.
+func (u *Update) dropPrevious() {
+	if u.Previous == nil {
+		return
+	}
+	dir := filepath.Dir(u.Previous.previousPath())
+	if err := os.RemoveAll(dir); err != nil {
+		u.logf("WARNING: failed removing previous version of update uuid:%s - %v", u.Notification.UUID, err)
+	}
+	u.logf("dropped version %d of update uuid:%s", u.Previous.Notification.Version, u.Notification.UUID)
+	u.Previous = nil
+	u.dirty = true
+}
+
+// checkRollback rolls the update back to the previous version that it keeps,
+// or to the newest deployed version kept seeding, once it has failed, after
+// the caller has released the lock. The caller must hold the lock.
+func (u *Update) checkRollback(a *Agent) {
+	if u.State != UpdateFailed || u.RolledBack != nil || u.rollingBack {
+		return
+	}
+	if u.Previous == nil && (a.Config.Deploy.NoRollback || !a.hasKeptDeployed(u.key())) {
+		return
+	}
+	u.rollingBack = true
+	go a.rollback(u)
+}
+
+// rollback replaces given failed update by the previous version that it
+// keeps, or else by the newest deployed version kept seeding, which is
+// started and deployed again. The failed update is saved with
+// its rollback and its payload is removed, while its version and the older
+// ones are refused (see addUpdate) until a newer version replaces the
+// previous one.
+func (a *Agent) rollback(u *Update) {
+	u.Stop()
+	u.Lock()
+	prev, kept := u.Previous, false
+	if prev == nil {
+		prev, kept = a.takeKept(u.key()), true
+	}
+	if prev == nil {
+		u.rollingBack = false
+		u.Unlock()
+		return
+	}
+	reason := u.Reason
+	if u.PendingReport != nil && len(u.PendingReport.Error) > 0 {
+		reason = u.PendingReport.Error
+	}
+	u.RolledBack = &Rollback{Version: prev.Notification.Version, Time: time.Now(), Reason: reason}
+	u.Reason = fmt.Sprintf("rolled back to version %d", prev.Notification.Version)
+	u.Previous = nil
+	u.removePayload()
+	if err := u.save(); err != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+	from := u.Notification.Version
+	u.Unlock()
+
+	if kept {
+		// its torrent is started again from the data directory
+		prev.Stop()
+	}
+	prev.Lock()
+	defer prev.Unlock()
+	if err := os.Rename(prev.previousPath(), filepath.Join(prev.dataDir(), prev.Notification.Info.Name)); err != nil {
+		prev.logf("ERROR: failed restoring update uuid:%s version:%d - %v",
+			prev.Notification.UUID, prev.Notification.Version, err)
+		return
+	}
+	os.RemoveAll(filepath.Dir(prev.previousPath()))
+	prev.retained, prev.deleted = false, false
+	prev.SupersededBy = 0
+	prev.RolledBackFrom = from
+	prev.DeployFails = 0
+	prev.NextDeploy = time.Time{}
+	prev.Sent = true // the peers have a newer version
+	prev.setState(UpdateDownloaded)
+	prev.Reason = fmt.Sprintf("rolling back from version %d", from)
+
+	a.Lock()
+	replaced := a.updates[u.key()] != u
+	if !replaced {
+		a.updates[u.key()] = prev
+	}
+	a.Unlock()
+	if replaced {
+		prev.removePayload()
+		prev.logf("not rolling back update uuid:%s to version %d since version %d is replaced",
+			prev.Notification.UUID, prev.Notification.Version, from)
+		return
+	}
+	u.logf("rolling back update uuid:%s version:%d to version %d - %s",
+		u.Notification.UUID, from, prev.Notification.Version, u.RolledBack.Reason)
+	metrics.Inc("update.rollbacks", "namespace", prev.ns.label())
+	a.audit(AuditRolledBack, &u.Notification, "", fmt.Sprintf("rolled back to version %d", prev.Notification.Version))
+	a.events.Add(AgentEvent{
+		Type:    EventRolledBack,
+		UUID:    u.Notification.UUID,
+		Version: prev.Notification.Version,
+		Trace:   u.Notification.TraceID,
+		From:    fmt.Sprint(from),
+		To:      fmt.Sprint(prev.Notification.Version),
+		Error:   u.RolledBack.Reason,
+	})
+	if err := prev.activate(a); err != nil {
+		prev.logf("ERROR: failed starting update uuid:%s version:%d - %v",
+			prev.Notification.UUID, prev.Notification.Version, err)
+	}
+}
+
+// deleteRolledBack deletes the metadata of the version that was rolled back
+// to this one, if any. The caller must hold the lock.
+func (u *Update) deleteRolledBack() {
+	if u.RolledBackFrom == 0 {
+		return
+	}
+	key := fmt.Sprintf("%s-v%d", u.Notification.UUID, u.RolledBackFrom)
+	if err := u.agent.metadata().Delete(u.metadataBucket(), key); err != nil && err != errMetadataNotFound {
+		u.logf("WARNING: failed deleting rolled back update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.RolledBackFrom, err)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestKeepPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Agent{
+		Config:      &Config{},
+		updates:     make(map[string]*Update),
+		dataDir:     filepath.Join(dir, "update"),
+		metadataDir: filepath.Join(dir, "notification"),
+	}
+	for _, d := range []string{a.dataDir, a.metadataDir} {
+		if err = os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	newUpdate := func(version uint64, state UpdateState) *Update {
+		u := NewUpdate(Notification{UUID: UUIDShell, Version: version, Info: metainfo.Info{Name: "update.sh"}}, a)
+		u.ns, u.State = a.namespaces[0], state
+		return u
+	}
+	payload := filepath.Join(a.dataDir, "update.sh")
+	if err = ioutil.WriteFile(payload, []byte("#!/bin/sh\necho v1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deployed version is kept with its payload
+	v1, v2 := newUpdate(1, UpdateDeployed), newUpdate(2, UpdatePending)
+	if err = v1.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if !v2.keepPrevious(a, v1) || v2.Previous != v1 {
+		t.Fatal("deployed version is not kept")
+	}
+	if _, err = os.Stat(payload); !os.IsNotExist(err) {
+		t.Errorf("payload of the kept version is not moved: %v", err)
+	}
+	if b, err := ioutil.ReadFile(v1.payloadPath()); err != nil || string(b) != "#!/bin/sh\necho v1\n" {
+		t.Errorf("payload of the kept version is lost: %v", err)
+	}
+	if err = v2.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v1.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(v1.payloadPath()); err != nil {
+		t.Errorf("payload of the kept version is deleted: %v", err)
+	}
+	loaded, err := LoadUpdateFromFile(v2.MetadataFilename(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := loaded.Previous; p == nil || p.Notification.Version != 1 || !p.retained || p.payloadPath() != v1.payloadPath() {
+		t.Fatalf("previous version is not saved with the new one: %+v", p)
+	}
+
+	// a version that has not been deployed hands over the kept one
+	v3 := newUpdate(3, UpdatePending)
+	if v3.keepPrevious(a, loaded) || v3.Previous == nil || loaded.Previous != nil {
+		t.Error("kept version is not handed over")
+	}
+
+	// the kept version is dropped once the new one is deployed
+	v3.dropPrevious()
+	if _, err = os.Stat(v1.payloadPath()); !os.IsNotExist(err) {
+		t.Errorf("payload of the dropped version is not removed: %v", err)
+	}
+
+	// the versions rolled back are refused
+	v3.RolledBackFrom = 4
+	a.updates[v3.key()] = v3
+	if _, err = a.addUpdate(newUpdate(4, UpdatePending)); err != errUpdateIsRolledBack {
+		t.Errorf("rolled back version is not refused: %v", err)
+	}
+	if _, err = a.addUpdate(newUpdate(5, UpdatePending)); err != nil {
+		t.Errorf("newer version is refused: %v", err)
+	}
+
+	// nothing is kept without rollback
+	a.Config.Deploy.NoRollback = true
+	if newUpdate(6, UpdatePending).keepPrevious(a, newUpdate(5, UpdateDeployed)) {
+		t.Error("previous version is kept without rollback")
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// residentMemory is not supported on this platform.
+func residentMemory() (uint64, error) {
+	return 0, errors.New("resident memory is not supported on this platform")
+}
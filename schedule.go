@@ -0,0 +1,72 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	scheduleDefaultClockSkew     = 300  // in seconds
+	scheduleDefaultFallbackDelay = 3600 // in seconds
+)
+
+// ScheduleConfig holds configurations of the updates that are scheduled by
+// their notifications to be deployed at a given time.
+type ScheduleConfig struct {
+	// ClockSkew is how far the local clock may be behind the clock of the
+	// publisher. A clock that is behind the creation time of a notification
+	// by more than ClockSkew is wrong, and the scheduled time is replaced
+	// by FallbackDelay after the download is complete.
+	ClockSkew     int `json:"clock-skew"`     // in seconds
+	FallbackDelay int `json:"fallback-delay"` // in seconds
+
+	// ClockTolerance is how far the local clock may be from the time sent
+	// by the server before it is not synced, and the scheduled times are
+	// replaced by FallbackDelay after the download until it is.
+	ClockTolerance int `json:"clock-tolerance"` // in seconds
+}
+
+// scheduleTime returns the time when the update of given notification, which
+// was downloaded at given time, can be deployed according to the local clock
+// now, and whether the local clock is wrong. It returns zero time if the
+// update is not scheduled.
+func scheduleTime(n *Notification, downloaded, now time.Time, cfg ScheduleConfig) (time.Time, bool) {
+	if n.NotBefore <= 0 {
+		return time.Time{}, false
+	}
+	created := time.Unix(n.CreationDate, 0)
+	if now.Before(created.Add(-time.Duration(cfg.ClockSkew) * time.Second)) {
+		return downloaded.Add(time.Duration(cfg.FallbackDelay) * time.Second), true
+	}
+	return time.Unix(n.NotBefore, 0), false
+}
+
+// scheduled returns the time when the update can be deployed, or zero time
+// if it is not scheduled. The metadata of older agents have no download
+// time, which is set to now and saved, so that the fallback delay does not
+// elapse at once nor restart on every reload. The caller must hold the lock.
+func (u *Update) scheduled() time.Time {
+	if u.Downloaded.IsZero() && u.Notification.NotBefore > 0 {
+		u.Downloaded, u.dirty = time.Now(), true
+		if err := u.flush(true); err != nil {
+			u.logf("WARNING: failed saving download time of update uuid:%s version:%d - %v",
+				u.Notification.UUID, u.Notification.Version, err)
+		}
+	}
+	t, wrongClock := scheduleTime(&u.Notification, u.Downloaded, time.Now(), u.agent.Config.Schedule)
+	if !wrongClock && !t.IsZero() && !u.agent.clock.Synced() {
+		// the scheduled time cannot be trusted until the clock syncs
+		t, wrongClock = u.Downloaded.Add(time.Duration(u.agent.Config.Schedule.FallbackDelay)*time.Second), true
+	}
+	if wrongClock && !u.clockWarned {
+		log.Printf("WARNING: the local clock is behind the creation time of update uuid:%s version:%d,"+
+			" it is scheduled for %v instead of %v", u.Notification.UUID, u.Notification.Version,
+			t.Format(time.RFC3339), time.Unix(u.Notification.NotBefore, 0).Format(time.RFC3339))
+		u.clockWarned = true
+	}
+	return t
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduleTime(t *testing.T) {
+	cfg := ScheduleConfig{ClockSkew: 300, FallbackDelay: 3600}
+	created := time.Unix(1500000000, 0)
+	notBefore := created.Add(48 * time.Hour)
+	downloaded := created.Add(time.Hour)
+	n := Notification{CreationDate: created.Unix()}
+
+	if at, _ := scheduleTime(&n, downloaded, downloaded, cfg); !at.IsZero() {
+		t.Errorf("unscheduled update is scheduled for %v", at)
+	}
+
+	n.NotBefore = notBefore.Unix()
+	for _, now := range []time.Time{
+		downloaded,
+		created.Add(-time.Minute), // within the clock skew
+	} {
+		if at, wrong := scheduleTime(&n, downloaded, now, cfg); wrong || !at.Equal(notBefore) {
+			t.Errorf("now:%v - scheduled for %v, wrong clock:%v", now, at, wrong)
+		}
+	}
+
+	// the clock is far behind the publisher's
+	now := time.Unix(0, 0)
+	if at, wrong := scheduleTime(&n, now, now, cfg); !wrong || !at.Equal(now.Add(time.Hour)) {
+		t.Errorf("wrong clock - scheduled for %v, wrong clock:%v", at, wrong)
+	}
+}
+
+func TestScheduledWithoutDownloadTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schedule")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Agent{
+		Config:      &Config{DataDir: dir, Schedule: ScheduleConfig{ClockSkew: 300, FallbackDelay: 3600}},
+		updates:     make(map[string]*Update),
+		dataDir:     filepath.Join(dir, "update"),
+		metadataDir: filepath.Join(dir, "notification"),
+	}
+	for _, d := range []string{a.dataDir, a.metadataDir} {
+		if err = os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = a.initNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata of an older agent are reloaded with a clock far behind
+	// the publisher's
+	created := time.Now().Add(24 * time.Hour)
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 1, CreationDate: created.Unix(),
+		NotBefore: created.Add(time.Hour).Unix()}, a)
+	u.ns = a.namespaces[0]
+	start := time.Now()
+	at := u.scheduled()
+	if u.Downloaded.Before(start) || !at.Equal(u.Downloaded.Add(time.Hour)) {
+		t.Fatalf("update without download time is scheduled for %v", at)
+	}
+	saved, err := a.loadUpdate(u.metadataBucket(), u.metadataKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Downloaded.Equal(u.Downloaded) {
+		t.Errorf("download time %v is not saved, got %v", u.Downloaded, saved.Downloaded)
+	}
+	if again := u.scheduled(); !again.Equal(at) {
+		t.Errorf("update is scheduled again for %v instead of %v", again, at)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version of the notifications and of the persisted
+// update metadata written by this software. The readers accept the versions
+// from MinSchemaVersion to SchemaVersion.
+//
+// The versions are:
+//
+//	0: before the schema version was introduced, i.e. the notifications
+//	   and the metadata files without schema_version. The metadata files
+//	   written before the update state was introduced are migrated using
+//	   their Deployed timestamp (see Update.migrate).
+//	1: the schema version is stamped on every notification and metadata
+//	   file.
+//
+// An agent older than the schema version of a notification fails verifying
+// its signature, since it does not know the new fields, hence it drops the
+// notification rather than misinterpreting it.
+const (
+	SchemaVersion    = 1
+	MinSchemaVersion = 0
+)
+
+var errSchemaUnsupported = errors.New("unsupported schema version, please upgrade the agent")
+
+// checkSchema returns errSchemaUnsupported if given schema version is outside
+// the range accepted by this software.
+func checkSchema(version int) error {
+	if version < MinSchemaVersion || version > SchemaVersion {
+		return errors.Wrapf(errSchemaUnsupported, "version %d is not within %d-%d",
+			version, MinSchemaVersion, SchemaVersion)
+	}
+	return nil
+}
+
+// refuseSchema records a notification refused because of its schema version,
+// which is reported in the agent status and once to the server, so that the
+// agents to upgrade can be found.
+func (a *Agent) refuseSchema(n *Notification, err error) {
+	a.Lock()
+	if a.unsupported == nil {
+		a.unsupported = make(map[string]uint64)
+	}
+	reported := a.unsupported[n.UUID] >= n.Version
+	if !reported {
+		a.unsupported[n.UUID] = n.Version
+	}
+	a.Unlock()
+	if reported {
+		return
+	}
+
+	log.Printf("ERROR: refused update uuid:%s version:%d - %v", n.UUID, n.Version, err)
+	metrics.Inc("update.schema_unsupported")
+	if len(a.Config.Server) == 0 {
+		return
+	}
+	r := &DeployReport{
+		PeerID:    a.ID.String(),
+		UUID:      n.UUID,
+		Version:   n.Version,
+		Error:     err.Error(),
+		TraceID:   n.TraceID,
+		Timestamp: time.Now(),
+		Reject:    RejectUnsupportedSchema,
+	}
+	go func() {
+		if err := a.sendDeployReport(r); err != nil {
+			log.Printf("failed sending deploy report uuid:%s version:%d - %v", r.UUID, r.Version, err)
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ScriptType is the kind of the deployment scripts of an update, which is
+// given by its UUID and selects their interpreter.
+type ScriptType string
+
+const (
+	// ScriptShell scripts are run by /bin/sh, whatever their extension.
+	ScriptShell ScriptType = "sh"
+
+	// ScriptPowerShell scripts (.ps1) are run by PowerShell.
+	ScriptPowerShell ScriptType = "ps1"
+
+	// ScriptBatch scripts (.bat or .cmd) are run by cmd.exe.
+	ScriptBatch ScriptType = "bat"
+)
+
+// scriptTypes are the script types of the UUIDs of the updates deployed by
+// ShellDeployer.
+var scriptTypes = map[string]ScriptType{
+	UUIDShell:      ScriptShell,
+	UUIDPowerShell: ScriptPowerShell,
+	UUIDBatch:      ScriptBatch,
+}
+
+// mainScript returns the name of the script run for a directory payload.
+func (t ScriptType) mainScript() string {
+	return "main." + string(t)
+}
+
+// check returns an error if given file is not a script of this type. Any
+// file is a shell script, as before the other types were supported.
+func (t ScriptType) check(filename string) error {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case t == ScriptShell:
+	case t == ScriptPowerShell && ext == ".ps1":
+	case t == ScriptBatch && (ext == ".bat" || ext == ".cmd"):
+	default:
+		return fmt.Errorf("%s is not a %s script", filepath.Base(filename), t)
+	}
+	return nil
+}
+
+// processGroup is the process of a script and the processes it spawns, which
+// are killed together when the script times out.
+type processGroup interface {
+	Kill() error
+	Close() error
+}
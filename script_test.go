@@ -0,0 +1,51 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestScriptTypeCheck(t *testing.T) {
+	cases := []struct {
+		t        ScriptType
+		filename string
+		ok       bool
+	}{
+		{ScriptShell, "update", true},
+		{ScriptShell, "main.sh", true},
+		{ScriptShell, "install.ps1", true},
+		{ScriptPowerShell, "main.ps1", true},
+		{ScriptPowerShell, "MAIN.PS1", true},
+		{ScriptPowerShell, "main.sh", false},
+		{ScriptPowerShell, "update", false},
+		{ScriptBatch, "main.bat", true},
+		{ScriptBatch, "main.cmd", true},
+		{ScriptBatch, "main.ps1", false},
+	}
+	for _, c := range cases {
+		if err := c.t.check(c.filename); (err == nil) != c.ok {
+			t.Errorf("%s check of %s returns %v", c.t, c.filename, err)
+		}
+	}
+}
+
+func TestScriptTypes(t *testing.T) {
+	for uuid, want := range map[string]ScriptType{
+		UUIDShell:      ScriptShell,
+		UUIDPowerShell: ScriptPowerShell,
+		UUIDBatch:      ScriptBatch,
+	} {
+		if got := scriptTypes[uuid]; got != want {
+			t.Errorf("script type of %s is '%s', expected '%s'", uuid, got, want)
+		}
+	}
+	if got := (ShellDeployer{}).script(); got != ScriptShell {
+		t.Errorf("default script type is '%s'", got)
+	}
+	if got := ScriptPowerShell.mainScript(); got != "main.ps1" {
+		t.Errorf("main script is %s", got)
+	}
+}
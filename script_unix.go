@@ -0,0 +1,80 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// scriptCommand returns the command running given script of given type.
+// PowerShell scripts need pwsh, and batch scripts are not supported.
+func scriptCommand(t ScriptType, filename string) (*exec.Cmd, error) {
+	switch t {
+	case ScriptShell:
+		return exec.Command("/bin/sh", filename), nil
+	case ScriptPowerShell:
+		pwsh, err := exec.LookPath("pwsh")
+		if err != nil {
+			return nil, fmt.Errorf("PowerShell (pwsh) is not available: %v", err)
+		}
+		return exec.Command(pwsh, "-NoProfile", "-NonInteractive", "-File", filename), nil
+	}
+	return nil, fmt.Errorf("%s scripts are not supported on this platform", t)
+}
+
+// deployEnvKeys are the variables of the agent passed to the scripts.
+var deployEnvKeys = []string{"PATH", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
+// setCredential makes given command, which is not started yet, run as given
+// user.
+func setCredential(cmd *exec.Cmd, du *DeployUser) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: du.Uid, Gid: du.Gid, Groups: du.Groups}
+	return nil
+}
+
+// unixProcessGroup is a process group whose ID is the PID of its leader.
+type unixProcessGroup int
+
+// startProcessGroup starts given command as the leader of a new process
+// group.
+func startProcessGroup(cmd *exec.Cmd) (processGroup, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return unixProcessGroup(cmd.Process.Pid), nil
+}
+
+// Kill kills all processes of the group.
+func (g unixProcessGroup) Kill() error {
+	return syscall.Kill(-int(g), syscall.SIGKILL)
+}
+
+// Close does nothing since the group ends with its processes.
+func (g unixProcessGroup) Close() error {
+	return nil
+}
+
+// checkOwner returns an error if given file is not owned by the user of the
+// agent.
+func checkOwner(st os.FileInfo) error {
+	s, ok := st.Sys().(*syscall.Stat_t)
+	if ok && int(s.Uid) != os.Getuid() {
+		return fmt.Errorf("is owned by uid %d, not by the agent (uid %d)", s.Uid, os.Getuid())
+	}
+	return nil
+}
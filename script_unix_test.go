@@ -0,0 +1,205 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShellDeployerKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the child keeps stdout open, so Wait would block if it was not killed
+	filename := filepath.Join(dir, "main.sh")
+	if err = ioutil.WriteFile(filename, []byte("sleep 10 &\nwait\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = (ShellDeployer{}).deploy(filename, 100*time.Millisecond); err == nil {
+		t.Error("timed out script succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script was killed after %v", elapsed)
+	}
+
+	if _, err = scriptCommand(ScriptBatch, "main.bat"); err == nil {
+		t.Error("batch scripts are supported")
+	}
+}
+
+func TestShellDeployerRunsAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the agent cannot switch users")
+	}
+	du, err := lookupDeployUser("nobody", nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "main.sh")
+	if err = ioutil.WriteFile(filename, []byte("id -u\npwd\necho $HOME $FOO\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(dir, "work")
+	if err = os.Mkdir(work, 0750); err != nil {
+		t.Fatal(err)
+	}
+	os.Chown(work, int(du.Uid), int(du.Gid))
+
+	os.Setenv("FOO", "agent")
+	defer os.Unsetenv("FOO")
+	out := NewDeployOutput(1024)
+	sh := ShellDeployer{Output: out, User: du, Dir: work, Env: (&DeployConfig{}).environ(du)}
+	if err = sh.deploy(filename, time.Minute); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if s, expected := out.String(), fmt.Sprintf("%d\n%s\n%s\n", du.Uid, work, du.Home); s != expected {
+		t.Errorf("expected output %q, got %q", expected, s)
+	}
+}
+
+func TestShellDeployerRunsAsUserInDataDir(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("the agent cannot switch users")
+	}
+	du, err := lookupDeployUser("nobody", nil)
+	if err != nil {
+		t.Skip(err)
+	}
+	dir, err := ioutil.TempDir("", "script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data directories are private to the agent
+	top := filepath.Join(dir, "data")
+	data := filepath.Join(top, "update")
+	if err = os.MkdirAll(data, 0750); err != nil {
+		t.Fatal(err)
+	}
+	payload := filepath.Join(data, "payload")
+	if err = os.Mkdir(payload, 0750); err != nil {
+		t.Fatal(err)
+	}
+	script := fmt.Sprintf("id -u\npwd\nls %s >/dev/null 2>&1 || echo unlisted\n", top)
+	filename := filepath.Join(payload, "main.sh")
+	if err = ioutil.WriteFile(filename, []byte(script), 0640); err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(data, deployWorkDir, "uuid-v1")
+	if err = os.MkdirAll(work, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chown(work, int(du.Uid), int(du.Gid)); err != nil {
+		t.Fatal(err)
+	}
+	out := NewDeployOutput(1024)
+	sh := ShellDeployer{Root: data, Output: out, User: du, Dir: work, Env: (&DeployConfig{}).environ(du)}
+	if err = sh.deploy(filename, time.Minute); err == nil {
+		t.Fatal("private payload is deployed by the user")
+	}
+
+	// the payload is staged in the working directory, whose parents are
+	// only traversable
+	if err = grantParents(du, work, top); err != nil {
+		t.Fatal(err)
+	}
+	out = NewDeployOutput(1024)
+	sh.Output, sh.Stage = out, filepath.Join(work, deployStageDir)
+	if err = sh.deploy(filename, time.Minute); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if s, expected := out.String(), fmt.Sprintf("%d\n%s\nunlisted\n", du.Uid, work); s != expected {
+		t.Errorf("expected output %q, got %q", expected, s)
+	}
+	for _, d := range []string{top, data} {
+		if st, err := os.Stat(d); err != nil || st.Mode().Perm()&0067 != 0 {
+			t.Errorf("data directory %s is opened: %v %v", d, st.Mode(), err)
+		}
+	}
+	if st, err := os.Stat(dir); err != nil || st.Mode().Perm() != 0755 {
+		t.Errorf("directory above the data directory is changed: %v %v", st.Mode(), err)
+	}
+	if st, err := os.Stat(payload); err != nil || st.Mode().Perm() != 0750 {
+		t.Errorf("payload is changed: %v %v", st.Mode(), err)
+	}
+	if _, err = os.Stat(filepath.Join(sh.Stage, "payload", "main.sh")); err != nil {
+		t.Errorf("payload is not staged: %v", err)
+	}
+}
+
+func TestShellDeployerCapturesOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	run := func(script string, d time.Duration) (*DeployOutput, error) {
+		filename := filepath.Join(dir, "main.sh")
+		if err := ioutil.WriteFile(filename, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		out := NewDeployOutput(1024)
+		return out, ShellDeployer{Output: out}.deploy(filename, d)
+	}
+
+	out, err := run("echo out\necho err >&2\nexit 3\n", time.Minute)
+	if err == nil || out.ExitCode != 3 || out.TimedOut {
+		t.Errorf("unexpected exit %d timed out %v: %v", out.ExitCode, out.TimedOut, err)
+	}
+	if s := out.String(); s != "out\nerr\n" {
+		t.Errorf("unexpected output %q", s)
+	}
+
+	// megabytes of output are truncated without blocking the script
+	out, err = run("head -c 4000000 /dev/zero | tr '\\0' x\necho end\n", time.Minute)
+	if err != nil || out.ExitCode != 0 {
+		t.Fatalf("script writing megabytes failed: %v", err)
+	}
+	if s := out.String(); !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "xxxend\n") {
+		t.Errorf("unexpected truncated output %q", s)
+	}
+
+	out, err = run("echo started\nsleep 10\n", 100*time.Millisecond)
+	if err == nil || !out.TimedOut || out.ExitCode != -1 || !strings.Contains(err.Error(), "timeout") {
+		t.Errorf("timeout is not recorded: exit %d timed out %v: %v", out.ExitCode, out.TimedOut, err)
+	}
+	if s := out.String(); s != "started\n" {
+		t.Errorf("unexpected output of the killed script %q", s)
+	}
+
+	// a daemon keeping the output open does not block the deployment
+	start := time.Now()
+	if _, err = run("setsid sleep 10 &\necho done\n", time.Minute); err != nil {
+		t.Errorf("script spawning a daemon failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("deployment waited %v for the daemon", elapsed)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+)
+
+// access rights of the script process assigned to a job object
+const processJobAccess = 0x0100 | 0x0001 // PROCESS_SET_QUOTA | PROCESS_TERMINATE
+
+// scriptCommand returns the command running given script of given type. The
+// shell scripts need sh in the PATH, e.g. of Git for Windows.
+func scriptCommand(t ScriptType, filename string) (*exec.Cmd, error) {
+	switch t {
+	case ScriptShell:
+		sh, err := exec.LookPath("sh")
+		if err != nil {
+			return nil, fmt.Errorf("sh is not available, use a PowerShell or batch update: %v", err)
+		}
+		return exec.Command(sh, filename), nil
+	case ScriptPowerShell:
+		return exec.Command("powershell.exe", "-NoProfile", "-NonInteractive",
+			"-ExecutionPolicy", "Bypass", "-File", filename), nil
+	case ScriptBatch:
+		return exec.Command("cmd.exe", "/C", filename), nil
+	}
+	return nil, fmt.Errorf("%s scripts are not supported on this platform", t)
+}
+
+// deployEnvKeys are the variables of the agent passed to the scripts, which
+// cmd.exe and PowerShell need.
+var deployEnvKeys = []string{"PATH", "PATHEXT", "SystemRoot", "SystemDrive", "ComSpec", "windir",
+	"TEMP", "TMP", "USERPROFILE", "ProgramData", "ProgramFiles", "ProgramFiles(x86)", "PSModulePath"}
+
+// setCredential returns an error since the scripts run as the user of the
+// agent on Windows.
+func setCredential(cmd *exec.Cmd, du *DeployUser) error {
+	return fmt.Errorf("running the scripts as %s is not supported on Windows", du.Name)
+}
+
+// jobObject is a Windows job object holding the process of a script, whose
+// child processes are assigned to the job as well.
+type jobObject syscall.Handle
+
+// startProcessGroup starts given command and assigns it to a new job object.
+// The process is killed if it cannot be assigned, since it could not be
+// killed with its children otherwise.
+func startProcessGroup(cmd *exec.Cmd) (processGroup, error) {
+	h, _, err := procCreateJobObjectW.Call(0, 0)
+	if h == 0 {
+		return nil, fmt.Errorf("failed creating job object: %v", err)
+	}
+	job := jobObject(h)
+	if err = cmd.Start(); err != nil {
+		job.Close()
+		return nil, err
+	}
+	if err = job.assign(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		job.Close()
+		return nil, fmt.Errorf("failed assigning the script to a job object: %v", err)
+	}
+	return job, nil
+}
+
+// assign assigns the process of given PID to the job.
+func (job jobObject) assign(pid int) error {
+	p, err := syscall.OpenProcess(processJobAccess, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(p)
+	if r, _, err := procAssignProcessToJobObject.Call(uintptr(job), uintptr(p)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Kill terminates all processes of the job.
+func (job jobObject) Kill() error {
+	if r, _, err := procTerminateJobObject.Call(uintptr(job), 1); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Close closes the handle of the job.
+func (job jobObject) Close() error {
+	return syscall.CloseHandle(syscall.Handle(job))
+}
+
+// checkOwner does nothing since the owners of the files are not exposed by
+// their modes on Windows.
+func checkOwner(st os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptCommand(t *testing.T) {
+	cmd, err := scriptCommand(ScriptPowerShell, `C:\update\main.ps1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(cmd.Args, " "); !strings.HasPrefix(args, "powershell.exe") ||
+		!strings.HasSuffix(args, `-File C:\update\main.ps1`) {
+		t.Errorf("unexpected PowerShell command: %s", args)
+	}
+	if cmd, err = scriptCommand(ScriptBatch, `C:\update\main.bat`); err != nil {
+		t.Fatal(err)
+	}
+	if args := strings.Join(cmd.Args, " "); args != `cmd.exe /C C:\update\main.bat` {
+		t.Errorf("unexpected batch command: %s", args)
+	}
+}
+
+func TestShellDeployerKillsJobObject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "script-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "main.bat")
+	if err = ioutil.WriteFile(filename, []byte("ping -n 10 127.0.0.1 >NUL\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err = (ShellDeployer{Script: ScriptBatch}).deploy(filename, 100*time.Millisecond); err == nil {
+		t.Error("timed out script succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("script was killed after %v", elapsed)
+	}
+}
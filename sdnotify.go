@@ -0,0 +1,84 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends given state (e.g. READY=1) to systemd's notification socket.
+// It does nothing and returns false if NOTIFY_SOCKET is not set, i.e. the
+// process is not run by systemd with Type=notify.
+func sdNotify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: name, Net: "unixgram"}
+	if name[0] == '@' {
+		// abstract namespace socket
+		addr.Name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns the interval of watchdog notifications, which is
+// half of WATCHDOG_USEC, or 0 if the watchdog is disabled.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdStartWatchdog sends WATCHDOG=1 every watchdog interval as long as function
+// `healthy` returns true, so that systemd restarts a deadlocked process. It
+// returns a channel that can be closed to stop the notifications, or nil if
+// the watchdog is disabled.
+func sdStartWatchdog(healthy func() bool) chan struct{} {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+	log.Printf("systemd watchdog is enabled with interval %v", interval)
+	return ExecEvery(interval, func() {
+		if !healthy() {
+			log.Println("WARNING: health check failed, skipped watchdog notification")
+		} else if _, err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("failed sending watchdog notification: %v", err)
+		}
+	})
+}
+
+// lockedWithin returns true if function `lock` returns within given timeout.
+func lockedWithin(timeout time.Duration, lock func()) bool {
+	done := make(chan struct{})
+	go func() {
+		lock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
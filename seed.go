@@ -0,0 +1,162 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/dht"
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/anacrolix/torrent/tracker"
+	"github.com/pkg/errors"
+)
+
+// seedStatsInterval is the interval of the stats printed while seeding.
+const seedStatsInterval = 10 * time.Second
+
+// seedOptions are the conditions of the end of the seeding by the submit
+// command, which seeds until it is interrupted if they are zero.
+type seedOptions struct {
+	Duration time.Duration
+	Ratio    float64 // of the uploaded bytes to the payload size
+}
+
+// done returns why the seeding of a payload of given size must stop after
+// given duration and uploaded bytes, or an empty string.
+func (o seedOptions) done(elapsed time.Duration, uploaded, size int64) string {
+	if o.Duration > 0 && elapsed >= o.Duration {
+		return fmt.Sprintf("seeded for %s", o.Duration)
+	}
+	if o.Ratio > 0 && size > 0 && float64(uploaded)/float64(size) >= o.Ratio {
+		return fmt.Sprintf("upload ratio %.2f is reached", o.Ratio)
+	}
+	return ""
+}
+
+// seedClientConfig returns the configurations of the torrent client seeding
+// the payloads of given directory, with the port, the rate limits and the
+// connection limits of given configurations of the agents, so that their
+// firewall rules apply. The pieces are verified in memory, nothing is
+// written beside the payload.
+func seedClientConfig(cfg BitTorrentConfig, dir string) *torrent.Config {
+	if cfg.Port == 0 {
+		cfg.Port = bindRandomPort()
+	}
+	bandwidth := NewBandwidthScheduler(cfg)
+	bandwidth.Apply(time.Now())
+	tcfg := &torrent.Config{
+		ListenPort:       cfg.Port,
+		DataDir:          dir,
+		Seed:             true,
+		NoDHT:            cfg.NoDHT,
+		HTTPUserAgent:    softwareName,
+		Debug:            cfg.Debug,
+		DhtStartingNodes: dht.GlobalBootstrapAddrs,
+		DisableIPv4:      cfg.DisableIPv4,
+		DisableIPv6:      cfg.DisableIPv6,
+
+		UploadRateLimiter:   bandwidth.up,
+		DownloadRateLimiter: bandwidth.down,
+	}
+	cfg.applyStorage(tcfg, dir, storage.NewMapPieceCompletion())
+	return tcfg
+}
+
+// seedPayload seeds the payload of given notification from given source file
+// or directory, announcing it to its tracker and to the DHT, until the
+// options are met or the process is interrupted. The stats are printed on
+// given output. The tracker is told that the seed stops before returning.
+func seedPayload(cfg BitTorrentConfig, n *Notification, source string, opts seedOptions, out io.Writer) error {
+	if filepath.Base(source) != n.Info.Name {
+		return fmt.Errorf("source %s does not match the payload name %s", source, n.Info.Name)
+	}
+	mi, err := n.torrentMetainfo()
+	if err != nil {
+		return err
+	}
+	mi = cfg.tokenizeMetaInfo(mi)
+	tcfg := seedClientConfig(cfg, filepath.Dir(source))
+	client, err := torrent.NewClient(tcfg)
+	if err != nil {
+		return errors.Wrap(err, "failed starting torrent client")
+	}
+	defer client.Close()
+	t, err := client.AddTorrent(mi)
+	if err != nil {
+		return err
+	}
+	defer t.Drop()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	<-t.GotInfo()
+	t.VerifyData()
+	if missing := t.BytesMissing(); missing > 0 {
+		return fmt.Errorf("source %s differs from the payload, %d bytes do not match", source, missing)
+	}
+	size := n.Info.TotalLength()
+	fmt.Fprintf(out, "seeding infohash:%s on port %d\n", t.InfoHash().HexString(), tcfg.ListenPort)
+
+	start := time.Now()
+	ticker := time.NewTicker(seedStatsInterval)
+	defer ticker.Stop()
+	reason := ""
+	for reason == "" {
+		select {
+		case <-interrupt:
+			reason = "interrupted"
+		case <-ticker.C:
+			stats := t.Stats()
+			fmt.Fprintf(out, "peers(total/active):%d/%d uploaded:%d ratio:%.2f\n", stats.TotalPeers,
+				stats.ActivePeers, stats.BytesWrittenData, float64(stats.BytesWrittenData)/float64(size))
+			reason = opts.done(time.Since(start), stats.BytesWrittenData, size)
+		}
+	}
+	fmt.Fprintf(out, "stop seeding: %s\n", reason)
+	if len(n.Announce) > 0 {
+		if err = announceStopped(&cfg, n.Announce, t, client.PeerID(), tcfg.ListenPort); err != nil {
+			fmt.Fprintf(out, "WARNING: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// announceStopped tells given tracker that the client of given peer ID stops
+// seeding given torrent, since closing the client does not announce it.
+func announceStopped(cfg *BitTorrentConfig, tr string, t *torrent.Torrent, peerID [20]byte, port int) error {
+	announce := tracker.Announce{
+		TrackerUrl: cfg.trackerURL(tr),
+		UserAgent:  softwareName,
+		Request: tracker.AnnounceRequest{
+			InfoHash: t.InfoHash(),
+			PeerId:   peerID,
+			Event:    tracker.Stopped,
+			Port:     uint16(port),
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := announce.Do()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrapf(err, "failed announcing the stop to %s", cfg.redactToken(tr))
+		}
+		return nil
+	case <-time.After(reannounceTimeout):
+		return fmt.Errorf("announcing the stop to %s timed out", cfg.redactToken(tr))
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedOptionsDone(t *testing.T) {
+	for i, test := range []struct {
+		opts     seedOptions
+		elapsed  time.Duration
+		uploaded int64
+		done     bool
+	}{
+		{seedOptions{}, 24 * time.Hour, 1000, false},
+		{seedOptions{Duration: time.Hour}, 59 * time.Minute, 0, false},
+		{seedOptions{Duration: time.Hour}, time.Hour, 0, true},
+		{seedOptions{Ratio: 1.5}, time.Hour, 149, false},
+		{seedOptions{Ratio: 1.5}, time.Second, 150, true},
+		{seedOptions{Duration: time.Hour, Ratio: 2}, time.Minute, 200, true},
+	} {
+		if reason := test.opts.done(test.elapsed, test.uploaded, 100); (reason != "") != test.done {
+			t.Errorf("%d: unexpected reason '%s'", i, reason)
+		}
+	}
+}
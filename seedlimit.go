@@ -0,0 +1,55 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// validateSeedLimits returns an error if the limits of the seeding of the
+// deployed updates are negative.
+func (c *BitTorrentConfig) validateSeedLimits() error {
+	if c.SeedRatio < 0 || c.SeedTime < 0 {
+		return fmt.Errorf("negative seed limit ratio:%v time:%d", c.SeedRatio, c.SeedTime)
+	}
+	return nil
+}
+
+// seedLimits returns the conditions of the end of the seeding of the deployed
+// updates, which seed forever if they are zero.
+func (c *BitTorrentConfig) seedLimits() seedOptions {
+	return seedOptions{Duration: time.Duration(c.SeedTime) * time.Second, Ratio: c.SeedRatio}
+}
+
+// checkSeeding returns true if the deployed update has uploaded its payload
+// the number of times of the seed ratio of the configuration, or has seeded
+// for its seed time since it was deployed, hence it must be stopped once the
+// caller releases the lock. The time is saved as SeedingFinished, so that the
+// update is not started again on restart. The uploaded bytes are counted
+// since the torrent was started. A proxy seeds forever. The caller must hold
+// the lock.
+func (u *Update) checkSeeding(a *Agent, now time.Time) bool {
+	if a.Config.Proxy || u.State != UpdateDeployed || u.torrent == nil || !u.SeedingFinished.IsZero() {
+		return false
+	}
+	stats := u.torrent.Stats()
+	reason := a.Config.BitTorrent.seedLimits().done(now.Sub(u.Deployed), stats.BytesWrittenData,
+		u.Notification.Info.TotalLength())
+	if reason == "" {
+		return false
+	}
+	u.SeedingFinished = now
+	u.dirty = true
+	u.logf("stop seeding update uuid:%s version:%d - %s", u.Notification.UUID, u.Notification.Version, reason)
+	metrics.Inc("update.seeding_finished", "namespace", u.ns.label())
+	return true
+}
+
+// seedingFinished returns true if the deployed update has finished seeding,
+// hence it is not started again. The caller must hold the lock.
+func (u *Update) seedingFinished() bool {
+	return u.State == UpdateDeployed && !u.SeedingFinished.IsZero()
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeedLimits(t *testing.T) {
+	for _, tc := range []struct {
+		cfg BitTorrentConfig
+		ok  bool
+	}{
+		{BitTorrentConfig{}, true},
+		{BitTorrentConfig{SeedRatio: 2, SeedTime: 3600}, true},
+		{BitTorrentConfig{SeedRatio: -1}, false},
+		{BitTorrentConfig{SeedTime: -1}, false},
+	} {
+		if err := tc.cfg.validateSeedLimits(); (err == nil) != tc.ok {
+			t.Errorf("seed limits %+v: %v", tc.cfg, err)
+		}
+	}
+
+	// zero limits seed forever
+	if r := (&BitTorrentConfig{}).seedLimits().done(365*24*time.Hour, 1<<40, 1); r != "" {
+		t.Errorf("seeding without limits stops: %s", r)
+	}
+	cfg := &BitTorrentConfig{SeedRatio: 2, SeedTime: 3600}
+	for _, tc := range []struct {
+		elapsed  time.Duration
+		uploaded int64
+		done     bool
+	}{
+		{time.Minute, 100, false},
+		{time.Minute, 200, true},
+		{time.Hour, 0, true},
+	} {
+		if r := cfg.seedLimits().done(tc.elapsed, tc.uploaded, 100); (r != "") != tc.done {
+			t.Errorf("seeding %s with %d bytes uploaded: %q", tc.elapsed, tc.uploaded, r)
+		}
+	}
+
+	// a deployed update that has finished seeding is not started again
+	u := &Update{State: UpdateDeployed}
+	if u.seedingFinished() {
+		t.Error("deployed update has finished seeding")
+	}
+	u.SeedingFinished = time.Now()
+	if !u.seedingFinished() {
+		t.Error("deployed update has not finished seeding")
+	}
+	u.State = UpdateDownloaded
+	if u.seedingFinished() {
+		t.Error("update rolled back to has finished seeding")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	// DefaultSendConcurrency is the number of peers that are sent to at
+	// the same time.
+	DefaultSendConcurrency = 32
+
+	// DefaultSendTimeout is the total deadline of a send in seconds.
+	DefaultSendTimeout = 60
+
+	// sendPingTimeout is how long a peer may take to reply a ping.
+	sendPingTimeout = 3 * time.Second
+)
+
+// SendRequest asks the agent to send an operator message to the peers of its
+// session table, or to ping them if there is no message.
+type SendRequest struct {
+	Peers       []string           `json:"peers,omitempty"` // all peers if empty
+	Maintenance *MaintenanceNotice `json:"maintenance,omitempty"`
+	Concurrency int                `json:"concurrency,omitempty"`
+	Timeout     int                `json:"timeout,omitempty"` // in seconds
+}
+
+// PeerSendResult is the outcome of a send to a peer.
+type PeerSendResult struct {
+	PeerID  string  `json:"peer-id"`
+	Address string  `json:"address,omitempty"`
+	Relayed bool    `json:"relayed,omitempty"` // reached through the server
+	OK      bool    `json:"ok"`
+	RTT     float64 `json:"rtt-ms,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// SendResult is the outcome of a send, whose failed peers may be retried.
+type SendResult struct {
+	Peers  []PeerSendResult `json:"peers"`
+	Sent   int              `json:"sent"`
+	Failed int              `json:"failed"`
+}
+
+// FailedPeers returns the IDs of the peers that the send failed to reach.
+func (r *SendResult) FailedPeers() []string {
+	var failed []string
+	for _, p := range r.Peers {
+		if !p.OK {
+			failed = append(failed, p.PeerID)
+		}
+	}
+	return failed
+}
+
+// send sends the message of given request to the peers, at most
+// req.Concurrency at a time until the deadline. A peer is pinged first,
+// directly then through the relay of the server, and the message is only
+// sent to the peers that replied, the same way, hence a peer succeeds if it
+// is reachable and the message has been sent to it. The
+// message is unicast with a TTL of one, so that a retry of the failed peers
+// does not reach the others again.
+func (a *Agent) send(req SendRequest) (*SendResult, error) {
+	if a.Overlay == nil || !a.Overlay.Ready() {
+		return nil, errNotReady
+	}
+	var data []byte
+	if req.Maintenance != nil {
+		if err := req.Maintenance.Verify(a.PublicKey); err != nil {
+			return nil, errUpdateVerificationFailed
+		}
+		// the local agent applies the notice as a broadcast does
+		if err := a.maintenance.Apply(req.Maintenance); err != nil && err != errMaintenanceNoticeIsOld {
+			return nil, err
+		}
+		var err error
+		if data, err = bencode.EncodeBytes(OperatorMessage{Maintenance: req.Maintenance}); err != nil {
+			return nil, err
+		}
+	}
+	concurrency := req.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultSendConcurrency
+	}
+	timeout := time.Duration(req.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = DefaultSendTimeout * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	table := a.Overlay.Peers()
+	peers := make(map[string]PeerID, len(table))
+	for pid := range table {
+		if pid != a.Overlay.LocalID() {
+			peers[pid.String()] = pid
+		}
+	}
+	targets := req.Peers
+	if len(targets) == 0 {
+		for id := range peers {
+			targets = append(targets, id)
+		}
+	}
+	sort.Strings(targets)
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+		results = make([]PeerSendResult, len(targets))
+	)
+	for i, id := range targets {
+		pid, ok := peers[id]
+		if !ok {
+			results[i] = PeerSendResult{PeerID: id, Error: errPeerNotFound.Error()}
+			continue
+		}
+		sem <- struct{}{}
+		if !time.Now().Before(deadline) {
+			<-sem
+			results[i] = PeerSendResult{PeerID: id, Error: "deadline exceeded before sending"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pid PeerID) {
+			defer wg.Done()
+			results[i] = a.sendToPeer(pid, data, deadline)
+			<-sem
+		}(i, pid)
+	}
+	wg.Wait()
+
+	r := &SendResult{Peers: results}
+	for _, p := range results {
+		if p.OK {
+			r.Sent++
+		} else {
+			r.Failed++
+		}
+	}
+	log.Printf("sent to %d peers, failed %d", r.Sent, r.Failed)
+	return r, nil
+}
+
+// sendToPeer pings given peer, directly then through the relay of the server
+// if it does not reply before the deadline, then sends it given data if any
+// the way it replied.
+func (a *Agent) sendToPeer(pid PeerID, data []byte, deadline time.Time) PeerSendResult {
+	r := PeerSendResult{PeerID: pid.String()}
+	addr, rtt, err := a.Overlay.Ping(pid, sendTimeout(deadline), false)
+	if addr != nil {
+		r.Address = addr.String()
+	}
+	if err != nil && err != errPeerNotFound && time.Now().Before(deadline) {
+		var relayErr error
+		if _, rtt, relayErr = a.Overlay.Ping(pid, sendTimeout(deadline), true); relayErr == nil {
+			err, r.Relayed = nil, true
+		} else {
+			err = fmt.Errorf("%v, through the relay: %v", err, relayErr)
+		}
+	}
+	if err != nil {
+		r.Error = fmt.Sprintf("unreachable: %v", err)
+		return r
+	}
+	r.RTT = float64(rtt) / float64(time.Millisecond)
+	if len(data) > 0 {
+		if err = a.Overlay.SendTo(pid, data, r.Relayed); err != nil {
+			r.Error = fmt.Sprintf("failed sending: %v", err)
+			return r
+		}
+	}
+	r.OK = true
+	return r
+}
+
+// sendTimeout returns how long a peer may take to reply a ping before given
+// deadline.
+func sendTimeout(deadline time.Time) time.Duration {
+	if timeout := time.Until(deadline); timeout < sendPingTimeout {
+		return timeout
+	}
+	return sendPingTimeout
+}
@@ -0,0 +1,263 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestSend(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maintenance, err := NewMaintenance(false, filepath.Join(dir, "maintenance.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	serverConn := listen()
+	defer serverConn.Close()
+	serverAddr := serverConn.LocalAddr().(*net.UDPAddr)
+	// the address of the peers that drop the messages
+	blackhole := listen()
+	defer blackhole.Close()
+	unreachable := blackhole.LocalAddr().(*net.UDPAddr)
+
+	// the local overlay, 4 peers that it reaches directly and 1 that it
+	// only reaches through the server
+	const relayed = 5
+	nodes := make([]*OverlayConn, relayed+1)
+	for i := range nodes {
+		conn := listen()
+		defer conn.Close()
+		nodes[i] = &OverlayConn{
+			ID:             PeerID{0, 0, 0, 0, 0, byte(i + 1)},
+			Config:         &OverlayConfig{StunPassword: defaultStunPassword},
+			automata:       NewAutomata(stateListening, nil, nil),
+			conn:           &overlayUDPConn{conn: conn},
+			rendezvousAddr: serverAddr,
+			peers:          make(SessionTable),
+		}
+	}
+	local := nodes[0]
+	s := &Server{
+		ID:    PeerID{0, 0, 0, 0, 0, 9},
+		peers: make(SessionTable),
+		cfg:   &ServerConfig{StunPassword: defaultStunPassword},
+	}
+	for i, node := range nodes {
+		addr := node.conn.conn.LocalAddr().(*net.UDPAddr)
+		s.peers[node.ID] = Session{addr, addr}
+		if i == relayed {
+			addr = unreachable
+		}
+		local.peers[node.ID] = Session{addr, addr}
+		node.peers[local.ID] = s.peers[local.ID]
+	}
+	down := PeerID{0, 0, 0, 0, 0, 8}
+	local.peers[down] = Session{unreachable, unreachable}
+	s.peers[down] = Session{unreachable, unreachable}
+	a := &Agent{Overlay: local, PublicKey: &key.PublicKey, maintenance: maintenance}
+
+	// the server relays the messages, and the nodes reply the pings after a
+	// while, recording the largest number of pings awaited by the local
+	// overlay, and count the data messages
+	var (
+		maxPending int32
+		received   = make([]int32, len(nodes))
+	)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := serverConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var req stun.Message
+			if _, err = req.Write(buf[:n]); err != nil {
+				t.Error(err)
+				continue
+			}
+			if err = s.processMessage(serverConn, addr, &req, new(stun.Message)); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i, node := range nodes {
+		go func(i int, node *OverlayConn) {
+			buf := make([]byte, 1500)
+			for {
+				n, addr, err := node.conn.conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				var req stun.Message
+				node.msg, node.senderAddr = buf[:n], addr
+				pid, err := node.parseHeader(&req)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				switch req.Type {
+				case stunPingRequest:
+					local.RLock()
+					pending := int32(len(local.pings))
+					local.RUnlock()
+					for {
+						max := atomic.LoadInt32(&maxPending)
+						if pending <= max || atomic.CompareAndSwapInt32(&maxPending, max, pending) {
+							break
+						}
+					}
+					time.Sleep(50 * time.Millisecond)
+					err = node.pingRequest(pid, &req)
+				case stunPingResponse:
+					err = node.pingResponse(pid, &req)
+				case stunDataIndication:
+					atomic.AddInt32(&received[i], 1)
+				default:
+					t.Errorf("unexpected message type %v", req.Type)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, node)
+	}
+
+	notice := &MaintenanceNotice{Active: true, Timestamp: time.Now().UnixNano(), By: "operator"}
+	if err = notice.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	id := func(i int) string {
+		return nodes[i].ID.String()
+	}
+	for _, c := range []struct {
+		name     string
+		req      SendRequest
+		ok       []string
+		relayed  []string
+		failed   []string
+		received []int32 // data messages received by the nodes
+		within   time.Duration
+	}{
+		{
+			name:   "ping",
+			req:    SendRequest{Peers: []string{id(1), id(2)}},
+			ok:     []string{id(1), id(2)},
+			within: time.Second,
+		},
+		{
+			name:   "unknown peer",
+			req:    SendRequest{Peers: []string{id(1), "ffffffffffff"}},
+			ok:     []string{id(1)},
+			failed: []string{"ffffffffffff"},
+			within: time.Second,
+		},
+		{
+			name:   "concurrency",
+			req:    SendRequest{Peers: []string{id(1), id(2), id(3), id(4)}, Concurrency: 2},
+			ok:     []string{id(1), id(2), id(3), id(4)},
+			within: time.Second,
+		},
+		{
+			name:    "relay",
+			req:     SendRequest{Peers: []string{id(1), id(relayed)}},
+			ok:      []string{id(1), id(relayed)},
+			relayed: []string{id(relayed)},
+			within:  sendPingTimeout + time.Second,
+		},
+		{
+			name:     "message",
+			req:      SendRequest{Peers: []string{id(1), id(relayed)}, Maintenance: notice},
+			ok:       []string{id(1), id(relayed)},
+			relayed:  []string{id(relayed)},
+			received: []int32{0, 1, 0, 0, 0, 1},
+			within:   sendPingTimeout + time.Second,
+		},
+		{
+			name:   "deadline",
+			req:    SendRequest{Peers: []string{down.String(), id(relayed)}, Concurrency: 1, Timeout: 1},
+			failed: []string{id(relayed), down.String()},
+			within: 2 * time.Second,
+		},
+	} {
+		atomic.StoreInt32(&maxPending, 0)
+		for i := range received {
+			atomic.StoreInt32(&received[i], 0)
+		}
+		start := time.Now()
+		r, err := a.send(c.req)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed > c.within {
+			t.Errorf("%s: took %v", c.name, elapsed)
+		}
+		var ok, relayed []string
+		for _, p := range r.Peers {
+			if p.OK {
+				ok = append(ok, p.PeerID)
+			}
+			if p.Relayed {
+				relayed = append(relayed, p.PeerID)
+			}
+		}
+		failed := r.FailedPeers()
+		sort.Strings(failed)
+		if !reflect.DeepEqual(ok, c.ok) || !reflect.DeepEqual(relayed, c.relayed) ||
+			!reflect.DeepEqual(failed, c.failed) {
+			t.Errorf("%s: ok %v, relayed %v, failed %v", c.name, ok, relayed, failed)
+		}
+		if r.Sent != len(c.ok) || r.Failed != len(c.failed) {
+			t.Errorf("%s: sent %d, failed %d", c.name, r.Sent, r.Failed)
+		}
+		if limit := int32(c.req.Concurrency); limit > 0 {
+			if pending := atomic.LoadInt32(&maxPending); pending > limit {
+				t.Errorf("%s: %d pings awaited at once", c.name, pending)
+			}
+		}
+		if c.received != nil {
+			deadline := time.Now().Add(time.Second)
+			for i := range received {
+				for atomic.LoadInt32(&received[i]) != c.received[i] && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if n := atomic.LoadInt32(&received[i]); n != c.received[i] {
+					t.Errorf("%s: node %d received %d messages", c.name, i, n)
+				}
+			}
+		}
+	}
+	if !maintenance.Status().Active {
+		t.Error("the local agent did not apply the notice it sent")
+	}
+}
@@ -6,12 +6,15 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,12 +26,37 @@ import (
 
 // ServerConfig contains the server configuration parameters.
 type ServerConfig struct {
-	Address              string `json:"address"`
-	SessionAdvertiseTime int    `json:"session-advertise-time"` // in seconds
-	Database             string `json:"database"`
-	SnapshotTime         int    `json:"snapshot-time"` // in seconds
-	PublicKey            Key    `json:"public-key"`
-	StunPassword         string `json:"stun-password"`
+	Address              string    `json:"address"`
+	SessionAdvertiseTime int       `json:"session-advertise-time"` // in seconds
+	Database             string    `json:"database"`
+	SnapshotTime         int       `json:"snapshot-time"` // in seconds
+	PublicKey            Key       `json:"public-key"`
+	StunPassword         string    `json:"stun-password"`
+	Log                  LogConfig `json:"log"`
+	TTL                  TTL       `json:"ttl"`               // of the notifications sent over UDP
+	SessionPageSize      int       `json:"session-page-size"` // max entries per binding response
+	ReportWindow         int       `json:"report-window"`     // in seconds, of the fleet statistics
+
+	Blacklist BlacklistConfig `json:"blacklist"`
+
+	// Certificates of the peers and pinning of their keys
+	PeerIdentity PeerIdentityServerConfig `json:"peer-identity"`
+
+	// RFC 5389 interop mode answering the binding requests of standard STUN
+	// clients
+	Interop InteropConfig `json:"stun-interop"`
+
+	// Compression of the notifications and session table pages
+	Compression CompressionConfig `json:"compression"`
+
+	// Replay of the recent notifications to the new and returning peers
+	Replay ReplayConfig `json:"replay"`
+
+	// Queues of the messages addressed to the peers that are offline
+	Queue QueueConfig `json:"queue"`
+
+	// Limits of the datagrams, checked before decoding them
+	Packets PacketLimits `json:"packet-limits"`
 }
 
 // DefaultServerConfig returns default server configurations.
@@ -41,23 +69,76 @@ func DefaultServerConfig() *ServerConfig {
 		PublicKey: Key{
 			Filename: "key.pub",
 		},
-		StunPassword: defaultStunPassword,
+		StunPassword:    defaultStunPassword,
+		TTL:             defaultTTL,
+		SessionPageSize: defaultSessionPageSize,
+		ReportWindow:    fleetDefaultWindow,
+		Blacklist:       DefaultBlacklistConfig(),
+		Interop:         DefaultInteropConfig(),
+		PeerIdentity: PeerIdentityServerConfig{
+			Mode: PeerIdentityTOFU,
+		},
+		Replay: ReplayConfig{
+			MaxUpdates: replayDefaultMaxUpdates,
+			MaxAge:     replayDefaultMaxAge,
+			AbsentTime: replayDefaultAbsentTime,
+		},
+		Queue: QueueConfig{
+			MaxMessages:   queueDefaultMaxMessages,
+			MaxBytes:      queueDefaultMaxBytes,
+			TTL:           queueDefaultTTL,
+			OfflineAfter:  queueDefaultOfflineAfter,
+			MaxAttempts:   queueDefaultMaxAttempts,
+			RetryInterval: queueDefaultRetryInterval,
+		},
+		Packets: PacketLimits{
+			MaxDatagramSize:  defaultMaxDatagramSize,
+			MaxAttributeSize: defaultMaxAttributeSize,
+			MaxAttributes:    defaultMaxAttributes,
+		},
 	}
 	return cfg
 }
 
+// defaultSessionPageSize is the maximum number of session table entries in a
+// binding response, 0 for as many as fit in sessionPageMaxSize.
+const defaultSessionPageSize = 0
+
+// sessionPageMaxSize is the size of a binding response that is safe from IP
+// fragmentation on the usual paths, in line with the datagrams accepted by
+// the server. A page is filled with entries up to this size, and a single
+// entry that does not fit is sent anyway.
+const sessionPageMaxSize = 1200
+
 // Server is a STUN server implementation for multicast messaging system
 type Server struct {
 	sync.RWMutex
 	Addr  *net.UDPAddr
 	ID    PeerID
 	peers SessionTable
+	tags  SessionTags // registered by the peers on every binding
 	cfg   *ServerConfig
 
+	extIDs     map[PeerID]ExtendedPeerID // registered by the peers on every binding
+	collisions map[PeerID]*PeerCollision // of the peer IDs registered by two peers
+	seen       map[PeerID]time.Time      // of the latest binding of the peers
+
+	queues        map[PeerID][]*queuedMessage // messages waiting for the peers
+	nextMessageID MessageID
+
 	udpConn   *net.UDPConn
 	publicKey *rsa.PublicKey
+	blacklist *Blacklist
+	interop   *interopLimiter
+	// validation failures by reason and source
+	validation *ValidationStats
+	caKey      ed25519.PublicKey
+	peerKeys   map[PeerID]ed25519.PublicKey // pinned on first contact
 
 	updates      map[string]*Notification
+	reports      map[string]*UpdateReports // deployment reports by UUID
+	fleet        *FleetAggregator
+	subscribers  map[string]map[string]*subscriber // progress subscriptions by UUID and address
 	lastModified time.Time
 	lastSaved    time.Time
 }
@@ -91,12 +172,29 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 		Addr:      addr,
 		ID:        *id,
 		peers:     make(SessionTable),
+		tags:      make(SessionTags),
 		cfg:       &cfg,
 		publicKey: pub,
+		blacklist: NewBlacklist(cfg.Blacklist),
+		interop:   newInteropLimiter(cfg.Interop),
+		fleet:     NewFleetAggregator(cfg.ReportWindow),
+
+		extIDs:      make(map[PeerID]ExtendedPeerID),
+		collisions:  make(map[PeerID]*PeerCollision),
+		seen:        make(map[PeerID]time.Time),
+		queues:      make(map[PeerID][]*queuedMessage),
+		subscribers: make(map[string]map[string]*subscriber),
+		validation:  NewValidationStats("server.validation_failures"),
 	}
 	if err = s.loadUpdates(); err != nil {
 		return nil, errors.Wrap(err, "failed loading update database")
 	}
+	if err = s.loadReports(); err != nil {
+		return nil, errors.Wrap(err, "failed loading deployment reports")
+	}
+	if err = s.loadPeerIdentity(); err != nil {
+		return nil, errors.Wrap(err, "failed loading peer keys")
+	}
 
 	j, _ = json.Marshal(s.cfg)
 	log.Printf("created server with config: %s", string(j))
@@ -119,7 +217,38 @@ func (s *Server) serveTCP() {
 }
 
 func (s *Server) serveHTTPRequest(ctx *fasthttp.RequestCtx) {
+	path := string(ctx.Path())
 	switch {
+	case path == "/report" && bytes.Compare(ctx.Method(), strPOST) == 0:
+		ctx.SetStatusCode(s.serveReport(ctx.PostBody(),
+			string(ctx.Request.Header.Peek(webhookSignatureHeader)),
+			string(ctx.Request.Header.Peek(reportPeerSignatureHeader))))
+	case strings.HasPrefix(path, "/canary/") && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.serveCanaryStatus(ctx, strings.TrimPrefix(path, "/canary/"))
+	case path == "/fleet-status" && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.serveFleetStatus(ctx)
+	case path == "/peers" && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.servePeers(ctx)
+	case path == "/collisions" && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.serveCollisions(ctx)
+	case path == "/queues" && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.serveQueues(ctx)
+	case path == "/validation-failures" && bytes.Compare(ctx.Method(), strGET) == 0:
+		s.serveValidationFailures(ctx)
+	case strings.HasPrefix(path, "/peers/") && strings.HasSuffix(path, "/messages") &&
+		bytes.Compare(ctx.Method(), strPOST) == 0:
+		s.serveQueueMessage(ctx, path)
+	case strings.HasPrefix(path, "/peers/") && strings.HasSuffix(path, "/reports") &&
+		bytes.Compare(ctx.Method(), strGET) == 0:
+		doJSONWrite(ctx, 200, s.PeerReports(strings.TrimSuffix(strings.TrimPrefix(path, "/peers/"), "/reports")))
+	case path == "/metrics" && bytes.Compare(ctx.Method(), strGET) == 0:
+		doJSONWrite(ctx, 200, struct {
+			Counters map[string]int64 `json:"counters"`
+			Gauges   map[string]int64 `json:"gauges"`
+		}{
+			Counters: metrics.Counters(),
+			Gauges:   metrics.Gauges(),
+		})
 	case bytes.Compare(ctx.Method(), strGET) == 0:
 		s.serveGetRequest(ctx)
 	case bytes.Compare(ctx.Method(), strPOST) == 0:
@@ -129,6 +258,75 @@ func (s *Server) serveHTTPRequest(ctx *fasthttp.RequestCtx) {
 	}
 }
 
+// serveFleetStatus returns the fleet-wide deployment statistics, which are
+// grouped by tag if query argument 'group-by' is 'tag'.
+func (s *Server) serveFleetStatus(ctx *fasthttp.RequestCtx) {
+	groupBy := string(ctx.QueryArgs().Peek("group-by"))
+	if groupBy != "" && groupBy != "tag" {
+		ctx.SetStatusCode(400)
+		return
+	}
+	s.Lock()
+	var summary FleetSummary
+	if groupBy == "tag" {
+		summary = s.fleet.SummaryByTag(time.Now())
+	} else {
+		summary = s.fleet.Summary(time.Now())
+	}
+	s.Unlock()
+	doJSONWrite(ctx, 200, summary)
+}
+
+// servePeers returns the peers of the session table with their tags and
+// extended IDs. A peer whose ID has been registered by another peer is
+// flagged "collision".
+func (s *Server) servePeers(ctx *fasthttp.RequestCtx) {
+	s.RLock()
+	peers := make(map[string]OverlayPeer, len(s.peers))
+	for pid, sess := range s.peers {
+		p := OverlayPeer{Addresses: make([]string, 0, len(sess)), Tags: s.tags[pid]}
+		for _, addr := range sess {
+			p.Addresses = append(p.Addresses, addr.String())
+		}
+		if ext, ok := s.extIDs[pid]; ok {
+			p.ExtendedID = ext.String()
+		}
+		if _, ok := s.collisions[pid]; ok {
+			p.Flags = append(p.Flags, "collision")
+		}
+		peers[pid.String()] = p
+	}
+	s.RUnlock()
+	doJSONWrite(ctx, 200, peers)
+}
+
+// serveCollisions returns the peer IDs registered by two peers, with the
+// alias assigned to the second one.
+func (s *Server) serveCollisions(ctx *fasthttp.RequestCtx) {
+	s.RLock()
+	collisions := make([]PeerCollision, 0, len(s.collisions))
+	for _, c := range s.collisions {
+		collisions = append(collisions, *c)
+	}
+	s.RUnlock()
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i].PeerID < collisions[j].PeerID })
+	doJSONWrite(ctx, 200, collisions)
+}
+
+// serveValidationFailures returns the sources of invalid messages by
+// descending number of failures, at most query argument 'top' of them.
+func (s *Server) serveValidationFailures(ctx *fasthttp.RequestCtx) {
+	top := 0
+	if ctx.QueryArgs().Has("top") {
+		var err error
+		if top, err = ctx.QueryArgs().GetUint("top"); err != nil {
+			ctx.SetStatusCode(400)
+			return
+		}
+	}
+	doJSONWrite(ctx, 200, s.validation.Offenders(top))
+}
+
 func (s *Server) serveGetRequest(ctx *fasthttp.RequestCtx) {
 	s.RLock()
 	doJSONWrite(ctx, 200, s.updates)
@@ -146,6 +344,9 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	err = n.Verify(s.publicKey)
+	if err == nil {
+		err = n.validatePaths()
+	}
 	if err != nil {
 		ctx.SetStatusCode(400)
 		return
@@ -157,7 +358,7 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 		if old.Version > n.Version {
 			ctx.SetStatusCode(409)
 			return
-		} else if old.Version == n.Version {
+		} else if old.Version == n.Version && !n.Supersedes(old) {
 			ctx.SetStatusCode(201)
 			return
 		}
@@ -165,6 +366,8 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 	s.updates[n.UUID] = &n
 	s.lastModified = time.Now()
 	ctx.SetStatusCode(200)
+	log.Printf("accepted update uuid:%s version:%d%s%s", n.UUID, n.Version, titleSuffix(n.title()),
+		traceSuffix(n.TraceID))
 
 	go func() {
 		for i := 0; i < 5; i++ {
@@ -174,26 +377,40 @@ func (s *Server) servePostRequest(ctx *fasthttp.RequestCtx) {
 	}()
 }
 
-func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
-	// send notification via UDP
+// buildNotificationMessage builds a data indication of given notification
+// with given TTL into given message, which is marked as a replay if replay is
+// true.
+func (s *Server) buildNotificationMessage(msg *stun.Message, n *Notification, ttl TTL, replay bool) error {
 	w := new(bytes.Buffer)
 	if err := n.Write(w); err != nil {
-		log.Printf("sendUpdateNotificationOverUDP - failed generating []byte of notification uuid:%s version:%d - %v", n.UUID, n.Version, err)
-		return
+		return errors.Wrapf(err, "failed generating []byte of notification uuid:%s version:%d",
+			n.UUID, n.Version)
 	}
-	msg := stunMessagePool.Get().(*stun.Message)
 	msg.Reset()
-	defer stunMessagePool.Put(msg)
-	err := msg.Build(
+	return msg.Build(
 		stun.TransactionID,
 		stunDataIndication,
-		PeerMessage(w.Bytes()),
+		s.cfg.Compression.encode(w.Bytes()),
+		ttl,
+		ReplayFlag(replay),
 		&s.ID,
 		stun.NewShortTermIntegrity(s.cfg.StunPassword),
 		stun.Fingerprint,
 	)
+}
+
+func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
+	// send notification via UDP
+	ttl := s.cfg.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	msg := stunMessagePool.Get().(*stun.Message)
+	defer stunMessagePool.Put(msg)
+	err := s.buildNotificationMessage(msg, n, ttl, false)
 	if err != nil {
 		log.Printf("sendUpdateNotificationOverUDP - failed generating stun message: %v", err)
+		return
 	}
 
 	s.RLock()
@@ -205,7 +422,8 @@ func (s *Server) sendUpdateNotificationOverUDP(n *Notification) {
 		if err != nil {
 			log.Printf("WARNING: failed sending data request to %s[%s][%s] - %v", id, addrs[0], addrs[1], err)
 		} else {
-			log.Printf("-> sent update notification to %s[%s] ", id, addrs[0])
+			log.Printf("-> sent update notification uuid:%s version:%d to %s[%s]%s",
+				n.UUID, n.Version, id, addrs[0], traceSuffix(n.TraceID))
 		}
 	}
 }
@@ -218,8 +436,17 @@ func (s *Server) serveUDP() {
 	}
 	s.udpConn = conn
 
+	if ok, err := sdNotify("READY=1"); err != nil {
+		log.Printf("failed notifying systemd: %v", err)
+	} else if ok {
+		sdStartWatchdog(s.healthy)
+	}
+
 	ExecEvery(time.Duration(s.cfg.SessionAdvertiseTime)*time.Second, s.advertiseSessionTable)
 	ExecEvery(time.Duration(s.cfg.SnapshotTime)*time.Second, s.saveUpdates)
+	if s.cfg.Queue.MaxMessages > 0 && s.cfg.Queue.RetryInterval > 0 {
+		ExecEvery(time.Duration(s.cfg.Queue.RetryInterval)*time.Second, s.flushQueues)
+	}
 
 	log.Printf("Serving UDP (STUN) at %s with id:%s", s.Addr.String(), s.ID.String())
 
@@ -228,7 +455,7 @@ func (s *Server) serveUDP() {
 		go s.udpWorker(w, jobs)
 	}
 
-	buf := make([]byte, 2048)
+	buf := make([]byte, udpMaxDatagramSize)
 	for {
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
@@ -236,16 +463,15 @@ func (s *Server) serveUDP() {
 			continue
 		}
 
-		msg := buf[:n]
-		if !stun.IsMessage(msg) {
-			log.Printf("message sent by %s is not STUN", addr)
+		if s.blacklist.Blocked(addrSource(addr)) {
 			continue
 		}
 
 		req := stunMessagePool.Get().(*stun.Message)
-		req.Reset()
-		if _, err := req.Write(msg); err != nil {
-			log.Printf("sender %s: failed to read stun message", addr)
+		if err := s.decodePacket(buf[:n], req); err != nil {
+			log.Printf("sender %s: invalid datagram of %d bytes - %v", addr, n, err)
+			s.blacklist.Failure(addrSource(addr))
+			s.validation.Failure(addrSource(addr), err)
 			stunMessagePool.Put(req)
 			continue
 		}
@@ -270,7 +496,7 @@ type stunRequestJob struct {
 func (s *Server) udpWorker(id int, jobs <-chan stunRequestJob) {
 	for j := range jobs {
 		log.Printf("worker %d - processMessage from %s", id, j.addr)
-		if err := s.processMessage(j.conn, j.addr, j.request, j.response); err != nil {
+		if err := s.handlePacket(j.conn, j.addr, j.request, j.response); err != nil {
 			log.Printf("worker %d - ERROR: processMessage from %s: %v", id, j.addr, err)
 		}
 		stunMessagePool.Put(j.request)
@@ -279,13 +505,63 @@ func (s *Server) udpWorker(id int, jobs <-chan stunRequestJob) {
 }
 
 func (s *Server) processMessage(c net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	var pid PeerID
+	sources := []string{addrSource(addr)}
+	if err := pid.GetFrom(req); err == nil {
+		sources = append(sources, peerSource(pid))
+	}
+	if s.blacklist.Blocked(sources...) {
+		return nil
+	}
+	// the other messages, including those of the agents whose integrity is
+	// wrong, are validated strictly
+	if s.cfg.Interop.Enabled && isPlainBinding(req) {
+		return s.answerPlainBinding(c, addr, req, res)
+	}
 	if err := validateMessage(req, nil, s.cfg.StunPassword); err != nil {
+		s.blacklist.Failure(sources[0])
+		// counted by the claimed peer ID if any, e.g. a node whose password
+		// is outdated
+		s.validation.Failure(sources[len(sources)-1], err)
 		return errors.Wrap(err, "Invalid message")
 	}
-	if req.Type == stun.BindingRequest {
-		return s.registerPeer(c, addr, req, res)
+	// the binding requests are checked once the peer ID is resolved
+	if req.Type != stun.BindingRequest && len(sources) > 1 {
+		if err := s.checkPeerMessage(req, pid); err != nil {
+			// the claimed peer ID is not blacklisted, lest anyone
+			// holding the password could block a peer
+			s.blacklist.Failure(sources[0])
+			s.validation.Failure(sources[1], &ValidationError{ValidationSignature, err})
+			return err
+		}
+	}
+	var err error
+	switch req.Type {
+	case stun.BindingRequest:
+		err = s.registerPeer(c, addr, req, res)
+	case stunProgressIndication:
+		err = s.forwardProgress(c, req)
+	case stunSubscribeRequest:
+		err = s.subscribe(c, addr, req, res)
+	case stunAckIndication:
+		err = s.ackMessage(req)
+	case stunDataRequest:
+		err = s.receiveReport(c, addr, req, res)
+	case stunDataError:
+		err = s.recordRejection(req)
+	case stunDataSuccess:
+		// a delivered message is acknowledged by its ack indication
+	case stunRelayIndication:
+		err = s.relayMessage(c, pid, req)
+	default:
+		err = fmt.Errorf("message type %v is not supported", req.Type)
 	}
-	return fmt.Errorf("message type is not STUN binding")
+	if err != nil {
+		s.blacklist.Failure(sources[0])
+		return err
+	}
+	s.blacklist.Success(sources...)
+	return nil
 }
 
 func (s *Server) registerPeer(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
@@ -294,6 +570,7 @@ func (s *Server) registerPeer(conn net.PacketConn, addr net.Addr, req, res *stun
 		pid          = new(PeerID)
 		xorAddr      stun.XORMappedAddress
 		torrentPorts TorrentPorts
+		torrentIPv6  TorrentIPv6
 	)
 
 	if err := pid.GetFrom(req); err != nil {
@@ -305,11 +582,39 @@ func (s *Server) registerPeer(conn net.PacketConn, addr net.Addr, req, res *stun
 	if err := torrentPorts.GetFrom(req); err != nil {
 		return errors.Wrap(err, "failed getting torrent-ports")
 	}
+	// the IPv6 address is optional since old agents do not send it
+	torrentIPv6.GetFrom(req)
+	// the tags are optional as well, and an agent without tags sends none
+	var tags PeerTags
+	if err := tags.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrap(err, "failed getting peer tags")
+	}
+	// so is the extended ID, without which a collision cannot be detected
+	var ext ExtendedPeerID
+	if err := ext.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrap(err, "failed getting extended peer ID")
+	}
+	s.Lock()
+	id, err := s.resolvePeerID(*pid, ext)
+	if err == nil {
+		if err = s.checkPeerCert(req, *pid, id); err != nil {
+			s.validation.Failure(peerSource(*pid), &ValidationError{ValidationSignature, err})
+		}
+	}
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+	*pid = id
+	replay := s.peerSeen(*pid, time.Now())
 
-	updated, err := s.updateSessionTable(addr, *pid, &xorAddr, torrentPorts)
+	updated, err := s.updateSessionTable(addr, *pid, &xorAddr, torrentPorts, torrentIPv6)
 	if err != nil {
 		return errors.Wrap(err, "failed evaluating peer session")
 	}
+	if s.updatePeerTags(*pid, tags) {
+		updated = true
+	}
 	if err := s.sendBindingSuccess(conn, *pid, req, res); err != nil {
 		return errors.Wrap(err, "failed sending binding success response")
 	}
@@ -318,45 +623,184 @@ func (s *Server) registerPeer(conn net.PacketConn, addr net.Addr, req, res *stun
 		s.advertiseNewPeer(*pid, conn, res)
 		s.advertiseSessionTableToPeer(*pid, res)
 	}
+	// the peer is registered, hence the replay can be addressed to it
+	if replay {
+		go s.replayNotifications(*pid)
+	}
+	// and so can its queued messages, which are delivered on every binding
+	// since a peer that has come back sends one right away
+	s.peerQueued(*pid)
 
 	return nil
 }
 
 func (s *Server) sendBindingSuccess(conn net.PacketConn, pid PeerID, req, res *stun.Message) error {
+	// the requested page of the session table, old agents that do not send
+	// the offset get the first page
+	var (
+		offset    SessionOffset
+		requested PeerID
+	)
+	offset.GetFrom(req)
+	requested.GetFrom(req)
+
 	s.RLock()
 	session, ok := s.peers[pid]
+	ids := s.sessionTableIDs(pid)
+	s.RUnlock()
 	if !ok {
 		return fmt.Errorf("failed sendBindingSuccess: session of peer ID:%s does not exist", pid)
 	}
-	s.RUnlock()
 
-	res.Reset()
-	err := res.Build(
-		stun.NewTransactionIDSetter(req.TransactionID),
-		stun.BindingSuccess,
-		&stun.XORMappedAddress{
-			IP:   session[0].IP,
-			Port: session[0].Port,
-		},
-		&s.ID,
-		&SessionTable{},
-		stun.NewShortTermIntegrity(s.cfg.StunPassword),
-		stun.Fingerprint,
-	)
-	if err != nil {
-		return errors.Wrapf(err, "failed building reply message for %s", pid)
+	// the page is filled with as many entries as fit in sessionPageMaxSize,
+	// up to the configured size: it is halved until it fits, and then grown
+	// back between the largest size that fits and the smallest that does not
+	size := s.cfg.SessionPageSize
+	if remaining := len(ids) - int(offset); size <= 0 || size > remaining {
+		size = remaining
+	}
+	if size < 1 {
+		size = 1
+	}
+	built := 0
+	build := func(size int) error {
+		built = size
+		page, next := s.sessionPage(ids, int(offset), size)
+		payload, err := s.cfg.Compression.encodeSessionTable(&page)
+		if err != nil {
+			return errors.Wrapf(err, "failed encoding session table for %s", pid)
+		}
+		s.RLock()
+		tags, extIDs, keys := s.sessionTags(page), s.sessionExtIDs(page), s.sessionKeys(page)
+		s.RUnlock()
+		setters := []stun.Setter{
+			stun.NewTransactionIDSetter(req.TransactionID),
+			stun.BindingSuccess,
+			&stun.XORMappedAddress{
+				IP:   session[0].IP,
+				Port: session[0].Port,
+			},
+			&s.ID,
+			payload,
+			tags,
+			extIDs,
+			keys,
+			offset,
+			ServerTime(time.Now()),
+		}
+		if next > 0 {
+			setters = append(setters, SessionNext(next))
+		}
+		// the peer is told the ID it is registered under if it collides
+		if requested != pid {
+			setters = append(setters, AssignedPeerID(pid))
+		}
+		setters = append(setters,
+			stun.NewShortTermIntegrity(s.cfg.StunPassword),
+			stun.Fingerprint)
+
+		res.Reset()
+		if err := res.Build(setters...); err != nil {
+			return errors.Wrapf(err, "failed building reply message for %s", pid)
+		}
+		return nil
+	}
+	fit, over := 0, size+1
+	for fit+1 < over {
+		if err := build(size); err != nil {
+			return err
+		}
+		if len(res.Raw) <= sessionPageMaxSize {
+			fit = size
+		} else {
+			over = size
+		}
+		if fit == 0 {
+			size = over / 2
+		} else {
+			size = (fit + over) / 2
+		}
+	}
+	// a single entry that does not fit is sent anyway
+	if fit == 0 {
+		fit = 1
+	}
+	if built != fit {
+		if err := build(fit); err != nil {
+			return err
+		}
 	}
-	if _, err = conn.WriteTo(res.Raw, session[0]); err != nil {
+	if _, err := conn.WriteTo(res.Raw, session[0]); err != nil {
 		return errors.Wrapf(err, "ERROR: WriteTo %s", session[0])
 	}
 	return nil
 }
 
+// sessionTableIDs returns the sorted IDs of the peers in the session table
+// except given peer. The caller must hold the lock.
+func (s *Server) sessionTableIDs(except PeerID) []PeerID {
+	ids := make([]PeerID, 0, len(s.peers))
+	for pid := range s.peers {
+		if pid != except {
+			ids = append(ids, pid)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	return ids
+}
+
+// sessionPage returns the page of the session table of given IDs at given
+// offset, and the offset of the next page or 0 if it is the last page.
+func (s *Server) sessionPage(ids []PeerID, offset, size int) (SessionTable, int) {
+	page := make(SessionTable)
+	if offset >= len(ids) {
+		return page, 0
+	}
+	end, next := offset+size, offset+size
+	if end >= len(ids) {
+		end, next = len(ids), 0
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for _, pid := range ids[offset:end] {
+		if session, ok := s.peers[pid]; ok {
+			page[pid] = session
+		}
+	}
+	return page, next
+}
+
+// updatePeerTags sets the tags registered by given peer. It returns true if
+// they have changed, hence they take effect on the next binding of the peer.
+func (s *Server) updatePeerTags(pid PeerID, tags PeerTags) bool {
+	s.Lock()
+	defer s.Unlock()
+	if tags.Equal(s.tags[pid]) {
+		return false
+	}
+	setPeerTags(s.tags, pid, tags)
+	log.Printf("peer %s registered tags [%s]", pid, strings.Join(tags, ","))
+	return true
+}
+
+// sessionTags returns the tags of the peers of given session table. The
+// caller must hold the lock.
+func (s *Server) sessionTags(st SessionTable) SessionTags {
+	tags := make(SessionTags)
+	for pid := range st {
+		if t, ok := s.tags[pid]; ok {
+			tags[pid] = t
+		}
+	}
+	return tags
+}
+
 func (s *Server) updateSessionTable(
 	addr net.Addr,
 	pid PeerID,
 	xorAddr *stun.XORMappedAddress,
 	torrentPorts TorrentPorts,
+	torrentIPv6 TorrentIPv6,
 ) (bool, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -378,12 +822,21 @@ func (s *Server) updateSessionTable(
 				Port: torrentPorts[1],
 			},
 		}
+		if len(torrentIPv6) > 0 {
+			session = append(session, &net.UDPAddr{ // torrent IPv6/port
+				IP:   net.IP(torrentIPv6),
+				Port: torrentPorts[1],
+			})
+		}
 		if old, ok := s.peers[pid]; ok && old.Equal(session) {
 			return false, nil
 		}
 		s.peers[pid] = session
-		log.Printf("Registered peer %s[%s,%s,%s,%s]", pid.String(), session[0].String(),
-			session[1].String(), session[2].String(), session[3].String())
+		addrs := make([]string, len(session))
+		for i, a := range session {
+			addrs[i] = a.String()
+		}
+		log.Printf("Registered peer %s[%s]", pid.String(), strings.Join(addrs, ","))
 		return true, nil
 	}
 	return false, fmt.Errorf("unknown addr: %v", addr)
@@ -404,6 +857,9 @@ func (s *Server) advertiseNewPeer(pid PeerID, c net.PacketConn, msg *stun.Messag
 		stunBindingIndication,
 		&s.ID,
 		&SessionTable{pid: session},
+		s.sessionTags(SessionTable{pid: session}),
+		s.sessionExtIDs(SessionTable{pid: session}),
+		s.sessionKeys(SessionTable{pid: session}),
 		stun.NewShortTermIntegrity(s.cfg.StunPassword),
 		stun.Fingerprint,
 	)
@@ -455,6 +911,9 @@ func (s *Server) advertiseSessionTableToPeer(dest PeerID, msg *stun.Message) {
 			stunBindingIndication,
 			&s.ID,
 			&SessionTable{pid: sess},
+			s.sessionTags(SessionTable{pid: sess}),
+			s.sessionExtIDs(SessionTable{pid: sess}),
+			s.sessionKeys(SessionTable{pid: sess}),
 			stun.NewShortTermIntegrity(s.cfg.StunPassword),
 			stun.Fingerprint)
 		if err != nil {
@@ -468,6 +927,18 @@ func (s *Server) advertiseSessionTableToPeer(dest PeerID, msg *stun.Message) {
 	log.Printf("sent session table to %s with %d failures", dest, nerr)
 }
 
+// healthy returns true if the server's lock can be acquired, i.e. it is not
+// deadlocked.
+func (s *Server) healthy() bool {
+	return lockedWithin(5*time.Second, func() { s.RLock(); s.RUnlock() })
+}
+
+// Stop saves the update database before the server exits.
+func (s *Server) Stop() {
+	sdNotify("STOPPING=1")
+	s.saveUpdates()
+}
+
 func (s *Server) saveUpdates() {
 	s.Lock()
 	defer s.Unlock()
@@ -478,6 +949,9 @@ func (s *Server) saveUpdates() {
 	if err == nil {
 		err = json.NewEncoder(f).Encode(s.updates)
 	}
+	if err == nil {
+		err = s.saveReports()
+	}
 	if err != nil {
 		log.Printf("failed saving update database: %v", err)
 	} else {
@@ -0,0 +1,440 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+)
+
+// The policies of the registrations of an agent with several rendezvous
+// servers.
+const (
+	// ServerPolicyStandby registers the agent with the primary server, and
+	// keeps the other servers warm with keep-alives every standby interval.
+	ServerPolicyStandby = "standby"
+
+	// ServerPolicyAll registers the agent with every server at the
+	// keep-alive interval.
+	ServerPolicyAll = "all"
+)
+
+const (
+	// standbyIntervalFactor is the interval of the keep-alives of the
+	// standby servers in keep-alive intervals if it is not configured.
+	standbyIntervalFactor = 5
+
+	// serverDedupSize is the number of data messages relayed by the servers
+	// that are remembered, which are forgotten at once beyond.
+	serverDedupSize = 256
+
+	// serverDedupWindow is the time during which the copy of a data message
+	// relayed by another server is dropped.
+	serverDedupWindow = 10 * time.Minute
+)
+
+// validateServers returns an error if given standby servers or policy are
+// invalid.
+func validateServers(servers []string, policy string) error {
+	for _, s := range servers {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return errors.Wrapf(err, "invalid server address %s", s)
+		}
+	}
+	switch policy {
+	case "", ServerPolicyStandby, ServerPolicyAll:
+		return nil
+	}
+	return fmt.Errorf("invalid server policy '%s', expected %s or %s", policy, ServerPolicyStandby, ServerPolicyAll)
+}
+
+// servers returns the addresses of the rendezvous servers in order of
+// preference, which are Servers if they are set, otherwise Server.
+func (cfg *Config) servers() []string {
+	if len(cfg.Servers) > 0 {
+		return cfg.Servers
+	}
+	return []string{cfg.Server}
+}
+
+// ServerStatus is the state of a rendezvous server of the agent. A server is
+// reachable if it has answered its latest keep-alive recently.
+type ServerStatus struct {
+	Address   string    `json:"address"`
+	Primary   bool      `json:"primary"`
+	Reachable bool      `json:"reachable"`
+	LastReply time.Time `json:"last-reply"`
+}
+
+// rendezvousServer is a rendezvous server of the overlay. The session table
+// of a server other than the primary is merged into the one of the primary.
+type rendezvousServer struct {
+	name      string       // configured address
+	addr      *net.UDPAddr // nil until it is resolved
+	lastSent  time.Time    // of the latest keep-alive
+	lastReply time.Time    // of the latest message received from it
+
+	session       serverSession
+	pending       *serverSession // the pages of a refresh
+	pendingOffset int
+}
+
+// serverSession is the session table sent by a server, with the tags, the
+// extended IDs and the keys of its peers.
+type serverSession struct {
+	peers  SessionTable
+	tags   SessionTags
+	extIDs SessionExtIDs
+	keys   SessionKeys
+}
+
+func newServerSession() serverSession {
+	return serverSession{make(SessionTable), make(SessionTags), make(SessionExtIDs), make(SessionKeys)}
+}
+
+// relayedData is a data message relayed by a server.
+type relayedData struct {
+	addr *net.UDPAddr
+	time time.Time
+}
+
+// newRendezvousServers returns the rendezvous servers of given addresses,
+// the first being the primary one which must resolve.
+func newRendezvousServers(names []string) ([]*rendezvousServer, error) {
+	servers := make([]*rendezvousServer, len(names))
+	for i, name := range names {
+		srv := &rendezvousServer{name: name, session: newServerSession()}
+		addr, err := net.ResolveUDPAddr("udp", name)
+		if err != nil && i == 0 {
+			return nil, fmt.Errorf("Cannot resolve server address: %v", err)
+		} else if err != nil {
+			log.Printf("WARNING: cannot resolve standby server %s: %v", name, err)
+		}
+		srv.addr = addr
+		servers[i] = srv
+	}
+	return servers, nil
+}
+
+// serverAt returns the rendezvous server of given address, or nil. The
+// caller must hold the lock.
+func (overlay *OverlayConn) serverAt(addr *net.UDPAddr) *rendezvousServer {
+	for _, srv := range overlay.servers {
+		if sameUDPAddr(srv.addr, addr) {
+			return srv
+		}
+	}
+	return nil
+}
+
+// standbyAt returns the rendezvous server of given address if it is not the
+// primary one, or nil. The caller must hold the lock.
+func (overlay *OverlayConn) standbyAt(addr *net.UDPAddr) *rendezvousServer {
+	if srv := overlay.serverAt(addr); srv != nil && srv != overlay.servers[overlay.primary] {
+		return srv
+	}
+	return nil
+}
+
+// isServer returns true if given address is one of a rendezvous server.
+func (overlay *OverlayConn) isServer(addr *net.UDPAddr) bool {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	return sameUDPAddr(addr, overlay.rendezvousAddr) || overlay.serverAt(addr) != nil
+}
+
+// serverReplied records that the server of given address, if any, sent a
+// message.
+func (overlay *OverlayConn) serverReplied(addr *net.UDPAddr) {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if srv := overlay.serverAt(addr); srv != nil {
+		srv.lastReply = time.Now()
+	}
+}
+
+// primaryReplied records that the primary server answered a binding request.
+func (overlay *OverlayConn) primaryReplied() {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if len(overlay.servers) > 0 {
+		overlay.servers[overlay.primary].lastReply = time.Now()
+	}
+}
+
+// serverInterval returns the interval of the keep-alives of given server.
+func (overlay *OverlayConn) serverInterval(srv *rendezvousServer) time.Duration {
+	interval := overlay.Config.ChannelLifespan * time.Second
+	if overlay.Config.ServerPolicy == ServerPolicyAll || srv == overlay.servers[overlay.primary] {
+		return interval
+	} else if overlay.Config.StandbyInterval > 0 {
+		return overlay.Config.StandbyInterval * time.Second
+	}
+	return standbyIntervalFactor * interval
+}
+
+// reachable returns true if given server has answered its latest keep-alive
+// within two of its intervals. The caller must hold the lock.
+func (overlay *OverlayConn) reachable(srv *rendezvousServer, now time.Time) bool {
+	return !srv.lastReply.IsZero() && !srv.lastReply.Before(srv.lastSent) &&
+		now.Sub(srv.lastReply) <= 2*overlay.serverInterval(srv)
+}
+
+// checkServers fails over to the first reachable server if the primary has
+// not answered its previous keep-alive, or back to a preferred server that
+// is reachable again. The caller must hold the lock.
+func (overlay *OverlayConn) checkServers(now time.Time) {
+	if len(overlay.servers) <= 1 {
+		return
+	}
+	primary := overlay.servers[overlay.primary]
+	dropped := !primary.lastSent.IsZero() && primary.lastReply.Before(primary.lastSent)
+	for i, srv := range overlay.servers {
+		if i == overlay.primary {
+			if !dropped {
+				return
+			}
+			continue
+		}
+		if overlay.reachable(srv, now) {
+			overlay.switchPrimary(i, dropped)
+			return
+		}
+	}
+	log.Printf("WARNING: primary server %s is not answering and no other server is reachable", primary.name)
+}
+
+// failover switches the primary server to the first reachable server, or to
+// the next one if none is reachable and blind is true, since the binding
+// with the primary has failed. It returns false if the primary is kept.
+func (overlay *OverlayConn) failover(blind bool) bool {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if len(overlay.servers) <= 1 {
+		return false
+	}
+	now := time.Now()
+	for i, srv := range overlay.servers {
+		if i != overlay.primary && overlay.reachable(srv, now) {
+			overlay.switchPrimary(i, true)
+			return true
+		}
+	}
+	if !blind {
+		return false
+	}
+	for n := 1; n < len(overlay.servers); n++ {
+		if i := (overlay.primary + n) % len(overlay.servers); overlay.servers[i].addr != nil {
+			overlay.switchPrimary(i, true)
+			return true
+		}
+	}
+	return false
+}
+
+// switchPrimary makes the server at given index the primary one, whose
+// session table replaces the one of the previous primary on its next
+// refresh. The caller must hold the lock.
+func (overlay *OverlayConn) switchPrimary(i int, dropped bool) {
+	old, srv := overlay.servers[overlay.primary], overlay.servers[i]
+	if dropped {
+		log.Printf("WARNING: primary server %s is not answering, failing over to server %s", old.name, srv.name)
+	} else {
+		log.Printf("server %s is reachable again, failing back from server %s", srv.name, old.name)
+	}
+	overlay.primary, overlay.rendezvousAddr = i, srv.addr
+	if overlay.conn != nil {
+		overlay.conn.setRendezvousAddr(srv.addr)
+	}
+	old.session, old.pending = newServerSession(), nil
+	srv.session, srv.pending = newServerSession(), nil
+	overlay.pendingPeers, overlay.pendingOffset = nil, 0
+	overlay.Events.Add(AgentEvent{Type: EventServerFailover, From: old.name, To: srv.name})
+	metrics.Inc("overlay.server_failovers")
+}
+
+// keepAliveServers sends a binding request to the primary server, and to the
+// other servers whose keep-alive interval has elapsed. The caller must hold
+// the lock.
+func (overlay *OverlayConn) keepAliveServers(now time.Time) {
+	if overlay.conn == nil {
+		return
+	}
+	msg, err := overlay.bindingRequestMessage(overlay.conn, 0)
+	if err != nil {
+		log.Printf("failed building binding request: %v", err)
+		return
+	}
+	if len(overlay.servers) == 0 {
+		overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+		return
+	}
+	// a tick may come slightly early, hence the slack
+	slack := overlay.Config.ChannelLifespan * time.Second / 2
+	for i, srv := range overlay.servers {
+		if i != overlay.primary && now.Sub(srv.lastSent) < overlay.serverInterval(srv)-slack {
+			continue
+		}
+		if srv.addr == nil {
+			if srv.addr, err = net.ResolveUDPAddr("udp", srv.name); err != nil {
+				log.Printf("WARNING: cannot resolve standby server %s: %v", srv.name, err)
+				continue
+			}
+		}
+		if _, err = overlay.conn.conn.WriteToUDP(msg.Raw, srv.addr); err != nil {
+			log.Printf("WARNING: failed sending keep-alive to server %s: %v", srv.name, err)
+		}
+		srv.lastSent = now
+	}
+}
+
+// updateServerSession merges the session table sent by a server other than
+// the primary into the one of the overlay, without replacing the peers sent
+// by the primary. A refresh of the server replaces its own table once all its
+// pages are received, whose peers that left are removed on the next refresh
+// of the primary.
+func (overlay *OverlayConn) updateServerSession(req *stun.Message, srv *rendezvousServer) error {
+	st, err := GetSessionTableFrom(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed getting session table from server %s", srv.name)
+	}
+	var (
+		tags   SessionTags
+		extIDs SessionExtIDs
+		keys   SessionKeys
+	)
+	if err = tags.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrapf(err, "failed getting peer tags from server %s", srv.name)
+	}
+	if err = extIDs.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrapf(err, "failed getting extended peer IDs from server %s", srv.name)
+	}
+	if err = keys.GetFrom(req); err != nil && err != stun.ErrAttributeNotFound {
+		return errors.Wrapf(err, "failed getting peer keys from server %s", srv.name)
+	}
+	overlay.Lock()
+	defer overlay.Unlock()
+
+	sess := &srv.session
+	var offset SessionOffset
+	if req.Type == stun.BindingSuccess && offset.GetFrom(req) == nil {
+		if offset == 0 {
+			pending := newServerSession()
+			srv.pending = &pending
+		} else if srv.pending == nil || int(offset) != srv.pendingOffset {
+			return nil
+		}
+		sess = srv.pending
+	}
+	for id, addrs := range *st {
+		sess.peers[id] = addrs
+		setPeerTags(sess.tags, id, tags[id])
+		setPeerExtID(sess.extIDs, id, extIDs[id])
+		setPeerKey(sess.keys, id, keys[id])
+		if _, ok := overlay.peers[id]; !ok {
+			overlay.Events.Add(AgentEvent{Type: EventPeerConnected, Peer: id.String()})
+			overlay.peers[id] = addrs
+			setPeerTags(overlay.peerTags, id, tags[id])
+			setPeerExtID(overlay.peerExtIDs, id, extIDs[id])
+			setPeerKey(overlay.peerKeys, id, keys[id])
+		}
+	}
+	if sess != srv.pending {
+		return nil
+	}
+	var next SessionNext
+	if next.GetFrom(req) == nil && int(next) > int(offset) {
+		srv.pendingOffset = int(next)
+		return overlay.requestServerPage(srv.addr, SessionOffset(next))
+	}
+	srv.session, srv.pending, srv.pendingOffset = *srv.pending, nil, 0
+	return nil
+}
+
+// mergeServerSessions adds the peers of the servers other than the primary
+// to given session table of the primary. The caller must hold the lock.
+func (overlay *OverlayConn) mergeServerSessions(peers SessionTable, tags SessionTags,
+	extIDs SessionExtIDs, keys SessionKeys) {
+	for i, srv := range overlay.servers {
+		if i == overlay.primary {
+			continue
+		}
+		for id, addrs := range srv.session.peers {
+			if _, ok := peers[id]; ok {
+				continue
+			}
+			peers[id] = addrs
+			setPeerTags(tags, id, srv.session.tags[id])
+			setPeerExtID(extIDs, id, srv.session.extIDs[id])
+			setPeerKey(keys, id, srv.session.keys[id])
+		}
+	}
+}
+
+// relayedByAnotherServer returns true if given data message relayed by the
+// server of given address has been relayed by another server recently, e.g.
+// a notification queued by every server the agent is registered with.
+func (overlay *OverlayConn) relayedByAnotherServer(addr *net.UDPAddr, data []byte) bool {
+	overlay.Lock()
+	defer overlay.Unlock()
+	if len(overlay.servers) <= 1 {
+		return false
+	}
+	key, now := sha256.Sum256(data), time.Now()
+	if r, ok := overlay.serverData[key]; ok && now.Sub(r.time) < serverDedupWindow {
+		return !sameUDPAddr(r.addr, addr)
+	}
+	if overlay.serverData == nil || len(overlay.serverData) >= serverDedupSize {
+		overlay.serverData = make(map[[sha256.Size]byte]relayedData)
+	}
+	overlay.serverData[key] = relayedData{addr: addr, time: now}
+	return false
+}
+
+// ServerStatus returns the state of the rendezvous servers, in order of
+// preference.
+func (overlay *OverlayConn) ServerStatus() []ServerStatus {
+	overlay.RLock()
+	defer overlay.RUnlock()
+	now := time.Now()
+	status := make([]ServerStatus, len(overlay.servers))
+	for i, srv := range overlay.servers {
+		status[i] = ServerStatus{
+			Address:   srv.name,
+			Primary:   i == overlay.primary,
+			Reachable: overlay.reachable(srv, now),
+			LastReply: srv.lastReply,
+		}
+	}
+	return status
+}
+
+// serverStatus returns the state of the rendezvous servers of the agent, or
+// nil if it has only one.
+func (a *Agent) serverStatus() []ServerStatus {
+	if a.Overlay == nil || len(a.Config.Servers) <= 1 {
+		return nil
+	}
+	return a.Overlay.ServerStatus()
+}
+
+// server returns the address of the primary rendezvous server, which is the
+// one the agent has failed over to if any.
+func (a *Agent) server() string {
+	if a.Overlay != nil {
+		a.Overlay.RLock()
+		defer a.Overlay.RUnlock()
+		if len(a.Overlay.servers) > 0 {
+			return a.Overlay.servers[a.Overlay.primary].name
+		}
+	}
+	return a.Config.Server
+}
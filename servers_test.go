@@ -0,0 +1,212 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+// newTestServers returns an overlay whose rendezvous servers are n UDP
+// sockets on the loopback, and a function closing the sockets.
+func newTestServers(t *testing.T, n int, policy string) (*OverlayConn, func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		conns []*net.UDPConn
+		names []string
+	)
+	for i := 0; i < n; i++ {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+		names = append(names, c.LocalAddr().String())
+	}
+	servers, err := newRendezvousServers(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay := &OverlayConn{
+		Config:         &OverlayConfig{ChannelLifespan: 60, ServerPolicy: policy},
+		Events:         NewEventRing(16),
+		conn:           &overlayUDPConn{conn: conn, rendezvousAddr: servers[0].addr},
+		rendezvousAddr: servers[0].addr,
+		servers:        servers,
+		peers:          make(SessionTable),
+		peerTags:       make(SessionTags),
+		peerExtIDs:     make(SessionExtIDs),
+		peerKeys:       make(SessionKeys),
+	}
+	return overlay, func() {
+		conn.Close()
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+}
+
+func TestValidateServers(t *testing.T) {
+	if err := validateServers([]string{"10.0.0.1:3478", "server.example.org:3478"}, ServerPolicyAll); err != nil {
+		t.Error(err)
+	}
+	if err := validateServers([]string{"10.0.0.1"}, ServerPolicyStandby); err == nil {
+		t.Error("server without port is valid")
+	}
+	if err := validateServers(nil, "any"); err == nil {
+		t.Error("unknown policy is valid")
+	}
+}
+
+func TestServerKeepAlives(t *testing.T) {
+	overlay, closeServers := newTestServers(t, 3, ServerPolicyStandby)
+	defer closeServers()
+	now := time.Now()
+	overlay.keepAliveServers(now)
+	for i, srv := range overlay.servers {
+		if !srv.lastSent.Equal(now) {
+			t.Errorf("server %d is not sent the first keep-alive", i)
+		}
+	}
+	// the standby servers are sent keep-alives less often
+	next := now.Add(time.Minute)
+	overlay.keepAliveServers(next)
+	if !overlay.servers[0].lastSent.Equal(next) || !overlay.servers[1].lastSent.Equal(now) {
+		t.Errorf("unexpected keep-alives %v %v", overlay.servers[0].lastSent, overlay.servers[1].lastSent)
+	}
+	later := now.Add(standbyIntervalFactor * time.Minute)
+	overlay.keepAliveServers(later)
+	if !overlay.servers[2].lastSent.Equal(later) {
+		t.Error("standby server is not sent a keep-alive after its interval")
+	}
+
+	all, closeAll := newTestServers(t, 2, ServerPolicyAll)
+	defer closeAll()
+	all.keepAliveServers(now)
+	all.keepAliveServers(next)
+	if !all.servers[1].lastSent.Equal(next) {
+		t.Error("server is not sent a keep-alive every interval with policy all")
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	overlay, closeServers := newTestServers(t, 3, ServerPolicyStandby)
+	defer closeServers()
+	now := time.Now()
+	primary, standby := overlay.servers[0], overlay.servers[2]
+
+	// the primary answers, hence it is kept
+	overlay.keepAliveServers(now)
+	primary.lastReply, standby.lastReply = now.Add(time.Second), now.Add(time.Second)
+	overlay.checkServers(now.Add(time.Minute))
+	if overlay.primary != 0 {
+		t.Fatalf("failed over to %d while the primary answers", overlay.primary)
+	}
+
+	// the primary does not answer the next keep-alive, and the first
+	// reachable standby replaces it
+	overlay.keepAliveServers(now.Add(time.Minute))
+	overlay.checkServers(now.Add(2 * time.Minute))
+	if overlay.primary != 2 || !sameUDPAddr(overlay.rendezvousAddr, standby.addr) ||
+		!sameUDPAddr(overlay.conn.rendezvousAddr, standby.addr) {
+		t.Fatalf("primary is %d at %s", overlay.primary, overlay.rendezvousAddr)
+	}
+	page := overlay.Events.Since(0)
+	if len(page.Events) != 1 || page.Events[0].Type != EventServerFailover || page.Events[0].To != standby.name {
+		t.Errorf("unexpected events %+v", page.Events)
+	}
+	status := overlay.ServerStatus()
+	if status[0].Primary || !status[2].Primary || status[0].Reachable || !status[2].Reachable {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// the preferred server answers again, hence it is the primary again
+	primary.lastReply = now.Add(2*time.Minute + time.Second)
+	overlay.checkServers(now.Add(3 * time.Minute))
+	if overlay.primary != 0 {
+		t.Errorf("primary is %d after the preferred server answers again", overlay.primary)
+	}
+
+	// the binding fails without any reachable server, the next one is tried
+	primary.lastSent = now.Add(4 * time.Minute)
+	standby.lastReply = time.Time{}
+	if overlay.failover(false) {
+		t.Error("failed over to an unreachable server")
+	}
+	if !overlay.failover(true) || overlay.primary != 1 {
+		t.Errorf("primary is %d after a blind failover", overlay.primary)
+	}
+}
+
+func TestServerSessionMerge(t *testing.T) {
+	overlay, closeServers := newTestServers(t, 2, ServerPolicyAll)
+	defer closeServers()
+	standby := overlay.servers[1]
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 3478}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 3478}
+	c := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 3478}
+	overlay.peers[PeerID{1}] = Session{a, a}
+
+	// an advertisement of the standby does not replace the peers of the
+	// primary
+	st := SessionTable{PeerID{1}: Session{c, c}, PeerID{2}: Session{b, b}}
+	msg := stun.MustBuild(stun.TransactionID, stun.NewType(stun.MethodBinding, stun.ClassIndication), &st)
+	if err := overlay.updateServerSession(msg, standby); err != nil {
+		t.Fatal(err)
+	}
+	if len(overlay.peers) != 2 || !sameUDPAddr(overlay.peers[PeerID{1}][0], a) {
+		t.Fatalf("unexpected merged table %v", overlay.peers)
+	}
+
+	// a refresh of the standby replaces its own table once it is complete
+	first := SessionTable{PeerID{3}: Session{c, c}}
+	msg = stun.MustBuild(stun.TransactionID, stun.BindingSuccess, &first, SessionOffset(0), SessionNext(1))
+	if err := overlay.updateServerSession(msg, standby); err != nil {
+		t.Fatal(err)
+	}
+	if standby.pending == nil || standby.pendingOffset != 1 || len(standby.session.peers) != 2 {
+		t.Fatalf("unexpected refresh state %v %d", standby.pending, standby.pendingOffset)
+	}
+	last := SessionTable{PeerID{4}: Session{c, c}}
+	msg = stun.MustBuild(stun.TransactionID, stun.BindingSuccess, &last, SessionOffset(1))
+	if err := overlay.updateServerSession(msg, standby); err != nil {
+		t.Fatal(err)
+	}
+	if standby.pending != nil || len(standby.session.peers) != 2 || standby.session.peers[PeerID{4}] == nil {
+		t.Fatalf("unexpected standby table %v", standby.session.peers)
+	}
+
+	// a refresh of the primary keeps the peers of the standby
+	peers := SessionTable{PeerID{1}: Session{a, a}}
+	overlay.mergeServerSessions(peers, make(SessionTags), make(SessionExtIDs), make(SessionKeys))
+	if len(peers) != 3 || peers[PeerID{3}] == nil || peers[PeerID{2}] != nil {
+		t.Errorf("unexpected refreshed table %v", peers)
+	}
+}
+
+func TestRelayedByAnotherServer(t *testing.T) {
+	overlay, closeServers := newTestServers(t, 2, ServerPolicyAll)
+	defer closeServers()
+	first, second := overlay.servers[0].addr, overlay.servers[1].addr
+	data := []byte("notification")
+	if overlay.relayedByAnotherServer(first, data) {
+		t.Error("first copy is dropped")
+	}
+	if overlay.relayedByAnotherServer(first, data) {
+		t.Error("copy sent again by the same server is dropped")
+	}
+	if !overlay.relayedByAnotherServer(second, data) {
+		t.Error("copy relayed by another server is not dropped")
+	}
+	if overlay.relayedByAnotherServer(second, []byte("other notification")) {
+		t.Error("other message is dropped")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultSignTimeout is how long an external signer may take, e.g. waiting
+// for the user to touch the token.
+const DefaultSignTimeout = 30 * time.Second
+
+// Signer produces RSA PKCS#1 v1.5 signatures over the SHA-256 digest of a
+// message, which are verified with rsa.VerifyPKCS1v15. The message is given
+// rather than its digest since the external signers hash it themselves.
+type Signer interface {
+	SignMessage(msg []byte) ([]byte, error)
+}
+
+// KeySigner signs with a private key loaded in memory.
+type KeySigner struct {
+	Key *rsa.PrivateKey
+}
+
+// SignMessage signs given message.
+func (ks KeySigner) SignMessage(msg []byte) ([]byte, error) {
+	hashed := sha256.Sum256(msg)
+	return rsa.SignPKCS1v15(rand.Reader, ks.Key, crypto.SHA256, hashed[:])
+}
+
+// SSHAgentSigner signs with an RSA key held by ssh-agent.
+type SSHAgentSigner struct {
+	Socket      string // SSH_AUTH_SOCK
+	Fingerprint string // SHA256 or MD5 fingerprint of the key, or empty for the only RSA key
+	Timeout     time.Duration
+}
+
+// SignMessage asks ssh-agent to sign given message with the key, and
+// verifies the signature with its public key.
+func (sa SSHAgentSigner) SignMessage(msg []byte) ([]byte, error) {
+	if len(sa.Socket) == 0 {
+		return nil, fmt.Errorf("ssh-agent is not running (SSH_AUTH_SOCK is not set)")
+	}
+	conn, err := net.DialTimeout("unix", sa.Socket, sa.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to ssh-agent at %s: %v", sa.Socket, err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+
+	key, err := sa.key(client)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		sig *ssh.Signature
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		sig, err := client.SignWithFlags(key, msg, agent.SignatureFlagRsaSha256)
+		done <- result{sig, err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+	case <-time.After(sa.Timeout):
+		return nil, fmt.Errorf("ssh-agent did not sign within %v, was the signing confirmed?", sa.Timeout)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("ssh-agent refused signing with key %s: %v", ssh.FingerprintSHA256(key), r.err)
+	}
+	if r.sig.Format != ssh.KeyAlgoRSASHA256 {
+		return nil, fmt.Errorf("ssh-agent signed with %s instead of %s", r.sig.Format, ssh.KeyAlgoRSASHA256)
+	}
+
+	// the signature must be what the private key would produce, which is
+	// verified since an old ssh-agent may ignore the flags
+	pub := key.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+	hashed := sha256.Sum256(msg)
+	if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], r.sig.Blob); err != nil {
+		return nil, fmt.Errorf("invalid signature from ssh-agent: %v", err)
+	}
+	return r.sig.Blob, nil
+}
+
+// key returns the RSA key of the fingerprint, or the only RSA key if the
+// fingerprint is empty.
+func (sa SSHAgentSigner) key(client agent.ExtendedAgent) (ssh.PublicKey, error) {
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed listing the keys of ssh-agent: %v", err)
+	}
+	var found []ssh.PublicKey
+	for _, k := range keys {
+		if len(sa.Fingerprint) > 0 {
+			if sa.Fingerprint != ssh.FingerprintSHA256(k) &&
+				strings.TrimPrefix(sa.Fingerprint, "MD5:") != ssh.FingerprintLegacyMD5(k) {
+				continue
+			}
+			if k.Type() != ssh.KeyAlgoRSA {
+				return nil, fmt.Errorf("key %s is %s, but an RSA key is required", sa.Fingerprint, k.Type())
+			}
+		} else if k.Type() != ssh.KeyAlgoRSA {
+			continue
+		}
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, pub)
+	}
+	switch {
+	case len(found) == 1:
+		return found[0], nil
+	case len(sa.Fingerprint) > 0:
+		return nil, fmt.Errorf("key %s is not in ssh-agent", sa.Fingerprint)
+	case len(found) == 0:
+		return nil, fmt.Errorf("ssh-agent has no RSA key")
+	}
+	return nil, fmt.Errorf("ssh-agent has %d RSA keys, the fingerprint of the signing key is required", len(found))
+}
+
+// PKCS11Signer signs with a private key of a PKCS#11 token, e.g. a YubiKey,
+// using pkcs11-tool of OpenSC, which prompts for the PIN.
+type PKCS11Signer struct {
+	Module  string // path of the PKCS#11 module
+	Slot    string
+	ID      string // hex ID of the key
+	Timeout time.Duration
+}
+
+// ParsePKCS11Signer parses a PKCS#11 key given as module:slot:id.
+func ParsePKCS11Signer(spec string, timeout time.Duration) (*PKCS11Signer, error) {
+	// the module is a path, which may have a colon
+	i := strings.LastIndex(spec, ":")
+	j := -1
+	if i > 0 {
+		j = strings.LastIndex(spec[:i], ":")
+	}
+	if j <= 0 || j+1 == i || i+1 == len(spec) {
+		return nil, fmt.Errorf("invalid PKCS#11 key '%s', expected module:slot:id", spec)
+	}
+	return &PKCS11Signer{
+		Module:  spec[:j],
+		Slot:    spec[j+1 : i],
+		ID:      spec[i+1:],
+		Timeout: timeout,
+	}, nil
+}
+
+// SignMessage asks the token to sign given message.
+func (p PKCS11Signer) SignMessage(msg []byte) ([]byte, error) {
+	tool, err := exec.LookPath("pkcs11-tool")
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11-tool (OpenSC) is required for PKCS#11 signing: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "p2pupdate-sign")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "message"), filepath.Join(dir, "signature")
+	if err = ioutil.WriteFile(input, msg, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, tool, "--module", p.Module, "--slot", p.Slot, "--id", p.ID,
+		"--login", "--sign", "--mechanism", "SHA256-RSA-PKCS",
+		"--input-file", input, "--output-file", output)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err = cmd.Run(); ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("token did not sign within %v, was it touched?", p.Timeout)
+	} else if err != nil {
+		return nil, fmt.Errorf("pkcs11-tool failed signing with key %s of slot %s: %v", p.ID, p.Slot, err)
+	}
+	return ioutil.ReadFile(output)
+}
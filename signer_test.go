@@ -0,0 +1,136 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent/metainfo"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startSSHAgent starts a throwaway ssh-agent holding given keys, and returns
+// its socket and a function stopping it.
+func startSSHAgent(t *testing.T, keys ...interface{}) (string, func()) {
+	bin, err := exec.LookPath("ssh-agent")
+	if err != nil {
+		t.Skip("ssh-agent is not installed")
+	}
+	dir, err := ioutil.TempDir("", "p2pupdate-ssh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	cmd := exec.Command(bin, "-D", "-a", socket)
+	if err = cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("unix", socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		stop()
+		t.Fatalf("ssh-agent is not listening: %v", err)
+	}
+	defer conn.Close()
+	client := agent.NewClient(conn)
+	for _, k := range keys {
+		if err = client.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+			stop()
+			t.Fatal(err)
+		}
+	}
+	return socket, stop
+}
+
+func TestSSHAgentSigner(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	socket, stop := startSSHAgent(t, key, edKey)
+	defer stop()
+
+	sshKey, _ := ssh.NewPublicKey(&key.PublicKey)
+	edPub, _ := ssh.NewPublicKey(edKey.Public())
+	n := Notification{
+		UUID:    UUIDShell,
+		Version: 1,
+		Info:    metainfo.Info{Name: "update", PieceLength: MinPieceLength, Length: 1},
+	}
+
+	// the signature is the same as the one of the private key file, hence
+	// the agents verify it as before
+	for _, fp := range []string{"", ssh.FingerprintSHA256(sshKey), "MD5:" + ssh.FingerprintLegacyMD5(sshKey)} {
+		signer := SSHAgentSigner{Socket: socket, Fingerprint: fp, Timeout: 5 * time.Second}
+		if err = n.SignWith(signer); err != nil {
+			t.Fatalf("fingerprint %s: %v", fp, err)
+		}
+		sig := n.Signatures[signatureName].Signature
+		if err = n.Verify(&key.PublicKey); err != nil {
+			t.Errorf("fingerprint %s: verification failed: %v", fp, err)
+		}
+		if err = n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sig, n.Signatures[signatureName].Signature) {
+			t.Errorf("fingerprint %s: signature differs from the one of the private key", fp)
+		}
+	}
+
+	for name, signer := range map[string]SSHAgentSigner{
+		"agent not running": {Timeout: time.Second},
+		"agent unreachable": {Socket: socket + ".missing", Timeout: time.Second},
+		"unknown key":       {Socket: socket, Fingerprint: "SHA256:unknown", Timeout: time.Second},
+		"wrong key type":    {Socket: socket, Fingerprint: ssh.FingerprintSHA256(edPub), Timeout: time.Second},
+	} {
+		if err = n.SignWith(signer); err == nil {
+			t.Errorf("%s: signing must fail", name)
+		} else {
+			t.Logf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestParsePKCS11Signer(t *testing.T) {
+	p, err := ParsePKCS11Signer("/usr/lib/opensc-pkcs11.so:0:01", time.Second)
+	if err != nil || p.Module != "/usr/lib/opensc-pkcs11.so" || p.Slot != "0" || p.ID != "01" {
+		t.Errorf("wrong PKCS#11 key %+v: %v", p, err)
+	}
+	if p, err = ParsePKCS11Signer("C:/opensc.dll:1:02", time.Second); err != nil || p.Module != "C:/opensc.dll" {
+		t.Errorf("wrong PKCS#11 key %+v: %v", p, err)
+	}
+	for _, spec := range []string{"", "module", "module:0", ":0:01", "module::01", "module:0:"} {
+		if _, err = ParsePKCS11Signer(spec, time.Second); err == nil {
+			t.Errorf("invalid PKCS#11 key '%s' is accepted", spec)
+		}
+	}
+}
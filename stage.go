@@ -0,0 +1,70 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// stagedReason is the reason of the staged updates waiting for a deploy
+// command.
+const stagedReason = "staged, waiting for a deploy command"
+
+var (
+	errUpdateNotStaged   = errors.New("update is not staged")
+	errUpdateNotComplete = errors.New("update is not downloaded yet")
+)
+
+// stage marks the new update as staged if the agent only stages the updates,
+// hence it is downloaded and seeded but it is not deployed until a deploy
+// command. The caller must hold the lock.
+func (u *Update) stage(a *Agent) {
+	if a.Config.StageOnly && !a.Config.Proxy {
+		u.Staged = true
+	}
+}
+
+// staged returns true if the update must not be deployed until a deploy
+// command. The staged updates are released once the agent does not only
+// stage the updates anymore. The caller must hold the lock.
+func (u *Update) staged() bool {
+	return u.Staged && u.agent.Config.StageOnly
+}
+
+// deployStagedUpdate releases the deployment of the staged update of given
+// key (see updateKey), whose signature is verified again and whose payload
+// must be complete, however long ago it was downloaded. The payload is
+// verified again before it is deployed. Version 0 means the current version.
+func (a *Agent) deployStagedUpdate(uuid string, version uint64, by string) error {
+	u := a.getUpdate(uuid)
+	if u == nil {
+		return errUpdateNotFound
+	}
+	u.Lock()
+	defer u.Unlock()
+	if version != 0 && version != u.Notification.Version {
+		return fmt.Errorf("version %d of uuid:%s is not available, the current version is %d",
+			version, uuid, u.Notification.Version)
+	}
+	if !u.Staged {
+		return errUpdateNotStaged
+	}
+	if u.torrent == nil || u.torrent.Info() == nil || u.torrent.BytesMissing() > 0 {
+		return errUpdateNotComplete
+	}
+	if err := u.Verify(a); err != nil {
+		return err
+	}
+	u.Staged = false
+	if err := u.save(); err != nil {
+		return err
+	}
+	u.logf("deploy of staged update uuid:%s version:%d is triggered by %s",
+		u.Notification.UUID, u.Notification.Version, by)
+	a.audit(AuditDeployTriggered, &u.Notification, by, "")
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestStageOnly(t *testing.T) {
+	a := &Agent{Config: &Config{StageOnly: true}, updates: make(map[string]*Update)}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 2}, a)
+	u.stage(a)
+	if !u.staged() {
+		t.Fatal("update of a stage-only agent is not staged")
+	}
+	a.updates[u.key()] = u
+	for _, test := range []struct {
+		uuid    string
+		version uint64
+		err     error
+	}{
+		{"unknown", 0, errUpdateNotFound},
+		{UUIDShell, 0, errUpdateNotComplete},
+		{UUIDShell, 2, errUpdateNotComplete},
+	} {
+		if err := a.deployStagedUpdate(test.uuid, test.version, approvalLocal); err != test.err {
+			t.Errorf("deploy of uuid:%s version:%d: expected %v, got %v", test.uuid, test.version, test.err, err)
+		}
+	}
+	if err := a.deployStagedUpdate(UUIDShell, 1, approvalLocal); err == nil {
+		t.Error("deploy of another version is triggered")
+	}
+	if !u.Staged {
+		t.Error("incomplete update is released")
+	}
+
+	// the staged updates are released once the agent deploys again
+	a.Config.StageOnly = false
+	if u.staged() {
+		t.Error("update is staged by an agent that deploys")
+	}
+	u.Staged = false
+	if err := a.deployStagedUpdate(UUIDShell, 0, approvalLocal); err != errUpdateNotStaged {
+		t.Errorf("deploy of an update that is not staged: %v", err)
+	}
+
+	// the proxies never deploy, hence they stage nothing
+	a.Config.StageOnly, a.Config.Proxy = true, true
+	v := NewUpdate(Notification{UUID: UUIDShell, Version: 3}, a)
+	if v.stage(a); v.Staged {
+		t.Error("update of a proxy is staged")
+	}
+}
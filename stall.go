@@ -0,0 +1,170 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The defaults of the stall detection.
+const (
+	stallDefaultWindow   = 600 // in seconds
+	stallDefaultDeadline = 0   // never
+)
+
+// The recovery steps of a stalled download, in the order of the escalation,
+// and the failure of the download once the deadline has passed.
+const (
+	stallStepReannounce = "reannounce" // announce to the trackers and the DHT
+	stallStepPeers      = "peers"      // add the overlay peers and the known swarm
+	stallStepReset      = "reset"      // drop the connections to the peers
+	stallStepFallback   = "fallback"   // download over HTTPS
+	stallStepFail       = "fail"
+)
+
+// StallConfig holds configurations of the detection of the stalled
+// downloads, which are recovered by escalating through the recovery steps
+// while no byte is downloaded.
+type StallConfig struct {
+	// Window is how long an update may be without progress before the next
+	// recovery step, which is disabled if 0.
+	Window int `json:"window"` // in seconds
+
+	// Fallback is true if the download over HTTPS of an update with
+	// fallback URLs is the last recovery step.
+	Fallback bool `json:"fallback"`
+
+	// Deadline is how long an update may be without progress before its
+	// download fails, which never happens if 0.
+	Deadline int `json:"deadline"` // in seconds
+}
+
+// stallState is the state of the stall detection of an update.
+type stallState struct {
+	progress  time.Time // when the completed bytes last changed
+	completed int64
+	step      int       // number of recovery steps since progress
+	escalated time.Time // of the latest recovery step
+}
+
+// duration returns for how long the update has been stalled at given time,
+// or 0 if it has not been escalated.
+func (s *stallState) duration(now time.Time) time.Duration {
+	if s.step == 0 {
+		return 0
+	}
+	return now.Sub(s.progress)
+}
+
+// check records given completed bytes at given time, and returns the next
+// recovery step of the download, or an empty string if there is none yet.
+// The steps are repeated once they are exhausted, the fallback being
+// excluded if it is not possible.
+func (s *stallState) check(cfg StallConfig, completed int64, now time.Time, fallback bool) string {
+	if s.progress.IsZero() || completed != s.completed {
+		*s = stallState{progress: now, completed: completed}
+		return ""
+	}
+	window := time.Duration(cfg.Window) * time.Second
+	if window <= 0 {
+		return ""
+	}
+	stalled := now.Sub(s.progress)
+	if cfg.Deadline > 0 && stalled >= time.Duration(cfg.Deadline)*time.Second {
+		return stallStepFail
+	}
+	if stalled < window || now.Sub(s.escalated) < window {
+		return ""
+	}
+	steps := []string{stallStepReannounce, stallStepPeers, stallStepReset, stallStepFallback}
+	step := steps[s.step%len(steps)]
+	if step == stallStepFallback && !(cfg.Fallback && fallback) {
+		s.step++
+		step = steps[0]
+	}
+	s.step++
+	s.escalated = now
+	return step
+}
+
+// stallReason returns the reason of the status of an update stalled for
+// given duration.
+func stallReason(d time.Duration) string {
+	return fmt.Sprintf("stalled (%dm)", int(d.Minutes()))
+}
+
+// checkStall escalates the recovery of the download of the update if it has
+// made no progress for the stall window of the configurations, and fails the
+// download once the deadline has passed. The caller must hold the lock.
+func (u *Update) checkStall(a *Agent) {
+	now := time.Now()
+	stalled := u.stall.duration(now)
+	fallback := !a.Config.Fallback.Disabled && len(u.Notification.FallbackURLs) > 0 && !u.fallback.running
+	step := u.stall.check(a.Config.Stall, u.torrent.BytesCompleted(), now, fallback)
+	if stalled > 0 && u.stall.step == 0 {
+		u.logf("update uuid:%s version:%d recovered after being stalled for %s",
+			u.Notification.UUID, u.Notification.Version, stalled.Round(time.Second))
+		metrics.Inc("update.stall_recoveries", "namespace", u.ns.label())
+		return
+	}
+	if step == "" {
+		return
+	}
+	stalled = now.Sub(u.stall.progress)
+	if step == stallStepFail {
+		u.failDownload(a, stalled)
+		return
+	}
+	u.logf("update uuid:%s version:%d stalled for %s, recovery step %d: %s",
+		u.Notification.UUID, u.Notification.Version, stalled.Round(time.Second), u.stall.step, step)
+	metrics.Inc("update.stall_escalations", "step", step, "namespace", u.ns.label())
+	switch step {
+	case stallStepReannounce:
+		go u.reannounce(a)
+	case stallStepPeers:
+		u.torrent.AddPeers(a.overlayTorrentPeers())
+		u.torrent.AddPeers(u.torrent.KnownSwarm())
+	case stallStepReset:
+		// dropping all connections clears the choking state of the peers,
+		// which are then connected again; the banned IPs of the torrent
+		// client cannot be cleared, they are only logged
+		if bad := a.torrentClient.BadPeerIPs(); len(bad) > 0 {
+			u.logf("update uuid:%s has %d banned peer IPs", u.Notification.UUID, len(bad))
+		}
+		swarm := u.torrent.KnownSwarm()
+		u.torrent.SetMaxEstablishedConns(u.torrent.SetMaxEstablishedConns(0))
+		u.torrent.AddPeers(swarm)
+	case stallStepFallback:
+		u.startFallback(a)
+	}
+}
+
+// failDownload marks the download of the update stalled for given duration as
+// failed, and reports the failure. The torrent is not dropped, hence the
+// update is downloaded anyway if a peer is back. The caller must hold the
+// lock.
+func (u *Update) failDownload(a *Agent, stalled time.Duration) {
+	err := errors.Errorf("download stalled for %s", stalled.Round(time.Second))
+	u.logf("ERROR: giving up download of update uuid:%s version:%d - %v",
+		u.Notification.UUID, u.Notification.Version, err)
+	metrics.Inc("update.stall_failures", "namespace", u.ns.label())
+	u.setState(UpdateFailedDownload)
+	u.Reason = err.Error()
+	u.dirty = true
+	a.notifyWebhooks(u, EventDownloadFailure, err)
+	u.PendingReport = &DeployReport{
+		PeerID:    a.ID.String(),
+		UUID:      u.Notification.UUID,
+		Version:   u.Notification.Version,
+		Error:     err.Error(),
+		TraceID:   u.Notification.TraceID,
+		Title:     u.Notification.title(),
+		Timestamp: time.Now(),
+	}
+	u.reportRetry = time.Time{}
+}
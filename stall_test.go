@@ -0,0 +1,68 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallCheck(t *testing.T) {
+	cfg := StallConfig{Window: 60, Fallback: true, Deadline: 600}
+	var s stallState
+	now := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, completed int64, fallback bool) string {
+		return s.check(cfg, completed, now.Add(d), fallback)
+	}
+
+	if step := at(0, 100, true); step != "" {
+		t.Fatalf("unexpected step %s of the first check", step)
+	}
+	// the steps are one window apart, the fallback being skipped if it is
+	// not possible, then repeated
+	for _, expected := range []struct {
+		d        time.Duration
+		fallback bool
+		step     string
+	}{
+		{30 * time.Second, true, ""},
+		{time.Minute, true, stallStepReannounce},
+		{90 * time.Second, true, ""},
+		{2 * time.Minute, true, stallStepPeers},
+		{3 * time.Minute, true, stallStepReset},
+		{4 * time.Minute, true, stallStepFallback},
+		{5 * time.Minute, false, stallStepReannounce},
+		{6 * time.Minute, false, stallStepPeers},
+		{7 * time.Minute, false, stallStepReset},
+		{8 * time.Minute, false, stallStepReannounce},
+	} {
+		if step := at(expected.d, 100, expected.fallback); step != expected.step {
+			t.Errorf("%v: expected step '%s', got '%s'", expected.d, expected.step, step)
+		}
+	}
+	if d := s.duration(now.Add(8 * time.Minute)); d != 8*time.Minute {
+		t.Errorf("unexpected stall duration %v", d)
+	}
+	if r := stallReason(s.duration(now.Add(8*time.Minute + 30*time.Second))); r != "stalled (8m)" {
+		t.Errorf("unexpected reason %s", r)
+	}
+	if step := at(10*time.Minute, 100, true); step != stallStepFail {
+		t.Errorf("expected failure after the deadline, got '%s'", step)
+	}
+
+	// progress resets the escalation
+	if step := at(11*time.Minute, 200, true); step != "" || s.step != 0 || s.duration(now) != 0 {
+		t.Errorf("unexpected step '%s' after progress", step)
+	}
+	if step := at(12*time.Minute, 200, true); step != stallStepReannounce {
+		t.Errorf("expected re-announce after progress, got '%s'", step)
+	}
+
+	// the detection can be disabled
+	cfg.Window = 0
+	if step := at(time.Hour, 200, true); step != "" {
+		t.Errorf("unexpected step '%s' when disabled", step)
+	}
+}
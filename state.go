@@ -0,0 +1,307 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of the files of an exported state.
+const (
+	StateUpdate      = "update"
+	StateTombstones  = "tombstones"
+	StateMaintenance = "maintenance"
+	StateAudit       = "audit"
+)
+
+const stateManifestName = "manifest.json"
+
+var errStateNotEmpty = errors.New("metadata store is not empty, the state is only imported on first start")
+
+// StateManifest describes an archive of the agent state, i.e. the update
+// metadata, the tombstones, the maintenance mode and the audit log. The
+// payloads are not exported, the agent downloads them again.
+type StateManifest struct {
+	SchemaVersion   int         `json:"schema-version"`
+	SoftwareVersion string      `json:"software-version"`
+	Created         time.Time   `json:"created"`
+	Files           []StateFile `json:"files"`
+}
+
+// StateFile is a file of an exported state, whose name is relative to the
+// data directory.
+type StateFile struct {
+	Name          string `json:"name"`
+	Kind          string `json:"kind"`
+	SchemaVersion int    `json:"schema-version,omitempty"` // of the update metadata
+	SHA256        string `json:"sha256"`
+}
+
+// stateFiles are the state files of the data directory besides the update
+// metadata.
+var stateFiles = []struct {
+	name, kind string
+}{
+	{"tombstones.json", StateTombstones},
+	{"maintenance.json", StateMaintenance},
+	{"audit.log", StateAudit},
+}
+
+// ExportState writes the state of the agent of given configurations as a
+// gzipped tar archive whose first file is the manifest. An update metadata
+// file that cannot be decoded, e.g. being written, is skipped.
+func ExportState(cfg Config, w io.Writer) (*StateManifest, error) {
+	manifest := &StateManifest{
+		SchemaVersion:   SchemaVersion,
+		SoftwareVersion: softwareVersion,
+		Created:         time.Now(),
+	}
+	contents := make(map[string][]byte)
+	add := func(name, kind string, schema int, b []byte) {
+		sum := sha256.Sum256(b)
+		manifest.Files = append(manifest.Files, StateFile{
+			Name:          name,
+			Kind:          kind,
+			SchemaVersion: schema,
+			SHA256:        hex.EncodeToString(sum[:]),
+		})
+		contents[name] = b
+	}
+
+	store, err := viewMetadataStore(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	keys, err := store.List(MetadataUpdates)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading update metadata")
+	}
+	for _, key := range keys {
+		name := path.Join("notification", key)
+		b, err := store.Get(MetadataUpdates, key)
+		if err != nil {
+			return nil, err
+		}
+		var u Update
+		if err = json.Unmarshal(b, &u); err != nil {
+			log.Printf("WARNING: skipped invalid update metadata file %s - %v", name, err)
+			continue
+		}
+		add(name, StateUpdate, u.SchemaVersion, b)
+	}
+	// the tombstones are exported as the file of the file layout
+	if tombstones, err := store.List(MetadataTombstones); err != nil {
+		return nil, err
+	} else if len(tombstones) > 0 {
+		values := make(map[string]json.RawMessage)
+		for _, key := range tombstones {
+			if values[key], err = store.Get(MetadataTombstones, key); err != nil {
+				return nil, err
+			}
+		}
+		b, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		add("tombstones.json", StateTombstones, 0, b)
+	}
+	for _, f := range stateFiles {
+		if f.kind == StateTombstones {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(cfg.DataDir, f.name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		add(f.name, f.kind, 0, b)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = writeTarFile(tw, stateManifestName, b, manifest.Created); err != nil {
+		return nil, err
+	}
+	for _, f := range manifest.Files {
+		if err = writeTarFile(tw, f.Name, contents[f.Name], manifest.Created); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, gz.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0640,
+		Size:    int64(len(b)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// ImportState restores an exported state into the data directory and the
+// metadata store of given configurations, which must not have update
+// metadata. Each file is
+// validated, and the update metadata are verified with the public key. The
+// files of a newer schema are skipped with a warning. It returns the names
+// of the imported and of the skipped files.
+func ImportState(cfg Config, r io.Reader) (imported []string, skipped []string, err error) {
+	dirs := cfg.metadataDirs()
+	if err = os.MkdirAll(dirs[MetadataUpdates], 0750); err != nil {
+		return nil, nil, err
+	}
+	store, err := openMetadataStore(&cfg, dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer store.Close()
+	if keys, err := store.List(MetadataUpdates); err != nil {
+		return nil, nil, err
+	} else if len(keys) > 0 {
+		return nil, nil, errStateNotEmpty
+	}
+	pub, err := LoadPublicKey(cfg.PublicKey.Filename)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed loading public key")
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid state archive")
+	}
+	contents := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, errors.Wrap(err, "invalid state archive")
+		}
+		if contents[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, nil, errors.Wrap(err, "invalid state archive")
+		}
+	}
+	var manifest StateManifest
+	if err = json.Unmarshal(contents[stateManifestName], &manifest); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid manifest of state archive")
+	}
+
+	for _, f := range manifest.Files {
+		b, ok := contents[f.Name]
+		sum := sha256.Sum256(b)
+		if !ok || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, nil, fmt.Errorf("file %s of state archive is missing or corrupted", f.Name)
+		}
+		name, err := validateStateFile(f, b, pub)
+		if err != nil {
+			log.Printf("WARNING: skipped file %s of state archive - %v", f.Name, err)
+			skipped = append(skipped, f.Name)
+			continue
+		}
+		if err = writeStateFile(cfg, store, f.Kind, name, b); err != nil {
+			return imported, skipped, err
+		}
+		imported = append(imported, name)
+	}
+	return imported, skipped, nil
+}
+
+// writeStateFile writes given validated file of an exported state, into the
+// metadata store if it is update metadata or tombstones.
+func writeStateFile(cfg Config, store MetadataStore, kind, name string, b []byte) error {
+	switch kind {
+	case StateUpdate:
+		return store.Put(MetadataUpdates, path.Base(name), b)
+	case StateTombstones:
+		var tombstones map[string]uint64
+		if err := json.Unmarshal(b, &tombstones); err != nil {
+			return err
+		}
+		ops := make([]MetadataOp, 0, len(tombstones))
+		for uuid, version := range tombstones {
+			ops = append(ops, MetadataOp{Bucket: MetadataTombstones, Key: uuid,
+				Value: []byte(strconv.FormatUint(version, 10))})
+		}
+		return store.Batch(ops)
+	}
+	return ioutil.WriteFile(filepath.Join(cfg.DataDir, filepath.FromSlash(name)), b, 0640)
+}
+
+// validateStateFile validates given file of an exported state, and returns
+// the name of the file to write in the data directory.
+func validateStateFile(f StateFile, b []byte, pub *rsa.PublicKey) (string, error) {
+	expected := f.Kind == StateUpdate
+	for _, sf := range stateFiles {
+		expected = expected || sf.name == f.Name && sf.kind == f.Kind
+	}
+	if !expected {
+		return "", fmt.Errorf("unexpected %s file", f.Kind)
+	}
+	switch f.Kind {
+	case StateUpdate:
+		var u Update
+		if err := json.Unmarshal(b, &u); err != nil {
+			return "", err
+		}
+		if err := checkSchema(u.SchemaVersion); err != nil {
+			return "", err
+		}
+		if err := u.Notification.Verify(pub); err != nil {
+			return "", errUpdateVerificationFailed
+		}
+		// the name is derived from the verified content rather than the
+		// archive, hence it cannot escape the metadata directory
+		return path.Join("notification", fmt.Sprintf("%s-v%d", u.Notification.UUID, u.Notification.Version)), nil
+	case StateTombstones:
+		var tombstones map[string]uint64
+		return f.Name, json.Unmarshal(b, &tombstones)
+	case StateMaintenance:
+		var status MaintenanceStatus
+		return f.Name, json.Unmarshal(b, &status)
+	case StateAudit:
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				return "", err
+			}
+		}
+		return f.Name, s.Err()
+	}
+	return "", fmt.Errorf("unknown kind %s", f.Kind)
+}
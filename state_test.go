@@ -0,0 +1,146 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// stateAgent returns an agent of given data directory with the state loaded
+// as on start, without its network.
+func stateAgent(t *testing.T, dataDir string) *Agent {
+	a := &Agent{
+		Config:      &Config{DataDir: dataDir},
+		updates:     make(map[string]*Update),
+		dataDir:     filepath.Join(dataDir, "update"),
+		metadataDir: filepath.Join(dataDir, "notification"),
+	}
+	if err := os.MkdirAll(a.metadataDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.loadTombstones(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if a.maintenance, err = NewMaintenance(false, a.maintenanceFilename()); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(a.metadataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		u, err := LoadUpdateFromFile(filepath.Join(a.metadataDir, f.Name()), a)
+		if err != nil {
+			continue
+		}
+		if _, err = a.addUpdate(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a
+}
+
+func TestExportImportState(t *testing.T) {
+	const uuid = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	priv, pub := writeKeys(t, dir, "key")
+	key, err := LoadPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := func(uuid string, version uint64) Notification {
+		n := Notification{
+			UUID:    uuid,
+			Version: version,
+			Info:    metainfo.Info{Name: uuid, PieceLength: MinPieceLength, Length: 1},
+		}
+		if err := n.Sign(key); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	src := stateAgent(t, filepath.Join(dir, "src"))
+	u := NewUpdate(notification(UUIDShell, 2), src)
+	u.State = UpdateDeployed
+	if _, err = src.addUpdate(u); err != nil {
+		t.Fatal(err)
+	}
+	if err = u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// the metadata of a newer schema is skipped by the import
+	newer := NewUpdate(notification(uuid, 1), src)
+	newer.SchemaVersion = SchemaVersion + 1
+	if err = newer.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err = src.addTombstone(UUIDApk, 3); err != nil {
+		t.Fatal(err)
+	}
+	src.audit(AuditRejected, &Notification{UUID: UUIDApk, Version: 3}, "operator", "")
+	if err = src.maintenance.SetLocal(true, "operator"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := ExportState(*src.Config, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 5 || manifest.SchemaVersion != SchemaVersion {
+		t.Errorf("wrong manifest %+v", manifest)
+	}
+
+	cfg := DefaultConfig()
+	cfg.DataDir = filepath.Join(dir, "dst")
+	cfg.PublicKey.Filename = pub
+	imported, skipped, err := ImportState(cfg, bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 4 || len(skipped) != 1 {
+		t.Errorf("imported %v, skipped %v", imported, skipped)
+	}
+	if _, _, err = ImportState(cfg, bytes.NewReader(archive.Bytes())); err != errStateNotEmpty {
+		t.Errorf("import into a used agent: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(cfg.DataDir, "update")); !os.IsNotExist(err) {
+		t.Error("payloads must not be imported")
+	}
+
+	// the imported agent makes the same decisions as the original one
+	dst := stateAgent(t, cfg.DataDir)
+	if !dst.maintenance.Status().Active {
+		t.Error("maintenance mode is not imported")
+	}
+	if entries, err := dst.auditEntries(); err != nil || len(entries) != 1 {
+		t.Errorf("wrong audit entries %v: %v", entries, err)
+	}
+	for _, n := range []Notification{
+		notification(UUIDShell, 1),
+		notification(UUIDShell, 2),
+		notification(UUIDShell, 3),
+		notification(UUIDApk, 3),
+		notification(UUIDApk, 4),
+		notification(uuid, 1),
+	} {
+		_, expected := src.addUpdate(NewUpdate(n, src))
+		if _, err = dst.addUpdate(NewUpdate(n, dst)); err != expected {
+			t.Errorf("uuid:%s version:%d: imported agent decided %v instead of %v", n.UUID, n.Version, err, expected)
+		}
+	}
+}
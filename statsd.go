@@ -0,0 +1,156 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	statsdMaxPacketSize   = 1432 // fits in an ethernet frame
+	statsdDefaultPrefix   = "p2pupdate"
+	statsdWriteTimeout    = 100 * time.Millisecond
+	statsdDefaultInterval = 10 // in seconds
+)
+
+// StatsDConfig holds configurations of StatsD metric emission.
+type StatsDConfig struct {
+	// Address of the StatsD server, e.g. 10.0.0.1:8125. Emission is disabled
+	// when it is empty.
+	Address string `json:"address"`
+	Prefix  string `json:"prefix"`
+
+	// DogStatsD=true means labels are sent as tags, otherwise their values
+	// are appended to metric names.
+	DogStatsD bool `json:"dogstatsd"`
+
+	Interval int `json:"interval"` // in seconds
+}
+
+// StatsD periodically pushes the metrics of a registry to a StatsD server.
+// Counters are sent as deltas since the previous emission, and gauges as
+// their current values.
+type StatsD struct {
+	cfg      StatsDConfig
+	registry *Metrics
+	conn     net.Conn
+	last     map[string]int64
+	quit     chan struct{}
+}
+
+// NewStatsD creates a StatsD emitter of given registry, and starts emitting
+// its metrics every interval.
+func NewStatsD(cfg StatsDConfig, registry *Metrics) (*StatsD, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = statsdDefaultPrefix
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = statsdDefaultInterval
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	s := &StatsD{
+		cfg:      cfg,
+		registry: registry,
+		conn:     conn,
+		last:     make(map[string]int64),
+	}
+	s.quit = ExecEvery(time.Duration(cfg.Interval)*time.Second, s.emit)
+	log.Printf("statsd - emitting metrics to %s every %ds", cfg.Address, cfg.Interval)
+	return s, nil
+}
+
+// Stop stops the emission.
+func (s *StatsD) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.quit)
+	s.conn.Close()
+}
+
+func (s *StatsD) emit() {
+	var lines []string
+	for key, value := range s.registry.Counters() {
+		if delta := value - s.last[key]; delta != 0 {
+			lines = append(lines, s.line(key, delta, "c"))
+		}
+		s.last[key] = value
+	}
+	for key, value := range s.registry.Gauges() {
+		lines = append(lines, s.line(key, value, "g"))
+	}
+	sort.Strings(lines)
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > statsdMaxPacketSize {
+			s.send(packet.Bytes())
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		s.send(packet.Bytes())
+	}
+}
+
+// send writes a packet without waiting for the server. A lost packet is not
+// resent.
+func (s *StatsD) send(packet []byte) {
+	s.conn.SetWriteDeadline(time.Now().Add(statsdWriteTimeout))
+	if _, err := s.conn.Write(packet); err != nil {
+		metrics.Inc("statsd.errors")
+	}
+}
+
+// line returns a StatsD line of given registry key, which has format
+// `name{key1=value1,key2=value2}`.
+func (s *StatsD) line(key string, value int64, kind string) string {
+	name, labels := key, []string(nil)
+	if i := strings.IndexByte(key, '{'); i >= 0 && strings.HasSuffix(key, "}") {
+		name = key[:i]
+		labels = strings.Split(key[i+1:len(key)-1], ",")
+	}
+	name = s.cfg.Prefix + "." + name
+	if !s.cfg.DogStatsD {
+		for _, l := range labels {
+			if j := strings.IndexByte(l, '='); j >= 0 {
+				name += "." + l[j+1:]
+			}
+		}
+		return fmt.Sprintf("%s:%d|%s", statsdSanitize(name), value, kind)
+	}
+	tags := make([]string, 0, len(labels))
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		for i := range kv {
+			kv[i] = statsdSanitize(kv[i])
+		}
+		tags = append(tags, strings.Join(kv, ":"))
+	}
+	if len(tags) == 0 {
+		return fmt.Sprintf("%s:%d|%s", statsdSanitize(name), value, kind)
+	}
+	return fmt.Sprintf("%s:%d|%s|#%s", statsdSanitize(name), value, kind, strings.Join(tags, ","))
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_",
+	",", "_", "\n", "_", " ", "_")
+
+func statsdSanitize(s string) string {
+	return statsdReplacer.Replace(s)
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsDEmit(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for _, tc := range []struct {
+		dogstatsd bool
+		expected  []string
+	}{
+		{false, []string{
+			"test.overlay.messages.sent:2|c",
+			"test.update.progress.abc:42|g",
+		}},
+		{true, []string{
+			"test.overlay.messages:2|c|#type:sent",
+			"test.update.progress:42|g|#uuid:abc",
+		}},
+	} {
+		registry := NewMetrics()
+		s, err := NewStatsD(StatsDConfig{
+			Address:   server.LocalAddr().String(),
+			Prefix:    "test",
+			DogStatsD: tc.dogstatsd,
+			Interval:  3600,
+		}, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		registry.Add("overlay.messages", 2, "type", "sent")
+		registry.Set("update.progress", 42, "uuid", "abc")
+		s.emit()
+
+		buf := make([]byte, statsdMaxPacketSize)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(lines)
+		if strings.Join(lines, "\n") != strings.Join(tc.expected, "\n") {
+			t.Errorf("dogstatsd:%v expected %q, got %q", tc.dogstatsd, tc.expected, lines)
+		}
+
+		// unchanged counters are not emitted again
+		s.emit()
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _, err = server.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(buf[:n]), "|c") {
+			t.Errorf("unchanged counter was emitted: %q", buf[:n])
+		}
+		s.Stop()
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// progressBucket is the granularity in percent of the completed bytes of a
+// status fingerprint.
+const progressBucket = 10
+
+// statusFingerprint is the compact status of an update whose change is
+// logged.
+type statusFingerprint struct {
+	State       UpdateState
+	Reason      string
+	Progress    int64 // completed percent, rounded down to progressBucket
+	Seeding     bool
+	TotalPeers  int
+	ActivePeers int
+}
+
+// statusLog decides when the status of an update is logged: when its
+// fingerprint changes, and every heartbeat otherwise so that the update is
+// known to be alive.
+type statusLog struct {
+	last      statusFingerprint
+	logged    time.Time
+	heartbeat time.Duration
+}
+
+// shouldLog returns true if the status of given fingerprint must be logged
+// at given time, which is then recorded as logged.
+func (l *statusLog) shouldLog(fp statusFingerprint, now time.Time) bool {
+	if !l.logged.IsZero() && fp == l.last && now.Sub(l.logged) < l.heartbeat {
+		return false
+	}
+	l.last = fp
+	l.logged = now
+	return true
+}
+
+// fingerprint returns the status fingerprint of the update. The caller must
+// hold the lock.
+func (u *Update) fingerprint() statusFingerprint {
+	fp := statusFingerprint{State: u.State, Reason: u.Reason}
+	if u.torrent != nil {
+		completed, missing := u.torrent.BytesCompleted(), u.torrent.BytesMissing()
+		if total := completed + missing; total > 0 {
+			fp.Progress = completed * 100 / total / progressBucket * progressBucket
+		}
+		fp.Seeding = u.torrent.Seeding()
+		stats := u.torrent.Stats()
+		fp.TotalPeers, fp.ActivePeers = stats.TotalPeers, stats.ActivePeers
+	}
+	return fp
+}
+
+// logStatus logs the status of the update if it has changed since it was
+// last logged, or on each tick if the debug logging is enabled. The caller
+// must hold the lock.
+func (u *Update) logStatus(lc LogConfig) {
+	if lc.Debug {
+		u.logf("%s", u.String())
+		return
+	}
+	if u.statusLog.heartbeat == 0 {
+		u.statusLog.heartbeat = time.Duration(lc.StatusHeartbeat) * time.Second
+		if u.statusLog.heartbeat <= 0 {
+			u.statusLog.heartbeat = defaultStatusHeartbeat * time.Second
+		}
+	}
+	if u.statusLog.shouldLog(u.fingerprint(), time.Now()) {
+		u.logf("%s", u.String())
+	}
+}
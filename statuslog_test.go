@@ -0,0 +1,52 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusLog(t *testing.T) {
+	l := statusLog{heartbeat: 10 * time.Minute}
+	now := time.Now()
+	fp := statusFingerprint{State: UpdateDownloaded, Progress: 100, Seeding: true, TotalPeers: 3}
+	for _, c := range []struct {
+		name  string
+		after time.Duration
+		fp    statusFingerprint
+		log   bool
+	}{
+		{"first status", 0, fp, true},
+		{"unchanged", 5 * time.Second, fp, false},
+		{"unchanged before heartbeat", 9 * time.Minute, fp, false},
+		{"heartbeat", 10*time.Minute + 5*time.Second, fp, true},
+		{"peer count", 10*time.Minute + 10*time.Second,
+			statusFingerprint{State: UpdateDownloaded, Progress: 100, Seeding: true, TotalPeers: 4}, true},
+		{"state", 10*time.Minute + 15*time.Second,
+			statusFingerprint{State: UpdateDeployed, Progress: 100, Seeding: true, TotalPeers: 4}, true},
+		{"unchanged after change", 10*time.Minute + 20*time.Second,
+			statusFingerprint{State: UpdateDeployed, Progress: 100, Seeding: true, TotalPeers: 4}, false},
+	} {
+		if log := l.shouldLog(c.fp, now.Add(c.after)); log != c.log {
+			t.Errorf("%s: logged %v, expected %v", c.name, log, c.log)
+		}
+	}
+
+	// the progress is bucketed, hence a download in progress is logged
+	// every bucket rather than every tick
+	l = statusLog{heartbeat: 10 * time.Minute}
+	logged := 0
+	for completed := int64(0); completed <= 100; completed++ {
+		fp := statusFingerprint{State: UpdateDownloading,
+			Progress: completed / progressBucket * progressBucket}
+		if l.shouldLog(fp, now.Add(time.Duration(completed)*time.Second)) {
+			logged++
+		}
+	}
+	if expected := 100/progressBucket + 1; logged != expected {
+		t.Errorf("logged %d lines of a download, expected %d", logged, expected)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// interopDefaultRate is the default number of responses per second to
+	// the plain binding requests, from all sources.
+	interopDefaultRate = 50
+
+	// interopDefaultSourceRate is the default number of responses per
+	// second to the plain binding requests of a source.
+	interopDefaultSourceRate = 1
+
+	// interopMaxSources is the number of tracked sources that triggers
+	// removing the idle ones.
+	interopMaxSources = 1024
+)
+
+// InteropConfig holds the configurations of the RFC 5389 interop mode, under
+// which the server answers the plain binding requests of standard STUN
+// clients, e.g. stunclient or a WebRTC stack, to debug the NAT behaviour.
+type InteropConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// Rate and SourceRate limit the responses per second to the plain
+	// binding requests from all sources and from a source, so that the
+	// server is not a reflection amplifier.
+	Rate       int `json:"rate"`
+	SourceRate int `json:"source-rate"`
+}
+
+// DefaultInteropConfig returns the default interop configurations, which
+// disable it.
+func DefaultInteropConfig() InteropConfig {
+	return InteropConfig{
+		Rate:       interopDefaultRate,
+		SourceRate: interopDefaultSourceRate,
+	}
+}
+
+// interopLimiter limits the responses to the plain binding requests, overall
+// and per source. It is safe for concurrent use.
+type interopLimiter struct {
+	sync.Mutex
+	cfg     InteropConfig
+	all     *rate.Limiter
+	sources map[string]*interopSource
+}
+
+type interopSource struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func newInteropLimiter(cfg InteropConfig) *interopLimiter {
+	if cfg.Rate <= 0 {
+		cfg.Rate = interopDefaultRate
+	}
+	if cfg.SourceRate <= 0 {
+		cfg.SourceRate = interopDefaultSourceRate
+	}
+	return &interopLimiter{
+		cfg:     cfg,
+		all:     rate.NewLimiter(rate.Limit(cfg.Rate), cfg.Rate),
+		sources: make(map[string]*interopSource),
+	}
+}
+
+// Allow returns true if a response can be sent to given source now.
+func (l *interopLimiter) Allow(source string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.sources) >= interopMaxSources {
+		// a source idle for a second has a full bucket again
+		for k, s := range l.sources {
+			if now.Sub(s.seen) > time.Second {
+				delete(l.sources, k)
+			}
+		}
+	}
+	s, ok := l.sources[source]
+	if !ok {
+		if len(l.sources) >= interopMaxSources {
+			return false
+		}
+		s = &interopSource{limiter: rate.NewLimiter(rate.Limit(l.cfg.SourceRate), l.cfg.SourceRate)}
+		l.sources[source] = s
+	}
+	s.seen = now
+	return s.limiter.AllowN(now, 1) && l.all.AllowN(now, 1)
+}
+
+// isPlainBinding returns true if given message is a binding request without
+// the username and integrity of the agents, e.g. of a standard STUN client.
+func isPlainBinding(m *stun.Message) bool {
+	return m.Type == stun.BindingRequest && !m.Contains(stun.AttrUsername) &&
+		!m.Contains(stun.AttrMessageIntegrity)
+}
+
+// answerPlainBinding answers given plain binding request with the reflexive
+// address of its sender only, as specified by RFC 5389: the sender is not
+// registered in the session table.
+func (s *Server) answerPlainBinding(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	if !s.interop.Allow(addrSource(addr), time.Now()) {
+		metrics.Inc("server.stun_interop", "result", "limited")
+		return nil
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("unsupported address %v", addr)
+	}
+	res.Reset()
+	if err := res.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: udpAddr.IP, Port: udpAddr.Port},
+		stun.NewSoftware("p2pupdate/"+softwareVersion),
+		stun.Fingerprint,
+	); err != nil {
+		return errors.Wrap(err, "failed building interop binding response")
+	}
+	if _, err := conn.WriteTo(res.Raw, addr); err != nil {
+		return errors.Wrap(err, "failed sending interop binding response")
+	}
+	metrics.Inc("server.stun_interop", "result", "answered")
+	return nil
+}
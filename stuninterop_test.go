@@ -0,0 +1,111 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestInteropBinding(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cfg := DefaultServerConfig()
+	cfg.Interop.Enabled = true
+	s := &Server{
+		peers:     make(SessionTable),
+		cfg:       cfg,
+		blacklist: NewBlacklist(cfg.Blacklist),
+		interop:   newInteropLimiter(cfg.Interop),
+	}
+
+	// a plain binding request of a standard client, e.g. stunclient
+	req := stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if !isPlainBinding(req) {
+		t.Fatal("plain binding request is not detected")
+	}
+	var res stun.Message
+	if err = s.processMessage(serverConn, conn.LocalAddr(), req, &res); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got stun.Message
+	if _, err = got.Write(b[:n]); err != nil {
+		t.Fatal(err)
+	}
+	var xorAddr stun.XORMappedAddress
+	if err = xorAddr.GetFrom(&got); err != nil {
+		t.Fatal(err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if got.Type != stun.BindingSuccess || got.TransactionID != req.TransactionID ||
+		!xorAddr.IP.Equal(local.IP) || xorAddr.Port != local.Port {
+		t.Errorf("unexpected response %v %v", got, xorAddr)
+	}
+	if len(s.peers) > 0 {
+		t.Error("plain binding request is registered in the session table")
+	}
+
+	// the responses to a source are rate-limited
+	if err = s.processMessage(serverConn, conn.LocalAddr(), req, &res); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err = conn.ReadFrom(b); err == nil {
+		t.Error("burst of plain binding requests is answered")
+	}
+
+	// the other messages, and the binding requests of the agents, are still
+	// validated
+	pid := PeerID{1}
+	for _, m := range []*stun.Message{
+		stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid),
+		stun.MustBuild(stun.TransactionID, stun.BindingRequest, stun.NewUsername("x"),
+			stun.NewShortTermIntegrity("wrong"), stun.Fingerprint),
+	} {
+		if isPlainBinding(m) {
+			t.Errorf("agent message %v is plain", m.Type)
+		}
+		if err = s.processMessage(serverConn, conn.LocalAddr(), m, &res); err == nil {
+			t.Errorf("message %v is not validated", m.Type)
+		}
+	}
+
+	// without interop mode, plain binding requests are invalid
+	s.cfg.Interop.Enabled = false
+	if err = s.processMessage(serverConn, conn.LocalAddr(), req, &res); err == nil {
+		t.Error("plain binding request is valid without interop mode")
+	}
+}
+
+func TestInteropLimiter(t *testing.T) {
+	l := newInteropLimiter(InteropConfig{Rate: 3, SourceRate: 1})
+	now := time.Now()
+	if !l.Allow("a", now) || l.Allow("a", now) {
+		t.Error("source is not limited")
+	}
+	if !l.Allow("b", now) || !l.Allow("c", now) || l.Allow("d", now) {
+		t.Error("sources are not limited overall")
+	}
+	if !l.Allow("a", now.Add(time.Second)) {
+		t.Error("source is limited once its bucket is refilled")
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/gortc/stun"
+	"github.com/vmihailenco/msgpack"
+)
+
+// attrDeployReport carries a deployment report, packed as MessagePack, in a
+// data request of an agent to the server.
+const attrDeployReport stun.AttrType = 0x8f19
+
+// reportStunTimeout is the time an agent waits for the server to answer a
+// report sent over the overlay before sending it over HTTP.
+const reportStunTimeout = 5 * time.Second
+
+// AddTo writes the report on given STUN message.
+func (r *DeployReport) AddTo(m *stun.Message) error {
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	m.Add(attrDeployReport, data)
+	return nil
+}
+
+// GetFrom reads the report from given STUN message.
+func (r *DeployReport) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrDeployReport)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(data, r)
+}
+
+// SendReport sends given deployment report to the server in a signed data
+// request, and waits until the server has answered it or the timeout.
+func (overlay *OverlayConn) SendReport(r *DeployReport, timeout time.Duration) error {
+	msg, err := stun.Build(
+		stun.TransactionID,
+		stunDataRequest,
+		overlay.localIDAttr(),
+		r,
+		overlay.Config.identity.Signature(),
+		stun.NewShortTermIntegrity(overlay.Config.StunPassword),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+
+	overlay.Lock()
+	if overlay.conn == nil {
+		overlay.Unlock()
+		return errConnNotOpened
+	}
+	if overlay.reports == nil {
+		overlay.reports = make(map[[stun.TransactionIDSize]byte]chan error)
+	}
+	overlay.reports[msg.TransactionID] = done
+	_, err = overlay.conn.conn.WriteToUDP(msg.Raw, overlay.rendezvousAddr)
+	overlay.Unlock()
+	defer func() {
+		overlay.Lock()
+		delete(overlay.reports, msg.TransactionID)
+		overlay.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("no report response within %v", timeout)
+	}
+}
+
+// reportResponse delivers the response of the server to a report of this
+// agent, and returns false if the response is not one.
+func (overlay *OverlayConn) reportResponse(res *stun.Message) bool {
+	overlay.Lock()
+	defer overlay.Unlock()
+	done, ok := overlay.reports[res.TransactionID]
+	if !ok {
+		return false
+	}
+	delete(overlay.reports, res.TransactionID)
+	var err error
+	if res.Type.Class == stun.ClassErrorResponse {
+		var code stun.ErrorCodeAttribute
+		if code.GetFrom(res) == nil {
+			err = fmt.Errorf("report refused: %d %s", code.Code, code.Reason)
+		} else {
+			err = fmt.Errorf("report refused")
+		}
+	}
+	done <- err
+	return true
+}
+
+// receiveReport adds the deployment report of a peer sent over the overlay,
+// whose peer ID is the one of the sender, and answers it with a data success
+// response once it is stored, or a data error response with the HTTP status
+// code of serveReport.
+func (s *Server) receiveReport(conn net.PacketConn, addr net.Addr, req, res *stun.Message) error {
+	var (
+		pid PeerID
+		r   DeployReport
+	)
+	if err := pid.GetFrom(req); err != nil {
+		return err
+	}
+	if err := r.GetFrom(req); err != nil {
+		return fmt.Errorf("invalid deploy report of %s: %v", pid, err)
+	}
+	if r.UUID == "" {
+		return fmt.Errorf("incomplete deploy report of %s", pid)
+	}
+	r.PeerID = pid.String()
+	setters := []stun.Setter{stun.NewTransactionIDSetter(req.TransactionID), stunDataSuccess, &s.ID}
+	if code := s.addReport(r); code != 200 {
+		log.Printf("refused deploy report of %s uuid:%s version:%d - status %d", pid, r.UUID, r.Version, code)
+		setters[1] = stunDataError
+		setters = append(setters, stun.ErrorCodeAttribute{Code: stun.ErrorCode(code), Reason: []byte("unknown update")})
+	}
+	setters = append(setters, stun.NewShortTermIntegrity(s.cfg.StunPassword), stun.Fingerprint)
+	if err := res.Build(setters...); err != nil {
+		return err
+	}
+	_, err := conn.WriteTo(res.Raw, addr)
+	return err
+}
+
+// PeerReports returns the latest deployment report of given peer for each
+// update, sorted by UUID.
+func (s *Server) PeerReports(pid string) []DeployReport {
+	s.RLock()
+	defer s.RUnlock()
+	reports := []DeployReport{}
+	for _, ur := range s.reports {
+		if r, ok := ur.Peers[pid]; ok {
+			reports = append(reports, r)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].UUID < reports[j].UUID })
+	return reports
+}
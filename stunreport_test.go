@@ -0,0 +1,88 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+)
+
+func TestDeployReportOverSTUN(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	serverConn, peerConn := listen(), listen()
+	defer serverConn.Close()
+	defer peerConn.Close()
+
+	uuid := "4d4e1a1c-7f3c-4d2a-9d3e-2b3c4d5e6f70"
+	pid := PeerID{0, 0x1c, 0x42, 1, 2, 3}
+	s := &Server{
+		ID:      PeerID{0, 0, 0, 0, 0, 2},
+		peers:   SessionTable{pid: Session{peerConn.LocalAddr().(*net.UDPAddr)}},
+		cfg:     &ServerConfig{StunPassword: defaultStunPassword},
+		updates: map[string]*Notification{uuid: {UUID: uuid, Version: 2}},
+		reports: make(map[string]*UpdateReports),
+		fleet:   NewFleetAggregator(60),
+	}
+	overlay := &OverlayConn{ID: pid, Config: &OverlayConfig{StunPassword: defaultStunPassword}}
+
+	// send delivers given report to the server, and its response to the
+	// overlay awaiting it
+	send := func(r DeployReport) (stun.MessageType, error) {
+		req := stun.MustBuild(stun.TransactionID, stunDataRequest, &pid, &r,
+			stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+		done := make(chan error, 1)
+		overlay.reports = map[[stun.TransactionIDSize]byte]chan error{req.TransactionID: done}
+		if err := s.receiveReport(serverConn, peerConn.LocalAddr(), req, new(stun.Message)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		peerConn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := peerConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &stun.Message{Raw: buf[:n]}
+		if err = res.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		if !overlay.reportResponse(res) {
+			t.Fatal("response is not delivered to the report")
+		}
+		return res.Type, <-done
+	}
+
+	r := DeployReport{PeerID: "forged", UUID: uuid, Version: 2, Success: false, ExitCode: 3,
+		Error: "exit status 3", Timestamp: time.Now().Round(time.Second)}
+	for i := 0; i < 2; i++ {
+		// the report sent again is acknowledged, but stored once
+		if typ, err := send(r); typ != stunDataSuccess || err != nil {
+			t.Fatalf("report is not acknowledged: %v %v", typ, err)
+		}
+	}
+	reports := s.PeerReports(pid.String())
+	if len(reports) != 1 || reports[0].ExitCode != 3 || !reports[0].Timestamp.Equal(r.Timestamp) {
+		t.Fatalf("unexpected reports of the peer: %+v", reports)
+	}
+	if len(s.PeerReports("forged")) != 0 {
+		t.Error("report is stored under the peer ID it claims")
+	}
+
+	r.UUID = "unknown"
+	if typ, err := send(r); typ != stunDataError || err == nil {
+		t.Errorf("report of an unknown update is acknowledged: %v %v", typ, err)
+	}
+	if overlay.reportResponse(stun.MustBuild(stun.TransactionID, stunDataSuccess)) {
+		t.Error("unsolicited response is delivered")
+	}
+}
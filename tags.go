@@ -0,0 +1,176 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gortc/stun"
+	"github.com/vmihailenco/msgpack"
+)
+
+const (
+	maxTags      = 16
+	maxTagLength = 32
+)
+
+// rTag is the format of a tag, e.g. greenhouse or rack-b.
+var rTag = regexp.MustCompile("^[a-z0-9][a-z0-9._-]*$")
+
+// attrTags and attrSessionTags are comprehension-optional STUN attributes.
+// A binding request carries the tags of its sender, and the session table
+// sent by the server carries the tags of its peers. They are added before
+// MESSAGE-INTEGRITY, hence they cannot be modified in transit.
+const (
+	attrTags        stun.AttrType = 0x8f0b
+	attrSessionTags stun.AttrType = 0x8f0c
+)
+
+// validateTags returns an error if a tag is invalid, duplicated, or if there
+// are too many tags.
+func validateTags(tags []string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags exceed the maximum of %d", len(tags), maxTags)
+	}
+	seen := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		if len(t) > maxTagLength || !rTag.MatchString(t) {
+			return fmt.Errorf("invalid tag '%s', expected up to %d lowercase letters, digits,"+
+				" dots, dashes or underscores", t, maxTagLength)
+		}
+		if seen[t] {
+			return fmt.Errorf("duplicated tag '%s'", t)
+		}
+		seen[t] = true
+	}
+	return nil
+}
+
+// PeerTags are the tags of a peer, e.g. its site or its rack.
+type PeerTags []string
+
+// AddTo adds PeerTags into STUN message if there is any tag.
+func (t PeerTags) AddTo(m *stun.Message) error {
+	if len(t) > 0 {
+		m.Add(attrTags, []byte(strings.Join(t, ",")))
+	}
+	return nil
+}
+
+// GetFrom gets PeerTags from STUN message.
+func (t *PeerTags) GetFrom(m *stun.Message) error {
+	b, err := m.Get(attrTags)
+	if err != nil {
+		return err
+	}
+	tags := PeerTags(strings.Split(string(b), ","))
+	if err = validateTags(tags); err != nil {
+		return err
+	}
+	sort.Strings(tags)
+	*t = tags
+	return nil
+}
+
+// Equal returns true if this and given tags are the same.
+func (t PeerTags) Equal(tt PeerTags) bool {
+	if len(t) != len(tt) {
+		return false
+	}
+	for i := range t {
+		if t[i] != tt[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SessionTags are the tags of the peers of a session table. The peers
+// without tags are omitted.
+type SessionTags map[PeerID]PeerTags
+
+// AddTo marshals SessionTags as MessagePack data, then writes it on given
+// STUN message if there is any tag.
+func (st SessionTags) AddTo(m *stun.Message) error {
+	if len(st) == 0 {
+		return nil
+	}
+	data, err := msgpack.Marshal(st)
+	if err == nil {
+		m.Add(attrSessionTags, data)
+	}
+	return err
+}
+
+// GetFrom gets SessionTags from STUN message.
+func (st *SessionTags) GetFrom(m *stun.Message) error {
+	data, err := m.Get(attrSessionTags)
+	if err != nil {
+		return err
+	}
+	tags := make(SessionTags)
+	if err = msgpack.Unmarshal(data, &tags); err != nil {
+		return err
+	}
+	for pid, t := range tags {
+		if err = validateTags(t); err != nil {
+			return fmt.Errorf("tags of peer %s: %v", pid, err)
+		}
+	}
+	*st = tags
+	return nil
+}
+
+// setPeerTags sets the tags of given peer, or removes them if it has none.
+func setPeerTags(st SessionTags, pid PeerID, tags PeerTags) {
+	if len(tags) > 0 {
+		st[pid] = tags
+	} else {
+		delete(st, pid)
+	}
+}
+
+// validateTagSelectors returns an error if a tag selector is invalid. A
+// selector is a list of alternatives separated by '|', each of them is a tag
+// that the agent must have, or a tag prefixed by '!' that it must not have.
+func validateTagSelectors(selectors []string) error {
+	for _, sel := range selectors {
+		for _, alt := range strings.Split(sel, "|") {
+			if err := validateTags([]string{strings.TrimPrefix(alt, "!")}); err != nil {
+				return fmt.Errorf("invalid tag selector '%s': %v", sel, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchTagSelector returns true if any alternative of given selector matches
+// given tags.
+func matchTagSelector(sel string, tags []string) bool {
+	for _, alt := range strings.Split(sel, "|") {
+		if strings.HasPrefix(alt, "!") {
+			if !containsString(tags, alt[1:]) {
+				return true
+			}
+		} else if containsString(tags, alt) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTags returns true if given tags of an agent match all tag selectors of
+// the notification, which is always the case if it has no selector.
+func (mi *Notification) MatchTags(tags []string) bool {
+	for _, sel := range mi.Tags {
+		if !matchTagSelector(sel, tags) {
+			return false
+		}
+	}
+	return true
+}
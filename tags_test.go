@@ -0,0 +1,93 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestValidateTags(t *testing.T) {
+	for _, tc := range []struct {
+		tags  []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"greenhouse", "rack-b", "site_1.a"}, true},
+		{[]string{"Greenhouse"}, false},
+		{[]string{"rack,b"}, false},
+		{[]string{"-rack"}, false},
+		{[]string{""}, false},
+		{[]string{"rack", "rack"}, false},
+		{[]string{"abcdefghijklmnopqrstuvwxyz0123456"}, false},
+	} {
+		if err := validateTags(tc.tags); (err == nil) != tc.valid {
+			t.Errorf("tags %q: valid %v, expected %v (%v)", tc.tags, err == nil, tc.valid, err)
+		}
+	}
+}
+
+func TestMatchTags(t *testing.T) {
+	tags := []string{"greenhouse", "rack-b"}
+	for _, tc := range []struct {
+		selectors []string
+		match     bool
+	}{
+		{nil, true},
+		{[]string{"greenhouse"}, true},
+		{[]string{"greenhouse", "rack-b"}, true},
+		{[]string{"greenhouse", "rack-a"}, false},
+		{[]string{"rack-a|rack-b"}, true},
+		{[]string{"!lab"}, true},
+		{[]string{"!rack-b"}, false},
+		{[]string{"lab|!rack-b"}, false},
+		{[]string{"greenhouse", "!lab"}, true},
+	} {
+		n := Notification{Tags: tc.selectors}
+		if m := n.MatchTags(tags); m != tc.match {
+			t.Errorf("selectors %q: match %v, expected %v", tc.selectors, m, tc.match)
+		}
+	}
+	if (&Notification{Tags: []string{"greenhouse"}}).MatchTags(nil) {
+		t.Error("agent without tags matches a selector")
+	}
+	if err := validateTagSelectors([]string{"rack-a|!lab"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateTagSelectors([]string{"rack-a||lab"}); err == nil {
+		t.Error("empty alternative is valid")
+	}
+}
+
+func TestTagsAttributes(t *testing.T) {
+	var pid PeerID
+	pid[0] = 1
+	msg, err := stun.Build(stun.TransactionID, stun.BindingRequest,
+		PeerTags{"rack-b", "greenhouse"}, SessionTags{pid: PeerTags{"lab"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags PeerTags
+	if err = tags.GetFrom(msg); err != nil || !tags.Equal(PeerTags{"greenhouse", "rack-b"}) {
+		t.Errorf("tags %q: %v", tags, err)
+	}
+	var st SessionTags
+	if err = st.GetFrom(msg); err != nil || len(st) != 1 || !st[pid].Equal(PeerTags{"lab"}) {
+		t.Errorf("session tags %v: %v", st, err)
+	}
+
+	// an agent without tags does not add the attributes
+	msg, err = stun.Build(stun.TransactionID, stun.BindingRequest, PeerTags(nil), SessionTags{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tags.GetFrom(msg); err != stun.ErrAttributeNotFound {
+		t.Errorf("expected no tags attribute, got %v", err)
+	}
+	if err = st.GetFrom(msg); err != stun.ErrAttributeNotFound {
+		t.Errorf("expected no session tags attribute, got %v", err)
+	}
+}
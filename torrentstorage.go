@@ -0,0 +1,241 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+)
+
+// The storage backends of the torrent client.
+const (
+	// StorageFile stores the payloads in files, which is the default.
+	StorageFile = "file"
+
+	// StorageMMap maps the payloads in memory, which is faster but the
+	// mapped pages count in the RSS of the agent.
+	StorageMMap = "mmap"
+
+	// StorageLowMemory stores the payloads in files, without piece cache
+	// and with fewer peer connections, whose buffers dominate the memory
+	// of the torrent client.
+	StorageLowMemory = "low-memory"
+)
+
+// memorySampleInterval is the interval of the sampling of the resident
+// memory, which is a gauge emitted with the other metrics.
+const memorySampleInterval = 15 * time.Second
+
+// sampleMemory sets the gauge of the resident memory and returns it, or 0 if
+// it is unknown on the platform.
+func sampleMemory() uint64 {
+	rss, err := residentMemory()
+	if err != nil {
+		return 0
+	}
+	metrics.Set("agent.rss_bytes", int64(rss))
+	return rss
+}
+
+// The peer connection limits of the low-memory storage, unless configured.
+const (
+	lowMemoryConnsPerTorrent = 10
+	lowMemoryHalfOpenConns   = 5
+	lowMemoryPeersPerTorrent = 50
+)
+
+// validateStorage returns an error if the storage of given configurations
+// is unknown or its limits are negative.
+func (c *BitTorrentConfig) validateStorage() error {
+	switch c.Storage {
+	case "", StorageFile, StorageMMap, StorageLowMemory:
+	default:
+		return fmt.Errorf("unknown storage '%s', expected %s, %s or %s", c.Storage,
+			StorageFile, StorageMMap, StorageLowMemory)
+	}
+	if c.PieceCache < 0 || c.MaxConnsPerTorrent < 0 || c.MaxHalfOpenConns < 0 || c.MaxPeersPerTorrent < 0 {
+		return fmt.Errorf("piece cache and connection limits must not be negative")
+	}
+	return nil
+}
+
+// applyStorage sets the storage backend and the memory limits of given
+// torrent client configurations. A limit is the default of the client if it
+// is 0, or the low-memory one if the storage is low-memory.
+func (c *BitTorrentConfig) applyStorage(cfg *torrent.Config, dir string, pc storage.PieceCompletion) {
+	cfg.EstablishedConnsPerTorrent = c.MaxConnsPerTorrent
+	cfg.HalfOpenConnsPerTorrent = c.MaxHalfOpenConns
+	cfg.TorrentPeersHighWater = c.MaxPeersPerTorrent
+	cfg.DefaultStorage = c.newStorage(dir, pc)
+	if c.Storage == StorageLowMemory {
+		if cfg.EstablishedConnsPerTorrent == 0 {
+			cfg.EstablishedConnsPerTorrent = lowMemoryConnsPerTorrent
+		}
+		if cfg.HalfOpenConnsPerTorrent == 0 {
+			cfg.HalfOpenConnsPerTorrent = lowMemoryHalfOpenConns
+		}
+		if cfg.TorrentPeersHighWater == 0 {
+			cfg.TorrentPeersHighWater = lowMemoryPeersPerTorrent
+		}
+	}
+	if cfg.TorrentPeersHighWater > 0 && cfg.TorrentPeersLowWater == 0 {
+		cfg.TorrentPeersLowWater = (cfg.TorrentPeersHighWater + 3) / 4
+	}
+}
+
+// newStorage returns the storage backend of the payloads in given directory,
+// with the piece cache if it is enabled.
+func (c *BitTorrentConfig) newStorage(dir string, pc storage.PieceCompletion) storage.ClientImpl {
+	var impl storage.ClientImpl
+	if c.Storage == StorageMMap {
+		impl = storage.NewMMapWithCompletion(dir, pc)
+	} else {
+		impl = storage.NewFileWithCompletion(dir, pc)
+	}
+	if c.PieceCache > 0 {
+		impl = newPieceCache(impl, c.PieceCache)
+	}
+	return impl
+}
+
+// pieceCache is a storage that caches the pieces read by the peers, whose
+// total size is bounded, in order to spare the reads of the most requested
+// pieces while seeding.
+type pieceCache struct {
+	storage.ClientImpl
+
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *cachedPiece, the most recently used first
+	entries map[metainfo.PieceKey]*list.Element
+}
+
+type cachedPiece struct {
+	key  metainfo.PieceKey
+	data []byte
+}
+
+func newPieceCache(impl storage.ClientImpl, max int64) *pieceCache {
+	return &pieceCache{
+		ClientImpl: impl,
+		max:        max,
+		lru:        list.New(),
+		entries:    make(map[metainfo.PieceKey]*list.Element),
+	}
+}
+
+func (c *pieceCache) OpenTorrent(info *metainfo.Info, ih metainfo.Hash) (storage.TorrentImpl, error) {
+	t, err := c.ClientImpl.OpenTorrent(info, ih)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedTorrent{TorrentImpl: t, cache: c, ih: ih}, nil
+}
+
+// get returns the cached data of given piece, or nil.
+func (c *pieceCache) get(key metainfo.PieceKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cachedPiece).data
+	}
+	return nil
+}
+
+// put caches given data of a piece, and evicts the least recently used
+// pieces beyond the size of the cache.
+func (c *pieceCache) put(key metainfo.PieceKey, data []byte) {
+	if int64(len(data)) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cachedPiece{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		p := c.lru.Remove(c.lru.Back()).(*cachedPiece)
+		delete(c.entries, p.key)
+		c.size -= int64(len(p.data))
+	}
+}
+
+// drop removes given piece from the cache.
+func (c *pieceCache) drop(key metainfo.PieceKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.size -= int64(len(e.Value.(*cachedPiece).data))
+	}
+}
+
+type cachedTorrent struct {
+	storage.TorrentImpl
+	cache *pieceCache
+	ih    metainfo.Hash
+}
+
+func (t *cachedTorrent) Piece(p metainfo.Piece) storage.PieceImpl {
+	return &cachedPieceImpl{
+		PieceImpl: t.TorrentImpl.Piece(p),
+		cache:     t.cache,
+		key:       metainfo.PieceKey{InfoHash: t.ih, Index: p.Index()},
+		length:    p.Length(),
+	}
+}
+
+// cachedPieceImpl reads a complete piece through the cache, while a piece
+// that is written or checked again is dropped from it.
+type cachedPieceImpl struct {
+	storage.PieceImpl
+	cache  *pieceCache
+	key    metainfo.PieceKey
+	length int64
+}
+
+func (p *cachedPieceImpl) ReadAt(b []byte, off int64) (int, error) {
+	data := p.cache.get(p.key)
+	if data == nil {
+		if !p.Completion().Complete {
+			return p.PieceImpl.ReadAt(b, off)
+		}
+		data = make([]byte, p.length)
+		if n, _ := p.PieceImpl.ReadAt(data, 0); int64(n) < p.length {
+			return p.PieceImpl.ReadAt(b, off)
+		}
+		p.cache.put(p.key, data)
+	}
+	if off >= int64(len(data)) {
+		return 0, fmt.Errorf("offset %d beyond piece length %d", off, len(data))
+	}
+	n := copy(b, data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (p *cachedPieceImpl) WriteAt(b []byte, off int64) (int, error) {
+	p.cache.drop(p.key)
+	return p.PieceImpl.WriteAt(b, off)
+}
+
+func (p *cachedPieceImpl) MarkNotComplete() error {
+	p.cache.drop(p.key)
+	return p.PieceImpl.MarkNotComplete()
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestPieceCacheEviction(t *testing.T) {
+	c := newPieceCache(nil, 10)
+	key := func(i int) metainfo.PieceKey { return metainfo.PieceKey{Index: i} }
+	c.put(key(0), make([]byte, 4))
+	c.put(key(1), make([]byte, 4))
+	c.get(key(0))
+	c.put(key(2), make([]byte, 4))
+	if c.get(key(1)) != nil {
+		t.Error("least recently used piece is not evicted")
+	}
+	if c.get(key(0)) == nil || c.get(key(2)) == nil {
+		t.Error("recently used pieces are evicted")
+	}
+	if c.size != 8 {
+		t.Errorf("wrong cache size %d", c.size)
+	}
+	c.put(key(3), make([]byte, 11))
+	if c.get(key(3)) != nil {
+		t.Error("piece larger than the cache is cached")
+	}
+	c.drop(key(0))
+	if c.get(key(0)) != nil || c.size != 4 {
+		t.Errorf("dropped piece is cached, size %d", c.size)
+	}
+}
+
+func TestValidateStorage(t *testing.T) {
+	for _, c := range []struct {
+		cfg BitTorrentConfig
+		ok  bool
+	}{
+		{BitTorrentConfig{}, true},
+		{BitTorrentConfig{Storage: StorageLowMemory, PieceCache: 1 << 20}, true},
+		{BitTorrentConfig{Storage: StorageMMap}, true},
+		{BitTorrentConfig{Storage: "bolt"}, false},
+		{BitTorrentConfig{MaxConnsPerTorrent: -1}, false},
+	} {
+		if err := c.cfg.validateStorage(); (err == nil) != c.ok {
+			t.Errorf("storage %+v: %v", c.cfg, err)
+		}
+	}
+}
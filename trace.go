@@ -0,0 +1,54 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// traceIDSize is the number of random bytes of a generated trace ID.
+const traceIDSize = 8
+
+// rTraceID is the format of a trace ID, which is written as is in the logs.
+var rTraceID = regexp.MustCompile("^[A-Za-z0-9._-]{1,64}$")
+
+// newTraceID returns a random trace ID, which correlates the log lines,
+// audit entries, reports and webhooks of an update submission across the
+// submitter, the server and the agents.
+func newTraceID() (string, error) {
+	b := make([]byte, traceIDSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validateTraceID returns an error if given trace ID is set but invalid.
+func validateTraceID(id string) error {
+	if id != "" && !rTraceID.MatchString(id) {
+		return fmt.Errorf("invalid trace ID '%s', expected up to 64 letters, digits, dots,"+
+			" dashes or underscores", id)
+	}
+	return nil
+}
+
+// traceSuffix returns the suffix of the log lines of given trace ID, which is
+// empty if it is not set.
+func traceSuffix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return " trace:" + id
+}
+
+// logf logs a message of the update, which is followed by the trace ID of its
+// notification if it has one, so that the call sites do not pass it.
+func (u *Update) logf(format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf(format, v...)+traceSuffix(u.Notification.TraceID))
+}
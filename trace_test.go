@@ -0,0 +1,78 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestTraceID(t *testing.T) {
+	id, err := newTraceID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 2*traceIDSize || validateTraceID(id) != nil {
+		t.Errorf("invalid generated trace ID '%s'", id)
+	}
+	if other, _ := newTraceID(); other == id {
+		t.Error("trace IDs are not random")
+	}
+	for _, id := range []string{"", "incident-42", "a.b_c"} {
+		if err = validateTraceID(id); err != nil {
+			t.Errorf("trace ID '%s' is invalid: %v", id, err)
+		}
+	}
+	for _, id := range []string{"a b", "a\nb", "100%", strings.Repeat("a", 65)} {
+		if validateTraceID(id) == nil {
+			t.Errorf("trace ID %q is valid", id)
+		}
+	}
+}
+
+func TestTraceIDSigned(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := Notification{
+		UUID:    "f5adf0cb-b0e1-5a22-97f1-09092f566438",
+		Version: 1,
+		Info:    metainfo.Info{Name: "update", PieceLength: 1024, Length: 1},
+		TraceID: "0123456789abcdef",
+	}
+	if err = n.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	n.TraceID = "fedcba9876543210"
+	if n.Verify(&key.PublicKey) == nil {
+		t.Error("modified trace ID must fail the verification")
+	}
+}
+
+func TestUpdateLogf(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	u := &Update{Notification: Notification{UUID: "foo", Version: 2}}
+	u.logf("update uuid:%s version:%d", u.Notification.UUID, u.Notification.Version)
+	if s := buf.String(); !strings.HasSuffix(s, "update uuid:foo version:2\n") {
+		t.Errorf("unexpected log line without trace ID: %s", s)
+	}
+	buf.Reset()
+	u.Notification.TraceID = "0123456789abcdef"
+	u.logf("WARNING: update uuid:%s", u.Notification.UUID)
+	if s := buf.String(); !strings.Contains(s, "WARNING: update uuid:foo trace:0123456789abcdef\n") {
+		t.Errorf("unexpected log line with trace ID: %s", s)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+const (
+	// trackerTokenPlaceholder is substituted by the tracker token of the
+	// agent in the announce URLs, so that the token is not in the torrents.
+	trackerTokenPlaceholder = "{token}"
+
+	// trackerTokenParam is the query parameter of the tracker token that is
+	// appended to the announce URLs without placeholder.
+	trackerTokenParam = "token"
+
+	// redactedToken replaces the tracker token in the logs and outputs.
+	redactedToken = "xxxxx"
+
+	// trackerForbidden prefixes the error of an announce refused by an HTTP
+	// tracker with 403 Forbidden.
+	trackerForbidden = "response from tracker: 403"
+)
+
+// trackerURL returns the URL announced by the agent for given announce URL.
+// The placeholder is substituted by the tracker token, which is empty if none
+// is configured. The token is appended to a URL without placeholder only if
+// its host is the one of the tracker of the config, so that it is never sent
+// to the other trackers of a notification.
+func (cfg *BitTorrentConfig) trackerURL(tr string) string {
+	if strings.Contains(tr, trackerTokenPlaceholder) {
+		return strings.Replace(tr, trackerTokenPlaceholder, url.QueryEscape(cfg.TrackerToken), -1)
+	}
+	if len(cfg.TrackerToken) == 0 || len(tr) == 0 || trackerHost(tr) != trackerHost(cfg.Tracker) {
+		return tr
+	}
+	u, err := url.Parse(tr)
+	if err != nil || u.Scheme == "udp" {
+		return tr
+	}
+	q := u.Query()
+	q.Set(trackerTokenParam, cfg.TrackerToken)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// trackerHost returns the host of given announce URL, or an empty string if
+// it is invalid.
+func trackerHost(tr string) string {
+	u, err := url.Parse(strings.Replace(tr, trackerTokenPlaceholder, "", -1))
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// redactToken returns given text without the tracker token.
+func (cfg *BitTorrentConfig) redactToken(s string) string {
+	if len(cfg.TrackerToken) == 0 {
+		return s
+	}
+	s = strings.Replace(s, cfg.TrackerToken, redactedToken, -1)
+	return strings.Replace(s, url.QueryEscape(cfg.TrackerToken), redactedToken, -1)
+}
+
+// redacted returns a copy of the config whose tracker token is redacted.
+func (cfg Config) redacted() Config {
+	if len(cfg.BitTorrent.TrackerToken) > 0 {
+		cfg.BitTorrent.TrackerToken = redactedToken
+	}
+	return cfg
+}
+
+// announceError returns the error of a failed announce to given tracker,
+// without the tracker token. A tracker refusing the announce with 403
+// Forbidden has most likely refused the token, or its absence.
+func (cfg *BitTorrentConfig) announceError(tr string, err error) error {
+	tr, msg := cfg.redactToken(tr), cfg.redactToken(err.Error())
+	switch {
+	case !strings.HasPrefix(msg, trackerForbidden):
+		return fmt.Errorf("announce to %s failed: %s", tr, msg)
+	case len(cfg.TrackerToken) == 0:
+		return fmt.Errorf("tracker %s refused the announce (403 Forbidden), it requires a tracker token"+
+			" but none is configured (bittorrent.tracker-token)", tr)
+	default:
+		return fmt.Errorf("tracker %s refused the tracker token (403 Forbidden): %s", tr, msg)
+	}
+}
+
+// trackerURLs returns the URLs announced by the agent for given announce
+// URLs.
+func (cfg *BitTorrentConfig) trackerURLs(trackers []string) []string {
+	urls := make([]string, len(trackers))
+	for i, tr := range trackers {
+		urls[i] = cfg.trackerURL(tr)
+	}
+	return urls
+}
+
+// tokenizeMetaInfo returns a copy of given metainfo whose trackers are the
+// URLs announced by the agent, or the metainfo itself if there is no token.
+func (cfg *BitTorrentConfig) tokenizeMetaInfo(mi *metainfo.MetaInfo) *metainfo.MetaInfo {
+	tokenized := cfg.trackerURL(mi.Announce) != mi.Announce
+	for _, tier := range mi.AnnounceList {
+		for _, tr := range tier {
+			tokenized = tokenized || cfg.trackerURL(tr) != tr
+		}
+	}
+	if !tokenized {
+		return mi
+	}
+	m := *mi
+	m.Announce = cfg.trackerURL(mi.Announce)
+	m.AnnounceList = make(metainfo.AnnounceList, len(mi.AnnounceList))
+	for i, tier := range mi.AnnounceList {
+		m.AnnounceList[i] = cfg.trackerURLs(tier)
+	}
+	return &m
+}
+
+// withTokenPlaceholder returns given announce URL with the placeholder of
+// the tracker token in its query if it has none.
+func withTokenPlaceholder(tr string) (string, error) {
+	if strings.Contains(tr, trackerTokenPlaceholder) {
+		return tr, nil
+	}
+	u, err := url.Parse(tr)
+	if err != nil {
+		return "", fmt.Errorf("invalid tracker %s: %v", tr, err)
+	}
+	if u.Scheme == "udp" {
+		return "", fmt.Errorf("UDP tracker %s cannot have a token", tr)
+	}
+	if _, ok := u.Query()[trackerTokenParam]; ok {
+		return "", fmt.Errorf("tracker %s already has a token", tr)
+	}
+	sep := "?"
+	if strings.HasSuffix(tr, "?") {
+		sep = ""
+	} else if len(u.RawQuery) > 0 {
+		sep = "&"
+	}
+	return tr + sep + trackerTokenParam + "=" + trackerTokenPlaceholder, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+func TestTrackerURL(t *testing.T) {
+	cfg := BitTorrentConfig{Tracker: "http://tracker.example.org:6969/announce", TrackerToken: "s3cr3t"}
+	for tr, expected := range map[string]string{
+		"http://tracker.example.org:6969/announce?token={token}": "http://tracker.example.org:6969/announce?token=s3cr3t",
+		"http://tracker.example.org:6969/{token}/announce":       "http://tracker.example.org:6969/s3cr3t/announce",
+		"http://tracker.example.org:6969/announce":               "http://tracker.example.org:6969/announce?token=s3cr3t",
+		"http://tracker.example.org:6969/announce?info=1":        "http://tracker.example.org:6969/announce?info=1&token=s3cr3t",
+		"http://other.example.org/announce":                      "http://other.example.org/announce",
+		"udp://tracker.example.org:6969":                         "udp://tracker.example.org:6969",
+		"":                                                       "",
+	} {
+		if got := cfg.trackerURL(tr); got != expected {
+			t.Errorf("URL of %s is %s, expected %s", tr, got, expected)
+		}
+	}
+
+	cfg.TrackerToken = ""
+	if got := cfg.trackerURL("http://tracker.example.org:6969/announce?token={token}"); got != "http://tracker.example.org:6969/announce?token=" {
+		t.Errorf("placeholder is not removed without token: %s", got)
+	}
+	if got := cfg.trackerURL(cfg.Tracker); got != cfg.Tracker {
+		t.Errorf("URL is changed without token: %s", got)
+	}
+}
+
+func TestTokenizeMetaInfo(t *testing.T) {
+	cfg := BitTorrentConfig{TrackerToken: "s3cr3t"}
+	mi := &metainfo.MetaInfo{Announce: "http://tracker.example.org/announce?token={token}"}
+	m := cfg.tokenizeMetaInfo(mi)
+	if m == mi || m.Announce != "http://tracker.example.org/announce?token=s3cr3t" {
+		t.Errorf("unexpected announce %s", m.Announce)
+	}
+	if mi.Announce != "http://tracker.example.org/announce?token={token}" {
+		t.Errorf("metainfo is modified: %s", mi.Announce)
+	}
+	if m.HashInfoBytes() != mi.HashInfoBytes() {
+		t.Error("infohash is changed")
+	}
+	untokenized := &metainfo.MetaInfo{Announce: "http://other.example.org/announce"}
+	if cfg.tokenizeMetaInfo(untokenized) != untokenized {
+		t.Error("metainfo without placeholder is copied")
+	}
+}
+
+func TestTrackerTokenRedaction(t *testing.T) {
+	cfg := Config{BitTorrent: BitTorrentConfig{Tracker: "http://tracker.example.org/announce", TrackerToken: "a/b c"}}
+	tr := cfg.BitTorrent.trackerURL(cfg.BitTorrent.Tracker)
+	if s := cfg.BitTorrent.redactToken("get " + tr + ": a/b c"); strings.Contains(s, "a/b") ||
+		strings.Contains(s, "a%2Fb") {
+		t.Errorf("token is not redacted: %s", s)
+	}
+	if r := cfg.redacted(); r.BitTorrent.TrackerToken != redactedToken || cfg.BitTorrent.TrackerToken != "a/b c" {
+		t.Errorf("unexpected redacted config token %s", r.BitTorrent.TrackerToken)
+	}
+
+	err := cfg.BitTorrent.announceError(tr, errors.New("Get "+tr+": connection refused"))
+	if strings.Contains(err.Error(), "a%2Fb") || !strings.HasPrefix(err.Error(), "announce to ") {
+		t.Errorf("unexpected error %v", err)
+	}
+	forbidden := errors.New("response from tracker: 403 Forbidden: unknown passkey")
+	if err = cfg.BitTorrent.announceError(tr, forbidden); !strings.Contains(err.Error(), "refused the tracker token") {
+		t.Errorf("unexpected error %v", err)
+	}
+	cfg.BitTorrent.TrackerToken = ""
+	if err = cfg.BitTorrent.announceError(tr, forbidden); !strings.Contains(err.Error(), "none is configured") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWithTokenPlaceholder(t *testing.T) {
+	for tr, expected := range map[string]string{
+		"http://tracker.example.org/announce":             "http://tracker.example.org/announce?token={token}",
+		"http://tracker.example.org/announce?":            "http://tracker.example.org/announce?token={token}",
+		"http://tracker.example.org/announce?info=1":      "http://tracker.example.org/announce?info=1&token={token}",
+		"http://tracker.example.org/{token}/announce":     "http://tracker.example.org/{token}/announce",
+		"http://tracker.example.org/announce?token=s3cr3": "",
+		"udp://tracker.example.org:6969":                  "",
+	} {
+		got, err := withTokenPlaceholder(tr)
+		if expected == "" && err == nil {
+			t.Errorf("tokenless URL of %s is %s, expected an error", tr, got)
+		} else if got != expected {
+			t.Errorf("tokenless URL of %s is %s, expected %s", tr, got, expected)
+		}
+	}
+}
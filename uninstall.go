@@ -0,0 +1,183 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// UninstallNotice is a signed operator message that removes an update from
+// the fleet: the agents stop and delete it, run its cleanup script if it has
+// been deployed, and tombstone it so that it is not fetched again. The notice
+// only applies to the versions created before it, hence replaying it cannot
+// remove a version published later.
+type UninstallNotice struct {
+	UUID       string               `bencode:"uuid" json:"uuid"`
+	MaxVersion uint64               `bencode:"max_version,omitempty" json:"max-version,omitempty"` // 0 means any version
+	Cleanup    string               `bencode:"cleanup,omitempty" json:"cleanup,omitempty"`         // script of the payload directory
+	Timestamp  int64                `bencode:"timestamp" json:"timestamp"`                         // Unix time in nanoseconds
+	By         string               `bencode:"by,omitempty" json:"by,omitempty"`
+	Signatures map[string]Signature `bencode:"signatures,omitempty" json:"signatures,omitempty"`
+}
+
+// UninstallResult is the acknowledgement of an uninstall notice by an agent.
+type UninstallResult struct {
+	UUID        string `json:"uuid"`
+	Uninstalled bool   `json:"uninstalled"` // false if the agent did not have the update
+	Version     uint64 `json:"version,omitempty"`
+	Cleanup     string `json:"cleanup,omitempty"` // outcome of the cleanup script
+}
+
+// Validate returns an error if the notice is invalid.
+func (un *UninstallNotice) Validate() error {
+	if len(un.UUID) == 0 {
+		return fmt.Errorf("uninstall notice without UUID")
+	}
+	if c := un.Cleanup; len(c) > 0 && (path.IsAbs(c) || path.Clean(c) != c ||
+		c == ".." || strings.HasPrefix(c, "../")) {
+		return fmt.Errorf("cleanup script %s must be a relative path in the payload", c)
+	}
+	return nil
+}
+
+// SignWith signs the notice using given signer.
+func (un *UninstallNotice) SignWith(signer Signer) error {
+	un.Signatures = nil
+	data, err := json.Marshal(un)
+	if err != nil {
+		return err
+	}
+	sig, err := signer.SignMessage(data)
+	if err != nil {
+		return err
+	}
+	un.Signatures = map[string]Signature{signatureName: {Signature: sig}}
+	return nil
+}
+
+// Verify verifies the notice's signature using given public key.
+func (un *UninstallNotice) Verify(pub *rsa.PublicKey) error {
+	s, ok := un.Signatures[signatureName]
+	if !ok {
+		return fmt.Errorf("signature is not available")
+	}
+	sigs := un.Signatures
+	un.Signatures = nil
+	defer func() { un.Signatures = sigs }()
+	data, err := json.Marshal(un)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], s.Signature)
+}
+
+// matches returns true if the notice applies to given notification.
+func (un *UninstallNotice) matches(n *Notification) bool {
+	return n.UUID == un.UUID && (un.MaxVersion == 0 || n.Version <= un.MaxVersion) &&
+		time.Unix(n.CreationDate, 0).Before(time.Unix(0, un.Timestamp))
+}
+
+// uninstall applies given verified notice. An agent without a matching
+// update acknowledges the notice without doing anything.
+func (a *Agent) uninstall(un *UninstallNotice) UninstallResult {
+	r := UninstallResult{UUID: un.UUID}
+	u := a.getUpdate(un.UUID)
+	matched := false
+	if u != nil {
+		u.RLock()
+		matched = un.matches(&u.Notification)
+		u.RUnlock()
+	}
+	// the update is only deleted if it has not been replaced meanwhile
+	if !matched || !a.deleteUpdateIf(un.UUID, u) {
+		log.Printf("nothing to uninstall uuid:%s max-version:%d", un.UUID, un.MaxVersion)
+		return r
+	}
+
+	u.Stop()
+	u.Lock()
+	r.Uninstalled, r.Version = true, u.Notification.Version
+	if len(un.Cleanup) > 0 && (u.State == UpdateDeployed || u.DeployFails > 0) {
+		if err := u.cleanup(un.Cleanup); err != nil {
+			r.Cleanup = fmt.Sprintf("%s failed: %v", un.Cleanup, err)
+		} else {
+			r.Cleanup = fmt.Sprintf("%s succeeded", un.Cleanup)
+		}
+	}
+	u.Unlock()
+
+	tombstone := r.Version
+	if un.MaxVersion > tombstone {
+		tombstone = un.MaxVersion
+	}
+	if err := a.tombstoneUpdate(un.UUID, tombstone, u); err != nil {
+		log.Printf("WARNING: failed saving tombstone of uuid:%s version:%d - %v", un.UUID, tombstone, err)
+	}
+	a.audit(AuditUninstalled, &u.Notification, un.By, r.Cleanup)
+	if err := u.Delete(); err != nil {
+		log.Printf("failed deleting uninstalled update uuid:%s version:%d - %v", un.UUID, r.Version, err)
+	}
+	a.dropKept(un.UUID)
+	return r
+}
+
+// cleanup executes given cleanup script of the payload directory as a
+// deployment script. The caller must hold the lock.
+func (u *Update) cleanup(script string) error {
+	sh, err := u.shellDeployer(scriptTypes[u.Notification.UUID])
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(u.dataDir(), u.Notification.Info.Name, filepath.FromSlash(script))
+	if sh.Stage != "" {
+		sh.Root = u.dataDir()
+		if sh, filename, err = sh.staged(filename); err != nil {
+			return err
+		}
+	}
+	log.Printf("executing cleanup script uuid:%s version:%d file:%s",
+		u.Notification.UUID, u.Notification.Version, filename)
+	if err := sh.deployFile(filename, time.Duration(u.deployTimeout())*time.Second); err != nil {
+		log.Printf("ERROR: executed cleanup script with error uuid:%s version:%d file:%s - %v",
+			u.Notification.UUID, u.Notification.Version, script, err)
+		return err
+	}
+	log.Printf("executed cleanup script uuid:%s version:%d file:%s",
+		u.Notification.UUID, u.Notification.Version, script)
+	return nil
+}
+
+// broadcastUninstall applies given signed notice and broadcasts it over the
+// overlay.
+func (a *Agent) broadcastUninstall(un *UninstallNotice) (UninstallResult, error) {
+	if err := un.Validate(); err != nil {
+		return UninstallResult{}, err
+	}
+	if err := un.Verify(a.PublicKey); err != nil {
+		return UninstallResult{}, errUpdateVerificationFailed
+	}
+	r := a.uninstall(un)
+	if a.Overlay == nil {
+		return r, errConnNotOpened
+	}
+	b, err := bencode.EncodeBytes(OperatorMessage{Uninstall: un})
+	if err != nil {
+		return r, err
+	}
+	_, err = a.Overlay.Write(b)
+	return r, err
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestUninstallNotice(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	un := UninstallNotice{UUID: UUIDShell, MaxVersion: 5, Cleanup: "cleanup.sh",
+		Timestamp: now.UnixNano(), By: "operator"}
+	if err = un.Validate(); err != nil {
+		t.Errorf("valid notice: %v", err)
+	}
+	if err = un.SignWith(KeySigner{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err = un.Verify(&key.PublicKey); err != nil {
+		t.Errorf("valid notice: %v", err)
+	}
+	un.MaxVersion = 0
+	if err = un.Verify(&key.PublicKey); err == nil {
+		t.Error("modified notice must fail the verification")
+	}
+	un.MaxVersion = 5
+
+	// the notice applies to the versions up to the ceiling created before it,
+	// hence a replay does not remove a later version
+	created := now.Add(-time.Hour).Unix()
+	for _, test := range []struct {
+		n       Notification
+		matches bool
+	}{
+		{Notification{UUID: UUIDShell, Version: 5, CreationDate: created}, true},
+		{Notification{UUID: UUIDShell, Version: 6, CreationDate: created}, false},
+		{Notification{UUID: UUIDApk, Version: 1, CreationDate: created}, false},
+		{Notification{UUID: UUIDShell, Version: 1, CreationDate: now.Add(time.Hour).Unix()}, false},
+	} {
+		if un.matches(&test.n) != test.matches {
+			t.Errorf("uuid:%s version:%d must match: %v", test.n.UUID, test.n.Version, test.matches)
+		}
+	}
+	un.MaxVersion = 0
+	if !un.matches(&Notification{UUID: UUIDShell, Version: 100, CreationDate: created}) {
+		t.Error("notice without version ceiling must match any version")
+	}
+
+	for _, cleanup := range []string{"/bin/rm", "../x.sh", "..", "a/../../x.sh", "./x.sh"} {
+		un.Cleanup = cleanup
+		if un.Validate() == nil {
+			t.Errorf("cleanup %s outside the payload is accepted", cleanup)
+		}
+	}
+	if (&UninstallNotice{}).Validate() == nil {
+		t.Error("notice without UUID is accepted")
+	}
+}
@@ -6,13 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/anacrolix/torrent"
@@ -33,13 +33,84 @@ const (
 	// $ uuidgen --sha1 --namespace @oid --name /bin/sh
 	UUIDShell = "f5adf0cb-b0e1-5a22-97f1-09092f566438"
 
+	// UUIDPowerShell is the UUID of updates that uses PowerShell script
+	// for deployment.
+	// Generated by invoking:
+	// $ uuidgen --sha1 --namespace @oid --name powershell.exe
+	UUIDPowerShell = "0b145023-7044-54bd-8427-2550b12ca0a3"
+
+	// UUIDBatch is the UUID of updates that uses batch script (cmd.exe)
+	// for deployment.
+	// Generated by invoking:
+	// $ uuidgen --sha1 --namespace @oid --name cmd.exe
+	UUIDBatch = "96be8097-63f9-56b1-8410-b63072639c99"
+
+	// UUIDConfig is the UUID of updates whose payload is a partial agent
+	// config document, which is merged into the configurations of the
+	// agents (see deployConfig).
+	// Generated by invoking:
+	// $ uuidgen --sha1 --namespace @oid --name p2pupdate-config
+	UUIDConfig = "a8e32778-b161-5ce0-bdf5-1f37fda4878b"
+
 	// DeployFailsLimit is the maximum fails of deployment. Exceeding this value
 	// means that the update should not be deployed.
 	DeployFailsLimit = 5
 
 	// ShellExecutionTimeout is the maximum execution time of a shell script
-	// before timeout.
+	// before timeout, unless the notification or the configuration sets
+	// another one (see deployTimeout).
 	ShellExecutionTimeout = 600 // in seconds
+
+	// DefaultSaveInterval is the minimum interval between the saves of the
+	// metadata of an update, unless the change is critical.
+	DefaultSaveInterval = 30 // in seconds
+)
+
+// UpdateState is the persisted lifecycle state of an Update.
+type UpdateState string
+
+const (
+	// UpdatePending means the update has been accepted but its download has
+	// not been started.
+	UpdatePending UpdateState = "pending"
+
+	// UpdateDownloading means the update file is being downloaded.
+	UpdateDownloading UpdateState = "downloading"
+
+	// UpdateDownloaded means the update file is complete and waiting to be
+	// deployed (or only seeded by proxy agents).
+	UpdateDownloaded UpdateState = "downloaded"
+
+	// UpdateDeploying means a deployer is executing the update.
+	UpdateDeploying UpdateState = "deploying"
+
+	// UpdateDeployed means the update has been deployed successfully.
+	UpdateDeployed UpdateState = "deployed"
+
+	// UpdateFailed means the deployment failed more than DeployFailsLimit.
+	UpdateFailed UpdateState = "failed"
+
+	// UpdateFailedDownload means the download made no progress until the
+	// stall deadline, which is given by Reason.
+	UpdateFailedDownload UpdateState = "failed-download"
+
+	// UpdateFailedDiskSpace means the payload does not fit in the free space
+	// of the data directory, hence the update is not started, which is
+	// given by Reason (see checkDiskSpace).
+	UpdateFailedDiskSpace UpdateState = "failed-disk-space"
+
+	// UpdateWaiting means the update is complete but its deployment waits
+	// for a condition, e.g. its group predecessors, which is given by
+	// Reason.
+	UpdateWaiting UpdateState = "waiting"
+
+	// UpdateBlocked means the update will not be deployed because one of
+	// its group predecessors has failed.
+	UpdateBlocked UpdateState = "blocked"
+
+	// UpdateAwaitingApproval means the update is complete but it must be
+	// approved by an operator before it is deployed.
+	UpdateAwaitingApproval UpdateState = "awaiting-approval"
 )
 
 // Update represents a system update that should be downloaded and deployed on
@@ -48,54 +119,443 @@ type Update struct {
 	sync.RWMutex
 
 	Notification Notification `json:"notification"`
+	State        UpdateState  `json:"state"`
 	Deployed     time.Time    `json:"deployed"`
 	Source       string       `json:"source"`
 	Stopped      bool         `json:"stopped"`
 	Sent         bool         `json:"sent"`
 	DeployFails  int          `json:"deploy-fails"`
 	Missing      int64        `json:"missing"`
+	Reason       string       `json:"reason,omitempty"` // why it is waiting, blocked or failed
+	Downloaded   time.Time    `json:"downloaded"`
+	Approval     *Approval    `json:"approval,omitempty"` // operator's decision
+
+	// Control is the latest remote stop or start of the update by an
+	// operator (see ControlNotice).
+	Control *RemoteControl `json:"control,omitempty"`
+
+	// SchemaVersion is the version of the metadata format (see
+	// SchemaVersion), which is 0 for the files written without it.
+	SchemaVersion int `json:"schema-version"`
+
+	// PendingReport is the deployment report that has not been received
+	// by the server yet.
+	PendingReport *DeployReport `json:"pending-report,omitempty"`
+
+	// Namespace is the name of the namespace of the update, which is empty
+	// for the default namespace.
+	Namespace string `json:"namespace,omitempty"`
+
+	// VerifiedClean is the marker of the payload that was complete and
+	// verified when the agent was stopped gracefully.
+	VerifiedClean *CleanMarker `json:"verified-clean,omitempty"`
+
+	// DeltaSource is the patch of a delta update given to the submitting
+	// agent, and DeltaFailed is true once the patch could not be applied,
+	// hence the payload is downloaded.
+	DeltaSource string `json:"delta-source,omitempty"`
+	DeltaFailed bool   `json:"delta-failed,omitempty"`
+
+	// SupersededBy is the newer version of an older version kept seeding,
+	// which is never deployed again unless it is rolled back to (see
+	// keepVersion).
+	SupersededBy uint64 `json:"superseded-by,omitempty"`
+
+	// Previous is the deployed version kept with its payload until this
+	// version is deployed, which is deployed again if this version fails
+	// (see rollback).
+	Previous *Update `json:"previous,omitempty"`
+
+	// RolledBack is the rollback of this version to the previous one, and
+	// RolledBackFrom is the version rolled back to this one, which is
+	// refused with the older ones.
+	RolledBack     *Rollback `json:"rolled-back,omitempty"`
+	RolledBackFrom uint64    `json:"rolled-back-from,omitempty"`
+
+	// DeployOutput is the end of the output of the scripts of the last
+	// deployment, DeployExitCode is the exit code of the last script, -1
+	// if it was killed, and DeployTimedOut is true if it was killed by the
+	// timeout (see DeployOutput).
+	DeployOutput   string `json:"deploy-output,omitempty"`
+	DeployExitCode int    `json:"deploy-exit-code,omitempty"`
+	DeployTimedOut bool   `json:"deploy-timed-out,omitempty"`
+
+	// DeployTimeout is the execution timeout in seconds of the scripts of
+	// the last deployment (see deployTimeout).
+	DeployTimeout int `json:"deploy-timeout,omitempty"`
+
+	// NextDeploy is the time of the next retry of a failed deployment
+	// (see scheduleRetry).
+	NextDeploy time.Time `json:"next-deploy,omitempty"`
+
+	// SeedingFinished is the time when the deployed update reached the seed
+	// limits of the configuration, hence it is stopped (see checkSeeding).
+	SeedingFinished time.Time `json:"seeding-finished,omitempty"`
+
+	// Staged is true while the update is downloaded but not deployed until
+	// a deploy command, when the agent only stages the updates.
+	Staged bool `json:"staged,omitempty"`
 
 	torrent *torrent.Torrent
+	patch   *torrent.Torrent // of the patch of a delta update
 	agent   *Agent
+	ns      *Namespace // nil until the notification is routed
+
+	// lazy is true if the verification of the payload was skipped on
+	// start, hence it must be fully checked before the deployment.
+	lazy bool
+
+	// ttl is the TTL of the overlay message that carried the notification,
+	// or 0 if the notification was not received from the overlay.
+	ttl TTL
+
+	// lastTick is the UnixNano time of the last monitor iteration, or 0 if
+	// the monitor is not running. It must be accessed atomically.
+	lastTick int64
+
+	// reportRetry is when the pending report is sent again.
+	reportRetry time.Time
+
+	// canaryStatus is the canary status polled from the server at
+	// canaryChecked.
+	canaryStatus  CanaryStatus
+	canaryChecked time.Time
+
+	// clockWarned is true if the wrong local clock has been logged.
+	clockWarned bool
+
+	// retained is true if the update is kept as the previous version of
+	// the next one, hence its payload is in previousDir, and rollingBack is
+	// true once its rollback has started.
+	retained    bool
+	rollingBack bool
+
+	// fallback is the state of the download over HTTPS.
+	fallback fallbackState
+
+	// reannounced is the state of the re-announces of the torrent.
+	reannounced reannounceState
+
+	// stall is the state of the stall detection of the download.
+	stall stallState
+
+	// preempted is the state of the preemption of the download by an
+	// update of higher priority.
+	preempted preemptState
+
+	// delta is the state of the patch of a delta update.
+	delta deltaState
+
+	// artifacts are the digests of the files of the payload served to the
+	// local consumers.
+	artifacts artifactDigests
+
+	// statusLog is when the status of the update was last logged.
+	statusLog statusLog
+
+	// progressLog is when the progress of the update was last sent to the
+	// server.
+	progressLog progressLog
+
+	// dirty is true if the metadata have changed since savedAt, and
+	// deleted is true once the metadata file is deleted, hence it must
+	// not be written anymore.
+	dirty   bool
+	savedAt time.Time
+	deleted bool
+}
+
+// UpdateStatus is the structured status of an Update, which is reported to
+// external systems.
+type UpdateStatus struct {
+	Namespace   string         `json:"namespace,omitempty"`
+	UUID        string         `json:"uuid"`
+	Version     uint64         `json:"version"`
+	State       UpdateState    `json:"state"`
+	Stopped     bool           `json:"stopped"`
+	RemoteStop  *RemoteControl `json:"remote-stop,omitempty"` // the update is stopped by an operator
+	Deployed    time.Time      `json:"deployed"`
+	DeployFails int            `json:"deploy-fails"`
+	Reason      string         `json:"reason,omitempty"`
+	Group       *UpdateGroup   `json:"group,omitempty"`
+	Rollout     int            `json:"rollout-percent,omitempty"`
+	Priority    string         `json:"priority"`
+	PreemptedBy string         `json:"preempted-by,omitempty"`     // UUID of the preempting update
+	Patching    bool           `json:"patching,omitempty"`         // the payload is rebuilt from a patch
+	Previous    uint64         `json:"previous-version,omitempty"` // kept until the update is deployed
+	RolledBack  *Rollback      `json:"rolled-back,omitempty"`
+	RollbackOf  uint64         `json:"rolled-back-from,omitempty"` // the version rolled back to this one
+	Scheduled   *time.Time     `json:"scheduled,omitempty"`
+	NextDeploy  *time.Time     `json:"next-deploy,omitempty"` // retry of a failed deployment
+	Staged      bool           `json:"staged,omitempty"`      // waiting for a deploy command
+	Trackerless bool           `json:"trackerless,omitempty"`
+	SHA256      string         `json:"sha256,omitempty"`
+	TraceID     string         `json:"trace-id,omitempty"`
+	Title       string         `json:"title"`
+	Notes       string         `json:"notes"`
+	Bucket      int            `json:"rollout-bucket"`
+	Completed   int64          `json:"completed"`
+	Missing     int64          `json:"missing"`
+	Seeding     bool           `json:"seeding"`
+	Seeded      *time.Time     `json:"seeding-finished,omitempty"` // the seed limits are reached
+	TotalPeers  int            `json:"total-peers"`
+	ActivePeers int            `json:"active-peers"`
+	Timestamp   time.Time      `json:"timestamp"`
 }
 
 // NewUpdate returns an Update instance from given notification and agent.
 func NewUpdate(n Notification, a *Agent) *Update {
 	return &Update{
-		Notification: n,
-		Stopped:      true,
-		Sent:         false,
-		agent:        a,
+		Notification:  n,
+		State:         UpdatePending,
+		Stopped:       true,
+		Sent:          false,
+		SchemaVersion: SchemaVersion,
+		agent:         a,
 	}
 }
 
 // LoadUpdateFromFile loads Update description from given filename.
 func LoadUpdateFromFile(filename string, a *Agent) (*Update, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUpdate(b, a)
+}
+
+// loadUpdate loads the Update of given key from given bucket of the metadata
+// store of the agent.
+func (a *Agent) loadUpdate(bucket, key string) (*Update, error) {
+	b, err := a.metadata().Get(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return decodeUpdate(b, a)
+}
+
+// decodeUpdate decodes given Update metadata of given agent.
+func decodeUpdate(b []byte, a *Agent) (*Update, error) {
 	u := Update{
 		Stopped: true,
 		Sent:    false,
 		agent:   a,
 	}
-	f, err := os.Open(filename)
+	err := json.Unmarshal(b, &u)
 	if err != nil {
 		return nil, err
 	}
-	return &u, json.NewDecoder(f).Decode(&u)
+	if err = checkSchema(u.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if a != nil {
+		if u.ns = a.namespace(u.Namespace); u.ns == nil {
+			return nil, fmt.Errorf("unknown namespace '%s'", u.Namespace)
+		}
+	}
+	if p := u.Previous; p != nil {
+		// its metadata are saved with this version only
+		p.agent, p.ns, p.Stopped, p.retained, p.deleted = a, u.ns, true, true, true
+	}
+	u.migrate()
+	return &u, nil
 }
 
-// MetadataFilename returns the name of the update metadata file.
+// migrate sets the State of an Update loaded from a metadata file.
+//
+// Metadata files written before State was introduced are migrated using the
+// Deployed timestamp: any non-zero value means the update has been deployed,
+// even if it was written while the clock was not synchronized (e.g. 1970).
+//
+// An update persisted as UpdateDeploying was interrupted in the middle of its
+// deployment, for example when the deployment script rebooted the node. This
+// is counted as a failed deployment, which is retried later as the others, so
+// that a script that never finishes is not re-executed in a loop.
+//
+// The migrated update is stamped with the current schema version, since it
+// is written in the current format when it is saved.
+func (u *Update) migrate() {
+	switch u.State {
+	case "":
+		if !u.Deployed.IsZero() {
+			u.State = UpdateDeployed
+		} else if u.DeployFails > DeployFailsLimit {
+			u.State = UpdateFailed
+		} else {
+			u.State = UpdatePending
+		}
+	case UpdateDeploying:
+		u.logf("deployment of uuid:%s version:%d was interrupted",
+			u.Notification.UUID, u.Notification.Version)
+		u.DeployFails++
+		if u.DeployFails > DeployFailsLimit {
+			u.State = UpdateFailed
+		} else {
+			u.State = UpdateDownloaded
+		}
+		u.scheduleRetry()
+	}
+	u.SchemaVersion = SchemaVersion
+}
+
+// MetadataFilename returns the name of the update metadata file of the file
+// layout.
 func (u *Update) MetadataFilename() string {
-	filename := fmt.Sprintf("%s-v%d", u.Notification.UUID, u.Notification.Version)
-	return filepath.Join(u.agent.metadataDir, filename)
+	return filepath.Join(u.namespace().metadataDir, u.metadataKey())
+}
+
+// metadataKey returns the key of the update metadata in the bucket of its
+// namespace.
+func (u *Update) metadataKey() string {
+	return fmt.Sprintf("%s-v%d", u.Notification.UUID, u.Notification.Version)
+}
+
+// metadataBucket returns the bucket of the update metadata.
+func (u *Update) metadataBucket() string {
+	return updatesBucket(u.namespace().Name)
 }
 
 // Save writes Update metadata to file.
 func (u *Update) Save() error {
-	f, err := os.OpenFile(u.MetadataFilename(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	u.Lock()
+	defer u.Unlock()
+	return u.save()
+}
+
+// save writes Update metadata to the metadata store, unless they have been
+// deleted. The caller must hold the lock.
+func (u *Update) save() error {
+	if u.deleted {
+		return nil
+	}
+	b, err := json.Marshal(u)
 	if err != nil {
 		return err
 	}
-	return u.Write(f)
+	if err = u.agent.metadata().Put(u.metadataBucket(), u.metadataKey(), b); err != nil {
+		return err
+	}
+	u.dirty = false
+	u.savedAt = time.Now()
+	metrics.Inc("update.metadata_writes", "namespace", u.namespace().label())
+	return nil
+}
+
+// flush saves the changed metadata, at most once every save interval unless
+// the change is critical, e.g. a deployment outcome. The caller must hold
+// the lock.
+func (u *Update) flush(critical bool) error {
+	if !u.dirty {
+		return nil
+	}
+	interval := time.Duration(u.agent.Config.SaveInterval) * time.Second
+	if interval <= 0 {
+		interval = DefaultSaveInterval * time.Second
+	}
+	if !critical && time.Since(u.savedAt) < interval {
+		return nil
+	}
+	return u.save()
+}
+
+// setState changes the State of the update. It returns true if the state has
+// changed, which means the update should be saved. The caller must hold the
+// lock.
+func (u *Update) setState(state UpdateState) bool {
+	if u.State == state {
+		return false
+	}
+	u.logf("update uuid:%s version:%d state %s -> %s",
+		u.Notification.UUID, u.Notification.Version, u.State, state)
+	if u.agent != nil {
+		u.agent.events.Add(AgentEvent{
+			Type:    EventStateChanged,
+			UUID:    u.Notification.UUID,
+			Version: u.Notification.Version,
+			Trace:   u.Notification.TraceID,
+			From:    string(u.State),
+			To:      string(state),
+		})
+	}
+	u.State = state
+	u.agent.updateStateChanged(u)
+	return true
+}
+
+// Status returns the structured status of the update.
+func (u *Update) Status() UpdateStatus {
+	u.RLock()
+	defer u.RUnlock()
+	return u.status()
+}
+
+// status returns the structured status of the update. The caller must hold
+// the lock.
+func (u *Update) status() UpdateStatus {
+	s := UpdateStatus{
+		Namespace:   u.Namespace,
+		UUID:        u.Notification.UUID,
+		Version:     u.Notification.Version,
+		State:       u.State,
+		Stopped:     u.Stopped,
+		Deployed:    u.Deployed,
+		DeployFails: u.DeployFails,
+		Reason:      u.Reason,
+		Group:       u.Notification.Group,
+		Rollout:     u.Notification.RolloutPercent,
+		Priority:    u.Notification.priority(),
+		PreemptedBy: u.preempted.by,
+		RolledBack:  u.RolledBack,
+		RollbackOf:  u.RolledBackFrom,
+		Staged:      u.Staged,
+		Patching:    u.delta.patching,
+		Trackerless: u.Notification.Trackerless(),
+		SHA256:      u.Notification.SHA256,
+		TraceID:     u.Notification.TraceID,
+		Title:       u.Notification.title(),
+		Notes:       u.Notification.notes(),
+		Missing:     u.Missing,
+		Timestamp:   time.Now(),
+	}
+	if u.Previous != nil {
+		s.Previous = u.Previous.Notification.Version
+	}
+	if !u.NextDeploy.IsZero() {
+		t := u.NextDeploy
+		s.NextDeploy = &t
+	}
+	if t := u.SeedingFinished; !t.IsZero() {
+		s.Seeded = &t
+	}
+	if u.remotelyStopped() {
+		s.RemoteStop = u.Control
+		s.Reason = fmt.Sprintf("stopped remotely by %s", u.Control.By)
+	}
+	if u.agent != nil {
+		s.Bucket = rolloutBucket(u.agent.ID, u.Notification.UUID)
+		t, _ := scheduleTime(&u.Notification, u.Downloaded, time.Now(), u.agent.Config.Schedule)
+		if !t.IsZero() {
+			s.Scheduled = &t
+		}
+	}
+	if u.torrent != nil {
+		stats := u.torrent.Stats()
+		s.Completed = u.torrent.BytesCompleted()
+		s.Missing = u.torrent.BytesMissing()
+		s.Seeding = u.torrent.Seeding()
+		s.TotalPeers = stats.TotalPeers
+		s.ActivePeers = stats.ActivePeers
+	}
+	if d := u.stall.duration(time.Now()); d > 0 && u.State == UpdateDownloading {
+		s.Reason = stallReason(d)
+	}
+	return s
+}
+
+// needsDeploy returns true if the update has not been deployed nor failed.
+func (u *Update) needsDeploy() bool {
+	return u.State != UpdateDeployed && u.State != UpdateFailed && u.State != UpdateFailedDownload &&
+		u.State != UpdateFailedDiskSpace
 }
 
 // Write writes this Update instance to Writer 'w'.
@@ -105,23 +565,62 @@ func (u *Update) Write(w io.Writer) error {
 	return json.NewEncoder(w).Encode(u)
 }
 
-// Verify verifies the update. It returns an error if the verification fails,
-// otherwise nil.
+// Verify verifies the update by the key of its namespace. A new notification
+// is routed to the namespace whose key verifies it. It returns an error if
+// the verification fails, otherwise nil.
 func (u *Update) Verify(a *Agent) error {
-	if err := u.Notification.Verify(a.PublicKey); err != nil {
+	var err error
+	if u.ns == nil {
+		var ns *Namespace
+		if ns, err = a.routeNotification(&u.Notification); err == nil {
+			u.ns, u.Namespace = ns, ns.Name
+		}
+	} else if !u.ns.accepts(&u.Notification) {
+		err = fmt.Errorf("notification is not accepted by namespace '%s'", u.ns.Name)
+	}
+	if err != nil {
 		log.Printf("verification failed: %v", err)
+		metrics.Inc("update.verification_failures", "namespace", u.ns.label())
 		return errUpdateVerificationFailed
 	}
 	return nil
 }
 
+// validate returns an error if a field of the notification is invalid.
+func (n *Notification) validate() error {
+	if err := n.Group.Validate(); err != nil {
+		return err
+	}
+	if err := validateTraceID(n.TraceID); err != nil {
+		return err
+	}
+	if err := validatePlatforms(n.Platforms); err != nil {
+		return err
+	}
+	if n.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d, it must be a positive number of seconds", n.Timeout)
+	}
+	if err := validateFallbackURLs(n.FallbackURLs); err != nil {
+		return err
+	}
+	if err := validatePriority(n.Priority); err != nil {
+		return err
+	}
+	if err := validateReleaseNotes(n.Title, n.Notes); err != nil {
+		return err
+	}
+	if err := n.Delta.Validate(n); err != nil {
+		return err
+	}
+	return n.validatePaths()
+}
+
 // Start starts the update's lifecycle.
 func (u *Update) Start(a *Agent) error {
 	u.Lock()
 	defer u.Unlock()
 
 	var (
-		mi  *metainfo.MetaInfo
 		old *Update
 		err error
 	)
@@ -129,116 +628,490 @@ func (u *Update) Start(a *Agent) error {
 	if err = u.Verify(a); err != nil {
 		return err
 	}
+	if err = checkSchema(u.Notification.SchemaVersion); err != nil {
+		a.refuseSchema(&u.Notification, err)
+		return err
+	}
+	// before the torrent storage writes anything
+	if err = u.Notification.validate(); err != nil {
+		return invalidNotification{err}
+	}
+	if err = a.checkPlatform(&u.Notification); err != nil {
+		return err
+	}
+	if u.State == "" {
+		u.State = UpdatePending
+	}
+	if u.SupersededBy > 0 {
+		// an older version reloaded on start, which only seeds
+		if !a.keepVersion(u) {
+			// once the lock is released
+			go a.deleteKept(u)
+			return nil
+		}
+		return u.activate(a)
+	}
 
 	// Remove existing update that has the same UUID. If the existing update
 	// is newer, then return an error.
-	if old, err = a.addUpdate(u); err != nil {
+	if old, err = a.addUpdate(u); err == errUpdateIsAlreadyExist {
+		existing := a.getUpdate(u.key())
+		if existing != nil && existing.supersede(&u.Notification, u.ttl) {
+			return nil
+		}
+		if existing != nil {
+			if retried, rerr := a.retryDiskSpace(existing); retried {
+				return rerr
+			}
+		}
+		return err
+	} else if err != nil {
 		return err
 	}
+	u.stage(a)
 	if old == nil {
-		log.Printf("older update of uuid:%s does not exist", u.Notification.UUID)
+		u.logf("older update of uuid:%s does not exist", u.Notification.UUID)
 	} else {
+		old.RLock()
+		awaiting := old.State == UpdateAwaitingApproval
+		control := old.Control
+		old.RUnlock()
+		// a remote stop of any version applies to the new one
+		if control != nil && control.Action == ControlStop && control.Version == 0 && u.Control == nil {
+			u.Control = control
+		}
+		if awaiting {
+			a.audit(AuditSuperseded, &old.Notification, "",
+				fmt.Sprintf("pending approval is cancelled by version %d", u.Notification.Version))
+		}
+		keep := u.keepsVersion(a, old)
 		old.Stop()
+		if keep {
+			// the older version seeds from the directory of its version
+			// until it falls off the kept ones
+			old.Lock()
+			if err = old.markSuperseded(u.Notification.Version); err != nil {
+				u.logf("WARNING: failed keeping update uuid:%s version:%d seeding - %v",
+					old.Notification.UUID, old.Notification.Version, err)
+				keep = false
+			} else if u.Previous == nil && old.Previous != nil {
+				u.Previous, old.Previous = old.Previous, nil
+			}
+			old.Unlock()
+		}
+		if keep {
+			u.reusePiecesOf(old)
+			old.keepDeltaBase(a)
+			if a.keepVersion(old) {
+				old.Lock()
+				if err = old.activate(a); err != nil {
+					old.logf("WARNING: failed seeding kept update uuid:%s version:%d - %v",
+						old.Notification.UUID, old.Notification.Version, err)
+				}
+				old.Unlock()
+			}
+			return u.activate(a)
+		}
+		u.reusePiecesOf(old)
+		kept := u.keepPrevious(a, old)
+		old.keepDeltaBase(a)
+		if kept {
+			// before the metadata of the previous version are deleted
+			if err = u.save(); err != nil {
+				u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+					u.Notification.UUID, u.Notification.Version, err)
+			}
+		}
 		if err = old.Delete(); err != nil {
-			log.Printf("WARNING: failed to delete update uuid:%s version:%d - %v",
+			old.logf("WARNING: failed to delete update uuid:%s version:%d - %v",
 				old.Notification.UUID, old.Notification.Version, err)
 		}
 	}
+	return u.activate(a)
+}
+
+// activate starts the torrent and the monitor of the update, unless it is
+// stopped remotely. The caller must hold the lock.
+func (u *Update) activate(a *Agent) error {
+	var (
+		mi  *metainfo.MetaInfo
+		err error
+	)
+
+	if u.remotelyStopped() {
+		u.logf("update uuid:%s version:%d is stopped remotely by %s, it is not started",
+			u.Notification.UUID, u.Notification.Version, u.Control.By)
+		u.Stopped = true
+		return u.save()
+	}
+	if u.seedingFinished() {
+		u.logf("update uuid:%s version:%d has finished seeding at %s, it is not started",
+			u.Notification.UUID, u.Notification.Version, u.SeedingFinished.Format(time.RFC3339))
+		u.Stopped = true
+		return nil
+	}
 
 	// activate torrent
-	log.Printf("starting update: %s", u.String())
+	u.logf("starting update: %s%s", u.String(), titleSuffix(u.Notification.title()))
+	if u.Notification.Trackerless() {
+		if a.Config.BitTorrent.NoDHT || a.Config.NoUDP {
+			u.logf("WARNING: update uuid:%s version:%d is trackerless and DHT is disabled,"+
+				" its peers are only found via the overlay", u.Notification.UUID, u.Notification.Version)
+		} else {
+			u.logf("update uuid:%s version:%d is trackerless, its peers are found via DHT"+
+				" and the overlay", u.Notification.UUID, u.Notification.Version)
+		}
+	} else if strings.Contains(u.Notification.Announce, trackerTokenPlaceholder) &&
+		len(a.Config.BitTorrent.TrackerToken) == 0 {
+		u.logf("WARNING: update uuid:%s version:%d has a tracker requiring a token but none is"+
+			" configured (bittorrent.tracker-token), its announces will be refused",
+			u.Notification.UUID, u.Notification.Version)
+	}
 	if mi, err = u.Notification.torrentMetainfo(); err != nil {
 		return fmt.Errorf("failed generating torrent metainfo: %v", err)
 	}
-	if u.torrent, err = a.torrentClient.AddTorrent(mi); err != nil {
+	err = u.checkDiskSpace(a)
+	for err != nil && u.SupersededBy == 0 && a.evictOldestKept() {
+		// the oldest kept versions make room for the current ones
+		err = u.checkDiskSpace(a)
+	}
+	if err != nil {
+		return u.failDiskSpace(err)
+	} else if u.State == UpdateFailedDiskSpace {
+		u.setState(UpdatePending)
+		u.Reason = ""
+	}
+	u.importPreimaged()
+	u.useCleanMarker(mi.HashInfoBytes())
+	if u.torrent, err = u.addTorrent(mi); err != nil {
 		return fmt.Errorf("failed adding torrent: %v", err)
 	}
+	if err = u.startDelta(a); err != nil {
+		return err
+	}
 	u.Stopped = false
-	log.Printf("started update: %s", u.String())
+	u.logf("started update: %s", u.String())
+	a.notifyWebhooks(u, EventUpdateReceived, nil)
 
-	// spawn a go-routine that monitors torrent's status
+	// spawn a go-routine that monitors torrent's status, which saves the
+	// metadata on its first iteration
+	u.dirty = true
 	go u.monitor(a)
 
 	return nil
 }
 
 func (u *Update) monitor(a *Agent) {
-	toSave := true
+	defer atomic.StoreInt64(&u.lastTick, 0)
 	for {
-		time.Sleep(5 * time.Second)
+		atomic.StoreInt64(&u.lastTick, time.Now().UnixNano())
+		select {
+		case <-time.After(5 * time.Second):
+		case <-a.maintenance.Lifted():
+			// the updates completed during the maintenance are deployed
+			// immediately
+		}
+
+		// the predecessors and the canaries are checked before locking
+		// this update since they may be deploying while holding their
+		// locks, and the canary status is polled from the server
+		u.RLock()
+		namespace, group := u.Namespace, u.Notification.Group
+		u.RUnlock()
+		holdState, holdReason := a.groupState(namespace, group)
+		if holdState == "" {
+			holdState, holdReason = a.canaryState(u)
+		}
+		a.deliverReport(u)
 
 		u.Lock()
+		if u.SupersededBy > 0 {
+			// a kept version seeds until it is stopped, but it shares
+			// its key with the current version
+			u.flush(true)
+			u.Unlock()
+			break
+		}
 		if u.Stopped || u.torrent == nil {
+			a.priorities.Set(u.key(), "", "", false)
+			a.deploys.Leave(u.key())
+			u.flush(true)
+			u.Unlock()
 			break
 		}
+		critical := false
 		if !u.Sent {
-			if err := u.Notification.Write(a.Overlay); err != nil {
-				log.Printf("failed sending update uuid:%s version:%d : %v",
+			if err := u.send(a); err == errTTLExpired {
+				u.logf("not forwarding update uuid:%s version:%d : %v",
+					u.Notification.UUID, u.Notification.Version, err)
+				u.Sent = true
+				u.dirty = true
+			} else if err != nil {
+				u.logf("failed sending update uuid:%s version:%d : %v",
 					u.Notification.UUID, u.Notification.Version, err)
 			} else {
+				u.logf("forwarded update uuid:%s version:%d to the overlay",
+					u.Notification.UUID, u.Notification.Version)
 				u.Sent = true
-				toSave = true
+				u.dirty = true
+				metrics.Inc("overlay.messages", "type", "sent")
 			}
 		}
 		u.Missing = u.torrent.BytesMissing()
+		if total := u.torrent.BytesCompleted() + u.Missing; total > 0 {
+			metrics.Set("update.progress", (total-u.Missing)*100/total,
+				"uuid", u.Notification.UUID, "namespace", u.ns.label())
+		}
+		a.priorities.Set(u.key(), u.Notification.UUID, u.Notification.priority(), u.Missing > 0)
 		if u.Missing > 0 {
+			if u.needsDeploy() && u.setState(UpdateDownloading) {
+				u.dirty = true
+			}
 			<-u.torrent.GotInfo()
-			u.torrent.DownloadAll()
-		} else if !a.Config.Proxy && u.Deployed.Year() < 2000 {
-			u.deploy()
-			toSave = true
+			u.torrent.AddPeers(a.overlayTorrentPeers())
+			if u.State != UpdateFailedDownload && !u.checkPreemption(a) && !u.checkDelta(a) {
+				u.torrent.DownloadAll()
+				u.checkReannounce(a)
+				u.checkFallback(a)
+				u.checkStall(a)
+			}
+		} else if u.State == UpdatePending || u.State == UpdateDownloading || u.State == UpdateFailedDownload {
+			u.Downloaded = time.Now()
+			if u.checkDigest("download") {
+				u.logf("downloaded update uuid:%s version:%d", u.Notification.UUID, u.Notification.Version)
+				u.setState(UpdateDownloaded)
+				u.Reason = ""
+				a.notifyWebhooks(u, EventDownloadComplete, nil)
+			} else {
+				critical = true
+			}
+			u.dirty = true
+		} else if !a.Config.Proxy && (u.needsDeploy() || u.retriesFailed()) {
+			state, reason := u.hold(holdState, holdReason)
+			if state != "" {
+				a.deploys.Leave(u.key())
+			} else if !a.deploys.Acquire(u.key(), u.Notification.priority(), u.Downloaded,
+				time.Duration(u.deployTimeout())*time.Second) {
+				state, reason = UpdateWaiting, a.deploys.Reason(u.key())
+			}
+			if state != "" && u.State == UpdateFailed {
+				// a failed update stays failed until it is retried
+				state = UpdateFailed
+			}
+			if state != "" {
+				changed := u.setState(state)
+				if changed && state == UpdateAwaitingApproval {
+					a.audit(AuditApprovalRequested, &u.Notification, "", "")
+				}
+				if changed || u.Reason != reason {
+					u.logf("update uuid:%s version:%d - %s",
+						u.Notification.UUID, u.Notification.Version, reason)
+					u.Reason = reason
+					u.dirty = true
+				}
+			} else {
+				u.Reason = ""
+				u.deployQueued(a)
+				u.dirty = true
+				critical = true
+			}
+		}
+		u.checkRollback(a)
+		finished := u.checkSeeding(a, time.Now())
+		u.logStatus(a.Config.Log)
+		u.sendProgress()
+		if err := u.flush(critical || finished); err != nil {
+			u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+				u.Notification.UUID, u.Notification.Version, err)
 		}
-		log.Println(u.String())
 		u.Unlock()
-
-		if toSave {
-			u.Save()
-			toSave = false
+		if finished {
+			// the monitor exits on the next iteration
+			u.Stop()
 		}
 	}
 }
 
+// hold returns the state and the reason why the complete update must not be
+// deployed yet, or an empty state if it can be deployed. The maintenance mode
+// of the agent pauses all deployments. The state of its group and canaries is
+// given by the caller. The agents whose tags do not match the selectors, or
+// whose platform is not targeted, never deploy the update. The canary agents
+// ignore the rollout. The scheduled time and the deploy window are conditions
+// as the others, hence the update is deployed at the latest of the times when
+// they are met. The staged updates wait for a deploy command. The operator's
+// approval is checked last, so that the update is only awaiting approval once
+// it can be deployed otherwise. The caller must hold the lock.
+func (u *Update) hold(state UpdateState, reason string) (UpdateState, string) {
+	if r := u.agent.maintenance.Reason(); len(r) > 0 {
+		return UpdateWaiting, r
+	}
+	if r := u.retryHold(); len(r) > 0 {
+		return UpdateWaiting, r
+	}
+	if !u.Notification.MatchTags(u.agent.Config.Tags) {
+		return UpdateWaiting, fmt.Sprintf("tags [%s] do not match selectors [%s]",
+			strings.Join(u.agent.Config.Tags, ","), strings.Join(u.Notification.Tags, " "))
+	}
+	if !u.Notification.MatchPlatform(u.agent.platform) {
+		return UpdateWaiting, fmt.Sprintf("platform %s is not in [%s]",
+			u.agent.platform, strings.Join(u.Notification.Platforms, " "))
+	}
+	if bucket := rolloutBucket(u.agent.ID, u.Notification.UUID); !u.Notification.InRollout(bucket) &&
+		!u.Notification.Canary.Includes(u.agent.ID) {
+		return UpdateWaiting, fmt.Sprintf("rollout bucket %d is outside rollout %d%%",
+			bucket, u.Notification.RolloutPercent)
+	}
+	if t := u.scheduled(); time.Now().Before(t) {
+		return UpdateWaiting, fmt.Sprintf("scheduled for %s", t.Format(time.RFC3339))
+	}
+	if r := u.agent.Config.DeployWindow.hold(time.Now()); len(r) > 0 {
+		return UpdateWaiting, r
+	}
+	if u.staged() {
+		return UpdateWaiting, stagedReason
+	}
+	if state != "" {
+		return state, reason
+	}
+	if u.agent.Config.Approval.requires(u.Notification.UUID) && !u.approved() {
+		return UpdateAwaitingApproval, "awaiting operator approval"
+	}
+	return "", ""
+}
+
+// supersede replaces the notification of this update with given notification
+// that supersedes it, without downloading the update again. The deployment
+// conditions are re-evaluated by the monitor and the new notification is
+// forwarded to the peers. It returns false if the notification does not
+// supersede the current one.
+func (u *Update) supersede(n *Notification, ttl TTL) bool {
+	u.Lock()
+	defer u.Unlock()
+	if !n.Supersedes(&u.Notification) {
+		return false
+	}
+	u.logf("notification of update uuid:%s version:%d is superseded (rollout %d%% -> %d%%,"+
+		" not before %d -> %d)", u.Notification.UUID, u.Notification.Version,
+		u.Notification.RolloutPercent, n.RolloutPercent, u.Notification.NotBefore, n.NotBefore)
+	u.Notification = *n
+	u.Sent = false
+	u.ttl = ttl
+	if err := u.save(); err != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+	return true
+}
+
+// send multicasts the notification to the overlay peers. A notification that
+// was received from the overlay is forwarded with a decremented TTL.
+func (u *Update) send(a *Agent) error {
+	if a.Overlay == nil {
+		return errConnNotOpened
+	}
+	var b bytes.Buffer
+	if err := u.Notification.Write(&b); err != nil {
+		return err
+	}
+	var err error
+	if u.ttl == 0 {
+		_, err = a.Overlay.Write(b.Bytes())
+	} else {
+		_, err = a.Overlay.Forward(b.Bytes(), u.ttl)
+	}
+	return err
+}
+
+// monitorAlive returns false if the monitor is running but has not completed
+// an iteration within given duration, i.e. it may be deadlocked.
+func (u *Update) monitorAlive(d time.Duration) bool {
+	t := atomic.LoadInt64(&u.lastTick)
+	return t == 0 || time.Since(time.Unix(0, t)) < d
+}
+
 // Stop stops the lifecycle of the update.
 func (u *Update) Stop() {
 	u.Lock()
 	defer u.Unlock()
-	log.Printf("stopping update: %v", u.String())
+	u.logf("stopping update: %v", u.String())
 	u.Stopped = true
 	if u.torrent != nil {
 		u.torrent.Drop()
 		<-u.torrent.Closed()
 		u.torrent = nil
 	}
-	log.Printf("stopped update: %v", u.String())
+	if u.patch != nil {
+		u.patch.Drop()
+		<-u.patch.Closed()
+		u.patch = nil
+	}
+	u.logf("stopped update: %v", u.String())
 }
 
 // Delete deletes this update files.
 func (u *Update) Delete() error {
 	u.Lock()
 	defer u.Unlock()
-	log.Printf("deleting update: %v", u.String())
+	u.logf("deleting update: %v", u.String())
 	if !u.Stopped {
 		return fmt.Errorf("update has not been stopped")
 	}
 
-	filename := filepath.Join(u.agent.dataDir, u.Notification.Info.Name)
-	if err := os.RemoveAll(filename); err != nil {
-		log.Printf("WARNING: failed removing update file %s", filename)
+	// the payload of a version kept for a rollback is removed once the
+	// next version does not need it anymore
+	if !u.retained {
+		u.removePayload()
 	}
+	u.dropPrevious()
+	u.deleteRolledBack()
+	u.removeDeployLog()
+	u.removeWorkDir()
 
-	filename = u.MetadataFilename()
-	if err := os.RemoveAll(filename); err != nil {
+	// the metadata are not saved anymore, even by a pending flush
+	u.deleted = true
+	if err := u.agent.metadata().Delete(u.metadataBucket(), u.metadataKey()); err != nil {
 		return errors.Wrapf(err, "failed deleting update uuid:%s version:%d",
 			u.Notification.UUID, u.Notification.Version)
 	}
 
-	log.Printf("deleted update: %v", u.String())
+	u.logf("deleted update: %v", u.String())
+	u.agent.notifyWebhooks(u, EventUpdateDeleted, nil)
 	return nil
 }
 
+// removePayload removes the files of the payload and of the patch of the
+// update. The payload of a version kept seeding is removed with the
+// directory of its version. The caller must hold the lock.
+func (u *Update) removePayload() {
+	filename, err := safeJoin(u.dataDir(), u.Notification.Info.Name)
+	if u.SupersededBy > 0 {
+		filename, err = u.versionDir(), nil
+	}
+	if err != nil {
+		log.Printf("WARNING: not removing update file - %v", err)
+	} else if err = os.RemoveAll(filename); err != nil {
+		log.Printf("WARNING: failed removing update file %s", filename)
+	}
+	if d := u.Notification.Delta; d != nil {
+		if filename, err = safeJoin(u.dataDir(), d.Info.Name); err != nil {
+			log.Printf("WARNING: not removing patch file - %v", err)
+		} else if err = os.RemoveAll(filename); err != nil {
+			log.Printf("WARNING: failed removing patch file %s", filename)
+		}
+	}
+}
+
 func (u *Update) String() string {
 	var b bytes.Buffer
-	b.WriteString(fmt.Sprintf("uuid:%v version:%d", u.Notification.UUID, u.Notification.Version))
+	b.WriteString(fmt.Sprintf("uuid:%v version:%d state:%s", u.Notification.UUID,
+		u.Notification.Version, u.State))
+	if u.Notification.Trackerless() {
+		b.WriteString(" trackerless")
+	}
+	if u.State == UpdateWaiting && len(u.Reason) > 0 {
+		b.WriteString(fmt.Sprintf(" reason:%q", u.Reason))
+	}
 	if u.torrent != nil {
 		b.WriteString(fmt.Sprintf(" completed/missing:%v/%v",
 			u.torrent.BytesCompleted(), u.torrent.BytesMissing()))
@@ -247,6 +1120,11 @@ func (u *Update) String() string {
 			fmt.Sprintf(" seeding:%v peers(total/active):%v/%v read/write:%v/%v",
 				u.torrent.Seeding(), stats.TotalPeers, stats.ActivePeers,
 				stats.BytesRead, stats.BytesWritten))
+		if u.agent != nil {
+			// the limits of the torrent client, 0 is unlimited
+			bw := u.agent.bandwidth.Status()
+			b.WriteString(fmt.Sprintf(" limit(up/down):%d/%dkbps", bw.UpKbps, bw.DownKbps))
+		}
 		s := u.torrent.PieceState(0)
 		b.WriteString(
 			fmt.Sprintf(" piece[0]checking:%v complete:%v ok:%v partial:%v priority:%v",
@@ -256,63 +1134,196 @@ func (u *Update) String() string {
 }
 
 func (u *Update) deploy() {
-	if u.DeployFails > DeployFailsLimit {
-		log.Printf("Too many deployment failures:%d uuid:%s version:%d",
-			u.DeployFails, u.Notification.UUID, u.Notification.Version)
+	// the payload is verified again since it may have been modified on
+	// disk while waiting for the deployment
+	if !u.checkDigest("deploy") || !u.verifyLazy() {
 		return
 	}
 
 	var (
-		apk   ApkDeployer
-		shell ShellDeployer
-		err   error
+		apk     ApkDeployer
+		restart []string
+		err     error
 	)
 
-	log.Printf("deploying update uuid:%s version:%d", u.Notification.UUID, u.Notification.Version)
-	switch u.Notification.UUID {
-	case UUIDApk:
+	if u.logRetry() {
+		u.logf("deploying update uuid:%s version:%d", u.Notification.UUID, u.Notification.Version)
+	}
+	start := time.Now()
+	u.setState(UpdateDeploying)
+	if err = u.save(); err != nil {
+		u.logf("WARNING: failed saving update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+	}
+
+	script, isScript := scriptTypes[u.Notification.UUID]
+	switch {
+	case u.Notification.UUID == UUIDApk:
 		err = u.deployWith(apk)
-	case UUIDShell:
-		err = u.deployWith(shell)
+	case u.Notification.UUID == UUIDConfig:
+		restart, err = u.deployConfig()
+	case isScript:
+		out := NewDeployOutput(u.agent.Config.Deploy.MaxOutput)
+		var sh ShellDeployer
+		if sh, err = u.shellDeployer(script); err == nil {
+			sh.Root, sh.Chmod, sh.Output = u.dataDir(), u.agent.Config.Deploy.ChmodEntrypoints, out
+			err = u.deployWith(sh)
+		}
+		u.recordDeployOutput(out, start, err)
 	default:
-		u.DeployFails++
-		log.Printf("ERROR: Unrecognized uuid:%s", u.Notification.UUID)
-		return
+		err = fmt.Errorf("unrecognized uuid:%s", u.Notification.UUID)
+		u.logf("ERROR: Unrecognized uuid:%s", u.Notification.UUID)
 	}
 
-	if err != nil {
+	switch {
+	case errors.Cause(err) == errUnsafeEntrypoint:
+		// like a digest mismatch, the payload is not retried
+		u.logf("ERROR: unsafe payload of update uuid:%s version:%d - %v",
+			u.Notification.UUID, u.Notification.Version, err)
+		u.agent.audit(AuditUnsafeEntrypoint, &u.Notification, "", err.Error())
+		metrics.Inc("update.verification_failures", "namespace", u.ns.label())
+		u.setState(UpdateFailed)
+		u.Reason = err.Error()
+		u.agent.notifyWebhooks(u, EventDeployFailure, err)
+		metrics.Inc("update.deploys", "result", "failure", "namespace", u.ns.label())
+	case err != nil:
 		u.DeployFails++
-	} else {
+		if u.DeployFails > DeployFailsLimit {
+			if u.DeployFails == DeployFailsLimit+1 {
+				u.logf("ERROR: too many deployment failures:%d uuid:%s version:%d",
+					u.DeployFails, u.Notification.UUID, u.Notification.Version)
+			}
+			u.setState(UpdateFailed)
+		} else {
+			u.setState(UpdateDownloaded)
+		}
+		u.scheduleRetry()
+		u.agent.notifyWebhooks(u, EventDeployFailure, err)
+		metrics.Inc("update.deploys", "result", "failure", "namespace", u.ns.label())
+	default:
 		u.DeployFails = 0
+		u.NextDeploy = time.Time{}
 		u.Deployed = time.Now()
+		u.SeedingFinished = time.Time{}
+		u.setState(UpdateDeployed)
+		u.dropDeltaBase()
+		u.dropPrevious()
+		u.agent.notifyWebhooks(u, EventDeploySuccess, nil)
+		metrics.Inc("update.deploys", "result", "success", "namespace", u.ns.label())
 	}
+	u.PendingReport = &DeployReport{
+		PeerID:          u.agent.ID.String(),
+		UUID:            u.Notification.UUID,
+		Version:         u.Notification.Version,
+		Success:         err == nil,
+		Duration:        time.Since(start).Seconds(),
+		ExitCode:        u.DeployExitCode,
+		SHA256:          u.Notification.SHA256,
+		TraceID:         u.Notification.TraceID,
+		Title:           u.Notification.title(),
+		Timestamp:       time.Now(),
+		RestartRequired: restart,
+	}
+	if err != nil {
+		u.PendingReport.Error = err.Error()
+	}
+	u.agent.events.Add(AgentEvent{
+		Type:    EventDeployAttempt,
+		UUID:    u.Notification.UUID,
+		Version: u.Notification.Version,
+		Trace:   u.Notification.TraceID,
+		Error:   u.PendingReport.Error,
+	})
+	u.reportRetry = time.Time{}
 }
 
 func (u *Update) deployWith(d Deployer) error {
+	u.DeployTimeout = u.deployTimeout()
+	timeout := time.Duration(u.DeployTimeout) * time.Second
 	for _, f := range u.torrent.Files() {
-		script := filepath.Join(u.agent.dataDir, f.Path())
-		log.Printf("executing update shell uuid:%s version:%d file:%s",
-			u.Notification.UUID, u.Notification.Version, script)
-		if err := d.deploy(script, ShellExecutionTimeout*time.Second); err != nil {
-			log.Printf("ERROR: executed update shell with error uuid:%s version:%d file:%s - %v",
-				u.Notification.UUID, u.Notification.Version, f.Path(), err)
+		script, err := safeJoin(u.dataDir(), strings.Split(f.Path(), "/")...)
+		if err != nil {
 			return err
 		}
-		log.Printf("executed update shell script uuid:%s version:%d file:%s",
+		logged := u.logRetry()
+		if logged {
+			u.logf("executing update shell uuid:%s version:%d file:%s timeout:%v",
+				u.Notification.UUID, u.Notification.Version, script, timeout)
+		}
+		if err := d.deploy(script, timeout); err != nil {
+			if logged {
+				u.logf("ERROR: executed update shell with error uuid:%s version:%d file:%s - %v",
+					u.Notification.UUID, u.Notification.Version, f.Path(), err)
+			}
+			return err
+		}
+		u.logf("executed update shell script uuid:%s version:%d file:%s",
 			u.Notification.UUID, u.Notification.Version, f.Path())
 	}
 	return nil
 }
 
+// deployTimeout returns the execution timeout in seconds of the scripts of
+// the update: the timeout of its notification, else the default of the
+// configuration, else ShellExecutionTimeout.
+func (u *Update) deployTimeout() int {
+	switch {
+	case u.Notification.Timeout > 0:
+		return u.Notification.Timeout
+	case u.agent != nil && u.agent.Config.Deploy.DefaultTimeout > 0:
+		return u.agent.Config.Deploy.DefaultTimeout
+	}
+	return ShellExecutionTimeout
+}
+
 // Deployer is an interface of update deployer.
 type Deployer interface {
 	deploy(filename string, d time.Duration) error
 }
 
-// ShellDeployer is an update deployer using system shell.
-type ShellDeployer struct{}
+// ShellDeployer is an update deployer running scripts of the given type,
+// ScriptShell if it is empty. The scripts must stay within Root, the data
+// directory of the update, or the directory of the deployed file if it is
+// empty. They are made accessible only to the agent if Chmod is true. Their
+// output is captured by Output, or discarded if it is nil. They run as User
+// in Dir with the environment Env, or like the agent if they are empty. The
+// payload is copied into Stage, and handed over to User, before it is
+// deployed, unless Stage is empty.
+type ShellDeployer struct {
+	Script ScriptType
+	Root   string
+	Chmod  bool
+	Output *DeployOutput
+	User   *DeployUser
+	Dir    string
+	Env    []string
+	Stage  string
+}
+
+// script returns the type of the scripts of the deployer.
+func (sh ShellDeployer) script() ScriptType {
+	if sh.Script == "" {
+		return ScriptShell
+	}
+	return sh.Script
+}
+
+// root returns the directory the payload of given file must stay within.
+func (sh ShellDeployer) root(filename string) string {
+	if sh.Root == "" {
+		return filepath.Dir(filename)
+	}
+	return sh.Root
+}
 
 func (sh ShellDeployer) deploy(filename string, d time.Duration) error {
+	if _, err := resolveWithin(sh.root(filename), filename); err != nil {
+		return err
+	}
+	sh, filename, err := sh.staged(filename)
+	if err != nil {
+		return err
+	}
 	st, err := os.Stat(filename)
 	if err != nil {
 		return err
@@ -326,26 +1337,77 @@ func (sh ShellDeployer) deploy(filename string, d time.Duration) error {
 	return sh.deployFile(filename, d)
 }
 
-func (ShellDeployer) deployFile(filename string, d time.Duration) error {
-	cmd := exec.Command("/bin/sh", filename)
-	if err := cmd.Start(); err != nil {
+// deployFile runs given script, which is killed with the processes it has
+// spawned once given duration has elapsed. The script is checked by
+// checkEntrypoint, and the resolved path is executed.
+// The output of the script and its exit are recorded by the Output.
+func (sh ShellDeployer) deployFile(filename string, d time.Duration) error {
+	t := sh.script()
+	if err := t.check(filename); err != nil {
+		return err
+	}
+	filename, err := checkEntrypoint(sh.root(filename), filename, sh.Chmod)
+	if err != nil {
+		return err
+	}
+	cmd, err := scriptCommand(t, filename)
+	if err != nil {
+		return err
+	}
+	cmd.Dir, cmd.Env = sh.Dir, sh.Env
+	if sh.User != nil {
+		if err = setCredential(cmd, sh.User); err != nil {
+			return err
+		}
+	}
+	out, err := sh.Output.pipe(cmd)
+	if err != nil {
+		return err
+	}
+	g, err := startProcessGroup(cmd)
+	out.started()
+	if err != nil {
+		out.close(0)
 		return err
 	}
+	defer g.Close()
+	var timedOut int32
 	timer := time.AfterFunc(d, func() {
-		cmd.Process.Kill()
+		atomic.StoreInt32(&timedOut, 1)
+		sh.Output.timedOut()
+		g.Kill()
 	})
-	err := cmd.Wait()
+	err = cmd.Wait()
 	timer.Stop()
+	out.close(deployOutputDrain)
+	sh.Output.exited(err)
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("killed after the timeout of %s: %v", d, err)
+	}
 	return err
 }
 
+// deployZip extracts given archive in a temporary directory, whose path is
+// valid on every platform, and deploys it as a directory, which is the root
+// of its entries.
 func (sh ShellDeployer) deployZip(filename string, d time.Duration) error {
-	dir := path.Join(os.TempDir(), filename)
-	defer os.RemoveAll(dir)
-	_, err := Unzip(filename, dir)
+	if _, err := checkEntrypoint(sh.root(filename), filename, false); err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "p2pupdate-")
 	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, err = Unzip(filename, dir); err != nil {
 		return fmt.Errorf("failed unzipping %s: %v", filename, err)
 	}
+	if sh.User != nil {
+		if err = handOver(sh.User, dir); err != nil {
+			return fmt.Errorf("failed handing %s over to %s: %v", dir, sh.User.Name, err)
+		}
+	}
+	sh.Root = dir
 	return sh.deployDir(dir, d)
 }
 
@@ -371,8 +1433,13 @@ func Unzip(src string, dest string) ([]string, error) {
 		}
 		defer rc.Close()
 
-		// Store filename/path for returning and using later on
+		// Store filename/path for returning and using later on, the
+		// entries escaping the destination are rejected
 		fpath := filepath.Join(dest, f.Name)
+		if rel, err := filepath.Rel(dest, fpath); err != nil || filepath.IsAbs(f.Name) ||
+			rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filenames, fmt.Errorf("illegal file path in archive: %s", f.Name)
+		}
 		filenames = append(filenames, fpath)
 
 		if f.FileInfo().IsDir() {
@@ -400,11 +1467,19 @@ func Unzip(src string, dest string) ([]string, error) {
 	return filenames, nil
 }
 
+// deployDir runs the main script of given directory once all of its entries
+// are checked by checkPayloadDir.
 func (sh ShellDeployer) deployDir(filename string, d time.Duration) error {
-	main := fmt.Sprintf("%s/main.sh", filename)
+	if sh.Root == "" {
+		sh.Root = filename
+	}
+	main := filepath.Join(filename, sh.script().mainScript())
 	if _, err := os.Stat(main); err != nil {
 		return err
 	}
+	if err := checkPayloadDir(sh.Root, filename); err != nil {
+		return err
+	}
 	return sh.deployFile(main, d)
 }
 
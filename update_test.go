@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLoadUpdateFromFileMigratesState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		metadata string
+		state    UpdateState
+		deploy   bool
+	}{
+		{
+			"deployed with unsynchronized clock",
+			`{"notification":{},"deployed":"1970-01-01T00:00:42Z","deploy-fails":0}`,
+			UpdateDeployed, false,
+		},
+		{
+			"deployed",
+			`{"notification":{},"deployed":"2018-05-01T10:00:00Z","deploy-fails":0}`,
+			UpdateDeployed, false,
+		},
+		{
+			"never deployed",
+			`{"notification":{},"deployed":"0001-01-01T00:00:00Z","deploy-fails":2}`,
+			UpdatePending, true,
+		},
+		{
+			"too many failures",
+			`{"notification":{},"deployed":"0001-01-01T00:00:00Z","deploy-fails":6}`,
+			UpdateFailed, false,
+		},
+		{
+			"failed download",
+			`{"notification":{},"state":"failed-download","reason":"download stalled for 1h0m0s"}`,
+			UpdateFailedDownload, false,
+		},
+		{
+			"state wins over timestamp",
+			`{"notification":{},"state":"downloaded","deployed":"2018-05-01T10:00:00Z"}`,
+			UpdateDownloaded, true,
+		},
+		{
+			"deployed state with zero timestamp",
+			`{"notification":{},"state":"deployed","deployed":"0001-01-01T00:00:00Z"}`,
+			UpdateDeployed, false,
+		},
+		{
+			"interrupted deployment",
+			`{"notification":{},"state":"deploying","deploy-fails":1}`,
+			UpdateDownloaded, true,
+		},
+	}
+
+	for i, test := range tests {
+		filename := filepath.Join(dir, string('a'+i))
+		if err = ioutil.WriteFile(filename, []byte(test.metadata), 0640); err != nil {
+			t.Fatal(err)
+		}
+		u, err := LoadUpdateFromFile(filename, nil)
+		if err != nil {
+			t.Errorf("%s: failed loading update: %v", test.name, err)
+			continue
+		}
+		if u.State != test.state {
+			t.Errorf("%s: expected state %s, got %s", test.name, test.state, u.State)
+		}
+		if u.needsDeploy() != test.deploy {
+			t.Errorf("%s: expected needsDeploy %v", test.name, test.deploy)
+		}
+		if u.SchemaVersion != SchemaVersion {
+			t.Errorf("%s: migrated update has schema version %d", test.name, u.SchemaVersion)
+		}
+		if u.State == UpdateDownloaded && u.DeployFails > 0 && u.NextDeploy.IsZero() {
+			t.Errorf("%s: interrupted deployment is not retried later", test.name)
+		}
+	}
+}
+
+func TestLoadUpdateFromFileSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a fixture of every schema version, and of a future one
+	fixtures := []struct {
+		metadata  string
+		supported bool
+	}{
+		{`{"notification":{"UUID":"a","Version":1},"state":"deployed"}`, true},
+		{`{"notification":{"UUID":"a","Version":1,"SchemaVersion":1},"state":"deployed","schema-version":1}`, true},
+		{`{"notification":{"UUID":"a","Version":1},"state":"deployed","schema-version":2}`, false},
+	}
+	for i, f := range fixtures {
+		filename := filepath.Join(dir, string('a'+i))
+		if err = ioutil.WriteFile(filename, []byte(f.metadata), 0640); err != nil {
+			t.Fatal(err)
+		}
+		u, err := LoadUpdateFromFile(filename, nil)
+		if !f.supported {
+			if errors.Cause(err) != errSchemaUnsupported {
+				t.Errorf("%s: expected unsupported schema, got %v", f.metadata, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed loading update: %v", f.metadata, err)
+		} else if u.State != UpdateDeployed || u.SchemaVersion != SchemaVersion {
+			t.Errorf("%s: wrong update state:%s schema:%d", f.metadata, u.State, u.SchemaVersion)
+		} else if err = checkSchema(u.Notification.SchemaVersion); err != nil {
+			t.Errorf("%s: notification schema is refused: %v", f.metadata, err)
+		}
+	}
+	if errors.Cause(checkSchema(SchemaVersion+1)) != errSchemaUnsupported || checkSchema(-1) == nil {
+		t.Error("schema versions outside the range must be refused")
+	}
+}
+
+func TestUpdateFlushCoalescesSaves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := &Agent{
+		Config:      &Config{SaveInterval: 3600},
+		updates:     make(map[string]*Update),
+		dataDir:     filepath.Join(dir, "update"),
+		metadataDir: dir,
+	}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 1}, a)
+	a.updates[UUIDShell] = u
+	key := metricKey("update.metadata_writes", []string{"namespace", u.namespace().label()})
+	writes := func() int64 { return metrics.Counters()[key] }
+	start := writes()
+
+	// a busy monitor changes the metadata on every tick
+	states := []UpdateState{UpdateDownloading, UpdateWaiting}
+	for tick := 0; tick < 100; tick++ {
+		u.Lock()
+		u.State = states[tick%len(states)]
+		u.Reason = fmt.Sprintf("tick %d", tick)
+		u.dirty = true
+		u.flush(false)
+		u.Unlock()
+	}
+	if n := writes() - start; n != 1 {
+		t.Errorf("busy monitor wrote the metadata %d times, expected once", n)
+	}
+
+	// a critical change is written immediately
+	u.Lock()
+	u.State = UpdateDeployed
+	u.dirty = true
+	u.flush(true)
+	u.Unlock()
+	if n := writes() - start; n != 2 {
+		t.Errorf("critical change is not written, %d writes", n)
+	}
+	u.Lock()
+	u.flush(true)
+	u.Unlock()
+	if n := writes() - start; n != 2 {
+		t.Errorf("unchanged metadata are written, %d writes", n)
+	}
+
+	// the shutdown flushes the pending changes
+	u.Lock()
+	u.Reason = "pending"
+	u.dirty = true
+	u.flush(false)
+	u.Unlock()
+	a.flushUpdates()
+	if loaded, err := LoadUpdateFromFile(u.MetadataFilename(), a); err != nil || loaded.Reason != "pending" {
+		t.Errorf("pending change is not flushed on shutdown: %v", err)
+	}
+
+	// a pending change is never written once the update is deleted
+	u.Lock()
+	u.dirty = true
+	u.Unlock()
+	if err = u.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	a.flushUpdates()
+	if _, err = os.Stat(u.MetadataFilename()); !os.IsNotExist(err) {
+		t.Errorf("metadata file of a deleted update is written again: %v", err)
+	}
+}
+
+func TestDeployTimeout(t *testing.T) {
+	a := &Agent{Config: &Config{}}
+	u := NewUpdate(Notification{UUID: UUIDShell, Version: 1}, a)
+	if d := u.deployTimeout(); d != ShellExecutionTimeout {
+		t.Errorf("expected the timeout of %d seconds, got %d", ShellExecutionTimeout, d)
+	}
+	a.Config.Deploy.DefaultTimeout = 1800
+	if d := u.deployTimeout(); d != 1800 {
+		t.Errorf("expected the timeout of the configuration, got %d", d)
+	}
+	u.Notification.Timeout = 30
+	if d := u.deployTimeout(); d != 30 {
+		t.Errorf("expected the timeout of the notification, got %d", d)
+	}
+	u.Notification.Timeout = -1
+	if err := u.Notification.validate(); err == nil {
+		t.Error("negative timeout is accepted")
+	}
+}
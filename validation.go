@@ -0,0 +1,182 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// The reasons of the validation failures of the STUN messages.
+const (
+	ValidationMalformed   = "malformed" // not a STUN message or failed decoding
+	ValidationType        = "type"
+	ValidationUsername    = "username"
+	ValidationFingerprint = "fingerprint"
+	ValidationIntegrity   = "integrity"
+	ValidationSignature   = "signature"  // not signed by the key of the peer
+	ValidationOversized   = "oversized"  // datagram or attribute exceeding the limits
+	ValidationAttributes  = "attributes" // too many attributes
+	ValidationPanic       = "panic"      // recovered panic while processing
+	ValidationOther       = "other"
+)
+
+// validationMaxSources is the number of distinct sources whose failures are
+// counted separately, the failures of the other sources are counted under
+// validationOtherSource.
+const validationMaxSources = 256
+
+const validationOtherSource = "other"
+
+// ValidationError is the error of a message that failed validation, with the
+// reason of the failure.
+type ValidationError struct {
+	Reason string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+// validationReason returns the reason of given validation error.
+func validationReason(err error) string {
+	if e, ok := err.(*ValidationError); ok {
+		return e.Reason
+	}
+	return ValidationOther
+}
+
+type validationKey struct {
+	reason, source string
+}
+
+// ValidationOffender is the number of validation failures of a source, by
+// reason.
+type ValidationOffender struct {
+	Source   string            `json:"source"`
+	Failures uint64            `json:"failures"`
+	Reasons  map[string]uint64 `json:"reasons"`
+}
+
+// ValidationStats counts the validation failures of the messages by reason
+// and source, i.e. a PeerID or an address. A failure is counted by an atomic
+// increment once its source is tracked. The metric of given name counts the
+// failures by reason. It is safe for concurrent use, and a nil
+// ValidationStats counts nothing.
+type ValidationStats struct {
+	sync.RWMutex
+	name    string
+	counts  map[validationKey]*uint64
+	sources map[string]struct{}
+}
+
+// NewValidationStats returns empty ValidationStats counted by the metric of
+// given name.
+func NewValidationStats(name string) *ValidationStats {
+	return &ValidationStats{
+		name:    name,
+		counts:  make(map[validationKey]*uint64),
+		sources: make(map[string]struct{}),
+	}
+}
+
+// Failure counts the validation failure of a message of given source, which
+// failed with given error.
+func (vs *ValidationStats) Failure(source string, err error) {
+	if vs == nil {
+		return
+	}
+	k := validationKey{validationReason(err), source}
+	metrics.Inc(vs.name, "reason", k.reason)
+	vs.RLock()
+	c, ok := vs.counts[k]
+	if !ok && len(vs.sources) >= validationMaxSources {
+		if _, tracked := vs.sources[source]; !tracked {
+			c, ok = vs.counts[validationKey{k.reason, validationOtherSource}]
+		}
+	}
+	vs.RUnlock()
+	if !ok {
+		c = vs.counter(k)
+	}
+	atomic.AddUint64(c, 1)
+}
+
+// counter returns the counter of given key, which is created and its source
+// tracked unless too many sources are.
+func (vs *ValidationStats) counter(k validationKey) *uint64 {
+	vs.Lock()
+	defer vs.Unlock()
+	if _, tracked := vs.sources[k.source]; !tracked {
+		if len(vs.sources) >= validationMaxSources {
+			k.source = validationOtherSource
+		} else {
+			vs.sources[k.source] = struct{}{}
+		}
+	}
+	c, ok := vs.counts[k]
+	if !ok {
+		c = new(uint64)
+		vs.counts[k] = c
+	}
+	return c
+}
+
+// Offenders returns the sources by descending number of failures, at most n
+// of them if n is positive.
+func (vs *ValidationStats) Offenders(n int) []ValidationOffender {
+	if vs == nil {
+		return []ValidationOffender{}
+	}
+	bySource := make(map[string]*ValidationOffender)
+	vs.RLock()
+	for k, c := range vs.counts {
+		o, ok := bySource[k.source]
+		if !ok {
+			o = &ValidationOffender{Source: k.source, Reasons: make(map[string]uint64)}
+			bySource[k.source] = o
+		}
+		count := atomic.LoadUint64(c)
+		o.Reasons[k.reason] += count
+		o.Failures += count
+	}
+	vs.RUnlock()
+	offenders := make([]ValidationOffender, 0, len(bySource))
+	for _, o := range bySource {
+		offenders = append(offenders, *o)
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].Failures != offenders[j].Failures {
+			return offenders[i].Failures > offenders[j].Failures
+		}
+		return offenders[i].Source < offenders[j].Source
+	})
+	if n > 0 && len(offenders) > n {
+		offenders = offenders[:n]
+	}
+	return offenders
+}
+
+// writeOffenders writes given offenders as a table, with their failures by
+// reason.
+func writeOffenders(w io.Writer, offenders []ValidationOffender) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tFAILURES\tREASONS")
+	for _, o := range offenders {
+		reasons := make([]string, 0, len(o.Reasons))
+		for r, n := range o.Reasons {
+			reasons = append(reasons, fmt.Sprintf("%s:%d", r, n))
+		}
+		sort.Strings(reasons)
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", o.Source, o.Failures, strings.Join(reasons, " "))
+	}
+	return tw.Flush()
+}
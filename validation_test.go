@@ -0,0 +1,112 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gortc/stun"
+)
+
+func TestValidationReason(t *testing.T) {
+	pid := PeerID{1}
+	valid := stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid,
+		stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint)
+	if err := validateMessage(valid, nil, defaultStunPassword); err != nil {
+		t.Fatal(err)
+	}
+	for reason, m := range map[string]*stun.Message{
+		ValidationType: valid,
+		ValidationUsername: stun.MustBuild(stun.TransactionID, stunProgressIndication,
+			stun.NewShortTermIntegrity(defaultStunPassword), stun.Fingerprint),
+		ValidationFingerprint: stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid,
+			stun.NewShortTermIntegrity(defaultStunPassword)),
+		ValidationIntegrity: stun.MustBuild(stun.TransactionID, stunProgressIndication, &pid,
+			stun.NewShortTermIntegrity("outdated"), stun.Fingerprint),
+	} {
+		var typ *stun.MessageType
+		if reason == ValidationType {
+			typ = &stun.BindingSuccess
+		}
+		if got := validationReason(validateMessage(m, typ, defaultStunPassword)); got != reason {
+			t.Errorf("reason is %s, expected %s", got, reason)
+		}
+	}
+	if got := validationReason(errors.New("failure")); got != ValidationOther {
+		t.Errorf("reason of an untyped error is %s", got)
+	}
+}
+
+func TestValidationStats(t *testing.T) {
+	vs := NewValidationStats("test.validation_failures")
+	integrity := &ValidationError{ValidationIntegrity, errors.New("integrity")}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				vs.Failure("peer:a", integrity)
+			}
+		}()
+	}
+	wg.Wait()
+	vs.Failure("peer:a", &ValidationError{ValidationFingerprint, errors.New("fingerprint")})
+	vs.Failure("addr:10.0.0.1", integrity)
+	vs.Failure("addr:10.0.0.2", integrity)
+
+	offenders := vs.Offenders(2)
+	if len(offenders) != 2 {
+		t.Fatalf("unexpected offenders %v", offenders)
+	}
+	if o := offenders[0]; o.Source != "peer:a" || o.Failures != 801 ||
+		o.Reasons[ValidationIntegrity] != 800 || o.Reasons[ValidationFingerprint] != 1 {
+		t.Errorf("unexpected top offender %+v", o)
+	}
+	if offenders[1].Source != "addr:10.0.0.1" {
+		t.Errorf("offenders with the same failures are not sorted by source: %v", offenders)
+	}
+
+	// the sources beyond the limit are aggregated
+	for i := 0; i < validationMaxSources+10; i++ {
+		vs.Failure(fmt.Sprintf("addr:192.168.0.%d", i), integrity)
+	}
+	offenders = vs.Offenders(0)
+	if len(offenders) != validationMaxSources+1 {
+		t.Fatalf("%d sources are tracked, expected %d", len(offenders), validationMaxSources+1)
+	}
+	var other uint64
+	for _, o := range offenders {
+		if o.Source == validationOtherSource {
+			other = o.Failures
+		}
+	}
+	if other != 13 {
+		t.Errorf("%d failures are aggregated, expected 13", other)
+	}
+	vs.Failure("peer:a", integrity)
+	if o := vs.Offenders(1)[0]; o.Failures != 802 {
+		t.Errorf("tracked source is not counted beyond the limit: %+v", o)
+	}
+
+	var b bytes.Buffer
+	if err := writeOffenders(&b, vs.Offenders(1)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "fingerprint:1 integrity:801") {
+		t.Errorf("unexpected table:\n%s", b.String())
+	}
+
+	var nilStats *ValidationStats
+	nilStats.Failure("peer:a", integrity)
+	if len(nilStats.Offenders(0)) != 0 {
+		t.Error("nil stats has offenders")
+	}
+}
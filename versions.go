@@ -0,0 +1,139 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// VersionAuto is the version of submit that is determined from the previous
+// submissions.
+const VersionAuto = "auto"
+
+// VersionRegistry records the last submitted version of each UUID in a local
+// file, so that submit determines the next version. The file is locked until
+// the registry is closed, hence the concurrent submissions from the same
+// machine get distinct versions.
+type VersionRegistry struct {
+	Versions map[string]uint64
+
+	file *os.File
+}
+
+// DefaultVersionRegistry returns the default registry file of the user.
+func DefaultVersionRegistry(homeDir string) string {
+	return filepath.Join(homeDir, ".p2pupdate", "versions.json")
+}
+
+// OpenVersionRegistry opens and locks the registry of given file, which is
+// created if it does not exist.
+func OpenVersionRegistry(filename string) (*VersionRegistry, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "failed locking version registry %s", filename)
+	}
+	r := &VersionRegistry{
+		Versions: make(map[string]uint64),
+		file:     f,
+	}
+	if err = json.NewDecoder(f).Decode(&r.Versions); err != nil && err != io.EOF {
+		r.Close()
+		return nil, errors.Wrapf(err, "failed reading version registry %s", filename)
+	}
+	return r, nil
+}
+
+// Next returns the version following the last submitted one of given UUID.
+// The first version is the current Unix time, as the default version before
+// the registry, hence it is not a downgrade of a version submitted without
+// the registry.
+func (r *VersionRegistry) Next(uuid string, now time.Time) uint64 {
+	if v, ok := r.Versions[uuid]; ok {
+		return v + 1
+	}
+	return uint64(now.Unix())
+}
+
+// Check returns an error if given version of the UUID is lower than the last
+// submitted one, unless the downgrade is allowed. The same version may be
+// submitted again, e.g. to widen its rollout.
+func (r *VersionRegistry) Check(uuid string, version uint64, allowDowngrade bool) error {
+	if last, ok := r.Versions[uuid]; ok && version < last && !allowDowngrade {
+		return fmt.Errorf("version %d of uuid:%s is lower than the last submitted version %d,"+
+			" which the agents reject (use --allow-downgrade to submit it anyway)", version, uuid, last)
+	}
+	return nil
+}
+
+// Record records given version as the last submitted one of the UUID.
+func (r *VersionRegistry) Record(uuid string, version uint64) error {
+	r.Versions[uuid] = version
+	if err := r.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := json.NewEncoder(r.file).Encode(r.Versions); err != nil {
+		return err
+	}
+	return r.file.Sync()
+}
+
+// Close unlocks and closes the registry.
+func (r *VersionRegistry) Close() error {
+	unlockFile(r.file)
+	return r.file.Close()
+}
+
+// resolveVersion returns the version of a submission given by --version,
+// which is a number, "auto" or empty. An empty version is automatic if the
+// registry exists, otherwise it is the current Unix time as before the
+// registry. The registry is returned locked unless it is not used, and the
+// caller must record the version once submitted, then close it.
+func resolveVersion(arg, uuid, registry string, allowDowngrade bool, now time.Time) (uint64, *VersionRegistry, error) {
+	if len(arg) == 0 {
+		if _, err := os.Stat(registry); os.IsNotExist(err) {
+			return uint64(now.Unix()), nil, nil
+		}
+		arg = VersionAuto
+	}
+	var version uint64
+	if arg != VersionAuto {
+		var err error
+		if version, err = strconv.ParseUint(arg, 10, 64); err != nil {
+			return 0, nil, fmt.Errorf("invalid version %s, expected a number or %s", arg, VersionAuto)
+		} else if version == 0 {
+			version = uint64(now.Unix())
+		}
+	}
+
+	r, err := OpenVersionRegistry(registry)
+	if err != nil {
+		return 0, nil, err
+	}
+	if arg == VersionAuto {
+		version = r.Next(uuid, now)
+	} else if err = r.Check(uuid, version, allowDowngrade); err != nil {
+		r.Close()
+		return 0, nil, err
+	}
+	return version, r, nil
+}
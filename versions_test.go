@@ -0,0 +1,103 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolveVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "versions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry := filepath.Join(dir, "p2pupdate", "versions.json")
+	now := time.Unix(1500000000, 0)
+
+	// without registry, the default version is the current time
+	v, r, err := resolveVersion("", UUIDShell, registry, false, now)
+	if err != nil || r != nil || v != uint64(now.Unix()) {
+		t.Fatalf("default version without registry: %d %v", v, err)
+	}
+	if _, err = os.Stat(registry); !os.IsNotExist(err) {
+		t.Fatal("registry is created by the default version")
+	}
+
+	// an explicit version creates the registry
+	if v, r, err = resolveVersion("5", UUIDShell, registry, false, now); err != nil || v != 5 {
+		t.Fatalf("explicit version: %d %v", v, err)
+	}
+	if err = r.Record(UUIDShell, v); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	for _, test := range []struct {
+		arg            string
+		uuid           string
+		allowDowngrade bool
+		version        uint64
+		ok             bool
+	}{
+		{"", UUIDShell, false, 6, true},
+		{"auto", UUIDShell, false, 6, true},
+		{"auto", UUIDApk, false, uint64(now.Unix()), true},
+		{"5", UUIDShell, false, 5, true},
+		{"4", UUIDShell, false, 0, false},
+		{"4", UUIDShell, true, 4, true},
+		{"x", UUIDShell, false, 0, false},
+	} {
+		v, r, err := resolveVersion(test.arg, test.uuid, registry, test.allowDowngrade, now)
+		if (err == nil) != test.ok || v != test.version {
+			t.Errorf("version '%s' of %s: %d %v", test.arg, test.uuid, v, err)
+		}
+		if r != nil {
+			r.Close()
+		}
+	}
+
+	// the concurrent submissions get distinct versions
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		versions = make(map[uint64]bool)
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, r, err := resolveVersion(VersionAuto, UUIDShell, registry, false, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer r.Close()
+			if err = r.Record(UUIDShell, v); err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			versions[v] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if len(versions) != 10 {
+		t.Errorf("concurrent submissions got %d distinct versions", len(versions))
+	}
+	r, err = OpenVersionRegistry(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Versions[UUIDShell] != 15 {
+		t.Errorf("last version is %d instead of 15", r.Versions[UUIDShell])
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Update lifecycle events that can be subscribed by webhooks.
+const (
+	EventUpdateReceived   = "update_received"
+	EventDownloadComplete = "download_complete"
+	EventDownloadFailure  = "download_failure"
+	EventDeploySuccess    = "deploy_success"
+	EventDeployFailure    = "deploy_failure"
+	EventUpdateDeleted    = "update_deleted"
+)
+
+const (
+	webhookQueueSize       = 64 // of each webhook
+	webhookDefaultTimeout  = 5  // in seconds
+	webhookDefaultRetries  = 3
+	webhookBackoff         = time.Second // before the first retry, doubled on each retry
+	webhookSignatureHeader = "X-P2PUpdate-Signature"
+)
+
+// WebhookConfig holds configurations of a webhook.
+type WebhookConfig struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+
+	// Secret is used to compute HMAC-SHA256 signature of the payload, which
+	// is sent in header X-P2PUpdate-Signature. No signature if it is empty.
+	Secret string `json:"secret,omitempty"`
+
+	Timeout int `json:"timeout"` // in seconds
+	Retries int `json:"retries"`
+}
+
+func (wc *WebhookConfig) subscribes(event string) bool {
+	for _, e := range wc.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON document posted to webhooks.
+type WebhookPayload struct {
+	PeerID    string    `json:"peer-id"`
+	UUID      string    `json:"uuid"`
+	Version   uint64    `json:"version"`
+	TraceID   string    `json:"trace-id,omitempty"`
+	Title     string    `json:"title,omitempty"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// webhook is a configured webhook with the queue of its payloads.
+type webhook struct {
+	WebhookConfig
+	queue chan []byte
+}
+
+// Webhooks delivers update lifecycle events to the configured webhooks. Each
+// webhook has its own queue and delivery goroutine, hence the deliveries
+// never block the update lifecycle, and a slow or unreachable webhook does
+// not delay the others.
+type Webhooks struct {
+	client  *fasthttp.Client
+	hooks   []*webhook
+	backoff time.Duration
+	debug   bool // logs the successful deliveries
+	quit    chan struct{}
+}
+
+// NewWebhooks returns a Webhooks instance of given configurations, and starts
+// the delivery goroutine of each webhook. The payloads are posted with given
+// client, and the successful deliveries are only logged if debug is true.
+func NewWebhooks(cfgs []WebhookConfig, client *fasthttp.Client, debug bool) *Webhooks {
+	w := &Webhooks{
+		client:  client,
+		backoff: webhookBackoff,
+		debug:   debug,
+		quit:    make(chan struct{}),
+	}
+	for _, cfg := range cfgs {
+		if cfg.Timeout <= 0 {
+			cfg.Timeout = webhookDefaultTimeout
+		}
+		if cfg.Retries <= 0 {
+			cfg.Retries = webhookDefaultRetries
+		}
+		hook := &webhook{WebhookConfig: cfg, queue: make(chan []byte, webhookQueueSize)}
+		w.hooks = append(w.hooks, hook)
+		go w.run(hook)
+	}
+	return w
+}
+
+// Notify queues given payload to every webhook subscribing its event. The
+// payload is dropped for a webhook whose queue is full.
+func (w *Webhooks) Notify(p WebhookPayload) {
+	if w == nil || len(w.hooks) == 0 {
+		return
+	}
+	var body []byte
+	for _, hook := range w.hooks {
+		if !hook.subscribes(p.Event) {
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(p); err != nil {
+				log.Printf("webhook - failed encoding payload: %v", err)
+				return
+			}
+		}
+		select {
+		case hook.queue <- body:
+		default:
+			log.Printf("webhook - queue is full, dropped event %s to %s", p.Event, hook.URL)
+			metrics.Inc("webhook.deliveries", "result", "dropped")
+		}
+	}
+}
+
+// Stop stops the delivery goroutines.
+func (w *Webhooks) Stop() {
+	if w != nil {
+		close(w.quit)
+	}
+}
+
+// run delivers the payloads queued for given webhook one after the other.
+func (w *Webhooks) run(hook *webhook) {
+	for {
+		select {
+		case body := <-hook.queue:
+			w.deliver(hook, body)
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Webhooks) deliver(hook *webhook, body []byte) {
+	backoff := w.backoff
+	for attempt := 1; attempt <= hook.Retries; attempt++ {
+		err := postWebhook(w.client, &hook.WebhookConfig, body)
+		if err == nil {
+			if w.debug {
+				log.Printf("webhook - delivered to %s (attempt %d)", hook.URL, attempt)
+			}
+			metrics.Inc("webhook.deliveries", "result", "success")
+			return
+		}
+		log.Printf("webhook - failed delivering to %s (attempt %d/%d): %v",
+			hook.URL, attempt, hook.Retries, err)
+		metrics.Inc("webhook.deliveries", "result", "error")
+		select {
+		case <-time.After(backoff):
+		case <-w.quit:
+			return
+		}
+		backoff *= 2
+	}
+	metrics.Inc("webhook.deliveries", "result", "failed")
+}
+
+// hmacSignature returns the HMAC-SHA256 signature of given body keyed by the
+// secret, in the format of the signature header.
+func hmacSignature(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(client *fasthttp.Client, hook *WebhookConfig, body []byte) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI(hook.URL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	if len(hook.Secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, hmacSignature(body, hook.Secret))
+	}
+	req.SetBody(body)
+
+	timeout := time.Duration(hook.Timeout) * time.Second
+	if err := client.DoTimeout(req, res, timeout); err != nil {
+		return err
+	}
+	if code := res.StatusCode(); code < 200 || code > 299 {
+		return fmt.Errorf("status code: %d", code)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 University of Glasgow.
+// Use of this source code is governed by an Apache
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type webhookDelivery struct {
+	body      []byte
+	signature string
+	time      time.Time
+}
+
+// webhookRecorder records the payloads posted to it. It fails the first
+// requests if failures is set, and blocks the requests until release is
+// closed if it is set.
+type webhookRecorder struct {
+	sync.Mutex
+	deliveries []webhookDelivery
+	failures   int
+	release    chan struct{}
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.Lock()
+	rec.deliveries = append(rec.deliveries,
+		webhookDelivery{body, r.Header.Get(webhookSignatureHeader), time.Now()})
+	release := rec.release
+	fail := rec.failures > 0
+	if fail {
+		rec.failures--
+	}
+	rec.Unlock()
+	if release != nil {
+		<-release
+	}
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// wait waits until n payloads have been posted, and returns them.
+func (rec *webhookRecorder) wait(t *testing.T, n int) []webhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec.Lock()
+		deliveries := append([]webhookDelivery(nil), rec.deliveries...)
+		rec.Unlock()
+		if len(deliveries) >= n {
+			return deliveries
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d payloads posted, expected %d", len(deliveries), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reset forgets the posted payloads, and fails given number of requests.
+func (rec *webhookRecorder) reset(failures int) {
+	rec.Lock()
+	defer rec.Unlock()
+	rec.deliveries = nil
+	rec.failures = failures
+}
+
+func TestWebhooks(t *testing.T) {
+	rec := new(webhookRecorder)
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+	const backoff = 50 * time.Millisecond
+
+	w := NewWebhooks([]WebhookConfig{{URL: srv.URL, Events: []string{EventDeploySuccess}, Secret: "secret"}},
+		&fasthttp.Client{}, false)
+	w.backoff = backoff
+	defer w.Stop()
+
+	// only the subscribed events are posted, with the HMAC of the payload
+	w.Notify(WebhookPayload{UUID: "u1", Event: EventUpdateReceived})
+	w.Notify(WebhookPayload{UUID: "u1", Event: EventDeploySuccess})
+	d := rec.wait(t, 1)
+	time.Sleep(2 * backoff)
+	if d = rec.wait(t, 1); len(d) != 1 {
+		t.Fatalf("%d payloads posted, expected 1", len(d))
+	}
+	var p WebhookPayload
+	if err := json.Unmarshal(d[0].body, &p); err != nil || p.Event != EventDeploySuccess || p.UUID != "u1" {
+		t.Errorf("unexpected payload %s: %v", d[0].body, err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(d[0].body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); d[0].signature != expected {
+		t.Errorf("signature %q, expected %q", d[0].signature, expected)
+	}
+
+	// a failed delivery is retried with an exponential backoff
+	rec.reset(2)
+	w.Notify(WebhookPayload{UUID: "u2", Event: EventDeploySuccess})
+	d = rec.wait(t, 3)
+	if string(d[0].body) != string(d[2].body) {
+		t.Error("the retries do not post the same payload")
+	}
+	if gap := d[1].time.Sub(d[0].time); gap < backoff {
+		t.Errorf("retried after %v", gap)
+	}
+	if gap := d[2].time.Sub(d[1].time); gap < 2*backoff {
+		t.Errorf("retried again after %v", gap)
+	}
+
+	// the payload is given up after the retries
+	rec.reset(webhookDefaultRetries + 1)
+	w.Notify(WebhookPayload{UUID: "u3", Event: EventDeploySuccess})
+	rec.wait(t, webhookDefaultRetries)
+	time.Sleep(8 * backoff)
+	if d = rec.wait(t, 0); len(d) != webhookDefaultRetries {
+		t.Errorf("%d attempts, expected %d", len(d), webhookDefaultRetries)
+	}
+}
+
+func TestWebhooksQueues(t *testing.T) {
+	slow := &webhookRecorder{release: make(chan struct{})}
+	slowSrv := httptest.NewServer(slow)
+	defer slowSrv.Close()
+	fast := new(webhookRecorder)
+	fastSrv := httptest.NewServer(fast)
+	defer fastSrv.Close()
+	release := func() {
+		slow.Lock()
+		defer slow.Unlock()
+		if slow.release != nil {
+			close(slow.release)
+			slow.release = nil
+		}
+	}
+	defer release()
+
+	events := []string{EventDeploySuccess}
+	w := NewWebhooks([]WebhookConfig{
+		{URL: slowSrv.URL, Events: events, Timeout: 30},
+		{URL: fastSrv.URL, Events: events},
+	}, &fasthttp.Client{}, false)
+	defer w.Stop()
+
+	// a blocked webhook does not delay the others, and its payloads are
+	// dropped once its queue is full
+	w.Notify(WebhookPayload{UUID: "u0", Event: EventDeploySuccess})
+	slow.wait(t, 1)
+	for i := 0; i < webhookQueueSize+1; i++ {
+		w.Notify(WebhookPayload{UUID: "u1", Event: EventDeploySuccess})
+	}
+	fast.wait(t, webhookQueueSize+2)
+	release()
+	slow.wait(t, webhookQueueSize+1)
+	time.Sleep(100 * time.Millisecond)
+	if d := slow.wait(t, 0); len(d) != webhookQueueSize+1 {
+		t.Errorf("%d payloads posted to the blocked webhook, expected %d", len(d), webhookQueueSize+1)
+	}
+}